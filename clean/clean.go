@@ -0,0 +1,162 @@
+// Package clean removes junk files from a directory using filters without
+// scanning it into a database or involving a repository. This is the same
+// cleanup that scan -cleanup and push -cleanup do as a side effect.
+package clean
+
+import (
+	"context"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/traverse"
+	"io/fs"
+	"path/filepath"
+)
+
+type Options func(*Clean)
+
+type Clean struct {
+	ctx     context.Context
+	dir     string
+	filters []*filter.Filter
+	noOp    bool
+	pruned  bool
+	ui      misc.UI
+}
+
+// Result describes what Run did.
+type Result struct {
+	// Junk lists the junk files that were removed or, with WithNoOp, that would
+	// be removed, in lexical order by path.
+	Junk []*fileinfo.FileInfo
+	// JunkSize is the total size of the files in Junk.
+	JunkSize int64
+	// Pruned lists the directories excluded by prune rules when WithPruned is
+	// given.
+	Pruned []*Pruned
+}
+
+// Pruned gives the disk usage of a pruned directory.
+type Pruned struct {
+	Path string
+	// Files and Size are the number and total size of the regular files below
+	// the directory.
+	Files int64
+	Size  int64
+}
+
+func New(dir string, options ...Options) *Clean {
+	c := &Clean{
+		ctx: context.Background(),
+		dir: dir,
+		ui:  misc.ConsoleUI{},
+	}
+	for _, fn := range options {
+		fn(c)
+	}
+	return c
+}
+
+func WithFilters(filters []*filter.Filter) Options {
+	return func(c *Clean) {
+		c.filters = filters
+	}
+}
+
+// WithNoOp causes junk files to be reported without being removed.
+func WithNoOp(noOp bool) Options {
+	return func(c *Clean) {
+		c.noOp = noOp
+	}
+}
+
+// WithPruned causes the disk usage of each pruned directory to be measured.
+// Their contents are otherwise never visited, so this can take as long as
+// scanning them would.
+func WithPruned(pruned bool) Options {
+	return func(c *Clean) {
+		c.pruned = pruned
+	}
+}
+
+// WithUI sets the UI used for messages. The default is misc.ConsoleUI.
+func WithUI(ui misc.UI) Options {
+	return func(c *Clean) {
+		c.ui = ui
+	}
+}
+
+// WithContext sets a context that stops the traversal when canceled.
+func WithContext(ctx context.Context) Options {
+	return func(c *Clean) {
+		c.ctx = ctx
+	}
+}
+
+// Run traverses the directory, removing junk files unless WithNoOp was given.
+// Problems with individual files and directories are reported through the UI
+// without stopping the traversal.
+func (c *Clean) Run() (*Result, error) {
+	tr, err := traverse.New(
+		c.dir,
+		traverse.WithFilters(c.filters),
+		traverse.WithCleanup(!c.noOp),
+		traverse.WithContext(c.ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := tr.Traverse(
+		func(msg string) {
+			c.ui.Message("%s", msg)
+		},
+		func(err error) {
+			c.ui.Message("%v", err)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	err = tree.WalkExcluded(func(info *fileinfo.FileInfo, group filter.Group) error {
+		switch {
+		case group == filter.Junk && info.FileType == fileinfo.TypeFile:
+			if c.noOp {
+				c.ui.Message("would remove %s", info.Path)
+			}
+			result.Junk = append(result.Junk, info)
+			result.JunkSize += info.Size
+		case group == filter.Prune && info.FileType == fileinfo.TypeDirectory && c.pruned:
+			result.Pruned = append(result.Pruned, c.diskUsage(info.Path))
+		}
+		return c.ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// diskUsage measures the regular files below the directory at relPath.
+func (c *Clean) diskUsage(relPath string) *Pruned {
+	p := &Pruned{Path: relPath}
+	_ = filepath.WalkDir(filepath.Join(c.dir, relPath), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			c.ui.Message("%v", err)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// TEST: NOT COVERED. The file disappeared while it was being measured.
+			c.ui.Message("%v", err)
+			return nil
+		}
+		p.Files++
+		p.Size += info.Size()
+		return nil
+	})
+	return p
+}
@@ -0,0 +1,142 @@
+package clean_test
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/clean"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/testutil"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// recordingUI is a misc.UI that records messages. Traversal reports
+// notifications and errors from different goroutines.
+type recordingUI struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (u *recordingUI) Message(format string, args ...any) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.messages = append(u.messages, fmt.Sprintf(format, args...))
+}
+
+func (u *recordingUI) Prompt(string) bool {
+	return false
+}
+
+func (u *recordingUI) Output() io.Writer {
+	return io.Discard
+}
+
+func TestClean(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	for path, contents := range map[string]string{
+		"a/keep":          "keep",
+		"a/file~":         "junk",
+		"a/b/other~":      "more junk",
+		"a/b/keep":        "keep",
+		"build/out.o":     "pruned",
+		"build/sub/x.o":   "also pruned",
+		"build/sub/old~":  "junk in a pruned directory stays",
+		"cache/data":      "pruned",
+		"excluded/file~":  "junk in an excluded directory",
+		"excluded/normal": "excluded",
+	} {
+		testutil.Check(t, os.MkdirAll(filepath.Dir(j(path)), 0o777))
+		testutil.Check(t, os.WriteFile(j(path), []byte(contents), 0o666))
+	}
+	f := filter.New()
+	testutil.Check(t, f.SetJunk("~$"))
+	f.AddPath(filter.Prune, "build")
+	f.AddPath(filter.Prune, "cache")
+	f.AddPath(filter.Exclude, "excluded")
+	filters := []*filter.Filter{f}
+
+	exists := func(path string) bool {
+		_, err := os.Lstat(j(path))
+		return err == nil
+	}
+	junkPaths := func(r *clean.Result) []string {
+		var paths []string
+		for _, x := range r.Junk {
+			paths = append(paths, x.Path)
+		}
+		return paths
+	}
+	expJunk := []string{"a/b/other~", "a/file~", "excluded/file~"}
+
+	// With no-op, junk is reported but not removed.
+	ui := &recordingUI{}
+	result, err := clean.New(tmp, clean.WithFilters(filters), clean.WithNoOp(true), clean.WithUI(ui)).Run()
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(junkPaths(result), expJunk) || result.JunkSize != 42 {
+		t.Errorf("wrong junk: %v, %d", junkPaths(result), result.JunkSize)
+	}
+	if len(result.Pruned) != 0 {
+		t.Errorf("pruned directories measured without WithPruned")
+	}
+	slices.Sort(ui.messages)
+	if !reflect.DeepEqual(ui.messages, []string{
+		"would remove a/b/other~",
+		"would remove a/file~",
+		"would remove excluded/file~",
+	}) {
+		t.Errorf("wrong messages: %q", ui.messages)
+	}
+	if !exists("a/file~") {
+		t.Errorf("junk removed with no-op")
+	}
+
+	ui = &recordingUI{}
+	result, err = clean.New(tmp, clean.WithFilters(filters), clean.WithPruned(true), clean.WithUI(ui)).Run()
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(junkPaths(result), expJunk) {
+		t.Errorf("wrong junk: %v", junkPaths(result))
+	}
+	slices.Sort(ui.messages)
+	if !reflect.DeepEqual(ui.messages, []string{
+		"removing a/b/other~",
+		"removing a/file~",
+		"removing excluded/file~",
+	}) {
+		t.Errorf("wrong messages: %q", ui.messages)
+	}
+	for _, path := range expJunk {
+		if exists(path) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+	for _, path := range []string{"a/keep", "a/b/keep", "build/sub/old~", "excluded/normal"} {
+		if !exists(path) {
+			t.Errorf("%s removed", path)
+		}
+	}
+	if !reflect.DeepEqual(result.Pruned, []*clean.Pruned{
+		{Path: "build", Files: 3, Size: 49},
+		{Path: "cache", Files: 1, Size: 6},
+	}) {
+		for _, x := range result.Pruned {
+			t.Errorf("wrong pruned: %#v", x)
+		}
+	}
+
+	// Once the junk is gone, there's nothing to do.
+	result, err = clean.New(tmp, clean.WithFilters(filters), clean.WithUI(&recordingUI{})).Run()
+	testutil.Check(t, err)
+	if len(result.Junk) != 0 {
+		t.Errorf("junk remains: %v", junkPaths(result))
+	}
+
+	_, err = clean.New(j("nope")).Run()
+	if err == nil {
+		t.Errorf("no error for missing directory")
+	}
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"io"
+	"time"
+)
+
+// The QFS 2 format is a compact binary format. See README.md in this source
+// directory.
+
+const binaryHeader = "QFS 2\n"
+
+// binaryFlagSparse is set in a record's flags if the file is sparse.
+const binaryFlagSparse = 1
+
+// encodeBinary returns the binary record for f, including its length prefix.
+func encodeBinary(f *fileinfo.FileInfo, nanoseconds bool) []byte {
+	var rec []byte
+	rec = binary.AppendUvarint(rec, uint64(len(f.Path)))
+	rec = append(rec, f.Path...)
+	rec = append(rec, byte(f.FileType))
+	rec = binary.AppendVarint(rec, timeValue(f.ModTime, nanoseconds))
+	rec = binary.AppendUvarint(rec, uint64(f.Size))
+	rec = binary.AppendUvarint(rec, uint64(f.Permissions))
+	rec = binary.AppendVarint(rec, int64(f.Uid))
+	rec = binary.AppendVarint(rec, int64(f.Gid))
+	rec = binary.AppendUvarint(rec, uint64(len(f.Special)))
+	rec = append(rec, f.Special...)
+	if !f.BirthTime.IsZero() || f.Checksum != "" || f.Sparse {
+		// A birth time of zero means the birth time is unknown.
+		var btime int64
+		if !f.BirthTime.IsZero() {
+			btime = timeValue(f.BirthTime, nanoseconds)
+		}
+		rec = binary.AppendVarint(rec, btime)
+	}
+	if f.Checksum != "" || f.Sparse {
+		rec = binary.AppendUvarint(rec, uint64(len(f.Checksum)))
+		rec = append(rec, f.Checksum...)
+	}
+	if f.Sparse {
+		rec = binary.AppendUvarint(rec, binaryFlagSparse)
+	}
+	return append(binary.AppendUvarint(nil, uint64(len(rec))), rec...)
+}
+
+// decodeBinary decodes a binary record without its length prefix.
+func decodeBinary(data []byte, nanoseconds bool) (*fileinfo.FileInfo, error) {
+	r := bytes.NewReader(data)
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if n > uint64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := make([]byte, n)
+		_, _ = r.Read(s)
+		return string(s), nil
+	}
+	path, err := readString()
+	if err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+	fileType, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("file type: %w", err)
+	}
+	mtime, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("mtime: %w", err)
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("size: %w", err)
+	}
+	mode, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("mode: %w", err)
+	}
+	uid, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("uid: %w", err)
+	}
+	gid, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("gid: %w", err)
+	}
+	special, err := readString()
+	if err != nil {
+		return nil, fmt.Errorf("special: %w", err)
+	}
+	var birthTime time.Time
+	if r.Len() != 0 {
+		btime, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("birth time: %w", err)
+		}
+		if btime != 0 {
+			birthTime = valueTime(btime, nanoseconds)
+		}
+	}
+	var checksum string
+	if r.Len() != 0 {
+		checksum, err = readString()
+		if err != nil {
+			return nil, fmt.Errorf("checksum: %w", err)
+		}
+	}
+	var flags uint64
+	if r.Len() != 0 {
+		flags, err = binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("flags: %w", err)
+		}
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("extra data at end of record")
+	}
+	return &fileinfo.FileInfo{
+		Path:        path,
+		FileType:    fileinfo.FileType(fileType),
+		ModTime:     valueTime(mtime, nanoseconds),
+		Size:        int64(size),
+		Permissions: uint16(mode),
+		Uid:         int(uid),
+		Gid:         int(gid),
+		Special:     special,
+		BirthTime:   birthTime,
+		Checksum:    checksum,
+		Sparse:      flags&binaryFlagSparse != 0,
+	}, nil
+}
+
+func (dw *Writer) writeBinary(f *fileinfo.FileInfo) error {
+	if !dw.first && f.Path <= dw.lastPath {
+		return fmt.Errorf("database rows out of order: %s after %s", f.Path, dw.lastPath)
+	}
+	dw.first = false
+	dw.lastPath = f.Path
+	_, err := dw.w.Write(encodeBinary(f, dw.nanosecs))
+	return err
+}
+
+// writeEnd writes the zero byte that follows the last record.
+func (dw *Writer) writeEnd() error {
+	return dw.w.WriteByte(0)
+}
+
+func (ld *Loader) getBinaryRow() (*fileinfo.FileInfo, error) {
+	ld.lastOffset = ld.nextOffset
+	length, err := binary.ReadUvarint(ld.r)
+	if err != nil {
+		return nil, fmt.Errorf("%s at offset %d: %w", ld.path.Path(), ld.lastOffset, err)
+	}
+	ld.nextOffset += uint64(len(binary.AppendUvarint(nil, length)))
+	if length == 0 {
+		// End of records; nothing may follow.
+		return nil, ld.checkEnd()
+	}
+	data := make([]byte, length)
+	if err = ld.read(data); err != nil {
+		return nil, err
+	}
+	f, err := decodeBinary(data, ld.nanosecs)
+	if err != nil {
+		return nil, fmt.Errorf("%s at offset %d: %w", ld.path.Path(), ld.lastOffset, err)
+	}
+	return f, nil
+}
+
+// checkEnd verifies that nothing follows the record terminator of a QFS 2
+// database.
+func (ld *Loader) checkEnd() error {
+	if _, err := ld.r.ReadByte(); err == nil {
+		return fmt.Errorf("%s at offset %d: unexpected data after the last record", ld.path.Path(), ld.nextOffset)
+	} else if !errors.Is(err, io.EOF) {
+		// TEST: NOT COVERED
+		return fmt.Errorf("%s at offset %d: %w", ld.path.Path(), ld.nextOffset, err)
+	}
+	return nil
+}
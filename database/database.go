@@ -1,6 +1,9 @@
-// Package database implements read/write support for QFS v1 databases and read
-// support for qsync v3 databases. The database formats are similar with
-// differences. See README.md in this source directory.
+// Package database implements read/write support for QFS v1 and v2 databases
+// and mtree specifications and read support for qsync v3 databases. The v1 and
+// qsync formats are similar with differences. The v2 format is binary. Each QFS
+// format has a nanosecond revision that stores times in nanoseconds instead of
+// milliseconds and a counted revision whose header records the number of
+// entries and their total size. See README.md in this source directory.
 package database
 
 import (
@@ -13,7 +16,6 @@ import (
 	"github.com/jberkenbilt/qfs/misc"
 	"io"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -34,6 +36,11 @@ type Loader struct {
 	nextOffset uint64
 	lastRow    []byte
 	lastFields []string
+	nanosecs   bool
+	counted    bool
+	entries    int
+	totalSize  int64
+	keyVersion int
 	filters    []*filter.Filter
 	repoRules  bool
 	filesOnly  bool
@@ -46,10 +53,32 @@ const (
 	DbQSync = iota
 	DbQfs
 	DbRepo
+	DbQfs2
+	// DbMtree is written by Writer and read by LoadMtree but is never detected
+	// from a header.
+	DbMtree
 )
 
+// nanosecondSuffix follows the header of the nanosecond revision of each QFS
+// format, in which times are in nanoseconds rather than milliseconds.
+const nanosecondSuffix = " NS"
+
+// countsRe matches the header of the counted revision of each QFS format, which
+// ends with the number of entries and the total size of regular files.
+var countsRe = regexp.MustCompile(`^(.*) entries=(\d+) size=(\d+)$`)
+
+// keysRe matches the header of a repository database that records the version
+// of the keys of the objects in the repository. This is only recorded for
+// versions after the first, so older versions of qfs, which can only use
+// version 1 keys, can't read the database.
+var keysRe = regexp.MustCompile(`^(.*) keys=(\d+)$`)
+
 var lenRe = regexp.MustCompile(`^(\d+)(?:/?(\d+))?$`)
 
+// ErrTruncated indicates that a database ended in the middle of its header or a
+// row, which happens if writing it was interrupted.
+var ErrTruncated = errors.New("database is truncated")
+
 func LoadFile(path string, options ...Options) (Database, error) {
 	return Load(fileinfo.NewPath(localsource.New(""), path), options...)
 }
@@ -70,22 +99,34 @@ func Load(path *fileinfo.Path, options ...Options) (Database, error) {
 	}
 	if err := ld.readHeader(); err != nil {
 		_ = f.Close()
-		return nil, err
+		return nil, truncated(err)
 	}
 	for _, fn := range options {
 		fn(ld)
 	}
 
-	db := Database{}
+	// When the header records the number of entries, the map can be sized in
+	// advance, which avoids growing it repeatedly for large databases.
+	db := make(Database, ld.entries)
 	err = ld.forEachRow(func(info *fileinfo.FileInfo) {
 		db[info.Path] = info
 	})
 	if err != nil {
-		return nil, err
+		return nil, truncated(err)
 	}
 	return db, nil
 }
 
+// truncated wraps errors caused by reaching the end of the database too soon
+// with ErrTruncated. The end of a database is detected without an error, so
+// these always indicate a truncated database.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w; %w", err, ErrTruncated)
+	}
+	return err
+}
+
 func WithFilters(filters []*filter.Filter) func(*Loader) {
 	return func(ld *Loader) {
 		ld.filters = filters
@@ -110,24 +151,135 @@ func WithNoSpecial(noSpecial bool) func(*Loader) {
 	}
 }
 
+// WithHeader stores the database's header in h when it is loaded.
+func WithHeader(h *Header) func(*Loader) {
+	return func(ld *Loader) {
+		*h = *ld.Header()
+	}
+}
+
 func (ld *Loader) readHeader() error {
 	first, err := ld.readBytes('\n')
 	if err != nil {
 		return err
 	}
-	header := string(first)
-	if header == "QFS 1" {
-		ld.format = DbQfs
-	} else if header == "QFS REPO 1" {
-		ld.format = DbRepo
-	} else if header == "SYNC_TOOLS_DB_VERSION 3" {
-		ld.format = DbQSync
-	} else {
+	h := parseHeader(string(first))
+	if h == nil {
 		return fmt.Errorf("%s is not a qfs database", ld.path.Path())
 	}
+	ld.format = h.Format
+	ld.nanosecs = h.Nanoseconds
+	ld.counted = h.Counted
+	ld.entries = h.Entries
+	ld.totalSize = h.TotalSize
+	ld.keyVersion = h.KeyVersion
 	return nil
 }
 
+// Header describes what is recorded in a database's header.
+type Header struct {
+	Format DbFormat
+	// Nanoseconds is true for the nanosecond revision of the format.
+	Nanoseconds bool
+	// Counted is true for the counted revision of the format, whose header
+	// records the number of entries and the total size of regular files. These
+	// are the counts at the time the database was written, before any filters
+	// are applied by the loader.
+	Counted   bool
+	Entries   int
+	TotalSize int64
+	// KeyVersion is the version of the keys in the repository described by a
+	// repository database, or 0 if it isn't recorded, in which case it is 1.
+	KeyVersion int
+}
+
+// Header returns what the loader found in the database's header.
+func (ld *Loader) Header() *Header {
+	return &Header{
+		Format:      ld.format,
+		Nanoseconds: ld.nanosecs,
+		Counted:     ld.counted,
+		Entries:     ld.entries,
+		TotalSize:   ld.totalSize,
+		KeyVersion:  ld.keyVersion,
+	}
+}
+
+// parseHeader parses the first line of a database without its newline. It
+// returns nil if the line is not a qfs database header.
+func parseHeader(line string) *Header {
+	h := &Header{}
+	if m := countsRe.FindStringSubmatch(line); m != nil {
+		entries, err1 := strconv.Atoi(m[2])
+		totalSize, err2 := strconv.ParseInt(m[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+		line = m[1]
+		h.Counted = true
+		h.Entries = entries
+		h.TotalSize = totalSize
+	}
+	if m := keysRe.FindStringSubmatch(line); m != nil {
+		keyVersion, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil
+		}
+		line = m[1]
+		h.KeyVersion = keyVersion
+	}
+	if l, ok := strings.CutSuffix(line, nanosecondSuffix); ok {
+		line = l
+		h.Nanoseconds = true
+	}
+	switch line {
+	case "QFS 1":
+		h.Format = DbQfs
+	case "QFS REPO 1":
+		h.Format = DbRepo
+	case "QFS 2":
+		h.Format = DbQfs2
+	case "SYNC_TOOLS_DB_VERSION 3":
+		// qsync databases have no revisions.
+		if h.Nanoseconds || h.Counted || h.KeyVersion != 0 {
+			return nil
+		}
+		h.Format = DbQSync
+	default:
+		return nil
+	}
+	return h
+}
+
+// timeValue returns t as it is stored in a database: in nanoseconds for the
+// nanosecond revision of a format and in milliseconds otherwise.
+func timeValue(t time.Time, nanoseconds bool) int64 {
+	if nanoseconds {
+		return t.UnixNano()
+	}
+	return t.UnixMilli()
+}
+
+// valueTime is the inverse of timeValue.
+func valueTime(v int64, nanoseconds bool) time.Time {
+	if nanoseconds {
+		return time.Unix(0, v)
+	}
+	return time.UnixMilli(v)
+}
+
+// NeedsNanoseconds returns true if any entry's modification time has a
+// fractional millisecond and can therefore only be stored in the nanosecond
+// revision of a format.
+func NeedsNanoseconds(db Database) bool {
+	for _, f := range db {
+		if fileinfo.SubMillisecond(f.ModTime) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ld *Loader) readBytes(delimiter byte) ([]byte, error) {
 	ld.lastOffset = ld.nextOffset
 	data, err := ld.r.ReadBytes(delimiter)
@@ -204,53 +356,74 @@ func (ld *Loader) getRow() ([]byte, error) {
 }
 
 func (ld *Loader) forEachRow(fn func(*fileinfo.FileInfo)) error {
+	cache := filter.NewCache(ld.repoRules, ld.filters...)
 	for {
-		data, err := ld.getRow()
+		f, done, err := ld.nextRow()
 		if err != nil {
 			return err
 		}
-		if data == nil {
+		if done {
 			break
 		}
-		fields := strings.Split(string(data), "\x00")
-		var f *fileinfo.FileInfo
-		switch ld.format {
-		case DbQSync:
-			f, err = ld.handleQSync(fields)
-		case DbQfs:
-			f, err = ld.handleQfs(fields)
-		case DbRepo:
-			f, err = ld.handleRepo(fields)
-		}
-		if err != nil {
-			return fmt.Errorf("%s at offset %d: %w", ld.path.Path(), ld.lastOffset, err)
+		if f != nil && ld.include(cache, f) {
+			fn(f)
 		}
-		ld.lastFields = fields
-		if f != nil {
-			included, _ := filter.IsIncluded(f.Path, ld.repoRules, ld.filters...)
-			if included && (ld.filesOnly || ld.noSpecial) {
-				switch f.FileType {
-				case fileinfo.TypeBlockDev:
-					included = false
-				case fileinfo.TypeCharDev:
-					included = false
-				case fileinfo.TypeSocket:
-					included = false
-				case fileinfo.TypePipe:
-					included = false
-				case fileinfo.TypeDirectory:
-					if ld.filesOnly {
-						included = false
-					}
-				default:
-				}
-			}
-			if included {
-				fn(f)
+	}
+	return nil
+}
+
+// include applies the loader's filters and options to f.
+func (ld *Loader) include(cache *filter.Cache, f *fileinfo.FileInfo) bool {
+	included, _ := cache.IsIncludedFile(f)
+	if included && (ld.filesOnly || ld.noSpecial) {
+		switch f.FileType {
+		case fileinfo.TypeBlockDev:
+			included = false
+		case fileinfo.TypeCharDev:
+			included = false
+		case fileinfo.TypeSocket:
+			included = false
+		case fileinfo.TypePipe:
+			included = false
+		case fileinfo.TypeDirectory:
+			if ld.filesOnly {
+				included = false
 			}
+		default:
 		}
 	}
-	return nil
+	return included
+}
+
+// nextRow returns the next row, which may be nil for rows that are ignored, or
+// true if there are no more rows.
+func (ld *Loader) nextRow() (*fileinfo.FileInfo, bool, error) {
+	if ld.format == DbQfs2 {
+		f, err := ld.getBinaryRow()
+		return f, f == nil && err == nil, err
+	}
+	data, err := ld.getRow()
+	if err != nil {
+		return nil, false, err
+	}
+	if data == nil {
+		return nil, true, nil
+	}
+	fields := strings.Split(string(data), "\x00")
+	var f *fileinfo.FileInfo
+	switch ld.format {
+	case DbQSync:
+		f, err = ld.handleQSync(fields)
+	case DbQfs:
+		f, err = ld.handleQfs(fields)
+	case DbRepo:
+		f, err = ld.handleRepo(fields)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("%s at offset %d: %w", ld.path.Path(), ld.lastOffset, err)
+	}
+	ld.lastFields = fields
+	return f, false, nil
 }
 
 func (ld *Loader) copyFieldIfEmpty(fields []string, n int) {
@@ -316,11 +489,11 @@ func (ld *Loader) handleQSync(fields []string) (*fileinfo.FileInfo, error) {
 }
 
 func (ld *Loader) handleQfs(fields []string) (*fileinfo.FileInfo, error) {
-	if len(fields) != 8 {
-		return nil, fmt.Errorf("wrong number of fields: %d, not 8", len(fields))
+	if len(fields) < 8 || len(fields) > 11 {
+		return nil, fmt.Errorf("wrong number of fields: %d, not 8 to 11", len(fields))
 	}
-	// 0    1     2     3    4    5   6   7
-	// name fType mtime size mode uid gid special
+	// 0    1     2     3    4    5   6   7       8       9          10
+	// name fType mtime size mode uid gid special [btime [checksum [sparse]]]
 	ld.copyFieldIfEmpty(fields, 4) // mode
 	ld.copyFieldIfEmpty(fields, 5) // uid
 	ld.copyFieldIfEmpty(fields, 6) // gid
@@ -329,47 +502,78 @@ func (ld *Loader) handleQfs(fields []string) (*fileinfo.FileInfo, error) {
 	if len(fields[1]) == 1 {
 		fileType = fileinfo.FileType(fields[1][0])
 	}
-	milliseconds, _ := strconv.Atoi(fields[2])
+	mtime, _ := strconv.ParseInt(fields[2], 10, 64)
 	size, _ := strconv.Atoi(fields[3])
 	mode, _ := strconv.ParseInt(fields[4], 8, 32)
 	uid, _ := strconv.Atoi(fields[5])
 	gid, _ := strconv.Atoi(fields[6])
+	var birthTime time.Time
+	if len(fields) >= 9 && fields[8] != "" {
+		btime, _ := strconv.ParseInt(fields[8], 10, 64)
+		birthTime = valueTime(btime, ld.nanosecs)
+	}
+	var checksum string
+	if len(fields) >= 10 {
+		checksum = fields[9]
+	}
+	sparse := len(fields) == 11 && fields[10] == "sparse"
 	return &fileinfo.FileInfo{
 		Path:        path,
 		FileType:    fileType,
-		ModTime:     time.UnixMilli(int64(milliseconds)),
+		ModTime:     valueTime(mtime, ld.nanosecs),
 		Size:        int64(size),
 		Permissions: uint16(mode),
 		Uid:         uid,
 		Gid:         gid,
 		Special:     fields[7],
+		BirthTime:   birthTime,
+		Checksum:    checksum,
+		Sparse:      sparse,
 	}, nil
 }
 
 func (ld *Loader) handleRepo(fields []string) (*fileinfo.FileInfo, error) {
-	if len(fields) != 6 {
-		return nil, fmt.Errorf("wrong number of fields: %d, not 6", len(fields))
+	if len(fields) < 6 || len(fields) > 8 {
+		return nil, fmt.Errorf("wrong number of fields: %d, not 6 to 8", len(fields))
+	}
+	// 0    1     2     3    4    5       6       7
+	// name fType mtime size mode special [hash] [flags]
+	var hash string
+	if len(fields) >= 7 {
+		hash = fields[6]
+	}
+	var chunked, sparse bool
+	if len(fields) == 8 {
+		for _, flag := range strings.Split(fields[7], ",") {
+			switch flag {
+			case "chunked":
+				chunked = true
+			case "sparse":
+				sparse = true
+			}
+		}
 	}
-	// 0    1     2     3    4    5
-	// name fType mtime size mode special
 	ld.copyFieldIfEmpty(fields, 4) // mode
 	path := fields[0]
 	fileType := fileinfo.TypeUnknown
 	if len(fields[1]) == 1 {
 		fileType = fileinfo.FileType(fields[1][0])
 	}
-	milliseconds, _ := strconv.Atoi(fields[2])
+	mtime, _ := strconv.ParseInt(fields[2], 10, 64)
 	size, _ := strconv.Atoi(fields[3])
 	mode, _ := strconv.ParseInt(fields[4], 8, 32)
 	return &fileinfo.FileInfo{
 		Path:        path,
 		FileType:    fileType,
-		ModTime:     time.UnixMilli(int64(milliseconds)),
+		ModTime:     valueTime(mtime, ld.nanosecs),
 		Size:        int64(size),
 		Permissions: uint16(mode),
 		Uid:         CurUid,
 		Gid:         CurGid,
 		Special:     fields[5],
+		Hash:        hash,
+		Chunked:     chunked,
+		Sparse:      sparse,
 	}, nil
 }
 
@@ -391,76 +595,303 @@ func newOrEmpty[T comparable](first bool, old *T, new T, s string) string {
 	return ""
 }
 
-func WriteDb(filename string, files Database, format DbFormat) error {
+// Writer writes database rows one at a time. Rows must be written in lexical
+// order by path. This makes it possible to write a database without holding all
+// the rows in memory. Call Close when done. The database is written to a
+// temporary file that replaces the real file on Close, so an existing database
+// is never left partially written. If writing fails, call Discard instead.
+type Writer struct {
+	format   DbFormat
+	file     *misc.AtomicFile // nil when writing to a stream
+	w        *bufio.Writer
+	bufSize  int
+	lastLine []byte
+	lastMode uint16
+	lastUid  int
+	lastGid  int
+	first    bool
+	closed   bool
+	nanosecs bool
+	// for DbRepo
+	keyVersion int
+	// for the counted revision
+	counted        bool
+	countEntries   int
+	countTotalSize int64
+	entries        int
+	totalSize      int64
+	// for DbQfs2
+	lastPath string
+}
+
+// DefaultBufferSize is the size of the buffer a Writer uses unless
+// WithBufferSize is given. Databases may have millions of rows, and a large
+// buffer avoids a system call for each one.
+const DefaultBufferSize = 256 * 1024
+
+// WriterOptions are options for NewWriter and NewStreamWriter.
+type WriterOptions func(*Writer)
+
+// WithBufferSize sets the size of the buffer used for writing the database.
+func WithBufferSize(size int) func(*Writer) {
+	return func(dw *Writer) {
+		dw.bufSize = size
+	}
+}
+
+// WithNanoseconds causes times to be written in nanoseconds using the
+// nanosecond revision of the format, which older versions of qfs can't read.
+// Otherwise, they are truncated to milliseconds. It has no effect on mtree
+// specifications, which always include nanoseconds. WriteDb and WriteDbTo use
+// the nanosecond revision when NeedsNanoseconds is true.
+func WithNanoseconds(nanoseconds bool) func(*Writer) {
+	return func(dw *Writer) {
+		dw.nanosecs = nanoseconds
+	}
+}
+
+// WithCounts records the number of entries and the total size of regular files
+// in the header using the counted revision of the format, which older versions
+// of qfs can't read. Since the header is written first, the counts must be known
+// in advance, and Close fails if the rows that were written don't match them. It
+// has no effect on mtree specifications. WriteDb and WriteDbTo always record
+// counts.
+func WithCounts(entries int, totalSize int64) func(*Writer) {
+	return func(dw *Writer) {
+		dw.counted = true
+		dw.countEntries = entries
+		dw.countTotalSize = totalSize
+	}
+}
+
+// WithKeyVersion records the version of the repository's keys in the header of
+// a repository database. Version 1 isn't recorded, so the database can be read
+// by versions of qfs that don't know about key versions. It has no effect on
+// other formats.
+func WithKeyVersion(version int) func(*Writer) {
+	return func(dw *Writer) {
+		dw.keyVersion = version
+	}
+}
+
+// NewWriter creates a Writer that writes the database to filename.
+func NewWriter(filename string, format DbFormat, options ...WriterOptions) (*Writer, error) {
+	if format == DbQSync {
+		return nil, errors.New("qsync format not supported for write")
+	}
+	f, err := misc.CreateAtomic(filename)
+	if err != nil {
+		return nil, fmt.Errorf("create database \"%s\": %w", filename, err)
+	}
+	dw, err := newWriter(f, format, options)
+	if err != nil {
+		// TEST: NOT COVERED
+		f.Discard()
+		return nil, err
+	}
+	dw.file = f
+	return dw, nil
+}
+
+// NewStreamWriter creates a Writer that writes the database to w, such as the
+// body of an upload, without creating a local file. Close flushes the database
+// to w but does not close w. After a failure, whatever has been written to w is
+// incomplete.
+func NewStreamWriter(w io.Writer, format DbFormat, options ...WriterOptions) (*Writer, error) {
+	if format == DbQSync {
+		return nil, errors.New("qsync format not supported for write")
+	}
+	return newWriter(w, format, options)
+}
+
+func newWriter(out io.Writer, format DbFormat, options []WriterOptions) (*Writer, error) {
+	dw := &Writer{
+		format:  format,
+		bufSize: DefaultBufferSize,
+		first:   true,
+	}
+	for _, fn := range options {
+		fn(dw)
+	}
 	var header string
 	switch format {
-	case DbQSync:
-		return errors.New("qsync format not supported for write")
 	case DbQfs:
-		header = "QFS 1\n"
+		header = "QFS 1"
 	case DbRepo:
-		header = "QFS REPO 1\n"
+		header = "QFS REPO 1"
+	case DbQfs2:
+		header = strings.TrimSuffix(binaryHeader, "\n")
+	case DbMtree:
+		header = strings.TrimSuffix(mtreeHeader, "\n")
 	}
-
-	err := os.MkdirAll(filepath.Dir(filename), 0777)
-	if err != nil {
-		return fmt.Errorf("create database \"%s\": %w", filename, err)
+	if dw.nanosecs && format != DbMtree {
+		header += nanosecondSuffix
 	}
-	w, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("create database \"%s\": %w", filename, err)
+	if dw.keyVersion > 1 && format == DbRepo {
+		header += fmt.Sprintf(" keys=%d", dw.keyVersion)
+	}
+	if dw.counted && format != DbMtree {
+		header += fmt.Sprintf(" entries=%d size=%d", dw.countEntries, dw.countTotalSize)
 	}
-	defer func() { _ = w.Close() }()
-	if _, err := w.WriteString(header); err != nil {
+	header += "\n"
+	dw.w = bufio.NewWriterSize(out, dw.bufSize)
+	if _, err := dw.w.WriteString(header); err != nil {
 		// TEST: NOT COVERED
-		return err
+		return nil, err
 	}
-	var lastLine []byte
-	var lastMode uint16
-	var lastUid int
-	var lastGid int
-	first := true
-	err = files.ForEach(func(f *fileinfo.FileInfo) error {
-		mode := newOrEmpty(first, &lastMode, f.Permissions, fmt.Sprintf("%04o", f.Permissions))
-		uid := newOrEmpty(first, &lastUid, f.Uid, strconv.FormatInt(int64(f.Uid), 10))
-		gid := newOrEmpty(first, &lastGid, f.Gid, strconv.FormatInt(int64(f.Gid), 10))
-		first = false
-		var fields []string
-		if format == DbQfs {
-			fields = []string{
-				f.Path,
-				string(f.FileType),
-				strconv.FormatInt(f.ModTime.UnixMilli(), 10),
-				strconv.FormatInt(f.Size, 10),
-				mode,
-				uid,
-				gid,
-				f.Special,
-			}
-		} else {
-			fields = []string{
-				f.Path,
-				string(f.FileType),
-				strconv.FormatInt(f.ModTime.UnixMilli(), 10),
-				strconv.FormatInt(f.Size, 10),
-				mode,
-				f.Special,
-			}
+	return dw, nil
+}
+
+// Write writes a single row to the database.
+func (dw *Writer) Write(f *fileinfo.FileInfo) error {
+	dw.entries++
+	if f.FileType == fileinfo.TypeFile {
+		dw.totalSize += f.Size
+	}
+	if dw.format == DbQfs2 {
+		return dw.writeBinary(f)
+	} else if dw.format == DbMtree {
+		return dw.writeMtree(f)
+	}
+	mode := newOrEmpty(dw.first, &dw.lastMode, f.Permissions, fmt.Sprintf("%04o", f.Permissions))
+	uid := newOrEmpty(dw.first, &dw.lastUid, f.Uid, strconv.FormatInt(int64(f.Uid), 10))
+	gid := newOrEmpty(dw.first, &dw.lastGid, f.Gid, strconv.FormatInt(int64(f.Gid), 10))
+	dw.first = false
+	var fields []string
+	if dw.format == DbQfs {
+		fields = []string{
+			f.Path,
+			string(f.FileType),
+			strconv.FormatInt(timeValue(f.ModTime, dw.nanosecs), 10),
+			strconv.FormatInt(f.Size, 10),
+			mode,
+			uid,
+			gid,
+			f.Special,
 		}
-		line := []byte(strings.Join(fields, "\x00"))
-		same := commonPrefix(lastLine, line)
-		lastLine = line
-		var sameStr string
-		if same > 0 {
-			sameStr = fmt.Sprintf("/%d", same)
+		var btime string
+		if !f.BirthTime.IsZero() {
+			btime = strconv.FormatInt(timeValue(f.BirthTime, dw.nanosecs), 10)
 		}
-		_, err := w.WriteString(fmt.Sprintf("%d%s\x00%s\n", len(line)-same, sameStr, line[same:]))
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
+		if f.Sparse {
+			// The birth time and checksum fields are present but empty if unknown.
+			fields = append(fields, btime, f.Checksum, "sparse")
+		} else if f.Checksum != "" {
+			// The birth time field is present but empty if it is unknown.
+			fields = append(fields, btime, f.Checksum)
+		} else if btime != "" {
+			fields = append(fields, btime)
+		}
+	} else {
+		fields = []string{
+			f.Path,
+			string(f.FileType),
+			strconv.FormatInt(timeValue(f.ModTime, dw.nanosecs), 10),
+			strconv.FormatInt(f.Size, 10),
+			mode,
+			f.Special,
+		}
+		var flags []string
+		if f.Chunked {
+			flags = append(flags, "chunked")
+		}
+		if f.Sparse {
+			flags = append(flags, "sparse")
+		}
+		if f.Hash != "" || len(flags) > 0 {
+			// The hash field is present but empty if there are flags but no hash.
+			fields = append(fields, f.Hash)
 		}
+		if len(flags) > 0 {
+			fields = append(fields, strings.Join(flags, ","))
+		}
+	}
+	line := []byte(strings.Join(fields, "\x00"))
+	same := commonPrefix(dw.lastLine, line)
+	dw.lastLine = line
+	var sameStr string
+	if same > 0 {
+		sameStr = fmt.Sprintf("/%d", same)
+	}
+	_, err := fmt.Fprintf(dw.w, "%d%s\x00%s\n", len(line)-same, sameStr, line[same:])
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return nil
+}
+
+// Close finishes writing the database and, when writing to a file, moves it
+// into place. For DbQfs2, this writes the record terminator. It is safe to
+// call Close more than once.
+func (dw *Writer) Close() error {
+	if dw.closed {
 		return nil
-	})
+	}
+	dw.closed = true
+	var err error
+	if dw.counted && dw.format != DbMtree &&
+		(dw.entries != dw.countEntries || dw.totalSize != dw.countTotalSize) {
+		err = fmt.Errorf(
+			"header records %d entries with total size %d, but %d entries with total size %d were written",
+			dw.countEntries, dw.countTotalSize, dw.entries, dw.totalSize,
+		)
+	}
+	if err == nil && dw.format == DbQfs2 {
+		err = dw.writeEnd()
+	}
+	if err == nil {
+		err = dw.w.Flush()
+	}
+	if dw.file == nil {
+		return err
+	}
+	if err != nil {
+		dw.file.Discard()
+		return err
+	}
+	return dw.file.Commit()
+}
+
+// Discard abandons the database without replacing any existing file. It does
+// nothing after Close, so it can be deferred. When writing to a stream, buffered
+// rows are dropped.
+func (dw *Writer) Discard() {
+	dw.closed = true
+	if dw.file != nil {
+		dw.file.Discard()
+	}
+}
+
+func WriteDb(filename string, files Database, format DbFormat, options ...WriterOptions) error {
+	if NeedsNanoseconds(files) {
+		options = append(options, WithNanoseconds(true))
+	}
+	options = append(options, WithCounts(files.Counts()))
+	w, err := NewWriter(filename, format, options...)
+	if err != nil {
+		return err
+	}
+	return writeAll(w, files)
+}
+
+// WriteDbTo writes the database to w in the given format. Use this to stream a
+// database, such as to S3, without writing it to a local file first.
+func WriteDbTo(w io.Writer, files Database, format DbFormat, options ...WriterOptions) error {
+	if NeedsNanoseconds(files) {
+		options = append(options, WithNanoseconds(true))
+	}
+	options = append(options, WithCounts(files.Counts()))
+	dw, err := NewStreamWriter(w, format, options...)
+	if err != nil {
+		return err
+	}
+	return writeAll(dw, files)
+}
+
+func writeAll(w *Writer, files Database) error {
+	defer w.Discard()
+	err := files.ForEach(w.Write)
 	if err != nil {
 		// TEST: NOT COVERED. This would only happen from a write error, which is not
 		// exercised.
@@ -481,19 +912,42 @@ func (db Database) ForEach(fn func(*fileinfo.FileInfo) error) error {
 	return nil
 }
 
+// Counts returns the number of entries and the total size of regular files,
+// which are what the counted revision of a format records in its header.
+func (db Database) Counts() (int, int64) {
+	var totalSize int64
+	for _, f := range db {
+		if f.FileType == fileinfo.TypeFile {
+			totalSize += f.Size
+		}
+	}
+	return len(db), totalSize
+}
+
 func (db Database) Print(long bool) error {
 	return db.ForEach(func(f *fileinfo.FileInfo) error {
-		fmt.Printf("%013d %c %08d %04o", f.ModTime.UnixMilli(), f.FileType, f.Size, f.Permissions)
-		if long {
-			fmt.Printf(" %05d %05d", f.Uid, f.Gid)
-		}
-		fmt.Printf(" %s %s", misc.FormatTime(f.ModTime), f.Path)
-		if f.FileType == fileinfo.TypeLink {
-			fmt.Printf(" -> %s", f.Special)
-		} else if f.FileType == fileinfo.TypeBlockDev || f.FileType == fileinfo.TypeCharDev {
-			fmt.Printf(" %s", f.Special)
-		}
-		fmt.Println("")
+		PrintRow(f, long)
 		return nil
 	})
 }
+
+// PrintRow prints a single row in the format used by Print.
+func PrintRow(f *fileinfo.FileInfo, long bool) {
+	fmt.Printf("%013d %c %08d %04o", f.ModTime.UnixMilli(), f.FileType, f.Size, f.Permissions)
+	if long {
+		fmt.Printf(" %05d %05d", f.Uid, f.Gid)
+		if !f.BirthTime.IsZero() {
+			fmt.Printf(" btime=%s", misc.FormatTime(f.BirthTime))
+		}
+		if f.Checksum != "" {
+			fmt.Printf(" %s", f.Checksum)
+		}
+	}
+	fmt.Printf(" %s %s", misc.FormatTime(f.ModTime), f.Path)
+	if f.FileType == fileinfo.TypeLink {
+		fmt.Printf(" -> %s", f.Special)
+	} else if f.FileType == fileinfo.TypeBlockDev || f.FileType == fileinfo.TypeCharDev {
+		fmt.Printf(" %s", f.Special)
+	}
+	fmt.Println("")
+}
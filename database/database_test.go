@@ -1,15 +1,22 @@
 package database_test
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/jberkenbilt/qfs/database"
 	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/testutil"
+	"io"
+	"os"
 	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func checkError(t *testing.T, e error, text string) {
@@ -68,6 +75,31 @@ func TestRoundTrip(t *testing.T) {
 	}
 }
 
+func TestRepoHash(t *testing.T) {
+	// Files stored by hash in the repository have an extra field.
+	tmp := t.TempDir()
+	db := database.Database{
+		"a": {Path: "a", FileType: fileinfo.TypeFile, Permissions: 0o644, Size: 3},
+		"b": {Path: "b", FileType: fileinfo.TypeFile, Permissions: 0o644, Size: 3, Hash: strings.Repeat("0", 64)},
+		"c": {Path: "c", FileType: fileinfo.TypeLink, Permissions: 0o777, Special: "b"},
+		"d": {Path: "d", FileType: fileinfo.TypeFile, Permissions: 0o600, Size: 9, Hash: strings.Repeat("1", 64), Chunked: true},
+		"e": {Path: "e", FileType: fileinfo.TypeFile, Permissions: 0o600, Size: 9, Sparse: true},
+		"f": {Path: "f", FileType: fileinfo.TypeFile, Permissions: 0o600, Size: 9, Hash: strings.Repeat("2", 64), Chunked: true, Sparse: true},
+	}
+	for _, f := range db {
+		f.Uid = database.CurUid
+		f.Gid = database.CurGid
+		f.ModTime = time.UnixMilli(1234)
+	}
+	path := filepath.Join(tmp, "repo")
+	testutil.Check(t, database.WriteDb(path, db, database.DbRepo))
+	db2, err := database.LoadFile(path)
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(db, db2) {
+		t.Errorf("round trip failed: %#v", db2)
+	}
+}
+
 func TestPartialFiles(t *testing.T) {
 	noSpecial := false
 	filesOnly := false
@@ -152,3 +184,669 @@ func TestErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestBinary(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db1, err := database.LoadFile("testdata/real.qfs")
+	testutil.Check(t, err)
+	testutil.Check(t, database.WriteDb(j("real.qfs2"), db1, database.DbQfs2))
+	db2, err := database.LoadFile(j("real.qfs2"))
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(db1, db2) {
+		t.Error("round trip failed")
+	}
+
+	// Nothing may follow the last record.
+	data, err := os.ReadFile(j("real.qfs2"))
+	testutil.Check(t, err)
+	testutil.Check(t, os.WriteFile(j("extra"), append(data, 0), 0o666))
+	_, err = database.LoadFile(j("extra"))
+	checkError(t, err, "unexpected data after the last record")
+
+	// Rows must be written in order.
+	w, err := database.NewWriter(j("out-of-order"), database.DbQfs2)
+	testutil.Check(t, err)
+	testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: "b"}))
+	checkError(t, w.Write(&fileinfo.FileInfo{Path: "a"}), "database rows out of order: a after b")
+	testutil.Check(t, w.Close())
+	testutil.Check(t, w.Close())
+}
+
+func TestTruncated(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db, err := database.LoadFile("testdata/real.qfs")
+	testutil.Check(t, err)
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbRepo, database.DbQfs2} {
+		testutil.Check(t, database.WriteDb(j("db"), db, format))
+		data, err := os.ReadFile(j("db"))
+		testutil.Check(t, err)
+		// Cut off the file in the header, in the middle of a row, and, for the binary
+		// format, before the record terminator.
+		cuts := []int{0, 3, len(data) / 2}
+		if format == database.DbQfs2 {
+			cuts = append(cuts, len(data)-1)
+		}
+		for _, n := range cuts {
+			testutil.Check(t, os.WriteFile(j("truncated"), data[:n], 0o666))
+			_, err = database.LoadFile(j("truncated"))
+			if !errors.Is(err, database.ErrTruncated) {
+				t.Errorf("format %d, %d bytes: wrong error: %v", format, n, err)
+			}
+		}
+	}
+
+	// An abandoned write leaves the existing database alone and cleans up after
+	// itself.
+	w, err := database.NewWriter(j("db"), database.DbQfs)
+	testutil.Check(t, err)
+	testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: "a"}))
+	w.Discard()
+	testutil.Check(t, w.Close())
+	db2, err := database.LoadFile(j("db"))
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(db, db2) {
+		t.Error("database was replaced")
+	}
+	entries, err := os.ReadDir(tmp)
+	testutil.Check(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{"db", "truncated"}) {
+		t.Errorf("wrong files: %v", names)
+	}
+}
+
+func TestBirthTimes(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db := database.Database{
+		"a": {
+			Path:        "a",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        5,
+			Permissions: 0o644,
+			BirthTime:   time.UnixMilli(1713636000123),
+		},
+		"b": {
+			Path:        "b",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        5,
+			Permissions: 0o644,
+		},
+	}
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbQfs2} {
+		testutil.Check(t, database.WriteDb(j("db"), db, format))
+		db2, err := database.LoadFile(j("db"))
+		testutil.Check(t, err)
+		if !reflect.DeepEqual(db, db2) {
+			t.Errorf("format %d: round trip failed: %#v", format, db2)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db := database.Database{
+		"a": {
+			Path:        "a",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        3,
+			Permissions: 0o644,
+			Checksum:    "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+		"b": {
+			Path:        "b",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        3,
+			Permissions: 0o644,
+			BirthTime:   time.UnixMilli(1713636000123),
+			Checksum:    "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+		},
+		"c": {
+			Path:        "c",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        3,
+			Permissions: 0o644,
+		},
+		"d": {
+			Path:        "d",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        3,
+			Permissions: 0o644,
+			Sparse:      true,
+		},
+		"e": {
+			Path:        "e",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        3,
+			Permissions: 0o644,
+			Checksum:    "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+			Sparse:      true,
+		},
+	}
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbQfs2} {
+		testutil.Check(t, database.WriteDb(j("db"), db, format))
+		db2, err := database.LoadFile(j("db"))
+		testutil.Check(t, err)
+		if !reflect.DeepEqual(db, db2) {
+			t.Errorf("format %d: round trip failed", format)
+		}
+	}
+}
+
+func TestNanoseconds(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db := database.Database{
+		"a": {
+			Path:        "a",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.Unix(1713636124, 123456789),
+			Size:        5,
+			Permissions: 0o644,
+			Uid:         database.CurUid,
+			Gid:         database.CurGid,
+			BirthTime:   time.Unix(1713636000, 1),
+		},
+		"b": {
+			Path:        "b",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Size:        5,
+			Permissions: 0o644,
+			Uid:         database.CurUid,
+			Gid:         database.CurGid,
+		},
+	}
+	// The QFS 2 database is written last and used below.
+	for _, tc := range []struct {
+		format database.DbFormat
+		header string
+	}{
+		{database.DbQfs, "QFS 1 NS entries=2 size=10\n"},
+		{database.DbRepo, "QFS REPO 1 NS entries=2 size=10\n"},
+		{database.DbQfs2, "QFS 2 NS entries=2 size=10\n"},
+	} {
+		format := tc.format
+		// Sub-millisecond times require the nanosecond revision.
+		testutil.Check(t, database.WriteDb(j("db"), db, format))
+		data, err := os.ReadFile(j("db"))
+		testutil.Check(t, err)
+		if !strings.HasPrefix(string(data), tc.header) {
+			t.Errorf("%s: wrong header", format)
+		}
+		db2, err := database.LoadFile(j("db"))
+		testutil.Check(t, err)
+		if format == database.DbRepo {
+			db2["a"].BirthTime = db["a"].BirthTime
+		}
+		if !reflect.DeepEqual(db, db2) {
+			t.Errorf("%s: round trip failed: %#v", format, db2["a"])
+		}
+		stats, err := database.GetStats(j("db"))
+		testutil.Check(t, err)
+		if stats.Format != format || !stats.Nanoseconds {
+			t.Errorf("%s: wrong stats: %#v", format, stats)
+		}
+	}
+
+	// Otherwise, the original revision is used, and a writer truncates times
+	// unless asked not to.
+	delete(db, "a")
+	testutil.Check(t, database.WriteDb(j("db"), db, database.DbQfs))
+	stats, err := database.GetStats(j("db"))
+	testutil.Check(t, err)
+	if stats.Nanoseconds {
+		t.Errorf("nanosecond revision used without sub-millisecond times")
+	}
+	for _, nanoseconds := range []bool{false, true} {
+		w, err := database.NewWriter(j("db"), database.DbQfs2, database.WithNanoseconds(nanoseconds))
+		testutil.Check(t, err)
+		testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: "c", ModTime: time.Unix(5, 999999)}))
+		testutil.Check(t, w.Close())
+		db2, err := database.LoadFile(j("db"))
+		testutil.Check(t, err)
+		exp := time.Unix(5, 0)
+		if nanoseconds {
+			exp = time.Unix(5, 999999)
+		}
+		if !db2["c"].ModTime.Equal(exp) {
+			t.Errorf("wrong time: %v", db2["c"].ModTime)
+		}
+	}
+}
+
+func TestMtree(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	load := func(path string, options ...database.Options) (database.Database, error) {
+		return database.LoadMtree(fileinfo.NewPath(localsource.New(""), path), options...)
+	}
+	db := database.Database{
+		".": {
+			Path:        ".",
+			FileType:    fileinfo.TypeDirectory,
+			ModTime:     time.UnixMilli(1713636124500),
+			Permissions: 0o755,
+			Uid:         1000,
+			Gid:         1000,
+		},
+		"a b#": {
+			Path:        "a b#",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124123),
+			Size:        3,
+			Permissions: 0o644,
+			Uid:         1000,
+			Gid:         1000,
+			Checksum:    "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+		"sub": {
+			Path:        "sub",
+			FileType:    fileinfo.TypeDirectory,
+			ModTime:     time.UnixMilli(1713636124000),
+			Permissions: 0o750,
+			Uid:         1000,
+			Gid:         1000,
+		},
+		"sub/dev": {
+			Path:        "sub/dev",
+			FileType:    fileinfo.TypeCharDev,
+			ModTime:     time.UnixMilli(1713636124000),
+			Permissions: 0o600,
+			Special:     "1,2",
+		},
+		"sub/link": {
+			Path:        "sub/link",
+			FileType:    fileinfo.TypeLink,
+			ModTime:     time.UnixMilli(1713636124000),
+			Permissions: 0o777,
+			Uid:         1000,
+			Gid:         1000,
+			Special:     "../a b#",
+		},
+		"sub/pipe": {
+			Path:        "sub/pipe",
+			FileType:    fileinfo.TypePipe,
+			ModTime:     time.UnixMilli(1713636124000),
+			Permissions: 0o644,
+			Uid:         1000,
+			Gid:         1000,
+		},
+		"sub/\u00e9": {
+			Path:        "sub/\u00e9",
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000),
+			Permissions: 0o644,
+			Uid:         1000,
+			Gid:         1000,
+			Checksum:    "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+		},
+	}
+	testutil.Check(t, database.WriteDb(j("spec"), db, database.DbMtree))
+	data, err := os.ReadFile(j("spec"))
+	testutil.Check(t, err)
+	if !strings.HasPrefix(string(data), "#mtree\n. type=dir mode=0755 uid=1000 gid=1000 time=1713636124.500000000\n") ||
+		!strings.Contains(string(data), "\n./a\\040b\\043 type=file ") ||
+		!strings.Contains(string(data), "\n./sub/\\303\\251 type=file ") ||
+		!strings.Contains(string(data), " device=native,1,2\n") {
+		t.Errorf("wrong output:\n%s", data)
+	}
+	db2, err := load(j("spec"))
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(db, db2) {
+		t.Errorf("round trip failed")
+	}
+	db2, err = load(j("spec"), database.WithFilesOnly(true))
+	testutil.Check(t, err)
+	if keys := misc.SortedKeys(db2); !slices.Equal(keys, []string{"a b#", "sub/link", "sub/\u00e9"}) {
+		t.Errorf("wrong files: %v", keys)
+	}
+
+	// Read the hierarchical form written by BSD mtree. Names are relative to the
+	// last directory, and defaults come from /set.
+	hierarchical := `#	   user: nobody
+# .
+/set type=file uid=1000 gid=1000 mode=0644 nlink=1
+.               type=dir mode=0755 nlink=3 time=1713636124.500000000
+
+# ./sub
+sub             type=dir mode=0750 time=1713636124.0
+    link        type=link mode=0777 link=../a\sb\043 time=1713636124.0
+    pipe        type=fifo time=1713636124
+    \303\251     time=1713636124.999999 \
+                blake3digest=6437B3AC38465133FFB63B75273A8DB548C558465D79DB03FD359C6CD5BD9D85
+/unset uid gid
+    dev         type=char mode=0600 device=freebsd,1,2 time=1713636124.0
+/set uid=1000 gid=1000
+# ./sub
+..
+
+a\040b#        size=3 time=1713636124.123456789 \
+  sha256=ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad
+..
+`
+	testutil.Check(t, os.WriteFile(j("hierarchical"), []byte(hierarchical), 0o666))
+	db2, err = load(j("hierarchical"))
+	testutil.Check(t, err)
+	// Nanoseconds are kept. The digits after the decimal point are nanoseconds,
+	// not a fraction.
+	for p, ns := range map[string]int{"a b#": 123456789, "sub/é": 999999} {
+		if f := db2[p]; f == nil || !f.ModTime.Equal(time.Unix(1713636124, int64(ns))) {
+			t.Errorf("%s: wrong time", p)
+		} else if !fileinfo.SameTime(f.ModTime, db[p].ModTime) {
+			t.Errorf("%s: time doesn't match millisecond time", p)
+		} else {
+			f.ModTime = db[p].ModTime
+		}
+	}
+	if !reflect.DeepEqual(db, db2) {
+		for _, k := range misc.SortedKeys(db2) {
+			t.Logf("%#v", db2[k])
+		}
+		t.Errorf("wrong result from hierarchical spec")
+	}
+
+	for _, tc := range []struct {
+		spec string
+		err  string
+	}{
+		{"x type=door\n", "line 1: x: unknown type \"door\""},
+		{"#mtree\nx mode=rw\n", "line 2: x: mode must be octal: \"rw\""},
+		{"x time=now\n", "invalid time \"now\""},
+		{"x size=big\n", "invalid size \"big\""},
+		{"x uid=root\n", "invalid uid \"root\""},
+		{"x\\ type=file\n", "ends with a backslash"},
+	} {
+		testutil.Check(t, os.WriteFile(j("bad"), []byte(tc.spec), 0o666))
+		_, err = load(j("bad"))
+		checkError(t, err, tc.err)
+	}
+	_, err = load(j("nonexistent"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestStatsAndMerge(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	file := func(path string, size int64, mtime int64) *fileinfo.FileInfo {
+		return &fileinfo.FileInfo{
+			Path:        path,
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(mtime),
+			Size:        size,
+			Permissions: 0o644,
+		}
+	}
+	db1 := database.Database{
+		".": {Path: ".", FileType: fileinfo.TypeDirectory, ModTime: time.UnixMilli(3000), Permissions: 0o755},
+		"a": file("a", 10, 1000),
+		"b": file("b", 20, 2000),
+	}
+	db2 := database.Database{
+		"b": file("b", 5, 4000),
+		"c": file("c", 7, 5000),
+	}
+	testutil.Check(t, database.WriteDb(j("db1"), db1, database.DbQfs))
+	testutil.Check(t, database.WriteDb(j("db2"), db2, database.DbQfs2))
+
+	for filename, exp := range map[string]database.DbFormat{
+		j("db1"):              database.DbQfs,
+		j("db2"):              database.DbQfs2,
+		"testdata/real.qsync": database.DbQSync,
+	} {
+		format, err := database.FileFormat(filename)
+		testutil.Check(t, err)
+		if format != exp {
+			t.Errorf("%s: wrong format: %s", filename, format)
+		}
+	}
+	_, err := database.FileFormat("database.go")
+	checkError(t, err, "database.go is not a qfs database")
+
+	stats, err := database.GetStats(j("db1"))
+	testutil.Check(t, err)
+	if stats.Format != database.DbQfs ||
+		stats.Entries != 3 ||
+		stats.ByType[fileinfo.TypeFile] != 2 ||
+		stats.ByType[fileinfo.TypeDirectory] != 1 ||
+		stats.TotalSize != 30 ||
+		stats.Largest.Path != "b" ||
+		stats.Oldest.UnixMilli() != 1000 ||
+		stats.Newest.UnixMilli() != 3000 {
+		t.Errorf("wrong stats: %#v", stats)
+	}
+
+	merged := database.Merge(db1, db2)
+	if !reflect.DeepEqual(misc.SortedKeys(merged), []string{".", "a", "b", "c"}) {
+		t.Errorf("wrong paths: %v", misc.SortedKeys(merged))
+	}
+	if merged["b"] != db2["b"] || merged["a"] != db1["a"] {
+		t.Errorf("wrong entries: %#v", merged)
+	}
+}
+
+func TestCounts(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db, err := database.LoadFile("testdata/real.qfs")
+	testutil.Check(t, err)
+	entries, totalSize := db.Counts()
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbRepo, database.DbQfs2} {
+		testutil.Check(t, database.WriteDb(j("db"), db, format))
+		data, err := os.ReadFile(j("db"))
+		testutil.Check(t, err)
+		exp := fmt.Sprintf("%s entries=%d size=%d\n", format, entries, totalSize)
+		if !strings.HasPrefix(string(data), exp) {
+			t.Errorf("%s: wrong header", format)
+		}
+		h, err := database.FileHeader(j("db"))
+		testutil.Check(t, err)
+		if !reflect.DeepEqual(h, &database.Header{
+			Format:    format,
+			Counted:   true,
+			Entries:   entries,
+			TotalSize: totalSize,
+		}) {
+			t.Errorf("%s: wrong header: %#v", format, h)
+		}
+		db2, err := database.LoadFile(j("db"))
+		testutil.Check(t, err)
+		if len(db2) != len(db) {
+			t.Errorf("%s: wrong number of entries", format)
+		}
+	}
+	// Databases without counts, such as those from older versions, are still read.
+	h, err := database.FileHeader("testdata/real.qfs")
+	testutil.Check(t, err)
+	if h.Format != database.DbQfs || h.Counted {
+		t.Errorf("wrong header: %#v", h)
+	}
+
+	// A writer fails if its rows don't match the counts it was given and doesn't
+	// replace the file.
+	w, err := database.NewWriter(j("db"), database.DbQfs, database.WithCounts(2, 5))
+	testutil.Check(t, err)
+	testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: "a", FileType: fileinfo.TypeFile, Size: 5}))
+	err = w.Close()
+	checkError(t, err, "header records 2 entries with total size 5, but 1 entries with total size 5 were written")
+	h, err = database.FileHeader(j("db"))
+	testutil.Check(t, err)
+	if h.Format != database.DbQfs2 {
+		t.Errorf("database was replaced")
+	}
+
+	// Only regular files count toward the size.
+	w, err = database.NewWriter(j("db"), database.DbQfs, database.WithCounts(2, 5))
+	testutil.Check(t, err)
+	testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: ".", FileType: fileinfo.TypeDirectory, Size: 4096}))
+	testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: "a", FileType: fileinfo.TypeFile, Size: 5}))
+	testutil.Check(t, w.Close())
+	h, err = database.FileHeader(j("db"))
+	testutil.Check(t, err)
+	if !h.Counted || h.Entries != 2 || h.TotalSize != 5 {
+		t.Errorf("wrong header: %#v", h)
+	}
+
+	for _, header := range []string{
+		"SYNC_TOOLS_DB_VERSION 3 entries=1 size=0\n",
+		"QFS 1 entries=1\n",
+		"QFS 1 entries=99999999999999999999999 size=0\n",
+	} {
+		testutil.Check(t, os.WriteFile(j("bad"), []byte(header), 0o644))
+		_, err = database.FileHeader(j("bad"))
+		checkError(t, err, "is not a qfs database")
+	}
+}
+
+func TestKeyVersion(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db, err := database.LoadFile("testdata/real.qfs")
+	testutil.Check(t, err)
+	entries, totalSize := db.Counts()
+	check := func(format database.DbFormat, version int, expHeader string, expVersion int) {
+		t.Helper()
+		testutil.Check(t, database.WriteDb(j("db"), db, format, database.WithKeyVersion(version)))
+		data, err := os.ReadFile(j("db"))
+		testutil.Check(t, err)
+		exp := fmt.Sprintf("%s entries=%d size=%d\n", expHeader, entries, totalSize)
+		if !strings.HasPrefix(string(data), exp) {
+			t.Errorf("%s: wrong header: %q", expHeader, strings.SplitN(string(data), "\n", 2)[0])
+		}
+		var h database.Header
+		db2, err := database.LoadFile(j("db"), database.WithHeader(&h))
+		testutil.Check(t, err)
+		if len(db2) != len(db) {
+			t.Errorf("%s: wrong number of entries", expHeader)
+		}
+		if h.Format != format || h.KeyVersion != expVersion || h.Entries != entries {
+			t.Errorf("%s: wrong header: %#v", expHeader, h)
+		}
+	}
+	check(database.DbRepo, 2, "QFS REPO 1 keys=2", 2)
+	// Version 1 isn't recorded, and only repository databases record versions.
+	check(database.DbRepo, 1, "QFS REPO 1", 0)
+	check(database.DbQfs, 2, "QFS 1", 0)
+
+	testutil.Check(t, os.WriteFile(j("bad"), []byte("SYNC_TOOLS_DB_VERSION 3 keys=2\n"), 0o644))
+	_, err = database.FileHeader(j("bad"))
+	checkError(t, err, "is not a qfs database")
+}
+
+func TestStreamWriter(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	db, err := database.LoadFile("testdata/real.qfs")
+	testutil.Check(t, err)
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbRepo, database.DbQfs2} {
+		testutil.Check(t, database.WriteDb(j("db"), db, format))
+		exp, err := os.ReadFile(j("db"))
+		testutil.Check(t, err)
+		// A tiny buffer forces many flushes, which must not change the output.
+		for _, size := range []int{16, database.DefaultBufferSize} {
+			buf := &bytes.Buffer{}
+			testutil.Check(t, database.WriteDbTo(buf, db, format, database.WithBufferSize(size)))
+			if !bytes.Equal(buf.Bytes(), exp) {
+				t.Errorf("format %d, buffer size %d: stream differs from file", format, size)
+			}
+		}
+	}
+	err = database.WriteDbTo(&bytes.Buffer{}, db, database.DbQSync)
+	checkError(t, err, "qsync format not supported for write")
+
+	// Nothing reaches the stream until the writer is closed or its buffer fills.
+	buf := &bytes.Buffer{}
+	w, err := database.NewStreamWriter(buf, database.DbQfs)
+	testutil.Check(t, err)
+	testutil.Check(t, w.Write(&fileinfo.FileInfo{Path: "a"}))
+	if buf.Len() != 0 {
+		t.Errorf("stream written before close: %q", buf.String())
+	}
+	testutil.Check(t, w.Close())
+	if !strings.HasPrefix(buf.String(), "QFS 1\n") {
+		t.Errorf("wrong output: %q", buf.String())
+	}
+}
+
+// benchmarkDb returns a database with n rows spread across directories.
+func benchmarkDb(n int) database.Database {
+	db := database.Database{}
+	for i := range n {
+		path := fmt.Sprintf("dir%03d/sub%03d/file%06d", i%997, i%89, i)
+		db[path] = &fileinfo.FileInfo{
+			Path:        path,
+			FileType:    fileinfo.TypeFile,
+			ModTime:     time.UnixMilli(1713636124000 + int64(i)),
+			Size:        int64(i * 17),
+			Permissions: 0o644,
+			Uid:         1000,
+			Gid:         1000,
+		}
+	}
+	return db
+}
+
+func BenchmarkWriteDb(b *testing.B) {
+	db := benchmarkDb(100000)
+	filename := filepath.Join(b.TempDir(), "db")
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbRepo, database.DbQfs2} {
+		for _, size := range []int{4096, database.DefaultBufferSize} {
+			b.Run(fmt.Sprintf("format=%d/buffer=%d", format, size), func(b *testing.B) {
+				for range b.N {
+					err := database.WriteDb(filename, db, format, database.WithBufferSize(size))
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkWriteDbTo(b *testing.B) {
+	db := benchmarkDb(100000)
+	for _, format := range []database.DbFormat{database.DbQfs, database.DbRepo, database.DbQfs2} {
+		b.Run(fmt.Sprintf("format=%d", format), func(b *testing.B) {
+			for range b.N {
+				if err := database.WriteDbTo(io.Discard, db, format); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"bufio"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"time"
+)
+
+func (f DbFormat) String() string {
+	switch f {
+	case DbQSync:
+		return "SYNC_TOOLS_DB_VERSION 3"
+	case DbQfs:
+		return "QFS 1"
+	case DbRepo:
+		return "QFS REPO 1"
+	case DbQfs2:
+		return "QFS 2"
+	case DbMtree:
+		return "mtree"
+	}
+	return "unknown"
+}
+
+// FileFormat returns the format of the database in filename by reading its
+// header.
+func FileFormat(filename string) (DbFormat, error) {
+	ld, err := readFileHeader(filename)
+	if err != nil {
+		return 0, err
+	}
+	return ld.format, nil
+}
+
+// FileHeader reads the header of the database in filename without reading its
+// entries. When the header records counts, this is a quick way to find the size
+// of a large database.
+func FileHeader(filename string) (*Header, error) {
+	ld, err := readFileHeader(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ld.Header(), nil
+}
+
+// readFileHeader returns a Loader that has read the header of the database in
+// filename and closed it.
+func readFileHeader(filename string) (*Loader, error) {
+	path := fileinfo.NewPath(localsource.New(""), filename)
+	f, err := path.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	ld := &Loader{
+		path: path,
+		f:    f,
+		r:    bufio.NewReader(f),
+	}
+	if err := ld.readHeader(); err != nil {
+		return nil, truncated(err)
+	}
+	return ld, nil
+}
+
+// Stats summarizes the contents of a database.
+type Stats struct {
+	Format DbFormat
+	// Nanoseconds is true for the nanosecond revision of the format.
+	Nanoseconds bool
+	Entries     int
+	// ByType gives the number of entries of each file type.
+	ByType map[fileinfo.FileType]int
+	// TotalSize is the total size of regular files.
+	TotalSize int64
+	// Largest is the largest regular file, or nil if there are none.
+	Largest *fileinfo.FileInfo
+	// Oldest and Newest are the earliest and latest modification times of any
+	// entry.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// GetStats loads the database in filename with the given options and
+// summarizes it.
+func GetStats(filename string, options ...Options) (*Stats, error) {
+	ld, err := readFileHeader(filename)
+	if err != nil {
+		return nil, err
+	}
+	db, err := LoadFile(filename, options...)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{
+		Format:      ld.format,
+		Nanoseconds: ld.nanosecs,
+		Entries:     len(db),
+		ByType:      map[fileinfo.FileType]int{},
+	}
+	for _, f := range db {
+		s.ByType[f.FileType]++
+		if f.FileType == fileinfo.TypeFile {
+			s.TotalSize += f.Size
+			if s.Largest == nil || f.Size > s.Largest.Size ||
+				(f.Size == s.Largest.Size && f.Path < s.Largest.Path) {
+				s.Largest = f
+			}
+		}
+		if s.Oldest.IsZero() || f.ModTime.Before(s.Oldest) {
+			s.Oldest = f.ModTime
+		}
+		if f.ModTime.After(s.Newest) {
+			s.Newest = f.ModTime
+		}
+	}
+	return s, nil
+}
+
+// Merge returns a database with the entries of all the given databases. If more
+// than one has an entry for the same path, the entry from the last one is used.
+func Merge(dbs ...Database) Database {
+	result := Database{}
+	for _, db := range dbs {
+		for p, f := range db {
+			result[p] = f
+		}
+	}
+	return result
+}
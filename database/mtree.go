@@ -0,0 +1,348 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mtree specifications are the text format read and written by BSD mtree,
+// libarchive, and other integrity tools. Each entry is a file name followed by
+// keyword=value pairs. We write the "full path" form, in which every name
+// except the top directory starts with "./", so entries are independent of
+// each other. We read that form as well as the hierarchical form, in which
+// names are relative to the most recent directory entry and ".." returns to its
+// parent. Keywords that qfs doesn't record are ignored.
+
+const mtreeHeader = "#mtree\n"
+
+var mtreeTypes = map[fileinfo.FileType]string{
+	fileinfo.TypeFile:      "file",
+	fileinfo.TypeDirectory: "dir",
+	fileinfo.TypeLink:      "link",
+	fileinfo.TypeCharDev:   "char",
+	fileinfo.TypeBlockDev:  "block",
+	fileinfo.TypePipe:      "fifo",
+	fileinfo.TypeSocket:    "socket",
+}
+
+// mtreeDigests maps mtree digest keywords to checksum algorithms. mtree has no
+// keyword for blake3, so blake3digest is our own and may not be recognized by
+// other tools.
+var mtreeDigests = map[string]string{
+	"sha256digest": "sha256",
+	"sha256":       "sha256",
+	"blake3digest": "blake3",
+}
+
+func (dw *Writer) writeMtree(f *fileinfo.FileInfo) error {
+	fType, ok := mtreeTypes[f.FileType]
+	if !ok {
+		// TEST: NOT COVERED. mtree can't represent files of unknown type.
+		return nil
+	}
+	name := "."
+	if f.Path != "." {
+		name = "./" + f.Path
+	}
+	var b strings.Builder
+	_, _ = fmt.Fprintf(
+		&b,
+		"%s type=%s mode=%04o uid=%d gid=%d time=%d.%09d",
+		mtreeEncode(name),
+		fType,
+		f.Permissions,
+		f.Uid,
+		f.Gid,
+		f.ModTime.Unix(),
+		f.ModTime.Nanosecond(),
+	)
+	switch f.FileType {
+	case fileinfo.TypeFile:
+		_, _ = fmt.Fprintf(&b, " size=%d", f.Size)
+	case fileinfo.TypeLink:
+		_, _ = fmt.Fprintf(&b, " link=%s", mtreeEncode(f.Special))
+	case fileinfo.TypeCharDev, fileinfo.TypeBlockDev:
+		_, _ = fmt.Fprintf(&b, " device=native,%s", f.Special)
+	default:
+	}
+	if alg, sum, ok := strings.Cut(f.Checksum, ":"); ok {
+		_, _ = fmt.Fprintf(&b, " %sdigest=%s", alg, sum)
+	}
+	b.WriteByte('\n')
+	_, err := dw.w.WriteString(b.String())
+	return err
+}
+
+// mtreeEncode encodes a name the way mtree does, with octal escapes for
+// whitespace, non-ASCII characters, backslash, and characters that mtree treats
+// as comments or wildcards.
+func mtreeEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`\#*?[`, c) >= 0 {
+			_, _ = fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// mtreeDecode reverses mtreeEncode. It also accepts the C-style escapes that
+// some implementations write.
+func mtreeDecode(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			n, _ := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("%q ends with a backslash", s)
+		}
+		i++
+		switch s[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// LoadMtree reads an mtree specification and returns its entries as a database.
+// The options are the same as for Load. mtree records modification times in
+// nanoseconds, which are kept; see fileinfo.SameTime for how they compare with
+// times from a scan.
+func LoadMtree(path *fileinfo.Path, options ...Options) (Database, error) {
+	f, err := path.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	ld := &Loader{
+		path:   path,
+		format: DbMtree,
+		f:      f,
+		r:      bufio.NewReader(f),
+	}
+	for _, fn := range options {
+		fn(ld)
+	}
+	cache := filter.NewCache(ld.repoRules, ld.filters...)
+	db := Database{}
+	err = ld.readMtree(func(info *fileinfo.FileInfo) {
+		if ld.include(cache, info) {
+			db[info.Path] = info
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (ld *Loader) readMtree(fn func(*fileinfo.FileInfo)) error {
+	defaults := map[string]string{}
+	cwd := "."
+	lineNo := 0
+	var line string
+	for {
+		data, err := ld.r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			// TEST: NOT COVERED
+			return fmt.Errorf("%s: %w", ld.path.Path(), err)
+		}
+		lineNo++
+		done := errors.Is(err, io.EOF)
+		data = strings.TrimRight(data, " \t\r\n")
+		if !done && strings.HasSuffix(data, `\`) {
+			// A trailing backslash continues the entry on the next line.
+			line += strings.TrimSuffix(data, `\`) + " "
+			continue
+		}
+		line += data
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			var err error
+			cwd, err = ld.mtreeEntry(fields, defaults, cwd, fn)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %w", ld.path.Path(), lineNo, err)
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// mtreeEntry handles a line of an mtree specification and returns the current
+// directory for the next line.
+func (ld *Loader) mtreeEntry(
+	fields []string,
+	defaults map[string]string,
+	cwd string,
+	fn func(*fileinfo.FileInfo),
+) (string, error) {
+	switch fields[0] {
+	case "/set":
+		for _, kv := range fields[1:] {
+			k, v, _ := strings.Cut(kv, "=")
+			defaults[k] = v
+		}
+		return cwd, nil
+	case "/unset":
+		for _, k := range fields[1:] {
+			if k == "all" {
+				clear(defaults)
+			}
+			delete(defaults, k)
+		}
+		return cwd, nil
+	case "..":
+		return path.Dir(cwd), nil
+	}
+	name, err := mtreeDecode(fields[0])
+	if err != nil {
+		return "", err
+	}
+	keywords := map[string]string{}
+	for k, v := range defaults {
+		keywords[k] = v
+	}
+	for _, kv := range fields[1:] {
+		k, v, _ := strings.Cut(kv, "=")
+		keywords[k] = v
+	}
+	fullPath := strings.Contains(name, "/")
+	var p string
+	if fullPath {
+		p = path.Clean(name)
+	} else {
+		p = path.Join(cwd, name)
+	}
+	info, err := mtreeFileInfo(p, keywords)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", p, err)
+	}
+	fn(info)
+	if !fullPath && info.FileType == fileinfo.TypeDirectory {
+		cwd = p
+	}
+	return cwd, nil
+}
+
+func mtreeFileInfo(p string, keywords map[string]string) (*fileinfo.FileInfo, error) {
+	info := &fileinfo.FileInfo{
+		Path:     p,
+		FileType: fileinfo.TypeFile,
+	}
+	if t, ok := keywords["type"]; ok {
+		info.FileType = fileinfo.TypeUnknown
+		for fType, name := range mtreeTypes {
+			if name == t {
+				info.FileType = fType
+			}
+		}
+		if info.FileType == fileinfo.TypeUnknown {
+			return nil, fmt.Errorf("unknown type \"%s\"", t)
+		}
+	}
+	if v, ok := keywords["mode"]; ok {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("mode must be octal: \"%s\"", v)
+		}
+		info.Permissions = uint16(mode & 0o7777)
+	}
+	for _, k := range []string{"uid", "gid"} {
+		v, ok := keywords[k]
+		if !ok {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s \"%s\"", k, v)
+		}
+		if k == "uid" {
+			info.Uid = id
+		} else {
+			info.Gid = id
+		}
+	}
+	if v, ok := keywords["time"]; ok {
+		// The digits after the decimal point are nanoseconds, not a fraction.
+		s, ns, _ := strings.Cut(v, ".")
+		seconds, err1 := strconv.ParseInt(s, 10, 64)
+		var nanoseconds int64
+		var err2 error
+		if ns != "" {
+			nanoseconds, err2 = strconv.ParseInt(ns, 10, 64)
+		}
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid time \"%s\"", v)
+		}
+		info.ModTime = time.Unix(seconds, nanoseconds)
+	}
+	switch info.FileType {
+	case fileinfo.TypeFile:
+		if v, ok := keywords["size"]; ok {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size \"%s\"", v)
+			}
+			info.Size = size
+		}
+		for k, alg := range mtreeDigests {
+			if v, ok := keywords[k]; ok {
+				info.Checksum = alg + ":" + strings.ToLower(v)
+			}
+		}
+	case fileinfo.TypeLink:
+		target, err := mtreeDecode(keywords["link"])
+		if err != nil {
+			return nil, err
+		}
+		info.Special = target
+	case fileinfo.TypeCharDev, fileinfo.TypeBlockDev:
+		// Devices are given as format,major,minor. Keep just major,minor as in a scan.
+		v := keywords["device"]
+		if parts := strings.Split(v, ","); len(parts) == 3 {
+			v = parts[1] + "," + parts[2]
+		}
+		info.Special = v
+	default:
+	}
+	return info, nil
+}
@@ -1,14 +1,18 @@
 package diff
 
 import (
+	"cmp"
 	"fmt"
 	"github.com/jberkenbilt/qfs/database"
 	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/filter"
 	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/scan"
-	"os"
+	"io"
+	"path"
+	"slices"
 	"strconv"
+	"time"
 )
 
 type Options func(*Diff)
@@ -25,6 +29,10 @@ type Diff struct {
 	noSpecial    bool
 	nonFileTimes bool
 	noOwnerships bool
+	noPerms      bool
+	renames      bool
+	permMask     uint16
+	modifyWindow time.Duration
 }
 
 type Check struct {
@@ -41,8 +49,12 @@ func (c *Check) String() string {
 	return s
 }
 
+// MetaChange describes changes to an entry other than to a regular file's
+// contents. Target is the new target of a symbolic link, which can be changed
+// by replacing the link without copying anything.
 type MetaChange struct {
 	Info        *fileinfo.FileInfo
+	Target      *string
 	Permissions *uint16
 	Uid         *int
 	Gid         *int
@@ -51,6 +63,9 @@ type MetaChange struct {
 
 func (m *MetaChange) String() string {
 	var s string
+	if m.Target != nil {
+		s += fmt.Sprintf("relink %s -> %s\n", m.Info.Path, *m.Target)
+	}
 	if m.Permissions != nil {
 		s += fmt.Sprintf("chmod %04o %s\n", *m.Permissions, m.Info.Path)
 	}
@@ -71,17 +86,48 @@ func (m *MetaChange) String() string {
 	return s
 }
 
+// Rename indicates that a regular file that was removed from Old.Path was
+// added at New.Path. Renames are detected heuristically: see WithRenames.
+type Rename struct {
+	Old *fileinfo.FileInfo
+	New *fileinfo.FileInfo
+}
+
+func (r *Rename) String() string {
+	return fmt.Sprintf("rename %s -> %s\n", r.Old.Path, r.New.Path)
+}
+
 type Result struct {
 	Check      []*Check
 	TypeChange []string // path
 	Rm         []*fileinfo.FileInfo
+	Rename     []*Rename
 	Add        []*fileinfo.FileInfo
 	Change     []*fileinfo.FileInfo
 	MetaChange []*MetaChange
 }
 
+// Relinks returns the symbolic links whose targets changed.
+func (r *Result) Relinks() []*fileinfo.FileInfo {
+	var result []*fileinfo.FileInfo
+	for _, m := range r.MetaChange {
+		if m.Target != nil {
+			result = append(result, m.Info)
+		}
+	}
+	return result
+}
+
+// NumChanges returns the number of operations required to apply the diff,
+// excluding checks and informational type changes.
+func (r *Result) NumChanges() int {
+	return len(r.Rm) + len(r.Rename) + len(r.Add) + len(r.Change) + len(r.MetaChange)
+}
+
 func New(options ...Options) *Diff {
-	d := &Diff{}
+	d := &Diff{
+		permMask: 0o7777,
+	}
 	for _, fn := range options {
 		fn(d)
 	}
@@ -118,12 +164,51 @@ func WithNoOwnerships(noOwnerships bool) func(*Diff) {
 	}
 }
 
+// WithNoPermissions causes permission changes to be ignored. This is for file
+// systems, such as FAT, that don't store permissions faithfully.
+func WithNoPermissions(noPerms bool) func(*Diff) {
+	return func(d *Diff) {
+		d.noPerms = noPerms
+	}
+}
+
+// WithPermissionMask causes only the permission bits in mask to be compared.
+// This is used for sites on platforms that can't represent all permission bits.
+func WithPermissionMask(mask uint16) func(*Diff) {
+	return func(d *Diff) {
+		d.permMask = mask
+	}
+}
+
 func WithNonFileTimes(nonFileTimes bool) func(*Diff) {
 	return func(d *Diff) {
 		d.nonFileTimes = nonFileTimes
 	}
 }
 
+// WithRenames causes regular files that were removed from one path and added at
+// another to be reported as renames when they can be matched up. A removed
+// file and an added file match if they have the same size and modification
+// time and, when both have content hashes, the same hash. Empty files never
+// match. If several files match on size and modification time, those whose
+// last path elements are also the same are paired; other ambiguous matches are
+// left as removals and additions.
+func WithRenames(renames bool) func(*Diff) {
+	return func(d *Diff) {
+		d.renames = renames
+	}
+}
+
+// WithModifyWindow causes modification times that differ by no more than
+// window to be treated as the same, as with rsync's --modify-window. This
+// keeps files on file systems with coarse timestamps, such as FAT, from
+// appearing to have changed. See fileinfo.SameTimeWithin.
+func WithModifyWindow(window time.Duration) func(*Diff) {
+	return func(d *Diff) {
+		d.modifyWindow = window
+	}
+}
+
 // RunFiles generates a diff that, when applied to oldSrc, makes it look like newSrc.
 func (d *Diff) RunFiles(oldSrc, newSrc string) (*Result, error) {
 	s1, err := scan.New(
@@ -188,16 +273,94 @@ func (d *Diff) Run(oldDb, newDb database.Database) (*Result, error) {
 	}
 	paths := misc.SortedKeys(work)
 	r := &Result{}
+	cache := filter.NewCache(d.repoRules, d.filters...)
 	for _, path := range paths {
-		d.compare(r, path, work[path])
+		d.compare(r, cache, path, work[path])
+	}
+	if d.renames {
+		findRenames(r)
 	}
 	return r, nil
 }
 
-func (d *Diff) compare(r *Result, path string, data *oldNew) {
-	if included, _ := filter.IsIncluded(path, d.repoRules, d.filters...); !included {
+type renameKey struct {
+	size    int64
+	modTime int64
+	base    string
+}
+
+// findRenames moves pairs of removed and added files that match according to
+// WithRenames from r.Rm and r.Add to r.Rename. Checks are left alone: the old
+// path must still have its old modification time, and the new path must not
+// exist or must already be up to date.
+func findRenames(r *Result) {
+	candidate := func(f *fileinfo.FileInfo) bool {
+		return f.FileType == fileinfo.TypeFile && f.Size > 0
+	}
+	renamed := map[*fileinfo.FileInfo]bool{}
+	for _, withBase := range []bool{true, false} {
+		key := func(f *fileinfo.FileInfo) renameKey {
+			k := renameKey{size: f.Size, modTime: f.ModTime.UnixMilli()}
+			if withBase {
+				k.base = path.Base(f.Path)
+			}
+			return k
+		}
+		removed := map[renameKey][]*fileinfo.FileInfo{}
+		for _, f := range r.Rm {
+			if candidate(f) && !renamed[f] {
+				removed[key(f)] = append(removed[key(f)], f)
+			}
+		}
+		added := map[renameKey][]*fileinfo.FileInfo{}
+		for _, f := range r.Add {
+			if candidate(f) && !renamed[f] {
+				added[key(f)] = append(added[key(f)], f)
+			}
+		}
+		for _, fNew := range r.Add {
+			k := key(fNew)
+			if renamed[fNew] || len(added[k]) != 1 || len(removed[k]) != 1 {
+				continue
+			}
+			fOld := removed[k][0]
+			if fOld.Hash != "" && fNew.Hash != "" && fOld.Hash != fNew.Hash {
+				continue
+			}
+			renamed[fOld] = true
+			renamed[fNew] = true
+			r.Rename = append(r.Rename, &Rename{Old: fOld, New: fNew})
+		}
+	}
+	if len(r.Rename) == 0 {
+		return
+	}
+	slices.SortFunc(r.Rename, func(a, b *Rename) int {
+		return cmp.Compare(a.New.Path, b.New.Path)
+	})
+	isRenamed := func(f *fileinfo.FileInfo) bool { return renamed[f] }
+	r.Rm = slices.DeleteFunc(r.Rm, isRenamed)
+	r.Add = slices.DeleteFunc(r.Add, isRenamed)
+}
+
+func (d *Diff) sameTime(t1, t2 time.Time) bool {
+	return fileinfo.SameTimeWithin(t1, t2, d.modifyWindow)
+}
+
+func (d *Diff) compare(r *Result, cache *filter.Cache, path string, data *oldNew) {
+	if included, _ := cache.IsIncluded(path); !included {
 		return
 	}
+	// A file that is outside a filter's size or age limit on either side is left
+	// alone, so it isn't removed when it grows or ages past the limit.
+	for _, f := range []*fileinfo.FileInfo{data.fOld, data.fNew} {
+		if f == nil {
+			continue
+		}
+		if included, _ := cache.IsIncludedFile(f); !included {
+			return
+		}
+	}
 	if data.fNew == nil {
 		// The file was removed. For regular files, make sure the file, if present, has
 		// the right modification time.
@@ -223,7 +386,7 @@ func (d *Diff) compare(r *Result, path string, data *oldNew) {
 		// The file has changed. Add data for conflict detection when the old file is a
 		// regular file.
 		if data.fOld.FileType == fileinfo.TypeFile {
-			if data.fNew.ModTime != data.fOld.ModTime || data.fNew.FileType != fileinfo.TypeFile {
+			if !d.sameTime(data.fNew.ModTime, data.fOld.ModTime) || data.fNew.FileType != fileinfo.TypeFile {
 				// The file will be replaced or overwritten. Allow the file to have the old modification time.
 				check := &Check{
 					Path: path,
@@ -245,10 +408,10 @@ func (d *Diff) compare(r *Result, path string, data *oldNew) {
 			r.TypeChange = append(r.TypeChange, path)
 			r.Rm = append(r.Rm, data.fOld)
 			r.Add = append(r.Add, data.fNew)
-		} else if data.fOld.Special != data.fNew.Special {
-			// Special has changed, so this will need to be replaced.
+		} else if data.fOld.Special != data.fNew.Special && data.fNew.FileType != fileinfo.TypeLink {
+			// A special file's device numbers have changed, so it will need to be replaced.
 			r.Change = append(r.Change, data.fNew)
-		} else if data.fOld.ModTime != data.fNew.ModTime && data.fOld.FileType == fileinfo.TypeFile {
+		} else if !d.sameTime(data.fOld.ModTime, data.fNew.ModTime) && data.fOld.FileType == fileinfo.TypeFile {
 			// This is a plain file that has changed.
 			r.Change = append(r.Change, data.fNew)
 		} else {
@@ -258,14 +421,19 @@ func (d *Diff) compare(r *Result, path string, data *oldNew) {
 				Info: data.fNew,
 			}
 			changes := false
+			if data.fOld.Special != data.fNew.Special {
+				// A symbolic link's target has changed.
+				changes = true
+				m.Target = &data.fNew.Special
+			}
 			if d.nonFileTimes {
-				if data.fOld.ModTime != data.fNew.ModTime && data.fOld.FileType != fileinfo.TypeFile {
+				if !d.sameTime(data.fOld.ModTime, data.fNew.ModTime) && data.fOld.FileType != fileinfo.TypeFile {
 					t := data.fNew.ModTime.UnixMilli()
 					changes = true
 					m.DirTime = &t
 				}
 			}
-			if data.fOld.Permissions != data.fNew.Permissions {
+			if !d.noPerms && data.fOld.Permissions&d.permMask != data.fNew.Permissions&d.permMask {
 				changes = true
 				m.Permissions = &data.fNew.Permissions
 			}
@@ -286,7 +454,7 @@ func (d *Diff) compare(r *Result, path string, data *oldNew) {
 	}
 }
 
-func (r *Result) WriteDiff(f *os.File, withChecks bool) error {
+func (r *Result) WriteDiff(f io.Writer, withChecks bool) error {
 	if withChecks {
 		for _, m := range r.Check {
 			if _, err := fmt.Fprint(f, m.String()); err != nil {
@@ -307,6 +475,12 @@ func (r *Result) WriteDiff(f *os.File, withChecks bool) error {
 			return err
 		}
 	}
+	for _, m := range r.Rename {
+		if _, err := fmt.Fprint(f, m.String()); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
 	for _, m := range r.Add {
 		var cmd string
 		if m.FileType == fileinfo.TypeDirectory {
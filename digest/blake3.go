@@ -0,0 +1,239 @@
+package digest
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// This is a straightforward implementation of the BLAKE3 hash function,
+// following the reference implementation in the BLAKE3 specification. It only
+// supports the default hash mode with 32-byte output, which is all that is
+// needed for file checksums. It makes no use of SIMD, so it is slower than
+// optimized implementations but still faster than reading most disks.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+	blake3OutLen   = 32
+
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] = s[a] + s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func round(s *[16]uint32, m *[16]uint32) {
+	// Mix the columns.
+	g(s, 0, 4, 8, 12, m[0], m[1])
+	g(s, 1, 5, 9, 13, m[2], m[3])
+	g(s, 2, 6, 10, 14, m[4], m[5])
+	g(s, 3, 7, 11, 15, m[6], m[7])
+	// Mix the diagonals.
+	g(s, 0, 5, 10, 15, m[8], m[9])
+	g(s, 1, 6, 11, 12, m[10], m[11])
+	g(s, 2, 7, 8, 13, m[12], m[13])
+	g(s, 3, 4, 9, 14, m[14], m[15])
+}
+
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for i := range 7 {
+		round(&s, &m)
+		if i < 6 {
+			var permuted [16]uint32
+			for j, k := range blake3Permutation {
+				permuted[j] = m[k]
+			}
+			m = permuted
+		}
+	}
+	for i := range 8 {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func blockWords(block []byte) [16]uint32 {
+	var padded [blake3BlockLen]byte
+	copy(padded[:], block)
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(padded[4*i:])
+	}
+	return words
+}
+
+func first8(words [16]uint32) [8]uint32 {
+	var cv [8]uint32
+	copy(cv[:], words[:8])
+	return cv
+}
+
+// output holds the inputs to the final compression of a chunk or parent node,
+// which is done differently depending on whether the node is the root.
+type output struct {
+	inputCV  [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	return first8(compress(&o.inputCV, &o.block, o.counter, o.blockLen, o.flags))
+}
+
+func (o *output) rootBytes() []byte {
+	words := compress(&o.inputCV, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	out := make([]byte, 0, blake3OutLen)
+	for _, w := range words[:blake3OutLen/4] {
+		out = binary.LittleEndian.AppendUint32(out, w)
+	}
+	return out
+}
+
+func parentOutput(left, right [8]uint32) *output {
+	o := &output{
+		inputCV:  blake3IV,
+		blockLen: blake3BlockLen,
+		flags:    flagParent,
+	}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+type chunkState struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [blake3BlockLen]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{cv: blake3IV, counter: counter}
+}
+
+func (c *chunkState) len() int {
+	return blake3BlockLen*c.blocksCompressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(input []byte) {
+	for len(input) > 0 {
+		// The last block of a chunk is compressed differently, so a full block is
+		// only compressed when more input arrives.
+		if c.blockLen == blake3BlockLen {
+			words := blockWords(c.block[:])
+			c.cv = first8(compress(&c.cv, &words, c.counter, blake3BlockLen, c.startFlag()))
+			c.blocksCompressed++
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], input)
+		c.blockLen += n
+		input = input[n:]
+	}
+}
+
+func (c *chunkState) output() *output {
+	return &output{
+		inputCV:  c.cv,
+		block:    blockWords(c.block[:c.blockLen]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+type blake3 struct {
+	chunk   chunkState
+	cvStack [][8]uint32
+}
+
+// NewBLAKE3 returns a hash.Hash computing the 32-byte BLAKE3 digest.
+func NewBLAKE3() hash.Hash {
+	return &blake3{chunk: newChunkState(0)}
+}
+
+func (h *blake3) addChunkCV(cv [8]uint32, totalChunks uint64) {
+	// Each trailing zero bit in the number of chunks so far means that a subtree
+	// is complete, so its two halves are merged into their parent.
+	for totalChunks&1 == 0 {
+		top := h.cvStack[len(h.cvStack)-1]
+		h.cvStack = h.cvStack[:len(h.cvStack)-1]
+		cv = parentOutput(top, cv).chainingValue()
+		totalChunks >>= 1
+	}
+	h.cvStack = append(h.cvStack, cv)
+}
+
+func (h *blake3) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// As with blocks, a full chunk is only finished when more input arrives, since
+		// the last chunk may be the root.
+		if h.chunk.len() == blake3ChunkLen {
+			cv := h.chunk.output().chainingValue()
+			totalChunks := h.chunk.counter + 1
+			h.addChunkCV(cv, totalChunks)
+			h.chunk = newChunkState(totalChunks)
+		}
+		take := min(blake3ChunkLen-h.chunk.len(), len(p))
+		h.chunk.update(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (h *blake3) Sum(b []byte) []byte {
+	o := h.chunk.output()
+	for i := len(h.cvStack) - 1; i >= 0; i-- {
+		o = parentOutput(h.cvStack[i], o.chainingValue())
+	}
+	return append(b, o.rootBytes()...)
+}
+
+func (h *blake3) Reset() {
+	h.chunk = newChunkState(0)
+	h.cvStack = nil
+}
+
+func (h *blake3) Size() int {
+	return blake3OutLen
+}
+
+func (h *blake3) BlockSize() int {
+	return blake3BlockLen
+}
@@ -0,0 +1,84 @@
+// Package digest computes checksums of file contents with a selectable
+// algorithm. Checksums are written as the algorithm's name, a colon, and the
+// hex-encoded digest, such as "sha256:e3b0...", so that checksums computed with
+// different algorithms are never mistaken for each other.
+package digest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	SHA256 = "sha256"
+	BLAKE3 = "blake3"
+)
+
+var algorithms = map[string]func() hash.Hash{
+	SHA256: sha256.New,
+	BLAKE3: NewBLAKE3,
+}
+
+// Algorithms returns the names of the supported algorithms.
+func Algorithms() []string {
+	var result []string
+	for name := range algorithms {
+		result = append(result, name)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// New returns a hash.Hash for the named algorithm.
+func New(algorithm string) (hash.Hash, error) {
+	fn, ok := algorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf(
+			"unknown checksum algorithm %q; use one of %s",
+			algorithm,
+			strings.Join(Algorithms(), ", "),
+		)
+	}
+	return fn(), nil
+}
+
+// Reader returns the checksum of everything read from r.
+func Reader(algorithm string, r io.Reader) (string, error) {
+	h, err := New(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// File returns the checksum of the file at path.
+func File(algorithm string, path string) (string, error) {
+	if _, err := New(algorithm); err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	sum, err := Reader(algorithm, f)
+	if err != nil {
+		return "", fmt.Errorf("checksum %s: %w", path, err)
+	}
+	return sum, nil
+}
+
+// Algorithm returns the name of the algorithm used to compute checksum.
+func Algorithm(checksum string) string {
+	algorithm, _, _ := strings.Cut(checksum, ":")
+	return algorithm
+}
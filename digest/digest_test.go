@@ -0,0 +1,78 @@
+package digest_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/jberkenbilt/qfs/digest"
+	"github.com/jberkenbilt/qfs/testutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBLAKE3(t *testing.T) {
+	// These are from the official BLAKE3 test vectors, whose input is the
+	// repeating sequence 0, 1, ..., 250, and cover the boundaries of blocks,
+	// chunks, and the tree of chunks.
+	vectors := map[int]string{
+		0:      "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+		1:      "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213",
+		1024:   "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7",
+		1025:   "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444",
+		2048:   "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a",
+		102400: "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085",
+	}
+	for n, exp := range vectors {
+		input := make([]byte, n)
+		for i := range input {
+			input[i] = byte(i % 251)
+		}
+		sum, err := digest.Reader(digest.BLAKE3, bytes.NewReader(input))
+		testutil.Check(t, err)
+		if sum != "blake3:"+exp {
+			t.Errorf("%d: wrong checksum: %s", n, sum)
+		}
+		// Writing in pieces that don't line up with blocks or chunks gives the same
+		// result, and Sum doesn't disturb the state.
+		h := digest.NewBLAKE3()
+		for i := 0; i < n; i += 100 {
+			_, _ = h.Write(input[i:min(i+100, n)])
+			_ = h.Sum(nil)
+		}
+		if sum2 := "blake3:" + hex.EncodeToString(h.Sum(nil)); sum2 != sum {
+			t.Errorf("%d: incremental checksum differs: %s", n, sum2)
+		}
+		h.Reset()
+		_, _ = h.Write(input)
+		if sum3 := "blake3:" + hex.EncodeToString(h.Sum(nil)); sum3 != sum {
+			t.Errorf("%d: checksum after reset differs: %s", n, sum3)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	testutil.Check(t, os.WriteFile(file, []byte("abc"), 0o644))
+	for algorithm, exp := range map[string]string{
+		digest.SHA256: "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		digest.BLAKE3: "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+	} {
+		sum, err := digest.File(algorithm, file)
+		testutil.Check(t, err)
+		if sum != exp {
+			t.Errorf("%s: wrong checksum: %s", algorithm, sum)
+		}
+		if digest.Algorithm(sum) != algorithm {
+			t.Errorf("%s: wrong algorithm: %s", algorithm, digest.Algorithm(sum))
+		}
+	}
+	_, err := digest.File("md5", file)
+	if err == nil || err.Error() != `unknown checksum algorithm "md5"; use one of blake3, sha256` {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = digest.File(digest.SHA256, filepath.Join(tmp, "nope"))
+	if !os.IsNotExist(err) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
 	"time"
@@ -37,6 +38,24 @@ type FileInfo struct {
 	Gid         int
 	Special     string
 	Dev         uint64
+	// Hash is the hex-encoded SHA-256 digest of a file whose contents are stored
+	// by hash in a repository with the content layout. It is empty otherwise. If
+	// Chunked is true, the file is stored in chunks, and Hash is the digest of
+	// the manifest that lists them.
+	Hash    string
+	Chunked bool
+	// BirthTime is the file's creation time. It is only captured on request and
+	// only on platforms and file systems that record it. It is zero otherwise.
+	BirthTime time.Time
+	// Checksum is the digest of a regular file's contents in the form
+	// algorithm:hex, as computed by the digest package. It is only computed on
+	// request and is empty otherwise.
+	Checksum string
+	// Sparse is true for a regular file that occupies less space than its size,
+	// such as a disk image with holes. It is only detected on platforms that
+	// report how much space files occupy. Retrieved copies of sparse files are
+	// given holes where they contain blocks of zeros.
+	Sparse bool
 }
 
 type DirEntry struct {
@@ -45,6 +64,10 @@ type DirEntry struct {
 	S3Time time.Time
 }
 
+// ErrChecksumMismatch is wrapped by errors from Source.Download when the
+// downloaded contents don't match the checksum recorded for them.
+var ErrChecksumMismatch = errors.New("contents don't match checksum")
+
 type Source interface {
 	FullPath(path string) string
 	FileInfo(path string) (*FileInfo, error)
@@ -53,6 +76,20 @@ type Source interface {
 	Download(srcPath string, srcInfo *FileInfo, f *os.File) error
 }
 
+// SameContentsSource is implemented by sources that can tell whether a local
+// file has the same contents as one of theirs without transferring it.
+type SameContentsSource interface {
+	SameContents(localPath *Path, srcPath string) (bool, error)
+}
+
+// ModifyWindowSource is implemented by sources whose modification times are
+// only accurate to within a window, such as those on FAT file systems, which
+// store them to two seconds, or on servers that round them. See
+// SameTimeWithin.
+type ModifyWindowSource interface {
+	ModifyWindow() time.Duration
+}
+
 type Path struct {
 	source Source
 	path   string
@@ -87,15 +124,51 @@ func (p *Path) Download(srcInfo *FileInfo, f *os.File) error {
 
 // Relative returns the path for `other` relative to the current path.
 func (p *Path) Relative(other string) *Path {
-	return NewPath(p.source, filepath.Join(filepath.Dir(p.path), other))
+	return NewPath(p.source, path.Join(path.Dir(p.path), other))
 }
 
 func (p *Path) Join(elem string) *Path {
-	return NewPath(p.source, filepath.Join(p.path, elem))
+	return NewPath(p.source, path.Join(p.path, elem))
+}
+
+// SameTime returns true if t1 and t2 are the same time. Times used to be
+// recorded only to the millisecond, and they still are unless nanoseconds are
+// requested, so if either time is a whole number of milliseconds, they are
+// compared to the millisecond. This keeps files from appearing to have changed
+// when an entry with nanoseconds is compared with an older one.
+func SameTime(t1, t2 time.Time) bool {
+	if t1.Equal(t2) {
+		return true
+	}
+	if SubMillisecond(t1) && SubMillisecond(t2) {
+		return false
+	}
+	return t1.Truncate(time.Millisecond).Equal(t2.Truncate(time.Millisecond))
+}
+
+// SameTimeWithin returns true if t1 and t2 are the same time according to
+// SameTime or differ by no more than window.
+func SameTimeWithin(t1, t2 time.Time, window time.Duration) bool {
+	if SameTime(t1, t2) {
+		return true
+	}
+	d := t1.Sub(t2)
+	if d < 0 {
+		d = -d
+	}
+	return d <= window
+}
+
+// SubMillisecond returns true if t is not a whole number of milliseconds and
+// therefore must be stored with nanosecond precision.
+func SubMillisecond(t time.Time) bool {
+	return t.Nanosecond()%int(time.Millisecond) != 0
 }
 
 // RequiresCopy returns true when src is a plain file and dest is other than a
-// plain file with the same size and modification time. These are the only
+// plain file with the same size and modification time. If dest's source is a
+// ModifyWindowSource, modification times are compared with SameTimeWithin.
+// These are the only
 // conditions under which an actual download/copy is required. In all other
 // cases, the operation to bring the files in sync can be done with the file
 // information alone and doesn't require actually reading the source. It is an
@@ -116,7 +189,11 @@ func RequiresCopy(srcInfo *FileInfo, dest *Path) (bool, error) {
 		// It is the caller's responsibility to make sure we can retrieve this safely.
 		return false, fmt.Errorf("%s exists and is not a plain file", dest.Path())
 	}
-	if destInfo.FileType == TypeFile && destInfo.Size == srcInfo.Size && destInfo.ModTime.Equal(srcInfo.ModTime) {
+	var window time.Duration
+	if ws, ok := dest.source.(ModifyWindowSource); ok {
+		window = ws.ModifyWindow()
+	}
+	if destInfo.FileType == TypeFile && destInfo.Size == srcInfo.Size && SameTimeWithin(destInfo.ModTime, srcInfo.ModTime, window) {
 		return false, nil
 	}
 	return true, nil
@@ -137,7 +214,7 @@ func RetrieveFromInfo(srcInfo *FileInfo, destPath *Path, download func(*os.File)
 	localPath := destPath.Path()
 	if srcInfo.FileType == TypeLink {
 		target, err := os.Readlink(localPath)
-		if err == nil && target == srcInfo.Special {
+		if err == nil && filepath.ToSlash(target) == srcInfo.Special {
 			return false, nil
 		}
 		err = os.MkdirAll(filepath.Dir(localPath), 0777)
@@ -148,7 +225,7 @@ func RetrieveFromInfo(srcInfo *FileInfo, destPath *Path, download func(*os.File)
 		if err != nil {
 			return false, err
 		}
-		err = os.Symlink(srcInfo.Special, localPath)
+		err = os.Symlink(filepath.FromSlash(srcInfo.Special), localPath)
 		if err != nil {
 			return false, err
 		}
@@ -166,10 +243,17 @@ func RetrieveFromInfo(srcInfo *FileInfo, destPath *Path, download func(*os.File)
 			// No action required
 			return false, nil
 		}
-		err = os.MkdirAll(localPath, 0777)
+		err = os.MkdirAll(filepath.Dir(localPath), 0777)
 		if err != nil {
 			return false, err
 		}
+		// Create the directory with no more access than the source has so that it is
+		// never more open than it should be, and then set its mode exactly, which
+		// restores anything the umask removed.
+		err = os.Mkdir(localPath, fs.FileMode(srcInfo.Permissions).Perm())
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return false, err
+		}
 		if err := os.Chmod(localPath, fs.FileMode(srcInfo.Permissions)); err != nil {
 			return false, fmt.Errorf("set mode for %s: %w", localPath, err)
 		}
@@ -198,26 +282,56 @@ func RetrieveFromInfo(srcInfo *FileInfo, destPath *Path, download func(*os.File)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return false, err
 	}
-	f, err := os.Create(localPath)
+	// Download into a temporary file and rename it into place so that a failed or
+	// interrupted download doesn't leave a partial file behind.
+	f, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".qfs-tmp*")
 	if err != nil {
 		return false, err
 	}
-	defer func() { _ = f.Close() }()
+	tmpPath := f.Name()
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+	}()
 	withUnlocked(func() {
 		err = download(f)
+		if errors.Is(err, ErrChecksumMismatch) {
+			// Corruption in transit is the likeliest cause, so try once more. If that
+			// fails too, the local file is left alone.
+			if err = f.Truncate(0); err != nil {
+				// TEST: NOT COVERED
+				return
+			}
+			if _, err = f.Seek(0, io.SeekStart); err != nil {
+				// TEST: NOT COVERED
+				return
+			}
+			err = download(f)
+		}
 	})
 	if err != nil {
 		return false, err
 	}
+	if st, err := f.Stat(); err == nil && srcInfo.Sparse && st.Size() >= sparseBlockSize {
+		withUnlocked(func() {
+			makeSparse(f, st.Size())
+		})
+	}
 	if err := f.Close(); err != nil {
+		// TEST: NOT COVERED
 		return false, err
 	}
-	if err := os.Chtimes(localPath, time.Time{}, srcInfo.ModTime); err != nil {
+	if err := os.Chtimes(tmpPath, time.Time{}, srcInfo.ModTime); err != nil {
+		// TEST: NOT COVERED
 		return false, fmt.Errorf("set times for %s: %w", localPath, err)
 	}
-	if err := os.Chmod(localPath, fs.FileMode(srcInfo.Permissions)); err != nil {
+	if err := os.Chmod(tmpPath, fs.FileMode(srcInfo.Permissions)); err != nil {
+		// TEST: NOT COVERED
 		return false, fmt.Errorf("set mode for %s: %w", localPath, err)
 	}
+	if err := os.Rename(tmpPath, localPath); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
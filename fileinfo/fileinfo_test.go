@@ -1,6 +1,7 @@
 package fileinfo_test
 
 import (
+	"errors"
 	"fmt"
 	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/localsource"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // Most of fileinfo is tested through other packages.
@@ -49,3 +51,152 @@ func TestRequiresCopy(t *testing.T) {
 		t.Errorf("wrong error: %v", err)
 	}
 }
+
+func TestSameTime(t *testing.T) {
+	ms := time.UnixMilli(1713636124123)
+	for _, tc := range []struct {
+		t1, t2 time.Time
+		same   bool
+	}{
+		{ms, ms, true},
+		{ms, time.UnixMilli(1713636124124), false},
+		// A time with nanoseconds matches the same millisecond without them.
+		{ms, ms.Add(456789), true},
+		{ms.Add(456789), ms, true},
+		{ms.Add(456789), ms.Add(1000000), false},
+		// Times with nanoseconds must match exactly.
+		{ms.Add(456789), ms.Add(456789), true},
+		{ms.Add(456789), ms.Add(456788), false},
+	} {
+		if fileinfo.SameTime(tc.t1, tc.t2) != tc.same {
+			t.Errorf("%v, %v: expected %v", tc.t1, tc.t2, tc.same)
+		}
+	}
+}
+
+func TestModifyWindow(t *testing.T) {
+	ms := time.UnixMilli(1713636124000)
+	for _, tc := range []struct {
+		t1, t2 time.Time
+		same   bool
+	}{
+		{ms, ms.Add(2 * time.Second), true},
+		{ms.Add(2 * time.Second), ms, true},
+		{ms, ms.Add(2001 * time.Millisecond), false},
+	} {
+		if fileinfo.SameTimeWithin(tc.t1, tc.t2, 2*time.Second) != tc.same {
+			t.Errorf("%v, %v: expected %v", tc.t1, tc.t2, tc.same)
+		}
+	}
+
+	// The destination's window determines whether a copy is required.
+	tmp := t.TempDir()
+	testutil.Check(t, os.WriteFile(filepath.Join(tmp, "one"), []byte("potato"), 0666))
+	testutil.Check(t, os.Chtimes(filepath.Join(tmp, "one"), time.Time{}, ms))
+	srcInfo := &fileinfo.FileInfo{
+		Path:     "one",
+		FileType: fileinfo.TypeFile,
+		ModTime:  ms.Add(time.Second),
+		Size:     6,
+	}
+	for _, tc := range []struct {
+		window   time.Duration
+		required bool
+	}{
+		{0, true},
+		{2 * time.Second, false},
+	} {
+		dest := localsource.New(tmp, localsource.WithModifyWindow(tc.window))
+		x, err := fileinfo.RequiresCopy(srcInfo, fileinfo.NewPath(dest, "one"))
+		testutil.Check(t, err)
+		if x != tc.required {
+			t.Errorf("window %v: expected %v", tc.window, tc.required)
+		}
+	}
+}
+
+func TestOwnerMap(t *testing.T) {
+	m := &fileinfo.OwnerMap{
+		Uids: map[int]int{},
+		Gids: map[int]int{},
+	}
+	testutil.Check(t, fileinfo.ParseIdMap("1001:2001", m.Uids))
+	testutil.Check(t, fileinfo.ParseIdMap("1002:2002", m.Gids))
+	for _, spec := range []string{"1001", "x:1", "1:-2"} {
+		if err := fileinfo.ParseIdMap(spec, m.Uids); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+	check := func(owner *fileinfo.Owner, uid, gid int) {
+		t.Helper()
+		u, g := m.Resolve(owner)
+		if u != uid || g != gid {
+			t.Errorf("%#v: got %d:%d, wanted %d:%d", owner, u, g, uid, gid)
+		}
+	}
+	// Mappings take precedence over names.
+	check(&fileinfo.Owner{Uid: 1001, Gid: 1002, User: "root", Group: "root"}, 2001, 2002)
+	// Names are matched when they exist.
+	check(&fileinfo.Owner{Uid: 1234, Gid: 1235, User: "root", Group: "root"}, 0, 0)
+	check(&fileinfo.Owner{Uid: 1234, Gid: 1235, User: "no-such-user", Group: "no-such-group"}, 1234, 1235)
+	check(&fileinfo.Owner{Uid: 1234, Gid: 1235}, 1234, 1235)
+	m.NumericIds = true
+	check(&fileinfo.Owner{Uid: 1234, Gid: 1235, User: "root", Group: "root"}, 1234, 1235)
+	check(&fileinfo.Owner{Uid: 1001, Gid: 1002, User: "root", Group: "root"}, 2001, 2002)
+}
+
+func TestRetrieveChecksumMismatch(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	testutil.Check(t, os.WriteFile(j("one"), []byte("old"), 0666))
+	destPath := fileinfo.NewPath(localsource.New(tmp), "one")
+	srcInfo := &fileinfo.FileInfo{
+		Path:        "one",
+		FileType:    fileinfo.TypeFile,
+		ModTime:     time.UnixMilli(1715443000777),
+		Size:        6,
+		Permissions: 0644,
+	}
+	// Each call writes bad contents until good is true.
+	calls := 0
+	download := func(good bool) func(*os.File) error {
+		return func(f *os.File) error {
+			calls++
+			if good && calls > 1 {
+				_, err := f.WriteString("potato")
+				return err
+			}
+			_, _ = f.WriteString("garbage")
+			return fmt.Errorf("download: %w", fileinfo.ErrChecksumMismatch)
+		}
+	}
+
+	// A second failure is returned, and the local file is unchanged.
+	_, err := fileinfo.RetrieveFromInfo(srcInfo, destPath, download(false))
+	if !errors.Is(err, fileinfo.ErrChecksumMismatch) || calls != 2 {
+		t.Errorf("wrong result: %v, %d calls", err, calls)
+	}
+	data, err := os.ReadFile(j("one"))
+	testutil.Check(t, err)
+	if string(data) != "old" {
+		t.Errorf("wrong contents: %q", data)
+	}
+
+	// A failure followed by a good download is retried with the partial
+	// contents discarded.
+	calls = 0
+	changed, err := fileinfo.RetrieveFromInfo(srcInfo, destPath, download(true))
+	testutil.Check(t, err)
+	data, err = os.ReadFile(j("one"))
+	testutil.Check(t, err)
+	if !changed || calls != 2 || string(data) != "potato" {
+		t.Errorf("wrong result: %v, %d calls, %q", changed, calls, data)
+	}
+	entries, err := os.ReadDir(tmp)
+	testutil.Check(t, err)
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
@@ -0,0 +1,90 @@
+package fileinfo
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Owner is the ownership of a file at the time it was captured. User and Group
+// may be empty if the names were not known.
+type Owner struct {
+	Uid   int
+	Gid   int
+	User  string
+	Group string
+}
+
+// OwnerSource is implemented by sources that can report the original ownership
+// of their files.
+type OwnerSource interface {
+	// Owner returns the ownership of the file at path, or nil if it is not known.
+	Owner(path string, info *FileInfo) (*Owner, error)
+}
+
+// OwnerMap determines the ownership given to retrieved files. By default, users
+// and groups are matched by name, falling back to the original numeric IDs if
+// the name doesn't exist locally. If NumericIds is set, names are ignored. Uids
+// and Gids map original IDs to local IDs and take precedence over names.
+type OwnerMap struct {
+	NumericIds bool
+	Uids       map[int]int
+	Gids       map[int]int
+}
+
+// ParseIdMap parses a mapping of the form old:new and adds it to m.
+func ParseIdMap(spec string, m map[int]int) error {
+	oldId, newId, found := strings.Cut(spec, ":")
+	if !found {
+		return fmt.Errorf("%s: id map must be old:new", spec)
+	}
+	o, err := strconv.Atoi(oldId)
+	if err != nil || o < 0 {
+		return fmt.Errorf("%s: invalid id %q", spec, oldId)
+	}
+	n, err := strconv.Atoi(newId)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s: invalid id %q", spec, newId)
+	}
+	m[o] = n
+	return nil
+}
+
+// Resolve returns the local uid and gid for owner.
+func (m *OwnerMap) Resolve(owner *Owner) (int, int) {
+	uid, gid := owner.Uid, owner.Gid
+	if newUid, ok := m.Uids[owner.Uid]; ok {
+		uid = newUid
+	} else if !m.NumericIds && owner.User != "" {
+		if u, err := user.Lookup(owner.User); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+	if newGid, ok := m.Gids[owner.Gid]; ok {
+		gid = newGid
+	} else if !m.NumericIds && owner.Group != "" {
+		if g, err := user.LookupGroup(owner.Group); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+	return uid, gid
+}
+
+// Apply sets the ownership of path based on owner. It does nothing if owner is
+// nil.
+func (m *OwnerMap) Apply(path string, owner *Owner) error {
+	if owner == nil {
+		return nil
+	}
+	uid, gid := m.Resolve(owner)
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("chown %d:%d %s: %w", uid, gid, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package fileinfo
+
+import (
+	"bytes"
+	"os"
+)
+
+// sparseBlockSize is the unit in which zeros are replaced with holes. It is a
+// multiple of the block size of common file systems.
+const sparseBlockSize = 64 << 10
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// makeSparse replaces blocks of zeros in f, whose size is size, with holes so
+// that sparse files, such as disk images, don't take up more space than they
+// did where they came from. Only whole blocks are replaced, and ranges that are
+// already holes are skipped. This is best effort: if the platform or file
+// system doesn't support holes, f is left as it is.
+func makeSparse(f *os.File, size int64) {
+	if !holesSupported {
+		return
+	}
+	buf := make([]byte, sparseBlockSize)
+	var holeStart int64 = -1
+	punch := func(end int64) bool {
+		if holeStart >= 0 && end > holeStart {
+			if err := punchHole(f, holeStart, end-holeStart); err != nil {
+				return false
+			}
+		}
+		holeStart = -1
+		return true
+	}
+	for offset := int64(0); offset+sparseBlockSize <= size; offset += sparseBlockSize {
+		if next := NextData(f, offset); next >= offset+sparseBlockSize {
+			// Already a hole; skip to the block containing the next data.
+			if !punch(offset) {
+				return
+			}
+			offset = next/sparseBlockSize*sparseBlockSize - sparseBlockSize
+			continue
+		}
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			// TEST: NOT COVERED
+			return
+		}
+		if bytes.Equal(buf, zeroBlock) {
+			if holeStart < 0 {
+				holeStart = offset
+			}
+		} else if !punch(offset) {
+			return
+		}
+	}
+	punch(size / sparseBlockSize * sparseBlockSize)
+}
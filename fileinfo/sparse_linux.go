@@ -0,0 +1,39 @@
+//go:build linux
+
+package fileinfo
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const holesSupported = true
+
+const (
+	seekData        = 3
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// NextData returns the offset of the first byte of data in f at or after
+// offset, skipping holes in sparse files. If there is no more data, it returns
+// the size of the file. If holes can't be detected, it returns offset.
+func NextData(f *os.File, offset int64) int64 {
+	next, err := f.Seek(offset, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		if st, err := f.Stat(); err == nil {
+			return max(offset, st.Size())
+		}
+	}
+	if err != nil {
+		// TEST: NOT COVERED. The file system doesn't support SEEK_DATA.
+		return offset
+	}
+	return next
+}
+
+// punchHole deallocates a range of f, which then reads as zeros.
+func punchHole(f *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, offset, length)
+}
@@ -0,0 +1,77 @@
+package fileinfo_test
+
+import (
+	"bytes"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/testutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSparse(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string {
+		return filepath.Join(tmp, path)
+	}
+	const mb = 1 << 20
+	// The source has data between two holes. The destination is written with
+	// zeros, which are turned back into holes.
+	testutil.Check(t, os.Mkdir(j("src"), 0o777))
+	f, err := os.Create(j("src/image"))
+	testutil.Check(t, err)
+	testutil.Check(t, f.Truncate(4*mb))
+	_, err = f.WriteAt(bytes.Repeat([]byte("data"), mb/4), 2*mb)
+	testutil.Check(t, err)
+	if next := fileinfo.NextData(f, 0); next != 2*mb && next != 0 {
+		// 0 means the file system doesn't report holes.
+		t.Errorf("wrong next data: %d", next)
+	}
+	if next := fileinfo.NextData(f, 3*mb+1); next != 4*mb && next != 3*mb+1 {
+		t.Errorf("wrong next data at end: %d", next)
+	}
+	testutil.Check(t, f.Close())
+	srcInfo, err := localsource.New(j("src")).FileInfo("image")
+	testutil.Check(t, err)
+	if !srcInfo.Sparse {
+		// Some file systems, such as tmpfs on older kernels, don't create holes.
+		t.Skip("the file system doesn't support sparse files")
+	}
+
+	testutil.Check(t, os.Mkdir(j("dest"), 0o777))
+	src := fileinfo.NewPath(localsource.New(j("src")), "image")
+	dest := fileinfo.NewPath(localsource.New(j("dest")), "image")
+	_, err = fileinfo.Retrieve(src, dest)
+	testutil.Check(t, err)
+	srcData, err := os.ReadFile(j("src/image"))
+	testutil.Check(t, err)
+	destData, err := os.ReadFile(j("dest/image"))
+	testutil.Check(t, err)
+	if !bytes.Equal(srcData, destData) {
+		t.Fatal("contents differ")
+	}
+	var st syscall.Stat_t
+	testutil.Check(t, syscall.Stat(j("dest/image"), &st))
+	if st.Blocks*512 > 2*mb {
+		t.Errorf("destination is not sparse: %d blocks", st.Blocks)
+	}
+
+	// A file that isn't sparse is retrieved as it is, even if it contains zeros,
+	// since it may have been allocated on purpose.
+	testutil.Check(t, os.WriteFile(j("src/dense"), make([]byte, mb), 0o644))
+	src = fileinfo.NewPath(localsource.New(j("src")), "dense")
+	info, err := src.FileInfo()
+	testutil.Check(t, err)
+	if info.Sparse {
+		t.Error("dense file is marked sparse")
+	}
+	dest = fileinfo.NewPath(localsource.New(j("dest")), "dense")
+	_, err = fileinfo.Retrieve(src, dest)
+	testutil.Check(t, err)
+	testutil.Check(t, syscall.Stat(j("dest/dense"), &st))
+	if st.Blocks*512 < mb {
+		t.Errorf("destination was made sparse: %d blocks", st.Blocks)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package fileinfo
+
+import (
+	"errors"
+	"os"
+)
+
+const holesSupported = false
+
+// NextData returns offset since holes in sparse files can't be detected on this
+// platform.
+func NextData(_ *os.File, offset int64) int64 {
+	return offset
+}
+
+func punchHole(*os.File, int64, int64) error {
+	return errors.ErrUnsupported
+}
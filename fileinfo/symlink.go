@@ -0,0 +1,60 @@
+package fileinfo
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SymlinkMode determines how symbolic links are handled when files are
+// retrieved. This matters on platforms, such as Windows, where creating
+// symbolic links may not be possible.
+type SymlinkMode int
+
+const (
+	// SymlinkCreate creates symbolic links. On Windows, these are NTFS symbolic
+	// links, which require Developer Mode or administrator privileges.
+	SymlinkCreate SymlinkMode = iota
+	// SymlinkSkip doesn't create symbolic links.
+	SymlinkSkip
+	// SymlinkCopy creates a copy of the link's target if it is a regular file.
+	SymlinkCopy
+	// SymlinkFollow creates symbolic links like SymlinkCreate, but when scanning,
+	// symbolic links to directories are followed, so the directories' contents
+	// are treated as if they were at the link's path.
+	SymlinkFollow
+)
+
+func ParseSymlinkMode(mode string) (SymlinkMode, error) {
+	switch mode {
+	case "create":
+		return SymlinkCreate, nil
+	case "skip":
+		return SymlinkSkip, nil
+	case "copy":
+		return SymlinkCopy, nil
+	case "follow":
+		return SymlinkFollow, nil
+	}
+	return SymlinkCreate, fmt.Errorf("symbolic link mode must be create, skip, copy, or follow")
+}
+
+// CreatesLinks returns true if symbolic links are created when files are
+// retrieved.
+func (m SymlinkMode) CreatesLinks() bool {
+	return m == SymlinkCreate || m == SymlinkFollow
+}
+
+// LinkTarget returns the path, relative to the same top as info, of the target
+// of the symbolic link described by info. It returns false if the target is
+// absolute or outside the top.
+func LinkTarget(info *FileInfo) (string, bool) {
+	if info.FileType != TypeLink || path.IsAbs(info.Special) {
+		return "", false
+	}
+	target := path.Join(path.Dir(info.Path), info.Special)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", false
+	}
+	return target, true
+}
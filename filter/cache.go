@@ -0,0 +1,278 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// IgnoreFile is the name of the files that prune paths within the directories
+// that contain them. Each line is a path relative to the directory, or a
+// `*/base`, `*.ext`, or `:re:pattern` rule that applies at any level beneath
+// it, as in a filter's prune section. Lines starting with # are comments.
+const IgnoreFile = ".qfsignore"
+
+// Whether a path is included depends on prune, include, and exclude rules that
+// match its ancestor directories as well as the path itself. During a
+// traversal, every path in a directory has the same ancestors, so a Cache
+// remembers what was decided about each directory. Checking a path then only
+// has to match rules against the path itself and look up its parent directory.
+
+// Cache answers the same questions as IsIncluded and IsIncludedFile for a fixed
+// set of filters, remembering the decisions about directories so that they are
+// not repeated for every path beneath them. Create one per traversal; it is
+// safe for concurrent use. The filters must not be changed while it is in use.
+type Cache struct {
+	repoRules bool
+	filters   []*Filter
+	mutex     sync.Mutex
+	dirs      map[string]*dirState // nil if decisions are not remembered
+	// ignores maps directories to the rules read from their ignore files.
+	ignores map[string]*filterGroup
+}
+
+// ignoreRules are the rules from the ignore file in dir.
+type ignoreRules struct {
+	dir   string
+	rules *filterGroup
+}
+
+// dirState records what the rules that match a directory or its ancestors
+// decide about paths within it.
+type dirState struct {
+	pruned bool
+	// groups holds, for each filter, Include or Exclude if the directory or its
+	// nearest ancestor matching either group matched that group, or NoGroup.
+	groups []Group
+	// ignores holds the ignore rules of the directory and its ancestors.
+	ignores []ignoreRules
+}
+
+// NewCache returns a Cache for the given filters. repoRules has the same meaning
+// as for IsIncluded.
+func NewCache(repoRules bool, filters ...*Filter) *Cache {
+	return &Cache{
+		repoRules: repoRules,
+		filters:   filters,
+		dirs:      map[string]*dirState{},
+		ignores:   map[string]*filterGroup{},
+	}
+}
+
+// ReadIgnoreFile reads the ignore file at p, which is in dir, so that its rules
+// apply to paths beneath dir. During a traversal, call it after reading a
+// directory and before checking any of its entries. Ignore files only work with
+// a cache created by NewCache.
+func (c *Cache) ReadIgnoreFile(p *fileinfo.Path, dir string) error {
+	r, err := p.Open()
+	if err != nil {
+		return fmt.Errorf("open %s: %w", p.Path(), err)
+	}
+	defer func() { _ = r.Close() }()
+	rules := newFilterGroup()
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "." {
+			return fmt.Errorf("%s:%d: an ignore file can't ignore its own directory", p.Path(), lineNo)
+		}
+		if err = rules.addRule(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", p.Path(), lineNo, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("read %s: %w", p.Path(), err)
+	}
+	c.mutex.Lock()
+	c.ignores[dir] = rules
+	c.mutex.Unlock()
+	return nil
+}
+
+// dirIgnores returns the rules from the ignore file in dir, if any.
+func (c *Cache) dirIgnores(dir string) []ignoreRules {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if rules, ok := c.ignores[dir]; ok {
+		return []ignoreRules{{dir: dir, rules: rules}}
+	}
+	return nil
+}
+
+// ignored returns whether any of the ignore rules match relPath.
+func ignored(relPath string, ignores []ignoreRules) bool {
+	base := path.Base(relPath)
+	for _, ig := range ignores {
+		rel := relPath
+		if ig.dir != "." {
+			rel = strings.TrimPrefix(relPath, ig.dir+"/")
+		}
+		if ig.rules.match(rel, base, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// state returns the dirState for dir, which must not be ".".
+func (c *Cache) state(dir string) *dirState {
+	if c.dirs != nil {
+		c.mutex.Lock()
+		s, ok := c.dirs[dir]
+		c.mutex.Unlock()
+		if ok {
+			return s
+		}
+	}
+	var parent *dirState
+	inherited := c.dirIgnores(".")
+	if p := path.Dir(dir); p != "." {
+		parent = c.state(p)
+		inherited = parent.ignores
+	}
+	base := path.Base(dir)
+	s := &dirState{pruned: parent != nil && parent.pruned}
+	if !s.pruned && ignored(dir, inherited) {
+		s.pruned = true
+	}
+	for _, f := range c.filters {
+		if f.groups[Prune].match(dir, base, false) {
+			s.pruned = true
+			break
+		}
+	}
+	if !s.pruned {
+		// Nothing beneath a pruned directory is checked further, so its groups are
+		// never needed.
+		s.ignores = append(slices.Clip(inherited), c.dirIgnores(dir)...)
+		s.groups = make([]Group, len(c.filters))
+		for i, f := range c.filters {
+			switch {
+			case f.groups[Include].match(dir, base, false):
+				s.groups[i] = Include
+			case f.groups[Exclude].match(dir, base, false):
+				s.groups[i] = Exclude
+			case parent != nil:
+				s.groups[i] = parent.groups[i]
+			default:
+				s.groups[i] = NoGroup
+			}
+		}
+	}
+	if c.dirs != nil {
+		c.mutex.Lock()
+		c.dirs[dir] = s
+		c.mutex.Unlock()
+	}
+	return s
+}
+
+// IsIncluded is like the IsIncluded function using the cache's filters.
+func (c *Cache) IsIncluded(relPath string) (included bool, group Group) {
+	if path.IsAbs(relPath) {
+		panic("Filter.IsIncluded must be called with a relative path")
+	}
+	base := path.Base(relPath)
+	for _, f := range c.filters {
+		for _, j := range f.junk {
+			if j.MatchString(base) {
+				return false, Junk
+			}
+		}
+	}
+
+	if c.repoRules {
+		// When working with repositories, override the filters' treatment of the .qfs
+		// directory. Most of the contents are specific to the local site, and it's
+		// important for filters to be included across all sites except for those the
+		// site keeps to itself.
+		if repofiles.IsLocalFilter(relPath) {
+			return false, RepoRule
+		} else if strings.HasPrefix(relPath, repofiles.Filters+"/") {
+			return true, RepoRule
+		} else if relPath == repofiles.Top {
+			return true, RepoRule
+		} else if strings.HasPrefix(relPath, repofiles.Top+"/") {
+			return false, RepoRule
+		}
+	}
+
+	var ancestors *dirState
+	ignores := c.dirIgnores(".")
+	if dir := path.Dir(relPath); dir != "." {
+		ancestors = c.state(dir)
+		ignores = ancestors.ignores
+	}
+
+	// Check prune. Nothing can override prune, so we can return immediately if we
+	// get a match. Rules from ignore files work like prune rules.
+	if ancestors != nil && ancestors.pruned {
+		return false, Prune
+	}
+	if ignored(relPath, ignores) {
+		return false, Prune
+	}
+	if len(c.filters) == 0 {
+		// No filters = include everything.
+		return true, Default
+	}
+	for _, f := range c.filters {
+		if f.groups[Prune].match(relPath, base, false) {
+			return false, Prune
+		}
+	}
+
+	// Check include/exclude for the path itself and then for its ancestors. A lower
+	// directory include can override a higher directory exclude, and a path needs
+	// to be included by all filters to be included.
+	includeMatched := false
+	defaultInclude := true
+	usedFalseDefault := false
+	for i, f := range c.filters {
+		if !f.defaultInclude() {
+			// If any filter has defaultInclude false, that becomes the overall default.
+			defaultInclude = false
+		}
+		g := NoGroup
+		if f.groups[Include].match(relPath, base, true) {
+			g = Include
+		} else if f.groups[Exclude].match(relPath, base, false) {
+			g = Exclude
+		} else if ancestors != nil {
+			g = ancestors.groups[i]
+		}
+		switch g {
+		case Include:
+			// The file could still be explicitly excluded by a later filter.
+			includeMatched = true
+		case Exclude:
+			return false, Exclude
+		default:
+			if !f.defaultInclude() {
+				usedFalseDefault = true
+			}
+		}
+	}
+	if includeMatched && !usedFalseDefault {
+		// This was explicitly included by all filters.
+		return true, Include
+	}
+	return defaultInclude, Default
+}
+
+// IsIncludedFile is like the IsIncludedFile function using the cache's filters.
+func (c *Cache) IsIncludedFile(info *fileinfo.FileInfo) (included bool, group Group) {
+	included, group = c.IsIncluded(info.Path)
+	return applyLimits(info, included, group, c.filters)
+}
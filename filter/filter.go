@@ -5,10 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jberkenbilt/qfs/fileinfo"
-	"github.com/jberkenbilt/qfs/repofiles"
-	"path/filepath"
+	"github.com/jberkenbilt/qfs/misc"
+	"path"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type filterGroup struct {
@@ -34,17 +35,44 @@ const (
 	Junk
 	Default
 	RepoRule
+	Limit
 )
 
+func (g Group) String() string {
+	switch g {
+	case Prune:
+		return "prune"
+	case Include:
+		return "include"
+	case Exclude:
+		return "exclude"
+	case Junk:
+		return "junk"
+	case Default:
+		return "default"
+	case RepoRule:
+		return "repository rule"
+	case Limit:
+		return "size or age limit"
+	}
+	return "none"
+}
+
 const (
-	kwdPrune   = ":prune:"
-	kwdInclude = ":include:"
-	kwdExclude = ":exclude:"
-	prefixRead = ":read:"
-	prefixJunk = ":junk:"
-	prefixRe   = ":re:"
-	prefixBase = "*/"
-	prefixExt  = "*."
+	kwdPrune      = ":prune:"
+	kwdInclude    = ":include:"
+	kwdExclude    = ":exclude:"
+	prefixRead    = ":read:"
+	prefixJunk    = ":junk:"
+	prefixMaxSize = ":exclude-larger:"
+	prefixMaxAge  = ":exclude-older:"
+	prefixStorage = ":storage-class:"
+	prefixIncGrp  = ":include-group:"
+	prefixExcGrp  = ":exclude-group:"
+	prefixPrnGrp  = ":prune-group:"
+	prefixRe      = ":re:"
+	prefixBase    = "*/"
+	prefixExt     = "*."
 )
 
 func newFilterGroup() *filterGroup {
@@ -56,11 +84,30 @@ func newFilterGroup() *filterGroup {
 }
 
 type Filter struct {
-	groups     []*filterGroup
-	junk       *regexp.Regexp
+	groups []*filterGroup
+	// junk patterns are matched in the order in which they were added.
+	junk       []*regexp.Regexp
 	includeDot *bool
+	// maxSize and maxAge are zero if there is no limit.
+	maxSize int64
+	maxAge  time.Duration
+	// storageClasses are in the order in which they first appear.
+	storageClasses []*storageClass
+	// siteGroups maps the names of site groups to whether the site whose filter
+	// this is belongs to them.
+	siteGroups map[string]bool
 }
 
+// A storageClass associates paths with the S3 storage class used for their
+// contents.
+type storageClass struct {
+	name  string
+	rules *filterGroup
+}
+
+// now is replaced by tests.
+var now = time.Now
+
 func (f *Filter) defaultInclude() bool {
 	if f.includeDot != nil {
 		return *f.includeDot
@@ -92,7 +139,7 @@ func (f *Filter) AddPath(g Group, val string) {
 		// documented as a known issue in README.md and exercised in the test suite.
 		cur := val
 		for cur != "." {
-			cur = filepath.Dir(cur)
+			cur = path.Dir(cur)
 			f.groups[g].fullPath[cur] = struct{}{}
 		}
 	}
@@ -103,21 +150,29 @@ func (f *Filter) AddBase(g Group, val string) {
 }
 
 func (f *Filter) AddPattern(g Group, val string) error {
+	re, err := compilePattern(val)
+	if err != nil {
+		return err
+	}
+	f.groups[g].pattern = append(f.groups[g].pattern, re)
+	return nil
+}
+
+func compilePattern(val string) (*regexp.Regexp, error) {
 	if val == "" {
-		return fmt.Errorf("empty pattern not allowed")
+		return nil, fmt.Errorf("empty pattern not allowed")
 	}
 	re, err := regexp.Compile(val)
 	if err != nil {
-		return fmt.Errorf("regexp error on %s: %w", val, err)
+		return nil, fmt.Errorf("regexp error on %s: %w", val, err)
 	}
-	f.groups[g].pattern = append(f.groups[g].pattern, re)
-	return nil
+	return re, nil
 }
 
+// SetJunk adds a junk pattern. A file is junk if its base matches any of the
+// filter's junk patterns, so each filter file, including nested ones, may add
+// its own. Adding a pattern that is already present has no effect.
 func (f *Filter) SetJunk(val string) error {
-	if f.junk != nil {
-		return errors.New("only one junk directive allowed per filter (including nested)")
-	}
 	if val == "" {
 		return fmt.Errorf("empty pattern not allowed")
 	}
@@ -125,7 +180,97 @@ func (f *Filter) SetJunk(val string) error {
 	if err != nil {
 		return fmt.Errorf("regexp error on %s: %w", val, err)
 	}
-	f.junk = re
+	for _, j := range f.junk {
+		if j.String() == re.String() {
+			return nil
+		}
+	}
+	f.junk = append(f.junk, re)
+	return nil
+}
+
+// SetMaxSize causes regular files larger than size bytes to be excluded.
+func (f *Filter) SetMaxSize(size int64) error {
+	if f.maxSize != 0 {
+		return errors.New("only one exclude-larger directive allowed per filter (including nested)")
+	}
+	if size <= 0 {
+		return errors.New("exclude-larger size must be positive")
+	}
+	f.maxSize = size
+	return nil
+}
+
+// SetMaxAge causes regular files last modified longer ago than age to be
+// excluded.
+func (f *Filter) SetMaxAge(age time.Duration) error {
+	if f.maxAge != 0 {
+		return errors.New("only one exclude-older directive allowed per filter (including nested)")
+	}
+	f.maxAge = age
+	return nil
+}
+
+// StorageClass returns the storage class associated with relPath by
+// :storage-class: directives or "" if there is none. As with include and
+// exclude, a match on a longer portion of the path wins. If a path is listed
+// under more than one storage class, the one that appears first in the filter
+// wins.
+func (f *Filter) StorageClass(relPath string) string {
+	cur := relPath
+	for {
+		base := path.Base(cur)
+		for _, sc := range f.storageClasses {
+			if sc.rules.match(cur, base, false) {
+				return sc.name
+			}
+		}
+		cur = path.Dir(cur)
+		if cur == "." {
+			return ""
+		}
+	}
+}
+
+// StorageClasses returns the names of the storage classes that appear in the
+// filter.
+func (f *Filter) StorageClasses() []string {
+	var result []string
+	for _, sc := range f.storageClasses {
+		result = append(result, sc.name)
+	}
+	return result
+}
+
+func (f *Filter) storageClass(name string) *storageClass {
+	for _, sc := range f.storageClasses {
+		if sc.name == name {
+			return sc
+		}
+	}
+	sc := &storageClass{name: name, rules: newFilterGroup()}
+	f.storageClasses = append(f.storageClasses, sc)
+	return sc
+}
+
+// addRule adds a path, base, or pattern rule to fg.
+func (fg *filterGroup) addRule(line string) error {
+	switch {
+	case line == ".":
+		return errors.New("default path directive only allowed in include or exclude")
+	case strings.HasPrefix(line, prefixRe):
+		re, err := compilePattern(line[len(prefixRe):])
+		if err != nil {
+			return err
+		}
+		fg.pattern = append(fg.pattern, re)
+	case strings.HasPrefix(line, prefixBase):
+		fg.base[line[len(prefixBase):]] = struct{}{}
+	case strings.HasPrefix(line, prefixExt):
+		fg.pattern = append(fg.pattern, regexp.MustCompile(regexp.QuoteMeta("."+line[len(prefixExt):])+`$`))
+	default:
+		fg.path[line] = struct{}{}
+	}
 	return nil
 }
 
@@ -167,7 +312,7 @@ func (fg *filterGroup) match(path string, base string, checkFullPath bool) bool
 // it is called after junk, and if it returns true, the file is included without
 // checking other filters.
 func IsIncluded(
-	path string,
+	relPath string,
 	repoRules bool,
 	filters ...*Filter,
 ) (included bool, group Group) {
@@ -179,90 +324,77 @@ func IsIncluded(
 	// `a/b` is pruned, it will not be considered even if `a/b/c` is included. If
 	// `a/b` is excluded and `a/b/c` is included, `a/b/c` will be considered
 	// included, but `a/b/x` would not. At each point, check explicit matches before
-	// patterns.
+	// patterns. The work is done by a Cache that doesn't remember anything; use
+	// NewCache to check many paths.
+	return (&Cache{repoRules: repoRules, filters: filters}).IsIncluded(relPath)
+}
 
-	if filepath.IsAbs(path) {
-		panic("Filter.IsIncluded must be called with a relative path")
+// IsIncludedFile is like IsIncluded but also applies the filters' size and age
+// limits to info. The limits only apply to regular files, and they don't apply
+// to paths that are included by repository rules. If info is excluded because
+// of a limit, the group is Limit.
+func IsIncludedFile(
+	info *fileinfo.FileInfo,
+	repoRules bool,
+	filters ...*Filter,
+) (included bool, group Group) {
+	included, group = IsIncluded(info.Path, repoRules, filters...)
+	return applyLimits(info, included, group, filters)
+}
+
+// applyLimits applies the filters' size and age limits to info given the result
+// of IsIncluded for its path.
+func applyLimits(
+	info *fileinfo.FileInfo,
+	included bool,
+	group Group,
+	filters []*Filter,
+) (bool, Group) {
+	if !included || group == RepoRule || info.FileType != fileinfo.TypeFile {
+		return included, group
 	}
-	base := filepath.Base(path)
 	for _, f := range filters {
-		if f.junk != nil && f.junk.MatchString(base) {
-			return false, Junk
+		if f.maxSize > 0 && info.Size > f.maxSize {
+			return false, Limit
 		}
-	}
-
-	if repoRules {
-		// When working with repositories, override the filters' treatment of the .qfs
-		// directory. Most of the contents are specific to the local site, and it's
-		// important for filters to be included across all sites.
-		if strings.HasPrefix(path, repofiles.Filters+"/") {
-			return true, RepoRule
-		} else if path == repofiles.Top {
-			return true, RepoRule
-		} else if strings.HasPrefix(path, repofiles.Top+"/") {
-			return false, RepoRule
+		if f.maxAge > 0 && now().Sub(info.ModTime) > f.maxAge {
+			return false, Limit
 		}
 	}
+	return included, group
+}
 
-	if len(filters) == 0 {
-		// No filters = include everything.
-		return true, Default
-	}
+// SetSiteGroups gives the site groups that :include-group:, :exclude-group:,
+// and :prune-group: directives may name, mapped to whether the site whose
+// filter this is belongs to them. It must be called before ReadFile. If it
+// isn't called, group directives apply to no site.
+func (f *Filter) SetSiteGroups(groups map[string]bool) {
+	f.siteGroups = groups
+}
 
-	// Check prune. Prune is checked at each path level. Nothing can override prune,
-	// so we can return immediately if we get a match.
-	cur := path
-	for { // each path level
-		base = filepath.Base(cur)
-		for _, f := range filters {
-			if f.groups[Prune].match(cur, base, false) {
-				return false, Prune
-			}
-		}
-		cur = filepath.Dir(cur)
-		if cur == "." {
-			break
-		}
+// readGroupDirective returns the group of a group directive and whether the
+// paths that follow it apply.
+func (f *Filter) readGroupDirective(line string) (Group, bool, error) {
+	var group Group
+	var name string
+	if val, ok := strings.CutPrefix(line, prefixIncGrp); ok {
+		group, name = Include, val
+	} else if val, ok = strings.CutPrefix(line, prefixExcGrp); ok {
+		group, name = Exclude, val
+	} else {
+		group, name = Prune, line[len(prefixPrnGrp):]
 	}
-
-	// Check include/exclude. A lower directory include can override a higher
-	// directory exclude, and a path needs to be included by all filters to be
-	// included.
-	includeMatched := false
-	defaultInclude := true
-	usedFalseDefault := false
-	for _, f := range filters {
-		if !f.defaultInclude() {
-			// If any filter has defaultInclude false, that becomes the overall default.
-			defaultInclude = false
-		}
-		cur = path
-	thisFilter:
-		for {
-			base = filepath.Base(cur)
-			if f.groups[Include].match(cur, base, cur == path) {
-				// We can stop testing this filter, but the file could still be explicitly
-				// excluded by a later filter.
-				includeMatched = true
-				break thisFilter
-			}
-			if f.groups[Exclude].match(cur, base, false) {
-				return false, Exclude
-			}
-			cur = filepath.Dir(cur)
-			if cur == "." {
-				if !f.defaultInclude() {
-					usedFalseDefault = true
-				}
-				break
-			}
-		}
+	if name == "" {
+		return group, false, errors.New("group name required")
+	}
+	if f.siteGroups == nil {
+		return group, false, nil
 	}
-	if includeMatched && !usedFalseDefault {
-		// This was explicitly included by all filters.
-		return true, Include
+	member, ok := f.siteGroups[name]
+	if !ok {
+		return group, false, fmt.Errorf("unknown site group %s", name)
 	}
-	return defaultInclude, Default
+	return group, member, nil
 }
 
 func (f *Filter) ReadLine(group Group, line string) error {
@@ -299,6 +431,7 @@ func (f *Filter) ReadFile(path *fileinfo.Path, pruneOnly bool) error {
 		stTop = iota
 		stGroup
 		stIgnore
+		stStorageClass
 	)
 	r, err := path.Open()
 	if err != nil {
@@ -309,6 +442,7 @@ func (f *Filter) ReadFile(path *fileinfo.Path, pruneOnly bool) error {
 	scanner.Split(bufio.ScanLines)
 	state := stTop
 	group := NoGroup
+	var class *storageClass
 	lineNo := 0
 	if pruneOnly {
 		f.SetDefaultInclude(true)
@@ -344,6 +478,19 @@ func (f *Filter) ReadFile(path *fileinfo.Path, pruneOnly bool) error {
 				state = stGroup
 				group = Exclude
 			}
+		case strings.HasPrefix(line, prefixIncGrp),
+			strings.HasPrefix(line, prefixExcGrp),
+			strings.HasPrefix(line, prefixPrnGrp):
+			g, applies, err := f.readGroupDirective(line)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path.Path(), lineNo, err)
+			}
+			if !applies || (pruneOnly && g != Prune) {
+				state = stIgnore
+			} else {
+				state = stGroup
+				group = g
+			}
 		case strings.HasPrefix(line, prefixRead):
 			toRead := line[len(prefixRead):]
 			err := func() error {
@@ -359,9 +506,34 @@ func (f *Filter) ReadFile(path *fileinfo.Path, pruneOnly bool) error {
 				return fmt.Errorf("%s:%d: %w", path.Path(), lineNo, err)
 			}
 			state = stTop
+		case strings.HasPrefix(line, prefixStorage):
+			name := line[len(prefixStorage):]
+			if pruneOnly {
+				state = stIgnore
+			} else if name == "" {
+				return fmt.Errorf("%s:%d: storage class name required", path.Path(), lineNo)
+			} else {
+				state = stStorageClass
+				class = f.storageClass(name)
+			}
+		case strings.HasPrefix(line, prefixMaxSize), strings.HasPrefix(line, prefixMaxAge):
+			// Limits are like include and exclude directives, so they are ignored when
+			// reading prune directives. Otherwise, a file that grew past a limit would
+			// be missing from a site's database and appear to have been removed.
+			if !pruneOnly {
+				if err := f.readLimit(line); err != nil {
+					return fmt.Errorf("%s:%d: %w", path.Path(), lineNo, err)
+				}
+			}
+			state = stTop
 		default:
 			if state == stIgnore {
 				continue
+			} else if state == stStorageClass {
+				if err = class.rules.addRule(line); err != nil {
+					return fmt.Errorf("%s:%d: %w", path.Path(), lineNo, err)
+				}
+				continue
 			} else if state != stGroup {
 				return fmt.Errorf("%s:%d: path not expected here", path.Path(), lineNo)
 			}
@@ -373,3 +545,18 @@ func (f *Filter) ReadFile(path *fileinfo.Path, pruneOnly bool) error {
 	}
 	return nil
 }
+
+func (f *Filter) readLimit(line string) error {
+	if val, ok := strings.CutPrefix(line, prefixMaxSize); ok {
+		size, err := misc.ParseSize(val)
+		if err != nil {
+			return err
+		}
+		return f.SetMaxSize(size)
+	}
+	age, err := misc.ParseAge(line[len(prefixMaxAge):])
+	if err != nil {
+		return err
+	}
+	return f.SetMaxAge(age)
+}
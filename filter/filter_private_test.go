@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func checkFile(
@@ -24,7 +25,7 @@ func checkFile(
 	excludePaths []string,
 	excludeBase []string,
 	excludePatterns []string,
-	junkRe string,
+	junkRe []string,
 	defaultInclude bool,
 ) {
 	t.Helper()
@@ -66,9 +67,12 @@ func checkFile(
 	compareMap("exclude paths", f.groups[Exclude].path, excludePaths)
 	compareMap("exclude base", f.groups[Exclude].base, excludeBase)
 	comparePatterns("exclude patterns", f.groups[Exclude].pattern, excludePatterns)
-	actJunk := reString(f.junk)
-	if junkRe != actJunk {
-		t.Errorf("junk: got %v, wanted %v", actJunk, junkRe)
+	var actJunk []string
+	for _, re := range f.junk {
+		actJunk = append(actJunk, reString(re))
+	}
+	if !slices.Equal(actJunk, junkRe) {
+		t.Errorf("junk: got %#v, wanted %#v", actJunk, junkRe)
 	}
 	if f.defaultInclude() != defaultInclude {
 		t.Errorf("default include: got %v, wanted %v", f.defaultInclude(), defaultInclude)
@@ -109,8 +113,8 @@ func TestFilter_ReadFile(t *testing.T) {
 			`\.swp$`,
 			`^cmake-build-.*$`,
 		},
-		`^\.?#|~$`, // junkRe
-		true,       // defaultInclude
+		[]string{`^\.?#|~$`}, // junkRe
+		true,                 // defaultInclude
 	)
 	checkFile(
 		t,
@@ -136,8 +140,8 @@ func TestFilter_ReadFile(t *testing.T) {
 		},
 		[]string{ // exclude patterns
 		},
-		`^\.?#|~$`, // junkRe
-		true,       // defaultInclude
+		[]string{`^\.?#|~$`}, // junkRe
+		true,                 // defaultInclude
 	)
 	checkFile(
 		t,
@@ -163,7 +167,7 @@ func TestFilter_ReadFile(t *testing.T) {
 		[]string{ // exclude patterns
 			`^cmake-build-.*$`,
 		},
-		"",    // junkRe
+		nil,   // junkRe
 		false, // defaultInclude
 	)
 }
@@ -183,10 +187,41 @@ func TestFileErrors(t *testing.T) {
 	check("testdata/bad1", "testdata/bad1:3: open testdata/does-not-exist: ")
 	check("testdata/bad2", "testdata/bad2:4: path not expected here")
 	check("testdata/bad3", "testdata/bad3:2: regexp error on ???*:")
-	check("testdata/bad4", "testdata/bad4:3: only one junk directive")
 	check("testdata/bad5", "testdata/bad5:3: default path directive only allowed in")
 	check("testdata/bad6", "testdata/bad6:2: empty pattern not allowed")
 	check("testdata/bad7", "testdata/bad7:1: empty pattern not allowed")
+	check("testdata/bad8", "testdata/bad8:2: only one exclude-larger directive")
+	check("testdata/bad9", "testdata/bad9:2: invalid age \"1y\"")
+	check("testdata/bad10", "testdata/bad10:3: storage class name required")
+	check("testdata/bad11", "testdata/bad11:1: group name required")
+}
+
+func TestJunk(t *testing.T) {
+	// Junk patterns accumulate across nested filter files. Duplicates are
+	// ignored.
+	f := New()
+	if err := f.ReadFile(fileinfo.NewPath(localsource.New(""), "testdata/junk1"), true); err != nil {
+		t.Fatal(err.Error())
+	}
+	var actJunk []string
+	for _, re := range f.junk {
+		actJunk = append(actJunk, re.String())
+	}
+	if exp := []string{`~$`, `^#`, `\.o$`}; !slices.Equal(actJunk, exp) {
+		t.Errorf("junk: got %#v, wanted %#v", actJunk, exp)
+	}
+	for p, exp := range map[string]bool{
+		"a/b~":   true,
+		"a/#b":   true,
+		"a/b.o":  true,
+		"a~/b":   false,
+		"a/b.oo": false,
+	} {
+		_, group := IsIncluded(p, false, f)
+		if (group == Junk) != exp {
+			t.Errorf("%s: wrong group %v", p, group)
+		}
+	}
 }
 
 func TestDefault(t *testing.T) {
@@ -208,3 +243,137 @@ func TestDefault(t *testing.T) {
 	}
 	// Explicit toggling of default is tested in regular filter tests
 }
+
+func TestLimits(t *testing.T) {
+	t0 := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return t0 }
+	defer func() { now = time.Now }()
+	read := func(pruneOnly bool) *Filter {
+		t.Helper()
+		f := New()
+		if err := f.ReadFile(fileinfo.NewPath(localsource.New(""), "testdata/limits"), pruneOnly); err != nil {
+			t.Fatal(err.Error())
+		}
+		return f
+	}
+	f := read(false)
+	if f.maxSize != 100*1024 || f.maxAge != 14*24*time.Hour {
+		t.Errorf("wrong limits: %d %v", f.maxSize, f.maxAge)
+	}
+	file := func(path string, ft fileinfo.FileType, size int64, age time.Duration) *fileinfo.FileInfo {
+		return &fileinfo.FileInfo{Path: path, FileType: ft, Size: size, ModTime: t0.Add(-age)}
+	}
+	day := 24 * time.Hour
+	for _, c := range []struct {
+		info     *fileinfo.FileInfo
+		included bool
+		group    Group
+	}{
+		{file("x/small", fileinfo.TypeFile, 100, day), true, Include},
+		{file("x/large", fileinfo.TypeFile, 200*1024, day), false, Limit},
+		{file("x/old", fileinfo.TypeFile, 100, 20*day), false, Limit},
+		{file("x/dir", fileinfo.TypeDirectory, 200*1024, 20*day), true, Include},
+		{file("y/large", fileinfo.TypeFile, 200*1024, day), false, Default},
+		{file(".qfs/filters/repo", fileinfo.TypeFile, 200*1024, 20*day), true, RepoRule},
+	} {
+		included, group := IsIncludedFile(c.info, true, New(), f)
+		if included != c.included || group != c.group {
+			t.Errorf("%s: got %v, %v", c.info.Path, included, group)
+		}
+	}
+	// Limits are ignored when only reading prune directives.
+	f = read(true)
+	if f.maxSize != 0 || f.maxAge != 0 {
+		t.Errorf("limits set with pruneOnly")
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	read := func(pruneOnly bool) *Filter {
+		t.Helper()
+		f := New()
+		if err := f.ReadFile(fileinfo.NewPath(localsource.New(""), "testdata/storage"), pruneOnly); err != nil {
+			t.Fatal(err.Error())
+		}
+		return f
+	}
+	f := read(false)
+	if classes := f.StorageClasses(); !slices.Equal(classes, []string{"GLACIER_IR", "DEEP_ARCHIVE"}) {
+		t.Errorf("wrong classes: %v", classes)
+	}
+	for path, exp := range map[string]string{
+		"archives/x":       "GLACIER_IR",
+		"archives/old/x":   "DEEP_ARCHIVE",
+		"archives/old/x.z": "DEEP_ARCHIVE",
+		"a/b/image.iso":    "GLACIER_IR",
+		"a/big/x":          "GLACIER_IR",
+		"a/b/x":            "",
+	} {
+		if class := f.StorageClass(path); class != exp {
+			t.Errorf("%s: got %q", path, class)
+		}
+	}
+	// Storage classes don't affect inclusion.
+	if included, _ := IsIncluded("archives/x", false, f); !included {
+		t.Errorf("archives/x is not included")
+	}
+	if classes := read(true).StorageClasses(); len(classes) != 0 {
+		t.Errorf("storage classes read with pruneOnly: %v", classes)
+	}
+}
+
+func TestSiteGroups(t *testing.T) {
+	read := func(groups map[string]bool, pruneOnly bool) *Filter {
+		t.Helper()
+		f := New()
+		f.SetSiteGroups(groups)
+		if err := f.ReadFile(fileinfo.NewPath(localsource.New(""), "testdata/groups"), pruneOnly); err != nil {
+			t.Fatal(err.Error())
+		}
+		return f
+	}
+	check := func(f *Filter, exp map[string]bool) {
+		t.Helper()
+		for path, expIncluded := range exp {
+			if included, _ := IsIncluded(path, false, f); included != expIncluded {
+				t.Errorf("%s: included = %v", path, included)
+			}
+		}
+	}
+	laptop := read(map[string]bool{"laptops": true, "servers": false}, false)
+	check(laptop, map[string]bool{
+		"common/x":     true,
+		"common/big":   false,
+		"common/cache": true,
+		"Music/x":      true,
+		"srv/x":        false,
+		"docs/x":       true,
+	})
+	server := read(map[string]bool{"laptops": false, "servers": true}, false)
+	check(server, map[string]bool{
+		"common/x":     true,
+		"common/big":   true,
+		"common/cache": false,
+		"Music/x":      false,
+		"srv/x":        true,
+		"docs/x":       true,
+	})
+	// Without groups, no group directives apply.
+	check(read(nil, false), map[string]bool{
+		"common/big": true,
+		"Music/x":    false,
+		"srv/x":      false,
+	})
+	// Only group prunes are read with pruneOnly.
+	check(read(map[string]bool{"laptops": true, "servers": true}, true), map[string]bool{
+		"Music/x":      true,
+		"common/cache": false,
+	})
+
+	f := New()
+	f.SetSiteGroups(map[string]bool{"laptops": true})
+	err := f.ReadFile(fileinfo.NewPath(localsource.New(""), "testdata/groups"), false)
+	if err == nil || err.Error() != "testdata/groups:7: unknown site group servers" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -1,11 +1,28 @@
 package filter_test
 
 import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/localsource"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 )
 
+// cached returns the result of checking p with a Cache that has already seen
+// other paths in the same directories. It must match filter.IsIncluded.
+func cached(p string, filters ...*filter.Filter) (bool, filter.Group) {
+	c := filter.NewCache(false, filters...)
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		_, _ = c.IsIncluded(dir + "/other")
+	}
+	_, _ = c.IsIncluded(p)
+	return c.IsIncluded(p)
+}
+
 func TestFilter(t *testing.T) {
 	f1 := filter.New()
 	// f1 has default include; check toggles f2 default include to exercise that only
@@ -15,6 +32,9 @@ func TestFilter(t *testing.T) {
 		for _, defaultInclude := range []bool{true, false} {
 			f1.SetDefaultInclude(defaultInclude)
 			included, group := filter.IsIncluded(p, false, f1)
+			if cIncluded, cGroup := cached(p, f1); cIncluded != included || cGroup != group {
+				t.Errorf("%s: cache returned %v, %v", p, cIncluded, cGroup)
+			}
 			if group != expGroup {
 				t.Errorf("%s: group = %v, wanted = %v", p, group, expGroup)
 			} else if expGroup == filter.Default {
@@ -35,10 +55,12 @@ func TestFilter(t *testing.T) {
 	if err != nil {
 		t.Error(err.Error())
 	}
-	err = f1.SetJunk("oops")
-	if err == nil || !strings.HasPrefix(err.Error(), "only one junk directive allowed") {
-		t.Errorf("wrong error: %v", err)
+	// Additional junk patterns accumulate.
+	err = f1.SetJunk(`\.bak$`)
+	if err != nil {
+		t.Error(err.Error())
 	}
+	check("one/two/three.bak", false, filter.Junk)
 	check("one/two/three~", false, filter.Junk)
 	check("one/two/#three", false, filter.Junk)
 	check("one/two/.#three", false, filter.Junk)
@@ -102,6 +124,16 @@ func TestFilter(t *testing.T) {
 	if !included || group != filter.RepoRule {
 		t.Errorf("wrong result for repo rules include")
 	}
+	for _, p := range []string{".qfs/filters/x.local", ".qfs/filters/private.local/x"} {
+		included, group = filter.IsIncluded(p, true)
+		if included || group != filter.RepoRule {
+			t.Errorf("wrong result for repo rules local filter %s", p)
+		}
+	}
+	included, group = filter.IsIncluded(".qfs/filters/x.local", false)
+	if !included || group != filter.Default {
+		t.Errorf("wrong result for local filter without repo rules")
+	}
 
 	// Multiple filters -- must be matched by all filters to be matched.
 	f2 := filter.New()
@@ -111,6 +143,9 @@ func TestFilter(t *testing.T) {
 		for _, defaultInclude := range []bool{true, false} {
 			f2.SetDefaultInclude(defaultInclude)
 			included, group = filter.IsIncluded(p, false, f1, f2)
+			if cIncluded, cGroup := cached(p, f1, f2); cIncluded != included || cGroup != group {
+				t.Errorf("%s: cache returned %v, %v", p, cIncluded, cGroup)
+			}
 			if f2Default && !defaultInclude {
 				if included || group != filter.Default {
 					t.Errorf("%s: wrong result when f2's default matched", p)
@@ -150,3 +185,118 @@ func TestFilter(t *testing.T) {
 		t.Errorf("wrong panic: %s", gotPanic)
 	}
 }
+
+// benchmarkPaths returns paths in a tree that is deep relative to the number
+// of files in each directory, like a typical source tree.
+func benchmarkPaths() []string {
+	var paths []string
+	for i := range 50 {
+		dir := fmt.Sprintf("src/project%02d/pkg/internal/module/sub%02d", i%10, i)
+		for j := range 200 {
+			paths = append(paths, fmt.Sprintf("%s/file%03d.go", dir, j))
+		}
+	}
+	return paths
+}
+
+func benchmarkFilters(b *testing.B) []*filter.Filter {
+	f1 := filter.New()
+	f1.AddPath(filter.Include, "src")
+	f1.AddPath(filter.Exclude, "src/project03")
+	f1.AddPath(filter.Prune, "src/project05/pkg")
+	f1.AddBase(filter.Exclude, "testdata")
+	f1.AddBase(filter.Prune, "node_modules")
+	f2 := filter.New()
+	for _, p := range []string{`\.o$`, `^\.cache$`, `^build-\d+$`, `\.(tmp|swp)$`} {
+		if err := f2.AddPattern(filter.Exclude, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f2.SetJunk(`~$`); err != nil {
+		b.Fatal(err)
+	}
+	return []*filter.Filter{f1, f2}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	tmp := t.TempDir()
+	write := func(name, contents string) *fileinfo.Path {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err.Error())
+		}
+		return fileinfo.NewPath(localsource.New(tmp), name)
+	}
+	top := write("top", "# comment\n\n*/node_modules\n")
+	proj := write("proj", "target\n*.o\n:re:^tmp\\d$\n")
+	// Ignore files work like prune rules, so they override includes.
+	f := filter.New()
+	f.SetDefaultInclude(true)
+	f.AddPath(filter.Include, "a/proj/target/keep")
+	c := filter.NewCache(false, f)
+	if err := c.ReadIgnoreFile(top, "."); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.ReadIgnoreFile(proj, "a/proj"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, tc := range []struct {
+		path     string
+		included bool
+	}{
+		{"node_modules", false},
+		{"a/node_modules/x", false},
+		{"a/b", true},
+		{"a/x.o", true},
+		{"a/proj/x.o", false},
+		{"a/proj/src/x.o", false},
+		{"a/proj/target", false},
+		{"a/proj/target/keep", false},
+		{"a/proj/src/target", true},
+		{"a/proj/tmp1", false},
+		{"a/proj/src/tmp12", true},
+		{"a/proj/node_modules", false},
+		{"a/proj/src/y.c", true},
+	} {
+		included, group := c.IsIncluded(tc.path)
+		if included != tc.included || (!included && group != filter.Prune) {
+			t.Errorf("%s: got %v, %v", tc.path, included, group)
+		}
+	}
+
+	bad := write("bad", "ok\n.\n")
+	err := filter.NewCache(false).ReadIgnoreFile(bad, ".")
+	if err == nil || err.Error() != filepath.Join(tmp, "bad")+":2: an ignore file can't ignore its own directory" {
+		t.Errorf("wrong error: %v", err)
+	}
+	bad = write("bad", ":re:(\n")
+	err = filter.NewCache(false).ReadIgnoreFile(bad, ".")
+	if err == nil || !strings.HasPrefix(err.Error(), filepath.Join(tmp, "bad")+":1: regexp error") {
+		t.Errorf("wrong error: %v", err)
+	}
+	missing := fileinfo.NewPath(localsource.New(tmp), "missing")
+	err = filter.NewCache(false).ReadIgnoreFile(missing, ".")
+	if err == nil || !strings.HasPrefix(err.Error(), "open "+filepath.Join(tmp, "missing")+":") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func BenchmarkIsIncluded(b *testing.B) {
+	paths := benchmarkPaths()
+	filters := benchmarkFilters(b)
+	b.Run("uncached", func(b *testing.B) {
+		for range b.N {
+			for _, p := range paths {
+				_, _ = filter.IsIncluded(p, false, filters...)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for range b.N {
+			c := filter.NewCache(false, filters...)
+			for _, p := range paths {
+				_, _ = c.IsIncluded(p)
+			}
+		}
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package gztar
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func mkfifo(name string, perm fs.FileMode) error {
+	return syscall.Mkfifo(name, uint32(perm))
+}
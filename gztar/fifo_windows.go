@@ -0,0 +1,12 @@
+//go:build windows
+
+package gztar
+
+import (
+	"errors"
+	"io/fs"
+)
+
+func mkfifo(string, fs.FileMode) error {
+	return errors.New("named pipes are not supported on Windows")
+}
@@ -4,21 +4,28 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"github.com/jberkenbilt/qfs/misc"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
-	"syscall"
 	"time"
 )
 
+// Extract extracts a gzip-compressed tar file into dest, preserving modes and
+// modification times. Since archives may come from elsewhere, members may not
+// be outside dest or be inside a symbolic link, and symbolic links are created
+// after everything else so that no member can be written through one.
 func Extract(filename string, dest string) error {
 	tarFile, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = tarFile.Close() }()
 	gz, err := gzip.NewReader(tarFile)
 	if err != nil {
 		return err
@@ -26,6 +33,7 @@ func Extract(filename string, dest string) error {
 	archive := tar.NewReader(gz)
 	dirTimes := map[string]time.Time{}
 	dirModes := map[string]os.FileMode{}
+	var links []*tar.Header
 	for {
 		h, err := archive.Next()
 		if h == nil || errors.Is(err, io.EOF) {
@@ -37,6 +45,12 @@ func Extract(filename string, dest string) error {
 		mode := fi.Mode()
 		modeType := mode.Type()
 		perm := mode.Perm()
+		if !filepath.IsLocal(filepath.FromSlash(h.Name)) {
+			return fmt.Errorf("%s: archive member %s is outside the archive's directory", filename, h.Name)
+		}
+		if err := checkParents(dest, h.Name); err != nil {
+			return fmt.Errorf("%s: archive member %s: %w", filename, h.Name, err)
+		}
 		name := filepath.Join(dest, h.Name)
 		if strings.HasSuffix(h.Name, "/") {
 			if err := os.MkdirAll(name, 0777); err != nil {
@@ -67,7 +81,7 @@ func Extract(filename string, dest string) error {
 					return err
 				}
 			case modeType&os.ModeNamedPipe != 0:
-				if err := syscall.Mkfifo(name, uint32(perm)); err != nil {
+				if err := mkfifo(name, perm); err != nil {
 					return err
 				}
 				if err := os.Chmod(name, perm); err != nil {
@@ -77,14 +91,21 @@ func Extract(filename string, dest string) error {
 					return err
 				}
 			case modeType&os.ModeSymlink != 0:
-				if err := os.Symlink(h.Linkname, name); err != nil {
-					return err
-				}
+				links = append(links, h)
 			default:
 				// ignore
 			}
 		}
 	}
+	for _, h := range links {
+		// An earlier link may be a parent of this one.
+		if err := checkParents(dest, h.Name); err != nil {
+			return fmt.Errorf("%s: archive member %s: %w", filename, h.Name, err)
+		}
+		if err := os.Symlink(h.Linkname, filepath.Join(dest, h.Name)); err != nil {
+			return err
+		}
+	}
 	dirs := misc.SortedKeys(dirTimes)
 	slices.Reverse(dirs)
 	for _, dir := range dirs {
@@ -97,3 +118,27 @@ func Extract(filename string, dest string) error {
 	}
 	return nil
 }
+
+// checkParents returns an error if any existing directory that contains the
+// archive member name below dest is a symbolic link.
+func checkParents(dest, name string) error {
+	dir := dest
+	parts := strings.Split(path.Dir(path.Clean(name)), "/")
+	for _, part := range parts {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		st, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			return errors.New("parent directory is a symbolic link")
+		}
+	}
+	return nil
+}
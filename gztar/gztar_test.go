@@ -0,0 +1,126 @@
+package gztar_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/jberkenbilt/qfs/gztar"
+	"github.com/jberkenbilt/qfs/testutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type member struct {
+	name     string
+	linkname string
+	content  string
+}
+
+func writeArchive(t *testing.T, filename string, members []member) {
+	t.Helper()
+	f, err := os.Create(filename)
+	testutil.Check(t, err)
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+	for _, m := range members {
+		h := &tar.Header{Name: m.name, Mode: 0o644}
+		switch {
+		case m.linkname != "":
+			h.Typeflag = tar.TypeSymlink
+			h.Linkname = m.linkname
+		case strings.HasSuffix(m.name, "/"):
+			h.Typeflag = tar.TypeDir
+			h.Mode = 0o755
+		default:
+			h.Typeflag = tar.TypeReg
+			h.Size = int64(len(m.content))
+		}
+		testutil.Check(t, archive.WriteHeader(h))
+		_, err = archive.Write([]byte(m.content))
+		testutil.Check(t, err)
+	}
+	testutil.Check(t, archive.Close())
+	testutil.Check(t, gz.Close())
+	testutil.Check(t, f.Close())
+}
+
+func TestExtract(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links requires privileges on Windows")
+	}
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	testutil.Check(t, os.Mkdir(j("outside"), 0o755))
+	writeArchive(t, j("ok.tar.gz"), []member{
+		{name: "files/"},
+		{name: "files/link", linkname: "a"},
+		{name: "files/a", content: "potato"},
+	})
+	testutil.Check(t, gztar.Extract(j("ok.tar.gz"), j("ok")))
+	data, err := os.ReadFile(j("ok/files/link"))
+	testutil.Check(t, err)
+	if string(data) != "potato" {
+		t.Errorf("wrong contents: %s", data)
+	}
+
+	for _, c := range []struct {
+		name    string
+		members []member
+		errText string
+	}{
+		{
+			"absolute",
+			[]member{{name: "/files/a", content: "x"}},
+			"is outside the archive's directory",
+		},
+		{
+			"dot-dot",
+			[]member{{name: "files/../../a", content: "x"}},
+			"is outside the archive's directory",
+		},
+		{
+			"file through link",
+			[]member{
+				{name: "files/a", linkname: j("outside")},
+				{name: "files/a/x", content: "x"},
+			},
+			"file exists",
+		},
+		{
+			"link through link",
+			[]member{
+				{name: "files/a", linkname: j("outside")},
+				{name: "files/a/x", linkname: "/etc/passwd"},
+			},
+			"file exists",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			filename := j(strings.ReplaceAll(c.name, " ", "-") + ".tar.gz")
+			writeArchive(t, filename, c.members)
+			err := gztar.Extract(filename, j("dest-"+filepath.Base(filename)))
+			if err == nil || !strings.Contains(err.Error(), c.errText) {
+				t.Errorf("wrong error: %v", err)
+			}
+			entries, err := os.ReadDir(j("outside"))
+			testutil.Check(t, err)
+			if len(entries) > 0 {
+				t.Errorf("wrote outside of the destination: %v", entries)
+			}
+		})
+	}
+
+	// A symbolic link that is already in the destination isn't followed either.
+	testutil.Check(t, os.Mkdir(j("existing"), 0o755))
+	testutil.Check(t, os.Symlink(j("outside"), j("existing/files")))
+	writeArchive(t, j("existing.tar.gz"), []member{{name: "files/a", content: "x"}})
+	err = gztar.Extract(j("existing.tar.gz"), j("existing"))
+	if err == nil || !strings.Contains(err.Error(), "files/a: parent directory is a symbolic link") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, err := os.Stat(j("outside/a")); err == nil {
+		t.Error("wrote outside of the destination")
+	}
+}
@@ -0,0 +1,71 @@
+// Package keyring stores secrets in the operating system's credential store:
+// the Secret Service (through secret-tool) on Linux and other Unix systems, the
+// login keychain (through security) on macOS, and the Credential Manager on
+// Windows. Secrets are identified by a service and an account name.
+package keyring
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotFound is returned by Get and Delete when there is no secret for the
+// service and account.
+var ErrNotFound = errors.New("secret not found in keyring")
+
+type Keyring interface {
+	// Get returns the secret stored for service and account.
+	Get(service, account string) (string, error)
+	// Set stores secret for service and account, replacing any existing secret.
+	Set(service, account, secret string) error
+	// Delete removes the secret stored for service and account.
+	Delete(service, account string) error
+}
+
+// System returns the operating system's keyring.
+func System() Keyring {
+	return systemKeyring{}
+}
+
+// memory is a Keyring that keeps secrets in memory.
+type memory struct {
+	mutex   sync.Mutex
+	secrets map[[2]string]string
+}
+
+// NewMemory returns a Keyring that keeps secrets in memory for as long as it
+// exists. It is useful for testing and for programs that obtain credentials
+// some other way.
+func NewMemory() Keyring {
+	return &memory{
+		secrets: map[[2]string]string{},
+	}
+}
+
+func (m *memory) Get(service, account string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	secret, ok := m.secrets[[2]string{service, account}]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+func (m *memory) Set(service, account, secret string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.secrets[[2]string{service, account}] = secret
+	return nil
+}
+
+func (m *memory) Delete(service, account string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := [2]string{service, account}
+	if _, ok := m.secrets[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.secrets, key)
+	return nil
+}
@@ -0,0 +1,66 @@
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// systemKeyring uses the security command to access the login keychain.
+type systemKeyring struct{}
+
+// errItemNotFound is the exit status of security when there is no matching item.
+const errItemNotFound = 44
+
+func security(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("security", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == errItemNotFound {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("security: %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// quote quotes s for security's interactive mode, which splits commands into
+// words the way a shell does.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func (systemKeyring) Get(service, account string) (string, error) {
+	secret, err := security("", "find-generic-password", "-s", service, "-a", account, "-w")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(secret, "\n"), nil
+}
+
+func (systemKeyring) Set(service, account, secret string) error {
+	// Giving the command on standard input keeps the secret out of the process
+	// list.
+	_, err := security(
+		fmt.Sprintf(
+			"add-generic-password -U -s %s -a %s -w %s\n",
+			quote(service),
+			quote(account),
+			quote(secret),
+		),
+		"-i",
+	)
+	return err
+}
+
+func (systemKeyring) Delete(service, account string) error {
+	_, err := security("", "delete-generic-password", "-s", service, "-a", account)
+	return err
+}
@@ -0,0 +1,33 @@
+package keyring_test
+
+import (
+	"errors"
+	"github.com/jberkenbilt/qfs/keyring"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	k := keyring.NewMemory()
+	if _, err := k.Get("qfs", "a"); !errors.Is(err, keyring.ErrNotFound) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := k.Set("qfs", "a", "secret"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k.Set("qfs", "a", "new secret"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := k.Get("other", "a"); !errors.Is(err, keyring.ErrNotFound) {
+		t.Errorf("wrong error: %v", err)
+	}
+	secret, err := k.Get("qfs", "a")
+	if err != nil || secret != "new secret" {
+		t.Errorf("wrong result: %q, %v", secret, err)
+	}
+	if err := k.Delete("qfs", "a"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k.Delete("qfs", "a"); !errors.Is(err, keyring.ErrNotFound) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !darwin && !windows
+
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// systemKeyring uses secret-tool, which is part of libsecret, to access the
+// Secret Service, which is provided by GNOME Keyring, KWallet, and others.
+type systemKeyring struct{}
+
+func secretTool(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("secret-tool (from libsecret) is required to use the keyring: %w", err)
+	} else if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && stderr.Len() == 0 {
+			// secret-tool lookup fails silently if there is no secret.
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("secret-tool %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (systemKeyring) Get(service, account string) (string, error) {
+	return secretTool("", "lookup", "service", service, "account", account)
+}
+
+func (systemKeyring) Set(service, account, secret string) error {
+	_, err := secretTool(
+		secret,
+		"store",
+		"--label", fmt.Sprintf("%s: %s", service, account),
+		"service", service,
+		"account", account,
+	)
+	return err
+}
+
+func (k systemKeyring) Delete(service, account string) error {
+	// secret-tool clear succeeds whether or not there is a secret.
+	if _, err := k.Get(service, account); err != nil {
+		return err
+	}
+	_, err := secretTool("", "clear", "service", service, "account", account)
+	return err
+}
@@ -0,0 +1,112 @@
+package keyring
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// systemKeyring stores generic credentials in the Windows Credential Manager.
+type systemKeyring struct{}
+
+var (
+	advapi32   = syscall.NewLazyDLL("advapi32.dll")
+	credRead   = advapi32.NewProc("CredReadW")
+	credWrite  = advapi32.NewProc("CredWriteW")
+	credDelete = advapi32.NewProc("CredDeleteW")
+	credFree   = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	errorNotFound           = syscall.Errno(1168)
+)
+
+// credential is CREDENTIALW from wincred.h.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+func credError(err error) error {
+	if errors.Is(err, errorNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func targetName(service, account string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(service + ":" + account)
+}
+
+func (systemKeyring) Get(service, account string) (string, error) {
+	target, err := targetName(service, account)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	r, _, err := credRead.Call(
+		uintptr(unsafe.Pointer(target)),
+		credTypeGeneric,
+		0,
+		uintptr(unsafe.Pointer(&cred)),
+	)
+	if r == 0 {
+		return "", credError(err)
+	}
+	defer func() { _, _, _ = credFree.Call(uintptr(unsafe.Pointer(cred))) }()
+	if cred.CredentialBlobSize == 0 {
+		return "", nil
+	}
+	return string(unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)), nil
+}
+
+func (systemKeyring) Set(service, account, secret string) error {
+	target, err := targetName(service, account)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(account)
+	if err != nil {
+		return err
+	}
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	r, _, err := credWrite.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if r == 0 {
+		return credError(err)
+	}
+	return nil
+}
+
+func (systemKeyring) Delete(service, account string) error {
+	target, err := targetName(service, account)
+	if err != nil {
+		return err
+	}
+	r, _, err := credDelete.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0)
+	if r == 0 {
+		return credError(err)
+	}
+	return nil
+}
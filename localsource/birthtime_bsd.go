@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+
+package localsource
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time recorded in the stat structure or the
+// zero time if the file system doesn't record it.
+func birthTime(_ string, lst fs.FileInfo) time.Time {
+	st, ok := lst.Sys().(*syscall.Stat_t)
+	if !ok || st == nil || st.Birthtimespec.Sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(st.Birthtimespec.Unix()).Truncate(time.Millisecond)
+}
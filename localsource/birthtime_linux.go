@@ -0,0 +1,86 @@
+//go:build linux
+
+package localsource
+
+import (
+	"io/fs"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The syscall package doesn't provide statx, which is the only way to get
+// creation times on Linux, so we call it directly. Its number varies by
+// architecture.
+var sysStatx = map[string]uintptr{
+	"386":     383,
+	"amd64":   332,
+	"arm":     397,
+	"arm64":   291,
+	"loong64": 291,
+	"riscv64": 291,
+}[runtime.GOARCH]
+
+const (
+	atFdcwd           = -100
+	atSymlinkNoFollow = 0x100
+	statxBtime        = 0x800
+)
+
+type statxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+// statxT is struct statx from linux/stat.h.
+type statxT struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	_              [128]byte
+}
+
+// birthTime returns the creation time of the file at path, which is not
+// followed if it is a symbolic link, or the zero time if the kernel or file
+// system doesn't record it.
+func birthTime(path string, _ fs.FileInfo) time.Time {
+	if sysStatx == 0 {
+		return time.Time{}
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		// TEST: NOT COVERED
+		return time.Time{}
+	}
+	var st statxT
+	dirFd := atFdcwd
+	_, _, errno := syscall.Syscall6(
+		sysStatx,
+		uintptr(dirFd),
+		uintptr(unsafe.Pointer(p)),
+		atSymlinkNoFollow,
+		statxBtime,
+		uintptr(unsafe.Pointer(&st)),
+		0,
+	)
+	if errno != 0 || st.Mask&statxBtime == 0 {
+		// TEST: NOT COVERED. This depends on the kernel and file system.
+		return time.Time{}
+	}
+	return time.Unix(st.Btime.Sec, int64(st.Btime.Nsec)).Truncate(time.Millisecond)
+}
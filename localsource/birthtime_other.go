@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package localsource
+
+import (
+	"io/fs"
+	"time"
+)
+
+// birthTime always returns the zero time since creation times aren't available
+// on this platform.
+func birthTime(_ string, _ fs.FileInfo) time.Time {
+	return time.Time{}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package localsource
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the file's creation time from its attribute data.
+func birthTime(_ string, lst fs.FileInfo) time.Time {
+	d, ok := lst.Sys().(*syscall.Win32FileAttributeData)
+	if !ok || d == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, d.CreationTime.Nanoseconds()).Truncate(time.Millisecond)
+}
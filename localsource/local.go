@@ -6,22 +6,70 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"syscall"
 	"time"
 )
 
+type Options func(*LocalSource)
+
 type LocalSource struct {
-	top string
+	top         string
+	birthTimes  bool
+	nanoseconds bool
+	window      time.Duration
+	pathMap     *PathMap
 }
 
-func New(top string) *LocalSource {
-	return &LocalSource{
+func New(top string, options ...Options) *LocalSource {
+	ls := &LocalSource{
 		top: top,
 	}
+	for _, fn := range options {
+		fn(ls)
+	}
+	return ls
+}
+
+// WithBirthTimes causes files' creation times to be captured where the platform
+// and file system support it. This requires an extra system call per file on
+// some platforms, so it is off by default.
+func WithBirthTimes(birthTimes bool) func(*LocalSource) {
+	return func(ls *LocalSource) {
+		ls.birthTimes = birthTimes
+	}
+}
+
+// WithNanoseconds causes modification times to be kept with the full precision
+// of the file system. Otherwise, they are truncated to milliseconds, which is
+// all that older databases and repositories can store.
+func WithNanoseconds(nanoseconds bool) func(*LocalSource) {
+	return func(ls *LocalSource) {
+		ls.nanoseconds = nanoseconds
+	}
+}
+
+// WithModifyWindow causes modification times that differ by no more than
+// window to be treated as the same when deciding whether files have to be
+// retrieved. See fileinfo.ModifyWindowSource.
+func WithModifyWindow(window time.Duration) func(*LocalSource) {
+	return func(ls *LocalSource) {
+		ls.window = window
+	}
+}
+
+func (ls *LocalSource) ModifyWindow() time.Duration {
+	return ls.window
+}
+
+// WithPathMap causes files to be stored at the paths given by pathMap. All
+// paths passed to and returned by the source are as they are before rewriting.
+func WithPathMap(pathMap *PathMap) func(*LocalSource) {
+	return func(ls *LocalSource) {
+		ls.pathMap = pathMap
+	}
 }
 
 func (ls *LocalSource) FullPath(path string) string {
-	return filepath.Join(ls.top, path)
+	return filepath.Join(ls.top, ls.pathMap.ToLocal(path))
 }
 
 func (ls *LocalSource) DirEntries(path string) ([]fileinfo.DirEntry, error) {
@@ -29,9 +77,17 @@ func (ls *LocalSource) DirEntries(path string) ([]fileinfo.DirEntry, error) {
 	if err != nil {
 		return nil, err
 	}
-	var result []fileinfo.DirEntry
+	var names []string
 	for _, e := range entries {
-		result = append(result, fileinfo.DirEntry{Name: e.Name()})
+		names = append(names, e.Name())
+	}
+	names = ls.pathMap.dirEntries(path, names, func(localPath string) bool {
+		_, err := os.Lstat(filepath.Join(ls.top, localPath))
+		return err == nil
+	})
+	var result []fileinfo.DirEntry
+	for _, name := range names {
+		result = append(result, fileinfo.DirEntry{Name: name})
 	}
 	return result, nil
 }
@@ -45,10 +101,6 @@ func (ls *LocalSource) Remove(path string) error {
 }
 
 func (ls *LocalSource) FileInfo(path string) (*fileinfo.FileInfo, error) {
-	fi := &fileinfo.FileInfo{
-		Path:     path,
-		FileType: fileinfo.TypeUnknown,
-	}
 	fullPath := ls.FullPath(path)
 	lst, err := os.Lstat(fullPath)
 	if err != nil {
@@ -56,17 +108,35 @@ func (ls *LocalSource) FileInfo(path string) (*fileinfo.FileInfo, error) {
 		// in its directory but can't lstat, so this is not exercised.
 		return nil, fmt.Errorf("lstat %s: %w", fullPath, err)
 	}
-	fi.ModTime = lst.ModTime().Truncate(time.Millisecond)
+	return ls.fileInfo(path, lst)
+}
+
+// TargetInfo is like FileInfo, but if path is a symbolic link, it returns
+// information about the link's target, still with the given path.
+func (ls *LocalSource) TargetInfo(path string) (*fileinfo.FileInfo, error) {
+	fullPath := ls.FullPath(path)
+	st, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", fullPath, err)
+	}
+	return ls.fileInfo(path, st)
+}
+
+func (ls *LocalSource) fileInfo(path string, lst os.FileInfo) (*fileinfo.FileInfo, error) {
+	fi := &fileinfo.FileInfo{
+		Path:     path,
+		FileType: fileinfo.TypeUnknown,
+	}
+	fullPath := ls.FullPath(path)
+	fi.ModTime = lst.ModTime()
+	if !ls.nanoseconds {
+		fi.ModTime = fi.ModTime.Truncate(time.Millisecond)
+	}
 	mode := lst.Mode()
-	fi.Permissions = uint16(mode.Perm())
-	st, ok := lst.Sys().(*syscall.Stat_t)
-	var major, minor uint32
-	if ok && st != nil {
-		fi.Uid = int(st.Uid)
-		fi.Gid = int(st.Gid)
-		fi.Dev = uint64(st.Dev) // the type of st.Dev varies by OS, so always cast
-		major = uint32(st.Rdev >> 8 & 0xfff)
-		minor = uint32(st.Rdev&0xff | (st.Rdev >> 12 & 0xfff00))
+	fi.Permissions = permissions(mode)
+	major, minor := sysInfo(fi, lst)
+	if ls.birthTimes {
+		fi.BirthTime = birthTime(fullPath, lst)
 	}
 	modeType := mode.Type()
 	switch {
@@ -93,7 +163,7 @@ func (ls *LocalSource) FileInfo(path string) (*fileinfo.FileInfo, error) {
 			// readlink fails.
 			return nil, fmt.Errorf("readlink %s: %w", fullPath, err)
 		}
-		fi.Special = target
+		fi.Special = filepath.ToSlash(target)
 	case mode.IsDir():
 		fi.FileType = fileinfo.TypeDirectory
 	}
@@ -109,3 +179,19 @@ func (ls *LocalSource) Download(srcPath string, _ *fileinfo.FileInfo, f *os.File
 	_, err = io.Copy(f, r)
 	return err
 }
+
+// Owner returns the numeric ownership of the file. Names are not included since
+// local IDs are already correct on this system.
+func (ls *LocalSource) Owner(path string, info *fileinfo.FileInfo) (*fileinfo.Owner, error) {
+	if info == nil {
+		var err error
+		info, err = ls.FileInfo(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fileinfo.Owner{
+		Uid: info.Uid,
+		Gid: info.Gid,
+	}, nil
+}
@@ -0,0 +1,130 @@
+package localsource
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var pathRuleRe = regexp.MustCompile(`^src=(.+?)\s+dest=(.+)$`)
+
+// PathRule causes the file or directory at Src, along with everything below
+// it, to be stored at Dest in the local directory.
+type PathRule struct {
+	Src  string
+	Dest string
+}
+
+// PathMap rewrites paths in a local directory according to a list of rules, so
+// that a file that appears as Src in a database or another directory is kept
+// at Dest locally. A LocalSource created WithPathMap accepts and reports paths
+// as they are before rewriting, so the rest of qfs doesn't know that files are
+// stored somewhere else.
+type PathMap struct {
+	rules []PathRule
+}
+
+// ParsePathRule parses a rule of the form `src=path dest=path`. Trailing
+// slashes are ignored.
+func ParsePathRule(rule string) (PathRule, error) {
+	m := pathRuleRe.FindStringSubmatch(strings.TrimSpace(rule))
+	if m == nil {
+		return PathRule{}, errors.New("path rules must have the form \"src=path dest=path\"")
+	}
+	return PathRule{
+		Src:  strings.TrimSuffix(m[1], "/"),
+		Dest: strings.TrimSuffix(m[2], "/"),
+	}, nil
+}
+
+// NewPathMap returns a PathMap for the given rules or nil if there are none.
+// Paths must be relative, may not be or be inside .qfs, and may not be the
+// same as or inside another rule's path on the same side.
+func NewPathMap(rules []PathRule) (*PathMap, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	m := &PathMap{}
+	for _, rule := range rules {
+		for _, p := range []string{rule.Src, rule.Dest} {
+			if p != path.Clean(p) || !filepath.IsLocal(p) || p == "." {
+				return nil, fmt.Errorf("%s: path rules must use clean relative paths", p)
+			}
+			if p == ".qfs" || strings.HasPrefix(p, ".qfs/") {
+				return nil, fmt.Errorf("%s: path rules can't apply to .qfs", p)
+			}
+		}
+		for _, other := range m.rules {
+			if within(rule.Src, other.Src) || within(other.Src, rule.Src) {
+				return nil, fmt.Errorf("path rules for %s and %s overlap", other.Src, rule.Src)
+			}
+			if within(rule.Dest, other.Dest) || within(other.Dest, rule.Dest) {
+				return nil, fmt.Errorf("path rules to %s and %s overlap", other.Dest, rule.Dest)
+			}
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+// within returns true if p is dir or is inside it.
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// rewrite replaces the first matching prefix of p given by from with the
+// corresponding prefix given by to.
+func (m *PathMap) rewrite(p string, from, to func(PathRule) string) string {
+	if m == nil {
+		return p
+	}
+	for _, rule := range m.rules {
+		if within(p, from(rule)) {
+			return to(rule) + p[len(from(rule)):]
+		}
+	}
+	return p
+}
+
+func ruleSrc(rule PathRule) string  { return rule.Src }
+func ruleDest(rule PathRule) string { return rule.Dest }
+
+// ToLocal returns the path at which p is stored locally.
+func (m *PathMap) ToLocal(p string) string {
+	return m.rewrite(p, ruleSrc, ruleDest)
+}
+
+// FromLocal returns the path reported for the local path p.
+func (m *PathMap) FromLocal(p string) string {
+	return m.rewrite(p, ruleDest, ruleSrc)
+}
+
+// dirEntries returns the names of the entries of dir, before rewriting, given
+// the names of the entries in the local directory it is stored in. Local
+// entries that are reported somewhere else are left out, and the sources of
+// rules whose destinations exist are added.
+func (m *PathMap) dirEntries(dir string, localNames []string, exists func(localPath string) bool) []string {
+	if m == nil {
+		return localNames
+	}
+	localDir := m.ToLocal(dir)
+	var names []string
+	for _, name := range localNames {
+		local := path.Join(localDir, name)
+		p := m.FromLocal(local)
+		if path.Dir(p) == dir && m.ToLocal(p) == local {
+			names = append(names, path.Base(p))
+		}
+	}
+	for _, rule := range m.rules {
+		name := path.Base(rule.Src)
+		if path.Dir(rule.Src) == dir && !slices.Contains(names, name) && exists(rule.Dest) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
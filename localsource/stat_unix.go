@@ -0,0 +1,33 @@
+//go:build !windows
+
+package localsource
+
+import (
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"io/fs"
+	"syscall"
+)
+
+// PermissionMask indicates which permission bits are meaningful on this
+// platform. See stat_windows.go.
+const PermissionMask uint16 = 0o7777
+
+func permissions(mode fs.FileMode) uint16 {
+	return uint16(mode.Perm())
+}
+
+// sysInfo fills in the parts of fi that come from the platform-specific stat
+// structure and returns the device numbers for special files.
+func sysInfo(fi *fileinfo.FileInfo, lst fs.FileInfo) (major, minor uint32) {
+	st, ok := lst.Sys().(*syscall.Stat_t)
+	if ok && st != nil {
+		fi.Uid = int(st.Uid)
+		fi.Gid = int(st.Gid)
+		fi.Dev = uint64(st.Dev) // the type of st.Dev varies by OS, so always cast
+		// Blocks are always 512 bytes regardless of the file system's block size.
+		fi.Sparse = lst.Mode().IsRegular() && int64(st.Blocks)*512 < lst.Size()
+		major = uint32(st.Rdev >> 8 & 0xfff)
+		minor = uint32(st.Rdev&0xff | (st.Rdev >> 12 & 0xfff00))
+	}
+	return
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package localsource
+
+import (
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"io/fs"
+)
+
+// PermissionMask indicates which permission bits are meaningful on this
+// platform. Windows only has a read-only attribute, which Go maps to the write
+// bits, so only the owner write bit can be compared with permissions recorded
+// on other platforms. Passing this to diff.WithPermissionMask prevents a Windows
+// site from reporting spurious permission changes.
+const PermissionMask uint16 = 0o200
+
+// permissions maps the read-only attribute to conventional Unix permissions:
+// 0644 or 0444 for files and 0755 or 0555 for directories.
+func permissions(mode fs.FileMode) uint16 {
+	perm := uint16(0o444)
+	if mode.IsDir() {
+		perm = 0o555
+	}
+	if mode.Perm()&0o200 != 0 {
+		perm |= 0o200
+	}
+	return perm
+}
+
+// sysInfo is a no-op on Windows, which has no numeric ownerships or device
+// numbers. Files are reported as owned by uid and gid 0.
+func sysInfo(_ *fileinfo.FileInfo, _ fs.FileInfo) (major, minor uint32) {
+	return 0, 0
+}
@@ -0,0 +1,181 @@
+// Package merge implements a line-based three-way merge in the style of
+// `diff3 -m`.
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+var ErrBinary = errors.New("file appears to be binary")
+
+// Merge3 merges the changes from base to ours and from base to theirs. It
+// returns the merged result and whether the merge was clean. If the same region
+// was changed differently on both sides, the result contains conflict markers
+// in the style of `diff3 -m`, and clean is false. If any input contains a NUL
+// byte, ErrBinary is returned.
+func Merge3(base, ours, theirs []byte) (merged []byte, clean bool, err error) {
+	for _, data := range [][]byte{base, ours, theirs} {
+		if bytes.IndexByte(data, 0) != -1 {
+			return nil, false, ErrBinary
+		}
+	}
+	o := splitLines(base)
+	a := splitLines(ours)
+	b := splitLines(theirs)
+	matchA := matches(o, a)
+	matchB := matches(o, b)
+
+	var out [][]byte
+	clean = true
+	emit := func(lines ...[]string) {
+		for _, chunk := range lines {
+			for _, line := range chunk {
+				out = append(out, []byte(line))
+			}
+		}
+	}
+	// resolve handles a region in which base, ours, and theirs don't all agree.
+	resolve := func(oc, ac, bc []string) {
+		switch {
+		case slices.Equal(ac, bc):
+			emit(ac)
+		case slices.Equal(oc, ac):
+			emit(bc)
+		case slices.Equal(oc, bc):
+			emit(ac)
+		default:
+			clean = false
+			emit(
+				[]string{"<<<<<<< ours\n"}, terminated(ac),
+				[]string{"||||||| base\n"}, terminated(oc),
+				[]string{"=======\n"}, terminated(bc),
+				[]string{">>>>>>> theirs\n"},
+			)
+		}
+	}
+
+	// Walk through all three in parallel. A stable region is one in which
+	// consecutive lines of base are matched, in order, with consecutive lines of
+	// both ours and theirs.
+	lo, la, lb := 0, 0, 0
+	for {
+		i := 0
+		for lo+i < len(o) && matchA[lo+i] == la+i && matchB[lo+i] == lb+i {
+			i++
+		}
+		if i > 0 {
+			emit(o[lo : lo+i])
+			lo += i
+			la += i
+			lb += i
+			continue
+		}
+		// Find the next base line that is matched in both ours and theirs.
+		j := lo
+		for j < len(o) && (matchA[j] == -1 || matchB[j] == -1) {
+			j++
+		}
+		if j == len(o) {
+			resolve(o[lo:], a[la:], b[lb:])
+			break
+		}
+		resolve(o[lo:j], a[la:matchA[j]], b[lb:matchB[j]])
+		lo, la, lb = j, matchA[j], matchB[j]
+	}
+	return bytes.Join(out, nil), clean, nil
+}
+
+// splitLines splits data into lines, retaining line terminators so the result
+// can be reassembled exactly.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 {
+			n = len(data)
+		}
+		lines = append(lines, string(data[:n]))
+		data = data[n:]
+	}
+	return lines
+}
+
+// terminated makes sure the last line of a conflict section ends with a newline
+// so that conflict markers always start on their own lines.
+func terminated(lines []string) []string {
+	if len(lines) == 0 || lines[len(lines)-1][len(lines[len(lines)-1])-1] == '\n' {
+		return lines
+	}
+	result := slices.Clone(lines)
+	result[len(result)-1] += "\n"
+	return result
+}
+
+// matches computes a longest common subsequence of a and b using Myers'
+// algorithm. The result has an entry for every line of a containing the index
+// of the matching line in b or -1 if the line is not part of the common
+// subsequence.
+func matches(a, b []string) []int {
+	n, m := len(a), len(b)
+	result := make([]int, n)
+	for i := range result {
+		result[i] = -1
+	}
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] holds the part of v that is read during step d, which is the range
+	// of diagonals [-d-1, d+1].
+	var trace [][]int
+	d := 0
+done:
+	for ; d <= maxD; d++ {
+		trace = append(trace, slices.Clone(v[offset-d-1:offset+d+2]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break done
+			}
+		}
+	}
+	// Backtrack to recover the matched lines.
+	x, y := n, m
+	for ; d > 0; d-- {
+		prev := trace[d]
+		get := func(k int) int { return prev[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			result[x] = y
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		result[x] = y
+	}
+	return result
+}
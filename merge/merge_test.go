@@ -0,0 +1,178 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		a   []string
+		b   []string
+		exp []int
+	}{
+		{nil, nil, []int{}},
+		{[]string{"a"}, nil, []int{-1}},
+		{nil, []string{"a"}, []int{}},
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}, []int{0, 1, 2}},
+		{[]string{"a", "b", "c"}, []string{"a", "c"}, []int{0, -1, 1}},
+		{[]string{"a", "c"}, []string{"x", "a", "b", "c"}, []int{1, 3}},
+		{[]string{"a", "b", "c", "a", "b", "b", "a"}, []string{"c", "b", "a", "b", "a", "c"}, nil},
+	}
+	for _, c := range cases {
+		m := matches(c.a, c.b)
+		if c.exp != nil && !slices.Equal(m, c.exp) {
+			t.Errorf("%v, %v: got %v, expected %v", c.a, c.b, m, c.exp)
+		}
+		// Matches must be increasing and refer to equal lines.
+		last := -1
+		n := 0
+		for i, j := range m {
+			if j == -1 {
+				continue
+			}
+			n++
+			if j <= last || c.a[i] != c.b[j] {
+				t.Errorf("%v, %v: invalid match %v", c.a, c.b, m)
+			}
+			last = j
+		}
+		if c.exp == nil && n != 4 {
+			// Myers' paper example: the LCS has length 4.
+			t.Errorf("%v, %v: LCS length %d", c.a, c.b, n)
+		}
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	cases := []struct {
+		name   string
+		ours   string
+		theirs string
+		exp    string
+		clean  bool
+	}{
+		{
+			"unchanged",
+			base,
+			base,
+			base,
+			true,
+		},
+		{
+			"ours only",
+			"one\n2\nthree\nfour\nfive\n",
+			base,
+			"one\n2\nthree\nfour\nfive\n",
+			true,
+		},
+		{
+			"theirs only",
+			base,
+			"one\ntwo\nthree\nfour\n",
+			"one\ntwo\nthree\nfour\n",
+			true,
+		},
+		{
+			"separate regions",
+			"zero\none\n2\nthree\nfour\nfive\n",
+			"one\ntwo\nthree\nfour\n5\nsix\n",
+			"zero\none\n2\nthree\nfour\n5\nsix\n",
+			true,
+		},
+		{
+			"same change",
+			"one\ntwo\n3\nfour\nfive\n",
+			"one\ntwo\n3\nfour\nfive\n",
+			"one\ntwo\n3\nfour\nfive\n",
+			true,
+		},
+		{
+			"conflict",
+			"one\ntwo\nTHREE\nfour\nfive\n",
+			"one\ntwo\n3\nfour\nfive\n",
+			"one\ntwo\n<<<<<<< ours\nTHREE\n||||||| base\nthree\n=======\n3\n>>>>>>> theirs\nfour\nfive\n",
+			false,
+		},
+		{
+			"missing newline",
+			"one\ntwo\nthree\nfour\nfive",
+			"one\ntwo\nthree\nfour\nfive\nsix",
+			"one\ntwo\nthree\nfour\n<<<<<<< ours\nfive\n||||||| base\nfive\n=======\nfive\nsix\n>>>>>>> theirs\n",
+			false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			merged, clean, err := Merge3([]byte(base), []byte(c.ours), []byte(c.theirs))
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if string(merged) != c.exp {
+				t.Errorf("got %q, expected %q", merged, c.exp)
+			}
+			if clean != c.clean {
+				t.Errorf("clean = %v", clean)
+			}
+		})
+	}
+	_, _, err := Merge3([]byte(base), []byte("a\x00b"), []byte(base))
+	if !errors.Is(err, ErrBinary) {
+		t.Errorf("expected binary error, got %v", err)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("%d\n", i))
+	}
+	old := strings.Join(lines, "")
+	cases := []struct {
+		name string
+		new  string
+		exp  string
+	}{
+		{"same", old, ""},
+		{
+			"separate hunks",
+			strings.Replace(strings.Replace(old, "2\n", "two\n", 1), "18\n", "", 1),
+			"--- a\n+++ b\n" +
+				"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,5 @@\n 15\n 16\n 17\n-18\n 19\n 20\n",
+		},
+		{
+			"joined hunks",
+			strings.Replace(strings.Replace(old, "2\n", "two\n", 1), "9\n", "nine\n", 1),
+			"--- a\n+++ b\n" +
+				"@@ -1,12 +1,12 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+nine\n 10\n 11\n 12\n",
+		},
+		{
+			"no newline",
+			old + "21",
+			"--- a\n+++ b\n@@ -18,3 +18,4 @@\n 18\n 19\n 20\n+21\n\\ No newline at end of file\n",
+		},
+		{
+			"empty",
+			"",
+			"--- a\n+++ b\n@@ -1,20 +0,0 @@\n-" + strings.Join(lines, "-"),
+		},
+	}
+	for _, c := range cases {
+		out, err := Unified("a", "b", []byte(old), []byte(c.new))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.exp {
+			t.Errorf("%s: wrong diff:\n%s", c.name, out)
+		}
+	}
+	_, err := Unified("a", "b", []byte(old), []byte("a\x00b"))
+	if !errors.Is(err, ErrBinary) {
+		t.Errorf("expected binary error, got %v", err)
+	}
+}
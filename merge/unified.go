@@ -0,0 +1,121 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Context is the number of unchanged lines Unified shows around each change.
+const Context = 3
+
+// edit is one line of a line-based edit script. kind is ' ' for a line that is
+// in both inputs, '-' for one that is only in the old input, or '+' for one
+// that is only in the new input. oldLine and newLine are the number of lines of
+// each input that precede it.
+type edit struct {
+	kind    byte
+	line    string
+	oldLine int
+	newLine int
+}
+
+// Unified returns a unified diff of oldData and newData in the style of
+// `diff -u`, using oldName and newName as the file names in the header. It
+// returns nil if the inputs are the same. If either contains a NUL byte,
+// ErrBinary is returned.
+func Unified(oldName, newName string, oldData, newData []byte) ([]byte, error) {
+	for _, data := range [][]byte{oldData, newData} {
+		if bytes.IndexByte(data, 0) != -1 {
+			return nil, ErrBinary
+		}
+	}
+	edits := editScript(splitLines(oldData), splitLines(newData))
+	var changes []int
+	for i, e := range edits {
+		if e.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	var out strings.Builder
+	_, _ = fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for len(changes) > 0 {
+		// A hunk extends until there are more unchanged lines between changes than
+		// would be shown as context on both sides.
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*Context+1 {
+			last++
+		}
+		start := max(0, changes[0]-Context)
+		end := min(len(edits), changes[last]+Context+1)
+		writeHunk(&out, edits[start:end])
+		changes = changes[last+1:]
+	}
+	return []byte(out.String()), nil
+}
+
+// editScript turns the longest common subsequence of a and b into a list of
+// lines that are kept, removed, or added.
+func editScript(a, b []string) []edit {
+	match := matches(a, b)
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		e := edit{oldLine: i, newLine: j}
+		switch {
+		case i < len(a) && match[i] == -1:
+			e.kind, e.line = '-', a[i]
+			i++
+		case j < len(b) && (i == len(a) || j < match[i]):
+			e.kind, e.line = '+', b[j]
+			j++
+		default:
+			e.kind, e.line = ' ', a[i]
+			i++
+			j++
+		}
+		edits = append(edits, e)
+	}
+	return edits
+}
+
+func writeHunk(out *strings.Builder, edits []edit) {
+	oldCount, newCount := 0, 0
+	for _, e := range edits {
+		if e.kind != '+' {
+			oldCount++
+		}
+		if e.kind != '-' {
+			newCount++
+		}
+	}
+	_, _ = fmt.Fprintf(
+		out,
+		"@@ -%s +%s @@\n",
+		hunkRange(edits[0].oldLine, oldCount),
+		hunkRange(edits[0].newLine, newCount),
+	)
+	for _, e := range edits {
+		out.WriteByte(e.kind)
+		out.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the range of a hunk as diff does: the first line, counting
+// from 1, and the number of lines unless it is 1. An empty range is identified
+// by the line before it.
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,87 @@
+package misc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var atomicTempRe = regexp.MustCompile(`^\..+\.\d+\.tmp$`)
+
+// AtomicFile is written in place of a file that must never be seen partially
+// written. Writes go to a temporary file in the same directory, and Commit
+// renames it over the real file once it has been flushed to disk. If Commit is
+// never called, Discard removes the temporary file, leaving the original alone.
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// CreateAtomic starts writing path, creating its directory if needed. The file
+// is created with the same permissions as os.Create.
+func CreateAtomic(path string) (*AtomicFile, error) {
+	dir, base := filepath.Split(path)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o777); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", base, rand.Uint32()))
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+		if errors.Is(err, fs.ErrExist) {
+			// TEST: NOT COVERED
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return &AtomicFile{File: f, path: path}, nil
+	}
+}
+
+// IsAtomicTemp returns true if name, a file name without a directory, has the
+// form of the temporary files created by CreateAtomic. Such a file is only left
+// behind if the process crashes while writing.
+func IsAtomicTemp(name string) bool {
+	return atomicTempRe.MatchString(name)
+}
+
+// Commit flushes the file to disk and renames it to its final name.
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	err := f.Sync()
+	if err == nil {
+		err = f.Close()
+	} else {
+		// TEST: NOT COVERED
+		_ = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		// TEST: NOT COVERED
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("write %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// Discard abandons the file if it hasn't been committed. It is safe to call
+// Discard after Commit, so it can be deferred.
+func (f *AtomicFile) Discard() {
+	if f.done {
+		return
+	}
+	f.done = true
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
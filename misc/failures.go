@@ -0,0 +1,106 @@
+package misc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrFailures indicates that some files failed during an operation that kept
+// going after them.
+var ErrFailures = errors.New("file(s) failed")
+
+// Failures collects the errors for individual files when an operation keeps
+// going after them so that a single problem doesn't prevent everything else
+// from being done. It is safe for concurrent use. A nil *Failures has no
+// failures.
+type Failures struct {
+	mutex    sync.Mutex
+	failures []*Failure
+}
+
+type Failure struct {
+	Path string
+	Err  error
+}
+
+// Add records that the file at path failed with err.
+func (f *Failures) Add(path string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures = append(f.failures, &Failure{Path: path, Err: err})
+}
+
+func (f *Failures) Len() int {
+	if f == nil {
+		return 0
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.failures)
+}
+
+// Summarize reports the failures through ui, grouped by FailureCategory and
+// sorted by path within each category.
+func (f *Failures) Summarize(ui UI) {
+	if f == nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.failures) == 0 {
+		return
+	}
+	byCategory := map[string][]*Failure{}
+	for _, x := range f.failures {
+		c := FailureCategory(x.Err)
+		byCategory[c] = append(byCategory[c], x)
+	}
+	ui.Message("----- failures -----")
+	for _, c := range SortedKeys(byCategory) {
+		list := byCategory[c]
+		slices.SortFunc(list, func(a, b *Failure) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+		ui.Message("%s (%d):", c, len(list))
+		for _, x := range list {
+			ui.Message("  %s: %v", x.Path, x.Err)
+		}
+	}
+	ui.Message("-----")
+}
+
+// Err returns nil if nothing failed or an error wrapping ErrFailures that gives
+// the number of failures.
+func (f *Failures) Err() error {
+	n := f.Len()
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d %w", n, ErrFailures)
+}
+
+// FailureCategory returns a short description of the kind of problem err
+// represents. Errors from S3 are recognized by their error codes.
+func FailureCategory(err error) string {
+	var coded interface{ ErrorCode() string }
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not found"
+	case errors.As(err, &coded):
+		switch code := coded.ErrorCode(); code {
+		case "AccessDenied", "Forbidden":
+			return "access denied"
+		case "NoSuchKey", "NoSuchVersion", "NotFound":
+			return "not found"
+		default:
+			return "S3 error " + code
+		}
+	}
+	return "other errors"
+}
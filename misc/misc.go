@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -93,6 +94,82 @@ func RemovePrefix(key string, prefix string) string {
 	return key[len(prefix):]
 }
 
+// InSubtrees returns true if subtrees is empty or if path, a relative path, is
+// one of the subtrees, is below one of them, or is a directory above one of
+// them.
+func InSubtrees(path string, subtrees []string) bool {
+	if len(subtrees) == 0 || path == "." {
+		return true
+	}
+	for _, s := range subtrees {
+		if path == s || strings.HasPrefix(path, s+"/") || strings.HasPrefix(s, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSize parses a number of bytes with an optional suffix of K, M, G, or T
+// (case-insensitive) for powers of 1024.
+func ParseSize(size string) (int64, error) {
+	s := size
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 || v > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size \"%s\"", size)
+	}
+	return v * multiplier, nil
+}
+
+// ParseAge parses a positive duration given as a whole number of hours, days,
+// or weeks, such as 36h, 90d, or 2w.
+func ParseAge(age string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+	if age != "" {
+		unit, ok := units[age[len(age)-1]]
+		n, err := strconv.Atoi(age[:len(age)-1])
+		if ok && err == nil && n > 0 {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid age \"%s\": age must be a number followed by h, d, or w", age)
+}
+
+// FormatSize formats a number of bytes for people to read using the same
+// suffixes as ParseSize. Sizes of 1K or more are shown with one decimal place.
+func FormatSize(size int64) string {
+	const units = "KMGT"
+	if size < 1<<10 {
+		return strconv.FormatInt(size, 10)
+	}
+	v := float64(size)
+	i := -1
+	for v >= 1<<10 && i < len(units)-1 {
+		v /= 1 << 10
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", v, units[i])
+}
+
 func FormatTime(t time.Time) string {
 	return t.Local().Format(TimeFormat)
 }
@@ -1,12 +1,15 @@
 package misc_test
 
 import (
+	"errors"
 	"fmt"
 	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/testutil"
+	"io/fs"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 )
 
 type workBatch struct {
@@ -106,3 +109,179 @@ func TestMessagePromptChannels(t *testing.T) {
 		t.Errorf("wrong output: %s", stdout)
 	}
 }
+
+func TestInSubtrees(t *testing.T) {
+	subtrees := []string{"a/b", "c"}
+	for path, exp := range map[string]bool{
+		".":     true,
+		"a":     true,
+		"a/b":   true,
+		"a/b/c": true,
+		"a/bc":  false,
+		"a/c":   false,
+		"c":     true,
+		"c/d":   true,
+		"cd":    false,
+		"d":     false,
+	} {
+		if misc.InSubtrees(path, subtrees) != exp {
+			t.Errorf("%s: expected %v", path, exp)
+		}
+	}
+	if !misc.InSubtrees("anything", nil) {
+		t.Error("empty subtrees should include everything")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, exp := range map[string]int64{
+		"0":    0,
+		"1234": 1234,
+		"4k":   4096,
+		"16M":  16 << 20,
+		"2g":   2 << 30,
+		"1T":   1 << 40,
+	} {
+		v, err := misc.ParseSize(s)
+		if err != nil || v != exp {
+			t.Errorf("%s: got %d, %v", s, v, err)
+		}
+	}
+	for _, s := range []string{"", "M", "-1", "1.5G", "1P", "9999999999T"} {
+		if _, err := misc.ParseSize(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for size, exp := range map[int64]string{
+		0:                 "0",
+		1023:              "1023",
+		1024:              "1.0K",
+		1536:              "1.5K",
+		16 << 20:          "16.0M",
+		3 << 30:           "3.0G",
+		5 << 40:           "5.0T",
+		(1 << 50) + 1<<49: "1536.0T",
+	} {
+		if s := misc.FormatSize(size); s != exp {
+			t.Errorf("%d: got %s", size, s)
+		}
+	}
+}
+
+type summaryUI struct {
+	misc.ConsoleUI
+	summarize bool
+	messages  []string
+}
+
+func (u *summaryUI) Message(format string, args ...any) {
+	u.messages = append(u.messages, fmt.Sprintf(format, args...))
+}
+
+func (u *summaryUI) Summarize() bool {
+	return u.summarize
+}
+
+func TestProgress(t *testing.T) {
+	defer func(interval time.Duration) {
+		misc.ProgressInterval = interval
+	}(misc.ProgressInterval)
+	run := func(ui *summaryUI) {
+		p := misc.NewProgress(ui, "stored", 12345)
+		p.File(1024, "storing %s", "a")
+		p.File(512, "storing %s", "b")
+		p.Done()
+	}
+
+	// Without summaries, each file is reported.
+	ui := &summaryUI{}
+	run(ui)
+	if !reflect.DeepEqual(ui.messages, []string{"storing a", "storing b"}) {
+		t.Errorf("wrong messages: %#v", ui.messages)
+	}
+
+	// Otherwise, totals are reported at intervals and at the end.
+	misc.ProgressInterval = time.Hour
+	ui = &summaryUI{summarize: true}
+	run(ui)
+	if !reflect.DeepEqual(ui.messages, []string{"stored 2/12,345 files, 1.5K"}) {
+		t.Errorf("wrong messages: %#v", ui.messages)
+	}
+	misc.ProgressInterval = 0
+	ui = &summaryUI{summarize: true}
+	run(ui)
+	exp := []string{"stored 1/12,345 files, 1.0K", "stored 2/12,345 files, 1.5K"}
+	if !reflect.DeepEqual(ui.messages, exp) {
+		t.Errorf("wrong messages: %#v", ui.messages)
+	}
+
+	// Files with no size are just counted.
+	ui = &summaryUI{summarize: true}
+	p := misc.NewProgress(ui, "removed", 1)
+	p.File(0, "removing %s", "a")
+	p.Done()
+	if !reflect.DeepEqual(ui.messages, []string{"removed 1/1 files"}) {
+		t.Errorf("wrong messages: %#v", ui.messages)
+	}
+	if (misc.ConsoleUI{}).Summarize() {
+		t.Error("ConsoleUI summarizes by default")
+	}
+}
+
+type codedError string
+
+func (e codedError) Error() string     { return "api error " + string(e) }
+func (e codedError) ErrorCode() string { return string(e) }
+
+func TestFailures(t *testing.T) {
+	f := &misc.Failures{}
+	if f.Err() != nil {
+		t.Error("error with no failures")
+	}
+	var wg sync.WaitGroup
+	for _, x := range []struct {
+		path string
+		err  error
+	}{
+		{"d/c", fmt.Errorf("open: %w", fs.ErrPermission)},
+		{"a", codedError("SlowDown")},
+		{"b", fmt.Errorf("download: %w", codedError("AccessDenied"))},
+		{"d/a", &fs.PathError{Op: "open", Path: "d/a", Err: fs.ErrPermission}},
+		{"e", codedError("NoSuchKey")},
+		{"f", errors.New("potato")},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Add(x.path, x.err)
+		}()
+	}
+	wg.Wait()
+	ui := &summaryUI{}
+	f.Summarize(ui)
+	exp := []string{
+		"----- failures -----",
+		"S3 error SlowDown (1):",
+		"  a: api error SlowDown",
+		"access denied (1):",
+		"  b: download: api error AccessDenied",
+		"not found (1):",
+		"  e: api error NoSuchKey",
+		"other errors (1):",
+		"  f: potato",
+		"permission denied (2):",
+		"  d/a: open d/a: permission denied",
+		"  d/c: open: permission denied",
+		"-----",
+	}
+	if !reflect.DeepEqual(ui.messages, exp) {
+		t.Errorf("wrong messages: %#v", ui.messages)
+	}
+	err := f.Err()
+	if !errors.Is(err, misc.ErrFailures) || err.Error() != "6 file(s) failed" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package misc
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProgressInterval is how often a Progress reports totals when its UI
+// summarizes.
+var ProgressInterval = 5 * time.Second
+
+// Summarizer may be implemented by a UI that wants per-file progress
+// summarized. If Summarize returns true, operations that would report each
+// file they store, copy, or remove report periodic totals instead. UIs that
+// don't implement Summarizer get a message for each file.
+type Summarizer interface {
+	Summarize() bool
+}
+
+// Progress reports progress through a UI as the files of a large operation
+// are processed. Unless the UI summarizes, File reports each file with its
+// own message. Otherwise, totals such as "stored 12,345/98,765 files, 3.2G"
+// are reported every ProgressInterval and by Done. Progress is safe for
+// concurrent use.
+type Progress struct {
+	ui        UI
+	summarize bool
+	verb      string
+	total     int
+	mutex     sync.Mutex
+	files     int
+	bytes     int64
+	reported  int
+	last      time.Time
+}
+
+// NewProgress returns a Progress for an operation on total files. verb, such
+// as "stored", is used in summaries.
+func NewProgress(ui UI, verb string, total int) *Progress {
+	s, ok := ui.(Summarizer)
+	return &Progress{
+		ui:        ui,
+		summarize: ok && s.Summarize(),
+		verb:      verb,
+		total:     total,
+		last:      time.Now(),
+	}
+}
+
+// File records that a file of the given size has been processed. If the UI
+// doesn't summarize, format and args are passed to its Message method.
+func (p *Progress) File(size int64, format string, args ...any) {
+	if !p.summarize {
+		p.ui.Message(format, args...)
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.files++
+	p.bytes += size
+	if time.Since(p.last) >= ProgressInterval {
+		p.report()
+	}
+}
+
+// Done reports the final totals if the UI summarizes and any files were
+// processed since the last report.
+func (p *Progress) Done() {
+	if !p.summarize {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.files > p.reported {
+		p.report()
+	}
+}
+
+// report must be called with the mutex locked.
+func (p *Progress) report() {
+	msg := fmt.Sprintf("%s %s/%s files", p.verb, formatCount(p.files), formatCount(p.total))
+	if p.bytes > 0 {
+		msg += ", " + FormatSize(p.bytes)
+	}
+	p.ui.Message("%s", msg)
+	p.reported = p.files
+	p.last = time.Now()
+}
+
+// formatCount formats n with commas between groups of three digits.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,52 @@
+package misc
+
+import (
+	"io"
+	"os"
+)
+
+// UI is how packages that interact with the user report progress, write output,
+// and ask questions. Packages that need one accept it with a WithUI option and
+// use ConsoleUI if none is given, so programs that embed qfs can handle all
+// interaction themselves instead of capturing standard output. Operations that
+// work on files concurrently call Message from multiple goroutines, so
+// implementations must be safe for concurrent use.
+type UI interface {
+	// Message reports status or progress, such as a file being copied.
+	Message(format string, args ...any)
+	// Prompt asks a yes/no question and returns true if the answer is yes.
+	Prompt(prompt string) bool
+	// Output returns the writer for command output such as diffs and listings.
+	Output() io.Writer
+}
+
+// ConsoleUI is the UI used by the command-line tool. It uses Message and Prompt
+// and writes output to standard output.
+type ConsoleUI struct{}
+
+// ConsoleSummary makes ConsoleUI summarize per-file progress; see Progress.
+// The command-line tool sets it when standard output isn't a terminal unless
+// -verbose is given. Messages sent to TestMessageChannel are never summarized.
+var ConsoleSummary bool
+
+func (ConsoleUI) Message(format string, args ...any) {
+	Message(format, args...)
+}
+
+func (ConsoleUI) Prompt(prompt string) bool {
+	return Prompt(prompt)
+}
+
+func (ConsoleUI) Output() io.Writer {
+	return os.Stdout
+}
+
+func (ConsoleUI) Summarize() bool {
+	return ConsoleSummary && TestMessageChannel == nil
+}
+
+// IsTerminal returns true if f is a terminal.
+func IsTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,178 @@
+package qfs
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repo"
+	"io"
+	"os"
+	"strings"
+)
+
+// Shell completion scripts are generated from the subcommand and argument
+// tables, so they never fall behind the command line. Scan inputs that start
+// with repo: are completed by running "qfs completion sites", which lists the
+// sites that have databases in the repository. That requires accessing the
+// repository, so it is only done when completing such an input.
+
+var completionShells = []string{"bash", "fish", "zsh"}
+
+// completionOptions returns the options of a subcommand as they would be typed.
+func completionOptions(name string) []string {
+	var result []string
+	for _, a := range misc.SortedKeys(argTables[subcommands[name].action]) {
+		if a != "" {
+			result = append(result, "-"+a)
+		}
+	}
+	return result
+}
+
+func topLevelOptions() []string {
+	var result []string
+	for _, a := range misc.SortedKeys(argTables[actNone]) {
+		if len(a) == 1 {
+			result = append(result, "-"+a)
+		} else if a != "" {
+			result = append(result, "--"+a)
+		}
+	}
+	return result
+}
+
+func writeBashCompletion(w io.Writer, progName string) {
+	names := misc.SortedKeys(subcommands)
+	fn := "_" + strings.ReplaceAll(progName, "-", "_")
+	_, _ = fmt.Fprintf(w, `# bash completion for %[1]s; generated by %[1]s completion bash
+%[2]s() {
+    # Take the current word up to whitespace since bash splits words at colons.
+    local line="${COMP_LINE:0:COMP_POINT}"
+    local cur="${line##*[[:space:]]}"
+    local sub="" w
+    for w in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+        case " %[3]s " in
+            *" $w "*) sub="$w"; break;;
+        esac
+    done
+    local words
+    case "$cur" in
+        repo:*)
+            words="$(%[1]s completion sites 2>/dev/null)"
+            ;;
+        -*)
+            case "$sub" in
+`, progName, fn, strings.Join(names, " "))
+	for _, name := range names {
+		_, _ = fmt.Fprintf(w, "                %s) words=\"%s\";;\n", name, strings.Join(completionOptions(name), " "))
+	}
+	_, _ = fmt.Fprintf(w, `                *) words="%[1]s";;
+            esac
+            ;;
+        *)
+            if [ -z "$sub" ]; then
+                words="%[2]s"
+            else
+                COMPREPLY=($(compgen -f -- "$cur"))
+                return
+            fi
+            ;;
+    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+    # Bash replaces only what follows the last colon.
+    if [[ "$cur" == *:* ]]; then
+        local colonPrefix="${cur%%"${cur##*:}"}"
+        COMPREPLY=("${COMPREPLY[@]#"$colonPrefix"}")
+    fi
+}
+complete -o filenames -F %[3]s %[4]s
+`, strings.Join(topLevelOptions(), " "), strings.Join(names, " "), fn, progName)
+}
+
+func writeZshCompletion(w io.Writer, progName string) {
+	// zsh runs the bash script with its bash completion emulation.
+	_, _ = fmt.Fprintf(w, "#compdef %s\nautoload -U +X bashcompinit && bashcompinit\n", progName)
+	writeBashCompletion(w, progName)
+}
+
+func writeFishCompletion(w io.Writer, progName string) {
+	names := misc.SortedKeys(subcommands)
+	_, _ = fmt.Fprintf(w, "# fish completion for %[1]s; generated by %[1]s completion fish\n", progName)
+	_, _ = fmt.Fprintf(w, "complete -c %s -f\n", progName)
+	for _, name := range names {
+		help := strings.TrimSpace(subcommands[name].help)
+		help, _, _ = strings.Cut(help, ".")
+		help = strings.Join(strings.Fields(help), " ")
+		_, _ = fmt.Fprintf(
+			w,
+			"complete -c %s -n __fish_use_subcommand -a %s -d %s\n",
+			progName,
+			name,
+			fishQuote(help),
+		)
+	}
+	for _, name := range names {
+		args := argTables[subcommands[name].action]
+		for _, a := range misc.SortedKeys(args) {
+			if a == "" {
+				continue
+			}
+			_, _ = fmt.Fprintf(
+				w,
+				"complete -c %s -n '__fish_seen_subcommand_from %s' -o %s -d %s\n",
+				progName,
+				name,
+				a,
+				fishQuote(args[a].help),
+			)
+		}
+		if _, ok := args[""]; ok {
+			_, _ = fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -F\n", progName, name)
+		}
+	}
+	_, _ = fmt.Fprintf(
+		w,
+		"complete -c %[1]s -n 'string match -q \"repo:*\" -- (commandline -ct)' -a '(%[1]s completion sites 2>/dev/null)'\n",
+		progName,
+	)
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func (p *parser) doCompletion() error {
+	switch p.input1 {
+	case "bash":
+		writeBashCompletion(os.Stdout, p.progName)
+	case "zsh":
+		writeZshCompletion(os.Stdout, p.progName)
+	case "fish":
+		writeFishCompletion(os.Stdout, p.progName)
+	case "sites":
+		return p.completeSites(os.Stdout)
+	}
+	return nil
+}
+
+// completeSites writes the scan inputs for the repository and each site that
+// has a database in it, one per line.
+func (p *parser) completeSites(w io.Writer) error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	names, err := r.SiteNames()
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(w, repo.ScanPrefix)
+	for _, name := range names {
+		_, _ = fmt.Fprintln(w, repo.ScanPrefix+name)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package qfs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The configuration file, .qfs/config, supplies default values for options. It
+// uses a subset of TOML: each line is blank, a comment, a [subcommand] section
+// header, or `option = value`, where value is true, false, an integer, a quoted
+// string, or an array of quoted strings on one line. Settings before the first
+// section apply to every subcommand that accepts the option. Settings in a
+// section apply only to that subcommand and take precedence over top-level
+// settings. An option given on the command line replaces any configured value.
+
+var configKeyRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+var configSectionRe = regexp.MustCompile(`^\[\s*([a-z0-9-]+)\s*]$`)
+var configIntRe = regexp.MustCompile(`^[-+]?\d+`)
+
+type configSetting struct {
+	line   int
+	key    string
+	isBool bool
+	values []string
+}
+
+// siteConfig maps section names to settings. Top-level settings are in the ""
+// section.
+type siteConfig struct {
+	filename string
+	sections map[string]map[string]*configSetting
+}
+
+func readConfig(filename string) (*siteConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &siteConfig{
+		filename: filename,
+		sections: map[string]map[string]*configSetting{"": {}},
+	}
+	section := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := configSectionRe.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			if _, ok := subcommands[section]; !ok {
+				return nil, fmt.Errorf("%s:%d: unknown subcommand \"%s\"", filename, lineNo, section)
+			}
+			if c.sections[section] == nil {
+				c.sections[section] = map[string]*configSetting{}
+			}
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !configKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected option = value", filename, lineNo)
+		}
+		if _, seen := c.sections[section][key]; seen {
+			return nil, fmt.Errorf("%s:%d: %s is already set", filename, lineNo, key)
+		}
+		setting, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", filename, lineNo, key, err)
+		}
+		setting.line = lineNo
+		setting.key = key
+		c.sections[section][key] = setting
+	}
+	return c, nil
+}
+
+// parseConfigValue parses the value of a setting, which may be followed by a
+// comment.
+func parseConfigValue(value string) (*configSetting, error) {
+	s := &configSetting{}
+	var rest string
+	switch {
+	case strings.HasPrefix(value, "true"):
+		s.isBool = true
+		s.values = []string{"true"}
+		rest = value[4:]
+	case strings.HasPrefix(value, "false"):
+		s.isBool = true
+		s.values = []string{"false"}
+		rest = value[5:]
+	case configIntRe.MatchString(value):
+		n := configIntRe.FindString(value)
+		s.values = []string{strings.TrimPrefix(n, "+")}
+		rest = value[len(n):]
+	case strings.HasPrefix(value, "["):
+		rest = strings.TrimSpace(value[1:])
+		for !strings.HasPrefix(rest, "]") {
+			str, after, err := parseConfigString(rest)
+			if err != nil {
+				return nil, err
+			}
+			s.values = append(s.values, str)
+			rest = strings.TrimSpace(after)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, errors.New("expected , or ] in array")
+			}
+		}
+		rest = rest[1:]
+	default:
+		str, after, err := parseConfigString(value)
+		if err != nil {
+			return nil, err
+		}
+		s.values = []string{str}
+		rest = after
+	}
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, fmt.Errorf("unexpected text after value: %s", rest)
+	}
+	return s, nil
+}
+
+// parseConfigString parses a double-quoted string with escapes or a
+// single-quoted literal string at the beginning of s. It returns the string and
+// whatever follows it.
+func parseConfigString(s string) (string, string, error) {
+	if strings.HasPrefix(s, "'") {
+		end := strings.Index(s[1:], "'")
+		if end == -1 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", errors.New("value must be true, false, a number, a quoted string, or an array of strings")
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			str, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return str, s[i+1:], nil
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
+
+// configOverrides lists options that replace other options when given on the
+// command line because they can't be given together.
+var configOverrides = map[string][]string{
+	"trash":      {"backup-dir"},
+	"backup-dir": {"trash"},
+}
+
+// applyConfig applies settings from the configuration file for options that
+// were not given on the command line.
+func (p *parser) applyConfig() error {
+	c, err := readConfig(filepath.Join(p.top, repofiles.Config))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var subcommand string
+	for name, s := range subcommands {
+		if s.action == p.action {
+			subcommand = name
+			break
+		}
+	}
+	settings := map[string]*configSetting{}
+	for key, s := range c.sections[""] {
+		if _, ok := argTables[p.action][key]; ok {
+			settings[key] = s
+		} else if !isOption(key) {
+			return fmt.Errorf("%s:%d: unknown option \"%s\"", c.filename, s.line, key)
+		}
+	}
+	for key, s := range c.sections[subcommand] {
+		if _, ok := argTables[p.action][key]; !ok {
+			return fmt.Errorf("%s:%d: %s doesn't accept option \"%s\"", c.filename, s.line, subcommand, key)
+		}
+		settings[key] = s
+	}
+	for _, key := range misc.SortedKeys(settings) {
+		s := settings[key]
+		if key == "top" {
+			return fmt.Errorf("%s:%d: top may not be set in the configuration file", c.filename, s.line)
+		}
+		if p.seen[key] || overridden(p.seen, key) {
+			continue
+		}
+		if err := p.applySetting(s); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", c.filename, s.line, key, err)
+		}
+	}
+	return nil
+}
+
+func overridden(seen map[string]bool, key string) bool {
+	for _, other := range configOverrides[key] {
+		if seen[other] {
+			return true
+		}
+	}
+	return false
+}
+
+// isOption returns true if any subcommand accepts the option.
+func isOption(key string) bool {
+	for _, args := range argTables {
+		if _, ok := args[key]; ok && key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// applySetting calls the option's handler as if it had been given on the
+// command line. An array value gives the option once for each element, and
+// false omits it.
+func (p *parser) applySetting(s *configSetting) error {
+	handler := argTables[p.action][s.key]
+	savedArgs, savedArg := p.args, p.arg
+	defer func() {
+		p.args, p.arg = savedArgs, savedArg
+	}()
+	if s.isBool {
+		if s.values[0] == "false" {
+			return nil
+		}
+		p.args, p.arg = nil, 0
+		if err := handler.fn(p, s.key); err != nil {
+			return fmt.Errorf("option requires a value, not true or false")
+		}
+		return nil
+	}
+	for _, v := range s.values {
+		p.args, p.arg = []string{v}, 0
+		if err := handler.fn(p, s.key); err != nil {
+			return err
+		}
+		if p.arg == 0 {
+			return fmt.Errorf("option doesn't take a value; use true or false")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package qfs
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setEcho turns echo on standard input on or off using stty and returns true if
+// it succeeded.
+func setEcho(on bool) bool {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run() == nil
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package qfs
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	kernel32       = syscall.NewLazyDLL("kernel32.dll")
+	setConsoleMode = kernel32.NewProc("SetConsoleMode")
+)
+
+// enableEchoInput is ENABLE_ECHO_INPUT from wincon.h.
+const enableEchoInput = 0x4
+
+// setEcho turns echo on standard input on or off by changing the console's
+// input mode and returns true if it succeeded.
+func setEcho(on bool) bool {
+	// TEST: NOT COVERED
+	h := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(h, &mode); err != nil {
+		return false
+	}
+	if on {
+		mode |= enableEchoInput
+	} else {
+		mode &^= enableEchoInput
+	}
+	r, _, _ := setConsoleMode.Call(uintptr(h), uintptr(mode))
+	return r != 0
+}
@@ -0,0 +1,480 @@
+package qfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repo"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// qfs gateway makes some repository operations available over HTTP using the
+// credentials of the site it runs at, so a web UI, other services, or qfs with
+// -gateway can use the repository without credentials for S3. Every request
+// must include the token from QFS_GATEWAY_TOKEN as a bearer token. Responses
+// are JSON objects except for successful requests for a file's contents.
+//
+//	GET  /v1/status
+//	GET  /v1/versions?path=p[&as-of=t][&long=true][&show-site=true]
+//	GET  /v1/get?path=p[&as-of=t]
+//	POST /v1/push[?n=true][&path=p...]
+//
+// t is a timestamp in any form accepted by -as-of. Requests are handled one at
+// a time since they share the site's local files.
+
+const gatewayTokenEnv = "QFS_GATEWAY_TOKEN"
+
+// These headers accompany a file's contents so that the file can be saved with
+// its modification time, in milliseconds since the epoch, and permissions.
+const (
+	gatewayModTimeHeader     = "X-Qfs-Modtime"
+	gatewayPermissionsHeader = "X-Qfs-Permissions"
+)
+
+type gatewayResponse struct {
+	Error    string   `json:"error,omitempty"`
+	Messages []string `json:"messages,omitempty"`
+	// Prompts are the questions that were answered no because a request can't
+	// answer them; see gatewayAnswers.
+	Prompts []string     `json:"prompts,omitempty"`
+	Output  string       `json:"output,omitempty"`
+	Status  *serveStatus `json:"status,omitempty"`
+}
+
+// errBadRequest marks a problem with a request rather than with carrying it
+// out.
+type errBadRequest struct {
+	error
+}
+
+// gatewayAnswers holds the answers to the prompts that a request answers by
+// being made. A push request is its own confirmation, and conflicts always stop
+// it. Any other prompt, such as whether to ignore an expired lock, asks about
+// something unexpected, so it is answered no and reported in the response.
+var gatewayAnswers = map[string]bool{
+	"Continue?":                 true,
+	"Conflicts detected. Exit?": true,
+}
+
+// gatewayUI collects a request's messages, output, and unanswered prompts for
+// the response.
+type gatewayUI struct {
+	mutex    gosync.Mutex
+	messages []string
+	prompts  []string
+	output   bytes.Buffer
+}
+
+func (ui *gatewayUI) Message(format string, args ...any) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	ui.messages = append(ui.messages, fmt.Sprintf(format, args...))
+}
+
+func (ui *gatewayUI) Prompt(prompt string) bool {
+	if answer, ok := gatewayAnswers[prompt]; ok {
+		return answer
+	}
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	ui.prompts = append(ui.prompts, prompt)
+	return false
+}
+
+func (ui *gatewayUI) Output() io.Writer {
+	return &ui.output
+}
+
+type gateway struct {
+	p     *parser
+	token string
+	mutex gosync.Mutex
+}
+
+func (p *parser) doGateway() error {
+	token := os.Getenv(gatewayTokenEnv)
+	if token == "" {
+		return fmt.Errorf("gateway requires %s to be set", gatewayTokenEnv)
+	}
+	g := &gateway{
+		p:     p,
+		token: token,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", g.handle(g.status))
+	mux.HandleFunc("GET /v1/versions", g.handle(g.versions))
+	mux.HandleFunc("GET /v1/get", g.get)
+	mux.HandleFunc("POST /v1/push", g.handle(g.push))
+	server := &http.Server{
+		Handler: g.authorize(mux),
+		BaseContext: func(net.Listener) context.Context {
+			return p.ctx
+		},
+	}
+	listener, err := net.Listen("tcp", p.listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-p.ctx.Done()
+		// Requests in progress see the canceled context and stop cleanly.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+	misc.Message("listening on %s", listener.Addr())
+	if p.cert != "" {
+		err = server.ServeTLS(listener, p.cert, p.certKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func writeGatewayResponse(w http.ResponseWriter, code int, response *gatewayResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func gatewayErrorCode(err error) int {
+	var badRequest errBadRequest
+	switch {
+	case errors.As(err, &badRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (g *gateway) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeGatewayResponse(w, http.StatusUnauthorized, &gatewayResponse{Error: "missing or invalid token"})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// newRepo returns the repository of the gateway's site for a request.
+func (g *gateway) newRepo(req *http.Request, ui *gatewayUI) (*repo.Repo, error) {
+	return repo.New(
+		repo.WithLocalTop(g.p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(req.Context()),
+		repo.WithUI(ui),
+	)
+}
+
+// handle returns a handler that calls fn with the gateway site's repository and
+// responds with the messages and output that fn generated and its error, if
+// any.
+func (g *gateway) handle(
+	fn func(req *http.Request, r *repo.Repo, response *gatewayResponse) error,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		ui := &gatewayUI{}
+		response := &gatewayResponse{}
+		r, err := g.newRepo(req, ui)
+		if err == nil {
+			err = fn(req, r, response)
+		}
+		response.Messages = ui.messages
+		response.Prompts = ui.prompts
+		if ui.output.Len() > 0 {
+			response.Output = ui.output.String()
+		}
+		code := http.StatusOK
+		if err != nil {
+			response.Error = err.Error()
+			code = gatewayErrorCode(err)
+		}
+		writeGatewayResponse(w, code, response)
+	}
+}
+
+func gatewayBool(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errBadRequest{fmt.Errorf("%s must be true or false", name)}
+	}
+	return b, nil
+}
+
+func gatewayTime(q url.Values, name string) (time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := parseTimestamp(v)
+	if err != nil {
+		return time.Time{}, errBadRequest{fmt.Errorf("%s: %w", name, err)}
+	}
+	return t, nil
+}
+
+func gatewayPath(q url.Values) (string, error) {
+	p := q.Get("path")
+	if p == "" {
+		return "", errBadRequest{errors.New("path is required")}
+	}
+	return p, nil
+}
+
+func (g *gateway) status(_ *http.Request, r *repo.Repo, response *gatewayResponse) error {
+	status, err := r.Status()
+	if err != nil {
+		return err
+	}
+	response.Status = newServeStatus(status)
+	var b strings.Builder
+	if err = status.Write(&b); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	response.Output = b.String()
+	return nil
+}
+
+func (g *gateway) versions(req *http.Request, r *repo.Repo, _ *gatewayResponse) error {
+	q := req.URL.Query()
+	p, err := gatewayPath(q)
+	if err != nil {
+		return err
+	}
+	asOf, err := gatewayTime(q, "as-of")
+	if err != nil {
+		return err
+	}
+	long, err := gatewayBool(q, "long")
+	if err != nil {
+		return err
+	}
+	showSite, err := gatewayBool(q, "show-site")
+	if err != nil {
+		return err
+	}
+	return r.ListVersions(p, &repo.ListVersionsConfig{
+		AsOf:     asOf,
+		Long:     long,
+		ShowSite: showSite,
+		Filters:  g.p.filters,
+	})
+}
+
+func (g *gateway) push(req *http.Request, r *repo.Repo, _ *gatewayResponse) error {
+	q := req.URL.Query()
+	noOp, err := gatewayBool(q, "n")
+	if err != nil {
+		return err
+	}
+	_, err = r.Push(&repo.PushConfig{
+		NoOp:  noOp,
+		Paths: q["path"],
+	})
+	return err
+}
+
+// get responds with the contents of a single file. It doesn't use handle since
+// the contents are sent as they are read.
+func (g *gateway) get(w http.ResponseWriter, req *http.Request) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ui := &gatewayUI{}
+	info, rd, err := func() (*fileinfo.FileInfo, io.ReadCloser, error) {
+		q := req.URL.Query()
+		p, err := gatewayPath(q)
+		if err != nil {
+			return nil, nil, err
+		}
+		asOf, err := gatewayTime(q, "as-of")
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := g.newRepo(req, ui)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r.OpenFile(p, &repo.GetConfig{
+			AsOf:    asOf,
+			Filters: g.p.filters,
+		})
+	}()
+	if err != nil {
+		writeGatewayResponse(w, gatewayErrorCode(err), &gatewayResponse{
+			Error:    err.Error(),
+			Messages: ui.messages,
+			Prompts:  ui.prompts,
+		})
+		return
+	}
+	defer func() { _ = rd.Close() }()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set(gatewayModTimeHeader, strconv.FormatInt(info.ModTime.UnixMilli(), 10))
+	w.Header().Set(gatewayPermissionsHeader, fmt.Sprintf("%04o", info.Permissions))
+	if _, err = io.Copy(w, rd); err != nil {
+		// TEST: NOT COVERED. Abort the response so the client doesn't mistake
+		// what it has received for the whole file.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// gatewayRequest sends a request to the gateway given with -gateway.
+func (p *parser) gatewayRequest(method, endpoint string, params url.Values) (*http.Response, error) {
+	token := os.Getenv(gatewayTokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("-gateway requires %s to be set", gatewayTokenEnv)
+	}
+	u := strings.TrimSuffix(p.gateway, "/") + endpoint
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(p.ctx, method, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("gateway: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+// gatewayCall sends a request to the gateway, reports the messages and writes
+// the output from its response, and returns its error, if any.
+func (p *parser) gatewayCall(method, endpoint string, params url.Values) error {
+	resp, err := p.gatewayRequest(method, endpoint, params)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return gatewayResult(resp)
+}
+
+func gatewayResult(resp *http.Response) error {
+	response := &gatewayResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("gateway: invalid response (%s): %w", resp.Status, err)
+	}
+	for _, m := range response.Messages {
+		misc.Message("%s", m)
+	}
+	for _, prompt := range response.Prompts {
+		misc.Message("gateway answered no: %s", prompt)
+	}
+	if _, err := io.WriteString(os.Stdout, response.Output); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if response.Error != "" {
+		return fmt.Errorf("gateway: %s", response.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway: %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *parser) gatewayTimestamp(params url.Values) {
+	if !p.timestamp.IsZero() {
+		params.Set("as-of", strconv.FormatInt(p.timestamp.UnixMilli(), 10))
+	}
+}
+
+func (p *parser) gatewayListVersions() error {
+	params := url.Values{"path": {p.input1}}
+	p.gatewayTimestamp(params)
+	if p.long {
+		params.Set("long", "true")
+	}
+	if p.showSite {
+		params.Set("show-site", "true")
+	}
+	return p.gatewayCall(http.MethodGet, "/v1/versions", params)
+}
+
+func (p *parser) gatewayStatus() error {
+	return p.gatewayCall(http.MethodGet, "/v1/status", nil)
+}
+
+func (p *parser) gatewayPush() error {
+	params := url.Values{"path": p.paths}
+	if p.noOp {
+		params.Set("n", "true")
+	}
+	return p.gatewayCall(http.MethodPost, "/v1/push", params)
+}
+
+// gatewayGet retrieves a single file through the gateway. As with get, it is
+// saved below the save location with its path in the repository.
+func (p *parser) gatewayGet() error {
+	relPath := path.Clean(filepath.ToSlash(p.input1))
+	dest := localsource.New(p.input2)
+	if !p.stdout {
+		if _, err := dest.FileInfo(relPath); !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s must not exist", filepath.Join(p.input2, relPath))
+		}
+	}
+	params := url.Values{"path": {relPath}}
+	p.gatewayTimestamp(params)
+	resp, err := p.gatewayRequest(http.MethodGet, "/v1/get", params)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return gatewayResult(resp)
+	}
+	if p.stdout {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	modTime, err1 := strconv.ParseInt(resp.Header.Get(gatewayModTimeHeader), 10, 64)
+	permissions, err2 := strconv.ParseUint(resp.Header.Get(gatewayPermissionsHeader), 8, 16)
+	if err1 != nil || err2 != nil || resp.ContentLength < 0 {
+		return errors.New("gateway: response is missing file information")
+	}
+	info := &fileinfo.FileInfo{
+		Path:        relPath,
+		FileType:    fileinfo.TypeFile,
+		ModTime:     time.UnixMilli(modTime),
+		Size:        resp.ContentLength,
+		Permissions: uint16(permissions),
+	}
+	fmt.Println(relPath)
+	_, err = fileinfo.RetrieveFromInfo(info, fileinfo.NewPath(dest, relPath), func(f *os.File) error {
+		_, err := io.Copy(f, resp.Body)
+		return err
+	})
+	return err
+}
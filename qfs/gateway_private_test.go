@@ -0,0 +1,24 @@
+package qfs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGatewayPrompts(t *testing.T) {
+	ui := &gatewayUI{}
+	// The request confirms the push, and conflicts stop it.
+	if !ui.Prompt("Continue?") {
+		t.Error("push wasn't confirmed")
+	}
+	if !ui.Prompt("Conflicts detected. Exit?") {
+		t.Error("conflicts were overridden")
+	}
+	// Anything else is declined and reported.
+	if ui.Prompt("Ignore the expired lock?") {
+		t.Error("expired lock was ignored")
+	}
+	if !slices.Equal(ui.prompts, []string{"Ignore the expired lock?"}) {
+		t.Errorf("wrong prompts: %q", ui.prompts)
+	}
+}
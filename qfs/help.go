@@ -0,0 +1,161 @@
+package qfs
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/misc"
+)
+
+// example is a command shown in a subcommand's help. args follows the program
+// name.
+type example struct {
+	args string
+	what string
+}
+
+var examples = map[string][]example{
+	"scan": {
+		{"scan .", "list the current directory recursively"},
+		{"scan -db /tmp/home.db -junk '~$' .", "save a database of the current directory without backup files"},
+		{"scan repo:laptop", "show the repository's copy of the database for site laptop"},
+		{"scan -checksum blake3 -db /backup/home.db .", "save a database with a checksum of every file"},
+		{"scan -format mtree -checksum sha256 . > home.mtree", "write an mtree specification for other integrity tools"},
+		{"scan -stats -db /tmp/home.db .", "show how long a scan takes and what the filters reject"},
+	},
+	"diff": {
+		{"diff /tmp/home.db .", "show what has changed since a database was saved"},
+		{"diff repo: .", "show what push would see"},
+		{"diff -offline repo:repo /tmp/repo.db", "compare a saved database with the repository as of the last refresh"},
+		{"diff mtree:/etc/mtree/home.spec .", "compare the current directory with an mtree specification"},
+	},
+	"init-repo": {
+		{"init-repo", "create the repository given in .qfs/repo"},
+		{"init-repo -clean-repo", "remove objects the repository filter excludes"},
+		{"init-repo -migrate -n -report migrate.json", "show what migrating from aws s3 sync would do"},
+	},
+	"push": {
+		{"push -n", "show what would be pushed without pushing it"},
+		{"push src docs", "push only changes in src and docs"},
+		{"push -plan /tmp/push.json", "save the changes for review and apply them later with apply-plan"},
+		{"push -metadata-only", "after chmod -R, update permissions without uploading files again"},
+		{"push -renames", "after renaming a directory, copy its files within S3 instead of uploading them"},
+		{"push -timeout 30m", "stop cleanly if the push has not finished after 30 minutes"},
+		{"push -keep-going", "push everything that can be pushed, then list files that failed"},
+	},
+	"pull": {
+		{"pull -n", "show what would be pulled without pulling it"},
+		{"pull -trash", "pull, saving files that would be removed or overwritten in .qfs/trash"},
+		{"pull -stage", "download all changed files before changing anything in the site"},
+		{"pull -schedule interleave", "start large downloads early without making small files wait for them"},
+		{"pull -delete-excluded -trash", "after removing a directory from the site filter, move its files to .qfs/trash"},
+	},
+	"list-versions": {
+		{"list-versions -as-of 2024-06-01 notes", "list versions of files under notes as of a date"},
+		{"list-versions -diff 2 notes/todo.txt", "show what changed in the most recent version of a file"},
+	},
+	"diff-versions": {
+		{"diff-versions -from 2024-06-01 -to 2024-06-02", "show what changed in the repository on June 1"},
+		{"diff-versions -from 1717200000 notes", "show what has changed under notes since a push"},
+	},
+	"get": {
+		{"get -as-of 2024-06-01 notes/todo.txt /tmp", "retrieve an old version of a file"},
+		{"get -stdout notes/todo.txt", "show the current version of a file"},
+		{"get -version-id 3HL4kqtJlcpXroDTDmJ.rmSpXd3dIbrHY notes/todo.txt /tmp", "retrieve a version shown by list-versions -long"},
+		{"get -deleted-only notes /tmp/restore", "recover files under notes that were removed"},
+		{"get -gateway https://backup.example.com:8443 -stdout notes/todo.txt", "show a file using a gateway's credentials"},
+	},
+	"sync": {
+		{"sync -owners /src /backup", "copy /src to /backup, preserving ownerships"},
+		{"sync -modify-window 2 /src /mnt/usb", "copy to a FAT file system, which stores times to two seconds"},
+		{"sync -rewrite \"src=docs dest=Documents\" /src /backup", "copy /src/docs to /backup/Documents"},
+		{"sync -prune-empty-dirs -prune '*.o' /src /backup", "copy /src without object files or directories left empty"},
+	},
+	"export-tar": {
+		{"export-tar -as-of 2024-06-01 projects -o projects.tar.gz", "archive projects as they were on a date"},
+		{"export-tar -o - photos | ssh host tar xzf -", "copy a snapshot of photos to another computer"},
+	},
+	"status": {
+		{"status", "show how the site and the repository have drifted"},
+		{"status -offline", "show drift as of the last refresh without accessing the repository"},
+	},
+	"refresh": {
+		{"refresh", "download the latest repository database before going offline"},
+	},
+	"login": {
+		{"login", "store keys for the repository's endpoint in the keyring"},
+		{"pass show minio | qfs login", "store keys from a password manager"},
+		{"login -remove", "remove the stored keys"},
+	},
+	"serve": {
+		{"serve -socket /tmp/qfs.sock", "answer requests from editors and status bars"},
+	},
+	"gateway": {
+		{"gateway -listen :8443 -cert cert.pem -key key.pem", "serve repository requests over HTTPS"},
+	},
+	"clone": {
+		{"clone -site laptop s3://bucket/home ~/home", "set up site laptop in ~/home and pull its files"},
+	},
+	"readonly-policy": {
+		{"readonly-policy > readonly.json", "save a policy for credentials of sites that may only pull"},
+	},
+	"db": {
+		{"db info /tmp/home.db", "summarize a database"},
+		{"db info -quick /tmp/home.db", "show the counts recorded in a database's header"},
+		{"db merge -o /tmp/all.db /tmp/home.db /tmp/work.db", "combine databases, preferring entries from work.db"},
+		{"db filter -prune '*.o' -o /tmp/src.db /tmp/home.db", "write a database without object files"},
+	},
+	"clean": {
+		{"clean -n -filter-prune ~/.qfs/prune .", "show the junk files the prune filter would remove"},
+		{"clean -pruned -prune node_modules .", "remove junk and show how much space pruned directories use"},
+	},
+	"protect": {
+		{"protect on", "require a confirmation token for commands that remove data"},
+		{"protect off -confirm-token 5d41402a", "remove protection using the token from a previous attempt"},
+	},
+	"copy-site": {
+		{"copy-site old-laptop new-laptop", "let a replacement computer take over a site's state"},
+		{"copy-site -filter-only laptop desktop", "start a new site with another site's filter"},
+	},
+	"quota": {
+		{"quota", "show how much of the repository's quota is used"},
+		{"quota -size 500G -objects 1000000", "refuse pushes that would go over 500 GiB or a million objects"},
+		{"quota -size 500G -warn", "warn about pushes that would go over 500 GiB"},
+		{"quota -remove", "remove the quota"},
+	},
+	"upgrade-repo": {
+		{"upgrade-repo -n", "show the keys that would be rewritten"},
+	},
+	"completion": {
+		{"completion bash > ~/.local/share/bash-completion/completions/qfs", "install bash completion"},
+		{"completion fish > ~/.config/fish/completions/qfs.fish", "install fish completion"},
+	},
+}
+
+// printSubcommandHelp prints the usage, description, options, and examples of
+// a subcommand.
+func printSubcommandHelp(progName string, name string) {
+	sData := subcommands[name]
+	args, ok := argTables[sData.action]
+	if !ok {
+		panic("no args for " + name)
+	}
+	pos, ok := args[""]
+	if ok {
+		fmt.Printf("\n%s %s {%s} [options]\n", progName, name, pos.help)
+	} else {
+		fmt.Printf("\n%s %s [options]\n", progName, name)
+	}
+	fmt.Println(sData.help)
+	fmt.Printf("%s options:\n", name)
+	for _, a := range misc.SortedKeys(args) {
+		if a == "" {
+			continue
+		}
+		fmt.Printf("  --%s: %s\n", a, args[a].help)
+	}
+	if len(examples[name]) > 0 {
+		fmt.Printf("%s examples:\n", name)
+		for _, e := range examples[name] {
+			fmt.Printf("  # %s\n  %s %s\n", e.what, progName, e.args)
+		}
+	}
+}
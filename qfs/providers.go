@@ -0,0 +1,69 @@
+package qfs
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/repo"
+	"github.com/jberkenbilt/qfs/s3lister"
+	"github.com/jberkenbilt/qfs/scan"
+	"io"
+)
+
+// Scan input providers for back ends that need the command's S3 client. Other
+// providers are registered by the scan package.
+
+func init() {
+	scan.Register("repo", scan.ProviderFunc(repoProvider))
+	scan.Register("s3", s3Provider{})
+}
+
+// repoProvider handles repo: and repo:$site.
+func repoProvider(input string, config *scan.Config) (database.Database, error) {
+	r, err := repo.New(
+		repo.WithLocalTop(config.Top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(config.Context),
+		repo.WithOffline(config.Offline),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return r.Scan(input, config.Filters)
+}
+
+// s3Provider lists objects for s3://bucket[/prefix]. This is a raw listing
+// rather than a database.
+type s3Provider struct{}
+
+func (s3Provider) Database(input string, _ *scan.Config) (database.Database, error) {
+	return nil, fmt.Errorf("%s: S3 locations can only be listed", input)
+}
+
+func (s3Provider) List(input string, config *scan.Config, w io.Writer) error {
+	m := s3Re.FindStringSubmatch(input)
+	if m == nil {
+		return fmt.Errorf("%s: S3 input must be s3://bucket[/prefix]", input)
+	}
+	bucket := m[1]
+	prefix := m[2]
+	ls, err := s3lister.New(s3lister.WithS3Client(S3Client))
+	if err != nil {
+		return err
+	}
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}
+	return ls.List(config.Context, listInput, func(objects []types.Object) {
+		for _, obj := range objects {
+			if config.Long {
+				_, _ = fmt.Fprintf(w, "%d %d %s\n", obj.LastModified.UnixMilli(), *obj.Size, *obj.Key)
+			} else {
+				_, _ = fmt.Fprintln(w, *obj.Key)
+			}
+		}
+	})
+}
@@ -2,58 +2,139 @@
 package qfs
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/clean"
 	"github.com/jberkenbilt/qfs/database"
 	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/digest"
 	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/keyring"
 	"github.com/jberkenbilt/qfs/localsource"
 	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/repo"
-	"github.com/jberkenbilt/qfs/s3lister"
+	"github.com/jberkenbilt/qfs/repofiles"
 	"github.com/jberkenbilt/qfs/scan"
 	"github.com/jberkenbilt/qfs/sync"
+	"github.com/jberkenbilt/qfs/traverse"
+	"io"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-var S3Client *s3.Client // Overridden in test suite
+var S3Client *s3.Client     // Overridden in test suite
+var Keyring keyring.Keyring // Overridden in test suite
 var s3Re = regexp.MustCompile(`^s3://([^/]+)(?:/(.*))?$`)
 var epochRe = regexp.MustCompile(`^\d+$`)
 var dateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
 var dateTimeRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_\d{2}:\d{2}:\d{2}(?:\.\d{3})?$`)
 
 type parser struct {
+	ctx           context.Context
 	progName      string
 	args          []string
 	arg           int
 	action        actionKey
 	top           string // local root directory instead of current directory
+	origDir       string // directory to return to after -C
 	input1        string
 	input2        string
+	paths         []string
 	filters       []*filter.Filter
 	dynamicFilter *filter.Filter
 	db            string
 	long          bool
+	stream        bool
+	stats         bool
+	scanStats     *traverse.Stats
+	binary        bool
+	quick         bool
+	pruned        bool
+	mtree         bool
 	cleanup       bool
 	sameDev       bool
+	followDirs    bool
 	filesOnly     bool
 	noSpecial     bool
+	pruneEmpty    bool
+	filterOnly    bool
 	nonFileTimes  bool
 	noOwnerships  bool
+	noPerms       bool
 	checks        bool
 	noOp          bool
+	bypassGov     bool
 	localFilter   bool
+	force         bool
+	remove        bool
+	merge         bool
+	mergeTool     string
+	diffVersions  string
+	diffTool      string
+	plan          string
+	report        string
+	confirmToken  string
+	mfa           string
+	keepGoing     bool
+	offline       bool
+	modifyWindow  time.Duration
+	showSite      bool
+	stdout        bool
+	versionId     string
+	deletedOnly   bool
+	backupDir     string
+	dest          string
+	output        string
+	versions      bool
+	trash         bool
+	owners        bool
+	dirTimes      bool
+	clampFuture   bool
+	metadataOnly  bool
+	renames       bool
+	birthTimes    bool
+	nanoseconds   bool
+	timeout       time.Duration
+	checksum      string
+	renameCase    bool
+	stage         bool
+	delExcluded   bool
+	verbose       bool
+	maxTransfer   int64
+	quotaSize     int64
+	quotaObjects  int64
+	quotaWarn     bool
+	local         bool
+	repair        bool
+	socket        string
+	listen        string
+	cert          string
+	certKey       string
+	gateway       string
+	site          string
+	numericIds    bool
+	uidMap        map[int]int
+	gidMap        map[int]int
+	pathRules     []localsource.PathRule
+	symlinks      fileinfo.SymlinkMode
+	schedule      sync.Schedule
 	initMode      repo.InitMode
 	timestamp     time.Time
+	fromTime      time.Time
+	toTime        time.Time
+	seen          map[string]bool // options given on the command line
 }
 
 // Our command-line syntax is complex and not well-suited to something like
@@ -83,6 +164,35 @@ const (
 	actPushTimes
 	actListVersions
 	actGet
+	actStatus
+	actUnlock
+	actEmptyTrash
+	actReplicate
+	actDoctor
+	actBundle
+	actSites
+	actRemoveSite
+	actSetRetention
+	actApplyRetention
+	actDu
+	actApplyPlan
+	actLog
+	actFsckRepo
+	actServe
+	actCompletion
+	actClone
+	actDiffVersions
+	actDb
+	actReadOnlyPolicy
+	actGateway
+	actClean
+	actProtect
+	actUpgradeRepo
+	actRefresh
+	actLogin
+	actExportTar
+	actQuota
+	actCopySite
 )
 
 func arg(fn func(*parser, string) error, help string) argHandler {
@@ -98,6 +208,8 @@ var argTables = func() map[actionKey]map[string]argHandler {
 		"filter-prune": arg(argFilter, "filter file -- read prune/junk only"),
 		"include":      arg(argDynamicFilter, "include directive for dynamic filter"),
 		"exclude":      arg(argDynamicFilter, "exclude directive for dynamic filter"),
+		"include-from": arg(argDynamicFilterFrom, "file of include directives for dynamic filter"),
+		"exclude-from": arg(argDynamicFilterFrom, "file of exclude directives for dynamic filter"),
 		"prune":        arg(argDynamicFilter, "prune directive for dynamic filter"),
 		"junk":         arg(argDynamicFilter, "junk directive for dynamic filter"),
 		"f":            arg(argFilesOnly, "files and symbolic links only"),
@@ -107,70 +219,298 @@ var argTables = func() map[actionKey]map[string]argHandler {
 		actNone: {
 			"":        arg(argSubcommand, "subcommand"),
 			"version": arg(argVersion, "show version and exit"),
+			"C":       arg(argChdir, "change to the given directory before doing anything else"),
 			// help is added in init to avoid circular initialization reference
 		},
 		actScan: {
-			"":        arg(argOneInput, "scan-input"),
-			"long":    arg(argLong, "show ownerships"),
-			"db":      arg(argDb, "write to specified database file"),
-			"cleanup": arg(argCleanup, "remove junk files"),
-			"xdev":    arg(argXDev, "don't cross device boundaries"),
-			"top":     arg(argTop, "with repo: or repo:site, specific top-level directory"),
+			"":                 arg(argOneInput, "scan-input"),
+			"long":             arg(argLong, "show ownerships, creation times, and checksums"),
+			"birth-times":      arg(argBirthTimes, "capture creation times where available"),
+			"nanoseconds":      arg(argNanoseconds, "keep modification times to the nanosecond"),
+			"checksum":         arg(argChecksum, "compute each file's checksum with algorithm (sha256 or blake3)"),
+			"db":               arg(argDb, "write to specified database file"),
+			"stream":           arg(argStream, "write output while scanning instead of after"),
+			"stats":            arg(argStats, "when done, show how the scan went to help tune filters"),
+			"binary":           arg(argBinary, "with -db, write the compact, binary QFS 2 format"),
+			"format":           arg(argFormat, "write output as qfs (the default) or as an mtree specification"),
+			"cleanup":          arg(argCleanup, "remove junk files"),
+			"xdev":             arg(argXDev, "don't cross device boundaries"),
+			"follow-dir-links": arg(argFollowDirLinks, "follow symbolic links to directories"),
+			"top":              arg(argTop, "with repo: or repo:site, specific top-level directory"),
 		},
 		actDiff: {
 			"":               arg(argTwoInputs, "old-scan-input new-scan-input"),
 			"non-file-times": arg(argNonFileTimes, "show modification time changes in non-files"),
 			"no-ownerships":  arg(argNoOwnerships, "don't show ownership changes"),
+			"no-perms":       arg(argNoPerms, "don't show permission changes"),
 			"checks":         arg(argChecks, "include information about \"old\" version for checking"),
+			"renames":        arg(argRenames, "show files that were moved or renamed as renames"),
+			"top":            arg(argTop, "with repo: or repo:site, specific top-level directory"),
+			"offline":        arg(argOffline, "read repo:repo from the local copy without accessing the repository"),
 		},
 		actInitRepo: {
 			"top":        arg(argTop, "local repository top-level directory"),
 			"clean-repo": arg(argCleanRepo, "remove objects not included by filters"),
 			"migrate":    arg(argMigrate, "migrate from aws s3 sync"),
+			"n":          arg(argNoOp, "with -migrate, show what would be migrated without changing anything"),
+			"report":     arg(argReport, "with -migrate, write a JSON report of what is migrated to the given file"),
 		},
 		actPush: {
-			"top":     arg(argTop, "local repository top-level directory"),
-			"cleanup": arg(argCleanup, "remove junk files while scanning"),
-			"n":       arg(argNoOp, "don't modify the repository"),
+			"":                    arg(argPaths, "path ..."),
+			"top":                 arg(argTop, "local repository top-level directory"),
+			"cleanup":             arg(argCleanup, "remove junk files while scanning"),
+			"n":                   arg(argNoOp, "don't modify the repository"),
+			"owners":              arg(argOwners, "save file ownerships in the repository"),
+			"dir-times":           arg(argDirTimes, "push changes to directory modification times"),
+			"clamp-future-mtimes": arg(argClampFuture, "set modification times that are in the future to now"),
+			"metadata-only":       arg(argMetadataOnly, "push only changes that leave contents alone, copying within S3"),
+			"renames":             arg(argRenames, "copy moved or renamed files within S3 instead of uploading them"),
+			"no-perms":            arg(argNoPerms, "ignore permission changes"),
+			"max-transfer":        arg(argMaxTransfer, "fail if more than the given size, such as 10G, would be uploaded"),
+			"birth-times":         arg(argBirthTimes, "capture creation times and save them with pushed files"),
+			"nanoseconds":         arg(argNanoseconds, "keep modification times to the nanosecond"),
+			"plan":                arg(argPlan, "write the changes to the given file as JSON instead of pushing"),
+			"keep-going":          arg(argKeepGoing, "push everything possible and report files that fail at the end"),
 		},
 		actPull: {
-			"top":          arg(argTop, "local repository top-level directory"),
-			"n":            arg(argNoOp, "don't modify the local site"),
-			"local-filter": arg(argLocalFilter, "use the local copy of the site filter"),
+			"":                       arg(argPaths, "path ..."),
+			"top":                    arg(argTop, "local repository top-level directory"),
+			"n":                      arg(argNoOp, "don't modify the local site"),
+			"local-filter":           arg(argLocalFilter, "use the local copy of the site filter"),
+			"merge":                  arg(argMerge, "attempt three-way merge of conflicting files"),
+			"merge-tool":             arg(argMergeTool, "command to use for -merge instead of internal merge"),
+			"trash":                  arg(argTrash, "move removed or overwritten files to .qfs/trash"),
+			"backup-dir":             arg(argBackupDir, "move removed or overwritten files to the given directory"),
+			"owners":                 arg(argOwners, "when running as root, restore saved ownerships"),
+			"numeric-ids":            arg(argNumericIds, "with -owners, don't map users and groups by name"),
+			"chown-map":              arg(argChownMap, "with -owners, map uid old:new (repeatable)"),
+			"chgrp-map":              arg(argChgrpMap, "with -owners, map gid old:new (repeatable)"),
+			"dir-times":              arg(argDirTimes, "restore directory modification times from the repository"),
+			"renames":                arg(argRenames, "move files that were moved or renamed instead of downloading them"),
+			"no-perms":               arg(argNoPerms, "ignore permission changes"),
+			"max-transfer":           arg(argMaxTransfer, "fail if more than the given size, such as 10G, would be downloaded"),
+			"birth-times":            arg(argBirthTimes, "capture creation times in the site database"),
+			"nanoseconds":            arg(argNanoseconds, "keep modification times to the nanosecond"),
+			"plan":                   arg(argPlan, "write the changes to the given file as JSON instead of pulling"),
+			"rename-case-collisions": arg(argRenameCaseCollisions, "on a case-insensitive file system, pull files that differ only in case under new names"),
+			"stage":                  arg(argStage, "download changed files into .qfs/stage before modifying the site"),
+			"delete-excluded":        arg(argDeleteExcluded, "after confirmation, remove unchanged local copies of files the filters exclude"),
+			"keep-going":             arg(argKeepGoing, "pull everything possible and report files that fail at the end"),
+			"schedule":               arg(argSchedule, "order of downloads: diff, largest, or interleave"),
 		},
 		actPushDb: {
 			"top": arg(argTop, "local repository top-level directory"),
 		},
 		actSync: {
-			"":  arg(argTwoInputs, "source-path dest-path"),
-			"n": arg(argNoOp, "show changes without modifying destination"),
+			"":                       arg(argTwoInputs, "source-path dest-path"),
+			"n":                      arg(argNoOp, "show changes without modifying destination"),
+			"backup-dir":             arg(argBackupDir, "move removed or overwritten files to the given directory"),
+			"owners":                 arg(argOwners, "when running as root, copy ownerships"),
+			"chown-map":              arg(argChownMap, "with -owners, map uid old:new (repeatable)"),
+			"chgrp-map":              arg(argChgrpMap, "with -owners, map gid old:new (repeatable)"),
+			"symlinks":               arg(argSymlinks, "handling of symbolic links: create, skip, copy, or follow"),
+			"dir-times":              arg(argDirTimes, "copy directory modification times"),
+			"renames":                arg(argRenames, "move files that were moved or renamed instead of copying them"),
+			"no-perms":               arg(argNoPerms, "ignore permission changes"),
+			"rename-case-collisions": arg(argRenameCaseCollisions, "on a case-insensitive destination, copy files that differ only in case under new names"),
+			"no-special":             arg(argNoSpecial, "ignore pipes, sockets, and devices in both directories"),
+			"prune-empty-dirs":       arg(argPruneEmptyDirs, "leave out directories that contain no files at any depth"),
+			"rewrite":                arg(argRewrite, "\"src=path dest=path\": write src at dest in the destination (repeatable)"),
 		},
 		actPushTimes: {
 			"top": arg(argTop, "local repository top-level directory"),
 		},
 		actListVersions: {
-			"":      arg(argOneInput, "path within repository"),
-			"top":   arg(argTop, "local repository top-level directory"),
-			"as-of": arg(argTimestamp, "ignore anything newer than specified timestamp"),
-			"long":  arg(argLong, "include S3 version identifiers"),
+			"":          arg(argOneInput, "path within repository"),
+			"top":       arg(argTop, "local repository top-level directory"),
+			"as-of":     arg(argTimestamp, "ignore anything newer than specified timestamp"),
+			"long":      arg(argLong, "include S3 version identifiers and saved creation times"),
+			"show-site": arg(argShowSite, "show which site stored each version"),
+			"diff":      arg(argDiffVersions, "show a diff of the contents of two versions, given as old[,new]"),
+			"diff-tool": arg(argDiffTool, "command to use for -diff instead of internal diff"),
+		},
+		actDiffVersions: {
+			"":     arg(argOneInput, "optional path within repository"),
+			"top":  arg(argTop, "local repository top-level directory"),
+			"from": arg(argFrom, "timestamp of the older state"),
+			"to":   arg(argTo, "timestamp of the newer state (default: now)"),
 		},
 		actGet: {
-			"":      arg(argTwoInputs, "repository-path local-path"),
+			"":             arg(argTwoInputs, "repository-path local-path"),
+			"top":          arg(argTop, "local repository top-level directory"),
+			"as-of":        arg(argTimestamp, "ignore anything newer than specified timestamp"),
+			"owners":       arg(argOwners, "when running as root, restore saved ownerships"),
+			"numeric-ids":  arg(argNumericIds, "with -owners, don't map users and groups by name"),
+			"chown-map":    arg(argChownMap, "with -owners, map uid old:new (repeatable)"),
+			"chgrp-map":    arg(argChgrpMap, "with -owners, map gid old:new (repeatable)"),
+			"stdout":       arg(argStdout, "write a single file to standard output"),
+			"dir-times":    arg(argDirTimes, "restore directory modification times"),
+			"keep-going":   arg(argKeepGoing, "retrieve everything possible and report files that fail at the end"),
+			"version-id":   arg(argVersionId, "retrieve the version of a single path with this S3 version ID"),
+			"deleted-only": arg(argDeletedOnly, "retrieve only deleted files, as they were before they were deleted"),
+		},
+		actExportTar: {
+			"":      arg(argOneInput, "[repository-path]"),
 			"top":   arg(argTop, "local repository top-level directory"),
 			"as-of": arg(argTimestamp, "ignore anything newer than specified timestamp"),
+			"o":     arg(argOutput, "gzip-compressed tar file to write, or - for standard output"),
+		},
+		actStatus: {
+			"top":     arg(argTop, "local repository top-level directory"),
+			"offline": arg(argOffline, "use local copies without accessing the repository"),
+		},
+		actEmptyTrash: {
+			"top":        arg(argTop, "local repository top-level directory"),
+			"backup-dir": arg(argBackupDir, "directory to empty instead of .qfs/trash"),
+		},
+		actReplicate: {
+			"top":      arg(argTop, "local repository top-level directory"),
+			"dest":     arg(argDest, "destination location as s3://bucket/prefix"),
+			"versions": arg(argVersions, "copy noncurrent versions and delete markers too"),
+		},
+		actUnlock: {
+			"top":   arg(argTop, "local repository top-level directory"),
+			"force": arg(argForce, "remove the lock even if it belongs to another site or process"),
+		},
+		actDoctor: {
+			"top": arg(argTop, "local repository top-level directory"),
+			"n":   arg(argNoOp, "report problems without offering repairs"),
+		},
+		actBundle: {
+			"":           arg(argTwoInputs, "create|apply bundle-file"),
+			"top":        arg(argTop, "local repository top-level directory"),
+			"n":          arg(argNoOp, "with apply, don't modify the local site"),
+			"trash":      arg(argTrash, "with apply, move removed or overwritten files to .qfs/trash"),
+			"backup-dir": arg(argBackupDir, "with apply, move removed or overwritten files to the given directory"),
+		},
+		actSites: {
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actReadOnlyPolicy: {
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actRemoveSite: {
+			"":    arg(argOneInput, "site"),
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actCopySite: {
+			"":            arg(argTwoInputs, "old-site new-site"),
+			"top":         arg(argTop, "local repository top-level directory"),
+			"filter-only": arg(argFilterOnly, "copy only the filter so the new site pulls everything"),
+		},
+		actSetRetention: {
+			"":    arg(argOneInput, "policy-file"),
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actApplyRetention: {
+			"top":               arg(argTop, "local repository top-level directory"),
+			"n":                 arg(argNoOp, "show versions that would be removed without removing them"),
+			"bypass-governance": arg(argBypassGovernance, "remove versions under governance-mode Object Lock retention"),
+		},
+		actDu: {
+			"":         arg(argOneInput, "path within repository"),
+			"top":      arg(argTop, "local repository top-level directory"),
+			"versions": arg(argVersions, "include noncurrent versions and delete markers"),
+		},
+		actApplyPlan: {
+			"":    arg(argOneInput, "plan file"),
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actLog: {
+			"top":   arg(argTop, "local repository top-level directory"),
+			"local": arg(argLocal, "show .qfs/audit.log instead of the repository's audit log"),
+		},
+		actFsckRepo: {
+			"top":    arg(argTop, "local repository top-level directory"),
+			"repair": arg(argRepair, "remove stale keys and rebuild the repository database"),
+		},
+		actProtect: {
+			"":    arg(argOneInput, "on|off"),
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actUpgradeRepo: {
+			"top": arg(argTop, "local repository top-level directory"),
+			"n":   arg(argNoOp, "show the keys that would be rewritten without changing anything"),
+		},
+		actRefresh: {
+			"top": arg(argTop, "local repository top-level directory"),
+		},
+		actLogin: {
+			"top":    arg(argTop, "local repository top-level directory"),
+			"remove": arg(argRemove, "remove the credentials instead of storing them"),
+		},
+		actQuota: {
+			"top":     arg(argTop, "local repository top-level directory"),
+			"size":    arg(argQuotaSize, "maximum total size of files, with optional K, M, G, or T"),
+			"objects": arg(argQuotaObjects, "maximum number of files, directories, and links"),
+			"warn":    arg(argQuotaWarn, "warn about pushes that exceed the quota instead of refusing them"),
+			"remove":  arg(argRemove, "remove the repository's quota"),
+		},
+		actCompletion: {
+			"":    arg(argOneInput, "bash|zsh|fish"),
+			"top": arg(argTop, "local repository top-level directory for completing repo:site"),
+		},
+		actClone: {
+			"":            arg(argTwoInputs, "s3://bucket/prefix dir"),
+			"site":        arg(argSite, "name of the new site"),
+			"owners":      arg(argOwners, "when running as root, restore saved ownerships"),
+			"numeric-ids": arg(argNumericIds, "with -owners, don't map users and groups by name"),
+			"chown-map":   arg(argChownMap, "with -owners, map uid old:new (repeatable)"),
+			"chgrp-map":   arg(argChgrpMap, "with -owners, map gid old:new (repeatable)"),
+			"dir-times":   arg(argDirTimes, "restore directory modification times from the repository"),
+		},
+		actDb: {
+			"":       arg(argDbInputs, "info|merge|filter db-file ..."),
+			"o":      arg(argDb, "with merge or filter, write to the given database file"),
+			"binary": arg(argBinary, "with -o, write the compact, binary QFS 2 format"),
+			"quick":  arg(argQuick, "with info, show only the counts recorded in the header"),
+		},
+		actClean: {
+			"":       arg(argOneInput, "dir"),
+			"n":      arg(argNoOp, "show junk files that would be removed without removing them"),
+			"pruned": arg(argPruned, "show the disk usage of each pruned directory"),
+		},
+		actServe: {
+			"socket": arg(argSocket, "path of the Unix domain socket to listen on"),
+			"top":    arg(argTop, "with repo: or repo:site, specific top-level directory"),
+		},
+		actGateway: {
+			"listen": arg(argListen, "address to listen on, such as localhost:8080"),
+			"cert":   arg(argCert, "certificate file for serving HTTPS"),
+			"key":    arg(argCertKey, "private key file for -cert"),
+			"top":    arg(argTop, "local repository top-level directory"),
 		},
 	}
-	for _, i := range []actionKey{actScan, actDiff, actSync, actListVersions, actGet} {
+	for _, i := range []actionKey{actScan, actDiff, actSync, actListVersions, actDiffVersions, actGet, actExportTar, actServe, actDb, actGateway, actClean} {
 		for arg, fn := range filterArgs {
 			a[i][arg] = fn
 		}
 	}
+	for _, i := range []actionKey{actPush, actPull, actSync, actBundle, actApplyPlan, actClone} {
+		a[i]["verbose"] = arg(argVerbose, "report each file even when output isn't a terminal")
+	}
+	for _, i := range []actionKey{actInitRepo, actApplyRetention, actFsckRepo, actRemoveSite, actProtect} {
+		a[i]["confirm-token"] = arg(argConfirmToken, "allow removing data from a protected repository")
+		a[i]["mfa"] = arg(argMFA, "\"serial code\" of an MFA device for buckets with MFA delete")
+	}
+	for _, i := range []actionKey{actScan, actPush, actPull, actListVersions, actGet, actExportTar} {
+		a[i]["timeout"] = arg(argTimeout, "stop cleanly if not done within the given duration, such as 30m")
+	}
+	for _, i := range []actionKey{actDiff, actPush, actPull, actSync, actStatus, actGet} {
+		a[i]["modify-window"] = arg(argModifyWindow, "treat modification times that differ by at most the given number of seconds as the same")
+	}
+	for i := range gatewayOptions {
+		a[i]["gateway"] = arg(argGateway, "send the request to the qfs gateway at the given URL instead of S3")
+	}
 	return a
 }()
 
 func init() {
-	// We have to plug argHelp in here to avoid a circular initialization reference.
-	argTables[actNone]["help"] = arg(argHelp, "show help and exit")
+	// We have to plug argHelp in here to avoid a circular initialization
+	// reference. Every subcommand accepts --help.
+	for _, args := range argTables {
+		args["help"] = arg(argHelp, "show help and exit")
+	}
 }
 
 type subcommandHandler struct {
@@ -194,21 +534,50 @@ specified filters. scan-input may be one of
 * db - path to local qfs database
 * repo - the repository indicated by .qfs/repo
 * repo:$site - the repository copy of the database for site $site
+* s3://bucket[/prefix] - a listing of the keys in an S3 location
+* file://path - a local directory or database
+* http://... or https://... - a qfs database retrieved over HTTP
+* mtree:path - an mtree specification, such as one written by
+  "scan -format mtree" or by BSD mtree
+
+Embedding programs may add other schemes with scan.Register.
 
 If -db is given, the result is written to the specified database.
 Otherwise, output is written to standard output.
+
+With -stream, when scanning a directory, each entry is written as soon as
+it is found rather than after the whole tree has been scanned. The output
+is the same, but memory use is proportional to the depth of the tree
+rather than the number of files, which matters for very large trees.
+
+With -binary, the database is written in the QFS 2 format, which is more
+compact and faster to read. All commands that read databases accept either
+format.
+
+With -format mtree, the output, or the database given with -db, is an mtree
+specification for use with other integrity tools. Use mtree:path to read
+one as a scan input, such as with "diff mtree:spec dir".
 `),
 	"diff": subcommand(actDiff, `
-Compare two scan inputs, applying all specified filters.
+Compare two scan inputs, applying all specified filters. Either input may
+be repo or repo:$site as with scan. In that case, the repository and site
+filters are also applied, and the comparison is made the same way push
+makes it, so "diff repo: ." shows what push would see.
 `),
 	"init-repo": subcommand(actInitRepo, `
 Initialize a repository.
 `),
 	"push": subcommand(actPush, `
-Push changes from the local site to the repository.
+Push changes from the local site to the repository. If paths are given,
+relative to the top of the site, only those parts of the site are scanned
+and pushed. With -plan, the changes are written to a file as JSON for use
+with apply-plan, and nothing is pushed.
 `),
 	"pull": subcommand(actPull, `
-Pull changes from the repository to the local site.
+Pull changes from the repository to the local site. If paths are given,
+relative to the top of the site, only changes to those parts of the site
+are pulled. With -plan, the changes are written to a file as JSON for use
+with apply-plan, and nothing is pulled.
 `),
 	"push-db": subcommand(actPushDb, `
 Regenerate the local site database and write it to the repository,
@@ -219,23 +588,235 @@ repository.
 	"sync": subcommand(actSync, `
 Synchronize a destination directory with the contents of a source directory
 subject to the given filters. Similar in spirit to a local rsync using qfs
-filters.
+filters. With -rewrite "src=path dest=path", the file or directory at path
+src in the source is kept at path dest in the destination.
 `),
 	"push-times": subcommand(actPushTimes, `
 List the timestamps of all known pushes.
 `),
 	"list-versions": subcommand(actListVersions, `
 List all the versions in the repository of all the files at or below a
-specified location.
+specified location. With -diff old[,new], show the differences between the
+contents of two versions of a regular file instead. Each version is a number,
+where 1 is the newest version listed, or a version ID as shown by -long. If
+new is omitted, the newest version is used.
+`),
+	"diff-versions": subcommand(actDiffVersions, `
+Show the differences between the repository's state at two times, as
+reconstructed from version history, without retrieving either. With a path,
+only files at or below it are compared.
 `),
 	"get": subcommand(actGet, `
 
 Retrieve files from the repository; useful for ad-hoc retrieval of files
 that are not included by the filter or recovering files that were changed
-locally and haven't been pushed.
+locally and haven't been pushed. With -stdout, give only the path of a
+single file, and its contents are written to standard output. With
+-version-id, the exact version of a single path shown by list-versions -long
+is retrieved. With -deleted-only, only files that are currently deleted are
+retrieved, each as it was just before it was deleted, which undoes removals.
+`),
+	"export-tar": subcommand(actExportTar, `
+Write the files that get would retrieve for repository-path, or for the
+whole repository other than .qfs if no path is given, to a gzip-compressed
+tar archive with the modes, modification times, and symbolic links recorded
+in the repository. Contents are streamed from the repository into the
+archive without being written to disk, so this is a convenient way to hand
+a snapshot, such as one selected with -as-of, to someone who doesn't use
+qfs. With -o -, the archive is written to standard output.
+`),
+	"status": subcommand(actStatus, `
+Summarize unpushed local changes, unpulled repository changes, pending
+conflicts, and the last push and pull times without modifying anything.
+With -offline, use the local copies of the repository database and the
+site's database and filters, as of the last push, pull, or refresh, without
+accessing the repository.
+`),
+	"refresh": subcommand(actRefresh, `
+Download the repository database if the local copy isn't current without
+changing the site, so that status -offline and diff -offline with repo:repo
+can show the repository as it is now while the repository can't be reached.
+`),
+	"login": subcommand(actLogin, `
+Store an access key ID and secret access key for the repository's endpoint
+in the operating system's keyring so that they don't have to be kept in
+files or environment variables. The keys are read from standard input, one
+per line, and the secret isn't echoed. .qfs/repo must set endpoint and
+keyring = true. With -remove, remove the stored keys instead.
+`),
+	"quota": subcommand(actQuota, `
+Show the repository's quota and how much of it is used, or, with -size,
+-objects, or -remove, replace or remove the quota. The quota limits the
+total size and number of the files, directories, and links in the
+repository, not counting old versions. Since it is stored in the
+repository, every site's pushes are refused if they would exceed it, or,
+with -warn, allowed with a warning.
+`),
+	"empty-trash": subcommand(actEmptyTrash, `
+Permanently remove files saved by pull -trash (or by pull or sync with
+-backup-dir). Only the timestamped directories that these options create
+are removed; anything else in the directory is left alone.
+`),
+	"replicate": subcommand(actReplicate, `
+Copy the repository to another S3 location, such as a different bucket or
+region, using server-side copies. With -versions, the version history is
+copied as well. The repository database is copied last, and afterward, it
+is checked against the destination's contents. The destination must not
+already contain a repository.
+`),
+	"unlock": subcommand(actUnlock, `
+Remove the repository lock left behind by an interrupted operation. Without
+-force, the lock must belong to this site and host, and the process that
+created it must no longer be running.
+`),
+	"doctor": subcommand(actDoctor, `
+Check the local .qfs directory and the repository for problems, such as
+missing or invalid configuration, unreadable databases, files left behind by
+an interrupted operation, or a stale repository lock, and offer to repair
+them. With -n, only report problems.
+`),
+	"bundle": subcommand(actBundle, `
+Move changes between sites without going through the repository, such as
+when a site can't reach the repository. "bundle create" writes the changes
+that push would make to bundle-file, a gzip-compressed tar file, without
+modifying anything. "bundle apply" applies a bundle created at another site
+to the local site as pull would, with the same conflict detection.
+`),
+	"sites": subcommand(actSites, `
+List the sites that have a database or filter in the repository along with
+the time of each site's last push that changed the repository.
+`),
+	"readonly-policy": subcommand(actReadOnlyPolicy, `
+Print an IAM policy that allows only what is needed to pull from the
+repository. Give sites that should never change the repository credentials
+limited by this policy, and create .qfs/readonly at those sites so that
+operations that would change the repository fail right away.
+`),
+	"remove-site": subcommand(actRemoveSite, `
+After confirmation, remove a site's database and filter from the
+repository. Other sites remove their copies of the filter when they pull.
+The current site can't be removed.
+`),
+	"copy-site": subcommand(actCopySite, `
+Copy old-site's filter and database in the repository to new-site within
+S3. Use this when replacing a computer: after moving the old site's files
+to the new computer, set its site name to new-site, and it can pull right
+away from where the old site left off. With -filter-only, only the filter
+is copied, and the new site starts empty and pulls everything. new-site
+must not already be known to the repository.
+`),
+	"set-retention": subcommand(actSetRetention, `
+Validate a retention policy and store it in the repository so that all
+sites share it. Each line of the policy has the form "granularity age",
+where granularity is all, hourly, daily, weekly, monthly, or yearly, and
+age is forever or a number followed by h, d, or w.
+`),
+	"apply-retention": subcommand(actApplyRetention, `
+Permanently remove the versions of files in the repository that the
+repository's retention policy doesn't keep. The current version of each
+file is always kept, as are versions protected by S3 Object Lock. With
+-bypass-governance, versions in governance mode are removed anyway.
+`),
+	"du": subcommand(actDu, `
+Show the number of objects and bytes used in the repository by each file
+or directory directly below the given path, or below the top of the
+repository if no path is given. With -versions, noncurrent versions and
+delete markers are shown as well. If the repository has a quota, how much
+of it is used is shown last.
+`),
+	"apply-plan": subcommand(actApplyPlan, `
+Apply a plan written by push -plan or pull -plan. The changes are computed
+again with the options recorded in the plan. If they differ in any way from
+the plan, including in conflicts, nothing is changed. Otherwise, they are
+applied without prompting.
+`),
+	"log": subcommand(actLog, `
+Show the audit log of operations that changed the repository, oldest first.
+Each site that has "audit = repository" in .qfs/repo stores a record of
+each such operation in the repository. With -local, show the records this
+site wrote to .qfs/audit.log with "audit = local".
+`),
+	"db": subcommand(actDb, `
+Work directly with database files. "db info" shows a database's format, its
+number of entries of each type, the total and largest file sizes, and the
+range of modification times. With -quick, it shows only the number of
+entries and total file size recorded in the header, which is fast for large
+databases. "db merge" combines two or more databases into
+the database given with -o; when more than one has an entry for a path, the
+last one wins. "db filter" writes the entries of a database that the given
+filters include to the database given with -o. Unless -binary is given, the
+output has the format of the first input, except that qsync databases are
+written in the QFS 1 format.
+`),
+	"clean": subcommand(actClean, `
+Remove junk files from dir, or the current directory if no dir is given,
+using the given filters. This is the cleanup that scan -cleanup and push
+-cleanup do, but it doesn't write a database or use a repository. With -n,
+the files are shown but not removed. With -pruned, the number and total size
+of the files in each directory excluded by a prune rule are shown, which
+helps decide whether the directory should be cleaned up by hand.
+`),
+	"protect": subcommand(actProtect, `
+Protect the repository with "on", remove its protection with "off", or show
+whether it is protected. In a protected repository, init-repo -clean-repo,
+apply-retention, fsck-repo -repair, and remove-site, which permanently
+remove data, fail unless -confirm-token is given with the token shown in the
+error message. The token is different for each operation and repository.
+Removing protection also requires a token. Protection is stored in the
+repository, so it applies at every site. For buckets with MFA delete, give
+-mfa "serial code" to these commands.
+`),
+	"upgrade-repo": subcommand(actUpgradeRepo, `
+Rewrite the key of every object in the repository in the version 2 format,
+which has room for metadata that can be added later, using copies within S3,
+and record the new version in the repository database. Sites must be using a
+version of qfs that supports version 2 keys before the repository is
+upgraded; older versions can't read the upgraded repository database. With
+-n, show the keys that would be rewritten without changing anything.
+`),
+	"fsck-repo": subcommand(actFsckRepo, `
+Check the repository for duplicate, invalid, and excluded keys, unreferenced
+contents, and differences between the repository database and the objects
+in the repository. Problems are only reported unless -repair is given, in
+which case stale keys are removed and the repository database is rebuilt.
+`),
+	"completion": subcommand(actCompletion, `
+Write a completion script for bash, zsh, or fish to standard output.
+Subcommands and options are completed, and scan inputs that start with
+repo: are completed with the sites that have databases in the repository.
+The scripts run "qfs completion sites" to get those.
+`),
+	"clone": subcommand(actClone, `
+Set up a new site in one step. dir, which must be empty or not exist, is
+created, .qfs/repo and .qfs/site are written, and the site is pulled, which
+downloads the filters and, if the repository has a filter for the site, the
+site's files. The repository must not already have a database for the site.
+`),
+	"serve": subcommand(actServe, `
+Listen on a Unix domain socket and answer scan, diff, and status requests,
+each given as a line of JSON, with a line of JSON. Filters are read once, and
+databases read from files are kept in memory until they change, so editors
+and status bars can check for drift cheaply. Runs until interrupted.
+`),
+	"gateway": subcommand(actGateway, `
+Serve status, list-versions, get, and push requests over HTTP, or HTTPS with
+-cert and -key, using this site's credentials, so that a web UI, other
+services, or qfs with -gateway can use the repository without credentials
+for S3. Requests must carry the token in the QFS_GATEWAY_TOKEN environment
+variable as a bearer token. Filters given here apply to list-versions and
+get requests. Push requests push this site. Runs until interrupted.
 `),
 }
 
+// gatewayOptions lists, for each subcommand that accepts -gateway, the options
+// that are passed to the gateway with the request.
+var gatewayOptions = map[actionKey][]string{
+	actListVersions: {"as-of", "long", "show-site"},
+	actGet:          {"as-of", "stdout"},
+	actStatus:       {},
+	actPush:         {"n"},
+}
+
 func (p *parser) check() error {
 	switch p.action {
 	case actNone:
@@ -244,11 +825,17 @@ func (p *parser) check() error {
 		if p.input1 == "" {
 			return errors.New("scan requires an input")
 		}
+		if p.mtree && p.binary {
+			return errors.New("-binary can't be used with -format mtree")
+		}
 	case actDiff:
 		if p.input2 == "" {
 			return errors.New("diff requires two inputs")
 		}
 	case actInitRepo:
+		if (p.noOp || p.report != "") && p.initMode != repo.InitMigrate {
+			return errors.New("-n and -report require -migrate")
+		}
 	case actPush:
 	case actPull:
 	case actPushDb:
@@ -261,18 +848,174 @@ func (p *parser) check() error {
 		if p.input1 == "" {
 			return errors.New("list-versions requires a path")
 		}
+		if p.diffTool != "" && p.diffVersions == "" {
+			return errors.New("-diff-tool requires -diff")
+		}
+		if p.diffVersions != "" && (!p.timestamp.IsZero() || p.long || p.showSite) {
+			return errors.New("-as-of, -long, and -show-site can't be used with -diff")
+		}
+	case actDiffVersions:
+		if p.fromTime.IsZero() {
+			return errors.New("diff-versions requires -from")
+		}
 	case actGet:
-		if p.input2 == "" {
+		if p.stdout {
+			if p.input1 == "" || p.input2 != "" {
+				return errors.New("get -stdout requires only a path")
+			}
+			if p.owners {
+				return errors.New("-owners can't be used with -stdout")
+			}
+		} else if p.input2 == "" {
 			return errors.New("get requires a path and a save location")
 		}
+		if p.versionId != "" && (p.deletedOnly || !p.timestamp.IsZero()) {
+			return errors.New("-version-id can't be used with -as-of or -deleted-only")
+		}
+	case actExportTar:
+		if p.output == "" {
+			return errors.New("export-tar requires -o")
+		}
+	case actQuota:
+		if p.remove && (p.quotaSize > 0 || p.quotaObjects > 0 || p.quotaWarn) {
+			return errors.New("quota -remove can't be used with other options")
+		}
+		if p.quotaWarn && p.quotaSize == 0 && p.quotaObjects == 0 {
+			return errors.New("quota -warn requires -size or -objects")
+		}
+	case actStatus:
+		if p.offline && p.gateway != "" {
+			return errors.New("-offline can't be used with -gateway")
+		}
+	case actUnlock:
+	case actEmptyTrash:
+	case actReplicate:
+		if p.dest == "" {
+			return errors.New("replicate requires -dest")
+		}
+	case actDoctor:
+	case actBundle:
+		if p.input2 == "" || (p.input1 != "create" && p.input1 != "apply") {
+			return errors.New("bundle requires create or apply and a bundle file")
+		}
+	case actDb:
+		switch p.input1 {
+		case "info":
+			if len(p.paths) != 1 {
+				return errors.New("db info requires one database")
+			}
+		case "merge":
+			if len(p.paths) < 2 || p.db == "" {
+				return errors.New("db merge requires at least two databases and -o")
+			}
+		case "filter":
+			if len(p.paths) != 1 || p.db == "" {
+				return errors.New("db filter requires one database and -o")
+			}
+			if len(p.filters) == 0 && p.dynamicFilter == nil && !p.filesOnly && !p.noSpecial {
+				return errors.New("db filter requires at least one filter")
+			}
+		default:
+			return errors.New("db requires info, merge, or filter")
+		}
+		if p.quick && p.input1 != "info" {
+			return errors.New("-quick can only be used with db info")
+		}
+		if p.quick && (len(p.filters) > 0 || p.dynamicFilter != nil || p.filesOnly || p.noSpecial) {
+			return errors.New("-quick can't be used with filters")
+		}
+	case actSites:
+	case actReadOnlyPolicy:
+	case actRemoveSite:
+		if p.input1 == "" {
+			return errors.New("remove-site requires a site name")
+		}
+	case actCopySite:
+		if p.input2 == "" {
+			return errors.New("copy-site requires an old site name and a new site name")
+		}
+	case actProtect:
+		if p.input1 != "" && p.input1 != "on" && p.input1 != "off" {
+			return errors.New("protect requires on, off, or nothing to show whether the repository is protected")
+		}
+	case actUpgradeRepo:
+	case actRefresh:
+	case actLogin:
+	case actSetRetention:
+		if p.input1 == "" {
+			return errors.New("set-retention requires a policy file")
+		}
+	case actApplyRetention:
+	case actDu:
+	case actClean:
+		if p.input1 == "" {
+			p.input1 = "."
+		}
+	case actApplyPlan:
+		if p.input1 == "" {
+			return errors.New("apply-plan requires a plan file")
+		}
+	case actLog:
+	case actFsckRepo:
+	case actCompletion:
+		if p.input1 != "sites" && !slices.Contains(completionShells, p.input1) {
+			return errors.New("completion requires bash, zsh, or fish")
+		}
+	case actServe:
+		if p.socket == "" {
+			return errors.New("serve requires -socket")
+		}
+	case actGateway:
+		if p.listen == "" {
+			return errors.New("gateway requires -listen")
+		}
+		if (p.cert == "") != (p.certKey == "") {
+			return errors.New("-cert and -key must be given together")
+		}
+	case actClone:
+		if p.input2 == "" || p.site == "" {
+			return errors.New("clone requires -site, a repository location, and a directory")
+		}
 	}
-	if p.noOp {
+	if p.gateway != "" {
+		for _, opt := range misc.SortedKeys(p.seen) {
+			switch opt {
+			case "gateway", "top", "timeout", "verbose":
+			default:
+				if !slices.Contains(gatewayOptions[p.action], opt) {
+					return fmt.Errorf("-%s can't be used with -gateway", opt)
+				}
+			}
+		}
+	}
+	if p.plan != "" && p.merge {
+		return errors.New("-plan can't be used with -merge")
+	}
+	if p.trash {
+		if p.backupDir != "" {
+			return errors.New("only one of -trash and -backup-dir may be given")
+		}
+		p.backupDir = filepath.Join(p.top, repofiles.Trash)
+	}
+	if p.noOp || p.plan != "" {
 		p.cleanup = false
 	}
+	if !p.owners && (p.numericIds || p.uidMap != nil || p.gidMap != nil) {
+		return errors.New("-numeric-ids, -chown-map, and -chgrp-map require -owners")
+	}
 	return nil
 }
 
 func argHelp(p *parser, _ string) error {
+	if p.action != actNone {
+		// qfs subcommand --help shows help for only that subcommand.
+		for name, sData := range subcommands {
+			if sData.action == p.action {
+				printSubcommandHelp(p.progName, name)
+			}
+		}
+		os.Exit(0)
+	}
 	fmt.Printf(`
 Usage:
 %s top-level-option
@@ -291,26 +1034,8 @@ Top-level options:
 		fmt.Printf("  --%s: %s\n", a, argTables[actNone][a].help)
 	}
 	fmt.Printf("\nSubcommands:\n")
-	for s, sData := range subcommands {
-		args, ok := argTables[sData.action]
-		if !ok {
-			panic("no args for " + s)
-		}
-		pos, ok := args[""]
-		if ok {
-			fmt.Printf("\n%s %s {%s} [options]\n", p.progName, s, pos.help)
-		} else {
-			fmt.Printf("\n%s %s [options]\n", p.progName, s)
-		}
-		fmt.Println(sData.help)
-		keys = misc.SortedKeys(args)
-		fmt.Printf("%s options:\n", s)
-		for _, a := range keys {
-			if a == "" {
-				continue
-			}
-			fmt.Printf("  --%s: %s\n", a, args[a].help)
-		}
+	for _, name := range misc.SortedKeys(subcommands) {
+		printSubcommandHelp(p.progName, name)
 	}
 
 	os.Exit(0)
@@ -323,6 +1048,55 @@ func argVersion(p *parser, _ string) error {
 	return nil
 }
 
+func argChdir(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	// Change directory right away so that relative paths in later arguments, such
+	// as filter files, are relative to the new directory. Run changes back when
+	// it returns so that programs that embed qfs aren't affected.
+	dir := p.args[p.arg]
+	p.arg++
+	if p.origDir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		p.origDir = cwd
+	}
+	return os.Chdir(dir)
+}
+
+// findTop returns the path, relative to the current directory, of the nearest
+// directory at or above the current directory that contains .qfs/repo. If
+// there is none or the current directory is the top, it returns "".
+func findTop() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		// TEST: NOT COVERED
+		return ""
+	}
+	for dir := cwd; ; {
+		if _, err := os.Stat(filepath.Join(dir, repofiles.RepoConfig)); err == nil {
+			if dir == cwd {
+				return ""
+			}
+			rel, err := filepath.Rel(cwd, dir)
+			if err != nil {
+				// TEST: NOT COVERED
+				return dir
+			}
+			return rel
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
 func argTop(p *parser, arg string) error {
 	if p.arg >= len(p.args) {
 		return fmt.Errorf("%s requires an argument", arg)
@@ -349,38 +1123,58 @@ func argMigrate(p *parser, _ string) error {
 }
 
 func argTimestamp(p *parser, arg string) error {
+	return timestampArg(p, arg, &p.timestamp)
+}
+
+func argFrom(p *parser, arg string) error {
+	return timestampArg(p, arg, &p.fromTime)
+}
+
+func argTo(p *parser, arg string) error {
+	return timestampArg(p, arg, &p.toTime)
+}
+
+// timestampArg parses the timestamp given as the argument of arg into dest.
+func timestampArg(p *parser, arg string, dest *time.Time) error {
 	if p.arg >= len(p.args) {
 		return fmt.Errorf("%s requires an argument", arg)
 	}
-	timestamp := p.args[p.arg]
+	t, err := parseTimestamp(p.args[p.arg])
 	p.arg++
+	if err != nil {
+		return err
+	}
+	*dest = t
+	return nil
+}
+
+// parseTimestamp parses a timestamp given as epoch time in seconds or
+// milliseconds or as a local date and optional time.
+func parseTimestamp(timestamp string) (time.Time, error) {
 	if epochRe.MatchString(timestamp) {
 		t, err := strconv.Atoi(timestamp)
 		if err != nil {
-			return fmt.Errorf("error parsing %s as epoch timestamp: %w", timestamp, err)
+			return time.Time{}, fmt.Errorf("error parsing %s as epoch timestamp: %w", timestamp, err)
 		}
 		if len(timestamp) > 10 {
-			p.timestamp = time.UnixMilli(int64(t))
-		} else {
-			p.timestamp = time.Unix(int64(t), 0)
+			return time.UnixMilli(int64(t)), nil
 		}
+		return time.Unix(int64(t), 0), nil
 	} else if dateRe.MatchString(timestamp) {
 		t, err := time.ParseInLocation(misc.DateFormat, timestamp, time.Local)
 		if err != nil {
-			return fmt.Errorf("error parsing %s as YYYY-MM-DD: %w", timestamp, err)
+			return time.Time{}, fmt.Errorf("error parsing %s as YYYY-MM-DD: %w", timestamp, err)
 		}
-		p.timestamp = t
+		return t, nil
 	} else if dateTimeRe.MatchString(timestamp) {
 		// Parse accepts optional milliseconds when omitted from the format.
 		t, err := time.ParseInLocation(misc.TimeFormatNoMs, timestamp, time.Local)
 		if err != nil {
-			return fmt.Errorf("error parsing %s as YYYY-MM-DD_hh:mm:ss[.sss]: %w", timestamp, err)
+			return time.Time{}, fmt.Errorf("error parsing %s as YYYY-MM-DD_hh:mm:ss[.sss]: %w", timestamp, err)
 		}
-		p.timestamp = t
-	} else {
-		return fmt.Errorf("timestamp must be epoch time (second or millisecond) or YYYY-MM-DD[_hh:mm:ss[.sss]]")
+		return t, nil
 	}
-	return nil
+	return time.Time{}, fmt.Errorf("timestamp must be epoch time (second or millisecond) or YYYY-MM-DD[_hh:mm:ss[.sss]]")
 }
 
 func argSubcommand(p *parser, arg string) error {
@@ -402,6 +1196,16 @@ func argNoSpecial(p *parser, _ string) error {
 	return nil
 }
 
+func argFilterOnly(p *parser, _ string) error {
+	p.filterOnly = true
+	return nil
+}
+
+func argPruneEmptyDirs(p *parser, _ string) error {
+	p.pruneEmpty = true
+	return nil
+}
+
 func argNonFileTimes(p *parser, _ string) error {
 	p.nonFileTimes = true
 	return nil
@@ -412,6 +1216,11 @@ func argNoOwnerships(p *parser, _ string) error {
 	return nil
 }
 
+func argNoPerms(p *parser, _ string) error {
+	p.noPerms = true
+	return nil
+}
+
 func argChecks(p *parser, _ string) error {
 	p.checks = true
 	return nil
@@ -437,6 +1246,20 @@ func argTwoInputs(p *parser, arg string) error {
 	return nil
 }
 
+func argPaths(p *parser, arg string) error {
+	p.paths = append(p.paths, arg)
+	return nil
+}
+
+// argDbInputs takes the db operation followed by database files.
+func argDbInputs(p *parser, arg string) error {
+	if p.input1 == "" {
+		p.input1 = arg
+		return nil
+	}
+	return argPaths(p, arg)
+}
+
 func argDb(p *parser, arg string) error {
 	if p.arg >= len(p.args) {
 		return fmt.Errorf("%s requires an argument", arg)
@@ -452,6 +1275,48 @@ func argLong(p *parser, _ string) error {
 	return nil
 }
 
+func argStream(p *parser, _ string) error {
+	p.stream = true
+	return nil
+}
+
+func argStats(p *parser, _ string) error {
+	p.stats = true
+	return nil
+}
+
+func argBinary(p *parser, _ string) error {
+	p.binary = true
+	return nil
+}
+
+func argPruned(p *parser, _ string) error {
+	p.pruned = true
+	return nil
+}
+
+func argQuick(p *parser, _ string) error {
+	p.quick = true
+	return nil
+}
+
+func argFormat(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	format := p.args[p.arg]
+	p.arg++
+	switch format {
+	case "qfs":
+		p.mtree = false
+	case "mtree":
+		p.mtree = true
+	default:
+		return fmt.Errorf("%s: unknown format \"%s\"; use qfs or mtree", arg, format)
+	}
+	return nil
+}
+
 func argCleanup(p *parser, _ string) error {
 	p.cleanup = true
 	return nil
@@ -462,284 +1327,1736 @@ func argNoOp(p *parser, _ string) error {
 	return nil
 }
 
+func argRemove(p *parser, _ string) error {
+	p.remove = true
+	return nil
+}
+
+func argKeepGoing(p *parser, _ string) error {
+	p.keepGoing = true
+	return nil
+}
+
+func argOffline(p *parser, _ string) error {
+	p.offline = true
+	return nil
+}
+
+func argBypassGovernance(p *parser, _ string) error {
+	p.bypassGov = true
+	return nil
+}
+
 func argLocalFilter(p *parser, _ string) error {
 	p.localFilter = true
 	return nil
 }
 
-func argXDev(p *parser, _ string) error {
-	p.sameDev = true
+func argMerge(p *parser, _ string) error {
+	p.merge = true
 	return nil
 }
 
-func argFilter(p *parser, arg string) error {
+func argMergeTool(p *parser, arg string) error {
 	if p.arg >= len(p.args) {
 		return fmt.Errorf("%s requires an argument", arg)
 	}
-	pruneOnly := false
-	if arg == "filter-prune" {
-		pruneOnly = true
+	p.mergeTool = p.args[p.arg]
+	p.arg++
+	p.merge = true
+	return nil
+}
+
+func argDiffVersions(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
 	}
-	filename := p.args[p.arg]
+	p.diffVersions = p.args[p.arg]
 	p.arg++
-	f := filter.New()
-	err := f.ReadFile(fileinfo.NewPath(localsource.New(""), filename), pruneOnly)
-	if err != nil {
-		return err
+	return nil
+}
+
+func argDiffTool(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
 	}
-	p.filters = append(p.filters, f)
+	p.diffTool = p.args[p.arg]
+	p.arg++
 	return nil
 }
 
-func argDynamicFilter(p *parser, arg string) error {
+func argDest(p *parser, arg string) error {
 	if p.arg >= len(p.args) {
 		return fmt.Errorf("%s requires an argument", arg)
 	}
-	parameter := p.args[p.arg]
+	p.dest = p.args[p.arg]
 	p.arg++
-	f := p.dynamicFilter
+	return nil
+}
+
+func argOutput(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.output = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argVersions(p *parser, _ string) error {
+	p.versions = true
+	return nil
+}
+
+func argTrash(p *parser, _ string) error {
+	p.trash = true
+	return nil
+}
+
+func argBackupDir(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.backupDir = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argOwners(p *parser, _ string) error {
+	p.owners = true
+	return nil
+}
+
+func argLocal(p *parser, _ string) error {
+	p.local = true
+	return nil
+}
+
+func argSocket(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.socket = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argListen(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.listen = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argCert(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.cert = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argCertKey(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.certKey = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argGateway(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	u, err := url.Parse(p.args[p.arg])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: URL must start with http:// or https://", arg)
+	}
+	p.gateway = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argSite(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.site = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argRepair(p *parser, _ string) error {
+	p.repair = true
+	return nil
+}
+
+func argDirTimes(p *parser, _ string) error {
+	p.dirTimes = true
+	return nil
+}
+
+func argClampFuture(p *parser, _ string) error {
+	p.clampFuture = true
+	return nil
+}
+
+func argMetadataOnly(p *parser, _ string) error {
+	p.metadataOnly = true
+	return nil
+}
+
+func argMaxTransfer(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	size, err := misc.ParseSize(p.args[p.arg])
+	if err != nil {
+		return fmt.Errorf("%s: %w", arg, err)
+	}
+	p.maxTransfer = size
+	p.arg++
+	return nil
+}
+
+func argQuotaSize(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	size, err := misc.ParseSize(p.args[p.arg])
+	if err != nil || size == 0 {
+		return fmt.Errorf("%s: size must be a positive number of bytes", arg)
+	}
+	p.quotaSize = size
+	p.arg++
+	return nil
+}
+
+func argQuotaObjects(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	n, err := strconv.ParseInt(p.args[p.arg], 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("%s: count must be a positive number", arg)
+	}
+	p.quotaObjects = n
+	p.arg++
+	return nil
+}
+
+func argQuotaWarn(p *parser, _ string) error {
+	p.quotaWarn = true
+	return nil
+}
+
+func argTimeout(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	timeout, err := time.ParseDuration(p.args[p.arg])
+	if err != nil {
+		return fmt.Errorf("%s: %w", arg, err)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("%s: duration must be positive", arg)
+	}
+	p.timeout = timeout
+	p.arg++
+	return nil
+}
+
+func argModifyWindow(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	seconds, err := strconv.Atoi(p.args[p.arg])
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("%s: window must be a non-negative number of seconds", arg)
+	}
+	p.modifyWindow = time.Duration(seconds) * time.Second
+	p.arg++
+	return nil
+}
+
+func argRenames(p *parser, _ string) error {
+	p.renames = true
+	return nil
+}
+
+func argBirthTimes(p *parser, _ string) error {
+	p.birthTimes = true
+	return nil
+}
+
+func argNanoseconds(p *parser, _ string) error {
+	p.nanoseconds = true
+	return nil
+}
+
+func argChecksum(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.checksum = p.args[p.arg]
+	p.arg++
+	if _, err := digest.New(p.checksum); err != nil {
+		return err
+	}
+	return nil
+}
+
+func argVerbose(p *parser, _ string) error {
+	p.verbose = true
+	return nil
+}
+
+func argRenameCaseCollisions(p *parser, _ string) error {
+	p.renameCase = true
+	return nil
+}
+
+func argDeleteExcluded(p *parser, _ string) error {
+	p.delExcluded = true
+	return nil
+}
+
+func argStage(p *parser, _ string) error {
+	p.stage = true
+	return nil
+}
+
+func argNumericIds(p *parser, _ string) error {
+	p.numericIds = true
+	return nil
+}
+
+func argIdMap(p *parser, arg string, m *map[int]int) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	if *m == nil {
+		*m = map[int]int{}
+	}
+	err := fileinfo.ParseIdMap(p.args[p.arg], *m)
+	if err != nil {
+		return err
+	}
+	p.arg++
+	return nil
+}
+
+func argChownMap(p *parser, arg string) error {
+	return argIdMap(p, arg, &p.uidMap)
+}
+
+func argChgrpMap(p *parser, arg string) error {
+	return argIdMap(p, arg, &p.gidMap)
+}
+
+func argRewrite(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	rule, err := localsource.ParsePathRule(p.args[p.arg])
+	if err != nil {
+		return fmt.Errorf("%s: %w", arg, err)
+	}
+	p.pathRules = append(p.pathRules, rule)
+	p.arg++
+	return nil
+}
+
+func argSymlinks(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	mode, err := fileinfo.ParseSymlinkMode(p.args[p.arg])
+	if err != nil {
+		return err
+	}
+	p.symlinks = mode
+	p.arg++
+	return nil
+}
+
+func argSchedule(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	schedule, err := sync.ParseSchedule(p.args[p.arg])
+	if err != nil {
+		return err
+	}
+	p.schedule = schedule
+	p.arg++
+	return nil
+}
+
+func argReport(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.report = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argConfirmToken(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.confirmToken = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argMFA(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.mfa = p.args[p.arg]
+	p.arg++
+	return repo.ValidateMFA(p.mfa)
+}
+
+func argPlan(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.plan = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argShowSite(p *parser, _ string) error {
+	p.showSite = true
+	return nil
+}
+
+func argStdout(p *parser, _ string) error {
+	p.stdout = true
+	return nil
+}
+
+func argVersionId(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	p.versionId = p.args[p.arg]
+	p.arg++
+	return nil
+}
+
+func argDeletedOnly(p *parser, _ string) error {
+	p.deletedOnly = true
+	return nil
+}
+
+func argForce(p *parser, _ string) error {
+	p.force = true
+	return nil
+}
+
+func argFollowDirLinks(p *parser, _ string) error {
+	p.followDirs = true
+	return nil
+}
+
+func argXDev(p *parser, _ string) error {
+	p.sameDev = true
+	return nil
+}
+
+func argFilter(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	pruneOnly := false
+	if arg == "filter-prune" {
+		pruneOnly = true
+	}
+	filename := p.args[p.arg]
+	p.arg++
+	f := filter.New()
+	err := f.ReadFile(fileinfo.NewPath(localsource.New(""), filename), pruneOnly)
+	if err != nil {
+		return err
+	}
+	p.filters = append(p.filters, f)
+	return nil
+}
+
+func argDynamicFilter(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	parameter := p.args[p.arg]
+	p.arg++
+	f := p.dynamicFilter
 	if f == nil {
 		f = filter.New()
 	}
-	group := filter.NoGroup
-	switch arg {
-	case "include":
-		group = filter.Include
-	case "exclude":
-		group = filter.Exclude
-	case "prune":
-		group = filter.Prune
-	case "junk":
-		group = filter.Junk
-	default:
-		// TEST: NOT COVERED. Not possible unless we messed up statically creating the
-		// arg tables.
-		panic("argDynamicFilter called with invalid argument")
+	group := filter.NoGroup
+	switch arg {
+	case "include":
+		group = filter.Include
+	case "exclude":
+		group = filter.Exclude
+	case "prune":
+		group = filter.Prune
+	case "junk":
+		group = filter.Junk
+	default:
+		// TEST: NOT COVERED. Not possible unless we messed up statically creating the
+		// arg tables.
+		panic("argDynamicFilter called with invalid argument")
+	}
+	err := func() error {
+		if group == filter.Junk {
+			return f.SetJunk(parameter)
+		}
+		return f.ReadLine(group, parameter)
+	}()
+	if err != nil {
+		return err
+	}
+	p.dynamicFilter = f
+	return nil
+}
+
+// argDynamicFilterFrom reads include or exclude directives, one per line, from a
+// file. Blank lines and lines starting with # are ignored. This is like a
+// filter file containing a single group with no group header.
+func argDynamicFilterFrom(p *parser, arg string) error {
+	if p.arg >= len(p.args) {
+		return fmt.Errorf("%s requires an argument", arg)
+	}
+	filename := p.args[p.arg]
+	p.arg++
+	group := filter.NoGroup
+	switch arg {
+	case "include-from":
+		group = filter.Include
+	case "exclude-from":
+		group = filter.Exclude
+	default:
+		// TEST: NOT COVERED. Not possible unless we messed up statically creating the
+		// arg tables.
+		panic("argDynamicFilterFrom called with invalid argument")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	f := p.dynamicFilter
+	if f == nil {
+		f = filter.New()
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := f.ReadLine(group, line); err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, i+1, err)
+		}
+	}
+	p.dynamicFilter = f
+	return nil
+}
+
+func (p *parser) handleArg() error {
+	var opt string
+	arg := p.args[p.arg]
+	p.arg++
+	if strings.HasPrefix(arg, "--") {
+		opt = arg[2:]
+	} else if strings.HasPrefix(arg, "-") {
+		opt = arg[1:]
+	}
+	handler, ok := argTables[p.action][opt]
+	if !ok {
+		if opt == "" {
+			return fmt.Errorf("unexpected positional argument \"%s\"", arg)
+		}
+		return fmt.Errorf("unknown option \"%s\"", arg)
+	}
+	if opt == "" {
+		return handler.fn(p, arg)
+	}
+	p.seen[opt] = true
+	return handler.fn(p, opt)
+}
+
+func (p *parser) doScan() (err error) {
+	if provider, ok := scan.ProviderFor(p.input1); ok {
+		if lister, ok := provider.(scan.Lister); ok {
+			return lister.List(p.input1, &scan.Config{Context: p.ctx, Top: p.top, Long: p.long}, os.Stdout)
+		}
+	}
+	if p.stats {
+		p.scanStats = &traverse.Stats{}
+		defer func() {
+			if err == nil {
+				p.printScanStats(os.Stderr)
+			}
+		}()
+	}
+	if p.stream {
+		return p.streamScan()
+	}
+	scanner, err := p.newScanner()
+	if err != nil {
+		// TEST: NOT COVERED. scan.New never returns an error.
+		return fmt.Errorf("create scanner: %w", err)
+	}
+	files, err := scanner.Run()
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	if p.db != "" {
+		return database.WriteDb(p.db, files, p.dbFormat())
+	} else if p.mtree {
+		return database.WriteDbTo(os.Stdout, files, database.DbMtree)
+	}
+	return files.Print(p.long)
+}
+
+func (p *parser) dbFormat() database.DbFormat {
+	if p.mtree {
+		return database.DbMtree
+	} else if p.binary {
+		return database.DbQfs2
+	}
+	return database.DbQfs
+}
+
+func (p *parser) newScanner() (*scan.Scan, error) {
+	return scan.New(
+		p.input1,
+		scan.WithFilters(p.filters),
+		scan.WithSameDev(p.sameDev),
+		scan.WithFollowDirLinks(p.followDirs),
+		scan.WithCleanup(p.cleanup),
+		scan.WithFilesOnly(p.filesOnly),
+		scan.WithNoSpecial(p.noSpecial),
+		scan.WithBirthTimes(p.birthTimes),
+		scan.WithNanoseconds(p.nanoseconds),
+		scan.WithStats(p.scanStats),
+		scan.WithChecksum(p.checksum),
+		scan.WithTop(p.top),
+		scan.WithContext(p.ctx),
+	)
+}
+
+// printScanStats shows the measurements collected for scan -stats.
+func (p *parser) printScanStats(w io.Writer) {
+	s := p.scanStats
+	if s.Workers == nil {
+		_, _ = fmt.Fprintln(w, "no statistics: -stats only applies when scanning a local directory")
+		return
+	}
+	_, _ = fmt.Fprintf(w, "total time: %s\n", s.Elapsed.Round(time.Millisecond))
+	_, _ = fmt.Fprintf(w, "entries: %d (%.0f/second)\n", s.Entries(), s.PerSecond())
+	for _, t := range []struct {
+		fileType fileinfo.FileType
+		name     string
+	}{
+		{fileinfo.TypeDirectory, "directories"},
+		{fileinfo.TypeFile, "files"},
+		{fileinfo.TypeLink, "links"},
+	} {
+		_, _ = fmt.Fprintf(w, "%s: %d\n", t.name, s.Visited[t.fileType])
+	}
+	for _, g := range []filter.Group{
+		filter.Prune,
+		filter.Exclude,
+		filter.Junk,
+		filter.Default,
+		filter.RepoRule,
+		filter.Limit,
+	} {
+		if n := s.Rejected[g]; n > 0 {
+			_, _ = fmt.Fprintf(w, "rejected by %s: %d\n", g, n)
+		}
+	}
+	if s.JunkRemoved > 0 {
+		_, _ = fmt.Fprintf(w, "junk removed: %d\n", s.JunkRemoved)
+	}
+	_, _ = fmt.Fprintf(w, "most entries waiting: %d\n", s.MaxPending)
+	for i, ws := range s.Workers {
+		_, _ = fmt.Fprintf(
+			w,
+			"worker %d: %d entries, busy %s\n",
+			i+1,
+			ws.Entries,
+			ws.Busy.Round(time.Microsecond),
+		)
+	}
+}
+
+// streamScan is doScan for -stream.
+func (p *parser) streamScan() error {
+	scanner, err := p.newScanner()
+	if err != nil {
+		// TEST: NOT COVERED. scan.New never returns an error.
+		return fmt.Errorf("create scanner: %w", err)
+	}
+	fn := func(f *fileinfo.FileInfo) error {
+		database.PrintRow(f, p.long)
+		return nil
+	}
+	var w *database.Writer
+	if p.db != "" {
+		w, err = database.NewWriter(p.db, p.dbFormat(), database.WithNanoseconds(p.nanoseconds))
+	} else if p.mtree {
+		w, err = database.NewStreamWriter(os.Stdout, database.DbMtree)
+	}
+	if err != nil {
+		return err
+	}
+	if w != nil {
+		defer w.Discard()
+		fn = w.Write
+	}
+	if err := scanner.Stream(fn); err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	if w != nil {
+		return w.Close()
+	}
+	return nil
+}
+
+func (p *parser) doDiff() error {
+	result, err := p.diffInputs(p.input1, p.input2, nil)
+	if err != nil {
+		return err
+	}
+	err = result.WriteDiff(os.Stdout, p.checks)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+
+	return nil
+}
+
+// diffInputs computes the differences shown by qfs diff. If cache is not nil,
+// databases read from files are taken from it when they haven't changed.
+func (p *parser) diffInputs(input1, input2 string, cache *dbCache) (*diff.Result, error) {
+	filters := p.filters
+	repoInput := strings.HasPrefix(input1, repo.ScanPrefix) ||
+		strings.HasPrefix(input2, repo.ScanPrefix)
+	if repoInput {
+		r, err := repo.New(
+			repo.WithLocalTop(p.top),
+			repo.WithS3Client(S3Client),
+			repo.WithKeyring(Keyring),
+			repo.WithContext(p.ctx),
+			repo.WithOffline(p.offline),
+		)
+		if err != nil {
+			return nil, err
+		}
+		siteFilters, err := r.SiteFilters()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(siteFilters, filters...)
+	}
+	load := func(input string) (database.Database, error) {
+		inputFilters := filters
+		if strings.HasPrefix(input, repo.ScanPrefix) {
+			// The diff applies the filters with repository rules.
+			inputFilters = nil
+		}
+		s, err := scan.New(
+			input,
+			scan.WithFilters(inputFilters),
+			scan.WithFilesOnly(p.filesOnly),
+			scan.WithNoSpecial(p.noSpecial || repoInput),
+			scan.WithTop(p.top),
+			scan.WithContext(p.ctx),
+			scan.WithOffline(p.offline),
+		)
+		if err != nil {
+			// TEST: NOT COVERED. scan.New never returns an error.
+			return nil, err
+		}
+		if cache != nil {
+			return cache.load(input, repoInput, s)
+		}
+		return s.Run()
+	}
+	files1, err := load(input1)
+	if err != nil {
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+	files2, err := load(input2)
+	if err != nil {
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+	// When comparing with the repository, compare the way push does: ownerships
+	// are not stored in the repository, and the .qfs directory is handled
+	// specially.
+	d := diff.New(
+		diff.WithFilters(filters),
+		diff.WithFilesOnly(p.filesOnly),
+		diff.WithNoSpecial(p.noSpecial || repoInput),
+		diff.WithNonFileTimes(p.nonFileTimes),
+		diff.WithNoOwnerships(p.noOwnerships || repoInput),
+		diff.WithNoPermissions(p.noPerms),
+		diff.WithRepoRules(repoInput),
+		diff.WithRenames(p.renames),
+		diff.WithModifyWindow(p.modifyWindow),
+	)
+	result, err := d.Run(files1, files2)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+	return result, nil
+}
+
+// ownerMap returns the ownership mapping requested by -owners and related
+// options, or nil if ownerships are not to be restored.
+func (p *parser) ownerMap() *fileinfo.OwnerMap {
+	if !p.owners {
+		return nil
+	}
+	return &fileinfo.OwnerMap{
+		NumericIds: p.numericIds,
+		Uids:       p.uidMap,
+		Gids:       p.gidMap,
+	}
+}
+
+func (p *parser) doInitRepo() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithConfirmToken(p.confirmToken),
+		repo.WithMFA(p.mfa),
+	)
+	if err != nil {
+		return err
+	}
+	return r.Init(&repo.InitConfig{
+		Mode:   p.initMode,
+		NoOp:   p.noOp,
+		Report: p.report,
+	})
+}
+
+func (p *parser) doPull() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithBirthTimes(p.birthTimes),
+		repo.WithNanoseconds(p.nanoseconds),
+		repo.WithModifyWindow(p.modifyWindow),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = r.Pull(&repo.PullConfig{
+		NoOp:                 p.noOp,
+		LocalFilter:          p.localFilter,
+		Merge:                p.merge,
+		MergeTool:            p.mergeTool,
+		BackupDir:            p.backupDir,
+		Paths:                p.paths,
+		Owners:               p.ownerMap(),
+		DirTimes:             p.dirTimes,
+		Renames:              p.renames,
+		NoPermissions:        p.noPerms,
+		MaxTransfer:          p.maxTransfer,
+		Plan:                 p.plan,
+		KeepGoing:            p.keepGoing,
+		RenameCaseCollisions: p.renameCase,
+		Stage:                p.stage,
+		DeleteExcluded:       p.delExcluded,
+		Schedule:             p.schedule,
+	})
+	return err
+}
+
+func (p *parser) doClone() error {
+	r, err := repo.Clone(
+		p.input1,
+		p.site,
+		repo.WithLocalTop(p.input2),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = r.Pull(&repo.PullConfig{
+		Owners:   p.ownerMap(),
+		DirTimes: p.dirTimes,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(p.input2, repofiles.SiteFilter(p.site))); err != nil {
+		misc.Message(
+			"the repository has no filter for %s; create %s and run qfs pull in %s",
+			p.site,
+			repofiles.SiteFilter(p.site),
+			p.input2,
+		)
+	}
+	return nil
+}
+
+func (p *parser) doPush() error {
+	if p.gateway != "" {
+		return p.gatewayPush()
+	}
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithBirthTimes(p.birthTimes),
+		repo.WithNanoseconds(p.nanoseconds),
+		repo.WithModifyWindow(p.modifyWindow),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = r.Push(&repo.PushConfig{
+		Cleanup:           p.cleanup,
+		NoOp:              p.noOp,
+		Paths:             p.paths,
+		Owners:            p.owners,
+		DirTimes:          p.dirTimes,
+		ClampFutureMtimes: p.clampFuture,
+		MetadataOnly:      p.metadataOnly,
+		Renames:           p.renames,
+		NoPermissions:     p.noPerms,
+		MaxTransfer:       p.maxTransfer,
+		Plan:              p.plan,
+		KeepGoing:         p.keepGoing,
+	})
+	return err
+}
+
+func (p *parser) doApplyPlan() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = r.ApplyPlan(p.input1)
+	return err
+}
+
+func (p *parser) doLog() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	records, err := r.AuditLog(&repo.AuditConfig{Local: p.local})
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		misc.Message("no audit records found")
+	}
+	for _, rec := range records {
+		fmt.Println(rec)
+	}
+	return nil
+}
+
+func (p *parser) doFsckRepo() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithConfirmToken(p.confirmToken),
+		repo.WithMFA(p.mfa),
+	)
+	if err != nil {
+		return err
+	}
+	result, err := r.Fsck(&repo.FsckConfig{Repair: p.repair})
+	if err != nil {
+		return err
+	}
+	if !result.Repaired && result.Problems() > 0 {
+		return fmt.Errorf("%d problem(s) found", result.Problems())
+	}
+	return nil
+}
+
+func (p *parser) doPushDb() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	return r.PushDb()
+}
+
+func (p *parser) doSync() error {
+	pathMap, err := localsource.NewPathMap(p.pathRules)
+	if err != nil {
+		return err
+	}
+	s, err := sync.New(
+		p.input1,
+		p.input2,
+		sync.WithFilters(p.filters),
+		sync.WithNoOp(p.noOp),
+		sync.WithBackupDir(p.backupDir),
+		sync.WithOwners(p.ownerMap()),
+		sync.WithSymlinks(p.symlinks),
+		sync.WithDirTimes(p.dirTimes),
+		sync.WithRenames(p.renames),
+		sync.WithNoPermissions(p.noPerms),
+		sync.WithModifyWindow(p.modifyWindow),
+		sync.WithRenameCaseCollisions(p.renameCase),
+		sync.WithNoSpecial(p.noSpecial),
+		sync.WithPruneEmptyDirs(p.pruneEmpty),
+		sync.WithPathMap(pathMap),
+		sync.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = s.Sync()
+	return err
+}
+
+func (p *parser) doPushTimes() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	return r.PushTimes()
+}
+
+func (p *parser) doListVersions() error {
+	if p.gateway != "" {
+		return p.gatewayListVersions()
+	}
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	if p.diffVersions != "" {
+		oldVersion, newVersion, _ := strings.Cut(p.diffVersions, ",")
+		return r.DiffContents(p.input1, &repo.ContentDiffConfig{
+			Old:  oldVersion,
+			New:  newVersion,
+			Tool: p.diffTool,
+		})
+	}
+	return r.ListVersions(p.input1, &repo.ListVersionsConfig{
+		AsOf:     p.timestamp,
+		Long:     p.long,
+		ShowSite: p.showSite,
+		Filters:  p.filters,
+	})
+}
+
+func (p *parser) doDiffVersions() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	result, err := r.DiffVersions(p.input1, &repo.DiffVersionsConfig{
+		From:    p.fromTime,
+		To:      p.toTime,
+		Filters: p.filters,
+	})
+	if err != nil {
+		return err
+	}
+	return result.WriteDiff(os.Stdout, false)
+}
+
+func (p *parser) doGet() error {
+	if p.gateway != "" {
+		return p.gatewayGet()
+	}
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithModifyWindow(p.modifyWindow),
+	)
+	if err != nil {
+		return err
+	}
+	return r.Get(p.input1, p.input2, &repo.GetConfig{
+		AsOf:        p.timestamp,
+		Filters:     p.filters,
+		Owners:      p.ownerMap(),
+		Stdout:      p.stdout,
+		DirTimes:    p.dirTimes,
+		KeepGoing:   p.keepGoing,
+		VersionId:   p.versionId,
+		DeletedOnly: p.deletedOnly,
+	})
+}
+
+func (p *parser) doExportTar() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	config := &repo.ExportConfig{
+		AsOf:    p.timestamp,
+		Filters: p.filters,
+	}
+	if p.output == "-" {
+		return r.ExportTar(p.input1, os.Stdout, config)
+	}
+	// Don't leave a partial archive behind if the export fails.
+	f, err := misc.CreateAtomic(p.output)
+	if err != nil {
+		return err
+	}
+	defer f.Discard()
+	if err := r.ExportTar(p.input1, f, config); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+func (p *parser) doStatus() error {
+	if p.gateway != "" {
+		return p.gatewayStatus()
+	}
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithOffline(p.offline),
+		repo.WithModifyWindow(p.modifyWindow),
+	)
+	if err != nil {
+		return err
 	}
-	err := func() error {
-		if group == filter.Junk {
-			return f.SetJunk(parameter)
-		}
-		return f.ReadLine(group, parameter)
-	}()
+	status, err := r.Status()
 	if err != nil {
 		return err
 	}
-	p.dynamicFilter = f
-	return nil
+	return status.Write(os.Stdout)
 }
 
-func (p *parser) handleArg() error {
-	var opt string
-	arg := p.args[p.arg]
-	p.arg++
-	if strings.HasPrefix(arg, "--") {
-		opt = arg[2:]
-	} else if strings.HasPrefix(arg, "-") {
-		opt = arg[1:]
+func (p *parser) doEmptyTrash() error {
+	backupDir := p.backupDir
+	if backupDir == "" {
+		backupDir = filepath.Join(p.top, repofiles.Trash)
 	}
-	handler, ok := argTables[p.action][opt]
-	if !ok {
-		if opt == "" {
-			return fmt.Errorf("unexpected positional argument \"%s\"", arg)
-		}
-		return fmt.Errorf("unknown option \"%s\"", arg)
+	return sync.EmptyTrash(backupDir, nil)
+}
+
+func (p *parser) doUnlock() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
 	}
-	if opt == "" {
-		return handler.fn(p, arg)
+	return r.Unlock(p.force)
+}
+
+func (p *parser) doReplicate() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
 	}
-	return handler.fn(p, opt)
+	return r.Replicate(&repo.ReplicateConfig{
+		Dest:     p.dest,
+		Versions: p.versions,
+	})
 }
 
-func (p *parser) doScan() error {
-	s3Match := s3Re.FindStringSubmatch(p.input1)
-	if s3Match != nil {
-		bucket := s3Match[1]
-		prefix := s3Match[2]
-		ls, err := s3lister.New(s3lister.WithS3Client(S3Client))
-		if err != nil {
-			return err
-		}
-		input := &s3.ListObjectsV2Input{
-			Bucket: &bucket,
-			Prefix: &prefix,
-		}
-		err = ls.List(context.Background(), input, func(objects []types.Object) {
-			for _, obj := range objects {
-				if p.long {
-					fmt.Printf("%d %d %s\n", obj.LastModified.UnixMilli(), *obj.Size, *obj.Key)
-				} else {
-					fmt.Println(*obj.Key)
-				}
-			}
-		})
-		if err != nil {
-			return err
+func (p *parser) doDoctor() error {
+	// Check the configuration file as each subcommand would read it. The file is
+	// read the same way each time, so stop after the first problem.
+	problems := 0
+	for _, name := range misc.SortedKeys(subcommands) {
+		check := &parser{top: p.top, action: subcommands[name].action, seen: map[string]bool{}}
+		if err := check.applyConfig(); err != nil {
+			misc.Message("problem: %v", err)
+			problems++
+			break
 		}
-		return nil
 	}
-	var files database.Database
-	if strings.HasPrefix(p.input1, repo.ScanPrefix) {
-		r, err := repo.New(
-			repo.WithLocalTop(p.top),
-			repo.WithS3Client(S3Client),
-		)
+	result, err := repo.Doctor(
+		&repo.DoctorConfig{
+			NoOp: p.noOp,
+		},
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	problems += result.Problems()
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	if len(result.Findings) == 0 {
+		misc.Message("no problems found")
+	}
+	return nil
+}
+
+func (p *parser) doDb() error {
+	if p.input1 == "info" {
+		return p.dbInfo()
+	}
+	format, err := database.FileFormat(p.paths[0])
+	if err != nil {
+		return err
+	}
+	if p.binary {
+		format = database.DbQfs2
+	} else if format == database.DbQSync {
+		format = database.DbQfs
+	}
+	var dbs []database.Database
+	for _, path := range p.paths {
+		db, err := database.LoadFile(path, p.dbOptions()...)
 		if err != nil {
 			return err
 		}
-		files, err = r.Scan(p.input1, p.filters)
-		if err != nil {
-			return err
+		dbs = append(dbs, db)
+	}
+	return database.WriteDb(p.db, database.Merge(dbs...), format)
+}
+
+// dbOptions returns options for loading databases with the given filters.
+func (p *parser) dbOptions() []database.Options {
+	return []database.Options{
+		database.WithFilters(p.filters),
+		database.WithFilesOnly(p.filesOnly),
+		database.WithNoSpecial(p.noSpecial),
+	}
+}
+
+// dbInfo implements db info.
+func (p *parser) dbInfo() error {
+	st, err := os.Stat(p.paths[0])
+	if err != nil {
+		return err
+	}
+	if p.quick {
+		return dbQuickInfo(p.paths[0], st.Size())
+	}
+	stats, err := database.GetStats(p.paths[0], p.dbOptions()...)
+	if err != nil {
+		return err
+	}
+	printDbFormat(stats.Format, stats.Nanoseconds)
+	fmt.Printf("database size: %s\n", misc.FormatSize(st.Size()))
+	fmt.Printf("entries: %d\n", stats.Entries)
+	for _, t := range []struct {
+		fileType fileinfo.FileType
+		name     string
+	}{
+		{fileinfo.TypeFile, "files"},
+		{fileinfo.TypeDirectory, "directories"},
+		{fileinfo.TypeLink, "links"},
+		{fileinfo.TypeCharDev, "character devices"},
+		{fileinfo.TypeBlockDev, "block devices"},
+		{fileinfo.TypePipe, "pipes"},
+		{fileinfo.TypeSocket, "sockets"},
+		{fileinfo.TypeUnknown, "unknown"},
+	} {
+		if n := stats.ByType[t.fileType]; n > 0 {
+			fmt.Printf("  %s: %d\n", t.name, n)
 		}
+	}
+	fmt.Printf("total file size: %s\n", misc.FormatSize(stats.TotalSize))
+	if stats.Largest != nil {
+		fmt.Printf("largest file: %s (%s)\n", stats.Largest.Path, misc.FormatSize(stats.Largest.Size))
+	}
+	if stats.Entries > 0 {
+		fmt.Printf("oldest modification time: %s\n", misc.FormatTime(stats.Oldest))
+		fmt.Printf("newest modification time: %s\n", misc.FormatTime(stats.Newest))
+	}
+	return nil
+}
+
+// dbQuickInfo implements db info -quick, which shows the counts recorded in the
+// database's header without reading its entries.
+func dbQuickInfo(filename string, size int64) error {
+	h, err := database.FileHeader(filename)
+	if err != nil {
+		return err
+	}
+	if !h.Counted {
+		return fmt.Errorf("%s doesn't record counts in its header; omit -quick", filename)
+	}
+	printDbFormat(h.Format, h.Nanoseconds)
+	fmt.Printf("database size: %s\n", misc.FormatSize(size))
+	fmt.Printf("entries: %d\n", h.Entries)
+	fmt.Printf("total file size: %s\n", misc.FormatSize(h.TotalSize))
+	return nil
+}
+
+func printDbFormat(format database.DbFormat, nanoseconds bool) {
+	if nanoseconds {
+		fmt.Printf("format: %s (nanoseconds)\n", format)
 	} else {
-		scanner, err := scan.New(
-			p.input1,
-			scan.WithFilters(p.filters),
-			scan.WithSameDev(p.sameDev),
-			scan.WithCleanup(p.cleanup),
-			scan.WithFilesOnly(p.filesOnly),
-			scan.WithNoSpecial(p.noSpecial),
-		)
-		if err != nil {
-			// TEST: NOT COVERED. scan.New never returns an error.
-			return fmt.Errorf("create scanner: %w", err)
-		}
-		files, err = scanner.Run()
-		if err != nil {
-			return fmt.Errorf("scan: %w", err)
-		}
+		fmt.Printf("format: %s\n", format)
 	}
-	if p.db != "" {
-		return database.WriteDb(p.db, files, database.DbQfs)
+}
+
+func (p *parser) doBundle() error {
+	options := []repo.Options{
+		repo.WithLocalTop(p.top),
+		repo.WithContext(p.ctx),
 	}
-	return files.Print(p.long)
+	if p.input1 == "create" {
+		_, err := repo.CreateBundle(p.input2, options...)
+		return err
+	}
+	_, err := repo.ApplyBundle(
+		p.input2,
+		&repo.BundleConfig{
+			NoOp:      p.noOp,
+			BackupDir: p.backupDir,
+		},
+		options...,
+	)
+	return err
 }
 
-func (p *parser) doDiff() error {
-	d := diff.New(
-		diff.WithFilters(p.filters),
-		diff.WithFilesOnly(p.filesOnly),
-		diff.WithNoSpecial(p.noSpecial),
-		diff.WithNonFileTimes(p.nonFileTimes),
-		diff.WithNoOwnerships(p.noOwnerships),
+func (p *parser) doReadOnlyPolicy() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
-	r, err := d.RunFiles(p.input1, p.input2)
 	if err != nil {
-		return fmt.Errorf("diff: %w", err)
+		return err
 	}
-	err = r.WriteDiff(os.Stdout, p.checks)
+	policy, err := r.ReadOnlyPolicy()
 	if err != nil {
 		// TEST: NOT COVERED
 		return err
 	}
+	_, _ = os.Stdout.Write(policy)
+	return nil
+}
 
+func (p *parser) doSites() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	sites, err := r.Sites()
+	if err != nil {
+		return err
+	}
+	for _, s := range sites {
+		lastPush := "never pushed"
+		if !s.LastPush.IsZero() {
+			lastPush = misc.FormatTime(s.LastPush)
+		}
+		var notes []string
+		if s.Current {
+			notes = append(notes, "current")
+		}
+		if !s.HasDb {
+			notes = append(notes, "no database")
+		}
+		if !s.HasFilter {
+			notes = append(notes, "no filter")
+		}
+		fmt.Printf("%s %s", s.Name, lastPush)
+		if len(notes) > 0 {
+			fmt.Printf(" (%s)", strings.Join(notes, ", "))
+		}
+		fmt.Println()
+	}
 	return nil
 }
 
-func (p *parser) doInitRepo() error {
+func (p *parser) doRemoveSite() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithConfirmToken(p.confirmToken),
+		repo.WithMFA(p.mfa),
 	)
 	if err != nil {
 		return err
 	}
-	return r.Init(p.initMode)
+	return r.RemoveSite(p.input1)
 }
 
-func (p *parser) doPull() error {
+func (p *parser) doCopySite() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
 	if err != nil {
 		return err
 	}
-	return r.Pull(&repo.PullConfig{
-		NoOp:        p.noOp,
-		LocalFilter: p.localFilter,
+	return r.CopySite(p.input1, p.input2, &repo.CopySiteConfig{
+		FilterOnly: p.filterOnly,
 	})
 }
 
-func (p *parser) doPush() error {
+func (p *parser) doProtect() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithConfirmToken(p.confirmToken),
+		repo.WithMFA(p.mfa),
+	)
+	if err != nil {
+		return err
+	}
+	switch p.input1 {
+	case "on":
+		return r.SetProtected(true)
+	case "off":
+		return r.SetProtected(false)
+	}
+	protected, err := r.Protected()
+	if err != nil {
+		return err
+	}
+	if protected {
+		fmt.Println("the repository is protected")
+	} else {
+		fmt.Println("the repository is not protected")
+	}
+	return nil
+}
+
+func (p *parser) doUpgradeRepo() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
 	if err != nil {
 		return err
 	}
-	return r.Push(&repo.PushConfig{
-		Cleanup: p.cleanup,
-		NoOp:    p.noOp,
+	return r.Upgrade(&repo.UpgradeConfig{
+		NoOp: p.noOp,
 	})
 }
 
-func (p *parser) doPushDb() error {
+func (p *parser) doRefresh() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
 	if err != nil {
 		return err
 	}
-	return r.PushDb()
+	return r.Refresh()
 }
 
-func (p *parser) doSync() error {
-	s, err := sync.New(
-		p.input1,
-		p.input2,
-		sync.WithFilters(p.filters),
-		sync.WithNoOp(p.noOp),
+func (p *parser) doLogin() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
 	if err != nil {
 		return err
 	}
-	return s.Sync()
+	if p.remove {
+		return r.Logout()
+	}
+	in := bufio.NewReader(os.Stdin)
+	accessKeyId, err := readCredential(in, "access key ID", false)
+	if err != nil {
+		return err
+	}
+	secretAccessKey, err := readCredential(in, "secret access key", true)
+	if err != nil {
+		return err
+	}
+	return r.Login(accessKeyId, secretAccessKey)
 }
 
-func (p *parser) doPushTimes() error {
+// readCredential reads a line from in, which is standard input. If standard
+// input is a terminal, it prompts for the line, and if secret is true, it turns
+// off echo while the line is typed.
+func readCredential(in *bufio.Reader, name string, secret bool) (string, error) {
+	if misc.IsTerminal(os.Stdin) {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: ", name)
+		if secret && setEcho(false) {
+			defer func() {
+				setEcho(true)
+				_, _ = fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("reading %s: %w", name, err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (p *parser) doSetRetention() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
 	if err != nil {
 		return err
 	}
-	return r.PushTimes()
+	return r.SetRetention(p.input1)
 }
 
-func (p *parser) doListVersions() error {
+func (p *parser) doApplyRetention() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+		repo.WithConfirmToken(p.confirmToken),
+		repo.WithMFA(p.mfa),
 	)
 	if err != nil {
 		return err
 	}
-	return r.ListVersions(p.input1, &repo.ListVersionsConfig{
-		AsOf:    p.timestamp,
-		Long:    p.long,
-		Filters: p.filters,
+	return r.ApplyRetention(&repo.RetentionConfig{
+		NoOp:             p.noOp,
+		BypassGovernance: p.bypassGov,
 	})
 }
 
-func (p *parser) doGet() error {
+func (p *parser) doDu() error {
 	r, err := repo.New(
 		repo.WithLocalTop(p.top),
 		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
 	)
 	if err != nil {
 		return err
 	}
-	return r.Get(p.input1, p.input2, &repo.GetConfig{
-		AsOf:    p.timestamp,
-		Filters: p.filters,
+	entries, err := r.Du(p.input1, &repo.DuConfig{
+		Versions: p.versions,
 	})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("nothing found in the repository below \"%s\"", p.input1)
+	}
+	total := &repo.DuEntry{Name: "total"}
+	show := func(e *repo.DuEntry) {
+		fmt.Printf("%8s %8d", misc.FormatSize(e.Size), e.Objects)
+		if p.versions {
+			fmt.Printf(" %8s %8d %8d", misc.FormatSize(e.NoncurrentSize), e.NoncurrentVersions, e.DeleteMarkers)
+		}
+		fmt.Printf("  %s\n", e.Name)
+	}
+	if p.versions {
+		fmt.Printf("%8s %8s %8s %8s %8s  %s\n", "size", "objects", "old-size", "old", "deleted", "name")
+	} else {
+		fmt.Printf("%8s %8s  %s\n", "size", "objects", "name")
+	}
+	for _, e := range entries {
+		show(e)
+		total.Objects += e.Objects
+		total.Size += e.Size
+		total.NoncurrentVersions += e.NoncurrentVersions
+		total.NoncurrentSize += e.NoncurrentSize
+		total.DeleteMarkers += e.DeleteMarkers
+	}
+	show(total)
+	q, usage, err := r.QuotaUsage()
+	if err != nil {
+		return err
+	}
+	if q != nil {
+		fmt.Printf("quota: %s\n", q.Describe(usage))
+	}
+	return nil
+}
+
+func (p *parser) doQuota() error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	if p.remove {
+		return r.SetQuota(nil)
+	}
+	if p.quotaSize > 0 || p.quotaObjects > 0 {
+		return r.SetQuota(&repo.Quota{
+			Size:     p.quotaSize,
+			Objects:  p.quotaObjects,
+			WarnOnly: p.quotaWarn,
+		})
+	}
+	q, usage, err := r.QuotaUsage()
+	if err != nil {
+		return err
+	}
+	if q == nil {
+		fmt.Println("the repository has no quota")
+		return nil
+	}
+	fmt.Printf("quota: %s\n", q.Describe(usage))
+	if q.WarnOnly {
+		fmt.Println("pushes that exceed the quota are allowed with a warning")
+	}
+	return nil
+}
+
+func (p *parser) doClean() error {
+	result, err := clean.New(
+		p.input1,
+		clean.WithFilters(p.filters),
+		clean.WithNoOp(p.noOp),
+		clean.WithPruned(p.pruned),
+		clean.WithContext(p.ctx),
+	).Run()
+	if err != nil {
+		return err
+	}
+	verb := "removed"
+	if p.noOp {
+		verb = "would remove"
+	}
+	misc.Message("%s %d junk file(s) (%s)", verb, len(result.Junk), misc.FormatSize(result.JunkSize))
+	if p.pruned {
+		if len(result.Pruned) == 0 {
+			misc.Message("no pruned directories")
+			return nil
+		}
+		total := &clean.Pruned{Path: "total"}
+		show := func(x *clean.Pruned) {
+			fmt.Printf("%8s %8d  %s\n", misc.FormatSize(x.Size), x.Files, x.Path)
+		}
+		fmt.Printf("%8s %8s  %s\n", "size", "files", "name")
+		for _, x := range result.Pruned {
+			show(x)
+			total.Files += x.Files
+			total.Size += x.Size
+		}
+		show(total)
+	}
+	return nil
+}
+
+// interruptContext returns a context that is canceled on the first interrupt
+// or termination signal so that operations can stop cleanly. After that, the
+// default handling of those signals is restored, so interrupting again exits
+// immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			signal.Stop(sigs)
+			misc.Message("interrupted; stopping cleanly (interrupt again to exit immediately)")
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sigs)
+		}
+	}()
+	return ctx, cancel
 }
 
-func Run(args []string) error {
+func Run(args []string) (retErr error) {
 	if len(args) == 0 {
 		return errors.New("no arguments provided")
 	}
@@ -748,18 +3065,51 @@ func Run(args []string) error {
 		args:     args[1:],
 		arg:      0,
 		action:   actNone,
+		seen:     map[string]bool{},
 	}
+	defer func() {
+		if p.origDir != "" {
+			_ = os.Chdir(p.origDir)
+		}
+	}()
 	for p.arg < len(p.args) {
 		if err := p.handleArg(); err != nil {
 			return err
 		}
 	}
+	if _, ok := argTables[p.action]["top"]; ok && !p.seen["top"] {
+		p.top = findTop()
+	}
+	// Doctor reports problems with the configuration file rather than failing.
+	if p.action != actNone && p.action != actDoctor {
+		if err := p.applyConfig(); err != nil {
+			return err
+		}
+	}
 	if err := p.check(); err != nil {
 		return err
 	}
 	if p.dynamicFilter != nil {
 		p.filters = append(p.filters, p.dynamicFilter)
 	}
+	// When output is going to a file or another program, report totals
+	// periodically instead of every file.
+	misc.ConsoleSummary = !p.verbose && !misc.IsTerminal(os.Stdout)
+	var cancel context.CancelFunc
+	p.ctx, cancel = interruptContext()
+	defer cancel()
+	if p.timeout > 0 {
+		// When the deadline passes, operations stop as if interrupted, so anything
+		// that must be cleaned up, such as the repository lock, still is.
+		var cancelTimeout context.CancelFunc
+		p.ctx, cancelTimeout = context.WithTimeout(p.ctx, p.timeout)
+		defer cancelTimeout()
+		defer func() {
+			if retErr != nil && errors.Is(p.ctx.Err(), context.DeadlineExceeded) {
+				retErr = fmt.Errorf("timed out after %s: %w", p.timeout, retErr)
+			}
+		}()
+	}
 	switch p.action {
 	case actNone:
 		// TEST: NOT COVERED. Can't actually happen.
@@ -782,8 +3132,66 @@ func Run(args []string) error {
 		return p.doPushTimes()
 	case actListVersions:
 		return p.doListVersions()
+	case actDiffVersions:
+		return p.doDiffVersions()
 	case actGet:
 		return p.doGet()
+	case actStatus:
+		return p.doStatus()
+	case actUnlock:
+		return p.doUnlock()
+	case actEmptyTrash:
+		return p.doEmptyTrash()
+	case actReplicate:
+		return p.doReplicate()
+	case actDoctor:
+		return p.doDoctor()
+	case actBundle:
+		return p.doBundle()
+	case actSites:
+		return p.doSites()
+	case actReadOnlyPolicy:
+		return p.doReadOnlyPolicy()
+	case actRemoveSite:
+		return p.doRemoveSite()
+	case actCopySite:
+		return p.doCopySite()
+	case actProtect:
+		return p.doProtect()
+	case actUpgradeRepo:
+		return p.doUpgradeRepo()
+	case actRefresh:
+		return p.doRefresh()
+	case actLogin:
+		return p.doLogin()
+	case actExportTar:
+		return p.doExportTar()
+	case actQuota:
+		return p.doQuota()
+	case actSetRetention:
+		return p.doSetRetention()
+	case actApplyRetention:
+		return p.doApplyRetention()
+	case actDu:
+		return p.doDu()
+	case actApplyPlan:
+		return p.doApplyPlan()
+	case actLog:
+		return p.doLog()
+	case actFsckRepo:
+		return p.doFsckRepo()
+	case actServe:
+		return p.doServe()
+	case actGateway:
+		return p.doGateway()
+	case actCompletion:
+		return p.doCompletion()
+	case actClone:
+		return p.doClone()
+	case actDb:
+		return p.doDb()
+	case actClean:
+		return p.doClean()
 	}
 	// TEST: NOT COVERED (not reachable, but go 1.22 doesn't see it)
 	return nil
@@ -1,15 +1,29 @@
 package qfs_test
 
 import (
+	"bufio"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jberkenbilt/qfs/database"
 	"github.com/jberkenbilt/qfs/gztar"
+	"github.com/jberkenbilt/qfs/keyring"
+	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/qfs"
+	"github.com/jberkenbilt/qfs/repo"
+	"github.com/jberkenbilt/qfs/scan"
 	"github.com/jberkenbilt/qfs/testutil"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"slices"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -94,6 +108,155 @@ func TestScanError(t *testing.T) {
 	}
 }
 
+func TestScanProviders(t *testing.T) {
+	oldLocal := time.Local
+	defer func() {
+		time.Local = oldLocal
+	}()
+	time.Local, _ = time.LoadLocation("EST5EDT")
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	abs, err := filepath.Abs("testdata/all-types.qfs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	scan.Register("test-db", scan.ProviderFunc(
+		func(input string, config *scan.Config) (database.Database, error) {
+			_, name, _ := strings.Cut(input, ":")
+			return database.LoadFile(
+				filepath.Join("testdata", name),
+				database.WithFilters(config.Filters),
+			)
+		},
+	))
+	defer scan.Register("test-db", nil)
+	if !slices.Contains(scan.Schemes(), "test-db") {
+		t.Errorf("wrong schemes: %v", scan.Schemes())
+	}
+
+	for _, input := range []string{
+		server.URL + "/all-types.qfs",
+		"file://" + abs,
+		"TEST-DB:all-types.qfs",
+	} {
+		for _, stream := range []bool{false, true} {
+			args := []string{"qfs", "scan", input}
+			if stream {
+				args = append(args, "-stream")
+			}
+			data, _ := testutil.WithStdout(func() {
+				err = qfs.Run(args)
+			})
+			if err != nil {
+				t.Errorf("%v: %v", args, err)
+			}
+			if !slices.Equal(data, allTypesOut) {
+				t.Errorf("%v: got wrong output: %s", args, data)
+			}
+		}
+	}
+
+	err = qfs.Run([]string{"qfs", "scan", server.URL + "/does-not-exist.qfs"})
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = qfs.Run([]string{"qfs", "diff", "s3://bucket/prefix", abs})
+	if err == nil || !strings.Contains(err.Error(), "input can only be listed") {
+		t.Errorf("wrong error: %v", err)
+	}
+	data, _ := testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "diff", "test-db:all-types.qfs", "file://" + abs})
+	})
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if len(data) != 0 {
+		t.Errorf("unexpected diff: %s", data)
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	t.Setenv("XDG_CACHE_HOME", j("cache"))
+	if err := os.Mkdir(j("serve"), 0o777); err != nil {
+		t.Fatal(err.Error())
+	}
+	serve := func(src string, modTime time.Time) {
+		t.Helper()
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = os.WriteFile(j("serve/site.qfs"), data, 0o666); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = os.Chtimes(j("serve/site.qfs"), modTime, modTime); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	var conditional int
+	fileServer := http.FileServer(http.Dir(j("serve")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			conditional++
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	url := server.URL + "/site.qfs"
+	noDiff := func(other string) {
+		t.Helper()
+		var err error
+		data, _ := testutil.WithStdout(func() {
+			err = qfs.Run([]string{"qfs", "diff", url, other})
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(data) != 0 {
+			t.Errorf("unexpected diff: %s", data)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	serve("testdata/all-types.qfs", start)
+	noDiff("testdata/all-types.qfs")
+	if conditional != 0 {
+		t.Errorf("first request was conditional")
+	}
+	// The second request is answered from the cache.
+	noDiff("testdata/all-types.qfs")
+	if conditional != 1 {
+		t.Errorf("second request was not conditional")
+	}
+	// When the database changes, the new one is retrieved.
+	serve("testdata/changed.qfs", start.Add(time.Minute))
+	noDiff("testdata/changed.qfs")
+	if conditional != 2 {
+		t.Errorf("wrong number of conditional requests: %d", conditional)
+	}
+	entries, err := os.ReadDir(j("cache/qfs/http"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 2 {
+		t.Errorf("wrong cache contents: %v", entries)
+	}
+
+	// If the cache can't be written, the database is still used.
+	testutil.Check(t, os.WriteFile(j("not-a-dir"), nil, 0o666))
+	t.Setenv("XDG_CACHE_HOME", j("not-a-dir"))
+	data, _ := testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "diff", url, "testdata/changed.qfs"})
+	})
+	testutil.Check(t, err)
+	if !strings.Contains(string(data), "unable to cache "+url) || strings.Contains(string(data), "add ") {
+		t.Errorf("wrong output: %s", data)
+	}
+}
+
 func TestDiffError(t *testing.T) {
 	tmp := t.TempDir()
 	err := qfs.Run([]string{
@@ -116,6 +279,210 @@ func TestDiffError(t *testing.T) {
 	}
 }
 
+func TestScanBirthTimes(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	testutil.Check(t, os.MkdirAll(j("files"), 0o777))
+	testutil.Check(t, os.WriteFile(j("files/a"), []byte("a"), 0o666))
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-db", j("without.db"), j("files")}))
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-birth-times", "-db", j("with.db"), j("files")}))
+	db, err := database.LoadFile(j("without.db"))
+	testutil.Check(t, err)
+	if !db["a"].BirthTime.IsZero() {
+		t.Errorf("birth time captured without -birth-times")
+	}
+	db, err = database.LoadFile(j("with.db"))
+	testutil.Check(t, err)
+	if db["a"].BirthTime.IsZero() {
+		t.Skip("creation times aren't available on this file system")
+	}
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-long", j("with.db")}))
+	})
+	exp := " btime=" + misc.FormatTime(db["a"].BirthTime) + " "
+	if !strings.Contains(string(stdout), exp) {
+		t.Errorf("wrong output: %s", stdout)
+	}
+}
+
+func TestScanNanoseconds(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	testutil.Check(t, os.MkdirAll(j("files"), 0o777))
+	testutil.Check(t, os.WriteFile(j("files/a"), []byte("a"), 0o666))
+	mtime := time.Unix(1713636124, 123456789)
+	testutil.Check(t, os.Chtimes(j("files/a"), mtime, mtime))
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-db", j("ms.db"), j("files")}))
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-nanoseconds", "-db", j("ns.db"), j("files")}))
+	db, err := database.LoadFile(j("ms.db"))
+	testutil.Check(t, err)
+	if !db["a"].ModTime.Equal(mtime.Truncate(time.Millisecond)) {
+		t.Errorf("wrong time without -nanoseconds: %v", db["a"].ModTime)
+	}
+	db, err = database.LoadFile(j("ns.db"))
+	testutil.Check(t, err)
+	if !db["a"].ModTime.Equal(mtime) {
+		t.Skip("this file system doesn't record nanoseconds")
+	}
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "db", "info", j("ns.db")}))
+	})
+	if !strings.HasPrefix(string(stdout), "format: QFS 1 (nanoseconds)\n") {
+		t.Errorf("wrong output: %s", stdout)
+	}
+	// The databases differ only in precision, so nothing has changed.
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "diff", j("ms.db"), j("ns.db")}))
+	})
+	if len(stdout) != 0 {
+		t.Errorf("wrong output: %s", stdout)
+	}
+}
+
+func TestScanStats(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	testutil.Check(t, os.MkdirAll(j("files/sub"), 0o777))
+	testutil.Check(t, os.WriteFile(j("files/sub/a"), []byte("a"), 0o666))
+	testutil.Check(t, os.WriteFile(j("files/b.o"), []byte("b"), 0o666))
+	stdout, stderr := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-stats", "-prune", "b.o", j("files")}))
+	})
+	// Statistics don't get mixed in with the scan output.
+	if strings.Contains(string(stdout), "entries:") {
+		t.Errorf("wrong output: %s", stdout)
+	}
+	for _, exp := range []string{
+		"entries: 4 (",
+		"directories: 2\n",
+		"files: 2\n",
+		"rejected by prune: 1\n",
+		"worker 1: ",
+	} {
+		if !strings.Contains(string(stderr), exp) {
+			t.Errorf("missing %q in stats: %s", exp, stderr)
+		}
+	}
+	_, stderr = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-db", j("files.db"), j("files")}))
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-stats", j("files.db")}))
+	})
+	if !strings.Contains(string(stderr), "no statistics") {
+		t.Errorf("wrong stats for database: %s", stderr)
+	}
+}
+
+func TestScanChecksum(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	testutil.Check(t, os.MkdirAll(j("files/sub"), 0o777))
+	testutil.Check(t, os.WriteFile(j("files/sub/a"), []byte("abc"), 0o666))
+	testutil.Check(t, os.Symlink("sub/a", j("files/link")))
+	const sha256Abc = "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	const blake3Abc = "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"
+	for _, args := range [][]string{
+		{"-checksum", "sha256"},
+		{"-checksum", "blake3", "-binary"},
+		{"-checksum", "blake3", "-stream"},
+		{"-checksum", "sha256", "-birth-times"},
+		{},
+	} {
+		testutil.Check(t, qfs.Run(append(append([]string{"qfs", "scan"}, args...), "-db", j("db"), j("files"))))
+		db, err := database.LoadFile(j("db"))
+		testutil.Check(t, err)
+		exp := ""
+		if len(args) > 0 {
+			exp = map[string]string{"sha256": sha256Abc, "blake3": blake3Abc}[args[1]]
+		}
+		if db["sub/a"].Checksum != exp {
+			t.Errorf("%v: wrong checksum: %s", args, db["sub/a"].Checksum)
+		}
+		if db["sub"].Checksum != "" || db["link"].Checksum != "" {
+			t.Errorf("%v: checksum for non-file", args)
+		}
+	}
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-checksum", "blake3", "-db", j("db"), j("files")}))
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-long", j("db")}))
+	})
+	if !strings.Contains(string(stdout), " "+blake3Abc+" ") {
+		t.Errorf("wrong output: %s", stdout)
+	}
+	err := qfs.Run([]string{"qfs", "scan", "-checksum", "md5", j("files")})
+	if err == nil || !strings.Contains(err.Error(), `unknown checksum algorithm "md5"; use one of blake3, sha256`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestScanMtree(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	testutil.Check(t, os.MkdirAll(j("files/sub dir"), 0o777))
+	testutil.Check(t, os.WriteFile(j("files/sub dir/a"), []byte("abc"), 0o666))
+	testutil.Check(t, os.Symlink("sub dir/a", j("files/link")))
+	const sha256Abc = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "--format", "mtree", "-checksum", "sha256", j("files")}))
+	})
+	lines := strings.Split(string(stdout), "\n")
+	if len(lines) != 6 || lines[0] != "#mtree" ||
+		!strings.HasPrefix(lines[1], ". type=dir ") ||
+		!strings.HasPrefix(lines[2], "./link type=link ") ||
+		!strings.HasSuffix(lines[2], " link=sub\\040dir/a") ||
+		!strings.HasPrefix(lines[3], "./sub\\040dir type=dir ") ||
+		!strings.HasPrefix(lines[4], "./sub\\040dir/a type=file ") ||
+		!strings.HasSuffix(lines[4], " size=3 sha256digest="+sha256Abc) {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	streamed, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-format", "mtree", "-stream", "-checksum", "sha256", j("files")}))
+	})
+	if string(streamed) != string(stdout) {
+		t.Errorf("wrong streamed output:\n%s", streamed)
+	}
+
+	// Diff the directory against the specification, and read the specification
+	// as a scan input.
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-format", "mtree", "-db", j("spec"), j("files")}))
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "diff", "mtree:" + j("spec"), j("files")}))
+	})
+	if len(stdout) != 0 {
+		t.Errorf("unexpected differences: %s", stdout)
+	}
+	testutil.Check(t, os.WriteFile(j("files/sub dir/b"), []byte("x"), 0o666))
+	testutil.Check(t, os.Remove(j("files/link")))
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "diff", "mtree:" + j("spec"), j("files")}))
+	})
+	if !strings.Contains(string(stdout), "rm link\n") || !strings.Contains(string(stdout), "add sub dir/b\n") {
+		t.Errorf("wrong diff: %s", stdout)
+	}
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-f", "mtree:" + j("spec")}))
+	})
+	if !strings.Contains(string(stdout), " sub dir/a\n") || strings.Contains(string(stdout), " .\n") {
+		t.Errorf("wrong scan output: %s", stdout)
+	}
+
+	testutil.Check(t, os.WriteFile(j("bad"), []byte("#mtree\nx type=door\n"), 0o666))
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"scan", "-format", "xml", j("files")}, `format: unknown format "xml"; use qfs or mtree`},
+		{[]string{"scan", "-format", "mtree", "-binary", j("files")}, "-binary can't be used with -format mtree"},
+		{[]string{"scan", "mtree:"}, "mtree input must be mtree:path"},
+		{[]string{"diff", "mtree:" + j("bad"), j("files")}, `line 2: x: unknown type "door"`},
+	} {
+		err := qfs.Run(append([]string{"qfs"}, tc.args...))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: wrong error: %v", tc.args, err)
+		}
+	}
+}
+
 func TestScanDir(t *testing.T) {
 	oldLocal := time.Local
 	defer func() {
@@ -221,6 +588,51 @@ func TestDiff(t *testing.T) {
 		"-db",
 		j("1.qfs"),
 	}))
+	// A streamed scan writes an identical database except that its header can't
+	// record counts, which aren't known until the scan is done. "d1.x" sorts
+	// between "d1" and "d1/f", which exercises interleaving of siblings with
+	// subdirectories.
+	testutil.Check(t, os.WriteFile(j("top/d1/f"), []byte("file"), 0666))
+	testutil.Check(t, os.WriteFile(j("top/d1.x"), []byte("file"), 0666))
+	for _, args := range [][]string{
+		{"-db", j("1a.qfs")},
+		{"-stream", "-db", j("1b.qfs")},
+		{"-binary", "-db", j("1c.qfs")},
+		{"-stream", "-binary", "-db", j("1d.qfs")},
+	} {
+		testutil.Check(t, qfs.Run(append([]string{"qfs", "scan", j("top")}, args...)))
+	}
+	for _, tc := range []struct {
+		file, streamed, header string
+	}{
+		{"1a.qfs", "1b.qfs", "QFS 1"},
+		{"1c.qfs", "1d.qfs", "QFS 2"},
+	} {
+		db1, err := os.ReadFile(j(tc.file))
+		testutil.Check(t, err)
+		db2, err := os.ReadFile(j(tc.streamed))
+		testutil.Check(t, err)
+		header1, rest1, _ := strings.Cut(string(db1), "\n")
+		header2, rest2, _ := strings.Cut(string(db2), "\n")
+		if !strings.HasPrefix(header1, tc.header+" entries=") || header2 != tc.header {
+			t.Errorf("wrong headers: %q, %q", header1, header2)
+		}
+		// The index of a QFS 2 database depends on the length of the header, so only
+		// the rows of the text format can be compared directly.
+		if tc.header == "QFS 1" && rest1 != rest2 {
+			t.Errorf("%s: streamed database differs", tc.header)
+		}
+		loaded1, err := database.LoadFile(j(tc.file))
+		testutil.Check(t, err)
+		loaded2, err := database.LoadFile(j(tc.streamed))
+		testutil.Check(t, err)
+		if !reflect.DeepEqual(loaded1, loaded2) {
+			t.Errorf("%s: streamed database differs", tc.header)
+		}
+	}
+	testutil.CheckLines(t, []string{"qfs", "diff", j("1a.qfs"), j("1c.qfs")}, nil)
+	testutil.Check(t, os.Remove(j("top/d1/f")))
+	testutil.Check(t, os.Remove(j("top/d1.x")))
 	time.Sleep(20 * time.Millisecond)
 	testutil.Check(t, os.WriteFile(j("top/f1"), []byte("change"), 0666))
 	testutil.Check(t, os.Remove(j("top/f2")))
@@ -248,6 +660,48 @@ func TestDiff(t *testing.T) {
 			"chmod 0744 d1",
 			"chmod 0444 f3",
 		})
+	testutil.CheckLines(
+		t,
+		[]string{"qfs", "diff", "-no-perms", j("1.qfs"), j("top")},
+		[]string{
+			"typechange f2",
+			"rm f2",
+			"rm f4",
+			"mkdir f2",
+			"add f5",
+			"change f1",
+		})
+	// With -renames, files in a renamed directory are shown as renames.
+	testutil.Check(t, os.MkdirAll(j("moves/a"), 0777))
+	testutil.Check(t, os.WriteFile(j("moves/a/file"), []byte("moved"), 0666))
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", j("moves"), "-db", j("moves.qfs")}))
+	testutil.Check(t, os.Rename(j("moves/a"), j("moves/b")))
+	testutil.CheckLines(
+		t,
+		[]string{"qfs", "diff", "-renames", j("moves.qfs"), j("moves")},
+		[]string{
+			"rm a",
+			"rename a/file -> b/file",
+			"mkdir b",
+		})
+	// With -modify-window, small differences in modification time are ignored.
+	testutil.Check(t, os.MkdirAll(j("window"), 0777))
+	testutil.Check(t, os.WriteFile(j("window/file"), []byte("same"), 0666))
+	mtime := time.Unix(1713636124, 0)
+	testutil.Check(t, os.Chtimes(j("window/file"), mtime, mtime))
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", j("window"), "-db", j("window.qfs")}))
+	mtime = mtime.Add(time.Second)
+	testutil.Check(t, os.Chtimes(j("window/file"), mtime, mtime))
+	testutil.CheckLines(
+		t,
+		[]string{"qfs", "diff", j("window.qfs"), j("window")},
+		[]string{
+			"change file",
+		})
+	testutil.CheckLines(
+		t,
+		[]string{"qfs", "diff", "-modify-window", "2", j("window.qfs"), j("window")},
+		nil)
 	testutil.CheckLines(
 		t,
 		[]string{
@@ -263,10 +717,10 @@ func TestDiff(t *testing.T) {
 			"rm RCS/.gtkrc-2.0,v",
 			"change RCS/.abcde.conf,v",
 			"change other/zero",
-			"change scripts/apply_sync",
 			"chown 517:1111 other/pipe",
 			"chown 517: other/socket",
 			"chown :617 qfs",
+			"relink scripts/apply_sync -> ../source/qsync/util/different",
 		})
 	testutil.Check(t, qfs.Run([]string{
 		"qfs",
@@ -287,6 +741,25 @@ func TestDiff(t *testing.T) {
 		"-db",
 		j("2.qfs"),
 	}))
+	// Get the same result reading directives from files.
+	testutil.Check(t, os.WriteFile(j("include-list"), []byte(".\n# comment\n\n*/.gitignore\n"), 0o644))
+	testutil.Check(t, os.WriteFile(j("exclude-list"), []byte("RCS\n  */.idea  \n"), 0o644))
+	testutil.Check(t, qfs.Run([]string{
+		"qfs",
+		"scan",
+		"testdata/real.qfs",
+		"-include-from",
+		j("include-list"),
+		"-exclude-from",
+		j("exclude-list"),
+		"-junk",
+		"~$",
+		"-prune",
+		"qfs/coverage",
+		"-db",
+		j("2-from.qfs"),
+	}))
+	testutil.CheckLines(t, []string{"qfs", "diff", j("2.qfs"), j("2-from.qfs")}, nil)
 	testutil.CheckLines(
 		t,
 		[]string{
@@ -488,58 +961,1256 @@ func TestDiff(t *testing.T) {
 	)
 }
 
-func TestCLI(t *testing.T) {
-	checkCli := func(cmd []string, expErr string) {
+func TestConfig(t *testing.T) {
+	oldLocal := time.Local
+	defer func() {
+		time.Local = oldLocal
+	}()
+	time.Local, _ = time.LoadLocation("EST5EDT")
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	if err := os.Mkdir(j(".qfs"), 0o777); err != nil {
+		t.Fatal(err.Error())
+	}
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(j(".qfs/config"), []byte(config), 0o666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	scan := func(args ...string) ([]byte, error) {
 		var err error
-		stdout, stderr := testutil.WithStdout(func() {
-			err = qfs.Run(cmd)
+		stdout, _ := testutil.WithStdout(func() {
+			err = qfs.Run(append([]string{"qfs", "scan", "-top", tmp, "testdata/all-types.qfs"}, args...))
 		})
-		if err == nil {
-			t.Errorf("no error")
-		} else if !strings.Contains(err.Error(), expErr) {
-			t.Errorf("wrong error: %v", err)
+		return stdout, err
+	}
+
+	// Top-level settings apply to subcommands that accept them and are otherwise
+	// ignored.
+	writeConfig(`
+# comment
+long = true # comment
+trash = true
+
+[scan]
+db = "` + j("from-config") + `"
+binary = false
+`)
+	_, err := scan()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = os.Stat(j("from-config")); err != nil {
+		t.Errorf("database was not written: %v", err)
+	}
+	// The command line overrides the configuration.
+	_, err = scan("-db", j("from-cli"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = os.Stat(j("from-cli")); err != nil {
+		t.Errorf("database was not written: %v", err)
+	}
+
+	// Section settings take precedence, and arrays repeat options.
+	writeConfig(`
+long = false
+[scan]
+long = true
+exclude = [ "*", 'potato' ]
+include = ["scripts"]
+`)
+	stdout, err := scan()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var exp []string
+	for _, line := range strings.Split(string(allTypesOutLong), "\n") {
+		if strings.HasSuffix(line, " .") || strings.Contains(line, " scripts") {
+			exp = append(exp, line)
 		}
-		if len(stdout) > 0 || len(stderr) > 0 {
-			t.Errorf("stdout=%s, stderr=%s", stdout, stderr)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(stdout)), "\n"); !slices.Equal(lines, exp) {
+		t.Errorf("wrong output: %s", stdout)
+	}
+
+	for config, expErr := range map[string]string{
+		"potato = true":            ".qfs/config:1: unknown option \"potato\"",
+		"[potato]":                 ".qfs/config:1: unknown subcommand \"potato\"",
+		"\n[scan]\nforce = true":   ".qfs/config:3: scan doesn't accept option \"force\"",
+		"long = true\nlong = true": ".qfs/config:2: long is already set",
+		"db":                       ".qfs/config:1: expected option = value",
+		"db = potato":              ".qfs/config:1: db: value must be",
+		"db = \"potato":            ".qfs/config:1: db: unterminated string",
+		"exclude = [\"a\" \"b\"]":  ".qfs/config:1: exclude: expected , or ] in array",
+		"long = true false":        ".qfs/config:1: long: unexpected text after value",
+		"db = true":                ".qfs/config:1: db: option requires a value",
+		"long = \"yes\"":           ".qfs/config:1: long: option doesn't take a value",
+		"[scan]\ntop = \"/tmp\"":   ".qfs/config:2: top may not be set",
+		"[scan]\njunk = \"??*\"":   ".qfs/config:2: junk: regexp error",
+	} {
+		writeConfig(config)
+		_, err = scan()
+		if err == nil || !strings.Contains(err.Error(), expErr) {
+			t.Errorf("%q: wrong error: %v", config, err)
 		}
 	}
-	checkCli(nil, "no arguments provided")
-	checkCli([]string{"qfs"}, "run qfs --help for help")
-	checkCli([]string{"qfs", "scan"}, "scan requires an input")
-	checkCli([]string{"qfs", "scan", "a", "a"}, "an input has already been specified")
-	checkCli([]string{"qfs", "diff", "a"}, "diff requires two inputs")
-	checkCli([]string{"qfs", "diff", "a", "a", "a"}, "inputs have already been specified")
-	checkCli([]string{"qfs", "scan", "-db"}, "db requires an argument")
-	checkCli([]string{"qfs", "scan", "-include"}, "include requires an argument")
-	checkCli([]string{"qfs", "scan", "-filter"}, "filter requires an argument")
-	checkCli([]string{"qfs", "potato"}, "unknown subcommand")
-	checkCli([]string{"qfs", "scan", "-potato"}, "unknown option")
-	checkCli([]string{"qfs", "scan", "-junk", "??*"}, "regexp error on ??*")
-	checkCli([]string{"qfs", "scan", "-filter", "testdata/bad-filter"}, "testdata/bad-filter:1: regexp error")
-	checkCli([]string{"qfs", "init-repo", "x"}, "unexpected positional argument \"x\"")
-	checkCli([]string{"qfs", "init-repo", "-top"}, "top requires an argument")
 }
 
-func TestHelpVersion(t *testing.T) {
-	cases := map[string]string{
-		"--version": "qfs version ",
-		"--help":    "qfs subcommand [options]",
+func TestRepoConfig(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	if err := os.Mkdir(j(".qfs"), 0o777); err != nil {
+		t.Fatal(err.Error())
 	}
-	for arg, text := range cases {
-		t.Run(arg, func(t *testing.T) {
-			stdout, stderr := testutil.WithStdout(func() {
-				defer func() {
-					_ = recover()
-				}()
-				testutil.Check(t, qfs.Run([]string{"qfs", arg}))
-			})
-			if !strings.Contains(string(stdout), text) {
-				t.Errorf("didn't see expected text")
-			}
-			if len(stderr) > 0 {
-				t.Errorf("stderr: %s", stderr)
-			}
+	credentials := `
+[test-profile]
+aws_access_key_id = test-key
+aws_secret_access_key = test-secret
+`
+	if err := os.WriteFile(j("credentials"), []byte(credentials), 0o600); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", j("credentials"))
+	t.Setenv("AWS_CONFIG_FILE", j("does-not-exist"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
 
-		})
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	writeRepo := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(j(".qfs/repo"), []byte(config), 0o666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	writeRepo("s3://qfs-test-bucket/home\n# comment\n\nendpoint = " + server.URL +
+		"\nregion = us-west-2\npath-style = true\nprofile = test-profile\n")
+	err := qfs.Run([]string{"qfs", "status", "-top", tmp})
+	if err == nil {
+		t.Errorf("status succeeded with no repository")
+	}
+	if len(requests) == 0 {
+		t.Fatalf("no requests were sent to the endpoint")
+	}
+	if !strings.HasPrefix(requests[0], "/qfs-test-bucket") ||
+		!strings.Contains(requests[0], "Credential=test-key/") ||
+		!strings.Contains(requests[0], "/us-west-2/s3/") {
+		t.Errorf("wrong request: %s", requests[0])
+	}
+
+	// Transient errors are retried as configured.
+	var attempts int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	writeRepo("s3://qfs-test-bucket/home\nendpoint = " + failing.URL +
+		"\nregion = us-west-2\npath-style = true\nprofile = test-profile\n" +
+		"retry-attempts = 3\nretry-delay = 1ms\nretry-max-delay = 2ms\n")
+	err = qfs.Run([]string{"qfs", "status", "-top", tmp})
+	if err == nil || !strings.Contains(err.Error(), "StatusCode: 503") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("wrong number of attempts: %d", attempts)
+	}
+
+	// The profile's credentials are used to assume the configured role, and the
+	// role's credentials are used for S3.
+	var stsRequests []string
+	requests = nil
+	withSts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/" {
+			_ = r.ParseForm()
+			stsRequests = append(stsRequests, fmt.Sprintf(
+				"%s %s %s %s %v",
+				r.Form.Get("Action"),
+				r.Form.Get("RoleArn"),
+				r.Form.Get("RoleSessionName"),
+				r.Form.Get("ExternalId"),
+				strings.Contains(r.Header.Get("Authorization"), "Credential=test-key/"),
+			))
+			_, _ = w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleResult><Credentials><AccessKeyId>role-key</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey>
+<SessionToken>role-token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration></Credentials>
+</AssumeRoleResult></AssumeRoleResponse>`))
+			return
+		}
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer withSts.Close()
+	writeRepo("s3://qfs-test-bucket/home\nendpoint = " + withSts.URL +
+		"\nregion = us-west-2\npath-style = true\nprofile = test-profile\n" +
+		"role-arn = arn:aws:iam::123456789012:role/backup\nexternal-id = ext\nsts-endpoint = " + withSts.URL + "\n")
+	err = qfs.Run([]string{"qfs", "status", "-top", tmp})
+	if err == nil {
+		t.Errorf("status succeeded with no repository")
+	}
+	if !slices.Equal(stsRequests, []string{"AssumeRole arn:aws:iam::123456789012:role/backup qfs ext true"}) {
+		t.Errorf("wrong STS requests: %q", stsRequests)
+	}
+	if len(requests) == 0 || !strings.Contains(requests[0], "Credential=role-key/") {
+		t.Errorf("wrong requests: %q", requests)
+	}
+
+	// With keyring, keys stored by login are used instead of the profile's.
+	qfs.Keyring = keyring.NewMemory()
+	defer func() { qfs.Keyring = nil }()
+	login := func(input string, args ...string) error {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, _ = w.WriteString(input)
+		_ = w.Close()
+		stdin := os.Stdin
+		os.Stdin = r
+		defer func() {
+			os.Stdin = stdin
+			_ = r.Close()
+		}()
+		return qfs.Run(append([]string{"qfs", "login", "-top", tmp}, args...))
+	}
+	writeRepo("s3://qfs-test-bucket/home\nendpoint = " + server.URL +
+		"\nregion = us-west-2\npath-style = true\nkeyring = true\n")
+	requests = nil
+	err = qfs.Run([]string{"qfs", "status", "-top", tmp})
+	if err == nil || !strings.Contains(err.Error(), "no credentials for "+server.URL+" in keyring; run \"qfs login\"") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("requests were sent without credentials: %q", requests)
+	}
+	err = login("keyring-key\n")
+	if err == nil || !strings.Contains(err.Error(), "reading secret access key: EOF") {
+		t.Errorf("wrong error: %v", err)
+	}
+	testutil.Check(t, login("keyring-key\nkeyring-secret"))
+	err = qfs.Run([]string{"qfs", "status", "-top", tmp})
+	if err == nil {
+		t.Errorf("status succeeded with no repository")
+	}
+	if len(requests) == 0 || !strings.Contains(requests[0], "Credential=keyring-key/") {
+		t.Errorf("wrong requests: %q", requests)
+	}
+	testutil.Check(t, login("", "-remove"))
+	err = login("", "-remove")
+	if err == nil || !strings.Contains(err.Error(), "there are no credentials for "+server.URL+" in keyring") {
+		t.Errorf("wrong error: %v", err)
+	}
+	writeRepo("s3://qfs-test-bucket/home\nendpoint = " + server.URL + "\n")
+	err = login("", "-remove")
+	if err == nil || !strings.Contains(err.Error(), ".qfs/repo: keyring must be set to true") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	for config, expErr := range map[string]string{
+		"s3://bucket/prefix\nretry-attempts = 0":                               ".qfs/repo:2: retry-attempts must be a positive integer",
+		"s3://bucket/prefix\nretry-max-delay = 10":                             ".qfs/repo:2: retry-max-delay must be a duration",
+		"s3://bucket/prefix\npotato = 1":                                       ".qfs/repo:2: unknown setting \"potato\"",
+		"s3://bucket/prefix\nregion":                                           ".qfs/repo:2: expected key = value",
+		"s3://bucket/prefix\npath-style = yes":                                 ".qfs/repo:2: path-style must be true or false",
+		"s3://bucket/prefix\naccelerate = on":                                  ".qfs/repo:2: accelerate must be true or false",
+		"s3://bucket/prefix\naccelerate = true\npath-style = true":             ".qfs/repo: accelerate can't be used with endpoint or path-style",
+		"s3://bucket/prefix\ndual-stack = true\nendpoint = http://x":           ".qfs/repo: dual-stack can't be used with endpoint",
+		"s3://bucket/prefix\nlayout = hash":                                    ".qfs/repo:2: layout must be path or content",
+		"s3://bucket/prefix\nchunk-size = 0":                                   ".qfs/repo:2: chunk-size must be a positive size",
+		"s3://bucket/prefix\nchunk-size = 1M":                                  ".qfs/repo: chunk-size requires layout = content",
+		"s3://bucket/prefix\naudit = yes":                                      ".qfs/repo:2: audit must be repository or local",
+		"s3://bucket/prefix\nobject-lock-mode = strict":                        ".qfs/repo:2: object-lock-mode must be governance or compliance",
+		"s3://bucket/prefix\nobject-lock-retain = 0d":                          ".qfs/repo:2: object-lock-retain must be a number followed by h, d, or w",
+		"s3://bucket/prefix\nlegal-hold = maybe":                               ".qfs/repo:2: legal-hold must be true or false",
+		"s3://bucket/prefix\nobject-lock-mode = compliance":                    ".qfs/repo: object-lock-mode and object-lock-retain must be given together",
+		"s3://bucket/prefix\nprofile = nobody":                                 "nobody",
+		"s3://bucket/prefix\nexternal-id = x":                                  ".qfs/repo: external-id, role-session-name, and sts-endpoint require role-arn",
+		"s3://bucket/prefix\nkeyring = yes":                                    ".qfs/repo:2: keyring must be true or false",
+		"s3://bucket/prefix\nkeyring = true":                                   ".qfs/repo: keyring requires endpoint",
+		"s3://bucket/prefix\nkeyring = true\nendpoint = http://x\nprofile = p": ".qfs/repo: keyring can't be used with profile or sso-start-url",
+		"s3://bucket/prefix\nsso-start-url = x":                                ".qfs/repo: sso-start-url, sso-account-id, sso-role-name, and sso-region",
+		"s3://bucket/prefix\nprofile = p\nsso-start-url = https://x\nsso-account-id = 1\nsso-role-name = r\nregion = r": ".qfs/repo: profile can't be used with sso-start-url",
+	} {
+		writeRepo(config)
+		err = qfs.Run([]string{"qfs", "status", "-top", tmp})
+		if err == nil || !strings.Contains(err.Error(), expErr) {
+			t.Errorf("%q: wrong error: %v", config, err)
+		}
+	}
+
+	// Without -top, the site is found from a subdirectory, here given with -C.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = os.Chdir(cwd) }()
+	if err = os.MkdirAll(j("a/b"), 0o777); err != nil {
+		t.Fatal(err.Error())
+	}
+	writeRepo("s3://qfs-test-bucket/home\nendpoint = " + server.URL +
+		"\nregion = us-west-2\npath-style = true\nprofile = test-profile\n")
+	requests = nil
+	err = qfs.Run([]string{"qfs", "-C", j("a/b"), "status"})
+	if err == nil {
+		t.Errorf("status succeeded with no repository")
+	}
+	if len(requests) == 0 {
+		t.Errorf("wrong requests: %v", requests)
+	}
+	// The original directory is restored when Run returns.
+	if dir, _ := os.Getwd(); dir != cwd {
+		t.Errorf("directory wasn't restored: %s", dir)
+	}
+	err = qfs.Run([]string{"qfs", "-C", j("nope"), "status"})
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	if err := os.Mkdir(j(".qfs"), 0o777); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	// The server denies all writes.
+	var puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			puts++
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	config := "s3://qfs-test-bucket/home\nendpoint = " + server.URL +
+		"\nregion = us-east-1\npath-style = true\n"
+	if err := os.WriteFile(j(".qfs/repo"), []byte(config), 0o666); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Push reports a denied write before doing anything else.
+	err := qfs.Run([]string{"qfs", "push", "-top", tmp})
+	if err == nil || !strings.Contains(err.Error(), "this site is read-only") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if puts != 1 {
+		t.Errorf("wrong number of writes: %d", puts)
+	}
+
+	// With the marker, nothing is attempted.
+	puts = 0
+	if err = os.WriteFile(j(".qfs/readonly"), nil, 0o666); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, args := range [][]string{
+		{"push"},
+		{"push-db"},
+		{"init-repo"},
+		{"apply-retention"},
+		{"remove-site", "other"},
+		{"fsck-repo", "-repair"},
+	} {
+		err = qfs.Run(append(append([]string{"qfs"}, args...), "-top", tmp))
+		if !errors.Is(err, repo.ErrReadOnly) {
+			t.Errorf("%v: wrong error: %v", args, err)
+		}
+	}
+	if puts != 0 {
+		t.Errorf("wrong number of writes: %d", puts)
+	}
+
+	stdout, _ := testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "readonly-policy", "-top", tmp})
+	})
+	testutil.Check(t, err)
+	var policy struct {
+		Statement []struct {
+			Action    []string
+			Resource  string
+			Condition map[string]map[string]string
+		}
+	}
+	testutil.Check(t, json.Unmarshal(stdout, &policy))
+	if len(policy.Statement) != 2 ||
+		policy.Statement[0].Resource != "arn:aws:s3:::qfs-test-bucket" ||
+		policy.Statement[0].Condition["StringLike"]["s3:prefix"] != "home/*" ||
+		policy.Statement[1].Resource != "arn:aws:s3:::qfs-test-bucket/home/*" {
+		t.Errorf("wrong policy:\n%s", stdout)
+	}
+	for _, st := range policy.Statement {
+		for _, action := range st.Action {
+			if strings.Contains(action, "Put") || strings.Contains(action, "Delete") {
+				t.Errorf("policy allows %s", action)
+			}
+		}
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	write := func(path, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(j(path)), 0o777); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(j(path), []byte(data), 0o666); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(j(path))
+		return err == nil
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The repository is empty.
+		w.Header().Set("Content-Type", "application/xml")
+		if r.URL.Query().Has("list-type") {
+			_, _ = fmt.Fprint(w, "<ListBucketResult></ListBucketResult>")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+	}))
+	defer server.Close()
+	doctor := func(args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			err = qfs.Run(append([]string{"qfs", "doctor", "-top", tmp}, args...))
+		})
+		return string(stdout), err
+	}
+
+	err := qfs.Run([]string{"qfs", "doctor", "-top", j("nope")})
+	if err == nil {
+		t.Errorf("no error for missing .qfs")
+	}
+
+	write(".qfs/repo", "s3://qfs-test-bucket/home\nendpoint = "+server.URL+"\nregion = us-east-1\npath-style = true\n")
+	write(".qfs/site", "repo\n")
+	write(".qfs/config", "potato = 1\n")
+	write(".qfs/db/repo", "garbage")
+	write(".qfs/db/.repo.1234.tmp", "")
+	write(".qfs/trash/.x.1234.tmp", "")
+	write(".qfs/push", "add x")
+	stdout, err := doctor("-n")
+	if err == nil || err.Error() != "6 problem(s) found" {
+		t.Errorf("wrong error: %v", err)
+	}
+	for _, exp := range []string{
+		"problem: " + j(".qfs/config") + ":1: unknown option \"potato\"",
+		"problem: .qfs/site: \"repo\" is not a valid site name",
+		"problem: .qfs/db/repo can't be read",
+		"problem: .qfs/push is truncated",
+		"problem: leftover temporary file .qfs/db/.repo.1234.tmp",
+		"problem: s3://qfs-test-bucket/home has not been initialized",
+	} {
+		if !strings.Contains(stdout, exp) {
+			t.Errorf("missing %q in output:\n%s", exp, stdout)
+		}
+	}
+	if strings.Contains(stdout, "trash") || strings.Contains(stdout, "prompt:") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+
+	// Accept two of the three offered repairs.
+	write(".qfs/site", "test\n")
+	write(".qfs/config", "[push]\ncleanup = true\n")
+	misc.TestPromptChannel = make(chan string, 3)
+	defer func() {
+		misc.TestPromptChannel = nil
+	}()
+	misc.TestPromptChannel <- "y"
+	misc.TestPromptChannel <- "n"
+	misc.TestPromptChannel <- "y"
+	stdout, err = doctor()
+	if err == nil || err.Error() != "2 problem(s) found" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if !strings.Contains(stdout, "note: .qfs/db/test doesn't exist") ||
+		!strings.Contains(stdout, "prompt: remove .qfs/db/repo?") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	if exists(".qfs/db/repo") || !exists(".qfs/push") || exists(".qfs/db/.repo.1234.tmp") ||
+		!exists(".qfs/trash/.x.1234.tmp") {
+		t.Errorf("wrong files removed")
+	}
+}
+
+func TestBundle(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	write := func(path, data string, modTime int64) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(j(path)), 0o777); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(j(path), []byte(data), 0o644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Chtimes(j(path), time.Time{}, time.UnixMilli(modTime)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	read := func(path string) string {
+		data, _ := os.ReadFile(j(path))
+		return string(data)
+	}
+	bundle := func(args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			err = qfs.Run(append([]string{"qfs", "bundle"}, args...))
+		})
+		return string(stdout), err
+	}
+	for _, site := range []string{"site1", "site2"} {
+		write(site+"/.qfs/site", site+"\n", 1000)
+		write(site+"/.qfs/filters/repo", ":junk:~$\n", 1000)
+		write(site+"/.qfs/filters/site1", "", 1000)
+		write(site+"/.qfs/filters/site2", ":exclude:\nskip\n", 1000)
+	}
+	write("site1/a/one", "one", 1_700_000_000_123)
+	write("site1/a/two", "two", 1_700_000_000_456)
+	write("site1/skip/x", "x", 1_700_000_000_789)
+	write("site1/one~", "junk", 1_700_000_000_789)
+	if err := os.Symlink("a/one", j("site1/link")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err := bundle("create")
+	if err == nil || err.Error() != "bundle requires create or apply and a bundle file" {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = bundle("apply", "-top", j("site2"), j("nope"))
+	if err == nil || !strings.Contains(err.Error(), "not a valid bundle") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// Without a local copy of the repository database, everything is bundled.
+	stdout, err := bundle("create", "-top", j("site1"), j("b1.tar.gz"))
+	testutil.Check(t, err)
+	if !strings.Contains(stdout, "no local copy of repository database") ||
+		!strings.Contains(stdout, "add skip/x") || strings.Contains(stdout, "one~") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	stdout, err = bundle("apply", "-top", j("site2"), "-n", j("b1.tar.gz"))
+	testutil.Check(t, err)
+	if !strings.Contains(stdout, "applying changes from site site1") ||
+		!strings.Contains(stdout, "add a/one") || strings.Contains(stdout, "skip") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	if _, err := os.Stat(j("site2/a")); err == nil {
+		t.Errorf("-n modified the site")
+	}
+	misc.TestPromptChannel = make(chan string, 2)
+	defer func() {
+		misc.TestPromptChannel = nil
+	}()
+	misc.TestPromptChannel <- "y"
+	_, err = bundle("apply", "-top", j("site2"), j("b1.tar.gz"))
+	testutil.Check(t, err)
+	if read("site2/a/one") != "one" || read("site2/a/two") != "two" || read("site2/skip/x") != "" {
+		t.Errorf("wrong files after apply")
+	}
+	if st, err := os.Stat(j("site2/a/one")); err != nil || st.ModTime().UnixMilli() != 1_700_000_000_123 {
+		t.Errorf("wrong modification time: %v", err)
+	}
+	if target, err := os.Readlink(j("site2/link")); err != nil || target != "a/one" {
+		t.Errorf("wrong link: %s, %v", target, err)
+	}
+
+	// Record site1's current state as its local copy of the repository database,
+	// as if it had pushed, and bundle subsequent changes.
+	_, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "scan", j("site1"), "-db", j("repo.db")})
+	})
+	testutil.Check(t, err)
+	testutil.Check(t, os.MkdirAll(j("site1/.qfs/db"), 0o777))
+	testutil.Check(t, os.Rename(j("repo.db"), j("site1/.qfs/db/repo")))
+	write("site1/a/one", "ONE", 1_700_000_001_000)
+	testutil.Check(t, os.Remove(j("site1/a/two")))
+	stdout, err = bundle("create", "-top", j("site1"), j("b2.tar.gz"))
+	testutil.Check(t, err)
+	if !strings.Contains(stdout, "change a/one") || !strings.Contains(stdout, "rm a/two") ||
+		strings.Contains(stdout, "link") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+
+	// A local change to a/one is a conflict.
+	write("site2/a/one", "local", 1_700_000_000_999)
+	_, err = bundle("apply", "-top", j("site2"), "-n", j("b2.tar.gz"))
+	if err == nil || err.Error() != "conflicts detected" {
+		t.Errorf("wrong error: %v", err)
+	}
+	misc.TestPromptChannel <- "n"
+	misc.TestPromptChannel <- "y"
+	stdout, err = bundle("apply", "-top", j("site2"), "-trash", j("b2.tar.gz"))
+	testutil.Check(t, err)
+	if !strings.Contains(stdout, "overriding conflicts") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	if read("site2/a/one") != "ONE" {
+		t.Errorf("a/one wasn't changed")
+	}
+	if _, err := os.Stat(j("site2/a/two")); err == nil {
+		t.Errorf("a/two wasn't removed")
+	}
+	trashed, _ := filepath.Glob(j("site2/.qfs/trash/*/a/one"))
+	if len(trashed) != 1 {
+		t.Errorf("local a/one wasn't moved to trash")
+	}
+}
+
+func TestDb(t *testing.T) {
+	oldLocal := time.Local
+	defer func() {
+		time.Local = oldLocal
+	}()
+	time.Local, _ = time.LoadLocation("EST5EDT")
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	run := func(args ...string) string {
+		t.Helper()
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			err = qfs.Run(append([]string{"qfs"}, args...))
+		})
+		testutil.Check(t, err)
+		return string(stdout)
+	}
+
+	stdout := run("db", "info", "testdata/all-types.qfs")
+	for _, line := range []string{
+		"format: QFS 1\n",
+		"entries: 15\n",
+		"  files: 3\n",
+		"  directories: 4\n",
+		"total file size: 433\n",
+		"largest file: .zshrc (191)\n",
+		"oldest modification time: 2000-09-04_12:04:31.000\n",
+		"newest modification time: 2024-04-20_16:02:56.786\n",
+	} {
+		if !strings.Contains(stdout, line) {
+			t.Errorf("missing %q in\n%s", line, stdout)
+		}
+	}
+
+	// Filtering keeps the input's format unless -binary is given.
+	run("db", "filter", "-prune", "other", "-o", j("filtered.db"), "testdata/all-types.qfs")
+	stdout = run("db", "info", j("filtered.db"))
+	if !strings.Contains(stdout, "format: QFS 1\n") || !strings.Contains(stdout, "entries: 10\n") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	run("db", "filter", "-binary", "-include", "other", "-o", j("other.db"), "testdata/all-types.qfs")
+	stdout = run("db", "info", j("other.db"))
+	if !strings.Contains(stdout, "format: QFS 2\n") || !strings.Contains(stdout, "entries: 6\n") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+
+	// Merging the pieces restores the original.
+	run("db", "merge", "-o", j("merged.db"), j("filtered.db"), j("other.db"))
+	orig, err := database.LoadFile("testdata/all-types.qfs")
+	testutil.Check(t, err)
+	merged, err := database.LoadFile(j("merged.db"))
+	testutil.Check(t, err)
+	if !reflect.DeepEqual(orig, merged) {
+		t.Error("merged database differs from original")
+	}
+
+	// -quick shows the counts from the header, which only newer databases have.
+	stdout = run("db", "info", "-quick", j("merged.db"))
+	for _, line := range []string{"format: QFS 1\n", "entries: 15\n", "total file size: 433\n"} {
+		if !strings.Contains(stdout, line) {
+			t.Errorf("missing %q in\n%s", line, stdout)
+		}
+	}
+	err = qfs.Run([]string{"qfs", "db", "info", "-quick", "testdata/all-types.qfs"})
+	if err == nil || !strings.Contains(err.Error(), "doesn't record counts in its header") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	for _, path := range []string{"a/file~", "a/keep", "build/x.o", "build/y.o"} {
+		testutil.Check(t, os.MkdirAll(filepath.Dir(j(path)), 0o777))
+		testutil.Check(t, os.WriteFile(j(path), []byte("12345"), 0o666))
+	}
+	cleanup, checkMessages := testutil.CaptureMessages()
+	defer cleanup()
+	run := func(args ...string) string {
+		t.Helper()
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			err = qfs.Run(append([]string{"qfs", "clean", "-junk", "~$", "-prune", "build"}, args...))
+		})
+		testutil.Check(t, err)
+		return string(stdout)
+	}
+	run("-n", tmp)
+	checkMessages(t, []string{
+		"would remove a/file~",
+		"would remove 1 junk file(s) (5)",
+	})
+	if _, err := os.Stat(j("a/file~")); err != nil {
+		t.Errorf("junk removed with -n: %v", err)
+	}
+	stdout := run("-pruned", tmp)
+	checkMessages(t, []string{
+		"removing a/file~",
+		"removed 1 junk file(s) (5)",
+	})
+	if _, err := os.Stat(j("a/file~")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("junk not removed: %v", err)
+	}
+	for _, line := range []string{"      10        2  build\n", "      10        2  total\n"} {
+		if !strings.Contains(stdout, line) {
+			t.Errorf("missing %q in\n%s", line, stdout)
+		}
+	}
+}
+
+func TestCLI(t *testing.T) {
+	checkCli := func(cmd []string, expErr string) {
+		var err error
+		stdout, stderr := testutil.WithStdout(func() {
+			err = qfs.Run(cmd)
+		})
+		if err == nil {
+			t.Errorf("no error")
+		} else if !strings.Contains(err.Error(), expErr) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if len(stdout) > 0 || len(stderr) > 0 {
+			t.Errorf("stdout=%s, stderr=%s", stdout, stderr)
+		}
+	}
+	checkCli(nil, "no arguments provided")
+	checkCli([]string{"qfs"}, "run qfs --help for help")
+	checkCli([]string{"qfs", "scan"}, "scan requires an input")
+	checkCli([]string{"qfs", "scan", "a", "a"}, "an input has already been specified")
+	checkCli([]string{"qfs", "diff", "a"}, "diff requires two inputs")
+	checkCli([]string{"qfs", "diff", "a", "a", "a"}, "inputs have already been specified")
+	checkCli([]string{"qfs", "scan", "-db"}, "db requires an argument")
+	checkCli([]string{"qfs", "scan", "-include"}, "include requires an argument")
+	checkCli([]string{"qfs", "scan", "-exclude-from"}, "exclude-from requires an argument")
+	checkCli([]string{"qfs", "scan", "-include-from", "testdata/bad-include-list"}, "testdata/bad-include-list:2: regexp error")
+	checkCli([]string{"qfs", "scan", "-filter"}, "filter requires an argument")
+	checkCli([]string{"qfs", "potato"}, "unknown subcommand")
+	checkCli([]string{"qfs", "scan", "-potato"}, "unknown option")
+	checkCli([]string{"qfs", "scan", "-junk", "??*"}, "regexp error on ??*")
+	checkCli([]string{"qfs", "scan", "-filter", "testdata/bad-filter"}, "testdata/bad-filter:1: regexp error")
+	checkCli([]string{"qfs", "init-repo", "x"}, "unexpected positional argument \"x\"")
+	checkCli([]string{"qfs", "init-repo", "-top"}, "top requires an argument")
+	checkCli([]string{"qfs", "init-repo", "-n"}, "-n and -report require -migrate")
+	checkCli([]string{"qfs", "init-repo", "-clean-repo", "-report", "r.json"}, "-n and -report require -migrate")
+	checkCli([]string{"qfs", "replicate"}, "replicate requires -dest")
+	checkCli([]string{"qfs", "replicate", "-dest"}, "dest requires an argument")
+	checkCli([]string{"qfs", "pull", "-chown-map"}, "chown-map requires an argument")
+	checkCli([]string{"qfs", "pull", "-owners", "-chown-map", "1000"}, "1000: id map must be old:new")
+	checkCli([]string{"qfs", "get", "-owners", "-chgrp-map", "1000:x", "a", "b"}, "1000:x: invalid id \"x\"")
+	checkCli([]string{"qfs", "sync", "-chown-map", "1000:1001", "a", "b"}, "-numeric-ids, -chown-map, and -chgrp-map require -owners")
+	checkCli([]string{"qfs", "pull", "-numeric-ids"}, "-numeric-ids, -chown-map, and -chgrp-map require -owners")
+	checkCli([]string{"qfs", "sync", "-symlinks", "hardlink", "a", "b"}, "symbolic link mode must be create, skip, copy, or follow")
+	checkCli([]string{"qfs", "pull", "-schedule", "smallest"}, "schedule must be diff, largest, or interleave")
+	checkCli([]string{"qfs", "status", "-offline", "-gateway", "https://example.com"}, "-offline can't be used with -gateway")
+	checkCli([]string{"qfs", "diff", "-modify-window", "-1", "a", "b"}, "modify-window: window must be a non-negative number of seconds")
+	checkCli([]string{"qfs", "sync", "-rewrite", "docs", "a", "b"}, "rewrite: path rules must have the form")
+	checkCli([]string{"qfs", "quota", "-size", "0"}, "size: size must be a positive number of bytes")
+	checkCli([]string{"qfs", "quota", "-objects", "many"}, "objects: count must be a positive number")
+	checkCli([]string{"qfs", "quota", "-remove", "-size", "1G"}, "quota -remove can't be used with other options")
+	checkCli([]string{"qfs", "quota", "-warn"}, "quota -warn requires -size or -objects")
+	checkCli([]string{"qfs", "copy-site", "site1"}, "copy-site requires an old site name and a new site name")
+	checkCli([]string{"qfs", "export-tar", "dir"}, "export-tar requires -o")
+	checkCli([]string{"qfs", "get", "-stdout", "a", "b"}, "get -stdout requires only a path")
+	checkCli([]string{"qfs", "diff-versions", "-to", "2024-06-01"}, "diff-versions requires -from")
+	checkCli([]string{"qfs", "list-versions", "-diff-tool", "meld", "a"}, "-diff-tool requires -diff")
+	checkCli([]string{"qfs", "list-versions", "-diff", "2", "-long", "a"}, "-as-of, -long, and -show-site can't be used with -diff")
+	checkCli([]string{"qfs", "remove-site"}, "remove-site requires a site name")
+	checkCli([]string{"qfs", "set-retention"}, "set-retention requires a policy file")
+	checkCli([]string{"qfs", "get", "-stdout", "-owners", "a"}, "-owners can't be used with -stdout")
+	checkCli([]string{"qfs", "get", "-version-id"}, "version-id requires an argument")
+	checkCli([]string{"qfs", "get", "-version-id", "v1", "-deleted-only", "a", "b"}, "-version-id can't be used with -as-of or -deleted-only")
+	checkCli([]string{"qfs", "get", "-version-id", "v1", "-as-of", "2024-06-01", "a", "b"}, "-version-id can't be used with -as-of or -deleted-only")
+	checkCli([]string{"qfs", "du", "a", "b"}, "at argument \"b\": an input has already been specified")
+	checkCli([]string{"qfs", "apply-plan"}, "apply-plan requires a plan file")
+	checkCli([]string{"qfs", "pull", "-merge", "-plan", "x"}, "-plan can't be used with -merge")
+	checkCli([]string{"qfs", "push", "-max-transfer", "ten"}, "max-transfer: invalid size \"ten\"")
+	checkCli([]string{"qfs", "serve"}, "serve requires -socket")
+	checkCli([]string{"qfs", "completion", "tcsh"}, "completion requires bash, zsh, or fish")
+	checkCli([]string{"qfs", "clone", "s3://bucket/prefix", "dir"}, "clone requires -site, a repository location, and a directory")
+	checkCli([]string{"qfs", "db", "list", "a"}, "db requires info, merge, or filter")
+	checkCli([]string{"qfs", "db", "info", "a", "b"}, "db info requires one database")
+	checkCli([]string{"qfs", "db", "merge", "-o", "c", "a"}, "db merge requires at least two databases and -o")
+	checkCli([]string{"qfs", "db", "filter", "-o", "b", "a"}, "db filter requires at least one filter")
+	checkCli([]string{"qfs", "db", "merge", "-quick", "-o", "c", "a", "b"}, "-quick can only be used with db info")
+	checkCli([]string{"qfs", "protect", "maybe"}, "protect requires on, off, or nothing")
+	checkCli([]string{"qfs", "apply-retention", "-mfa", "123456"}, "MFA must be given as \"serial code\"")
+	checkCli([]string{"qfs", "db", "info", "-quick", "-prune", "x", "a"}, "-quick can't be used with filters")
+}
+
+func TestHelpVersion(t *testing.T) {
+	cases := map[string]string{
+		"--version": "qfs version ",
+		"--help":    "qfs subcommand [options]",
+	}
+	for arg, text := range cases {
+		t.Run(arg, func(t *testing.T) {
+			stdout, stderr := testutil.WithStdout(func() {
+				defer func() {
+					_ = recover()
+				}()
+				testutil.Check(t, qfs.Run([]string{"qfs", arg}))
+			})
+			if !strings.Contains(string(stdout), text) {
+				t.Errorf("didn't see expected text")
+			}
+			if len(stderr) > 0 {
+				t.Errorf("stderr: %s", stderr)
+			}
+
+		})
+	}
+}
+
+func TestSubcommandHelp(t *testing.T) {
+	stdout, _ := testutil.WithStdout(func() {
+		defer func() {
+			_ = recover()
+		}()
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "--help"}))
+	})
+	out := string(stdout)
+	if !strings.Contains(out, "qfs push {path ...} [options]") ||
+		!strings.Contains(out, "push examples:\n  # show what would be pushed without pushing it\n  qfs push -n\n") ||
+		strings.Contains(out, "pull options:") {
+		t.Errorf("wrong help:\n%s", out)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	completion := func(shell string) string {
+		t.Helper()
+		stdout, _ := testutil.WithStdout(func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "completion", shell}))
+		})
+		return string(stdout)
+	}
+	bash := completion("bash")
+	for _, exp := range []string{
+		"\n                fsck-repo) words=\"-confirm-token -help -mfa -repair -top\";;\n",
+		"words=\"$(qfs completion sites 2>/dev/null)\"",
+		"complete -o filenames -F _qfs qfs\n",
+	} {
+		if !strings.Contains(bash, exp) {
+			t.Errorf("bash completion doesn't contain %q", exp)
+		}
+	}
+	if zsh := completion("zsh"); !strings.HasPrefix(zsh, "#compdef qfs\n") || !strings.HasSuffix(zsh, bash) {
+		t.Errorf("wrong zsh completion:\n%s", zsh)
+	}
+	fish := completion("fish")
+	for _, exp := range []string{
+		"complete -c qfs -n __fish_use_subcommand -a push -d 'Push changes from the local site to the repository'\n",
+		"complete -c qfs -n '__fish_seen_subcommand_from fsck-repo' -o repair -d 'remove stale keys and rebuild the repository database'\n",
+		"complete -c qfs -n '__fish_seen_subcommand_from scan' -F\n",
+	} {
+		if !strings.Contains(fish, exp) {
+			t.Errorf("fish completion doesn't contain %q", exp)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	// Unix domain socket paths are limited in length, so don't use t.TempDir.
+	tmp, err := os.MkdirTemp("", "qfs-serve")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	dir := j("dir")
+	if err = os.MkdirAll(j("dir/sub"), 0o755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, f := range []string{"dir/a", "dir/sub/b", "dir/junk~"} {
+		if err = os.WriteFile(j(f), []byte(f), 0o644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	testutil.Check(t, qfs.Run([]string{"qfs", "scan", "-db", j("db"), "-junk", "~$", dir}))
+
+	// As in TestGateway, standard output is captured once so that it isn't
+	// swapped while the server is running.
+	_, _ = testutil.WithStdout(func() {
+		testServe(t, j, dir)
+	})
+}
+
+func testServe(t *testing.T, j func(string) string, dir string) {
+	socket := j("sock")
+	done := make(chan error, 1)
+	go func() {
+		done <- qfs.Run([]string{"qfs", "serve", "-socket", socket, "-junk", "~$"})
+	}()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	responses := bufio.NewScanner(conn)
+	request := func(req string) map[string]any {
+		t.Helper()
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if !responses.Scan() {
+			t.Fatalf("no response: %v", responses.Err())
+		}
+		response := map[string]any{}
+		if err := json.Unmarshal(responses.Bytes(), &response); err != nil {
+			t.Fatal(err.Error())
+		}
+		return response
+	}
+
+	// A second server can't use the same socket.
+	err = qfs.Run([]string{"qfs", "serve", "-socket", socket})
+	if err == nil || !strings.Contains(err.Error(), "another server is listening") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	r := request(`{"id": 1, "op": "scan", "input": "` + dir + `"}`)
+	files, _ := r["files"].([]any)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.(map[string]any)["path"].(string))
+	}
+	if r["id"] != 1.0 || !slices.Equal(paths, []string{".", "a", "sub", "sub/b"}) {
+		t.Errorf("wrong scan response: %v", r)
+	}
+	r = request(`{"op": "diff", "input": "` + j("db") + `", "input2": "` + dir + `"}`)
+	if r["changes"] != 0.0 || r["diff"] != nil {
+		t.Errorf("wrong diff response: %v", r)
+	}
+	// The database is cached, so only the directory is scanned again.
+	if err = os.WriteFile(j("dir/c"), []byte("c"), 0o644); err != nil {
+		t.Fatal(err.Error())
+	}
+	r = request(`{"op": "diff", "input": "` + j("db") + `", "input2": "` + dir + `"}`)
+	if r["changes"] != 1.0 || fmt.Sprint(r["diff"]) != "[add c]" {
+		t.Errorf("wrong diff response: %v", r)
+	}
+	r = request(`{"id": "x", "op": "diff", "input": "` + j("db") + `"}`)
+	if r["id"] != "x" || r["error"] != "diff requires input and input2" {
+		t.Errorf("wrong error response: %v", r)
+	}
+	r = request(`{"op": "potato"}`)
+	if !strings.HasPrefix(r["error"].(string), "unknown op") {
+		t.Errorf("wrong error response: %v", r)
+	}
+	r = request(`not json`)
+	if !strings.HasPrefix(r["error"].(string), "invalid request") {
+		t.Errorf("wrong error response: %v", r)
+	}
+
+	// The server stops cleanly when interrupted.
+	self, _ := os.FindProcess(os.Getpid())
+	testutil.Check(t, self.Signal(syscall.SIGTERM))
+	select {
+	case err = <-done:
+		testutil.Check(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't stop")
+	}
+	_ = conn.Close()
+}
+
+func TestTimeout(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	if err := os.Mkdir(j(".qfs"), 0o777); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	// The server never answers, like a stuck connection.
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer server.Close()
+	defer close(stop)
+	config := "s3://qfs-test-bucket/home\nendpoint = " + server.URL +
+		"\nregion = us-east-1\npath-style = true\n"
+	if err := os.WriteFile(j(".qfs/repo"), []byte(config), 0o666); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(j(".qfs/site"), []byte("site\n"), 0o666); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, args := range [][]string{
+		{"pull"},
+		{"get", "a", j("a")},
+		{"list-versions", "a"},
+	} {
+		start := time.Now()
+		err := qfs.Run(append(append([]string{"qfs"}, args...), "-timeout", "200ms", "-top", tmp))
+		if err == nil || !strings.HasPrefix(err.Error(), "timed out after 200ms: ") {
+			t.Errorf("%v: wrong error: %v", args, err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%v: took too long: %s", args, elapsed)
+		}
+	}
+
+	for arg, exp := range map[string]string{
+		"potato": `timeout: time: invalid duration "potato"`,
+		"-1s":    "timeout: duration must be positive",
+	} {
+		err := qfs.Run([]string{"qfs", "pull", "-timeout", arg, "-top", tmp})
+		if err == nil || err.Error() != exp {
+			t.Errorf("%s: wrong error: %v", arg, err)
+		}
+	}
+	err := qfs.Run([]string{"qfs", "status", "-timeout", "1s", "-top", tmp})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	if err := os.Mkdir(j(".qfs"), 0o777); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	// The repository's S3 service rejects everything.
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer s3Server.Close()
+	config := "s3://qfs-test-bucket/home\nendpoint = " + s3Server.URL +
+		"\nregion = us-east-1\npath-style = true\nretry-attempts = 1\n"
+	if err := os.WriteFile(j(".qfs/repo"), []byte(config), 0o666); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(j(".qfs/site"), []byte("site\n"), 0o666); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Setenv("QFS_GATEWAY_TOKEN", "")
+	err := qfs.Run([]string{"qfs", "gateway", "-listen", "localhost:0", "-top", tmp})
+	if err == nil || err.Error() != "gateway requires QFS_GATEWAY_TOKEN to be set" {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = qfs.Run([]string{"qfs", "gateway", "-listen", "localhost:0", "-cert", "x", "-top", tmp})
+	if err == nil || err.Error() != "-cert and -key must be given together" {
+		t.Errorf("wrong error: %v", err)
+	}
+	t.Setenv("QFS_GATEWAY_TOKEN", "secret")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Check(t, err)
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	// Standard output is captured once around the whole exchange. The server and
+	// the client both write to it, so it must not be swapped while the server is
+	// running.
+	_, _ = testutil.WithStdout(func() {
+		testGateway(t, tmp, addr)
+	})
+}
+
+func testGateway(t *testing.T, tmp, addr string) {
+	done := make(chan error, 1)
+	go func() {
+		done <- qfs.Run([]string{"qfs", "gateway", "-listen", addr, "-top", tmp})
+	}()
+	base := "http://" + addr
+	request := func(path, token string) (int, map[string]any) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, base+path, nil)
+		testutil.Check(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		var resp *http.Response
+		for i := 0; i < 100; i++ {
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		testutil.Check(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		response := map[string]any{}
+		testutil.Check(t, json.NewDecoder(resp.Body).Decode(&response))
+		return resp.StatusCode, response
+	}
+	for _, token := range []string{"", "wrong"} {
+		code, r := request("/v1/status", token)
+		if code != http.StatusUnauthorized || r["error"] != "missing or invalid token" {
+			t.Errorf("%q: wrong response: %d %v", token, code, r)
+		}
+	}
+	code, r := request("/v1/versions?long=potato&path=x", "secret")
+	if code != http.StatusBadRequest || r["error"] != "long must be true or false" {
+		t.Errorf("wrong response: %d %v", code, r)
+	}
+	code, r = request("/v1/get", "secret")
+	if code != http.StatusBadRequest || r["error"] != "path is required" {
+		t.Errorf("wrong response: %d %v", code, r)
+	}
+	// Errors from the repository are passed back to the client.
+	err := qfs.Run([]string{"qfs", "status", "-gateway", base, "-top", tmp})
+	if err == nil || !strings.HasPrefix(err.Error(), "gateway: ") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// The server stops cleanly when interrupted.
+	self, _ := os.FindProcess(os.Getpid())
+	testutil.Check(t, self.Signal(syscall.SIGTERM))
+	select {
+	case err := <-done:
+		testutil.Check(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't stop")
+	}
+}
+
+func TestGatewayClient(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": "missing or invalid token"}`))
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+		switch r.URL.Path {
+		case "/v1/versions":
+			_, _ = w.Write([]byte(`{"messages": ["hello"], "output": "versions\n"}`))
+		case "/v1/get":
+			w.Header().Set("X-Qfs-Modtime", fmt.Sprint(mtime.UnixMilli()))
+			w.Header().Set("X-Qfs-Permissions", "0640")
+			_, _ = w.Write([]byte("contents"))
+		case "/v1/push":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"messages": ["checking"], "prompts": ["Ignore the expired lock?"], "error": "push failed"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("QFS_GATEWAY_TOKEN", "")
+	err := qfs.Run([]string{"qfs", "status", "-gateway", server.URL, "-top", tmp})
+	if err == nil || err.Error() != "-gateway requires QFS_GATEWAY_TOKEN to be set" {
+		t.Errorf("wrong error: %v", err)
+	}
+	t.Setenv("QFS_GATEWAY_TOKEN", "wrong")
+	err = qfs.Run([]string{"qfs", "status", "-gateway", server.URL, "-top", tmp})
+	if err == nil || err.Error() != "gateway: missing or invalid token" {
+		t.Errorf("wrong error: %v", err)
+	}
+	t.Setenv("QFS_GATEWAY_TOKEN", "secret")
+
+	stdout, _ := testutil.WithStdout(func() {
+		err = qfs.Run([]string{
+			"qfs", "list-versions", "-gateway", server.URL, "-long", "-as-of", "1717243200000", "notes", "-top", tmp,
+		})
+	})
+	testutil.Check(t, err)
+	// Messages are reported as if they came from the local site.
+	if !strings.HasSuffix(string(stdout), ": hello\nversions\n") {
+		t.Errorf("wrong output: %q", stdout)
+	}
+	stdout, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "get", "-gateway", server.URL, "-stdout", "notes/a", "-top", tmp})
+	})
+	testutil.Check(t, err)
+	if string(stdout) != "contents" {
+		t.Errorf("wrong output: %q", stdout)
+	}
+	_, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "get", "-gateway", server.URL, "notes/a", j("dest"), "-top", tmp})
+	})
+	testutil.Check(t, err)
+	st, err := os.Stat(j("dest/notes/a"))
+	testutil.Check(t, err)
+	if st.Size() != 8 || !st.ModTime().Equal(mtime) || st.Mode().Perm() != 0o640 {
+		t.Errorf("wrong file: %d %v %v", st.Size(), st.ModTime(), st.Mode())
+	}
+	err = qfs.Run([]string{"qfs", "get", "-gateway", server.URL, "notes/a", j("dest"), "-top", tmp})
+	if err == nil || !strings.HasSuffix(err.Error(), "must not exist") {
+		t.Errorf("wrong error: %v", err)
+	}
+	stdout, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "push", "-gateway", server.URL, "-n", "src", "-top", tmp})
+	})
+	if err == nil || err.Error() != "gateway: push failed" || !strings.Contains(string(stdout), "checking") ||
+		!strings.Contains(string(stdout), "gateway answered no: Ignore the expired lock?") {
+		t.Errorf("wrong error: %v %q", err, stdout)
+	}
+	if !slices.Equal(requests, []string{
+		"GET /v1/versions?as-of=1717243200000&long=true&path=notes",
+		"GET /v1/get?path=notes%2Fa",
+		"GET /v1/get?path=notes%2Fa",
+		"POST /v1/push?n=true&path=src",
+	}) {
+		t.Errorf("wrong requests: %q", requests)
+	}
+
+	for _, args := range [][]string{
+		{"push", "-gateway", server.URL, "-owners"},
+		{"list-versions", "-gateway", server.URL, "-exclude", "x", "notes"},
+	} {
+		err = qfs.Run(append(append([]string{"qfs"}, args...), "-top", tmp))
+		if err == nil || !strings.HasSuffix(err.Error(), "can't be used with -gateway") {
+			t.Errorf("%v: wrong error: %v", args, err)
+		}
+	}
+	err = qfs.Run([]string{"qfs", "status", "-gateway", "localhost:8080", "-top", tmp})
+	if err == nil || err.Error() != "gateway: URL must start with http:// or https://" {
+		t.Errorf("wrong error: %v", err)
 	}
 }
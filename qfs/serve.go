@@ -0,0 +1,311 @@
+package qfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repo"
+	"github.com/jberkenbilt/qfs/scan"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// qfs serve answers scan, diff, and status requests over a Unix domain socket
+// so that editors and status bars can check for drift without starting qfs
+// each time. Each request is a single line of JSON, and each response is a
+// single line of JSON. Filters given on the command line are read once, and
+// databases read from files are kept in memory until the files change.
+
+// serveRequest is a request to qfs serve. ID, if given, is returned unchanged
+// in the response.
+type serveRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Op     string          `json:"op"`
+	Input  string          `json:"input,omitempty"`
+	Input2 string          `json:"input2,omitempty"`
+}
+
+type serveResponse struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Files   []*serveFile    `json:"files,omitempty"`
+	Diff    []string        `json:"diff,omitempty"`
+	Changes *int            `json:"changes,omitempty"`
+	Status  *serveStatus    `json:"status,omitempty"`
+}
+
+// serveFile is a file in a scan response. ModTime is in milliseconds since the
+// epoch, and Permissions is octal.
+type serveFile struct {
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	ModTime     int64  `json:"modTime"`
+	Size        int64  `json:"size"`
+	Permissions string `json:"permissions"`
+	Uid         int    `json:"uid"`
+	Gid         int    `json:"gid"`
+	Special     string `json:"special,omitempty"`
+}
+
+type serveStatus struct {
+	Site              string     `json:"site"`
+	Repository        string     `json:"repository"`
+	Lock              string     `json:"lock,omitempty"`
+	LockExpired       bool       `json:"lockExpired,omitempty"`
+	LastPush          *time.Time `json:"lastPush,omitempty"`
+	LastPull          *time.Time `json:"lastPull,omitempty"`
+	PushedSincePull   bool       `json:"pushedSincePull"`
+	Unpushed          int        `json:"unpushed"`
+	UnpushedConflicts []string   `json:"unpushedConflicts"`
+	Unpulled          int        `json:"unpulled"`
+	UnpulledConflicts []string   `json:"unpulledConflicts"`
+}
+
+// dbCache holds databases read from files. An entry is used as long as the
+// file's size and modification time are unchanged.
+type dbCache struct {
+	entries map[string]*dbCacheEntry
+}
+
+type dbCacheEntry struct {
+	size    int64
+	modTime time.Time
+	db      database.Database
+}
+
+func newDbCache() *dbCache {
+	return &dbCache{
+		entries: map[string]*dbCacheEntry{},
+	}
+}
+
+// load runs s, which scans input, unless input is a file whose database is
+// already cached. The same file may be read with different filters depending
+// on whether the repository is involved, so that is part of the cache key.
+func (c *dbCache) load(input string, repoInput bool, s *scan.Scan) (database.Database, error) {
+	if _, ok := scan.ProviderFor(input); ok {
+		return s.Run()
+	}
+	st, err := os.Stat(input)
+	if err != nil || st.IsDir() {
+		return s.Run()
+	}
+	key := fmt.Sprintf("%v:%s", repoInput, input)
+	if e := c.entries[key]; e != nil && e.size == st.Size() && e.modTime.Equal(st.ModTime()) {
+		return e.db, nil
+	}
+	db, err := s.Run()
+	if err != nil {
+		return nil, err
+	}
+	c.entries[key] = &dbCacheEntry{
+		size:    st.Size(),
+		modTime: st.ModTime(),
+		db:      db,
+	}
+	return db, nil
+}
+
+func (p *parser) doServe() error {
+	// A socket left behind by a server that is no longer running is removed. If
+	// another server is still listening, leave it alone.
+	if st, err := os.Lstat(p.socket); err == nil {
+		if st.Mode().Type() != fs.ModeSocket {
+			return fmt.Errorf("%s exists and is not a socket", p.socket)
+		}
+		if conn, err := net.Dial("unix", p.socket); err == nil {
+			_ = conn.Close()
+			return fmt.Errorf("another server is listening on %s", p.socket)
+		}
+		if err = os.Remove(p.socket); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	listener, err := net.Listen("unix", p.socket)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-p.ctx.Done()
+		_ = listener.Close()
+	}()
+	misc.Message("listening on %s", p.socket)
+
+	// Requests are handled one at a time since they share the cache and may
+	// scan the same files.
+	var mutex gosync.Mutex
+	var conns gosync.WaitGroup
+	cache := newDbCache()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			conns.Wait()
+			if p.ctx.Err() != nil {
+				return nil
+			}
+			// TEST: NOT COVERED
+			return err
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer func() { _ = conn.Close() }()
+			go func() {
+				// Stop waiting for requests on shutdown.
+				<-p.ctx.Done()
+				_ = conn.SetReadDeadline(time.Now())
+			}()
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				line := bytes.TrimSpace(scanner.Bytes())
+				if len(line) == 0 {
+					continue
+				}
+				mutex.Lock()
+				response := p.serveRequest(line, cache)
+				mutex.Unlock()
+				data, err := json.Marshal(response)
+				if err != nil {
+					// TEST: NOT COVERED
+					data, _ = json.Marshal(&serveResponse{ID: response.ID, Error: err.Error()})
+				}
+				if _, err = conn.Write(append(data, '\n')); err != nil {
+					// TEST: NOT COVERED
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (p *parser) serveRequest(line []byte, cache *dbCache) *serveResponse {
+	req := &serveRequest{}
+	if err := json.Unmarshal(line, req); err != nil {
+		return &serveResponse{Error: fmt.Sprintf("invalid request: %v", err)}
+	}
+	response := &serveResponse{ID: req.ID}
+	var err error
+	switch req.Op {
+	case "scan":
+		err = p.serveScan(req, cache, response)
+	case "diff":
+		err = p.serveDiff(req, cache, response)
+	case "status":
+		err = p.serveStatus(response)
+	default:
+		err = fmt.Errorf("unknown op \"%s\"; use scan, diff, or status", req.Op)
+	}
+	if err != nil {
+		return &serveResponse{ID: req.ID, Error: err.Error()}
+	}
+	return response
+}
+
+func (p *parser) serveScan(req *serveRequest, cache *dbCache, response *serveResponse) error {
+	if req.Input == "" {
+		return errors.New("scan requires input")
+	}
+	s, err := scan.New(
+		req.Input,
+		scan.WithFilters(p.filters),
+		scan.WithFilesOnly(p.filesOnly),
+		scan.WithNoSpecial(p.noSpecial),
+		scan.WithTop(p.top),
+		scan.WithContext(p.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED. scan.New never returns an error.
+		return err
+	}
+	files, err := cache.load(req.Input, false, s)
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	return files.ForEach(func(f *fileinfo.FileInfo) error {
+		response.Files = append(response.Files, &serveFile{
+			Path:        f.Path,
+			Type:        string(f.FileType),
+			ModTime:     f.ModTime.UnixMilli(),
+			Size:        f.Size,
+			Permissions: fmt.Sprintf("%04o", f.Permissions),
+			Uid:         f.Uid,
+			Gid:         f.Gid,
+			Special:     f.Special,
+		})
+		return nil
+	})
+}
+
+func (p *parser) serveDiff(req *serveRequest, cache *dbCache, response *serveResponse) error {
+	if req.Input == "" || req.Input2 == "" {
+		return errors.New("diff requires input and input2")
+	}
+	result, err := p.diffInputs(req.Input, req.Input2, cache)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if err = result.WriteDiff(&b, false); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line != "" {
+			response.Diff = append(response.Diff, line)
+		}
+	}
+	changes := result.NumChanges()
+	response.Changes = &changes
+	return nil
+}
+
+func (p *parser) serveStatus(response *serveResponse) error {
+	r, err := repo.New(
+		repo.WithLocalTop(p.top),
+		repo.WithS3Client(S3Client),
+		repo.WithKeyring(Keyring),
+		repo.WithContext(p.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	status, err := r.Status()
+	if err != nil {
+		return err
+	}
+	response.Status = newServeStatus(status)
+	return nil
+}
+
+func newServeStatus(status *repo.StatusResult) *serveStatus {
+	timeOrNil := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return &serveStatus{
+		Site:              status.Site,
+		Repository:        status.Repository,
+		Lock:              status.Lock,
+		LockExpired:       status.LockExpired,
+		LastPush:          timeOrNil(status.LastPush),
+		LastPull:          timeOrNil(status.LastPull),
+		PushedSincePull:   status.PushedSincePull,
+		Unpushed:          status.Unpushed.NumChanges(),
+		UnpushedConflicts: append([]string{}, status.UnpushedConflicts...),
+		Unpulled:          status.Unpulled.NumChanges(),
+		UnpulledConflicts: append([]string{}, status.UnpulledConflicts...),
+	}
+}
@@ -0,0 +1,244 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// An audit log records each operation that changes the repository: which
+// site, user, and host made the change, when, and how much changed. It is
+// enabled by `audit` in .qfs/repo. With `audit = repository`, each record is
+// stored as a separate object under .qfs/audit in the repository, so records
+// are never rewritten, and sites can't overwrite each other's records. With
+// `audit = local`, records are appended to .qfs/audit.log at the site.
+
+const (
+	auditRepository = "repository"
+	auditLocal      = "local"
+)
+
+// AuditRecord is one entry in the audit log.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Site      string    `json:"site"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	// Counts gives the number of things affected by the operation, such as
+	// files added or versions removed.
+	Counts map[string]int `json:"counts,omitempty"`
+	// RepoDbKey and RepoDbVersion identify the repository database uploaded by
+	// the operation, if any. RepoDbVersion is only known if the bucket has
+	// versioning enabled.
+	RepoDbKey     string `json:"repoDbKey,omitempty"`
+	RepoDbVersion string `json:"repoDbVersion,omitempty"`
+	// Note gives anything else needed to understand the operation.
+	Note string `json:"note,omitempty"`
+}
+
+// AuditConfig is passed to AuditLog.
+type AuditConfig struct {
+	// If Local is true, records are read from .qfs/audit.log instead of the
+	// repository.
+	Local bool
+}
+
+func (a *AuditRecord) String() string {
+	site := a.Site
+	if site == "" {
+		site = "(no site)"
+	}
+	s := fmt.Sprintf("%s %s %s %s@%s", misc.FormatTime(a.Time), a.Operation, site, a.User, a.Host)
+	for _, k := range misc.SortedKeys(a.Counts) {
+		s += fmt.Sprintf(" %s=%d", k, a.Counts[k])
+	}
+	if a.RepoDbVersion != "" {
+		s += " db-version=" + a.RepoDbVersion
+	} else if a.RepoDbKey != "" {
+		s += " db-key=" + a.RepoDbKey
+	}
+	if a.Note != "" {
+		s += " (" + a.Note + ")"
+	}
+	return s
+}
+
+// changeCounts gives the audit counts for the changes made by a push.
+func changeCounts(diffResult *diff.Result) map[string]int {
+	return map[string]int{
+		"added":    len(diffResult.Add),
+		"changed":  len(diffResult.Change),
+		"removed":  len(diffResult.Rm),
+		"renamed":  len(diffResult.Rename),
+		"metadata": len(diffResult.MetaChange),
+	}
+}
+
+func (r *Repo) auditPrefix() string {
+	return path.Join(r.prefix, repofiles.Audit) + "/"
+}
+
+// audit adds a record of an operation that changed the repository to the
+// audit log if the site has one. The repository database information comes
+// from the last one this operation loaded or uploaded.
+func (r *Repo) audit(operation, site string, counts map[string]int, note string) error {
+	if r.auditMode == "" {
+		return nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		// TEST: NOT COVERED
+		host = "unknown"
+	}
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	rec := &AuditRecord{
+		Time:      time.Now(),
+		Operation: operation,
+		Site:      site,
+		User:      username,
+		Host:      host,
+		Counts:    counts,
+		Note:      note,
+	}
+	if r.repoDbVersion != nil {
+		rec.RepoDbKey = r.repoDbVersion.key
+		rec.RepoDbVersion = r.repoDbVersion.versionId
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	data = append(data, '\n')
+	if r.auditMode == auditLocal {
+		f, err := os.OpenFile(
+			r.localPath(repofiles.AuditLog).Path(),
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0o644,
+		)
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("write audit record: %w", err)
+		}
+		_, err = f.Write(data)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("write audit record: %w", err)
+		}
+		return nil
+	}
+	// Keys sort by time. The site keeps records made at the same time by
+	// different sites apart.
+	name := rec.Time.UTC().Format("20060102T150405.000Z")
+	if site != "" {
+		name += "-" + site
+	}
+	_, err = r.s3Client.PutObject(r.ctx, &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.auditPrefix() + name),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("write audit record: %w", err)
+	}
+	return nil
+}
+
+// AuditLog returns the records in the audit log, oldest first.
+func (r *Repo) AuditLog(config *AuditConfig) ([]*AuditRecord, error) {
+	if config.Local {
+		return readLocalAuditLog(r.localPath(repofiles.AuditLog).Path())
+	}
+	var keys []string
+	prefix := r.auditPrefix()
+	paginator := s3.NewListObjectsV2Paginator(r.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &r.bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(r.ctx)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("list s3://%s/%s: %w", r.bucket, prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+	}
+	var result []*AuditRecord
+	for _, key := range keys {
+		output, err := r.s3Client.GetObject(r.ctx, &s3.GetObjectInput{
+			Bucket: &r.bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("read s3://%s/%s: %w", r.bucket, key, err)
+		}
+		data, err := io.ReadAll(output.Body)
+		_ = output.Body.Close()
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("read s3://%s/%s: %w", r.bucket, key, err)
+		}
+		rec := &AuditRecord{}
+		if err = json.Unmarshal(data, rec); err != nil {
+			return nil, fmt.Errorf("parse s3://%s/%s: %w", r.bucket, key, err)
+		}
+		result = append(result, rec)
+	}
+	return result, nil
+}
+
+func readLocalAuditLog(filename string) ([]*AuditRecord, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var result []*AuditRecord
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		rec := &AuditRecord{}
+		if err = json.Unmarshal([]byte(line), rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNo, err)
+		}
+		result = append(result, rec)
+	}
+	if err = scanner.Err(); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,341 @@
+package repo
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/gztar"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/sync"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A bundle carries the changes a push would make from one site to another
+// without going through the repository. It is a gzip-compressed tar file
+// containing a header, the creating site's local copy of the repository
+// database (the base), the creating site's current database, and the files that
+// were added or changed since the base. Both databases are restricted to the
+// creating site's filters. The receiving site computes the changes from the two
+// databases using its own filters, so it applies only what it would have
+// pulled.
+
+const (
+	bundleHeader = "QFS BUNDLE 1\n"
+	bundleInfo   = "qfs-bundle"
+	bundleBase   = "base.db"
+	bundleSite   = "site.db"
+	bundleFiles  = "files"
+)
+
+// BundleConfig is passed to ApplyBundle.
+type BundleConfig struct {
+	// NoOp shows the changes without applying them.
+	NoOp bool
+	// If BackupDir is given, files that would be removed or overwritten are moved
+	// into a timestamped subdirectory of it instead.
+	BackupDir string
+}
+
+// CreateBundle writes the changes that push would send to the repository to
+// filename. If the site has never pulled, the bundle contains all the files the
+// site's filters include. Neither the site nor the repository is modified.
+func CreateBundle(filename string, options ...Options) (*Result, error) {
+	r := newRepo(options)
+	site, err := r.currentSite()
+	if err != nil {
+		return nil, err
+	}
+	baseDb, err := r.loadLocalDb(repofiles.RepoDb(), database.WithRepoRules(true))
+	if errors.Is(err, fs.ErrNotExist) {
+		r.ui.Message("no local copy of repository database; bundling all files")
+		baseDb = database.Database{}
+	} else if errors.Is(err, database.ErrTruncated) {
+		return nil, fmt.Errorf("%w; run qfs pull to replace it", err)
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	localDb, err := r.scanLocalSite(site, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := r.localFilters(site, false)
+	if err != nil {
+		return nil, err
+	}
+	baseDb = filterDb(baseDb, filters)
+	localDb = filterDb(localDb, filters)
+	diffResult, err := makeDiff(nil).Run(baseDb, localDb)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	result := &Result{Changes: diffResult}
+	if diffResult.NumChanges() == 0 {
+		r.ui.Message("no changes to bundle")
+		return result, nil
+	}
+	r.ui.Message("----- changes in bundle -----")
+	_ = diffResult.WriteDiff(r.ui.Output(), false)
+	r.ui.Message("-----")
+
+	f, err := misc.CreateAtomic(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Discard()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = writeBundleData(tw, bundleInfo, []byte(bundleHeader+"site "+site+"\n"))
+	if err == nil {
+		err = writeBundleDb(tw, bundleBase, baseDb)
+	}
+	if err == nil {
+		err = writeBundleDb(tw, bundleSite, localDb)
+	}
+	for _, list := range [][]*fileinfo.FileInfo{diffResult.Add, diffResult.Change, diffResult.Relinks()} {
+		for _, info := range list {
+			if err == nil {
+				err = r.ctx.Err()
+			}
+			if err == nil {
+				err = r.writeBundleFile(tw, info)
+			}
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write %s: %w", filename, err)
+	}
+	if err = f.Commit(); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	r.ui.Message("wrote %s", filename)
+	return result, nil
+}
+
+// filterDb returns the entries of db that are included by filters.
+func filterDb(db database.Database, filters []*filter.Filter) database.Database {
+	result := database.Database{}
+	cache := filter.NewCache(true, filters...)
+	for path, info := range db {
+		if included, _ := cache.IsIncluded(path); included {
+			result[path] = info
+		}
+	}
+	return result
+}
+
+func writeBundleData(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeBundleDb(tw *tar.Writer, name string, db database.Database) error {
+	tmp, err := os.CreateTemp("", "qfs-bundle-*.db")
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if err = database.WriteDb(tmp.Name(), db, database.DbQfs); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return writeBundleData(tw, name, data)
+}
+
+// writeBundleFile adds a file, directory, or symbolic link from the local site
+// to the bundle with the modification time and permissions recorded in info.
+func (r *Repo) writeBundleFile(tw *tar.Writer, info *fileinfo.FileInfo) error {
+	h := &tar.Header{
+		Name:    bundleFiles + "/" + info.Path,
+		Mode:    int64(info.Permissions),
+		ModTime: info.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	switch info.FileType {
+	case fileinfo.TypeFile:
+		h.Typeflag = tar.TypeReg
+		h.Size = info.Size
+	case fileinfo.TypeDirectory:
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+	case fileinfo.TypeLink:
+		h.Typeflag = tar.TypeSymlink
+		h.Linkname = info.Special
+	default:
+		// TEST: NOT COVERED. Special files are excluded from the scan.
+		return nil
+	}
+	if err := tw.WriteHeader(h); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if info.FileType != fileinfo.TypeFile {
+		return nil
+	}
+	in, err := os.Open(r.localPath(info.Path).Path())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	if _, err = io.CopyN(tw, in, info.Size); err != nil {
+		return fmt.Errorf("%s changed while creating bundle: %w", info.Path, err)
+	}
+	return nil
+}
+
+// ApplyBundle applies the changes in a bundle created by CreateBundle to the
+// local site. Files that have changed locally since the bundle's base are
+// reported as conflicts, as with pull. The repository and the local copy of the
+// repository database are not modified, so once the repository is reachable,
+// the receiving site pushes the changes unless it pulls them first.
+func ApplyBundle(filename string, config *BundleConfig, options ...Options) (*Result, error) {
+	r := newRepo(options)
+	site, err := r.currentSite()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp("", "qfs-bundle-")
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer removeExtracted(tmp)
+	if err = gztar.Extract(filename, tmp); err != nil {
+		return nil, fmt.Errorf("%s: not a valid bundle: %w", filename, err)
+	}
+	from, err := readBundleInfo(filepath.Join(tmp, bundleInfo))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	r.ui.Message("applying changes from site %s", from)
+	baseDb, err := database.LoadFile(filepath.Join(tmp, bundleBase), database.WithRepoRules(true))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	bundleDb, err := database.LoadFile(filepath.Join(tmp, bundleSite), database.WithRepoRules(true))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	filters, err := r.localFilters(site, false)
+	if err != nil {
+		return nil, err
+	}
+	diffResult, err := makeDiff(filters).Run(baseDb, bundleDb)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	result := &Result{Changes: diffResult}
+
+	localSrc := r.localSource()
+	result.Conflicts, err = r.checkConflicts(diffResult.Check, !config.NoOp, func(path string) (*fileinfo.FileInfo, error) {
+		info, err := localSrc.FileInfo(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+		return info, nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if diffResult.NumChanges() == 0 {
+		r.ui.Message("no changes to apply")
+		return result, nil
+	}
+	r.ui.Message("----- changes to apply -----")
+	_ = diffResult.WriteDiff(r.ui.Output(), false)
+	r.ui.Message("-----")
+	if config.NoOp {
+		return result, nil
+	}
+	if !r.ui.Prompt("Continue?") {
+		return result, fmt.Errorf("exiting")
+	}
+	var trashDir string
+	if config.BackupDir != "" {
+		trashDir = sync.TrashDir(config.BackupDir)
+	}
+	err = r.applyChanges(localsource.New(filepath.Join(tmp, bundleFiles)), diffResult, nil, trashDir, nil, nil, nil, "", nil, sync.ScheduleDiff)
+	if err != nil {
+		if interrupted := r.ctx.Err(); interrupted != nil {
+			return result, fmt.Errorf("interrupted; apply the bundle again to apply the remaining changes: %w", interrupted)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+func readBundleInfo(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", errors.New("not a qfs bundle")
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return "", err
+	}
+	rest, found := strings.CutPrefix(string(data), bundleHeader)
+	if !found {
+		return "", errors.New("not a qfs bundle or from a newer version of qfs")
+	}
+	scanner := bufio.NewScanner(strings.NewReader(rest))
+	for scanner.Scan() {
+		if site, found := strings.CutPrefix(scanner.Text(), "site "); found {
+			return site, nil
+		}
+	}
+	return "", errors.New("bundle doesn't identify its site")
+}
+
+// removeExtracted removes an extracted bundle, first making sure its
+// directories are writable.
+func removeExtracted(dir string) {
+	_ = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			_ = os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	_ = os.RemoveAll(dir)
+}
@@ -0,0 +1,176 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// A site keeps up to two local copies of the repository database:
+// .qfs/db/repo, which is what the site last pushed or pulled, and
+// .qfs/db/repo.tmp, a newer copy that a command downloaded but that hasn't been
+// pulled yet. .qfs/db/repo.version records which version of the object in S3
+// the newest of these came from, so later commands can use that copy instead
+// of downloading the database again, and commands run offline can use it
+// without accessing the repository at all.
+
+// ErrOffline indicates that an operation requires access to the repository,
+// which it doesn't have with WithOffline.
+var ErrOffline = errors.New("this operation requires access to the repository")
+
+// repoDbRecord is the contents of .qfs/db/repo.version.
+type repoDbRecord struct {
+	Key       string    `json:"key"`
+	ETag      string    `json:"eTag"`
+	VersionId string    `json:"versionId,omitempty"`
+	ModTime   time.Time `json:"modTime"`
+}
+
+// WithOffline causes the repository database to be loaded from the newest local
+// copy without accessing the repository. It is meant for Status and for Scan of
+// the repository database. Push, Pull, and Refresh fail with ErrOffline.
+func WithOffline(offline bool) func(r *Repo) {
+	return func(r *Repo) {
+		r.offline = offline
+	}
+}
+
+// checkOnline returns an error wrapping ErrOffline if the repository can't be
+// accessed.
+func (r *Repo) checkOnline(op string) error {
+	if r.offline {
+		return fmt.Errorf("%s: %w", op, ErrOffline)
+	}
+	return nil
+}
+
+func (r *Repo) readRepoDbRecord() *repoDbRecord {
+	data, err := os.ReadFile(r.localPath(repofiles.RepoDbVersion).Path())
+	if err != nil {
+		return nil
+	}
+	rec := &repoDbRecord{}
+	if json.Unmarshal(data, rec) != nil {
+		return nil
+	}
+	return rec
+}
+
+// writeRepoDbRecord records the version of the repository database that was
+// loaded. Like the local copies it describes, the record is only a cache, so
+// failure to write it is not an error.
+func (r *Repo) writeRepoDbRecord(modTime time.Time) {
+	recordPath := r.localPath(repofiles.RepoDbVersion).Path()
+	if r.repoDbVersion == nil {
+		_ = os.Remove(recordPath)
+		return
+	}
+	data, err := json.Marshal(&repoDbRecord{
+		Key:       r.repoDbVersion.key,
+		ETag:      r.repoDbVersion.eTag,
+		VersionId: r.repoDbVersion.versionId,
+		ModTime:   modTime,
+	})
+	if err == nil {
+		err = os.WriteFile(recordPath, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		// TEST: NOT COVERED
+		r.ui.Message("unable to record version of repository database: %v", err)
+		_ = os.Remove(recordPath)
+	}
+}
+
+// loadCachedRepoDb loads the copy of the repository database that a previous
+// command downloaded if it is the version given by r.repoDbVersion. It returns
+// nil if there is no such copy.
+func (r *Repo) loadCachedRepoDb(srcInfo *fileinfo.FileInfo) (database.Database, error) {
+	rec := r.readRepoDbRecord()
+	if rec == nil || !r.repoDbVersion.equal(&objectVersion{key: rec.Key, eTag: rec.ETag}) {
+		return nil, nil
+	}
+	if _, err := os.Stat(r.localPath(repofiles.TempRepoDb()).Path()); err != nil {
+		return nil, nil
+	}
+	r.ui.Message("cached copy of repository database is current")
+	db, err := r.loadRepoDbCopy(repofiles.TempRepoDb())
+	if err != nil {
+		return nil, err
+	}
+	// If the database is sharded, the local copy of the index was downloaded
+	// along with the cached copy, and knowing it avoids uploading unchanged
+	// shards.
+	indexPath := r.localPath(repofiles.RepoShardIndex)
+	if requiresCopy, err := fileinfo.RequiresCopy(srcInfo, indexPath); err == nil && !requiresCopy {
+		if data, err := os.ReadFile(indexPath.Path()); err == nil {
+			r.shardIndex, _ = parseShardIndex(indexPath.Path(), bytes.NewReader(data))
+		}
+	}
+	return db, nil
+}
+
+// loadOfflineRepoDb loads the newest local copy of the repository database
+// without accessing the repository.
+func (r *Repo) loadOfflineRepoDb() error {
+	relPath := repofiles.TempRepoDb()
+	if _, err := os.Stat(r.localPath(relPath).Path()); err != nil {
+		relPath = repofiles.RepoDb()
+	}
+	db, err := r.loadRepoDbCopy(relPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("there is no local copy of the repository database; run \"qfs refresh\" while online")
+	} else if err != nil {
+		return err
+	}
+	r.ui.Message("using local copy of repository database")
+	r.repoDb = db
+	r.repoDbVersion = nil
+	r.repoDbInfo = nil
+	r.downloadedRepoDb = relPath == repofiles.TempRepoDb()
+	r.shardIndex = nil
+	r.initialized = true
+	if rec := r.readRepoDbRecord(); rec != nil {
+		r.repoDbVersion = &objectVersion{key: rec.Key, eTag: rec.ETag, versionId: rec.VersionId}
+		r.repoDbInfo = &fileinfo.FileInfo{
+			Path:     repofiles.RepoDb(),
+			FileType: fileinfo.TypeFile,
+			ModTime:  rec.ModTime,
+		}
+	}
+	return r.newRepoSource()
+}
+
+// loadedRepoDbCopy returns the relative path of the local copy of the
+// repository database that was loaded by loadRepoDb.
+func (r *Repo) loadedRepoDbCopy() string {
+	if r.downloadedRepoDb {
+		return repofiles.TempRepoDb()
+	}
+	return repofiles.RepoDb()
+}
+
+// Refresh makes sure the local copy of the repository database is the latest
+// version, downloading it if necessary, so that commands run later with
+// WithOffline see the repository as it is now. It doesn't change the site.
+func (r *Repo) Refresh() error {
+	if err := r.checkOnline("refresh"); err != nil {
+		return err
+	}
+	err := r.loadRepoDb()
+	if err != nil {
+		return err
+	}
+	if !r.initialized {
+		return errors.New("repository is not initialized")
+	}
+	r.ui.Message("local copy of repository database is as of %s", misc.FormatTime(r.repoDbInfo.ModTime))
+	return nil
+}
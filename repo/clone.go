@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"io/fs"
+	"os"
+	"slices"
+)
+
+// Clone sets up a new site called site for the repository at location, which
+// has the form s3://bucket/prefix, in the directory given with WithLocalTop. The
+// directory is created if it doesn't exist and must be empty if it does. Clone
+// writes .qfs/repo and .qfs/site and returns the new site's Repo, on which Pull
+// may be called to download the filters and the site's files. The repository
+// must be initialized and must not already have a database for the site. If it
+// does, the site already exists somewhere; use RemoveSite if it is gone for
+// good. Nothing is written unless all checks pass.
+func Clone(location, site string, options ...Options) (*Repo, error) {
+	if _, ok := siteName(repofiles.SiteDb(site), repofiles.SiteDb("")); !ok {
+		return nil, fmt.Errorf("\"%s\" is not a valid site name", site)
+	}
+	r := newRepo(options)
+	if r.localTop == "" {
+		return nil, errors.New("clone requires a directory")
+	}
+	entries, err := os.ReadDir(r.localTop)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", r.localTop)
+	}
+	if s3Re.FindStringSubmatch(location) == nil {
+		return nil, fmt.Errorf("%s must have the form s3://bucket/prefix", location)
+	}
+	repoConfig := location + "\n"
+	if err = r.applyConfig(repoConfig); err != nil {
+		return nil, err
+	}
+
+	src, err := s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	_, err = fileinfo.NewPath(src, repofiles.RepoDb()).FileInfo()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s has not been initialized; run qfs init-repo", location)
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	names, err := r.SiteNames()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if slices.Contains(names, site) {
+		return nil, fmt.Errorf(
+			"the repository already has a database for site %s; if that site no longer exists, run qfs remove-site %s from another site",
+			site,
+			site,
+		)
+	}
+
+	if err = os.MkdirAll(r.localPath(repofiles.Top).Path(), 0777); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(r.localPath(repofiles.RepoConfig).Path(), []byte(repoConfig), 0666); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if err = os.WriteFile(r.localPath(repofiles.Site).Path(), []byte(site+"\n"), 0666); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	r.ui.Message("created site %s in %s", site, r.localTop)
+	return r, nil
+}
@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/merge"
+	"github.com/jberkenbilt/qfs/misc"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ContentDiffConfig is passed to DiffContents.
+type ContentDiffConfig struct {
+	// Old and New select the versions to compare. Each is either a number, where
+	// 1 is the newest version shown by ListVersions, 2 is the one before it, and
+	// so on, or an S3 version ID as shown by ListVersions with Long. If New is
+	// empty, the newest version is used.
+	Old string
+	New string
+	// Tool, if not empty, is a command such as `diff -u` or `meld` that is run
+	// with the old and new versions as its last two arguments instead of using
+	// the internal diff.
+	Tool string
+}
+
+// DiffContents shows the differences between the contents of two versions of
+// a regular file so that they can be inspected before one is restored.
+func (r *Repo) DiffContents(relPath string, config *ContentDiffConfig) error {
+	files, err := r.getVersions(relPath, &ListVersionsConfig{})
+	if err != nil {
+		return err
+	}
+	var versions []*versionData
+	for _, v := range files[relPath] {
+		if !v.isDelete {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s: no versions found in repository", relPath)
+	}
+	newSpec := config.New
+	if newSpec == "" {
+		newSpec = "1"
+	}
+	var selected [2]*versionData
+	for i, spec := range []string{config.Old, newSpec} {
+		selected[i], err = selectVersion(relPath, versions, spec)
+		if err != nil {
+			return err
+		}
+	}
+	var tempFiles [2]string
+	for i, v := range selected {
+		f, err := os.CreateTemp("", "qfs-version-*")
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		tempFiles[i] = f.Name()
+		defer func() { _ = os.Remove(f.Name()) }()
+		err = r.src.DownloadVersion(v.key, &v.version, f)
+		_ = f.Close()
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	if config.Tool != "" {
+		return runDiffTool(config.Tool, tempFiles[0], tempFiles[1], r.ui.Output())
+	}
+	var data [2][]byte
+	for i, name := range tempFiles {
+		data[i], err = os.ReadFile(name)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	label := func(v *versionData) string {
+		return fmt.Sprintf("%s\t%s", relPath, misc.FormatTime(v.lastModified))
+	}
+	out, err := merge.Unified(label(selected[0]), label(selected[1]), data[0], data[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", relPath, err)
+	}
+	_, _ = r.ui.Output().Write(out)
+	return nil
+}
+
+// selectVersion returns the version of relPath identified by spec, which is a
+// number counting from the newest version or a version ID.
+func selectVersion(relPath string, versions []*versionData, spec string) (*versionData, error) {
+	var v *versionData
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 || n > len(versions) {
+			return nil, fmt.Errorf("%s: version number must be from 1 to %d", relPath, len(versions))
+		}
+		v = versions[n-1]
+	} else {
+		for _, x := range versions {
+			if x.version == spec {
+				v = x
+				break
+			}
+		}
+		if v == nil {
+			return nil, fmt.Errorf("%s: version %s not found", relPath, spec)
+		}
+	}
+	if v.info.FileType != fileinfo.TypeFile {
+		return nil, fmt.Errorf("%s: version %s is not a regular file", relPath, spec)
+	}
+	return v, nil
+}
+
+// runDiffTool runs a command such as `diff -u` with the old and new versions of
+// a file as its last two arguments, writing its output to out. Like diff, the
+// tool may exit with status 1 to indicate that the files differ.
+func runDiffTool(diffTool, oldPath, newPath string, out io.Writer) error {
+	words := strings.Fields(diffTool)
+	if len(words) == 0 {
+		return errors.New("diff tool is empty")
+	}
+	args := append(words[1:], oldPath, newPath)
+	cmd := exec.Command(words[0], args...)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("run %s: %w", words[0], err)
+	}
+	return nil
+}
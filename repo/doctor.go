@@ -0,0 +1,302 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DoctorConfig is passed to Doctor.
+type DoctorConfig struct {
+	// NoOp reports problems without offering to repair them.
+	NoOp bool
+}
+
+// DoctorFinding is something Doctor noticed. A finding that is not a problem is
+// informational. Repair describes the repair that was offered, if any.
+type DoctorFinding struct {
+	Problem  bool
+	Message  string
+	Repair   string
+	Repaired bool
+}
+
+// DoctorResult is returned by Doctor.
+type DoctorResult struct {
+	Findings []*DoctorFinding
+}
+
+// Problems returns the number of problems that were not repaired.
+func (d *DoctorResult) Problems() int {
+	n := 0
+	for _, f := range d.Findings {
+		if f.Problem && !f.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+type doctor struct {
+	r      *Repo
+	config *DoctorConfig
+	result *DoctorResult
+}
+
+func (d *doctor) note(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	d.result.Findings = append(d.result.Findings, &DoctorFinding{Message: msg})
+	d.r.ui.Message("note: %s", msg)
+}
+
+// problem reports a problem. If repair is not nil, the user is asked whether to
+// perform the repair described by what.
+func (d *doctor) problem(what string, repair func() error, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	f := &DoctorFinding{
+		Problem: true,
+		Message: msg,
+	}
+	d.result.Findings = append(d.result.Findings, f)
+	d.r.ui.Message("problem: %s", msg)
+	if repair == nil {
+		return
+	}
+	f.Repair = what
+	if d.config.NoOp || !d.r.ui.Prompt(what+"?") {
+		return
+	}
+	if err := repair(); err != nil {
+		// TEST: NOT COVERED
+		d.r.ui.Message("repair failed: %v", err)
+		return
+	}
+	f.Repaired = true
+	d.r.ui.Message("repaired")
+}
+
+func (d *doctor) removeFile(relPath string) func() error {
+	return func() error {
+		return os.Remove(d.r.localPath(relPath).Path())
+	}
+}
+
+// Doctor checks the local .qfs directory and the repository for problems that
+// prevent qfs from working or that require knowledge of qfs's internals to fix.
+// Unless config.NoOp is set, it offers to repair problems where it can. It
+// returns an error only if it can't perform the checks.
+func Doctor(config *DoctorConfig, options ...Options) (*DoctorResult, error) {
+	d := &doctor{
+		r:      newRepo(options),
+		config: config,
+		result: &DoctorResult{},
+	}
+	r := d.r
+	top := r.localPath(repofiles.Top).Path()
+	if _, err := os.Stat(top); err != nil {
+		return nil, err
+	}
+
+	configured := false
+	if _, err := os.Stat(r.localPath(repofiles.RepoConfig).Path()); errors.Is(err, fs.ErrNotExist) {
+		d.problem("", nil, "%s is missing; run qfs init-repo or create it with s3://bucket/prefix", repofiles.RepoConfig)
+	} else if err = r.configure(); err != nil {
+		d.problem("", nil, "%v", err)
+	} else {
+		configured = true
+	}
+
+	site, err := r.currentSite()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		d.problem("", nil, "%s is missing; create it containing this site's name", repofiles.Site)
+	case err != nil:
+		// TEST: NOT COVERED
+		d.problem("", nil, "%v", err)
+	case site == "":
+		d.problem("", nil, "%s is empty; it must contain this site's name", repofiles.Site)
+	}
+	_, validName := siteName(repofiles.SiteDb(site), repofiles.SiteDb(""))
+	if err == nil && site != "" && !validName {
+		d.problem("", nil, "%s: \"%s\" is not a valid site name", repofiles.Site, site)
+	}
+	siteOk := err == nil && validName
+
+	if _, err := r.symlinkMode(); err != nil {
+		d.problem("", nil, "%v", err)
+	}
+
+	if siteOk {
+		d.checkDb(repofiles.SiteDb(site), "the next push will create it")
+	}
+	d.checkDb(repofiles.RepoDb(), "the next pull will create it")
+	if err := d.checkMarkers(); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if err := d.checkTempFiles(top); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if configured {
+		if err := d.checkRepository(); err != nil {
+			return nil, err
+		}
+	}
+	return d.result, nil
+}
+
+// checkDb makes sure a local database can be read.
+func (d *doctor) checkDb(relPath string, ifMissing string) {
+	var options []database.Options
+	if relPath == repofiles.RepoDb() {
+		options = append(options, database.WithRepoRules(true))
+	}
+	_, err := database.Load(d.r.localPath(relPath), options...)
+	if errors.Is(err, fs.ErrNotExist) {
+		d.note("%s doesn't exist; %s", relPath, ifMissing)
+	} else if err != nil {
+		d.problem("remove "+relPath, d.removeFile(relPath), "%s can't be read: %v", relPath, err)
+	}
+}
+
+// checkMarkers checks the push and pull files, which record the changes made by
+// the last push and pull. Pull removes the push file when it finishes, so if the
+// push file is older than the pull file, the last pull didn't finish.
+func (d *doctor) checkMarkers() error {
+	var infos []*fileinfo.FileInfo
+	for _, relPath := range []string{repofiles.Push, repofiles.Pull} {
+		p := d.r.localPath(relPath)
+		info, err := p.FileInfo()
+		if err != nil {
+			infos = append(infos, nil)
+			continue
+		}
+		infos = append(infos, info)
+		data, err := os.ReadFile(p.Path())
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+			d.problem("remove "+relPath, d.removeFile(relPath), "%s is truncated", relPath)
+		}
+	}
+	push, pull := infos[0], infos[1]
+	if push != nil && pull != nil && push.ModTime.Before(pull.ModTime) {
+		d.note("the last pull didn't finish; run qfs pull")
+	}
+	return nil
+}
+
+// checkTempFiles looks for temporary files left behind by a crash while writing
+// a database or diff. Trash is skipped since it contains the user's files.
+func (d *doctor) checkTempFiles(top string) error {
+	trash := d.r.localPath(repofiles.Trash).Path()
+	var found []string
+	err := filepath.WalkDir(top, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		if entry.IsDir() && path == trash {
+			return filepath.SkipDir
+		}
+		if entry.Type().IsRegular() && misc.IsAtomicTemp(entry.Name()) {
+			rel, err := filepath.Rel(d.r.localTop, path)
+			if err != nil {
+				// TEST: NOT COVERED
+				return err
+			}
+			found = append(found, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	for _, relPath := range found {
+		d.problem("remove "+relPath, d.removeFile(relPath), "leftover temporary file %s", relPath)
+	}
+	return nil
+}
+
+// checkRepository checks that the repository is reachable and initialized and
+// that it isn't locked by a process that is gone.
+func (d *doctor) checkRepository() error {
+	r := d.r
+	location := fmt.Sprintf("s3://%s/%s", r.bucket, r.prefix)
+	src, err := s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	srcInfo, err := fileinfo.NewPath(src, repofiles.RepoDb()).FileInfo()
+	if errors.Is(err, fs.ErrNotExist) {
+		d.problem("", nil, "%s has not been initialized; run qfs init-repo", location)
+	} else if err != nil {
+		d.problem("", nil, "can't access %s: %v", location, err)
+		return nil
+	} else {
+		localPath := r.localPath(repofiles.RepoDb())
+		if _, err := localPath.FileInfo(); err == nil {
+			current, err := r.localRepoDbCurrent(srcInfo)
+			if err != nil {
+				// TEST: NOT COVERED
+				return err
+			}
+			if !current {
+				d.note("the repository has changed since this site last pulled")
+			}
+		}
+	}
+
+	lock, err := r.readLock()
+	if err != nil {
+		d.problem("", nil, "can't read repository lock: %v", err)
+		return nil
+	}
+	if lock == nil {
+		return nil
+	}
+	removeLock := func() error {
+		if err := r.removeBusy(); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		r.ui.Message("if the interrupted operation was a push, run qfs push again")
+		return nil
+	}
+	site, _ := r.currentSite()
+	me := newLockInfo(site)
+	switch {
+	case lock.expired():
+		d.problem("remove the lock", removeLock, "the repository lock held by %s has expired", lock)
+	case lock.Host == "":
+		d.note("the repository is locked by an unknown owner; if no qfs process is running, run qfs unlock -force")
+	case lock.Site == me.Site && lock.Host == me.Host && !processRunning(lock.PID):
+		d.problem(
+			"remove the lock",
+			removeLock,
+			"the repository is locked by %s, which is no longer running",
+			lock,
+		)
+	default:
+		d.note("the repository is locked by %s", lock)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/s3source"
+	"path"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+)
+
+// DuConfig is passed to Du.
+type DuConfig struct {
+	// If Versions is true, noncurrent versions and delete markers are counted as
+	// well. This requires listing every version in the repository.
+	Versions bool
+}
+
+// DuEntry is the space used by one entry directly below the path given to Du.
+type DuEntry struct {
+	Name string
+	// Objects and Size count current objects.
+	Objects int64
+	Size    int64
+	// NoncurrentVersions, NoncurrentSize, and DeleteMarkers are only set with
+	// DuConfig.Versions.
+	NoncurrentVersions int64
+	NoncurrentSize     int64
+	DeleteMarkers      int64
+}
+
+func (e *DuEntry) add(other *DuEntry) {
+	e.Objects += other.Objects
+	e.Size += other.Size
+	e.NoncurrentVersions += other.NoncurrentVersions
+	e.NoncurrentSize += other.NoncurrentSize
+	e.DeleteMarkers += other.DeleteMarkers
+}
+
+// Du reports the space used in the repository by each file or directory
+// directly below relPath, which is relative to the top of the repository, in
+// order by name. Each directory below relPath is listed in parallel. Objects
+// that qfs stores under .qfs, such as databases and, with the content layout,
+// the contents of files, are counted under .qfs when relPath is the top.
+func (r *Repo) Du(relPath string, config *DuConfig) ([]*DuEntry, error) {
+	src, err := s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	base := r.prefix
+	if p := path.Clean(filepath.ToSlash(relPath)); p != "." && p != "" {
+		base = path.Join(base, strings.ReplaceAll(p, "@", "@@"))
+	}
+	if base != "" {
+		base += "/"
+	}
+
+	entries := map[string]*DuEntry{}
+	get := func(name string) *DuEntry {
+		if entries[name] == nil {
+			entries[name] = &DuEntry{Name: name}
+		}
+		return entries[name]
+	}
+	// nameOf returns the name of the entry that directly contains the object with
+	// the given key.
+	nameOf := func(key string, size int64) string {
+		if info := src.KeyToFileInfo(key, size); info != nil {
+			return path.Base(info.Path)
+		}
+		return strings.ReplaceAll(strings.TrimPrefix(key, base), "@@", "@")
+	}
+
+	// List what is directly below base, and then list each subdirectory in
+	// parallel.
+	var subdirs []string
+	err = r.duList(base, true, config.Versions, func(key string, size int64, current, isDelete bool) {
+		get(nameOf(key, size)).add(duCount(size, current, isDelete))
+	}, func(prefix string) {
+		subdirs = append(subdirs, prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan string, numWorkers)
+	go func() {
+		for _, prefix := range subdirs {
+			c <- prefix
+		}
+		close(c)
+	}()
+	var mutex gosync.Mutex
+	var allErrors []error
+	misc.DoConcurrently(
+		func(c chan string, errorChan chan error) {
+			for prefix := range c {
+				total := &DuEntry{}
+				err := r.duList(prefix, false, config.Versions, func(_ string, size int64, current, isDelete bool) {
+					total.add(duCount(size, current, isDelete))
+				}, nil)
+				if err != nil {
+					errorChan <- err
+					continue
+				}
+				name := strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(prefix, base), "/"), "@@", "@")
+				mutex.Lock()
+				get(name).add(total)
+				mutex.Unlock()
+			}
+		},
+		func(e error) {
+			allErrors = append(allErrors, e)
+		},
+		c,
+		numWorkers,
+	)
+	if len(allErrors) > 0 {
+		return nil, allErrors[0]
+	}
+	var result []*DuEntry
+	for _, name := range misc.SortedKeys(entries) {
+		result = append(result, entries[name])
+	}
+	return result, nil
+}
+
+func duCount(size int64, current, isDelete bool) *DuEntry {
+	switch {
+	case isDelete:
+		return &DuEntry{DeleteMarkers: 1}
+	case current:
+		return &DuEntry{Objects: 1, Size: size}
+	default:
+		return &DuEntry{NoncurrentVersions: 1, NoncurrentSize: size}
+	}
+}
+
+// duList lists the objects under prefix, calling handle for each object,
+// version, or delete marker. If delimit is true, only objects directly below
+// prefix are passed to handle, and subdir is called with the prefix of each
+// subdirectory.
+func (r *Repo) duList(
+	prefix string,
+	delimit bool,
+	versions bool,
+	handle func(key string, size int64, current, isDelete bool),
+	subdir func(prefix string),
+) error {
+	var delimiter *string
+	if delimit {
+		delimiter = aws.String("/")
+	}
+	if !versions {
+		paginator := s3.NewListObjectsV2Paginator(r.s3Client, &s3.ListObjectsV2Input{
+			Bucket:    &r.bucket,
+			Prefix:    &prefix,
+			Delimiter: delimiter,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(r.ctx)
+			if err != nil {
+				return fmt.Errorf("list s3://%s/%s: %w", r.bucket, prefix, err)
+			}
+			for _, x := range page.Contents {
+				handle(*x.Key, aws.ToInt64(x.Size), true, false)
+			}
+			for _, x := range page.CommonPrefixes {
+				subdir(*x.Prefix)
+			}
+		}
+		return nil
+	}
+	paginator := s3.NewListObjectVersionsPaginator(r.s3Client, &s3.ListObjectVersionsInput{
+		Bucket:    &r.bucket,
+		Prefix:    &prefix,
+		Delimiter: delimiter,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(r.ctx)
+		if err != nil {
+			return fmt.Errorf("list versions of s3://%s/%s: %w", r.bucket, prefix, err)
+		}
+		for _, x := range page.Versions {
+			handle(*x.Key, aws.ToInt64(x.Size), aws.ToBool(x.IsLatest), false)
+		}
+		for _, x := range page.DeleteMarkers {
+			handle(*x.Key, 0, aws.ToBool(x.IsLatest), true)
+		}
+		for _, x := range page.CommonPrefixes {
+			subdir(*x.Prefix)
+		}
+	}
+	return nil
+}
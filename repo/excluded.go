@@ -0,0 +1,111 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/sync"
+	"os"
+	"slices"
+	"strings"
+)
+
+// findExcluded returns the files and directories in the repository that
+// filters exclude and of which the site still has copies. Files are only
+// returned if the local copy is unchanged from the repository's, so nothing
+// that exists only at this site is returned. If subtree is not nil, only paths
+// it includes are considered.
+func (r *Repo) findExcluded(filters []*filter.Filter, subtree *filter.Filter) (files, dirs []*fileinfo.FileInfo) {
+	local := r.localSource()
+	cache := filter.NewCache(true, filters...)
+	for _, p := range misc.SortedKeys(r.repoDb) {
+		info := r.repoDb[p]
+		if p == "." {
+			continue
+		}
+		if included, _ := cache.IsIncludedFile(info); included {
+			continue
+		}
+		if subtree != nil {
+			if included, _ := filter.IsIncluded(p, true, subtree); !included {
+				continue
+			}
+		}
+		cur, err := fileinfo.NewPath(local, p).FileInfo()
+		if err != nil || cur.FileType != info.FileType {
+			continue
+		}
+		switch info.FileType {
+		case fileinfo.TypeDirectory:
+			dirs = append(dirs, info)
+		case fileinfo.TypeLink:
+			if cur.Special == info.Special {
+				files = append(files, info)
+			}
+		case fileinfo.TypeFile:
+			if cur.Size == info.Size && fileinfo.SameTimeWithin(cur.ModTime, info.ModTime, r.modifyWindow) {
+				files = append(files, info)
+			} else {
+				r.ui.Message("keeping %s, which the site filter excludes, since it differs from the repository", p)
+			}
+		}
+	}
+	return files, dirs
+}
+
+// deleteExcluded removes the site's copies of files that filters exclude, as
+// found by findExcluded, after confirmation. Files are moved into trashDir if it
+// is not empty. Excluded directories are removed if they are empty afterward.
+// It returns the paths of the files that were, or with noOp would be, removed.
+func (r *Repo) deleteExcluded(
+	filters []*filter.Filter,
+	subtree *filter.Filter,
+	noOp bool,
+	trashDir string,
+) ([]string, error) {
+	files, dirs := r.findExcluded(filters, subtree)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	var paths []string
+	r.ui.Message("----- excluded files to remove -----")
+	for _, f := range files {
+		paths = append(paths, f.Path)
+		_, _ = fmt.Fprintf(r.ui.Output(), "rm %s\n", f.Path)
+	}
+	r.ui.Message("-----")
+	if noOp {
+		return paths, nil
+	}
+	if !r.ui.Prompt(fmt.Sprintf("Remove %d excluded file(s) from this site?", len(files))) {
+		return nil, nil
+	}
+	err := sync.ApplyChanges(
+		r.localSource(),
+		r.localSource(),
+		&diff.Result{Rm: files},
+		nil,
+		&sync.ApplyConfig{
+			TrashDir: trashDir,
+			UI:       r.ui,
+			Context:  r.ctx,
+		},
+		numWorkers,
+	)
+	if err != nil {
+		return paths, err
+	}
+	// Remove the deepest directories first. A directory that isn't empty still
+	// has something that exists only at this site, so it is kept.
+	slices.SortFunc(dirs, func(a, b *fileinfo.FileInfo) int {
+		return strings.Count(b.Path, "/") - strings.Count(a.Path, "/")
+	})
+	for _, d := range dirs {
+		if os.Remove(r.localPath(d.Path).Path()) == nil {
+			r.ui.Message("removed empty directory %s", d.Path)
+		}
+	}
+	return paths, nil
+}
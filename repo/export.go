@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ExportConfig struct {
+	// AsOf and Filters select versions as with Get.
+	AsOf    time.Time
+	Filters []*filter.Filter
+}
+
+// ExportTar writes the files Get would retrieve for relPath, or for the whole
+// repository other than .qfs if relPath is empty, to w as a gzip-compressed
+// tar archive. Entries are named by their paths in the repository and have
+// the modes and modification times recorded there. Contents are streamed from
+// the repository into the archive, so nothing is written to disk. Nothing else
+// is written to the UI's output, so w may be standard output.
+func (r *Repo) ExportTar(relPath string, w io.Writer, config *ExportConfig) error {
+	if relPath != "" {
+		relPath = path.Clean(filepath.ToSlash(relPath))
+	}
+	files, err := r.getVersions(
+		relPath,
+		&ListVersionsConfig{
+			AsOf:    config.AsOf,
+			Filters: config.Filters,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	// getVersions finds everything that starts with relPath, so only keep relPath
+	// and what's below it.
+	var toExport []*versionData
+	for _, p := range misc.SortedKeys(files) {
+		data := files[p]
+		if len(data) == 0 || data[0].isDelete {
+			continue
+		}
+		if relPath == "" {
+			if p == repofiles.Top || strings.HasPrefix(p, repofiles.Top+"/") {
+				continue
+			}
+		} else if p != relPath && !strings.HasPrefix(p, relPath+"/") {
+			continue
+		}
+		toExport = append(toExport, data[0])
+	}
+	if len(toExport) == 0 {
+		return fmt.Errorf("%s: %w", relPath, fs.ErrNotExist)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	for _, v := range toExport {
+		if err := r.ctx.Err(); err != nil {
+			return fmt.Errorf("export interrupted: %w", err)
+		}
+		if err := r.exportEntry(archive, v); err != nil {
+			return err
+		}
+	}
+	return errors.Join(archive.Close(), gz.Close())
+}
+
+// exportEntry writes the tar header for v and, if it is a regular file, its
+// contents.
+func (r *Repo) exportEntry(archive *tar.Writer, v *versionData) error {
+	info := v.info
+	h := &tar.Header{
+		Name:    info.Path,
+		Mode:    int64(info.Permissions),
+		ModTime: info.ModTime,
+	}
+	switch info.FileType {
+	case fileinfo.TypeDirectory:
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+	case fileinfo.TypeLink:
+		h.Typeflag = tar.TypeSymlink
+		h.Linkname = info.Special
+	case fileinfo.TypeFile:
+		h.Typeflag = tar.TypeReg
+		h.Size = info.Size
+	default:
+		// TEST: NOT COVERED. Repositories only contain files, directories, and
+		// symbolic links.
+		return nil
+	}
+	if err := archive.WriteHeader(h); err != nil {
+		return err
+	}
+	if info.FileType != fileinfo.TypeFile {
+		return nil
+	}
+	rd, err := r.src.OpenVersion(v.key, &v.version)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rd.Close() }()
+	n, err := io.Copy(archive, rd)
+	if err != nil {
+		return fmt.Errorf("%s: %w", info.Path, err)
+	}
+	if n != info.Size {
+		// TEST: NOT COVERED
+		return fmt.Errorf("%s: expected %d bytes but read %d", info.Path, info.Size, n)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"slices"
+)
+
+// FsckConfig is passed to Fsck.
+type FsckConfig struct {
+	// Repair causes stale keys to be removed and the repository database to be
+	// rebuilt from the objects in the repository. Otherwise, problems are only
+	// reported.
+	Repair bool
+}
+
+// FsckResult is returned by Fsck. Keys are full S3 keys, and paths are relative
+// to the top of the repository.
+type FsckResult struct {
+	// Duplicates are keys for files that also have newer keys. They are left
+	// behind when storing a new key doesn't remove the old one.
+	Duplicates []string
+	// Invalid are keys that don't encode file information, such as those left by
+	// an interrupted upload or stored by another tool.
+	Invalid []string
+	// Excluded are keys for files that the repository filter excludes.
+	Excluded []string
+	// Unreferenced are content objects that no file refers to.
+	Unreferenced []string
+	// Missing are paths in the repository database that have no object.
+	Missing []string
+	// Untracked are paths that have objects but aren't in the repository
+	// database.
+	Untracked []string
+	// Changed are paths whose objects don't match the repository database.
+	Changed []string
+	// Repaired is true if the problems were repaired.
+	Repaired bool
+}
+
+// StaleKeys returns the keys that would be removed by a repair.
+func (f *FsckResult) StaleKeys() []string {
+	keys := slices.Concat(f.Duplicates, f.Invalid, f.Excluded, f.Unreferenced)
+	slices.Sort(keys)
+	return keys
+}
+
+// Problems returns the number of problems found.
+func (f *FsckResult) Problems() int {
+	return len(f.StaleKeys()) + len(f.Missing) + len(f.Untracked) + len(f.Changed)
+}
+
+// sameObject returns true if the repository database entry for a file matches
+// the file information decoded from its object's key.
+func (r *Repo) sameObject(path string, dbInfo, objInfo *fileinfo.FileInfo) bool {
+	if r.src.KeyFromPath(path, dbInfo) != r.src.KeyFromPath(path, objInfo) {
+		return false
+	}
+	return dbInfo.FileType != fileinfo.TypeFile || dbInfo.Size == objInfo.Size
+}
+
+// Fsck checks the consistency of the repository. It lists every key under the
+// repository's prefix and reports keys that are duplicates, invalid, or
+// excluded by the repository filter, content objects no file refers to, and
+// differences between the repository database and the objects in the
+// repository. With config.Repair, after confirmation, the stale keys are
+// removed, and the repository database is rebuilt from the objects with the
+// repository locked. This is more thorough than init-repo -clean-repo, which
+// only removes keys.
+func (r *Repo) Fsck(config *FsckConfig) (*FsckResult, error) {
+	if config.Repair {
+		if err := r.checkReadOnly(); err != nil {
+			return nil, err
+		}
+		if err := r.checkProtected("repair the repository"); err != nil {
+			return nil, err
+		}
+	}
+	err := r.loadRepoDb()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if !r.initialized {
+		return nil, errors.New("the repository has not been initialized; run qfs init-repo")
+	}
+	err = r.checkBusy()
+	if err != nil {
+		return nil, err
+	}
+	repoFilterPath := fileinfo.NewPath(r.src, repofiles.SiteFilter(repofiles.RepoSite))
+	f := filter.New()
+	err = f.ReadFile(repoFilterPath, false)
+	if err != nil {
+		return nil, fmt.Errorf("read repository copy of repository filter: %w", err)
+	}
+	r.ui.Message("listing repository objects")
+	objects, err := r.src.Database(true, true, []*filter.Filter{f})
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+
+	result := &FsckResult{}
+	for _, key := range misc.SortedKeys(r.src.ExtraKeys()) {
+		info := r.src.KeyToFileInfo(key, 0)
+		switch {
+		case info == nil:
+			result.Invalid = append(result.Invalid, key)
+		case objects[info.Path] != nil:
+			result.Duplicates = append(result.Duplicates, key)
+		default:
+			result.Excluded = append(result.Excluded, key)
+		}
+	}
+	versioned, err := r.src.VersionHashes()
+	if err != nil {
+		return nil, err
+	}
+	result.Unreferenced, err = r.src.UnreferencedContent(versioned)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range misc.SortedKeys(r.repoDb) {
+		if objects[p] == nil {
+			result.Missing = append(result.Missing, p)
+		} else if !r.sameObject(p, r.repoDb[p], objects[p]) {
+			result.Changed = append(result.Changed, p)
+		}
+	}
+	for _, p := range misc.SortedKeys(objects) {
+		if r.repoDb[p] == nil {
+			result.Untracked = append(result.Untracked, p)
+		}
+	}
+
+	report := func(what string, items []string) {
+		for _, item := range items {
+			_, _ = fmt.Fprintf(r.ui.Output(), "%s: %s\n", what, item)
+		}
+	}
+	report("duplicate key", result.Duplicates)
+	report("invalid key", result.Invalid)
+	report("excluded key", result.Excluded)
+	report("unreferenced content", result.Unreferenced)
+	report("missing object", result.Missing)
+	report("not in database", result.Untracked)
+	report("database mismatch", result.Changed)
+	if result.Problems() == 0 {
+		r.ui.Message("no problems found")
+		return result, nil
+	}
+	r.ui.Message("%d problem(s) found", result.Problems())
+	if !config.Repair {
+		r.ui.Message("run qfs fsck-repo -repair to repair")
+		return result, nil
+	}
+	stale := result.StaleKeys()
+	if !r.ui.Prompt(fmt.Sprintf("Remove %d stale key(s) and rebuild the repository database?", len(stale))) {
+		return result, nil
+	}
+
+	site, _ := r.currentSite()
+	err = r.createBusy(site)
+	if err != nil {
+		return nil, err
+	}
+	defer r.stopHeartbeat()
+	err = r.fsckRepair(site, result, objects)
+	if err2 := r.removeBusy(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Repaired = true
+	r.ui.Message("repaired")
+	return result, nil
+}
+
+func (r *Repo) fsckRepair(site string, result *FsckResult, objects database.Database) error {
+	stale := result.StaleKeys()
+	if len(stale) > 0 {
+		err := r.src.RemoveKeys(stale)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	r.repoDb = objects
+	err := r.updateRepoDb()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return r.audit("fsck-repo", site, map[string]int{
+		"removed": len(stale),
+		"missing": len(result.Missing),
+		"added":   len(result.Untracked),
+		"changed": len(result.Changed),
+	}, "")
+}
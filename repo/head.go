@@ -0,0 +1,156 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io"
+	"path"
+	"time"
+)
+
+// The key of the repository database changes with every upload, so S3's
+// conditional writes can't protect it directly. Instead, before uploading a new
+// database, a site writes the head object, whose key never changes, to record
+// which database it is replacing. The head is written only if its ETag is still
+// the one that was read, so when two sites try to replace the same database,
+// only one of them can. If a site fails before finishing its upload, the other
+// sites are blocked until LockTTL has passed.
+
+// repoDbHead is the content of the head object.
+type repoDbHead struct {
+	// Base is the key of the database being replaced, or empty if there wasn't
+	// one.
+	Base string `json:"base"`
+	// New is the key of the new database. It is the same as Base if the upload
+	// didn't happen.
+	New   string    `json:"new"`
+	Owner *lockInfo `json:"owner"`
+	// time is when the head was written according to S3.
+	time time.Time
+}
+
+func (r *Repo) headKey() string {
+	return path.Join(r.prefix, repofiles.RepoDbHead)
+}
+
+// readRepoDbHead returns the head object and its ETag, or nil if there isn't
+// one.
+func (r *Repo) readRepoDbHead() (*repoDbHead, string, error) {
+	output, err := r.s3Client.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.headKey()),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return nil, "", nil
+		}
+		// TEST: NOT COVERED
+		return nil, "", fmt.Errorf("read repository database head: %w", err)
+	}
+	defer func() { _ = output.Body.Close() }()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, "", fmt.Errorf("read repository database head: %w", err)
+	}
+	head := &repoDbHead{}
+	if err = json.Unmarshal(data, head); err != nil {
+		return nil, "", fmt.Errorf("parse s3://%s/%s: %w", r.bucket, r.headKey(), err)
+	}
+	if output.LastModified != nil {
+		head.time = *output.LastModified
+	}
+	return head, aws.ToString(output.ETag), nil
+}
+
+// writeRepoDbHead writes head only if the head object's ETag is still eTag or,
+// if eTag is empty, only if there is no head object. It returns the new ETag. If
+// the head has changed, the error wraps ErrRepoChanged.
+func (r *Repo) writeRepoDbHead(head *repoDbHead, eTag string) (string, error) {
+	data, err := json.Marshal(head)
+	if err != nil {
+		// TEST: NOT COVERED
+		return "", err
+	}
+	input := &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.headKey()),
+		Body:   bytes.NewReader(append(data, '\n')),
+	}
+	var options []func(*s3.Options)
+	if eTag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		// This version of the SDK doesn't have a field for If-Match.
+		options = append(options, func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-Match", eTag))
+		})
+	}
+	output, err := r.s3Client.PutObject(r.ctx, input, options...)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return "", fmt.Errorf(
+				"another site updated the repository database at the same time: %w",
+				ErrRepoChanged,
+			)
+		}
+	}
+	if err != nil {
+		// TEST: NOT COVERED
+		return "", fmt.Errorf("write repository database head: %w", err)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+// claimRepoDb records in the head object that this site is replacing the
+// loaded repository database with the one whose key is newKey. If another site
+// has already claimed the loaded database, the error wraps ErrRepoChanged. It
+// returns a function that releases the claim if the upload fails.
+func (r *Repo) claimRepoDb(newKey string) (func(), error) {
+	var base string
+	if r.repoDbVersion != nil {
+		base = r.repoDbVersion.key
+	}
+	head, eTag, err := r.readRepoDbHead()
+	if err != nil {
+		return nil, err
+	}
+	if head != nil && head.Base == base && head.New != base && time.Since(head.time) < LockTTL {
+		owner := "another site"
+		if head.Owner != nil {
+			owner = head.Owner.String()
+		}
+		return nil, fmt.Errorf(
+			"repository database %s is being replaced by %s: %w",
+			r.repoDbVersion,
+			owner,
+			ErrRepoChanged,
+		)
+	}
+	site, _ := r.currentSite()
+	claim := &repoDbHead{
+		Base:  base,
+		New:   newKey,
+		Owner: newLockInfo(site),
+	}
+	eTag, err = r.writeRepoDbHead(claim, eTag)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// TEST: NOT COVERED. If this fails, the claim is ignored after LockTTL.
+		claim.New = base
+		_, _ = r.writeRepoDbHead(claim, eTag)
+	}, nil
+}
@@ -0,0 +1,159 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/misc"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// headServer is a minimal S3 that stores objects in memory and honors
+// If-Match and If-None-Match on PUT.
+type headServer struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	eTags   map[string]string
+	times   map[string]time.Time
+	n       int
+}
+
+func (s *headServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := req.URL.Path
+	eTag, exists := s.eTags[key]
+	switch req.Method {
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Header().Set("ETag", eTag)
+		w.Header().Set("Last-Modified", s.times[key].UTC().Format(http.TimeFormat))
+		_, _ = w.Write(s.objects[key])
+	case http.MethodPut:
+		if (req.Header.Get("If-None-Match") == "*" && exists) ||
+			(req.Header.Get("If-Match") != "" && req.Header.Get("If-Match") != eTag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code></Error>")
+			return
+		}
+		data, _ := io.ReadAll(req.Body)
+		s.n++
+		s.objects[key] = data
+		s.eTags[key] = fmt.Sprintf(`"%d"`, s.n)
+		s.times[key] = time.Now()
+		w.Header().Set("ETag", s.eTags[key])
+	}
+}
+
+type silentUI struct{}
+
+func (silentUI) Message(string, ...any) {}
+func (silentUI) Prompt(string) bool     { return false }
+func (silentUI) Output() io.Writer      { return io.Discard }
+
+var _ misc.UI = silentUI{}
+
+func TestClaimRepoDb(t *testing.T) {
+	s := &headServer{
+		objects: map[string][]byte{},
+		eTags:   map[string]string{},
+		times:   map[string]time.Time{},
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	newRepo := func(loaded string) *Repo {
+		r := &Repo{
+			ctx:      context.Background(),
+			localTop: t.TempDir(),
+			bucket:   "bucket",
+			prefix:   "home",
+			s3Client: client,
+			ui:       silentUI{},
+		}
+		if loaded != "" {
+			r.repoDbVersion = &objectVersion{key: loaded}
+		}
+		return r
+	}
+
+	// Without a head object, the first site to claim the database wins.
+	site1 := newRepo("")
+	site2 := newRepo("")
+	release, err := site1.claimRepoDb("v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = site2.claimRepoDb("other")
+	if !errors.Is(err, ErrRepoChanged) || !strings.Contains(err.Error(), "is being replaced by") {
+		t.Errorf("wrong error: %v", err)
+	}
+	// A released claim can be taken by another site.
+	release()
+	release, err = site2.claimRepoDb("v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Once v1 is uploaded, sites that loaded it may replace it, but only one at a
+	// time.
+	site1 = newRepo("v1")
+	site2 = newRepo("v1")
+	if _, err = site1.claimRepoDb("v2"); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = site2.claimRepoDb("other")
+	if !errors.Is(err, ErrRepoChanged) {
+		t.Errorf("wrong error: %v", err)
+	}
+	// Releasing a claim that has since been replaced doesn't clobber the new one.
+	release()
+	head, _, err := site1.readRepoDbHead()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if head.Base != "v1" || head.New != "v2" {
+		t.Errorf("wrong head: %#v", head)
+	}
+
+	// If the head changes between reading and writing it, the write fails.
+	_, eTag, err := site1.readRepoDbHead()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = site2.claimRepoDb("v3"); err == nil {
+		// site2 loaded v1, which site1 has claimed.
+		t.Error("claimed a database that was already claimed")
+	}
+	if _, err = newRepo("v2").writeRepoDbHead(&repoDbHead{Base: "v2", New: "v3"}, eTag); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = newRepo("v2").writeRepoDbHead(&repoDbHead{Base: "v2", New: "v4"}, eTag)
+	if !errors.Is(err, ErrRepoChanged) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// A claim whose upload never finished is ignored once it expires.
+	defer func(ttl time.Duration) { LockTTL = ttl }(LockTTL)
+	LockTTL = 0
+	if _, err = newRepo("v2").claimRepoDb("v4"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,100 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// Hooks are programs in .qfs/hooks that are run before and after push and
+// pull apply changes. Like .qfs/config, they are local to the site. Each hook
+// is given a JSON summary of the changes on standard input. If a pre- hook
+// fails, the operation is not done. A failing post- hook is reported but
+// doesn't change the outcome of an operation that has already been done.
+
+const (
+	HookPrePush  = "pre-push"
+	HookPostPush = "post-push"
+	HookPrePull  = "pre-pull"
+	HookPostPull = "post-pull"
+)
+
+// HookInput is the JSON written to a hook's standard input. Changes, Conflicts,
+// and Bytes are as in a Plan.
+type HookInput struct {
+	Hook      string       `json:"hook"`
+	Operation string       `json:"operation"`
+	Site      string       `json:"site"`
+	Top       string       `json:"top"`
+	Changes   *PlanChanges `json:"changes"`
+	Conflicts []string     `json:"conflicts"`
+	Merged    []string     `json:"merged,omitempty"`
+	Bytes     int64        `json:"bytes"`
+}
+
+// runHook runs the named hook if the site has it. The hook is run in the top
+// directory of the site with QFS_HOOK and QFS_SITE in its environment. Its
+// output goes to the UI's output, and its standard error goes to ours.
+func (r *Repo) runHook(hook, site string, result *Result) error {
+	hookPath := r.localPath(path.Join(repofiles.Hooks, hook)).Path()
+	st, err := os.Stat(hookPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		r.ui.Message("ignoring %s hook: not a regular file", hook)
+		return nil
+	}
+	operation := "push"
+	if hook == HookPrePull || hook == HookPostPull {
+		operation = "pull"
+	}
+	plan := newPlan(operation, site, result.Changes, result.Conflicts)
+	top, err := filepath.Abs(r.localTop)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	input, err := json.MarshalIndent(&HookInput{
+		Hook:      hook,
+		Operation: operation,
+		Site:      site,
+		Top:       top,
+		Changes:   plan.Changes,
+		Conflicts: plan.Conflicts,
+		Merged:    result.Merged,
+		Bytes:     plan.Bytes,
+	}, "", "  ")
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.ui.Message("running %s hook", hook)
+	cmd := exec.Command(hookPath)
+	cmd.Dir = top
+	cmd.Env = append(os.Environ(), "QFS_HOOK="+hook, "QFS_SITE="+site)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	cmd.Stdout = r.ui.Output()
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %w", hook, err)
+	}
+	return nil
+}
+
+// runPostHook runs a post- hook, reporting but otherwise ignoring failure.
+func (r *Repo) runPostHook(hook, site string, result *Result) {
+	if err := r.runHook(hook, site, result); err != nil {
+		r.ui.Message("%v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/jberkenbilt/qfs/keyring"
+	"github.com/jberkenbilt/qfs/repofiles"
+)
+
+// keyringService is the service under which qfs stores credentials in the
+// keyring.
+const keyringService = "qfs"
+
+// keyringCredentials is what is stored in the keyring for an endpoint.
+type keyringCredentials struct {
+	AccessKeyId     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
+// WithKeyring sets the keyring used when .qfs/repo sets keyring. If nil, the
+// operating system's keyring is used.
+func WithKeyring(k keyring.Keyring) func(r *Repo) {
+	return func(r *Repo) {
+		if k != nil {
+			r.keyring = k
+		}
+	}
+}
+
+// keyringProvider is an aws.CredentialsProvider that reads static keys from the
+// keyring. Since they are read the first time they are needed, operations that
+// don't access the repository, such as Login, work without them.
+type keyringProvider struct {
+	keyring keyring.Keyring
+	account string
+}
+
+func (p *keyringProvider) Retrieve(context.Context) (aws.Credentials, error) {
+	data, err := p.keyring.Get(keyringService, p.account)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return aws.Credentials{}, fmt.Errorf("no credentials for %s in keyring; run \"qfs login\"", p.account)
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return aws.Credentials{}, err
+	}
+	var creds keyringCredentials
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		// TEST: NOT COVERED
+		return aws.Credentials{}, fmt.Errorf("credentials for %s in keyring are invalid: %w", p.account, err)
+	}
+	return aws.Credentials{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		Source:          "keyring",
+	}, nil
+}
+
+func (r *Repo) checkKeyring() error {
+	if r.keyringAccount == "" {
+		return fmt.Errorf("%s: keyring must be set to true to keep credentials in the keyring", repofiles.RepoConfig)
+	}
+	return nil
+}
+
+// Login stores static keys for the repository's endpoint in the keyring. They
+// are used by all sites on this computer whose .qfs/repo sets keyring and the
+// same endpoint. The keys are not checked.
+func (r *Repo) Login(accessKeyId, secretAccessKey string) error {
+	if err := r.checkKeyring(); err != nil {
+		return err
+	}
+	if accessKeyId == "" || secretAccessKey == "" {
+		return errors.New("an access key ID and a secret access key are required")
+	}
+	data, err := json.Marshal(&keyringCredentials{
+		AccessKeyId:     accessKeyId,
+		SecretAccessKey: secretAccessKey,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if err := r.keyring.Set(keyringService, r.keyringAccount, string(data)); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.ui.Message("stored credentials for %s in keyring", r.keyringAccount)
+	return nil
+}
+
+// Logout removes the keys stored by Login for the repository's endpoint.
+func (r *Repo) Logout() error {
+	if err := r.checkKeyring(); err != nil {
+		return err
+	}
+	err := r.keyring.Delete(keyringService, r.keyringAccount)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("there are no credentials for %s in keyring", r.keyringAccount)
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.ui.Message("removed credentials for %s from keyring", r.keyringAccount)
+	return nil
+}
@@ -0,0 +1,298 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// LockTTL is how long a lock remains valid without being refreshed. While an
+// operation holds the lock, a heartbeat refreshes it every LockTTL/4, so a lock
+// older than LockTTL was left behind by a process that is no longer running.
+var LockTTL = 10 * time.Minute
+
+// lockInfo is the content of the repository's "busy" object. It identifies
+// which process created it so that a stale lock can be safely removed.
+type lockInfo struct {
+	Site string    `json:"site"`
+	Host string    `json:"host"`
+	PID  int       `json:"pid"`
+	Time time.Time `json:"time"`
+}
+
+func (l *lockInfo) String() string {
+	if l.Host == "" {
+		// An empty object, as written by older versions of qfs
+		return fmt.Sprintf("unknown owner since %s", misc.FormatTime(l.Time))
+	}
+	return fmt.Sprintf(
+		"site %s on host %s (pid %d) since %s",
+		l.Site,
+		l.Host,
+		l.PID,
+		misc.FormatTime(l.Time),
+	)
+}
+
+func (l *lockInfo) expired() bool {
+	return time.Since(l.Time) > LockTTL
+}
+
+func newLockInfo(site string) *lockInfo {
+	host, err := os.Hostname()
+	if err != nil {
+		// TEST: NOT COVERED
+		host = "unknown"
+	}
+	return &lockInfo{
+		Site: site,
+		Host: host,
+		PID:  os.Getpid(),
+		Time: time.Now(),
+	}
+}
+
+// ownedBy returns true if l was created by the same site, host, and process as
+// other.
+func (l *lockInfo) ownedBy(other *lockInfo) bool {
+	return l.Site == other.Site && l.Host == other.Host && l.PID == other.PID
+}
+
+func (r *Repo) busyKey() string {
+	return path.Join(r.prefix, repofiles.Busy)
+}
+
+// readLock returns the current lock or nil if the repository is not locked.
+func (r *Repo) readLock() (*lockInfo, error) {
+	output, err := r.s3Client.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.busyKey()),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return nil, nil
+		}
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer func() { _ = output.Body.Close() }()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("read \"busy\" object: %w", err)
+	}
+	lock := &lockInfo{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		if output.LastModified != nil {
+			lock.Time = *output.LastModified
+		}
+		return lock, nil
+	}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3://%s/%s: %w", r.bucket, r.busyKey(), err)
+	}
+	return lock, nil
+}
+
+func (r *Repo) writeLock(lock *lockInfo) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	_, err = r.s3Client.PutObject(r.ctx, &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.busyKey()),
+		Body:   bytes.NewReader(append(data, '\n')),
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("create \"busy\" object: %w", err)
+	}
+	return nil
+}
+
+// createBusy acquires the repository lock on behalf of site and starts a
+// heartbeat that keeps it fresh until removeBusy or stopHeartbeat is called.
+// Every operation that modifies the repository calls it, so it also refuses to
+// run on a read-only site.
+func (r *Repo) createBusy(site string) error {
+	err := r.checkReadOnly()
+	if err != nil {
+		return err
+	}
+	err = r.checkBusy()
+	if err != nil {
+		return err
+	}
+	lock := newLockInfo(site)
+	err = r.writeLock(lock)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.startHeartbeat(lock)
+	return nil
+}
+
+// checkBusy returns an error if another process holds a lock on the
+// repository. An expired lock was probably left by an operation that didn't
+// finish, so the user is warned and asked whether to ignore it.
+func (r *Repo) checkBusy() error {
+	lock, err := r.readLock()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if lock == nil {
+		return nil
+	}
+	if r.heartbeat != nil && lock.ownedBy(r.heartbeat.lock) {
+		return nil
+	}
+	if lock.expired() {
+		if r.ignoredLock != nil && r.ignoredLock.ownedBy(lock) && r.ignoredLock.Time.Equal(lock.Time) {
+			// The user already chose to ignore it during this operation.
+			return nil
+		}
+		r.ui.Message(
+			"the repository lock held by %s has expired; that operation may not have"+
+				" finished, so the repository database may be inconsistent",
+			lock,
+		)
+		if !r.ui.Prompt("Ignore the expired lock?") {
+			return fmt.Errorf(
+				"repository is locked by %s; run qfs doctor or qfs unlock to remove the"+
+					" expired lock, and if it was left by a push, push again from that site",
+				lock,
+			)
+		}
+		r.ignoredLock = lock
+		return nil
+	}
+	return fmt.Errorf(
+		"s3://%s/%s exists; repository is locked by %s; if that process is gone, run qfs unlock",
+		r.bucket,
+		r.busyKey(),
+		lock,
+	)
+}
+
+// removeBusy removes the lock. This happens even if the operation's context
+// has been canceled so that an interrupted operation doesn't leave the
+// repository locked.
+func (r *Repo) removeBusy() error {
+	r.stopHeartbeat()
+	input := &s3.DeleteObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.busyKey()),
+	}
+	_, err := r.s3Client.DeleteObject(context.WithoutCancel(r.ctx), input)
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("remove \"busy\" object: %w", err)
+	}
+	return nil
+}
+
+type heartbeat struct {
+	lock *lockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (r *Repo) startHeartbeat(lock *lockInfo) {
+	r.stopHeartbeat()
+	h := &heartbeat{
+		lock: lock,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	r.heartbeat = h
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(LockTTL / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				// Don't recreate a lock that someone else has removed or taken over.
+				current, err := r.readLock()
+				if err != nil || current == nil || !current.ownedBy(lock) {
+					// TEST: NOT COVERED
+					r.ui.Message("repository lock is no longer held by this process")
+					return
+				}
+				lock.Time = time.Now()
+				if err = r.writeLock(lock); err != nil {
+					// TEST: NOT COVERED
+					r.ui.Message("refresh repository lock: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopHeartbeat stops refreshing the lock without removing it. It is safe to call
+// when no heartbeat is running.
+func (r *Repo) stopHeartbeat() {
+	if r.heartbeat == nil {
+		return
+	}
+	close(r.heartbeat.stop)
+	<-r.heartbeat.done
+	r.heartbeat = nil
+}
+
+// Unlock removes the repository lock. Without force, the lock must belong to
+// this site and host, and the process that created it must no longer be
+// running, unless the lock has expired.
+func (r *Repo) Unlock(force bool) error {
+	lock, err := r.readLock()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if lock == nil {
+		r.ui.Message("repository is not locked")
+		return nil
+	}
+	if !force && !lock.expired() {
+		site, err := r.currentSite()
+		if err != nil {
+			return err
+		}
+		me := newLockInfo(site)
+		if lock.Host == "" {
+			return fmt.Errorf("owner of lock is unknown; use -force to remove it")
+		}
+		if lock.Site != me.Site || lock.Host != me.Host {
+			return fmt.Errorf("repository is locked by %s; use -force to remove it", lock)
+		}
+		if lock.PID != me.PID && processRunning(lock.PID) {
+			return fmt.Errorf("process %d holding the lock is still running", lock.PID)
+		}
+	}
+	err = r.removeBusy()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.ui.Message("removed lock held by %s", lock)
+	return nil
+}
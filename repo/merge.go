@@ -0,0 +1,211 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/merge"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// mergedFile is the result of successfully merging local changes to a file with
+// changes from the repository.
+type mergedFile struct {
+	path     string
+	data     []byte
+	repoInfo *fileinfo.FileInfo
+}
+
+// mergeConflicts attempts a three-way merge of each file that has been changed
+// both locally and in the repository. The common ancestor is the version of the
+// file the site last had, which is retrieved from the repository using bucket
+// versioning. Successfully merged files are removed from the diff result's
+// checks and changes so they are neither reported as conflicts nor overwritten.
+// Nothing is written locally; see writeMerged.
+func (r *Repo) mergeConflicts(diffResult *diff.Result, mergeTool string) []*mergedFile {
+	localSrc := r.localSource()
+	changes := map[string]*fileinfo.FileInfo{}
+	for _, f := range diffResult.Change {
+		changes[f.Path] = f
+	}
+	var merged []*mergedFile
+	mergedPaths := map[string]struct{}{}
+	for _, ch := range diffResult.Check {
+		repoInfo, ok := changes[ch.Path]
+		if !ok || repoInfo.FileType != fileinfo.TypeFile {
+			continue
+		}
+		localInfo, err := localSrc.FileInfo(ch.Path)
+		if err != nil || localInfo.FileType != fileinfo.TypeFile {
+			continue
+		}
+		if slices.Contains(ch.ModTime, localInfo.ModTime.UnixMilli()) {
+			// Not a conflict
+			continue
+		}
+		data, clean, err := r.merge3(ch, repoInfo, mergeTool)
+		if err != nil {
+			r.ui.Message("%s: unable to merge: %v", ch.Path, err)
+			continue
+		}
+		if !clean {
+			r.ui.Message("%s: merge has conflicts", ch.Path)
+			continue
+		}
+		_, _ = fmt.Fprintf(r.ui.Output(), "merged: %s\n", ch.Path)
+		merged = append(merged, &mergedFile{
+			path:     ch.Path,
+			data:     data,
+			repoInfo: repoInfo,
+		})
+		mergedPaths[ch.Path] = struct{}{}
+	}
+	isMerged := func(path string) bool {
+		_, ok := mergedPaths[path]
+		return ok
+	}
+	diffResult.Check = slices.DeleteFunc(diffResult.Check, func(c *diff.Check) bool {
+		return isMerged(c.Path)
+	})
+	diffResult.Change = slices.DeleteFunc(diffResult.Change, func(f *fileinfo.FileInfo) bool {
+		return isMerged(f.Path)
+	})
+	return merged
+}
+
+// merge3 merges the local file with the repository's version using the version
+// identified by the check as the common ancestor.
+func (r *Repo) merge3(ch *diff.Check, repoInfo *fileinfo.FileInfo, mergeTool string) ([]byte, bool, error) {
+	base, err := os.CreateTemp("", "qfs-base-*")
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	defer func() { _ = os.Remove(base.Name()) }()
+	theirs, err := os.CreateTemp("", "qfs-theirs-*")
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	defer func() { _ = os.Remove(theirs.Name()) }()
+	err = r.downloadAncestor(ch, base)
+	_ = base.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	err = r.src.Download(ch.Path, repoInfo, theirs)
+	_ = theirs.Close()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	ours := r.localPath(ch.Path).Path()
+	if mergeTool != "" {
+		return runMergeTool(mergeTool, ours, base.Name(), theirs.Name())
+	}
+	var data [3][]byte
+	for i, path := range []string{base.Name(), ours, theirs.Name()} {
+		data[i], err = os.ReadFile(path)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, false, err
+		}
+	}
+	return merge.Merge3(data[0], data[1], data[2])
+}
+
+// downloadAncestor finds the most recent version of the file whose modification
+// time matches one of the times in the check and writes it to f. This only works
+// if versioning is enabled on the bucket since the ancestor's key will have been
+// deleted when the newer version was pushed.
+func (r *Repo) downloadAncestor(ch *diff.Check, f *os.File) error {
+	prefix := r.src.KeyFromPath(ch.Path, nil)
+	input := &s3.ListObjectVersionsInput{
+		Bucket: &r.bucket,
+		Prefix: &prefix,
+	}
+	var key, versionId string
+	var lastModified time.Time
+	paginator := s3.NewListObjectVersionsPaginator(r.s3Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(r.ctx)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		for _, v := range output.Versions {
+			info := r.src.KeyToFileInfo(*v.Key, 0)
+			if info == nil || info.Path != ch.Path || info.FileType != fileinfo.TypeFile {
+				continue
+			}
+			if !slices.Contains(ch.ModTime, info.ModTime.UnixMilli()) {
+				continue
+			}
+			if v.LastModified != nil && v.LastModified.After(lastModified) && v.VersionId != nil {
+				key = *v.Key
+				versionId = *v.VersionId
+				lastModified = *v.LastModified
+			}
+		}
+	}
+	if key == "" {
+		return errors.New("common ancestor is not in the repository; is bucket versioning enabled?")
+	}
+	return r.src.DownloadVersion(key, &versionId, f)
+}
+
+// runMergeTool runs a command such as `diff3 -m` or `git merge-file -p` with
+// the local, ancestor, and repository versions of a file as its last three
+// arguments. The merged result is read from standard output. A non-zero exit
+// status indicates that the merge was not clean.
+func runMergeTool(mergeTool, ours, base, theirs string) ([]byte, bool, error) {
+	words := strings.Fields(mergeTool)
+	if len(words) == 0 {
+		return nil, false, errors.New("merge tool is empty")
+	}
+	args := append(words[1:], ours, base, theirs)
+	cmd := exec.Command(words[0], args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.Bytes(), false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("run %s: %w", words[0], err)
+	}
+	return stdout.Bytes(), true, nil
+}
+
+// writeMerged replaces the local files with their merged contents and records
+// the repository versions in the site database so the files aren't pulled
+// again. The merged files are newer than the repository versions, so the next
+// push will send them.
+func (r *Repo) writeMerged(merged []*mergedFile, siteDb database.Database) error {
+	for _, m := range merged {
+		path := r.localPath(m.path).Path()
+		err := os.WriteFile(path, m.data, os.FileMode(m.repoInfo.Permissions))
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("write merged %s: %w", m.path, err)
+		}
+		err = os.Chmod(path, os.FileMode(m.repoInfo.Permissions))
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		info := *m.repoInfo
+		siteDb[m.path] = &info
+		r.ui.Message("wrote merged %s", m.path)
+	}
+	return nil
+}
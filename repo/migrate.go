@@ -0,0 +1,206 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"io/fs"
+	"net/url"
+)
+
+// MigrateReport describes what init-repo -migrate does to the keys that aws s3
+// sync stored. It is written as JSON with InitConfig.Report.
+type MigrateReport struct {
+	// Move lists the keys that are renamed to the keys qfs would use.
+	Move []*MigrateMove `json:"move"`
+	// Skip lists the keys that can't be migrated. Push uploads these files again,
+	// and clean-repo removes the keys.
+	Skip []*MigrateSkip `json:"skip"`
+	// There's no rename in S3, so each move is a server-side copy followed by a
+	// delete. Bytes is the total size of the objects that are copied.
+	Copies  int   `json:"copies"`
+	Deletes int   `json:"deletes"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type MigrateMove struct {
+	Key    string `json:"key"`
+	NewKey string `json:"newKey"`
+	Size   int64  `json:"size"`
+}
+
+type MigrateSkip struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// migrateReport decides which keys aws s3 sync would consider current. Like
+// aws s3 sync, it considers a key current if the local file has the same size
+// and is older than the object.
+func (r *Repo) migrateReport() *MigrateReport {
+	report := &MigrateReport{
+		Move: []*MigrateMove{},
+		Skip: []*MigrateSkip{},
+	}
+	extraKeys := r.src.ExtraKeys()
+	for _, key := range misc.SortedKeys(extraKeys) {
+		size, ok := r.src.ExtraKeySize(key)
+		if !ok {
+			// This key was stored by qfs and is left for clean-repo.
+			continue
+		}
+		skip := func(reason string) {
+			report.Skip = append(report.Skip, &MigrateSkip{Key: key, Reason: reason})
+		}
+		path := misc.RemovePrefix(key, r.prefix)
+		info, err := r.localPath(path).FileInfo()
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			skip("no local file")
+		case err != nil:
+			// TEST: NOT COVERED
+			skip(err.Error())
+		case info.FileType != fileinfo.TypeFile:
+			skip("local path is not a regular file")
+		case info.Size != size:
+			skip(fmt.Sprintf("local file size %d differs from object size %d", info.Size, size))
+		case !info.ModTime.Before(extraKeys[key]):
+			skip("local file is newer than object")
+		case size > maxCopySize:
+			// TEST: NOT COVERED
+			skip("object is too large to copy within S3")
+		default:
+			report.Move = append(report.Move, &MigrateMove{
+				Key:    key,
+				NewKey: r.src.KeyFromPath(path, info),
+				Size:   size,
+			})
+			report.Copies++
+			report.Deletes++
+			report.Bytes += size
+		}
+	}
+	return report
+}
+
+// showMigrateReport shows the keys that can't be migrated and the keys that are
+// moved and writes the report to a file if requested.
+func (r *Repo) showMigrateReport(report *MigrateReport, reportFile string) error {
+	if reportFile != "" {
+		if err := writeJSON(reportFile, report); err != nil {
+			return err
+		}
+		r.ui.Message("wrote migration report to %s", reportFile)
+	}
+	if len(report.Skip) > 0 {
+		r.ui.Message("----- keys that can't be migrated -----")
+		for _, s := range report.Skip {
+			_, _ = fmt.Fprintf(r.ui.Output(), "%s: %s\n", s.Key, s.Reason)
+		}
+		r.ui.Message("-----")
+	}
+	if len(report.Move) == 0 {
+		r.ui.Message("no keys to migrate")
+		return nil
+	}
+	r.ui.Message("----- keys to migrate -----")
+	for _, m := range report.Move {
+		_, _ = fmt.Fprintf(r.ui.Output(), "%s -> %s\n", m.Key, m.NewKey)
+	}
+	r.ui.Message("-----")
+	r.ui.Message(
+		"migration requires %d copies of %s within S3 and %d deletions",
+		report.Copies,
+		misc.FormatSize(report.Bytes),
+		report.Deletes,
+	)
+	return nil
+}
+
+// migrateNoOp shows what init-repo -migrate would do without changing the
+// repository.
+func (r *Repo) migrateNoOp(config *InitConfig) error {
+	if config.Mode != InitMigrate {
+		return errors.New("only migration can be done without modifying the repository")
+	}
+	err := r.loadRepoDb()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	_, err = r.src.Database(true, true, nil)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return r.showMigrateReport(r.migrateReport(), config.Report)
+}
+
+// migrateRepo renames objects stored by aws s3 sync as qfs would store them
+// and returns how many were renamed.
+func (r *Repo) migrateRepo(config *InitConfig) (int, error) {
+	report := r.migrateReport()
+	if err := r.showMigrateReport(report, config.Report); err != nil {
+		return 0, err
+	}
+	if len(report.Move) == 0 {
+		return 0, nil
+	}
+	if !r.ui.Prompt("Continue?") {
+		return 0, fmt.Errorf("exiting")
+	}
+
+	c := make(chan *MigrateMove, numWorkers)
+	go func() {
+		for _, m := range report.Move {
+			c <- m
+		}
+		close(c)
+	}()
+	misc.DoConcurrently(
+		func(c chan *MigrateMove, errorChan chan error) {
+			for x := range c {
+				r.ui.Message("moving %s -> %s", x.Key, x.NewKey)
+				copyInput := &s3.CopyObjectInput{
+					Bucket:     &r.bucket,
+					CopySource: aws.String(url.PathEscape(fmt.Sprintf("%s/%s", r.bucket, x.Key))),
+					Key:        &x.NewKey,
+				}
+				// There's no rename in S3, so we copy the object and, if successful, delete the old one.
+				_, err := r.s3Client.CopyObject(r.ctx, copyInput)
+				if err != nil {
+					// TEST: NOT COVERED
+					errorChan <- fmt.Errorf("copy %s -> %s: %w", x.Key, x.NewKey, err)
+					continue
+				}
+				deleteInput := &s3.DeleteObjectInput{
+					Bucket: &r.bucket,
+					Key:    &x.Key,
+				}
+				_, err = r.s3Client.DeleteObject(r.ctx, deleteInput)
+				if err != nil {
+					// TEST: NOT COVERED
+					errorChan <- fmt.Errorf("delete %s: %w", x.Key, err)
+					continue
+				}
+			}
+		},
+		func(e error) {
+			// TEST: NOT COVERED. This doesn't have to be an error; a later init-repo
+			// -cleanup and push will get everything in sync.
+			r.ui.Message("WARNING: %v", e)
+		},
+		c,
+		numWorkers,
+	)
+	var err error
+	r.repoDb, err = r.src.Database(true, true, nil)
+	if err != nil {
+		// TEST: NOT COVERED
+		return 0, err
+	}
+	return len(report.Move), nil
+}
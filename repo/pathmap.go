@@ -0,0 +1,42 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// readPathMap reads the site's path rules from .qfs/pathmap, which contains one
+// rule of the form `src=path dest=path` per line. Files are pushed, pulled, and
+// recorded in the site database at their source paths and stored locally at
+// their destination paths. See localsource.PathMap.
+func (r *Repo) readPathMap() error {
+	data, err := os.ReadFile(r.localPath(repofiles.PathMap).Path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	var rules []localsource.PathRule
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := localsource.ParsePathRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", repofiles.PathMap, i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	r.pathMap, err = localsource.NewPathMap(rules)
+	if err != nil {
+		return fmt.Errorf("%s: %w", repofiles.PathMap, err)
+	}
+	return nil
+}
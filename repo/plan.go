@@ -0,0 +1,282 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// A plan records the changes that push or pull would make so they can be
+// reviewed before they are applied. Applying a plan recomputes the changes
+// exactly as push or pull would and proceeds without prompting only if they are
+// the same as the ones in the plan, so a plan can't be used to make changes
+// that weren't reviewed.
+
+const planVersion = 1
+
+// Plan is the JSON form of a plan written with PushConfig.Plan or
+// PullConfig.Plan.
+type Plan struct {
+	Version   int       `json:"version"`
+	Operation string    `json:"operation"`
+	Site      string    `json:"site"`
+	Created   time.Time `json:"created"`
+	// Options that affect how the plan is applied
+	Paths         []string           `json:"paths,omitempty"`
+	Owners        bool               `json:"owners,omitempty"`
+	OwnerMap      *fileinfo.OwnerMap `json:"ownerMap,omitempty"`
+	LocalFilter   bool               `json:"localFilter,omitempty"`
+	BackupDir     string             `json:"backupDir,omitempty"`
+	DirTimes      bool               `json:"dirTimes,omitempty"`
+	MetadataOnly  bool               `json:"metadataOnly,omitempty"`
+	Renames       bool               `json:"renames,omitempty"`
+	NoPermissions bool               `json:"noPermissions,omitempty"`
+	// Changes and Conflicts are what must match when the plan is applied.
+	Changes   *PlanChanges `json:"changes"`
+	Conflicts []string     `json:"conflicts"`
+	// Bytes is the total size of the files that would be copied.
+	Bytes int64 `json:"bytes"`
+}
+
+type PlanChanges struct {
+	TypeChange []string          `json:"typeChange"`
+	Remove     []*PlanFile       `json:"remove"`
+	Rename     []*PlanRename     `json:"rename,omitempty"`
+	Add        []*PlanFile       `json:"add"`
+	Change     []*PlanFile       `json:"change"`
+	MetaChange []*PlanMetaChange `json:"metaChange"`
+}
+
+// PlanFile describes a file in a plan. Type is the file type as it appears in
+// a qfs database: f, d, or l for files, directories, and symbolic links.
+type PlanFile struct {
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"modTime"`
+	Permissions string `json:"permissions"`
+	Target      string `json:"target,omitempty"`
+}
+
+// PlanRename describes a renamed file. To describes the file at its new path.
+type PlanRename struct {
+	From string    `json:"from"`
+	To   *PlanFile `json:"to"`
+}
+
+type PlanMetaChange struct {
+	Path        string `json:"path"`
+	Target      string `json:"target,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+	ModTime     *int64 `json:"modTime,omitempty"`
+}
+
+func planFiles(files []*fileinfo.FileInfo) []*PlanFile {
+	result := []*PlanFile{}
+	for _, f := range files {
+		pf := &PlanFile{
+			Path:        f.Path,
+			Type:        string(f.FileType),
+			ModTime:     f.ModTime.UnixMilli(),
+			Permissions: fmt.Sprintf("%04o", f.Permissions),
+		}
+		switch f.FileType {
+		case fileinfo.TypeFile:
+			pf.Size = f.Size
+		case fileinfo.TypeLink:
+			pf.Target = f.Special
+		}
+		result = append(result, pf)
+	}
+	return result
+}
+
+func newPlan(operation, site string, diffResult *diff.Result, conflicts []string) *Plan {
+	c := &PlanChanges{
+		TypeChange: append([]string{}, diffResult.TypeChange...),
+		Remove:     planFiles(diffResult.Rm),
+		Add:        planFiles(diffResult.Add),
+		Change:     planFiles(diffResult.Change),
+		MetaChange: []*PlanMetaChange{},
+	}
+	for _, rn := range diffResult.Rename {
+		c.Rename = append(c.Rename, &PlanRename{
+			From: rn.Old.Path,
+			To:   planFiles([]*fileinfo.FileInfo{rn.New})[0],
+		})
+	}
+	for _, m := range diffResult.MetaChange {
+		pm := &PlanMetaChange{
+			Path:    m.Info.Path,
+			ModTime: m.DirTime,
+		}
+		if m.Target != nil {
+			pm.Target = *m.Target
+		}
+		if m.Permissions != nil {
+			pm.Permissions = fmt.Sprintf("%04o", *m.Permissions)
+		}
+		c.MetaChange = append(c.MetaChange, pm)
+	}
+	p := &Plan{
+		Version:   planVersion,
+		Operation: operation,
+		Site:      site,
+		Created:   time.Now(),
+		Changes:   c,
+		Conflicts: append([]string{}, conflicts...),
+	}
+	for _, list := range [][]*PlanFile{c.Add, c.Change} {
+		for _, f := range list {
+			p.Bytes += f.Size
+		}
+	}
+	return p
+}
+
+// reportConflicts reports conflicts and returns their paths without treating
+// them as errors. It is used when writing or applying a plan, which records the
+// conflicts for review instead.
+func (r *Repo) reportConflicts(
+	checks []*diff.Check,
+	getInfo func(path string) (*fileinfo.FileInfo, error),
+) ([]string, error) {
+	conflictPaths, err := findConflicts(checks, r.modifyWindow, getInfo)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	for _, path := range conflictPaths {
+		_, _ = fmt.Fprintf(r.ui.Output(), "conflict: %s\n", path)
+	}
+	if len(conflictPaths) == 0 {
+		r.ui.Message("no conflicts found")
+	}
+	return conflictPaths, nil
+}
+
+// writePlan writes plan to filename as JSON.
+func (r *Repo) writePlan(filename string, plan *Plan) error {
+	if plan.BackupDir != "" {
+		// The plan may be applied from a different directory.
+		dir, err := filepath.Abs(plan.BackupDir)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		plan.BackupDir = dir
+	}
+	if err := writeJSON(filename, plan); err != nil {
+		return err
+	}
+	r.ui.Message("wrote %s plan to %s", plan.Operation, filename)
+	return nil
+}
+
+// writeJSON replaces filename with the indented JSON form of v.
+func writeJSON(filename string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	f, err := misc.CreateAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Discard()
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if err = f.Commit(); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return nil
+}
+
+// checkPlan returns an error unless the changes and conflicts in approved are
+// the same as those in plan, which was just computed.
+func checkPlan(approved, plan *Plan) error {
+	a, err := json.Marshal(approved.Changes)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	b, err := json.Marshal(plan.Changes)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if string(a) != string(b) || !slices.Equal(approved.Conflicts, plan.Conflicts) {
+		return errors.New("the site or repository has changed since the plan was created; create a new plan")
+	}
+	return nil
+}
+
+// ReadPlan reads a plan written by Push or Pull.
+func ReadPlan(filename string) (*Plan, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	if err = json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s: not a valid plan: %w", filename, err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("%s: unsupported plan version %d", filename, plan.Version)
+	}
+	if plan.Changes == nil || (plan.Operation != "push" && plan.Operation != "pull") {
+		return nil, fmt.Errorf("%s: not a valid plan", filename)
+	}
+	return plan, nil
+}
+
+// ApplyPlan applies a plan written by Push or Pull. The changes are
+// recomputed with the options recorded in the plan, and if they differ from
+// the plan in any way, nothing is changed. Otherwise, the changes are applied
+// without prompting, including overriding any conflicts recorded in the plan.
+func (r *Repo) ApplyPlan(filename string) (*Result, error) {
+	plan, err := ReadPlan(filename)
+	if err != nil {
+		return nil, err
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		return nil, err
+	}
+	if plan.Site != site {
+		return nil, fmt.Errorf("%s: the plan is for site %s, but this is site %s", filename, plan.Site, site)
+	}
+	r.ui.Message("applying %s plan created at %s", plan.Operation, misc.FormatTime(plan.Created))
+	if plan.Operation == "push" {
+		return r.Push(&PushConfig{
+			Paths:         plan.Paths,
+			Owners:        plan.Owners,
+			DirTimes:      plan.DirTimes,
+			MetadataOnly:  plan.MetadataOnly,
+			Renames:       plan.Renames,
+			NoPermissions: plan.NoPermissions,
+			approved:      plan,
+		})
+	}
+	return r.Pull(&PullConfig{
+		LocalFilter:   plan.LocalFilter,
+		BackupDir:     plan.BackupDir,
+		Paths:         plan.Paths,
+		Owners:        plan.OwnerMap,
+		DirTimes:      plan.DirTimes,
+		Renames:       plan.Renames,
+		NoPermissions: plan.NoPermissions,
+		approved:      plan,
+	})
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package repo
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processRunning returns true if pid refers to a running process on this host.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package repo
+
+import (
+	"os"
+)
+
+// processRunning returns true if pid refers to a running process on this host.
+// On Windows, FindProcess opens a handle to the process, which fails if there is
+// no such process.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
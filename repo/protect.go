@@ -0,0 +1,138 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"path"
+	"strings"
+)
+
+// ErrProtected is returned by operations that permanently remove data from a
+// protected repository when the confirmation token wasn't given.
+var ErrProtected = errors.New("the repository is protected")
+
+// WithMFA supplies the serial number and current code of an MFA device, as
+// "serial code", for the requests that remove objects. This is required to
+// remove versions from a bucket that has MFA delete enabled. S3 only accepts it
+// over HTTPS.
+func WithMFA(mfa string) func(r *Repo) {
+	return func(r *Repo) {
+		r.mfa = mfa
+	}
+}
+
+// WithConfirmToken supplies the token that allows an operation to remove data
+// from a protected repository. See ConfirmToken.
+func WithConfirmToken(token string) func(r *Repo) {
+	return func(r *Repo) {
+		r.confirmToken = token
+	}
+}
+
+// ValidateMFA checks that mfa has the form required by WithMFA.
+func ValidateMFA(mfa string) error {
+	if len(strings.Fields(mfa)) != 2 {
+		return fmt.Errorf("MFA must be given as \"serial code\"")
+	}
+	return nil
+}
+
+func (r *Repo) protectedKey() string {
+	return path.Join(r.prefix, repofiles.Protected)
+}
+
+// Protected returns true if the repository is protected, in which case
+// operations that permanently remove data require a confirmation token.
+func (r *Repo) Protected() (bool, error) {
+	_, err := r.s3Client.HeadObject(r.ctx, &s3.HeadObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.protectedKey()),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		// TEST: NOT COVERED
+		return false, fmt.Errorf("check repository protection: %w", err)
+	}
+	return true, nil
+}
+
+// SetProtected protects the repository or removes its protection. Since the
+// protection is stored in the repository, it applies at every site. Removing
+// it requires the confirmation token for "remove protection".
+func (r *Repo) SetProtected(protected bool) error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	if protected {
+		_, err := r.s3Client.PutObject(r.ctx, &s3.PutObjectInput{
+			Bucket: &r.bucket,
+			Key:    aws.String(r.protectedKey()),
+			Body:   bytes.NewReader(nil),
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("protect repository: %w", err)
+		}
+		r.ui.Message("the repository is protected")
+		return nil
+	}
+	if err := r.checkProtected("remove protection"); err != nil {
+		return err
+	}
+	input := &s3.DeleteObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.protectedKey()),
+	}
+	if r.mfa != "" {
+		input.MFA = &r.mfa
+	}
+	_, err := r.s3Client.DeleteObject(r.ctx, input)
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("remove repository protection: %w", err)
+	}
+	r.ui.Message("the repository is no longer protected")
+	return nil
+}
+
+// ConfirmToken returns the token that must be given with WithConfirmToken to do
+// operation in a protected repository. The token depends on the operation and
+// the repository's location, so one that was given for something else doesn't
+// work.
+func (r *Repo) ConfirmToken(operation string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("s3://%s/%s\x00%s", r.bucket, r.prefix, operation)))
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+// checkProtected returns an error wrapping ErrProtected if the repository is
+// protected and the confirmation token for operation wasn't given. The error
+// includes the token so that the operation can be confirmed by running it
+// again.
+func (r *Repo) checkProtected(operation string) error {
+	protected, err := r.Protected()
+	if err != nil {
+		return err
+	}
+	if !protected {
+		return nil
+	}
+	token := r.ConfirmToken(operation)
+	if r.confirmToken == token {
+		return nil
+	}
+	return fmt.Errorf(
+		"%w; to %s anyway, run again with -confirm-token %s",
+		ErrProtected,
+		operation,
+		token,
+	)
+}
@@ -0,0 +1,269 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A quota limits the total size and number of the files, directories, and
+// links in the repository database, which are the current versions of
+// everything in the repository. Noncurrent versions and objects that qfs keeps
+// for itself, such as databases, aren't counted. The quota is stored in the
+// repository so that every site enforces it when pushing.
+
+// Quota is the repository's quota. A zero limit means no limit.
+type Quota struct {
+	Size    int64
+	Objects int64
+	// If WarnOnly is true, pushes that exceed the quota are allowed with a
+	// warning.
+	WarnOnly bool
+}
+
+// Usage is what a quota limits.
+type Usage struct {
+	Size    int64
+	Objects int64
+}
+
+// parseQuota parses a quota as written by Quota.String. filename is used in
+// error messages.
+func parseQuota(filename string, data string) (*Quota, error) {
+	q := &Quota{}
+	for i, line := range strings.Split(data, "\n") {
+		lineNo := i + 1
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 1 && fields[0] == "warn":
+			q.WarnOnly = true
+		case len(fields) == 2 && (fields[0] == "size" || fields[0] == "objects"):
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%s:%d: %s must be a positive number", filename, lineNo, fields[0])
+			}
+			if fields[0] == "size" {
+				q.Size = n
+			} else {
+				q.Objects = n
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: expected \"size bytes\", \"objects count\", or \"warn\"", filename, lineNo)
+		}
+	}
+	return q, nil
+}
+
+func (q *Quota) String() string {
+	var b strings.Builder
+	if q.Size > 0 {
+		_, _ = fmt.Fprintf(&b, "size %d\n", q.Size)
+	}
+	if q.Objects > 0 {
+		_, _ = fmt.Fprintf(&b, "objects %d\n", q.Objects)
+	}
+	if q.WarnOnly {
+		_, _ = fmt.Fprintln(&b, "warn")
+	}
+	return b.String()
+}
+
+// Describe returns a description of u relative to the quota.
+func (q *Quota) Describe(u *Usage) string {
+	var parts []string
+	percent := func(n, limit int64) int64 {
+		return (100*n + limit/2) / limit
+	}
+	if q.Size > 0 {
+		parts = append(parts, fmt.Sprintf(
+			"%s of %s (%d%%)",
+			misc.FormatSize(u.Size),
+			misc.FormatSize(q.Size),
+			percent(u.Size, q.Size),
+		))
+	} else {
+		parts = append(parts, misc.FormatSize(u.Size))
+	}
+	if q.Objects > 0 {
+		parts = append(parts, fmt.Sprintf(
+			"%d of %d objects (%d%%)",
+			u.Objects,
+			q.Objects,
+			percent(u.Objects, q.Objects),
+		))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d objects", u.Objects))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// exceeded returns a description of each limit that after exceeds. A limit
+// that is already exceeded doesn't count if after uses less than before, so
+// that it's always possible to push removals.
+func (q *Quota) exceeded(before, after *Usage) []string {
+	var result []string
+	if q.Size > 0 && after.Size > q.Size && after.Size > before.Size {
+		result = append(result, fmt.Sprintf("%s is more than %s", misc.FormatSize(after.Size), misc.FormatSize(q.Size)))
+	}
+	if q.Objects > 0 && after.Objects > q.Objects && after.Objects > before.Objects {
+		result = append(result, fmt.Sprintf("%d objects is more than %d", after.Objects, q.Objects))
+	}
+	return result
+}
+
+// quotaSize returns the size counted against the quota for info. Only files
+// have contents in the repository.
+func quotaSize(info *fileinfo.FileInfo) int64 {
+	if info.FileType == fileinfo.TypeFile {
+		return info.Size
+	}
+	return 0
+}
+
+func dbUsage(db database.Database) *Usage {
+	u := &Usage{}
+	for _, info := range db {
+		u.Size += quotaSize(info)
+		u.Objects++
+	}
+	return u
+}
+
+// afterPush returns the usage of a repository whose database is db after
+// pushing diffResult.
+func (u *Usage) afterPush(diffResult *diff.Result, db database.Database) *Usage {
+	result := *u
+	remove := func(p string) {
+		if info, ok := db[p]; ok {
+			result.Size -= quotaSize(info)
+			result.Objects--
+		}
+	}
+	for _, info := range diffResult.Rm {
+		remove(info.Path)
+	}
+	for _, r := range diffResult.Rename {
+		remove(r.Old.Path)
+		result.Size += quotaSize(r.New)
+		result.Objects++
+	}
+	for _, files := range [][]*fileinfo.FileInfo{diffResult.Add, diffResult.Change} {
+		for _, info := range files {
+			remove(info.Path)
+			result.Size += quotaSize(info)
+			result.Objects++
+		}
+	}
+	return &result
+}
+
+func (r *Repo) quotaKey() string {
+	return path.Join(r.prefix, repofiles.Quota)
+}
+
+// Quota returns the repository's quota or nil if it doesn't have one.
+func (r *Repo) Quota() (*Quota, error) {
+	output, err := r.s3Client.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.quotaKey()),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return nil, nil
+		}
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer func() { _ = output.Body.Close() }()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("read quota: %w", err)
+	}
+	return parseQuota(repofiles.Quota, string(data))
+}
+
+// SetQuota stores the quota in the repository, replacing any previous quota.
+// If q is nil, the repository's quota is removed.
+func (r *Repo) SetQuota(q *Quota) error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	if q == nil {
+		_, err := r.s3Client.DeleteObject(r.ctx, &s3.DeleteObjectInput{
+			Bucket: &r.bucket,
+			Key:    aws.String(r.quotaKey()),
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("remove quota: %w", err)
+		}
+		r.ui.Message("removed quota")
+		return nil
+	}
+	if q.Size <= 0 && q.Objects <= 0 {
+		return errors.New("a quota requires a size or a number of objects")
+	}
+	_, err := r.s3Client.PutObject(r.ctx, &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.quotaKey()),
+		Body:   bytes.NewReader([]byte(q.String())),
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("store quota: %w", err)
+	}
+	r.ui.Message("stored quota")
+	return nil
+}
+
+// QuotaUsage returns the repository's quota along with the repository's
+// current usage as counted by the quota. If the repository doesn't have a
+// quota, both are nil.
+func (r *Repo) QuotaUsage() (*Quota, *Usage, error) {
+	q, err := r.Quota()
+	if err != nil || q == nil {
+		return nil, nil, err
+	}
+	if err := r.loadRepoDb(); err != nil {
+		return nil, nil, err
+	}
+	return q, dbUsage(r.repoDb), nil
+}
+
+// checkQuota returns an error if pushing diffResult would exceed the
+// repository's quota. If the quota is only a warning, it shows the warning
+// instead.
+func (r *Repo) checkQuota(diffResult *diff.Result) error {
+	q, err := r.Quota()
+	if err != nil || q == nil {
+		return err
+	}
+	before := dbUsage(r.repoDb)
+	after := before.afterPush(diffResult, r.repoDb)
+	r.ui.Message("quota after push: %s", q.Describe(after))
+	exceeded := q.exceeded(before, after)
+	if len(exceeded) == 0 {
+		return nil
+	}
+	err = fmt.Errorf("push would exceed the repository's quota: %s", strings.Join(exceeded, "; "))
+	if q.WarnOnly {
+		r.ui.Message("WARNING: %v", err)
+		return nil
+	}
+	return err
+}
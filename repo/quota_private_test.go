@@ -0,0 +1,82 @@
+package repo
+
+import (
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"strings"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	q, err := parseQuota("quota", "size 1024\n\nobjects 10\nwarn\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if *q != (Quota{Size: 1024, Objects: 10, WarnOnly: true}) {
+		t.Errorf("wrong quota: %#v", q)
+	}
+	if q.String() != "size 1024\nobjects 10\nwarn\n" {
+		t.Errorf("wrong string:\n%s", q)
+	}
+	for data, exp := range map[string]string{
+		"size":          "quota:1: expected",
+		"\nobjects 0":   "quota:2: objects must be a positive number",
+		"size 1K":       "quota:1: size must be a positive number",
+		"warn\nbytes 3": "quota:2: expected",
+	} {
+		_, err := parseQuota("quota", data)
+		if err == nil || !strings.HasPrefix(err.Error(), exp) {
+			t.Errorf("%q: wrong error: %v", data, err)
+		}
+	}
+}
+
+func TestQuotaAfterPush(t *testing.T) {
+	file := func(path string, size int64) *fileinfo.FileInfo {
+		return &fileinfo.FileInfo{Path: path, FileType: fileinfo.TypeFile, Size: size}
+	}
+	dir := func(path string) *fileinfo.FileInfo {
+		return &fileinfo.FileInfo{Path: path, FileType: fileinfo.TypeDirectory, Size: 4096}
+	}
+	db := database.Database{}
+	for _, info := range []*fileinfo.FileInfo{
+		dir("a"),
+		file("a/one", 100),
+		file("a/two", 200),
+		file("a/three", 300),
+	} {
+		db[info.Path] = info
+	}
+	before := dbUsage(db)
+	if *before != (Usage{Size: 600, Objects: 4}) {
+		t.Errorf("wrong usage: %#v", before)
+	}
+	after := before.afterPush(
+		&diff.Result{
+			Rm:     []*fileinfo.FileInfo{file("a/one", 0)},
+			Rename: []*diff.Rename{{Old: file("a/two", 200), New: file("b/two", 200)}},
+			Add:    []*fileinfo.FileInfo{dir("b"), file("b/four", 1000)},
+			Change: []*fileinfo.FileInfo{file("a/three", 30)},
+		},
+		db,
+	)
+	if *after != (Usage{Size: 1230, Objects: 5}) {
+		t.Errorf("wrong usage after push: %#v", after)
+	}
+
+	q := &Quota{Size: 1000, Objects: 5}
+	if x := q.exceeded(before, after); len(x) != 1 || x[0] != "1.2K is more than 1000" {
+		t.Errorf("wrong result: %#v", x)
+	}
+	// Going down is fine even when still over.
+	if x := q.exceeded(&Usage{Size: 2000, Objects: 6}, after); len(x) != 0 {
+		t.Errorf("wrong result: %#v", x)
+	}
+	if s := q.Describe(after); s != "1.2K of 1000 (123%), 5 of 5 objects (100%)" {
+		t.Errorf("wrong description: %s", s)
+	}
+	if s := (&Quota{Objects: 10}).Describe(after); s != "1.2K, 5 of 10 objects (50%)" {
+		t.Errorf("wrong description: %s", s)
+	}
+}
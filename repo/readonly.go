@@ -0,0 +1,152 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// ErrReadOnly is returned by operations that would modify the repository from
+// a read-only site.
+var ErrReadOnly = errors.New(
+	"this site is read-only; it may pull from the repository but may not change it",
+)
+
+// readOnly returns true if the site has been marked read-only by creating
+// .qfs/readonly.
+func (r *Repo) readOnly() bool {
+	_, err := os.Stat(r.localPath(repofiles.ReadOnly).Path())
+	return err == nil
+}
+
+// checkReadOnly returns ErrReadOnly if the site has been marked read-only.
+func (r *Repo) checkReadOnly() error {
+	if r.readOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// checkWritable returns ErrReadOnly if the site has been marked read-only or if
+// its credentials don't allow it to write to the repository. It finds out by
+// writing an empty canary object only if it doesn't already exist, so S3
+// checks permission without creating a new version each time. This makes it
+// possible to report a read-only site before transferring anything.
+func (r *Repo) checkWritable() error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	_, err := r.s3Client.PutObject(r.ctx, &s3.PutObjectInput{
+		Bucket:      &r.bucket,
+		Key:         aws.String(path.Join(r.prefix, repofiles.Canary)),
+		Body:        bytes.NewReader(nil),
+		IfNoneMatch: aws.String("*"),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			// The canary already exists, and we're allowed to write.
+			return nil
+		case "AccessDenied":
+			return fmt.Errorf("%w (%s)", ErrReadOnly, apiErr.ErrorMessage())
+		}
+	}
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("check write access to repository: %w", err)
+	}
+	return nil
+}
+
+// policyStatement is a statement in an IAM policy document.
+type policyStatement struct {
+	Effect    string                       `json:"Effect"`
+	Action    []string                     `json:"Action"`
+	Resource  string                       `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// ReadOnlyPolicy returns an IAM policy that allows only what a read-only site
+// needs to pull from the repository. Attach it to the credentials used by sites
+// that must never change the repository.
+func (r *Repo) ReadOnlyPolicy() ([]byte, error) {
+	prefix := r.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	policy := struct {
+		Version   string             `json:"Version"`
+		Statement []*policyStatement `json:"Statement"`
+	}{
+		Version: "2012-10-17",
+		Statement: []*policyStatement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"s3:ListBucket", "s3:ListBucketVersions"},
+				Resource: "arn:aws:s3:::" + r.bucket,
+				Condition: map[string]map[string]string{
+					"StringLike": {"s3:prefix": prefix + "*"},
+				},
+			},
+			{
+				Effect: "Allow",
+				Action: []string{
+					"s3:GetObject",
+					"s3:GetObjectVersion",
+					"s3:GetObjectTagging",
+					"s3:GetObjectVersionTagging",
+				},
+				Resource: "arn:aws:s3:::" + r.bucket + "/" + prefix + "*",
+			},
+		},
+	}
+	if r.accelerate {
+		// The S3 client checks that transfer acceleration is enabled.
+		policy.Statement = append(policy.Statement, &policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"s3:GetAccelerateConfiguration"},
+			Resource: "arn:aws:s3:::" + r.bucket,
+		})
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// storeSiteDb records the site database at localSiteFile, written by pull, in
+// the repository. A read-only site can't, so pull keeps the local copy, and the
+// next pull uses it in place of the repository's copy.
+func (r *Repo) storeSiteDb(site string) error {
+	if r.readOnly() {
+		r.ui.Message("read-only site; keeping site database locally")
+		return nil
+	}
+	err := r.storeSiteDbChecked(site, repofiles.TempSiteDb(site))
+	if err != nil {
+		return fmt.Errorf("update site database in repository: %w", err)
+	}
+	r.ui.Message("updated repository copy of site database to reflect changes")
+	return nil
+}
+
+// readOnlySiteDbExists returns true if a read-only site has kept its own copy
+// of its database.
+func (r *Repo) readOnlySiteDbExists(site string) bool {
+	if !r.readOnly() {
+		return false
+	}
+	_, err := os.Stat(r.localPath(repofiles.TempSiteDb(site)).Path())
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,360 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"io/fs"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type ReplicateConfig struct {
+	// Dest is the destination in the form s3://bucket/prefix.
+	Dest string
+	// Versions causes noncurrent versions and delete markers to be copied as well
+	// as current objects.
+	Versions bool
+}
+
+// maxCopySize is the largest object S3 can copy with CopyObject. Larger objects
+// are copied in copyPartSize pieces using a multipart upload.
+var maxCopySize int64 = 5 * 1024 * 1024 * 1024
+var copyPartSize int64 = 512 * 1024 * 1024
+
+// replicaObject is a single version of an object to be replicated.
+type replicaObject struct {
+	key          string
+	versionId    *string
+	size         int64
+	lastModified time.Time
+	isDelete     bool
+}
+
+// Replicate copies the repository to another S3 location using server-side
+// copies. The repository database is copied last, so an interrupted replication
+// can be rerun, and the destination's database is checked against the
+// destination's contents afterward.
+func (r *Repo) Replicate(config *ReplicateConfig) error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	m := s3Re.FindStringSubmatch(strings.TrimSuffix(config.Dest, "/"))
+	if m == nil || m[2] == "" {
+		return fmt.Errorf("replication destination must be s3://bucket/prefix")
+	}
+	destBucket := m[1]
+	destPrefix := m[2]
+	if destBucket == r.bucket && destPrefix == r.prefix {
+		return fmt.Errorf("replication destination is the same as the repository")
+	}
+	destSrc, err := s3source.New(
+		destBucket,
+		destPrefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = fileinfo.NewPath(destSrc, repofiles.RepoDb()).FileInfo()
+	if err == nil {
+		return fmt.Errorf("s3://%s/%s already contains a repository", destBucket, destPrefix)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		// TEST: NOT COVERED
+		return err
+	}
+
+	err = r.loadRepoDb()
+	if err != nil {
+		return err
+	}
+	if !r.initialized {
+		return errors.New("repository is not initialized")
+	}
+	site, _ := r.currentSite()
+	err = r.createBusy(site)
+	if err != nil {
+		return err
+	}
+	defer r.stopHeartbeat()
+
+	objects, err := r.replicaObjects(config.Versions)
+	if err != nil {
+		return err
+	}
+	// Copy the repository database last. Group versions by key so each key's
+	// versions can be copied in order.
+	var keys, dbKeys []string
+	byKey := map[string][]*replicaObject{}
+	for _, obj := range objects {
+		if _, seen := byKey[obj.key]; !seen {
+			info := r.src.KeyToFileInfo(obj.key, 0)
+			if info != nil && info.Path == repofiles.RepoDb() {
+				dbKeys = append(dbKeys, obj.key)
+			} else {
+				keys = append(keys, obj.key)
+			}
+		}
+		byKey[obj.key] = append(byKey[obj.key], obj)
+	}
+	destKey := func(key string) string {
+		return destPrefix + strings.TrimPrefix(key, r.prefix)
+	}
+	var allErrors []error
+	for _, group := range [][]string{keys, dbKeys} {
+		c := make(chan string, numWorkers)
+		go func() {
+			for _, key := range group {
+				c <- key
+			}
+			close(c)
+		}()
+		misc.DoConcurrently(
+			func(c chan string, errorChan chan error) {
+				for key := range c {
+					if r.ctx.Err() != nil {
+						continue
+					}
+					ok := true
+					for _, obj := range byKey[key] {
+						if err := r.replicate(obj, destBucket, destKey(key)); err != nil {
+							errorChan <- err
+							ok = false
+							break
+						}
+					}
+					if ok {
+						_, _ = fmt.Fprintf(r.ui.Output(), "copied %s\n", misc.RemovePrefix(key, r.prefix))
+					}
+				}
+			},
+			func(e error) {
+				allErrors = append(allErrors, e)
+			},
+			c,
+			numWorkers,
+		)
+		if err := r.ctx.Err(); err != nil {
+			// Unless the database was already copied, replication can be rerun.
+			_ = r.removeBusy()
+			return fmt.Errorf("replication interrupted: %w", err)
+		}
+		if len(allErrors) > 0 {
+			// Don't copy the database if anything else failed.
+			_ = r.removeBusy()
+			return errors.Join(allErrors...)
+		}
+	}
+	err = r.removeBusy()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return r.validateReplica(destSrc, destBucket, destPrefix)
+}
+
+// replicaObjects returns the objects to replicate sorted by key and, within
+// each key, from oldest to newest.
+func (r *Repo) replicaObjects(versions bool) ([]*replicaObject, error) {
+	prefix := r.prefix + "/"
+	busy := r.busyKey()
+	var objects []*replicaObject
+	add := func(key *string, versionId *string, size *int64, lastModified *time.Time, isDelete bool) {
+		if *key == busy {
+			return
+		}
+		obj := &replicaObject{
+			key:       *key,
+			versionId: versionId,
+			isDelete:  isDelete,
+		}
+		if size != nil {
+			obj.size = *size
+		}
+		if lastModified != nil {
+			obj.lastModified = *lastModified
+		}
+		objects = append(objects, obj)
+	}
+	if versions {
+		paginator := s3.NewListObjectVersionsPaginator(r.s3Client, &s3.ListObjectVersionsInput{
+			Bucket: &r.bucket,
+			Prefix: &prefix,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(r.ctx)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, fmt.Errorf("list versions in s3://%s/%s: %w", r.bucket, prefix, err)
+			}
+			for _, v := range page.Versions {
+				add(v.Key, v.VersionId, v.Size, v.LastModified, false)
+			}
+			for _, d := range page.DeleteMarkers {
+				add(d.Key, d.VersionId, nil, d.LastModified, true)
+			}
+		}
+	} else {
+		paginator := s3.NewListObjectsV2Paginator(r.s3Client, &s3.ListObjectsV2Input{
+			Bucket: &r.bucket,
+			Prefix: &prefix,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(r.ctx)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, fmt.Errorf("list objects in s3://%s/%s: %w", r.bucket, prefix, err)
+			}
+			for _, obj := range page.Contents {
+				add(obj.Key, nil, obj.Size, obj.LastModified, false)
+			}
+		}
+	}
+	slices.SortStableFunc(objects, func(a, b *replicaObject) int {
+		if c := strings.Compare(a.key, b.key); c != 0 {
+			return c
+		}
+		return a.lastModified.Compare(b.lastModified)
+	})
+	return objects, nil
+}
+
+// replicate copies a single object version to the destination. Delete markers
+// are replicated by deleting the destination object.
+func (r *Repo) replicate(obj *replicaObject, destBucket, destKey string) error {
+	if obj.isDelete {
+		_, err := r.s3Client.DeleteObject(r.ctx, &s3.DeleteObjectInput{
+			Bucket: &destBucket,
+			Key:    &destKey,
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("delete s3://%s/%s: %w", destBucket, destKey, err)
+		}
+		return nil
+	}
+	if obj.size > maxCopySize {
+		return r.copyInParts(obj, destBucket, destKey)
+	}
+	_, err := r.s3Client.CopyObject(r.ctx, &s3.CopyObjectInput{
+		Bucket:     &destBucket,
+		Key:        &destKey,
+		CopySource: s3source.CopySource(r.bucket, obj.key, obj.versionId),
+	})
+	if err != nil {
+		return fmt.Errorf("copy s3://%s/%s to s3://%s/%s: %w", r.bucket, obj.key, destBucket, destKey, err)
+	}
+	return nil
+}
+
+// copyInParts copies an object that is too large for CopyObject. Unlike
+// CopyObject, a multipart upload doesn't copy metadata or tags, so they are
+// copied explicitly.
+func (r *Repo) copyInParts(obj *replicaObject, destBucket, destKey string) error {
+	head, err := r.s3Client.HeadObject(r.ctx, &s3.HeadObjectInput{
+		Bucket:    &r.bucket,
+		Key:       &obj.key,
+		VersionId: obj.versionId,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("get metadata for s3://%s/%s: %w", r.bucket, obj.key, err)
+	}
+	tags, err := r.src.Tags(obj.key, obj.versionId)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	tagging := url.Values{}
+	for k, v := range tags {
+		tagging.Set(k, v)
+	}
+	create, err := r.s3Client.CreateMultipartUpload(r.ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &destBucket,
+		Key:         &destKey,
+		Metadata:    head.Metadata,
+		ContentType: head.ContentType,
+		Tagging:     aws.String(tagging.Encode()),
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("start copy of s3://%s/%s: %w", r.bucket, obj.key, err)
+	}
+	abort := func(err error) error {
+		_, _ = r.s3Client.AbortMultipartUpload(r.ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &destBucket,
+			Key:      &destKey,
+			UploadId: create.UploadId,
+		})
+		return fmt.Errorf("copy s3://%s/%s to s3://%s/%s: %w", r.bucket, obj.key, destBucket, destKey, err)
+	}
+	var parts []types.CompletedPart
+	for start, part := int64(0), int32(1); start < obj.size; start, part = start+copyPartSize, part+1 {
+		end := min(start+copyPartSize, obj.size) - 1
+		output, err := r.s3Client.UploadPartCopy(r.ctx, &s3.UploadPartCopyInput{
+			Bucket:          &destBucket,
+			Key:             &destKey,
+			UploadId:        create.UploadId,
+			PartNumber:      aws.Int32(part),
+			CopySource:      s3source.CopySource(r.bucket, obj.key, obj.versionId),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       output.CopyPartResult.ETag,
+			PartNumber: aws.Int32(part),
+		})
+	}
+	_, err = r.s3Client.CompleteMultipartUpload(r.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &destBucket,
+		Key:             &destKey,
+		UploadId:        create.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return abort(err)
+	}
+	return nil
+}
+
+// validateReplica checks that the replicated repository database matches the
+// contents of the destination.
+func (r *Repo) validateReplica(destSrc *s3source.S3Source, destBucket, destPrefix string) error {
+	destDb, err := readRepoDb(destSrc)
+	if err != nil {
+		return fmt.Errorf("load replicated repository database: %w", err)
+	}
+	scanned, err := destSrc.Database(true, true, nil)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	diffResult, err := makeDiff(nil).Run(destDb, scanned)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if n := diffResult.NumChanges(); n > 0 {
+		return fmt.Errorf(
+			"s3://%s/%s: replicated repository database differs from contents in %d places",
+			destBucket,
+			destPrefix,
+			n,
+		)
+	}
+	r.ui.Message("replicated repository database matches s3://%s/%s", destBucket, destPrefix)
+	return nil
+}
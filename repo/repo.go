@@ -1,33 +1,34 @@
 package repo
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/jberkenbilt/qfs/database"
 	"github.com/jberkenbilt/qfs/diff"
 	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/keyring"
 	"github.com/jberkenbilt/qfs/localsource"
 	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3lister"
 	"github.com/jberkenbilt/qfs/s3source"
 	"github.com/jberkenbilt/qfs/sync"
 	"github.com/jberkenbilt/qfs/traverse"
+	"io"
 	"io/fs"
 	"maps"
-	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
 	"sort"
 	"strings"
+	gosync "sync"
 	"time"
 )
 
@@ -36,6 +37,7 @@ const ScanPrefix = "repo:"
 type Options func(*Repo)
 
 type Repo struct {
+	ctx              context.Context
 	localTop         string
 	bucket           string
 	prefix           string
@@ -43,30 +45,244 @@ type Repo struct {
 	initialized      bool
 	src              *s3source.S3Source
 	repoDb           database.Database
+	repoDbInfo       *fileinfo.FileInfo
+	repoDbVersion    *objectVersion
+	siteDbVersion    *objectVersion
 	downloadedRepoDb bool
+	shardIndex       shardIndex
+	heartbeat        *heartbeat
+	ignoredLock      *lockInfo // expired lock the user chose to ignore
+	ui               misc.UI
+	retryPolicy      s3source.RetryPolicy
+	layout           s3source.Layout
+	chunkSize        int64
+	auditMode        string
+	shardDb          bool
+	objectLock       *s3source.ObjectLock
+	accelerate       bool
+	birthTimes       bool
+	nanoseconds      bool
+	mfa              string
+	confirmToken     string
+	// keyVersion is the version of the repository's keys, which is recorded in
+	// the header of the repository database, or 0 if it isn't known.
+	keyVersion int
+	// offline is set by WithOffline.
+	offline bool
+	// modifyWindow is set by WithModifyWindow.
+	modifyWindow time.Duration
+	// keyring holds credentials if .qfs/repo sets keyring, in which case
+	// keyringAccount is the account they are stored under.
+	keyring        keyring.Keyring
+	keyringAccount string
+	// pathMap is read from .qfs/pathmap.
+	pathMap *localsource.PathMap
+}
+
+// ErrRepoChanged indicates that another site updated the repository database
+// after this operation loaded it.
+var ErrRepoChanged = errors.New("repository changed; pull and retry")
+
+// objectVersion identifies a specific version of the object that holds the
+// repository database or a site database. Since the modification time is part
+// of the key, a new upload always results in a new key, so the key and ETag are
+// both recorded.
+type objectVersion struct {
+	key       string
+	eTag      string
+	versionId string
+}
+
+func (v *objectVersion) String() string {
+	if v == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s (etag %s)", v.key, v.eTag)
+}
+
+func (v *objectVersion) equal(other *objectVersion) bool {
+	if v == nil || other == nil {
+		return v == other
+	}
+	return v.key == other.key && v.eTag == other.eTag
 }
 
 type PushConfig struct {
 	Cleanup bool
 	NoOp    bool
+	// If Paths is given, only those paths, relative to the top of the site, are
+	// scanned and pushed.
+	Paths []string
+	// Owners causes the ownership of each pushed file to be saved in the
+	// repository so it can be restored by pull or get.
+	Owners bool
+	// DirTimes causes changes to directory modification times to be pushed.
+	// Otherwise, a directory's modification time is only updated in the
+	// repository when the directory is added or its permissions change.
+	DirTimes bool
+	// ClampFutureMtimes causes files whose modification times are in the future to
+	// be given the current time, both locally and in the repository, before
+	// changes are computed. Otherwise, such files are reported but pushed as is.
+	ClampFutureMtimes bool
+	// MetadataOnly causes only changes that leave files' contents alone, such as
+	// permission changes and modification time changes of files whose contents
+	// are the same, to be pushed. Such files are copied to their new keys within
+	// S3 rather than uploaded again. Other changes are left for a later push.
+	MetadataOnly bool
+	// Renames causes files that were moved or renamed locally to be copied to
+	// their new locations within S3 instead of being uploaded again. See
+	// diff.WithRenames.
+	Renames bool
+	// NoPermissions causes permission changes to be ignored. Files whose contents
+	// change are still pushed with their current permissions. See
+	// diff.WithNoPermissions.
+	NoPermissions bool
+	// If MaxTransfer is not zero, the push fails without changing anything if
+	// the files to be uploaded total more than MaxTransfer bytes.
+	MaxTransfer int64
+	// If Plan is given, the changes are written to it as JSON for later use with
+	// ApplyPlan, and the repository is not modified.
+	Plan string
+	// KeepGoing causes files that can't be stored to be reported at the end
+	// instead of stopping the push. The changes that were pushed are recorded,
+	// and the push fails so that the rest can be pushed later.
+	KeepGoing bool
+	// approved is set by ApplyPlan.
+	approved *Plan
 }
 
 type PullConfig struct {
 	NoOp        bool
 	LocalFilter bool
+	// Merge enables three-way merging of files changed both locally and in the
+	// repository. If MergeTool is given, it is used instead of the internal merge.
+	Merge     bool
+	MergeTool string
+	// If BackupDir is given, files that would be removed or overwritten are moved
+	// into a timestamped subdirectory of it instead. It must be on the same file
+	// system as the site.
+	BackupDir string
+	// If Paths is given, only changes to those paths, relative to the top of the
+	// site, are pulled.
+	Paths []string
+	// If Owners is given and we are running as root, pulled files are given the
+	// ownership saved when they were pushed, mapped through Owners.
+	Owners *fileinfo.OwnerMap
+	// DirTimes causes directories to be given the modification times recorded in
+	// the repository after their contents are pulled.
+	DirTimes bool
+	// Renames causes files that were moved or renamed in the repository to be
+	// moved locally instead of being downloaded again. See diff.WithRenames.
+	Renames bool
+	// NoPermissions causes permission changes to be ignored, so nothing is
+	// chmodded. Files that are downloaded still get the repository's permissions.
+	NoPermissions bool
+	// If MaxTransfer is not zero, the pull fails without changing anything if
+	// the files to be downloaded total more than MaxTransfer bytes.
+	MaxTransfer int64
+	// If the site's file system ignores case, files that differ only in case
+	// from other files are reported as case collisions, and the pull fails.
+	// RenameCaseCollisions causes them to be pulled under different names
+	// instead. See sync.CaseRenames.
+	RenameCaseCollisions bool
+	// DeleteExcluded causes the site's copies of files in the repository that
+	// the filters exclude to be removed after confirmation. Files that differ
+	// from the repository's copies are kept. If BackupDir is given, removed files
+	// are moved there.
+	DeleteExcluded bool
+	// Stage causes changed files to be downloaded into .qfs/stage before the
+	// site is modified. They are moved into place, and other changes are applied,
+	// only once everything has been downloaded. See sync.ApplyConfig.StageDir.
+	Stage bool
+	// If Plan is given, the changes are written to it as JSON for later use with
+	// ApplyPlan, and the local site is not modified. It can't be used with Merge.
+	Plan string
+	// KeepGoing causes files that can't be retrieved to be reported at the end
+	// instead of stopping the pull. See sync.ApplyConfig.Failures. The changes
+	// that were pulled are recorded, and the pull fails so that the rest can be
+	// pulled later.
+	KeepGoing bool
+	// Schedule determines the order in which files are downloaded. See
+	// sync.Schedule.
+	Schedule sync.Schedule
+	// approved is set by ApplyPlan.
+	approved *Plan
+}
+
+// Result describes what Push or Pull found. With NoOp, nothing was changed.
+type Result struct {
+	// Changes is the difference between the site and the repository.
+	Changes *diff.Result
+	// Conflicts lists the paths of failed conflict checks, including any that were
+	// overridden.
+	Conflicts []string
+	// Merged lists the paths of files merged by Pull.
+	Merged []string
+	// CaseCollisions lists files that Pull would add that differ only in case
+	// from other files on a site whose file system ignores case.
+	CaseCollisions []*sync.CaseCollision
+	// Excluded lists files removed, or with NoOp that would be removed, by Pull
+	// with DeleteExcluded.
+	Excluded []string
+	// Transfer estimates how much would be or was copied.
+	Transfer *TransferEstimate
 }
 
 type InitMode int
 
+type InitConfig struct {
+	Mode InitMode
+	// NoOp, with InitMigrate, reports what would be migrated without changing
+	// anything in the repository.
+	NoOp bool
+	// Report, with InitMigrate, is a file to which a MigrateReport is written as
+	// JSON.
+	Report string
+}
+
 type ListVersionsConfig struct {
-	AsOf    time.Time
-	Long    bool
+	AsOf     time.Time
+	Long     bool
+	ShowSite bool
+	Filters  []*filter.Filter
+}
+
+type DiffVersionsConfig struct {
+	From    time.Time
+	To      time.Time
 	Filters []*filter.Filter
 }
 
 type GetConfig struct {
 	AsOf    time.Time
 	Filters []*filter.Filter
+	// If Owners is given and we are running as root, retrieved files are given the
+	// ownership saved when they were pushed, mapped through Owners.
+	Owners *fileinfo.OwnerMap
+	// If Stdout is true, the path must be a regular file, and its contents are
+	// written to the UI's output instead of being saved. The save location is
+	// ignored.
+	Stdout bool
+	// DirTimes causes retrieved directories to be given the modification times
+	// recorded in the repository.
+	DirTimes bool
+	// KeepGoing causes files that can't be retrieved to be reported at the end
+	// instead of stopping the retrieval.
+	KeepGoing bool
+	// If VersionId is given, the path must be a single file, directory, or link,
+	// and that exact version of it is retrieved. It can't be combined with AsOf
+	// or DeletedOnly.
+	VersionId string
+	// DeletedOnly causes only files that are currently deleted to be retrieved,
+	// each at the last version before it was deleted.
+	DeletedOnly bool
+}
+
+func (config *GetConfig) check() error {
+	if config.VersionId != "" && (config.DeletedOnly || !config.AsOf.IsZero()) {
+		return errors.New("a version ID can't be combined with a time or with deleted-only")
+	}
+	return nil
 }
 
 type versionData struct {
@@ -75,6 +291,8 @@ type versionData struct {
 	lastModified time.Time
 	isDelete     bool
 	info         *fileinfo.FileInfo
+	site         string
+	birthTime    time.Time
 }
 
 func cmpVersionData(a, b *versionData) int {
@@ -102,34 +320,76 @@ const (
 
 const numWorkers = 10
 
+// Tags applied to objects stored in the repository to record their provenance
+const (
+	TagSite = "qfs-site"
+	TagTime = "qfs-time"
+)
+
 var s3Re = regexp.MustCompile(`^s3://([^/]+)/(.*)\n?$`)
-var ctx = context.Background()
 
 func New(options ...Options) (*Repo, error) {
-	r := &Repo{}
+	r := newRepo(options)
+	if err := r.configure(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newRepo returns a Repo with the given options applied but without reading the
+// repository configuration.
+func newRepo(options []Options) *Repo {
+	r := &Repo{
+		ctx:         context.Background(),
+		ui:          misc.ConsoleUI{},
+		retryPolicy: s3source.DefaultRetryPolicy,
+		keyring:     keyring.System(),
+	}
 	for _, fn := range options {
 		fn(r)
 	}
+	return r
+}
+
+// configure reads the repository configuration and creates the S3 client.
+func (r *Repo) configure() error {
 	data, err := os.ReadFile(r.localPath(repofiles.RepoConfig).Path())
 	if err != nil {
-		return nil, err
+		return err
 	}
-	m := s3Re.FindSubmatch(data)
-	if m == nil {
-		return nil, fmt.Errorf("%s must contain s3://bucket/prefix", repofiles.RepoConfig)
+	if err := r.applyConfig(string(data)); err != nil {
+		return err
+	}
+	return r.readPathMap()
+}
+
+// applyConfig applies the contents of a repository configuration file and
+// creates the S3 client.
+func (r *Repo) applyConfig(data string) error {
+	c, err := parseRepoConfig(data, r.retryPolicy)
+	if err != nil {
+		return err
 	}
-	r.bucket = string(m[1])
-	r.prefix = string(m[2])
+	r.bucket = c.bucket
+	r.prefix = c.prefix
+	r.retryPolicy = c.retry
+	r.layout = c.layout
+	r.chunkSize = c.chunkSize
+	r.auditMode = c.audit
+	r.shardDb = c.shardDb
+	r.objectLock = c.objectLock()
+	r.accelerate = c.accel
+	r.keyringAccount = c.keyringAccount()
 	if r.s3Client == nil {
-		// TEST: NOT COVERED. We don't have any automated tests that use a real S3
-		// bucket.
-		cfg, err := config.LoadDefaultConfig(ctx)
+		r.s3Client, err = c.s3Client(r.ctx, r.keyring)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		r.s3Client = s3.NewFromConfig(cfg)
 	}
-	return r, nil
+	// All operations, including those of the sources created from this client,
+	// are retried the same way.
+	r.s3Client = r.retryPolicy.Client(r.s3Client)
+	return nil
 }
 
 func WithLocalTop(path string) func(r *Repo) {
@@ -145,189 +405,202 @@ func WithS3Client(s3Client *s3.Client) func(r *Repo) {
 	}
 }
 
-func (r *Repo) createBusy() error {
-	input := &s3.PutObjectInput{
-		Bucket: &r.bucket,
-		Key:    aws.String(filepath.Join(r.prefix, repofiles.Busy)),
-		Body:   bytes.NewReader([]byte{}),
+// WithRetryPolicy sets how failed S3 operations are retried. The default is
+// s3source.DefaultRetryPolicy. Settings in .qfs/repo take precedence.
+func WithRetryPolicy(policy s3source.RetryPolicy) func(r *Repo) {
+	return func(r *Repo) {
+		r.retryPolicy = policy
 	}
-	_, err := r.s3Client.PutObject(ctx, input)
-	if err != nil {
-		// TEST: NOT COVERED
-		return fmt.Errorf("create \"busy\" object: %w", err)
+}
+
+// WithContext sets the context for the repository's operations. When it is
+// canceled, operations stop as soon as they can do so while leaving the site and
+// the repository consistent. The default is context.Background().
+func WithContext(ctx context.Context) func(r *Repo) {
+	return func(r *Repo) {
+		r.ctx = ctx
 	}
-	return nil
 }
 
-func (r *Repo) checkBusy() error {
-	input := &s3.HeadObjectInput{
-		Bucket: &r.bucket,
-		Key:    aws.String(filepath.Join(r.prefix, repofiles.Busy)),
+// WithBirthTimes causes the creation times of local files to be captured when
+// the site is scanned. They are recorded in the site database and saved with
+// the files that are pushed. See localsource.WithBirthTimes.
+func WithBirthTimes(birthTimes bool) func(r *Repo) {
+	return func(r *Repo) {
+		r.birthTimes = birthTimes
 	}
-	_, err := r.s3Client.HeadObject(ctx, input)
-	if err != nil {
-		var notFound *types.NotFound
-		if errors.As(err, &notFound) {
-			return nil
-		}
-		// TEST: NOT COVERED
-		return err
+}
+
+// WithNanoseconds causes the modification times of local files to be captured
+// with nanosecond precision when the site is scanned. Databases with such times
+// are written in the nanosecond revision of their formats, and keys of pushed
+// files include the nanoseconds. See localsource.WithNanoseconds.
+func WithNanoseconds(nanoseconds bool) func(r *Repo) {
+	return func(r *Repo) {
+		r.nanoseconds = nanoseconds
 	}
-	return fmt.Errorf(
-		"s3://%s/%s/%s exists; if necessary, rerun qfs init-repo",
-		r.bucket,
-		r.prefix,
-		repofiles.Busy,
-	)
 }
 
-func (r *Repo) removeBusy() error {
-	input := &s3.DeleteObjectInput{
-		Bucket: &r.bucket,
-		Key:    aws.String(filepath.Join(r.prefix, repofiles.Busy)),
+// WithModifyWindow causes modification times that differ by no more than
+// window to be treated as the same when finding changes and conflicts and when
+// deciding whether files have to be retrieved. This is useful for sites on
+// file systems with coarse timestamps, such as FAT. See diff.WithModifyWindow.
+func WithModifyWindow(window time.Duration) func(r *Repo) {
+	return func(r *Repo) {
+		r.modifyWindow = window
 	}
-	_, err := r.s3Client.DeleteObject(ctx, input)
-	if err != nil {
-		// TEST: NOT COVERED
-		return fmt.Errorf("remove \"busy\" object: %w", err)
+}
+
+// WithUI sets the UI used for messages, prompts, and output. The default is
+// misc.ConsoleUI.
+func WithUI(ui misc.UI) func(r *Repo) {
+	return func(r *Repo) {
+		r.ui = ui
 	}
-	return nil
+}
+
+// tagUploads arranges for everything subsequently stored in the repository to be
+// tagged with the site and the time of the current operation.
+func (r *Repo) tagUploads(site string) {
+	r.src.SetTags(map[string]string{
+		TagSite: site,
+		TagTime: misc.FormatTime(time.Now()),
+	})
+}
+
+// detachContext switches to a context that can't be canceled. It is called
+// once an operation has made its changes so that the bookkeeping that follows
+// isn't interrupted, leaving the databases consistent with what was changed.
+func (r *Repo) detachContext() {
+	r.stopHeartbeat()
+	r.ctx = context.WithoutCancel(r.ctx)
+	r.src.SetContext(r.ctx)
 }
 
 func (r *Repo) localPath(relPath string) *fileinfo.Path {
-	return fileinfo.NewPath(localsource.New(r.localTop), relPath)
+	return fileinfo.NewPath(
+		r.localSource(
+			localsource.WithBirthTimes(r.birthTimes),
+			localsource.WithNanoseconds(r.nanoseconds),
+		),
+		relPath,
+	)
+}
+
+// localSource returns a source for the site's files that applies the site's
+// path rules.
+func (r *Repo) localSource(options ...localsource.Options) *localsource.LocalSource {
+	return localsource.New(r.localTop, append(options, localsource.WithPathMap(r.pathMap))...)
 }
 
-func (r *Repo) cleanRepo() error {
+// loadLocalDb loads a database from the site's .qfs directory. Databases are
+// written atomically, but one left truncated by a crash in an older version is
+// removed, and an error wrapping database.ErrTruncated is returned. Callers can
+// treat this like a missing database.
+func (r *Repo) loadLocalDb(relPath string, options ...database.Options) (database.Database, error) {
+	path := r.localPath(relPath)
+	db, err := database.Load(path, options...)
+	if !errors.Is(err, database.ErrTruncated) {
+		return db, err
+	}
+	r.ui.Message("removing truncated database %s", relPath)
+	if rmErr := path.Remove(); rmErr != nil {
+		// TEST: NOT COVERED
+		return nil, rmErr
+	}
+	return nil, fmt.Errorf("%w; removed it", err)
+}
+
+// cleanRepo removes unneeded objects from the repository and returns how many
+// were removed.
+func (r *Repo) cleanRepo() (int, error) {
 	var extraKeys []string
 	for k := range maps.Keys(r.src.ExtraKeys()) {
 		extraKeys = append(extraKeys, k)
 	}
+	// Contents stored by hash are removed once no version of any file refers to
+	// them. The caller holds the repository lock, so no push can start referring
+	// to them.
+	versioned, err := r.src.VersionHashes()
+	if err != nil {
+		return 0, err
+	}
+	unreferenced, err := r.src.UnreferencedContent(versioned)
+	if err != nil {
+		return 0, err
+	}
+	extraKeys = append(extraKeys, unreferenced...)
 	sort.Strings(extraKeys)
 	if len(extraKeys) == 0 {
-		misc.Message("no objects to clean from repository")
+		r.ui.Message("no objects to clean from repository")
 	} else {
-		misc.Message("----- keys to remove -----")
+		lockEnabled, err := r.src.ObjectLockEnabled()
+		if err != nil {
+			// TEST: NOT COVERED
+			return 0, err
+		}
+		now := time.Now()
+		protected := 0
+		r.ui.Message("----- keys to remove -----")
 		for _, k := range extraKeys {
-			fmt.Println(k)
+			var retention *s3source.Retention
+			if lockEnabled {
+				retention, err = r.src.VersionRetention(k, nil)
+				if err != nil {
+					// TEST: NOT COVERED
+					return 0, err
+				}
+			}
+			if retention.Protected(now, false) {
+				protected++
+				_, _ = fmt.Fprintf(r.ui.Output(), "%s (%s)\n", k, retention)
+			} else {
+				_, _ = fmt.Fprintln(r.ui.Output(), k)
+			}
+		}
+		r.ui.Message("-----")
+		if protected > 0 {
+			// Removing a key only adds a delete marker, which Object Lock allows.
+			r.ui.Message(
+				"%d key(s) are protected by Object Lock; removing them hides them, but their data remains until they can be removed",
+				protected,
+			)
 		}
-		misc.Message("-----")
-		if misc.Prompt("Remove above keys?") {
+		if r.ui.Prompt("Remove above keys?") {
 			err := r.src.RemoveKeys(extraKeys)
 			if err != nil {
-				return err
+				return 0, err
 			}
 		} else {
-			return fmt.Errorf("not removing extra keys")
+			return 0, fmt.Errorf("not removing extra keys")
 		}
 	}
-	return nil
+	return len(extraKeys), nil
 }
 
-func (r *Repo) migrateRepo() error {
-	toCopy := map[string]string{}
-	for key, updateTime := range r.src.ExtraKeys() {
-		path := misc.RemovePrefix(key, r.prefix)
-		local := r.localPath(path)
-		info, err := local.FileInfo()
-		if err != nil {
-			// TEST: NOT COVERED
-			continue
-		}
-		if info.ModTime.Before(updateTime) {
-			// aws s3 sync would consider this file to be up-to-date since its modification
-			// time is older than the S3 update time.
-			newKey := r.src.KeyFromPath(path, info)
-			toCopy[key] = newKey
-		}
-	}
-	if len(toCopy) == 0 {
-		// TEST: NOT COVERED
-		misc.Message("no keys to migrate")
-		return nil
-	}
-	var oldKeys []string
-	for k := range maps.Keys(toCopy) {
-		oldKeys = append(oldKeys, k)
-	}
-	sort.Strings(oldKeys)
-	misc.Message("----- keys to migrate -----")
-	for _, oldKey := range oldKeys {
-		fmt.Printf("%s -> %s\n", oldKey, toCopy[oldKey])
-	}
-	misc.Message("-----")
-	if !misc.Prompt("Continue?") {
-		return fmt.Errorf("exiting")
-	}
-
-	type toCopyData struct {
-		old string
-		new string
+func (r *Repo) Init(config *InitConfig) error {
+	mode := config.Mode
+	if config.NoOp {
+		// A dry run only reads the repository, so it is allowed even if the site is
+		// read-only.
+		return r.migrateNoOp(config)
 	}
-	c := make(chan *toCopyData, numWorkers)
-	go func() {
-		for oldKey, newKey := range toCopy {
-			c <- &toCopyData{
-				old: oldKey,
-				new: newKey,
-			}
-		}
-		close(c)
-	}()
-	misc.DoConcurrently(
-		func(c chan *toCopyData, errorChan chan error) {
-			for x := range c {
-				misc.Message("moving %s -> %s", x.old, x.new)
-				copyInput := &s3.CopyObjectInput{
-					Bucket:     &r.bucket,
-					CopySource: aws.String(url.PathEscape(fmt.Sprintf("%s/%s", r.bucket, x.old))),
-					Key:        &x.new,
-				}
-				// There's no rename in S3, so we copy the object and, if successful, delete the old one.
-				_, err := r.s3Client.CopyObject(ctx, copyInput)
-				if err != nil {
-					// TEST: NOT COVERED
-					errorChan <- fmt.Errorf("copy %s -> %s: %w", x.old, x.new, err)
-					continue
-				}
-				deleteInput := &s3.DeleteObjectInput{
-					Bucket: &r.bucket,
-					Key:    &x.old,
-				}
-				_, err = r.s3Client.DeleteObject(ctx, deleteInput)
-				if err != nil {
-					// TEST: NOT COVERED
-					errorChan <- fmt.Errorf("delete %s: %w", x.old, err)
-					continue
-				}
-			}
-		},
-		func(e error) {
-			// TEST: NOT COVERED. This doesn't have to be an error; a later init-repo
-			// -cleanup and push will get everything in sync. There are some restrictions to
-			// CopyObject, such as a 5 GB file limit.
-			misc.Message("WARNING: %v", e)
-		},
-		c,
-		numWorkers,
-	)
-	var err error
-	r.repoDb, err = r.src.Database(true, true, nil)
+	err := r.checkReadOnly()
 	if err != nil {
-		// TEST: NOT COVERED
 		return err
 	}
-	return nil
-}
-
-func (r *Repo) Init(mode InitMode) error {
-	err := r.loadRepoDb()
+	if mode == InitCleanRepo {
+		if err = r.checkProtected("clean the repository"); err != nil {
+			return err
+		}
+	}
+	err = r.loadRepoDb()
 	if err != nil {
 		// TEST: not covered
 		return err
 	}
 	if r.initialized && mode != InitCleanRepo {
-		if !misc.Prompt("Repository is already initialized. Rebuild database?") {
+		if !r.ui.Prompt("Repository is already initialized. Rebuild database?") {
 			return fmt.Errorf(
 				"repository is already initialized; delete s3://%s/%s/%s to re-initialize",
 				r.bucket,
@@ -337,11 +610,13 @@ func (r *Repo) Init(mode InitMode) error {
 		}
 	}
 
-	err = r.createBusy()
+	// The site may not have been set up yet when initializing a repository.
+	site, _ := r.currentSite()
+	err = r.createBusy(site)
 	if err != nil {
-		// TEST: NOT COVERED
 		return err
 	}
+	defer r.stopHeartbeat()
 	var filters []*filter.Filter
 	if mode == InitCleanRepo {
 		repoFilterPath := fileinfo.NewPath(r.src, repofiles.SiteFilter(repofiles.RepoSite))
@@ -357,16 +632,24 @@ func (r *Repo) Init(mode InitMode) error {
 		// TEST: NOT COVERED
 		return err
 	}
+	// If the database was missing, the version of the keys is whatever was found.
+	r.keyVersion = r.src.KeyVersion()
+	operation := "init-repo"
+	counts := map[string]int{"files": len(r.repoDb)}
 	if mode == InitCleanRepo {
-		err = r.cleanRepo()
+		n, err := r.cleanRepo()
 		if err != nil {
 			return err
 		}
+		operation = "clean-repo"
+		counts = map[string]int{"removed": n}
 	} else if mode == InitMigrate {
-		err = r.migrateRepo()
+		n, err := r.migrateRepo(config)
 		if err != nil {
 			return err
 		}
+		operation = "migrate"
+		counts = map[string]int{"migrated": n}
 	}
 
 	err = r.updateRepoDb()
@@ -374,28 +657,12 @@ func (r *Repo) Init(mode InitMode) error {
 		// TEST: NOT COVERED
 		return err
 	}
-	err = r.removeBusy()
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
-	}
-	return nil
-}
-
-func (r *Repo) updateRepoDb() error {
-	tmpDb := r.localPath(repofiles.TempRepoDb())
-	err := database.WriteDb(tmpDb.Path(), r.repoDb, database.DbRepo)
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
-	}
-	misc.Message("uploading repository database")
-	err = r.src.Store(tmpDb, repofiles.RepoDb())
+	err = r.audit(operation, site, counts, "")
 	if err != nil {
 		// TEST: NOT COVERED
 		return err
 	}
-	err = os.Rename(tmpDb.Path(), r.localPath(repofiles.RepoDb()).Path())
+	err = r.removeBusy()
 	if err != nil {
 		// TEST: NOT COVERED
 		return err
@@ -403,599 +670,1965 @@ func (r *Repo) updateRepoDb() error {
 	return nil
 }
 
-func (r *Repo) currentSite() (string, error) {
-	data, err := os.ReadFile(r.localPath(repofiles.Site).Path())
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(string(data)), nil
-}
-
-func checkConflicts(
-	checks []*diff.Check,
-	allowOverride bool,
-	getInfo func(path string) (*fileinfo.FileInfo, error),
-) error {
-	conflicts := false
-	for _, ch := range checks {
-		info, err := getInfo(ch.Path)
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
-		}
-		if info == nil {
-			// It's fine if it doesn't exist.
-		} else {
-			conflict := true
-			for _, m := range ch.ModTime {
-				if m == info.ModTime.UnixMilli() {
-					conflict = false
-					break
-				}
-			}
-			if conflict {
-				conflicts = true
-				fmt.Printf("conflict: %s\n", ch.Path)
-			}
-		}
-	}
-	if !conflicts {
-		misc.Message("no conflicts found")
-	} else if allowOverride && !misc.Prompt("Conflicts detected. Exit?") {
-		misc.Message("overriding conflicts")
-		conflicts = false
-	}
-	if conflicts {
-		return fmt.Errorf("conflicts detected")
-	}
-	return nil
-}
-
-func makeDiff(filters []*filter.Filter) *diff.Diff {
-	return diff.New(
-		diff.WithFilters(filters),
-		diff.WithNoOwnerships(true),
-		diff.WithNoSpecial(true),
-		diff.WithRepoRules(true),
-	)
+// currentRepoDbVersion returns the version of the repository database that is
+// currently in the repository, or nil if there isn't one. It always consults S3
+// rather than any cached information.
+func (r *Repo) currentRepoDbVersion() (*objectVersion, error) {
+	return r.currentVersion(repofiles.RepoDb())
 }
 
-func (r *Repo) generateLocalSiteDb(site string, cleanup bool) (database.Database, error) {
-	// Generate the local site database using prunes only from the repo and site filters.
-	filterFiles := []string{
-		repofiles.SiteFilter(repofiles.RepoSite),
-		repofiles.SiteFilter(site),
-	}
-	var filters []*filter.Filter
-	for _, file := range filterFiles {
-		f := filter.New()
-		err := f.ReadFile(r.localPath(file), true)
-		if err != nil {
-			// TEST: NOT COVERED
-			return nil, err
-		}
-		filters = append(filters, f)
-	}
-	tr, err := traverse.New(
-		r.localTop,
-		traverse.WithNoSpecial(true),
-		traverse.WithFilters(filters),
-		traverse.WithRepoRules(true),
-		traverse.WithCleanup(cleanup),
+// currentVersion returns the version of the database at relPath that is
+// currently in the repository, or nil if there isn't one.
+func (r *Repo) currentVersion(relPath string) (*objectVersion, error) {
+	src, err := s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
 	)
 	if err != nil {
 		// TEST: NOT COVERED
 		return nil, err
 	}
-	misc.Message("generating local database")
-	localResult, err := tr.Traverse(nil, nil)
-	if err != nil {
+	info, err := fileinfo.NewPath(src, relPath).FileInfo()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
 		// TEST: NOT COVERED
 		return nil, err
 	}
-	localDb := localResult.Database()
-	localSiteDbPath := r.localPath(repofiles.SiteDb(site))
-	err = database.WriteDb(localSiteDbPath.Path(), localDb, database.DbQfs)
+	return r.versionOf(src, relPath, info)
+}
+
+func (r *Repo) versionOf(src *s3source.S3Source, relPath string, info *fileinfo.FileInfo) (*objectVersion, error) {
+	key := src.KeyFromPath(relPath, info)
+	output, err := r.s3Client.HeadObject(r.ctx, &s3.HeadObjectInput{
+		Bucket: &r.bucket,
+		Key:    &key,
+	})
 	if err != nil {
 		// TEST: NOT COVERED
-		return nil, err
+		return nil, fmt.Errorf("get information about s3://%s/%s: %w", r.bucket, key, err)
 	}
-	return localDb, nil
+	v := &objectVersion{key: key}
+	if output.ETag != nil {
+		v.eTag = *output.ETag
+	}
+	if output.VersionId != nil {
+		v.versionId = *output.VersionId
+	}
+	return v, nil
 }
 
-func (r *Repo) uploadSiteDb(site string) error {
-	misc.Message("uploading site database")
-	localSiteDbPath := r.localPath(repofiles.SiteDb(site))
-	err := r.src.Store(localSiteDbPath, repofiles.SiteDb(site))
+// checkRepoDbUnchanged returns an error wrapping ErrRepoChanged if the
+// repository database is no longer the version that was loaded.
+func (r *Repo) checkRepoDbUnchanged() error {
+	current, err := r.currentRepoDbVersion()
 	if err != nil {
 		// TEST: NOT COVERED
 		return err
 	}
+	if !current.equal(r.repoDbVersion) {
+		// TEST: NOT COVERED. This requires another site to update the repository while
+		// this operation is running.
+		return fmt.Errorf(
+			"repository database was %s when loaded and is now %s: %w",
+			r.repoDbVersion,
+			current,
+			ErrRepoChanged,
+		)
+	}
 	return nil
 }
 
-func (r *Repo) Push(config *PushConfig) error {
-	err := r.loadRepoDb()
+// updateRepoDb uploads the repository database, sharded if the configuration
+// calls for it. The database is streamed directly to S3 rather than written to
+// a local file first, so no scratch space is needed for the upload. The local
+// copy is written afterward with the same modification time as the uploaded
+// copy so that it is recognized as current.
+func (r *Repo) updateRepoDb() error {
+	// Check that nobody else has written the database since it was loaded, and
+	// claim it with a conditional write of the head object so that nobody else
+	// can replace it while we are uploading. The check after uploading catches
+	// sites running older versions of qfs, which don't write the head.
+	err := r.checkRepoDbUnchanged()
 	if err != nil {
-		// TEST: not covered
 		return err
 	}
-	err = r.checkBusy()
-	if err != nil {
-		return err
+	info := &fileinfo.FileInfo{
+		Path:        repofiles.RepoDb(),
+		FileType:    fileinfo.TypeFile,
+		ModTime:     time.UnixMilli(time.Now().UnixMilli()),
+		Permissions: 0o644,
 	}
-	site, err := r.currentSite()
+	release, err := r.claimRepoDb(r.src.KeyFromPath(repofiles.RepoDb(), info))
 	if err != nil {
 		return err
 	}
-	// Open the local copy of the repo database early
-	localRepoDb, err := database.Load(
-		r.localPath(repofiles.RepoDb()),
-		database.WithRepoRules(true),
-	)
+	var idx shardIndex
+	var superseded []string
+	if r.shardDb {
+		idx, superseded, err = r.storeShards(info)
+	} else {
+		r.ui.Message("uploading repository database")
+		err = r.storeDbStream(repofiles.RepoDb(), info, r.repoDb, true)
+		// Shards of a previously sharded database are no longer needed.
+		superseded = r.supersededShards(nil)
+	}
 	if err != nil {
 		// TEST: NOT COVERED
+		release()
 		return err
 	}
-
-	localDb, err := r.generateLocalSiteDb(site, config.Cleanup)
+	current, err := r.currentRepoDbVersion()
 	if err != nil {
+		// TEST: NOT COVERED
 		return err
 	}
-
-	// Diff against the local copy of the repo database using the same filters but
-	// honoring everything, not just prunes.
-	filterFiles := []string{
-		repofiles.SiteFilter(repofiles.RepoSite),
-		repofiles.SiteFilter(site),
+	if current == nil || current.key != r.src.KeyFromPath(repofiles.RepoDb(), info) {
+		// TEST: NOT COVERED. This requires a concurrent upload by another site.
+		return fmt.Errorf(
+			"another site uploaded repository database %s at the same time: %w",
+			current,
+			ErrRepoChanged,
+		)
 	}
-	var filters []*filter.Filter
-	for _, file := range filterFiles {
-		f := filter.New()
-		err = f.ReadFile(r.localPath(file), false)
+	if len(superseded) > 0 {
+		err = r.src.RemoveKeys(superseded)
 		if err != nil {
-			// TEST: NOT COVERED
-			return err
+			// TEST: NOT COVERED. Old shards are harmless but take up space.
+			r.ui.Message("unable to remove old repository database shards: %v", err)
 		}
-		filters = append(filters, f)
 	}
-	d := makeDiff(filters)
-	diffResult, err := d.Run(localRepoDb, localDb)
-	if err != nil {
+	r.shardIndex = idx
+	r.repoDbVersion = current
+	r.updateLocalRepoDb(info.ModTime)
+	r.writeRepoDbRecord(info.ModTime)
+	r.updateLocalShards(idx, info.ModTime)
+	return nil
+}
+
+// updateLocalRepoDbSubtrees updates the local copy of the repository database
+// after a pull of only the given subtrees. The local copy records what the site
+// last pulled, which push compares the site with, so only entries in the
+// subtrees are taken from the new database. Otherwise, the next push would see
+// the site's copies of files that were changed elsewhere as local changes and
+// write them back over the newer ones. The copy keeps its old modification time
+// so that it isn't mistaken for the current database, and the downloaded copy
+// stays in place for the next command.
+func (r *Repo) updateLocalRepoDbSubtrees(subtrees []string) error {
+	localPath := r.localPath(repofiles.RepoDb()).Path()
+	var modTime time.Time
+	localDb, err := r.loadLocalDb(repofiles.RepoDb(), database.WithRepoRules(true))
+	if errors.Is(err, fs.ErrNotExist) {
+		localDb = database.Database{}
+	} else if err != nil {
 		// TEST: NOT COVERED
 		return err
+	} else if st, err := os.Stat(localPath); err == nil {
+		modTime = st.ModTime()
 	}
-
-	if !config.NoOp {
-		// Write diff to a local file as a marker that a push has been run.
-		err = r.SaveDiff(repofiles.Push, diffResult)
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
+	inSubtrees := func(path string) bool {
+		for _, s := range subtrees {
+			if path == s || strings.HasPrefix(path, s+"/") {
+				return true
+			}
 		}
+		return false
 	}
-
-	err = checkConflicts(diffResult.Check, !config.NoOp, func(path string) (*fileinfo.FileInfo, error) {
-		info, ok := r.repoDb[path]
-		if !ok {
-			return nil, nil
+	for path := range localDb {
+		if inSubtrees(path) {
+			delete(localDb, path)
 		}
-		return info, nil
-	})
-	if err != nil {
-		return err
 	}
-
-	changes := len(diffResult.Change) > 0 || len(diffResult.Add) > 0 ||
-		len(diffResult.Rm) > 0 || len(diffResult.MetaChange) > 0
-	if changes {
-		misc.Message("----- changes to push -----")
-		_ = diffResult.WriteDiff(os.Stdout, false)
-		misc.Message("-----")
-		if !config.NoOp && !misc.Prompt("Continue?") {
-			// TEST: NOT COVERED
-			return fmt.Errorf("exiting")
+	for path, info := range r.repoDb {
+		// Directories above the subtrees are created when needed to hold them.
+		if _, ok := localDb[path]; inSubtrees(path) || (!ok && misc.InSubtrees(path, subtrees)) {
+			localDb[path] = info
 		}
-	} else {
-		misc.Message("no changes to push")
-	}
-
-	if config.NoOp {
-		return nil
 	}
-
-	// Apply changes to the repository.
-	err = r.createBusy()
+	err = database.WriteDb(localPath, localDb, database.DbRepo, r.repoDbOptions())
 	if err != nil {
 		// TEST: NOT COVERED
 		return err
 	}
-
-	if changes {
-		err = r.pushChangesToRepo(r.src, diffResult)
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
-		}
-		// Update the repository database.
-		err = r.updateRepoDb()
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
-		}
-	} else if r.downloadedRepoDb {
-		// Our local copy was outdated, so update it.
-		misc.Message("updating local copy of repository database")
-		err = os.Rename(
-			r.localPath(repofiles.TempRepoDb()).Path(),
-			r.localPath(repofiles.RepoDb()).Path(),
-		)
-		if err != nil {
-			return err
-		}
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
 	}
+	return os.Chtimes(localPath, modTime, modTime)
+}
 
-	// Store the site's database in the repository
-	err = r.uploadSiteDb(site)
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
+// updateLocalRepoDb writes the local copy of the repository database after it
+// has been uploaded. The local copy is only a cache, so if it can't be written,
+// it is removed, and the database is downloaded again when next needed.
+func (r *Repo) updateLocalRepoDb(modTime time.Time) {
+	localDb := r.localPath(repofiles.RepoDb()).Path()
+	err := database.WriteDb(localDb, r.repoDb, database.DbRepo, r.repoDbOptions())
+	if err == nil {
+		err = os.Chtimes(localDb, modTime, modTime)
 	}
-	err = r.removeBusy()
 	if err != nil {
 		// TEST: NOT COVERED
-		return err
+		r.ui.Message("unable to update local copy of repository database: %v", err)
+		_ = os.Remove(localDb)
 	}
-	return nil
+	// A copy downloaded before the update is now out of date.
+	_ = os.Remove(r.localPath(repofiles.TempRepoDb()).Path())
+	r.downloadedRepoDb = false
 }
 
-func (r *Repo) pushChangesToRepo(src *s3source.S3Source, diffResult *diff.Result) error {
-	// Delete what needs to be deleted.
-	err := r.src.RemoveBatch(diffResult.Rm)
+func (r *Repo) currentSite() (string, error) {
+	data, err := os.ReadFile(r.localPath(repofiles.Site).Path())
 	if err != nil {
-		// TEST: NOT COVERED
-		return fmt.Errorf("delete keys: %w", err)
+		return "", err
 	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	c := make(chan *fileinfo.FileInfo, numWorkers)
+// findConflicts returns the paths of all checks that fail in the order of the
+// checks. A check fails if the file exists and doesn't have any of the
+// modification times listed in the check, allowing for window. Looking up a file may require a
+// system call or a request, so the checks are done concurrently, and getInfo
+// must be safe for concurrent use. If any lookups fail, the error for the first
+// such check is returned.
+func findConflicts(
+	checks []*diff.Check,
+	window time.Duration,
+	getInfo func(path string) (*fileinfo.FileInfo, error),
+) ([]string, error) {
+	failed := make([]bool, len(checks))
+	errs := make([]error, len(checks))
+	c := make(chan int, numWorkers)
 	go func() {
-		for _, f := range diffResult.Add {
-			c <- f
-		}
-		for _, f := range diffResult.Change {
-			c <- f
-		}
-		for _, f := range diffResult.MetaChange {
-			if f.Permissions != nil {
-				c <- f.Info
-			}
+		for i := range checks {
+			c <- i
 		}
 		close(c)
 	}()
-	var allErrors []error
 	misc.DoConcurrently(
-		func(c chan *fileinfo.FileInfo, errorChan chan error) {
-			for f := range c {
-				misc.Message("storing %s", f.Path)
-				err := src.Store(r.localPath(f.Path), f.Path)
+		func(c chan int, _ chan error) {
+			for i := range c {
+				ch := checks[i]
+				info, err := getInfo(ch.Path)
 				if err != nil {
 					// TEST: NOT COVERED
-					errorChan <- err
+					errs[i] = err
+					continue
 				}
+				// It's fine if it doesn't exist.
+				failed[i] = info != nil && !slices.ContainsFunc(ch.ModTime, func(m int64) bool {
+					return fileinfo.SameTimeWithin(time.UnixMilli(m), info.ModTime, window)
+				})
 			}
 		},
-		func(e error) {
-			// TEST: NOT COVERED
-			allErrors = append(allErrors, e)
-		},
+		// Errors are recorded by check so that the result doesn't depend on timing.
+		func(error) {},
 		c,
 		numWorkers,
 	)
-	if len(allErrors) > 0 {
-		// TEST: NOT COVERED
-		return errors.Join(allErrors...)
+	var conflicts []string
+	for i, ch := range checks {
+		if errs[i] != nil {
+			// TEST: NOT COVERED
+			return nil, errs[i]
+		}
+		if failed[i] {
+			conflicts = append(conflicts, ch.Path)
+		}
 	}
-
-	return nil
+	return conflicts, nil
 }
 
-func (r *Repo) PushDb() error {
-	site, err := r.currentSite()
+// checkConflicts reports conflicts and returns their paths. It returns an error
+// if there are conflicts unless allowOverride is true and the user chooses to
+// continue.
+func (r *Repo) checkConflicts(
+	checks []*diff.Check,
+	allowOverride bool,
+	getInfo func(path string) (*fileinfo.FileInfo, error),
+) ([]string, error) {
+	conflictPaths, err := findConflicts(checks, r.modifyWindow, getInfo)
 	if err != nil {
-		return err
+		// TEST: NOT COVERED
+		return nil, err
 	}
-	_, err = r.generateLocalSiteDb(site, false)
-	if err != nil {
-		return err
+	for _, path := range conflictPaths {
+		_, _ = fmt.Fprintf(r.ui.Output(), "conflict: %s\n", path)
 	}
-	r.src, err = s3source.New(
-		r.bucket,
-		r.prefix,
-		s3source.WithS3Client(r.s3Client),
-	)
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
+	conflicts := len(conflictPaths) > 0
+	if !conflicts {
+		r.ui.Message("no conflicts found")
+	} else if allowOverride && !r.ui.Prompt("Conflicts detected. Exit?") {
+		r.ui.Message("overriding conflicts")
+		conflicts = false
 	}
-	err = r.uploadSiteDb(site)
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
+	if conflicts {
+		return conflictPaths, fmt.Errorf("conflicts detected")
 	}
-	return nil
+	return conflictPaths, nil
 }
 
-func (r *Repo) SaveDiff(path string, diffResult *diff.Result) error {
-	f, err := os.Create(r.localPath(path).Path())
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
+// checkCaseCollisions reports the files that applying diffResult would add
+// that differ only in case from other files if the site is on a case-insensitive
+// file system. If there are any, it returns an error unless rename is true, in
+// which case it returns the paths at which they are to be written.
+func (r *Repo) checkCaseCollisions(
+	destDb database.Database,
+	diffResult *diff.Result,
+	rename bool,
+	result *Result,
+) (map[string]string, error) {
+	insensitive, err := sync.CaseInsensitive(r.localTop)
+	if err != nil || !insensitive {
+		return nil, err
 	}
-	defer func() { _ = f.Close() }()
-	err = diffResult.WriteDiff(f, true)
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
+	result.CaseCollisions = sync.FindCaseCollisions(destDb, diffResult)
+	if len(result.CaseCollisions) == 0 {
+		return nil, nil
 	}
-	if err = f.Close(); err != nil {
-		// TEST: NOT COVERED
-		return err
+	for _, c := range result.CaseCollisions {
+		_, _ = fmt.Fprintln(r.ui.Output(), c)
 	}
-	return nil
+	if !rename {
+		return nil, errors.New("case collisions detected")
+	}
+	return sync.CaseRenames(destDb, diffResult, result.CaseCollisions), nil
 }
 
-func (r *Repo) Pull(config *PullConfig) error {
-	err := r.loadRepoDb()
-	if err != nil {
-		// TEST: not covered
-		return err
-	}
-	err = r.checkBusy()
-	if err != nil {
-		return err
-	}
-	site, err := r.currentSite()
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
-	}
+func makeDiff(filters []*filter.Filter, options ...diff.Options) *diff.Diff {
+	return diff.New(
+		append(
+			[]diff.Options{
+				diff.WithFilters(filters),
+				diff.WithNoOwnerships(true),
+				diff.WithNoSpecial(true),
+				diff.WithRepoRules(true),
+				diff.WithPermissionMask(localsource.PermissionMask),
+			},
+			options...,
+		)...,
+	)
+}
 
-	repoSiteDbPath := fileinfo.NewPath(r.src, repofiles.SiteDb(site))
-	files, err := database.Load(repoSiteDbPath, database.WithRepoRules(true))
-	var siteDb database.Database
-	if errors.Is(err, fs.ErrNotExist) {
-		misc.Message("repository doesn't contain a database for this site")
-		siteDb = database.Database{}
-	} else if err != nil {
-		// TEST: NOT COVERED
-		return err
-	} else {
-		misc.Message("loading site database from repository")
-		siteDb = files
+// storageClassFn returns a function that gives the storage class for a path
+// from the repository filter's :storage-class: directives. Only the repository
+// filter is used so that every site stores a given file the same way.
+func storageClassFn(repoFilter *filter.Filter) (func(string) types.StorageClass, error) {
+	valid := types.StorageClass("").Values()
+	for _, name := range repoFilter.StorageClasses() {
+		if !slices.Contains(valid, types.StorageClass(name)) {
+			return nil, fmt.Errorf("%s: unknown storage class %s", repofiles.SiteFilter(repofiles.RepoSite), name)
+		}
 	}
+	return func(path string) types.StorageClass {
+		return types.StorageClass(repoFilter.StorageClass(path))
+	}, nil
+}
 
-	// Load filters from the repository. If the site filter doesn't exist on the
-	// repository, fall back to a local copy for bootstrapping. This makes it
-	// possible to bootstrap a new site from the new site rather than pre-creating
-	// the filter.
-	repoFilter := filter.New()
-	repoFilterPath := fileinfo.NewPath(r.src, repofiles.SiteFilter(repofiles.RepoSite))
-	err = repoFilter.ReadFile(repoFilterPath, false)
-	if err != nil {
-		// TEST: NOT COVERED
-		return fmt.Errorf("reading repository copy of repository filter: %w", err)
-	}
-	var siteFilterPath *fileinfo.Path
-	localFilter := config.LocalFilter
-	siteFilter := filter.New()
-	for {
-		if localFilter {
-			siteFilterPath = r.localPath(repofiles.SiteFilter(site))
-		} else {
-			siteFilterPath = fileinfo.NewPath(r.src, repofiles.SiteFilter(site))
-		}
-		err = siteFilter.ReadFile(siteFilterPath, false)
-		if errors.Is(err, fs.ErrNotExist) {
-			if localFilter {
-				misc.Message("no filter is configured for this site; bootstrapping with exclude all")
-				siteFilter.SetDefaultInclude(false)
-				break
-			} else {
-				misc.Message("site filter does not exist on the repository; trying local copy")
-				localFilter = true
+// siteGroups returns the site groups defined in the repository, mapped to
+// whether site belongs to them. Each file in .qfs/filters/groups defines the
+// group with its name and lists the sites in it, one per line. If fromRepo is
+// true, the repository's copies of the files are read. Otherwise, the local
+// copies are.
+func (r *Repo) siteGroups(site string, fromRepo bool) (map[string]bool, error) {
+	var src fileinfo.Source
+	var names []string
+	if fromRepo {
+		src = r.src
+		for p, info := range r.repoDb {
+			name, ok := strings.CutPrefix(p, repofiles.Groups+"/")
+			if ok && info.FileType == fileinfo.TypeFile && !strings.Contains(name, "/") {
+				names = append(names, name)
 			}
-		} else if err != nil {
+		}
+	} else {
+		src = r.localSource()
+		entries, err := os.ReadDir(r.localPath(repofiles.Groups).Path())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			// TEST: NOT COVERED
-			return fmt.Errorf("reading site filter: %w", err)
-		} else {
-			break
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				names = append(names, e.Name())
+			}
 		}
 	}
-	filters := []*filter.Filter{
-		repoFilter,
-		siteFilter,
-	}
-
-	// Look at differences between the repository's state and the repository's last
-	// record of the site's state.
-	d := makeDiff(filters)
-	diffResult, err := d.Run(siteDb, r.repoDb)
-	if err != nil {
-		// TEST: NOT COVERED
-		return err
-	}
-
-	if !config.NoOp {
-		// Write diff to a local file for reference.
-		err = r.SaveDiff(repofiles.Pull, diffResult)
+	groups := map[string]bool{}
+	for _, name := range names {
+		data, err := func() ([]byte, error) {
+			f, err := fileinfo.NewPath(src, path.Join(repofiles.Groups, name)).Open()
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = f.Close() }()
+			return io.ReadAll(f)
+		}()
 		if err != nil {
 			// TEST: NOT COVERED
-			return err
+			return nil, fmt.Errorf("read site group %s: %w", name, err)
+		}
+		groups[name] = false
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == site {
+				groups[name] = true
+			}
 		}
 	}
+	return groups, nil
+}
 
-	// Check conflicts
-	localSrc := localsource.New(r.localTop)
-	err = checkConflicts(diffResult.Check, !config.NoOp, func(path string) (*fileinfo.FileInfo, error) {
-		info, err := localSrc.FileInfo(path)
-		if errors.Is(err, fs.ErrNotExist) {
-			return nil, nil
+// localFilters reads the local copies of the repository and site filters. If
+// pruneOnly is true, only prune and junk directives are read.
+func (r *Repo) localFilters(site string, pruneOnly bool) ([]*filter.Filter, error) {
+	filterFiles := []string{
+		repofiles.SiteFilter(repofiles.RepoSite),
+		repofiles.SiteFilter(site),
+	}
+	groups, err := r.siteGroups(site, false)
+	if err != nil {
+		return nil, err
+	}
+	var filters []*filter.Filter
+	for i, file := range filterFiles {
+		f := filter.New()
+		if i > 0 {
+			// Group directives only apply to site filters.
+			f.SetSiteGroups(groups)
 		}
+		err := f.ReadFile(r.localPath(file), pruneOnly)
 		if err != nil {
 			// TEST: NOT COVERED
 			return nil, err
 		}
-		return info, nil
-	})
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// SiteFilters returns the local copies of the repository and current site
+// filters. These are the filters push uses when comparing the local site with
+// the repository.
+func (r *Repo) SiteFilters() ([]*filter.Filter, error) {
+	site, err := r.currentSite()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return r.localFilters(site, false)
+}
 
-	changes := len(diffResult.Change)+len(diffResult.Add)+len(diffResult.Rm)+len(diffResult.MetaChange) > 0
-	if changes {
-		misc.Message("----- changes to pull -----")
-		_ = diffResult.WriteDiff(os.Stdout, false)
-		misc.Message("-----")
-		if !config.NoOp && !misc.Prompt("Continue?") {
-			return fmt.Errorf("exiting")
+// cleanSubtrees validates paths given to restrict push or pull to parts of the
+// site and returns them in canonical form. If any path is the top of the site,
+// nil is returned since no restriction is needed.
+func cleanSubtrees(paths []string) ([]string, error) {
+	var result []string
+	for _, p := range paths {
+		c := path.Clean(filepath.ToSlash(p))
+		if filepath.IsAbs(p) || path.IsAbs(c) || c == ".." || strings.HasPrefix(c, "../") {
+			return nil, fmt.Errorf("%s: paths must be relative to the top of the site", p)
 		}
-	} else {
-		misc.Message("no changes to pull")
+		if c == "." {
+			return nil, nil
+		}
+		result = append(result, c)
 	}
+	return result, nil
+}
 
-	if config.NoOp {
+// subtreeFilter returns a filter that includes only the given subtrees, or nil
+// if there are none.
+func subtreeFilter(subtrees []string) *filter.Filter {
+	if len(subtrees) == 0 {
 		return nil
 	}
+	f := filter.New()
+	for _, s := range subtrees {
+		f.AddPath(filter.Include, s)
+	}
+	return f
+}
 
-	if changes {
-		err = r.applyChangesFromRepo(r.src, diffResult, siteDb)
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
-		}
-		// Push a modified copy of the site database
-		localSiteFile := r.localPath(repofiles.TempSiteDb(site))
-		err = database.WriteDb(localSiteFile.Path(), siteDb, database.DbQfs)
-		if err != nil {
+// scanLocalSite traverses the local site using prunes only from the repo and
+// site filters. If subtrees are given, only they and the directories above
+// them are traversed.
+func (r *Repo) scanLocalSite(site string, cleanup bool, subtrees []string) (database.Database, error) {
+	filters, err := r.localFilters(site, true)
+	if err != nil {
+		return nil, err
+	}
+	symlinks, err := r.symlinkMode()
+	if err != nil {
+		return nil, err
+	}
+	tr, err := traverse.New(
+		r.localTop,
+		traverse.WithNoSpecial(true),
+		traverse.WithFilters(filters),
+		traverse.WithRepoRules(true),
+		traverse.WithCleanup(cleanup),
+		traverse.WithSubtrees(subtrees),
+		traverse.WithFollowDirLinks(symlinks == fileinfo.SymlinkFollow),
+		traverse.WithBirthTimes(r.birthTimes),
+		traverse.WithNanoseconds(r.nanoseconds),
+		traverse.WithPathMap(r.pathMap),
+		traverse.WithContext(r.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	r.ui.Message("generating local database")
+	localResult, err := tr.Traverse(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	localDb := localResult.Database()
+	if !symlinks.CreatesLinks() {
+		oldDb, err := r.loadLocalDb(repofiles.SiteDb(site))
+		if err == nil {
+			keepLinks(oldDb, localDb, symlinks)
+		} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, database.ErrTruncated) {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+	return localDb, nil
+}
+
+// generateLocalSiteDb scans the local site and writes the local site database.
+// If subtrees are given, only they are scanned, and the results replace the
+// corresponding parts of the existing local site database. The filters are
+// always scanned since they are always included in the repository.
+func (r *Repo) generateLocalSiteDb(site string, cleanup bool, subtrees []string) (database.Database, error) {
+	localSiteDbPath := r.localPath(repofiles.SiteDb(site))
+	var oldDb database.Database
+	if len(subtrees) > 0 {
+		var err error
+		oldDb, err = r.loadLocalDb(repofiles.SiteDb(site))
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, database.ErrTruncated) {
+			r.ui.Message("no local site database; scanning the whole site")
+			subtrees = nil
+		} else if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		} else {
+			subtrees = append(slices.Clone(subtrees), repofiles.Filters)
+		}
+	}
+	localDb, err := r.scanLocalSite(site, cleanup, subtrees)
+	if err != nil {
+		return nil, err
+	}
+	if len(subtrees) > 0 {
+		for path := range oldDb {
+			if misc.InSubtrees(path, subtrees) {
+				delete(oldDb, path)
+			}
+		}
+		maps.Copy(oldDb, localDb)
+		localDb = oldDb
+	}
+	err = database.WriteDb(localSiteDbPath.Path(), localDb, database.DbQfs)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	return localDb, nil
+}
+
+// checkFutureMtimes reports files in localDb whose modification times are in
+// the future. Such times are usually caused by bad clocks or by extracting
+// archives, and they cause spurious conflicts when the file is later changed at
+// a site whose clock is correct. If clamp is true, each such file's
+// modification time is set to now, and localDb and the local site database are
+// updated to match.
+func (r *Repo) checkFutureMtimes(site string, localDb database.Database, clamp bool) error {
+	now := time.Now().Truncate(time.Millisecond)
+	var future []string
+	for p, info := range localDb {
+		if info.ModTime.After(now) {
+			future = append(future, p)
+		}
+	}
+	if len(future) == 0 {
+		return nil
+	}
+	slices.Sort(future)
+	for _, p := range future {
+		info := localDb[p]
+		if !clamp || info.FileType == fileinfo.TypeLink {
+			r.ui.Message(
+				"WARNING: %s has a modification time in the future: %s",
+				p,
+				misc.FormatTime(info.ModTime),
+			)
+			continue
+		}
+		err := os.Chtimes(r.localPath(p).Path(), time.Time{}, now)
+		if err != nil {
+			return fmt.Errorf("set modification time of %s: %w", p, err)
+		}
+		r.ui.Message("changed modification time of %s from %s to now", p, misc.FormatTime(info.ModTime))
+		info.ModTime = now
+	}
+	if !clamp {
+		r.ui.Message("use -clamp-future-mtimes to set future modification times to now")
+		return nil
+	}
+	err := database.WriteDb(r.localPath(repofiles.SiteDb(site)).Path(), localDb, database.DbQfs)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return nil
+}
+
+func (r *Repo) uploadSiteDb(site string) error {
+	r.ui.Message("uploading site database")
+	return r.storeSiteDbChecked(site, repofiles.SiteDb(site))
+}
+
+// Push pushes local changes to the repository and returns what it found.
+func (r *Repo) Push(config *PushConfig) (*Result, error) {
+	if err := r.checkOnline("push"); err != nil {
+		return nil, err
+	}
+	noOp := config.NoOp || config.Plan != ""
+	if !noOp {
+		// Find out about a read-only site before doing any work.
+		err := r.checkWritable()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := r.loadRepoDb()
+	if err != nil {
+		// TEST: not covered
+		return nil, err
+	}
+	err = r.checkBusy()
+	if err != nil {
+		return nil, err
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := r.lockSite()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	err = r.recordSiteDbVersion(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	// Open the local copy of the repo database early
+	localRepoDb, err := r.loadLocalDb(repofiles.RepoDb(), database.WithRepoRules(true))
+	if errors.Is(err, database.ErrTruncated) {
+		return nil, fmt.Errorf("%w; run qfs pull to replace it", err)
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+
+	err = r.checkRepoFilterCurrent(localRepoDb)
+	if err != nil {
+		if !noOp {
+			return nil, err
+		}
+		r.ui.Message("WARNING: %v", err)
+	}
+
+	subtrees, err := cleanSubtrees(config.Paths)
+	if err != nil {
+		return nil, err
+	}
+	localDb, err := r.generateLocalSiteDb(site, config.Cleanup, subtrees)
+	if err != nil {
+		return nil, err
+	}
+	err = r.checkFutureMtimes(site, localDb, config.ClampFutureMtimes && !noOp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Diff against the local copy of the repo database using the same filters but
+	// honoring everything, not just prunes.
+	filters, err := r.localFilters(site, false)
+	if err != nil {
+		return nil, err
+	}
+	storageClass, err := storageClassFn(filters[0])
+	if err != nil {
+		return nil, err
+	}
+	if f := subtreeFilter(subtrees); f != nil {
+		filters = append(filters, f)
+	}
+	d := makeDiff(
+		filters,
+		diff.WithNonFileTimes(config.DirTimes),
+		diff.WithRenames(config.Renames),
+		diff.WithNoPermissions(config.NoPermissions),
+		diff.WithModifyWindow(r.modifyWindow),
+	)
+	diffResult, err := d.Run(localRepoDb, localDb)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if config.MetadataOnly {
+		diffResult, err = r.metadataOnly(site, diffResult, localRepoDb, localDb, !noOp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := &Result{Changes: diffResult}
+
+	if !noOp {
+		// Write diff to a local file as a marker that a push has been run.
+		err = r.SaveDiff(repofiles.Push, diffResult)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+
+	getRepoInfo := func(path string) (*fileinfo.FileInfo, error) {
+		info, ok := r.repoDb[path]
+		if !ok {
+			return nil, nil
+		}
+		return info, nil
+	}
+	planning := config.Plan != "" || config.approved != nil
+	if planning {
+		result.Conflicts, err = r.reportConflicts(diffResult.Check, getRepoInfo)
+	} else {
+		result.Conflicts, err = r.checkConflicts(diffResult.Check, !config.NoOp, getRepoInfo)
+	}
+	if err != nil {
+		return result, err
+	}
+	var plan *Plan
+	if planning {
+		plan = newPlan("push", site, diffResult, result.Conflicts)
+		plan.Paths = config.Paths
+		plan.Owners = config.Owners
+		plan.DirTimes = config.DirTimes
+		plan.MetadataOnly = config.MetadataOnly
+		plan.Renames = config.Renames
+		plan.NoPermissions = config.NoPermissions
+	}
+	if config.approved != nil {
+		if err = checkPlan(config.approved, plan); err != nil {
+			return result, err
+		}
+	}
+
+	changes := diffResult.NumChanges() > 0
+	result.Transfer = estimateTransfer(diffResult, config.MetadataOnly)
+	if changes {
+		r.ui.Message("----- changes to push -----")
+		_ = diffResult.WriteDiff(r.ui.Output(), false)
+		r.ui.Message("-----")
+		if err = r.checkTransfer(result.Transfer, "upload", config.MaxTransfer); err != nil {
+			return result, err
+		}
+		if err = r.checkQuota(diffResult); err != nil {
+			return result, err
+		}
+		if !noOp && config.approved == nil && !r.ui.Prompt("Continue?") {
+			// TEST: NOT COVERED
+			return result, fmt.Errorf("exiting")
+		}
+	} else {
+		r.ui.Message("no changes to push")
+	}
+
+	if config.Plan != "" {
+		return result, r.writePlan(config.Plan, plan)
+	}
+	if noOp {
+		return result, nil
+	}
+	if changes {
+		if err = r.runHook(HookPrePush, site, result); err != nil {
+			return result, err
+		}
+	}
+
+	// Apply changes to the repository.
+	err = r.createBusy(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer r.stopHeartbeat()
+	r.tagUploads(site)
+	r.src.SetCaptureOwners(config.Owners)
+	r.src.SetStorageClass(storageClass)
+
+	var interrupted error
+	var failures *misc.Failures
+	if config.KeepGoing {
+		failures = &misc.Failures{}
+	}
+	if changes {
+		// Make sure nobody else pushed while we were computing changes. Nothing has
+		// been modified yet, so it's safe to release the lock.
+		err = r.checkRepoDbUnchanged()
+		if err != nil {
+			// TEST: NOT COVERED
+			_ = r.removeBusy()
+			return nil, err
+		}
+		err = r.pushChangesToRepo(r.src, diffResult, config.MetadataOnly, failures)
+		interrupted = r.ctx.Err()
+		if err != nil && interrupted == nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+	r.detachContext()
+
+	if changes {
+		// Update the repository database. If we were interrupted or some files
+		// failed, it reflects the changes that were pushed, and the rest will be
+		// pushed next time.
+		if interrupted != nil {
+			r.ui.Message("interrupted; recording changes pushed so far")
+		} else if failures.Len() > 0 {
+			r.ui.Message("recording changes that were pushed")
+		}
+		err = r.updateRepoDb()
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+		if interrupted != nil || failures.Len() > 0 {
+			note := "interrupted"
+			if interrupted == nil {
+				note = failures.Err().Error()
+			}
+			err = r.audit("push", site, changeCounts(diffResult), note)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, err
+			}
+			// Don't upload the site database since the repository doesn't contain all
+			// of the site's changes.
+			err = r.removeBusy()
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, err
+			}
+			if interrupted == nil {
+				failures.Summarize(r.ui)
+				return result, fmt.Errorf("push incomplete; push again to push the remaining changes: %w", failures.Err())
+			}
+			return result, fmt.Errorf("push interrupted; push again to push the remaining changes: %w", interrupted)
+		}
+	} else if r.downloadedRepoDb {
+		// Our local copy was outdated, so update it.
+		r.ui.Message("updating local copy of repository database")
+		err = os.Rename(
+			r.localPath(repofiles.TempRepoDb()).Path(),
+			r.localPath(repofiles.RepoDb()).Path(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Store the site's database in the repository
+	err = r.uploadSiteDb(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if changes {
+		err = r.audit("push", site, changeCounts(diffResult), "")
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+	err = r.removeBusy()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if changes {
+		r.runPostHook(HookPostPush, site, result)
+	}
+	return result, nil
+}
+
+// checkRepoFilterCurrent returns an error if the repository filter has changed
+// since this site last pulled. The repository filter's entry in the repository
+// database serves as its version. Pushing with an outdated copy of the filter
+// would compare the site with the repository using the wrong set of paths.
+func (r *Repo) checkRepoFilterCurrent(localRepoDb database.Database) error {
+	repoFilter := repofiles.SiteFilter(repofiles.RepoSite)
+	current := r.repoDb[repoFilter]
+	if current == nil {
+		// TEST: NOT COVERED. The repository filter is always pushed.
+		return nil
+	}
+	sameVersion := func(info *fileinfo.FileInfo) bool {
+		return info != nil &&
+			info.Size == current.Size &&
+			info.ModTime.UnixMilli() == current.ModTime.UnixMilli()
+	}
+	if sameVersion(localRepoDb[repoFilter]) {
+		return nil
+	}
+	// The filter may have been updated without a pull, such as by applying a
+	// bundle.
+	localInfo, err := r.localPath(repoFilter).FileInfo()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// TEST: NOT COVERED
+		return err
+	}
+	if err == nil && sameVersion(localInfo) {
+		return nil
+	}
+	return fmt.Errorf(
+		"the repository filter was changed at %s since this site last pulled; run qfs pull first",
+		misc.FormatTime(current.ModTime),
+	)
+}
+
+// metadataOnly returns the part of diffResult that leaves files' contents alone
+// for PushConfig.MetadataOnly. For each change that is left out, the local site
+// database is given the repository's entry for the path, as if the site still
+// had the repository's version, so that the change is neither pushed nor
+// pulled until the next full push. If write is false, the local site database
+// is not rewritten.
+func (r *Repo) metadataOnly(
+	site string,
+	diffResult *diff.Result,
+	localRepoDb database.Database,
+	localDb database.Database,
+	write bool,
+) (*diff.Result, error) {
+	result := &diff.Result{
+		MetaChange: diffResult.MetaChange,
+	}
+	keep := map[string]bool{}
+	for _, m := range diffResult.MetaChange {
+		keep[m.Info.Path] = true
+	}
+	var skipped []string
+	for _, f := range diffResult.Change {
+		same, err := r.src.SameContents(r.localPath(f.Path), f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			result.Change = append(result.Change, f)
+			keep[f.Path] = true
+		} else {
+			skipped = append(skipped, f.Path)
+		}
+	}
+	for _, f := range diffResult.Add {
+		skipped = append(skipped, f.Path)
+	}
+	for _, f := range diffResult.Rm {
+		skipped = append(skipped, f.Path)
+	}
+	for _, rn := range diffResult.Rename {
+		skipped = append(skipped, rn.Old.Path, rn.New.Path)
+	}
+	for _, c := range diffResult.Check {
+		if keep[c.Path] {
+			result.Check = append(result.Check, c)
+		}
+	}
+	if len(skipped) == 0 {
+		return result, nil
+	}
+	r.ui.Message(
+		"-metadata-only: not pushing %d change(s) to contents or to which files exist; push again without it to push them",
+		len(skipped),
+	)
+	if !write {
+		return result, nil
+	}
+	for _, p := range skipped {
+		if info := localRepoDb[p]; info != nil {
+			localDb[p] = info
+		} else {
+			delete(localDb, p)
+		}
+	}
+	err := database.WriteDb(r.localPath(repofiles.SiteDb(site)).Path(), localDb, database.DbQfs)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	return result, nil
+}
+
+// pushItem is a file to be stored by pushChangesToRepo. If renamedFrom is not
+// empty, the file was renamed from that path.
+type pushItem struct {
+	info        *fileinfo.FileInfo
+	renamedFrom string
+}
+
+// pushChangesToRepo applies diffResult to the repository. If rekey is true,
+// changed files are known to have the same contents as the repository's copies
+// and are copied to their new keys within S3 instead of being uploaded. Renamed
+// files are also copied within S3. If failures is not nil, files that can't be
+// stored are recorded there instead of causing an error.
+func (r *Repo) pushChangesToRepo(
+	src *s3source.S3Source,
+	diffResult *diff.Result,
+	rekey bool,
+	failures *misc.Failures,
+) error {
+	// Delete what needs to be deleted.
+	removed := misc.NewProgress(r.ui, "removed", len(diffResult.Rm))
+	for _, f := range diffResult.Rm {
+		removed.File(0, "removing %s", f.Path)
+	}
+	err := r.src.RemoveBatch(diffResult.Rm)
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("delete keys: %w", err)
+	}
+	removed.Done()
+
+	total := len(diffResult.Rename) + len(diffResult.Add) + len(diffResult.Change)
+	for _, f := range diffResult.MetaChange {
+		if f.Target != nil || f.Permissions != nil || f.DirTime != nil {
+			total++
+		}
+	}
+	stored := misc.NewProgress(r.ui, "stored", total)
+	c := make(chan pushItem, numWorkers)
+	go func() {
+		for _, rn := range diffResult.Rename {
+			c <- pushItem{info: rn.New, renamedFrom: rn.Old.Path}
+		}
+		for _, f := range diffResult.Add {
+			c <- pushItem{info: f}
+		}
+		for _, f := range diffResult.Change {
+			c <- pushItem{info: f}
+		}
+		for _, f := range diffResult.MetaChange {
+			// A link's target is part of its key, so storing a relinked link just
+			// creates an empty object.
+			if f.Target != nil || f.Permissions != nil || f.DirTime != nil {
+				c <- pushItem{info: f.Info}
+			}
+		}
+		close(c)
+	}()
+	var allErrors []error
+	misc.DoConcurrently(
+		func(c chan pushItem, errorChan chan error) {
+			for item := range c {
+				if r.ctx.Err() != nil {
+					continue
+				}
+				f := item.info
+				var err error
+				if item.renamedFrom != "" {
+					stored.File(0, "renaming %s to %s", item.renamedFrom, f.Path)
+					err = src.Rename(r.localPath(f.Path), item.renamedFrom, f.Path)
+				} else if rekey {
+					stored.File(0, "updating metadata of %s", f.Path)
+					err = src.Rekey(r.localPath(f.Path), f.Path)
+				} else {
+					stored.File(f.Size, "storing %s", f.Path)
+					err = src.Store(r.localPath(f.Path), f.Path)
+				}
+				if err != nil && failures != nil {
+					failures.Add(f.Path, err)
+				} else if err != nil {
+					// TEST: NOT COVERED
+					errorChan <- err
+				}
+			}
+		},
+		func(e error) {
+			// TEST: NOT COVERED
+			allErrors = append(allErrors, e)
+		},
+		c,
+		numWorkers,
+	)
+	stored.Done()
+	if len(allErrors) > 0 {
+		// TEST: NOT COVERED
+		return errors.Join(allErrors...)
+	}
+
+	return nil
+}
+
+func (r *Repo) PushDb() error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		return err
+	}
+	unlock, err := r.lockSite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = r.recordSiteDbVersion(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	_, err = r.generateLocalSiteDb(site, false, nil)
+	if err != nil {
+		return err
+	}
+	r.src, err = s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+		s3source.WithObjectLock(r.objectLock),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.tagUploads(site)
+	err = r.uploadSiteDb(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return r.audit("push-db", site, nil, "")
+}
+
+func (r *Repo) SaveDiff(path string, diffResult *diff.Result) error {
+	f, err := misc.CreateAtomic(r.localPath(path).Path())
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	defer f.Discard()
+	err = diffResult.WriteDiff(f, true)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return f.Commit()
+}
+
+// Pull applies changes from the repository to the local site and returns what
+// it found.
+func (r *Repo) Pull(config *PullConfig) (*Result, error) {
+	if err := r.checkOnline("pull"); err != nil {
+		return nil, err
+	}
+	noOp := config.NoOp || config.Plan != ""
+	planning := config.Plan != "" || config.approved != nil
+	if planning && config.Merge {
+		return nil, errors.New("merging can't be used with a plan")
+	}
+	err := r.loadRepoDb()
+	if err != nil {
+		// TEST: not covered
+		return nil, err
+	}
+	err = r.checkBusy()
+	if err != nil {
+		return nil, err
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	unlock, err := r.lockSite()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	err = r.recordSiteDbVersion(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+
+	siteDb, err := r.loadRepoSiteDb(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	filters, err := r.repoFilters(site, config.LocalFilter)
+	if err != nil {
+		return nil, err
+	}
+	subtrees, err := cleanSubtrees(config.Paths)
+	if err != nil {
+		return nil, err
+	}
+	siteFilters := filters
+	subtree := subtreeFilter(subtrees)
+	if subtree != nil {
+		filters = append(slices.Clone(filters), subtree)
+	}
+
+	// Look at differences between the repository's state and the repository's last
+	// record of the site's state.
+	d := makeDiff(
+		filters,
+		diff.WithNonFileTimes(config.DirTimes),
+		diff.WithRenames(config.Renames),
+		diff.WithNoPermissions(config.NoPermissions),
+		diff.WithModifyWindow(r.modifyWindow),
+	)
+	diffResult, err := d.Run(siteDb, r.repoDb)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	result := &Result{Changes: diffResult}
+
+	if !noOp {
+		// Write diff to a local file for reference.
+		err = r.SaveDiff(repofiles.Pull, diffResult)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+
+	var merged []*mergedFile
+	if config.Merge {
+		merged = r.mergeConflicts(diffResult, config.MergeTool)
+		for _, m := range merged {
+			result.Merged = append(result.Merged, m.path)
+		}
+	}
+
+	// Check conflicts
+	localSrc := r.localSource()
+	getLocalInfo := func(path string) (*fileinfo.FileInfo, error) {
+		info, err := localSrc.FileInfo(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+		return info, nil
+	}
+	if planning {
+		result.Conflicts, err = r.reportConflicts(diffResult.Check, getLocalInfo)
+	} else {
+		result.Conflicts, err = r.checkConflicts(diffResult.Check, !config.NoOp, getLocalInfo)
+	}
+	if err != nil {
+		return result, err
+	}
+	caseRenames, err := r.checkCaseCollisions(siteDb, diffResult, config.RenameCaseCollisions, result)
+	if err != nil {
+		return result, err
+	}
+	var plan *Plan
+	if planning {
+		plan = newPlan("pull", site, diffResult, result.Conflicts)
+		plan.Paths = config.Paths
+		plan.LocalFilter = config.LocalFilter
+		plan.BackupDir = config.BackupDir
+		plan.OwnerMap = config.Owners
+		plan.DirTimes = config.DirTimes
+		plan.Renames = config.Renames
+		plan.NoPermissions = config.NoPermissions
+	}
+	if config.approved != nil {
+		if err = checkPlan(config.approved, plan); err != nil {
+			return result, err
+		}
+	}
+
+	changes := diffResult.NumChanges() > 0 || len(merged) > 0
+	result.Transfer = estimateTransfer(diffResult, false)
+	if changes {
+		r.ui.Message("----- changes to pull -----")
+		_ = diffResult.WriteDiff(r.ui.Output(), false)
+		r.ui.Message("-----")
+		if err = r.checkTransfer(result.Transfer, "download", config.MaxTransfer); err != nil {
+			return result, err
+		}
+		if !noOp && config.approved == nil && !r.ui.Prompt("Continue?") {
+			return result, fmt.Errorf("exiting")
+		}
+	} else {
+		r.ui.Message("no changes to pull")
+	}
+
+	if config.Plan != "" {
+		return result, r.writePlan(config.Plan, plan)
+	}
+	if noOp {
+		if config.DeleteExcluded {
+			result.Excluded, err = r.deleteExcluded(siteFilters, subtree, true, "")
+			if err != nil {
+				// TEST: NOT COVERED. Nothing is removed with noOp.
+				return result, err
+			}
+		}
+		return result, nil
+	}
+
+	if changes {
+		if err = r.runHook(HookPrePull, site, result); err != nil {
+			return result, err
+		}
+		r.tagUploads(site)
+		var trashDir string
+		if config.BackupDir != "" {
+			trashDir = sync.TrashDir(config.BackupDir)
+		}
+		var dirTimes database.Database
+		if config.DirTimes {
+			dirTimes = r.repoDb
+		}
+		var stageDir string
+		if config.Stage {
+			stageDir = r.localPath(repofiles.Stage).Path()
+		}
+		var failures *misc.Failures
+		if config.KeepGoing {
+			failures = &misc.Failures{}
+		}
+		err = r.applyChanges(
+			r.src,
+			diffResult,
+			siteDb,
+			trashDir,
+			config.Owners,
+			dirTimes,
+			caseRenames,
+			stageDir,
+			failures,
+			config.Schedule,
+		)
+		interrupted := r.ctx.Err()
+		if err != nil && interrupted == nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+		r.detachContext()
+		if interrupted != nil {
+			r.ui.Message("interrupted; recording changes pulled so far")
+		} else if failures.Len() > 0 {
+			r.ui.Message("recording changes that were pulled")
+		} else {
+			err = r.writeMerged(merged, siteDb)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, err
+			}
+		}
+		// Push a modified copy of the site database. If we were interrupted or some
+		// files failed, it reflects the changes that were applied, and the rest will
+		// be pulled next time.
+		localSiteFile := r.localPath(repofiles.TempSiteDb(site))
+		err = database.WriteDb(localSiteFile.Path(), siteDb, database.DbQfs)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+		err = r.storeSiteDb(site)
+		if err != nil {
+			return nil, err
+		}
+		if interrupted != nil {
+			// Keep the old local copy of the repository database since the site
+			// doesn't match the new one.
+			return result, fmt.Errorf("pull interrupted; pull again to pull the remaining changes: %w", interrupted)
+		}
+		if failures.Len() > 0 {
+			// As above, keep the old local copy of the repository database.
+			failures.Summarize(r.ui)
+			return result, fmt.Errorf("pull incomplete; pull again to pull the remaining changes: %w", failures.Err())
+		}
+	}
+
+	if r.downloadedRepoDb && subtrees != nil {
+		err = r.updateLocalRepoDbSubtrees(subtrees)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	} else if r.downloadedRepoDb {
+		err = os.Rename(
+			r.localPath(repofiles.TempRepoDb()).Path(),
+			r.localPath(repofiles.RepoDb()).Path(),
+		)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+
+	err = r.localPath(repofiles.Push).Remove()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	if config.DeleteExcluded {
+		var trashDir string
+		if config.BackupDir != "" {
+			trashDir = sync.TrashDir(config.BackupDir)
+		}
+		result.Excluded, err = r.deleteExcluded(siteFilters, subtree, false, trashDir)
+		if err != nil {
+			return result, err
+		}
+	}
+	if changes {
+		r.runPostHook(HookPostPull, site, result)
+	}
+
+	return result, nil
+}
+
+// loadRepoSiteDb loads the repository's copy of the given site's database. If
+// the repository doesn't have one, an empty database is returned. A read-only
+// site uses the copy that its last pull kept locally.
+func (r *Repo) loadRepoSiteDb(site string) (database.Database, error) {
+	if r.readOnlySiteDbExists(site) {
+		r.ui.Message("loading read-only site's local copy of site database")
+		return r.loadLocalDb(repofiles.TempSiteDb(site))
+	}
+	repoSiteDbPath := fileinfo.NewPath(r.src, repofiles.SiteDb(site))
+	files, err := database.Load(repoSiteDbPath, database.WithRepoRules(true))
+	if errors.Is(err, fs.ErrNotExist) {
+		r.ui.Message("repository doesn't contain a database for this site")
+		return database.Database{}, nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	r.ui.Message("loading site database from repository")
+	return files, nil
+}
+
+// repoFilters loads the repository and site filters from the repository. If
+// the site filter doesn't exist on the repository, fall back to a local copy
+// for bootstrapping. This makes it possible to bootstrap a new site from the
+// new site rather than pre-creating the filter.
+func (r *Repo) repoFilters(site string, localFilter bool) ([]*filter.Filter, error) {
+	repoFilter := filter.New()
+	repoFilterPath := fileinfo.NewPath(r.src, repofiles.SiteFilter(repofiles.RepoSite))
+	err := repoFilter.ReadFile(repoFilterPath, false)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("reading repository copy of repository filter: %w", err)
+	}
+	var siteFilterPath *fileinfo.Path
+	siteFilter := filter.New()
+	for {
+		if localFilter {
+			siteFilterPath = r.localPath(repofiles.SiteFilter(site))
+		} else {
+			siteFilterPath = fileinfo.NewPath(r.src, repofiles.SiteFilter(site))
+		}
+		groups, err := r.siteGroups(site, !localFilter)
+		if err != nil {
+			return nil, err
+		}
+		siteFilter.SetSiteGroups(groups)
+		err = siteFilter.ReadFile(siteFilterPath, false)
+		if errors.Is(err, fs.ErrNotExist) {
+			if localFilter {
+				r.ui.Message("no filter is configured for this site; bootstrapping with exclude all")
+				siteFilter.SetDefaultInclude(false)
+				break
+			} else {
+				r.ui.Message("site filter does not exist on the repository; trying local copy")
+				localFilter = true
+			}
+		} else if err != nil {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("reading site filter: %w", err)
+		} else {
+			break
+		}
+	}
+	return []*filter.Filter{
+		repoFilter,
+		siteFilter,
+	}, nil
+}
+
+// applyChanges applies diffResult to the local site, copying files from src.
+// If dirTimes is not nil, directory modification times are set from it. If
+// stageDir is not empty, files are staged there first. Files are retrieved in
+// the order given by schedule.
+func (r *Repo) applyChanges(
+	src fileinfo.Source,
+	diffResult *diff.Result,
+	localDb database.Database,
+	trashDir string,
+	owners *fileinfo.OwnerMap,
+	dirTimes database.Database,
+	caseRenames map[string]string,
+	stageDir string,
+	failures *misc.Failures,
+	schedule sync.Schedule,
+) error {
+	symlinks, err := r.symlinkMode()
+	if err != nil {
+		return err
+	}
+	return sync.ApplyChanges(
+		src,
+		r.localSource(localsource.WithModifyWindow(r.modifyWindow)),
+		diffResult,
+		localDb,
+		&sync.ApplyConfig{
+			TrashDir:    trashDir,
+			Owners:      owners,
+			Symlinks:    symlinks,
+			UI:          r.ui,
+			Context:     r.ctx,
+			DirTimes:    dirTimes,
+			CaseRenames: caseRenames,
+			StageDir:    stageDir,
+			Failures:    failures,
+			Schedule:    schedule,
+		},
+		numWorkers,
+	)
+}
+
+// symlinkMode returns the site's handling of symbolic links from .qfs/symlinks.
+// If the file doesn't exist, symbolic links are created.
+func (r *Repo) symlinkMode() (fileinfo.SymlinkMode, error) {
+	data, err := os.ReadFile(r.localPath(repofiles.Symlinks).Path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileinfo.SymlinkCreate, nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return fileinfo.SymlinkCreate, err
+	}
+	mode, err := fileinfo.ParseSymlinkMode(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fileinfo.SymlinkCreate, fmt.Errorf("%s: %w", repofiles.Symlinks, err)
+	}
+	return mode, nil
+}
+
+// keepLinks adds entries from oldDb for symbolic links that the site doesn't
+// create. Without this, a site that skips or copies symbolic links would push
+// their removal or replacement. A link is kept if nothing exists at its path or,
+// when copying, if the file there still matches the link's target.
+func keepLinks(oldDb, newDb database.Database, mode fileinfo.SymlinkMode) {
+	for p, old := range oldDb {
+		if old.FileType != fileinfo.TypeLink {
+			continue
+		}
+		cur, exists := newDb[p]
+		keep := !exists
+		if exists && mode == fileinfo.SymlinkCopy && cur.FileType == fileinfo.TypeFile {
+			if target, ok := fileinfo.LinkTarget(old); ok {
+				t := oldDb[target]
+				keep = t != nil && t.Size == cur.Size && fileinfo.SameTime(t.ModTime, cur.ModTime)
+			}
+		}
+		if keep {
+			newDb[p] = old
+		}
+	}
+}
+
+func (r *Repo) loadRepoDb() error {
+	if r.offline {
+		return r.loadOfflineRepoDb()
+	}
+	src, err := s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	srcPath := fileinfo.NewPath(src, repofiles.RepoDb())
+	srcInfo, err := srcPath.FileInfo()
+	if errors.Is(err, fs.ErrNotExist) {
+		r.repoDb = database.Database{}
+		r.repoDbVersion = nil
+		r.downloadedRepoDb = false
+		r.shardIndex = nil
+		r.initialized = false
+		r.keyVersion = 0
+		r.writeRepoDbRecord(time.Time{})
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return err
+	} else {
+		r.repoDbVersion, err = r.versionOf(src, repofiles.RepoDb(), srcInfo)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		db, downloaded, err := r.loadRepoDbFrom(src, srcInfo)
+		if err != nil {
+			return err
+		}
+		r.repoDb = db
+		r.repoDbInfo = srcInfo
+		r.downloadedRepoDb = downloaded
+		r.initialized = true
+		r.writeRepoDbRecord(srcInfo.ModTime)
+	}
+	return r.newRepoSource()
+}
+
+// newRepoSource creates the source for the repository that uses the
+// repository database. If the version of the repository's keys isn't known,
+// the source uses the version of the keys it finds.
+func (r *Repo) newRepoSource() error {
+	var err error
+	r.src, err = s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+		s3source.WithDatabase(r.repoDb),
+		s3source.WithLayout(r.layout),
+		s3source.WithChunkSize(r.chunkSize),
+		s3source.WithObjectLock(r.objectLock),
+		s3source.WithMFA(r.mfa),
+		s3source.WithKeyVersion(r.keyVersion),
+	)
+	return err
+}
+
+// loadRepoDbCopy loads a local copy of the repository database or of one of its
+// shards and records the version of the repository's keys from its header.
+func (r *Repo) loadRepoDbCopy(relPath string) (database.Database, error) {
+	var h database.Header
+	db, err := r.loadLocalDb(relPath, database.WithRepoRules(true), database.WithHeader(&h))
+	if err != nil {
+		return nil, err
+	}
+	r.keyVersion = max(h.KeyVersion, s3source.KeyVersion1)
+	return db, nil
+}
+
+// repoDbOptions returns the options for writing the repository database or its
+// shards, which record the version of the repository's keys.
+func (r *Repo) repoDbOptions() database.WriterOptions {
+	return database.WithKeyVersion(r.keyVersion)
+}
+
+// loadRepoDbFrom loads the repository database, whose object is described by
+// srcInfo, using local copies that are current. It returns the database and
+// whether anything was downloaded, in which case the database has been written
+// to TempRepoDb, and the local copy in RepoDb is left alone.
+func (r *Repo) loadRepoDbFrom(src *s3source.S3Source, srcInfo *fileinfo.FileInfo) (database.Database, bool, error) {
+	r.shardIndex = nil
+	db, err := r.loadCachedRepoDb(srcInfo)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	} else if db != nil {
+		return db, true, nil
+	}
+	indexCopy, err := fileinfo.RequiresCopy(srcInfo, r.localPath(repofiles.RepoShardIndex))
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	if !indexCopy {
+		// The database is sharded, and we already have its index.
+		return r.loadShards(src, srcInfo)
+	}
+	localPath := r.localPath(repofiles.RepoDb())
+	requiresCopy, err := fileinfo.RequiresCopy(srcInfo, localPath)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	if !requiresCopy {
+		r.ui.Message("local copy of repository database is current")
+		db, err := r.loadRepoDbCopy(repofiles.RepoDb())
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, false, err
+		}
+		// Any copy downloaded earlier is out of date.
+		_ = os.Remove(r.localPath(repofiles.TempRepoDb()).Path())
+		r.removeLocalShards(nil)
+		return db, false, nil
+	}
+	r.ui.Message("downloading latest repository database")
+	pending := r.localPath(repofiles.TempRepoDb())
+	_, err = fileinfo.Retrieve(fileinfo.NewPath(src, repofiles.RepoDb()), pending)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	sharded, err := isShardIndex(pending.Path())
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	if sharded {
+		// Keep what we downloaded as the local copy of the index.
+		indexPath := r.localPath(repofiles.RepoShardIndex).Path()
+		err = os.MkdirAll(filepath.Dir(indexPath), 0o777)
+		if err == nil {
+			err = os.Rename(pending.Path(), indexPath)
+		}
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, false, err
+		}
+		return r.loadShards(src, srcInfo)
+	}
+	db, err = r.loadRepoDbCopy(repofiles.TempRepoDb())
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	r.removeLocalShards(nil)
+	return db, true, nil
+}
+
+// StatusResult is returned by Status.
+type StatusResult struct {
+	Site string
+	// Repository is the location of the repository as s3://bucket/prefix.
+	Repository string
+	// Lock describes the repository lock, if any, and LockExpired indicates
+	// whether it has expired.
+	Lock        string
+	LockExpired bool
+	// LastPush and LastPull are zero if there hasn't been a push or pull.
+	LastPush        time.Time
+	LastPull        time.Time
+	PushedSincePull bool
+	// Unpushed and Unpulled are the changes push and pull would make, and
+	// UnpushedConflicts and UnpulledConflicts are the paths that would conflict.
+	Unpushed          *diff.Result
+	UnpushedConflicts []string
+	Unpulled          *diff.Result
+	UnpulledConflicts []string
+	// Offline is true if the repository wasn't accessed. The lock is unknown,
+	// and the repository is as of LastPush.
+	Offline bool
+}
+
+// Status reports how the local site and the repository have drifted from each
+// other without modifying either. It computes the same diffs as `push -n` and
+// `pull -n` using the local copy of the repository database when it is current.
+// With WithOffline, it uses the newest local copies of the repository database
+// and of the site's database and filters instead.
+func (r *Repo) Status() (*StatusResult, error) {
+	err := r.loadRepoDb()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		return nil, err
+	}
+	var lock *lockInfo
+	if !r.offline {
+		lock, err = r.readLock()
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+	}
+
+	// Local changes not yet pushed: compare the local site with our local copy of
+	// the repository database, as push does.
+	localRepoDb, err := r.loadLocalDb(repofiles.RepoDb(), database.WithRepoRules(true))
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, database.ErrTruncated) {
+		localRepoDb = database.Database{}
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	localDb, err := r.scanLocalSite(site, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	localFilters, err := r.localFilters(site, false)
+	if err != nil {
+		return nil, err
+	}
+	pushResult, err := makeDiff(localFilters, diff.WithModifyWindow(r.modifyWindow)).Run(localRepoDb, localDb)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	pushConflicts, err := findConflicts(pushResult.Check, r.modifyWindow, func(path string) (*fileinfo.FileInfo, error) {
+		return r.repoDb[path], nil
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+
+	// Repository changes not yet pulled: compare the repository's record of this
+	// site with the repository, as pull does. Offline, the local copy of the
+	// site's database is what the site last pushed or pulled.
+	var siteDb database.Database
+	var repoFilters []*filter.Filter
+	if r.offline {
+		siteDb, err = r.loadLocalDb(repofiles.SiteDb(site))
+		if errors.Is(err, fs.ErrNotExist) {
+			siteDb = database.Database{}
+		} else if err != nil {
 			// TEST: NOT COVERED
-			return err
+			return nil, err
 		}
-		err = r.src.Store(localSiteFile, repofiles.SiteDb(site))
+		repoFilters = localFilters
+	} else {
+		siteDb, err = r.loadRepoSiteDb(site)
 		if err != nil {
 			// TEST: NOT COVERED
-			return fmt.Errorf("update site database in repository: %w", err)
+			return nil, err
 		}
-		misc.Message("updated repository copy of site database to reflect changes")
-	}
-
-	if r.downloadedRepoDb {
-		err = os.Rename(
-			r.localPath(repofiles.TempRepoDb()).Path(),
-			r.localPath(repofiles.RepoDb()).Path(),
-		)
+		repoFilters, err = r.repoFilters(site, false)
 		if err != nil {
-			// TEST: NOT COVERED
-			return err
+			return nil, err
 		}
 	}
-
-	err = r.localPath(repofiles.Push).Remove()
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+	pullResult, err := makeDiff(repoFilters, diff.WithModifyWindow(r.modifyWindow)).Run(siteDb, r.repoDb)
+	if err != nil {
 		// TEST: NOT COVERED
-		return err
+		return nil, err
 	}
-
-	return nil
-}
-
-func (r *Repo) applyChangesFromRepo(
-	src *s3source.S3Source,
-	diffResult *diff.Result,
-	localDb database.Database,
-) error {
-	return sync.ApplyChanges(
-		src,
-		localsource.New(r.localTop),
-		diffResult,
-		localDb,
-		numWorkers,
-	)
-}
-
-func (r *Repo) loadRepoDb() error {
-	localPath := r.localPath(repofiles.RepoDb())
-	src, err := s3source.New(
-		r.bucket,
-		r.prefix,
-		s3source.WithS3Client(r.s3Client),
-	)
+	localSrc := r.localSource()
+	pullConflicts, err := findConflicts(pullResult.Check, r.modifyWindow, func(path string) (*fileinfo.FileInfo, error) {
+		info, err := localSrc.FileInfo(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return info, err
+	})
 	if err != nil {
 		// TEST: NOT COVERED
-		return err
+		return nil, err
 	}
-	srcPath := fileinfo.NewPath(src, repofiles.RepoDb())
-	srcInfo, err := srcPath.FileInfo()
-	if errors.Is(err, fs.ErrNotExist) {
-		r.repoDb = database.Database{}
-		r.downloadedRepoDb = false
-		r.initialized = false
-	} else if err != nil {
-		// TEST: NOT COVERED
-		return err
-	} else {
-		var toLoad *fileinfo.Path
-		requiresCopy, err := fileinfo.RequiresCopy(srcInfo, localPath)
-		if err != nil {
-			// TEST: NOT COVERED
-			return err
-		}
-		if !requiresCopy {
-			misc.Message("local copy of repository database is current")
-			toLoad = localPath
+
+	result := &StatusResult{
+		Site:              site,
+		Repository:        fmt.Sprintf("s3://%s/%s", r.bucket, r.prefix),
+		Unpushed:          pushResult,
+		UnpushedConflicts: pushConflicts,
+		Unpulled:          pullResult,
+		UnpulledConflicts: pullConflicts,
+		Offline:           r.offline,
+	}
+	if lock != nil {
+		result.Lock = lock.String()
+		result.LockExpired = lock.expired()
+	}
+	if r.repoDbInfo != nil {
+		result.LastPush = r.repoDbInfo.ModTime
+	}
+	if info, err := r.localPath(repofiles.Pull).FileInfo(); err == nil {
+		result.LastPull = info.ModTime
+	}
+	_, err = r.localPath(repofiles.Push).FileInfo()
+	result.PushedSincePull = err == nil
+	return result, nil
+}
+
+// Write writes the status in the format used by `qfs status`.
+func (s *StatusResult) Write(w io.Writer) error {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
 		}
-		downloaded := false
-		if toLoad == nil {
-			misc.Message("downloading latest repository database")
-			downloaded = true
-			pending := r.localPath(repofiles.TempRepoDb())
-			_, err = fileinfo.Retrieve(fileinfo.NewPath(src, repofiles.RepoDb()), pending)
-			if err != nil {
-				// TEST: NOT COVERED
-				return err
-			}
-			toLoad = pending
+		return misc.FormatTime(t)
+	}
+	lines := []string{
+		fmt.Sprintf("site: %s", s.Site),
+		fmt.Sprintf("repository: %s", s.Repository),
+	}
+	if s.Offline {
+		lines = append(lines, "offline: repository as of last refresh")
+	}
+	if s.Lock != "" {
+		if s.LockExpired {
+			lines = append(lines, fmt.Sprintf("repository has an expired lock held by %s", s.Lock))
+		} else {
+			lines = append(lines, fmt.Sprintf("repository is locked by %s", s.Lock))
 		}
-		db, err := database.Load(toLoad, database.WithRepoRules(true))
-		if err != nil {
+	}
+	lines = append(
+		lines,
+		fmt.Sprintf("last push to repository: %s", formatTime(s.LastPush)),
+		fmt.Sprintf("last pull to site: %s", formatTime(s.LastPull)),
+		fmt.Sprintf("pushed since last pull: %v", s.PushedSincePull),
+		fmt.Sprintf("unpushed changes: %d", s.Unpushed.NumChanges()),
+		fmt.Sprintf("unpushed conflicts: %d", len(s.UnpushedConflicts)),
+		fmt.Sprintf("unpulled changes: %d", s.Unpulled.NumChanges()),
+		fmt.Sprintf("unpulled conflicts: %d", len(s.UnpulledConflicts)),
+	)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
 			// TEST: NOT COVERED
 			return err
 		}
-		r.repoDb = db
-		r.downloadedRepoDb = downloaded
-		r.initialized = true
-	}
-
-	r.src, err = s3source.New(
-		r.bucket,
-		r.prefix,
-		s3source.WithS3Client(r.s3Client),
-		s3source.WithDatabase(r.repoDb),
-	)
-	if err != nil {
-		return err
 	}
 	return nil
 }
 
+// Scan returns the database for a repo: scan input. The repository database,
+// repo:repo, is read from the local copy when it is current, and with
+// WithOffline, it is the only input that can be read.
 func (r *Repo) Scan(input string, filters []*filter.Filter) (database.Database, error) {
 	if !strings.HasPrefix(input, ScanPrefix) {
 		panic("repo.Scan called with input that doesn't start with " + ScanPrefix)
 	}
 	input = input[len(ScanPrefix):]
+	if input == repofiles.RepoSite {
+		if err := r.loadRepoDb(); err != nil {
+			return nil, err
+		}
+		if !r.initialized {
+			return nil, fmt.Errorf("%s%s: repository is not initialized", ScanPrefix, input)
+		}
+		return database.Load(
+			r.localPath(r.loadedRepoDbCopy()),
+			database.WithRepoRules(false),
+			database.WithFilters(filters),
+		)
+	}
+	if err := r.checkOnline(ScanPrefix + input); err != nil {
+		return nil, err
+	}
 	src, err := s3source.New(
 		r.bucket,
 		r.prefix,
 		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
 	)
 	if err != nil {
 		return nil, err
@@ -1013,29 +2646,40 @@ func (r *Repo) Scan(input string, filters []*filter.Filter) (database.Database,
 	)
 }
 
-func (r *Repo) getVersions(path string, config *ListVersionsConfig) (map[string][]*versionData, error) {
+func (r *Repo) getVersions(relPath string, config *ListVersionsConfig) (map[string][]*versionData, error) {
 	var err error
 	r.src, err = s3source.New(
 		r.bucket,
 		r.prefix,
 		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
 	)
 	if err != nil {
 		return nil, err
 	}
-	prefix := filepath.Join(r.prefix, path)
+	prefix := path.Join(r.prefix, filepath.ToSlash(relPath))
+	if relPath == "" && prefix != "" {
+		// Don't match other prefixes that start with this one.
+		prefix += "/"
+	}
 	input := &s3.ListObjectVersionsInput{
 		Bucket: &r.bucket,
 		Prefix: &prefix,
 	}
-	paginator := s3.NewListObjectVersionsPaginator(r.s3Client, input)
+	lister, err := s3lister.New(s3lister.WithS3Client(r.s3Client))
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
 	files := map[string][]*versionData{}
+	var filesMutex gosync.Mutex
+	cache := filter.NewCache(false, config.Filters...)
 	handle := func(key string, size int64, lastModified time.Time, version string, isDelete bool) {
 		info := r.src.KeyToFileInfo(key, size)
 		if info == nil {
 			return
 		}
-		if included, _ := filter.IsIncluded(info.Path, false, config.Filters...); !included {
+		if included, _ := cache.IsIncluded(info.Path); !included {
 			return
 		}
 		// Compare the "as of" time with the S3 modification time so the time reflects
@@ -1044,6 +2688,8 @@ func (r *Repo) getVersions(path string, config *ListVersionsConfig) (map[string]
 		if !config.AsOf.Equal(time.Time{}) && lastModified.After(config.AsOf) {
 			return
 		}
+		filesMutex.Lock()
+		defer filesMutex.Unlock()
 		files[info.Path] = append(files[info.Path], &versionData{
 			key:          key,
 			version:      version,
@@ -1052,17 +2698,21 @@ func (r *Repo) getVersions(path string, config *ListVersionsConfig) (map[string]
 			info:         info,
 		})
 	}
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("error getting versions for s3://%s/%s: %w", r.bucket, prefix, err)
-		}
-		for _, x := range page.Versions {
-			handle(*x.Key, *x.Size, *x.LastModified, *x.VersionId, false)
-		}
-		for _, x := range page.DeleteMarkers {
-			handle(*x.Key, 0, *x.LastModified, *x.VersionId, true)
-		}
+	// Versions are listed in parallel, so they arrive in no particular order.
+	err = lister.ListVersions(
+		r.ctx,
+		input,
+		func(versions []types.ObjectVersion, deleteMarkers []types.DeleteMarkerEntry) {
+			for _, x := range versions {
+				handle(*x.Key, *x.Size, *x.LastModified, *x.VersionId, false)
+			}
+			for _, x := range deleteMarkers {
+				handle(*x.Key, 0, *x.LastModified, *x.VersionId, true)
+			}
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting versions for s3://%s/%s: %w", r.bucket, prefix, err)
 	}
 	for _, data := range files {
 		slices.SortFunc(data, cmpVersionData)
@@ -1075,6 +2725,18 @@ func (r *Repo) ListVersions(path string, config *ListVersionsConfig) error {
 	if err != nil {
 		return err
 	}
+	if config.ShowSite {
+		err = r.getVersionSites(files)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Long {
+		err = r.getVersionBirthTimes(files)
+		if err != nil {
+			return err
+		}
+	}
 	var fileNames []string
 	for k := range maps.Keys(files) {
 		fileNames = append(fileNames, k)
@@ -1082,11 +2744,11 @@ func (r *Repo) ListVersions(path string, config *ListVersionsConfig) error {
 	sort.Strings(fileNames)
 	for _, p := range fileNames {
 		data := files[p]
-		fmt.Println(p)
+		_, _ = fmt.Fprintln(r.ui.Output(), p)
 		for i, x := range data {
 			if x.isDelete {
 				if i == 0 {
-					fmt.Printf("  %v deleted\n", misc.FormatTime(x.lastModified))
+					_, _ = fmt.Fprintf(r.ui.Output(), "  %v deleted\n", misc.FormatTime(x.lastModified))
 				}
 				continue
 			}
@@ -1096,7 +2758,10 @@ func (r *Repo) ListVersions(path string, config *ListVersionsConfig) error {
 			} else {
 				extra = fmt.Sprintf("%04o %d", x.info.Permissions, x.info.Size)
 			}
-			fmt.Printf(
+			if config.ShowSite {
+				extra += " site=" + x.site
+			}
+			_, _ = fmt.Fprintf(r.ui.Output(),
 				"  %v %c %v %v\n",
 				misc.FormatTime(x.lastModified),
 				x.info.FileType,
@@ -1104,41 +2769,147 @@ func (r *Repo) ListVersions(path string, config *ListVersionsConfig) error {
 				extra,
 			)
 			if config.Long {
-				fmt.Printf("    %v %v\n", x.key, x.version)
+				_, _ = fmt.Fprintf(r.ui.Output(), "    %v %v", x.key, x.version)
+				if !x.birthTime.IsZero() {
+					_, _ = fmt.Fprintf(r.ui.Output(), " btime=%v", misc.FormatTime(x.birthTime))
+				}
+				_, _ = fmt.Fprintln(r.ui.Output())
 			}
 		}
 	}
 	return nil
 }
 
-func (r *Repo) Get(path string, saveLocation string, config *GetConfig) error {
-	dest := localsource.New(saveLocation)
-	_, err := dest.FileInfo(path)
-	var pathError *os.PathError
-	if !(errors.As(err, &pathError) && os.IsNotExist(pathError)) {
-		return fmt.Errorf("%s must not exist", filepath.Join(saveLocation, path))
+// DiffVersions compares the state of the repository at or below path at two
+// times, as reconstructed from version history. If To is zero, the current
+// state is used.
+func (r *Repo) DiffVersions(path string, config *DiffVersionsConfig) (*diff.Result, error) {
+	if !config.To.IsZero() && !config.From.Before(config.To) {
+		return nil, fmt.Errorf("%s is not before %s", misc.FormatTime(config.From), misc.FormatTime(config.To))
 	}
 	files, err := r.getVersions(
 		path,
 		&ListVersionsConfig{
-			AsOf:    config.AsOf,
+			AsOf:    config.To,
 			Filters: config.Filters,
 		},
 	)
+	if err != nil {
+		return nil, err
+	}
+	fromDb := database.Database{}
+	toDb := database.Database{}
+	for p, data := range files {
+		if len(data) > 0 && !data[0].isDelete {
+			toDb[p] = data[0].info
+		}
+		// Versions are sorted newest first, so the first one that isn't newer than
+		// From gives the state at that time.
+		for _, v := range data {
+			if !v.lastModified.After(config.From) {
+				if !v.isDelete {
+					fromDb[p] = v.info
+				}
+				break
+			}
+		}
+	}
+	return makeDiff(nil).Run(fromDb, toDb)
+}
+
+// getVersionSites retrieves the tags of each version to determine which site
+// stored it. Versions stored before tagging was introduced or by other means
+// are reported as "unknown".
+func (r *Repo) getVersionSites(files map[string][]*versionData) error {
+	return forEachVersion(files, func(v *versionData) error {
+		tags, err := r.src.Tags(v.key, &v.version)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		v.site = tags[TagSite]
+		if v.site == "" {
+			v.site = "unknown"
+		}
+		return nil
+	})
+}
+
+// getVersionBirthTimes retrieves the creation time, if one was saved, of each
+// version.
+func (r *Repo) getVersionBirthTimes(files map[string][]*versionData) error {
+	return forEachVersion(files, func(v *versionData) error {
+		var err error
+		v.birthTime, err = r.src.VersionBirthTime(v.key, &v.version)
+		return err
+	})
+}
+
+// forEachVersion calls fn concurrently for each version that isn't a delete
+// marker.
+func forEachVersion(files map[string][]*versionData, fn func(*versionData) error) error {
+	c := make(chan *versionData, numWorkers)
+	go func() {
+		for _, data := range files {
+			for _, v := range data {
+				if !v.isDelete {
+					c <- v
+				}
+			}
+		}
+		close(c)
+	}()
+	var allErrors []error
+	misc.DoConcurrently(
+		func(c chan *versionData, errorChan chan error) {
+			for v := range c {
+				if err := fn(v); err != nil {
+					errorChan <- err
+				}
+			}
+		},
+		func(e error) {
+			// TEST: NOT COVERED
+			allErrors = append(allErrors, e)
+		},
+		c,
+		numWorkers,
+	)
+	return errors.Join(allErrors...)
+}
+
+func (r *Repo) Get(path string, saveLocation string, config *GetConfig) error {
+	if config.Stdout {
+		return r.getToOutput(path, config)
+	}
+	owners := config.Owners
+	if owners != nil && os.Geteuid() != 0 {
+		r.ui.Message("not changing ownerships: this requires running as root")
+		owners = nil
+	}
+	symlinks, err := r.symlinkMode()
+	if err != nil {
+		return err
+	}
+	dest := localsource.New(saveLocation, localsource.WithModifyWindow(r.modifyWindow))
+	_, err = dest.FileInfo(path)
+	var pathError *os.PathError
+	if !(errors.As(err, &pathError) && os.IsNotExist(pathError)) {
+		return fmt.Errorf("%s must not exist", filepath.Join(saveLocation, path))
+	}
+	toGet, err := r.getSelected(path, config)
 	if err != nil {
 		return err
 	}
 	c := make(chan *versionData, numWorkers)
 	var allErrors []error
-	fileNames := misc.SortedKeys(files)
+	var failures *misc.Failures
+	if config.KeepGoing {
+		failures = &misc.Failures{}
+	}
 	go func() {
-		for _, p := range fileNames {
-			data := files[p]
-			if len(data) == 0 || data[0].isDelete {
-				continue
-			}
-			v := data[0]
-			fmt.Println(p)
+		for _, v := range toGet {
+			_, _ = fmt.Fprintln(r.ui.Output(), v.info.Path)
 			c <- v
 		}
 		close(c)
@@ -1147,14 +2918,29 @@ func (r *Repo) Get(path string, saveLocation string, config *GetConfig) error {
 		func(c chan *versionData, errorChan chan error) {
 			for v := range c {
 				p := v.info.Path
+				if v.info.FileType == fileinfo.TypeLink && !symlinks.CreatesLinks() {
+					r.ui.Message("skipping symbolic link %s", p)
+					continue
+				}
+				destPath := fileinfo.NewPath(dest, p)
 				_, err := fileinfo.RetrieveFromInfo(
 					v.info,
-					fileinfo.NewPath(dest, p),
+					destPath,
 					func(f *os.File) error {
 						return r.src.DownloadVersion(v.key, &v.version, f)
 					},
 				)
-				if err != nil {
+				if err == nil && owners != nil {
+					// TEST: NOT COVERED. Tests don't run as root.
+					var owner *fileinfo.Owner
+					owner, err = r.src.VersionOwner(v.key, &v.version)
+					if err == nil {
+						err = owners.Apply(destPath.Path(), owner)
+					}
+				}
+				if err != nil && failures != nil {
+					failures.Add(p, err)
+				} else if err != nil {
 					errorChan <- err
 					return
 				}
@@ -1166,7 +2952,139 @@ func (r *Repo) Get(path string, saveLocation string, config *GetConfig) error {
 		c,
 		1, ///numWorkers,
 	)
-	return errors.Join(allErrors...)
+	if len(allErrors) > 0 {
+		return errors.Join(allErrors...)
+	}
+	if config.DirTimes {
+		// Now that the directories' contents are in place, set their times.
+		var dirs []*fileinfo.FileInfo
+		for _, v := range toGet {
+			if v.info.FileType == fileinfo.TypeDirectory {
+				dirs = append(dirs, v.info)
+			}
+		}
+		if err = sync.SetDirTimes(dest, dirs); err != nil {
+			return err
+		}
+	}
+	failures.Summarize(r.ui)
+	return failures.Err()
+}
+
+// getToOutput writes the contents of a single file to the UI's output. Nothing
+// else is written so that the output can be piped.
+func (r *Repo) getToOutput(relPath string, config *GetConfig) error {
+	_, rd, err := r.OpenFile(relPath, config)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rd.Close() }()
+	_, err = io.Copy(r.ui.Output(), rd)
+	return err
+}
+
+// versionToGet returns the version Get retrieves from data, which contains a
+// path's versions, newest first, or nil if the path should be skipped.
+func versionToGet(data []*versionData, config *GetConfig) *versionData {
+	if len(data) == 0 {
+		return nil
+	}
+	switch {
+	case config.VersionId != "":
+		for _, v := range data {
+			if v.version == config.VersionId && !v.isDelete {
+				return v
+			}
+		}
+		return nil
+	case config.DeletedOnly:
+		if !data[0].isDelete {
+			return nil
+		}
+		for _, v := range data[1:] {
+			if !v.isDelete {
+				return v
+			}
+		}
+		return nil
+	case data[0].isDelete:
+		return nil
+	}
+	return data[0]
+}
+
+// getSelected returns the versions Get retrieves for relPath, sorted by path.
+func (r *Repo) getSelected(relPath string, config *GetConfig) ([]*versionData, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	files, err := r.getVersions(
+		relPath,
+		&ListVersionsConfig{
+			AsOf:    config.AsOf,
+			Filters: config.Filters,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if config.VersionId != "" {
+		// A version ID identifies a version of a single path, and getVersions finds
+		// everything that starts with relPath, so look for an exact match.
+		relPath = path.Clean(filepath.ToSlash(relPath))
+		v := versionToGet(files[relPath], config)
+		if v == nil {
+			return nil, fmt.Errorf("%s: version %s not found", relPath, config.VersionId)
+		}
+		return []*versionData{v}, nil
+	}
+	var result []*versionData
+	for _, p := range misc.SortedKeys(files) {
+		if v := versionToGet(files[p], config); v != nil {
+			result = append(result, v)
+		}
+	}
+	if config.DeletedOnly && len(result) == 0 {
+		r.ui.Message("no deleted files found")
+	}
+	return result, nil
+}
+
+// OpenFile returns information about the version of a single regular file that
+// Get would retrieve along with a reader for its contents, which the caller
+// must close. Only AsOf, Filters, VersionId, and DeletedOnly from config are
+// used.
+func (r *Repo) OpenFile(relPath string, config *GetConfig) (*fileinfo.FileInfo, io.ReadCloser, error) {
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if err := config.check(); err != nil {
+		return nil, nil, err
+	}
+	files, err := r.getVersions(
+		relPath,
+		&ListVersionsConfig{
+			AsOf:    config.AsOf,
+			Filters: config.Filters,
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	// getVersions finds everything that starts with relPath, so look for an exact
+	// match.
+	v := versionToGet(files[relPath], config)
+	if v == nil && config.VersionId != "" {
+		return nil, nil, fmt.Errorf("%s: version %s not found", relPath, config.VersionId)
+	} else if v == nil {
+		return nil, nil, fmt.Errorf("%s: %w", relPath, fs.ErrNotExist)
+	}
+	if v.info.FileType != fileinfo.TypeFile {
+		return nil, nil, fmt.Errorf("%s is not a regular file", relPath)
+	}
+	rd, err := r.src.OpenVersion(v.key, &v.version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v.info, rd, nil
 }
 
 func (r *Repo) PushTimes() error {
@@ -1183,7 +3101,7 @@ func (r *Repo) PushTimes() error {
 		if x.isDelete {
 			continue
 		}
-		fmt.Printf("%v\n", misc.FormatTime(x.lastModified))
+		_, _ = fmt.Fprintf(r.ui.Output(), "%v\n", misc.FormatTime(x.lastModified))
 	}
 	return nil
 }
@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFindConflicts(t *testing.T) {
+	var checks []*diff.Check
+	var exp []string
+	for i := range 50 {
+		p := fmt.Sprintf("f%02d", i)
+		checks = append(checks, &diff.Check{Path: p, ModTime: []int64{int64(i)}})
+		if i%3 == 0 {
+			exp = append(exp, p)
+		}
+	}
+	getInfo := func(path string) (*fileinfo.FileInfo, error) {
+		var i int
+		_, _ = fmt.Sscanf(path, "f%d", &i)
+		// Make later lookups finish first.
+		time.Sleep(time.Duration(50-i) * time.Millisecond / 10)
+		switch i % 3 {
+		case 0:
+			return &fileinfo.FileInfo{Path: path, ModTime: time.UnixMilli(int64(i + 1))}, nil
+		case 1:
+			return &fileinfo.FileInfo{Path: path, ModTime: time.UnixMilli(int64(i))}, nil
+		}
+		return nil, nil
+	}
+	conflicts, err := findConflicts(checks, 0, getInfo)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !slices.Equal(conflicts, exp) {
+		t.Errorf("wrong conflicts: %v", conflicts)
+	}
+	// Within the window, differing modification times aren't conflicts.
+	conflicts, err = findConflicts(checks, time.Millisecond, getInfo)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("wrong conflicts: %v", conflicts)
+	}
+
+	getInfo = func(path string) (*fileinfo.FileInfo, error) {
+		if path == "f10" || path == "f40" {
+			return nil, errors.New(path)
+		}
+		return nil, nil
+	}
+	_, err = findConflicts(checks, 0, getInfo)
+	if err == nil || err.Error() != "f10" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package repo_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,6 +19,7 @@ import (
 	"github.com/jberkenbilt/qfs/repofiles"
 	"github.com/jberkenbilt/qfs/s3source"
 	"github.com/jberkenbilt/qfs/s3test"
+	"github.com/jberkenbilt/qfs/sync"
 	"github.com/jberkenbilt/qfs/testutil"
 	"io"
 	"io/fs"
@@ -27,6 +29,7 @@ import (
 	"regexp"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -119,6 +122,8 @@ func deleteTestBucket() {
 				Delete: &types.Delete{
 					Objects: objects,
 				},
+				// TestObjectLock leaves objects in governance mode.
+				BypassGovernanceRetention: aws.Bool(true),
 			}
 			_, err = s3Client.DeleteObjects(ctx, i2)
 			if err != nil {
@@ -508,7 +513,7 @@ func TestRepo_IsInitialized(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	err = r.Init(repo.InitCleanRepo)
+	err = r.Init(&repo.InitConfig{Mode: repo.InitCleanRepo})
 	var nsb *types.NoSuchBucket
 	if err == nil || !errors.As(err, &nsb) {
 		t.Errorf("wrong error: %v", err)
@@ -551,6 +556,50 @@ func TestMigrate(t *testing.T) {
 		testutil.Check(t, err)
 	}
 
+	// See what would be migrated without changing anything.
+	expReport := `repo/one/out-of-date: local file is newer than object
+repo/one/in-sync -> repo/one/in-sync@f,1715856724523,0644
+repo/two/also-in-sync -> repo/two/also-in-sync@f,1715856724523,0444
+`
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	testutil.ExpStdout(
+		t,
+		func() {
+			err := qfs.Run([]string{"qfs", "init-repo", "-migrate", "-n", "-report", reportFile, "-top", tmp})
+			if err != nil {
+				t.Error(err.Error())
+			}
+		},
+		expReport,
+		"",
+	)
+	checkMessages(t, []string{
+		"wrote migration report to " + reportFile,
+		"----- keys that can't be migrated -----",
+		"-----",
+		"----- keys to migrate -----",
+		"-----",
+		"migration requires 2 copies of 0 within S3 and 2 deletions",
+	},
+	)
+	data, err := os.ReadFile(reportFile)
+	testutil.Check(t, err)
+	report := &repo.MigrateReport{}
+	testutil.Check(t, json.Unmarshal(data, report))
+	if len(report.Move) != 2 || report.Move[1].NewKey != "repo/two/also-in-sync@f,1715856724523,0444" ||
+		len(report.Skip) != 1 || report.Skip[0].Key != "repo/one/out-of-date" ||
+		report.Copies != 2 || report.Deletes != 2 || report.Bytes != 0 {
+		t.Errorf("wrong report: %s", data)
+	}
+	// Nothing was changed.
+	src, err := s3source.New(TestBucket, "repo", s3source.WithS3Client(s3Client))
+	testutil.Check(t, err)
+	_, err = src.Database(true, true, nil)
+	testutil.Check(t, err)
+	if len(src.ExtraKeys()) != 3 {
+		t.Errorf("wrong keys after no-op: %v", src.ExtraKeys())
+	}
+
 	// Migrate keys we can migrate.
 	testutil.ExpStdout(
 		t,
@@ -558,20 +607,35 @@ func TestMigrate(t *testing.T) {
 			misc.TestPromptChannel <- "y" // Continue?
 			_ = qfs.Run([]string{"qfs", "init-repo", "-migrate", "-top", tmp})
 		},
-		`repo/one/in-sync -> repo/one/in-sync@f,1715856724523,0644
-repo/two/also-in-sync -> repo/two/also-in-sync@f,1715856724523,0444
-prompt: Continue?
-`,
+		expReport+"prompt: Continue?\n",
 		"",
 	)
 	checkMessages(t, []string{
+		"----- keys that can't be migrated -----",
+		"-----",
 		"----- keys to migrate -----",
 		"-----",
+		"migration requires 2 copies of 0 within S3 and 2 deletions",
 		"moving repo/one/in-sync -> repo/one/in-sync@f,1715856724523,0644",
 		"moving repo/two/also-in-sync -> repo/two/also-in-sync@f,1715856724523,0444",
 		"uploading repository database",
 	},
 	)
+	testutil.ExpStdout(
+		t,
+		func() {
+			_ = qfs.Run([]string{"qfs", "init-repo", "-migrate", "-n", "-top", tmp})
+		},
+		"repo/one/out-of-date: local file is newer than object\n",
+		"",
+	)
+	checkMessages(t, []string{
+		"local copy of repository database is current",
+		"----- keys that can't be migrated -----",
+		"-----",
+		"no keys to migrate",
+	},
+	)
 
 	// Do an initial push. This will push everything that was not migrated. This has
 	// to be done before init-repo -cleanup so the repo filter will be there.
@@ -943,6 +1007,51 @@ prompt: Continue?
 		t.Errorf("wrong error: %v", err)
 	}
 
+	// Status right after a push shows no drift in either direction.
+	statusOut, _ := testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "status", "-top", j("site1")})
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+	})
+	statusRe := regexp.MustCompile(`^site: site1
+repository: s3://qfs-test-repo/home
+last push to repository: \d{4}-\d{2}-\d{2}_\d{2}:\d{2}:\d{2}\.\d{3}
+last pull to site: never
+pushed since last pull: true
+unpushed changes: 0
+unpushed conflicts: 0
+unpulled changes: 0
+unpulled conflicts: 0
+$`)
+	if !statusRe.Match(statusOut) {
+		t.Errorf("wrong status output: %s", statusOut)
+	}
+	checkMessages(t, []string{
+		"local copy of repository database is current",
+		"generating local database",
+		"loading site database from repository",
+	})
+
+	// Diffing the repository against the site sees what push sees, which is
+	// nothing. Diffing against the repository's copy of the site database
+	// shows the same thing.
+	testutil.ExpStdout(
+		t,
+		func() {
+			err = qfs.Run([]string{"qfs", "diff", "-top", j("site1"), "repo:", j("site1")})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+			err = qfs.Run([]string{"qfs", "diff", "-top", j("site1"), "repo:site1", j("site1")})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		},
+		"",
+		"",
+	)
+
 	// Change file on site1 without pushing -- will be pushed later.
 	writeFile(t, j("site1/dir1/change-in-site1"), start, 0o644, "")
 
@@ -1277,6 +1386,28 @@ add dir2/link-to-remove
 	if string(lvOut1) == string(lvOutLong1) {
 		t.Errorf("regular and long outputs are the same")
 	}
+	// Objects are tagged with the site that stored them.
+	lvOutSite, _ := testutil.WithStdout(
+		func() {
+			testutil.Check(t, qfs.Run([]string{
+				"qfs",
+				"list-versions",
+				"-top",
+				j("site2"),
+				"-show-site",
+				".qfs/db",
+			}))
+		},
+	)
+	for _, exp := range []string{
+		"0644 ", // confirm normal output is there
+		"site=site1\n",
+		"site=site2\n",
+	} {
+		if !strings.Contains(string(lvOutSite), exp) {
+			t.Errorf("didn't find %q in list-versions -show-site output: %s", exp, lvOutSite)
+		}
+	}
 
 	// In the next stage of testing, exercise that changes are carried across.
 	// Advance the timestamps so changes are detected in case the test suite runs
@@ -1348,9 +1479,9 @@ mkdir dir4
 add dir4/only-site-2
 change dir1/file-to-change-and-chmod
 change dir1/ro-file-to-change
-change dir2/link-to-change
 chmod 0600 dir1/file-to-chmod
 chmod 0750 dir2/dir-to-chmod
+relink dir2/link-to-change -> new-target
 `,
 		"",
 	)
@@ -1404,9 +1535,9 @@ mkdir dir4
 add dir4/only-site-2
 change dir1/file-to-change-and-chmod
 change dir1/ro-file-to-change
-change dir2/link-to-change
 chmod 0600 dir1/file-to-chmod
 chmod 0750 dir2/dir-to-chmod
+relink dir2/link-to-change -> new-target
 prompt: Continue?
 `,
 		"",
@@ -1576,9 +1707,9 @@ add dir2/new-file
 add dir2/new-link
 change dir1/file-to-change-and-chmod
 change dir1/ro-file-to-change
-change dir2/link-to-change
 chmod 0600 dir1/file-to-chmod
 chmod 0750 dir2/dir-to-chmod
+relink dir2/link-to-change -> new-target
 `,
 		"",
 	)
@@ -1627,9 +1758,9 @@ add dir2/new-file
 add dir2/new-link
 change dir1/file-to-change-and-chmod
 change dir1/ro-file-to-change
-change dir2/link-to-change
 chmod 0600 dir1/file-to-chmod
 chmod 0750 dir2/dir-to-chmod
+relink dir2/link-to-change -> new-target
 prompt: Continue?
 `,
 		"",
@@ -2115,6 +2246,106 @@ prompt: Continue?
 	_, err = s3Client.DeleteObject(ctx, deleteInput)
 	testutil.Check(t, err)
 
+	// Unlock validates ownership unless forced. A lock with no content, as
+	// created by older versions, has no known owner.
+	_, err = s3Client.PutObject(ctx, putInput)
+	testutil.Check(t, err)
+	err = qfs.Run([]string{"qfs", "unlock", "-top", j("site1")})
+	if err == nil || !strings.Contains(err.Error(), "owner of lock is unknown") {
+		t.Errorf("%v", err)
+	}
+	hostname, err := os.Hostname()
+	testutil.Check(t, err)
+	putLock := func(site string, when time.Time) string {
+		t.Helper()
+		lock := &struct {
+			Site string    `json:"site"`
+			Host string    `json:"host"`
+			PID  int       `json:"pid"`
+			Time time.Time `json:"time"`
+		}{site, hostname, os.Getpid(), when}
+		data, err := json.Marshal(lock)
+		testutil.Check(t, err)
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(TestBucket),
+			Key:    aws.String("home/.qfs/busy"),
+			Body:   bytes.NewReader(data),
+		})
+		testutil.Check(t, err)
+		return fmt.Sprintf(
+			"site %s on host %s (pid %d) since %s",
+			site,
+			hostname,
+			os.Getpid(),
+			misc.FormatTime(when),
+		)
+	}
+	owner := putLock("site2", time.Now())
+	err = qfs.Run([]string{"qfs", "push", "-top", j("site1")})
+	if err == nil || !strings.Contains(err.Error(), "repository is locked by "+owner) {
+		t.Errorf("%v", err)
+	}
+	err = qfs.Run([]string{"qfs", "unlock", "-top", j("site1")})
+	if err == nil || !strings.Contains(err.Error(), "use -force to remove it") {
+		t.Errorf("%v", err)
+	}
+	err = qfs.Run([]string{"qfs", "unlock", "-force", "-top", j("site1")})
+	testutil.Check(t, err)
+	err = qfs.Run([]string{"qfs", "unlock", "-top", j("site1")})
+	testutil.Check(t, err)
+	checkMessages(t, []string{
+		"local copy of repository database is current",
+		"removed lock held by " + owner,
+		"repository is not locked",
+	})
+	// This site's own lock can be removed without -force once its process is
+	// gone. Here, the "process" is the test itself.
+	owner = putLock("site1", time.Now())
+	err = qfs.Run([]string{"qfs", "unlock", "-top", j("site1")})
+	testutil.Check(t, err)
+	checkMessages(t, []string{"removed lock held by " + owner})
+	// An expired lock is only ignored if the user agrees.
+	owner = putLock("site2", time.Now().Add(-2*repo.LockTTL))
+	expiredMessage := "the repository lock held by " + owner + " has expired; that operation may not" +
+		" have finished, so the repository database may be inconsistent"
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "n"
+			err = qfs.Run([]string{"qfs", "pull", "-n", "-top", j("site1")})
+			if err == nil || !strings.Contains(err.Error(), "run qfs doctor or qfs unlock") {
+				t.Errorf("%v", err)
+			}
+		},
+		"prompt: Ignore the expired lock?\n",
+		"",
+	)
+	checkMessages(t, []string{
+		"local copy of repository database is current",
+		expiredMessage,
+	})
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run([]string{"qfs", "pull", "-n", "-top", j("site1")})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		},
+		"prompt: Ignore the expired lock?\n",
+		"",
+	)
+	checkMessages(t, []string{
+		"local copy of repository database is current",
+		expiredMessage,
+		"loading site database from repository",
+		"no conflicts found",
+		"no changes to pull",
+	})
+	_, err = s3Client.DeleteObject(ctx, deleteInput)
+	testutil.Check(t, err)
+
 	// Bring site2 back in sync
 	testutil.ExpStdout(
 		t,
@@ -2238,6 +2469,28 @@ dir1/ro-file-to-change
 		"",
 		"",
 	)
+	// Get a single file to standard output.
+	expContents, _ := os.ReadFile(j("sync/dir1/file-to-chmod"))
+	stdout, _ := testutil.WithStdout(func() {
+		err = qfs.Run([]string{
+			"qfs",
+			"get",
+			"-top",
+			j("site2"),
+			"-stdout",
+			"dir1/file-to-chmod",
+		})
+	})
+	testutil.Check(t, err)
+	if !bytes.Equal(stdout, expContents) {
+		t.Errorf("wrong output: %s", stdout)
+	}
+	_, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "get", "-top", j("site2"), "-stdout", "dir1"})
+	})
+	if err == nil || err.Error() != "dir1 is not a regular file" {
+		t.Errorf("wrong error: %v", err)
+	}
 	// Get from an earlier time
 	testutil.ExpStdout(
 		t,
@@ -2282,6 +2535,43 @@ dir1/ro-file-to-change
 		"",
 		"",
 	)
+	// Export the same files to a tar archive. Extracted, it should also match
+	// sync2.
+	testutil.Check(t, qfs.Run([]string{
+		"qfs",
+		"export-tar",
+		"-top",
+		j("site2"),
+		"dir1",
+		"-as-of",
+		pushTime1,
+		"-o",
+		j("export.tar.gz"),
+	}))
+	testutil.Check(t, gztar.Extract(j("export.tar.gz"), j("export")))
+	testutil.ExpStdout(
+		t,
+		func() {
+			err = qfs.Run([]string{
+				"qfs",
+				"diff",
+				j("sync2/dir1"),
+				j("export/dir1"),
+			})
+			if err != nil {
+				t.Error(err.Error())
+			}
+		},
+		"",
+		"",
+	)
+	err = qfs.Run([]string{"qfs", "export-tar", "-top", j("site2"), "dir9", "-o", j("export2.tar.gz")})
+	if err == nil || !strings.Contains(err.Error(), "dir9: file does not exist") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, err := os.Stat(j("export2.tar.gz")); err == nil {
+		t.Errorf("failed export left an archive")
+	}
 	// Get with a filter. It should match what we synced except the filtered files.
 	// Use site1 to read the repo data. It's the same, so it doesn't matter.
 	testutil.ExpStdout(
@@ -2407,7 +2697,7 @@ prompt: Continue?
 	putInput.Key = aws.String("this/is/safe")
 	_, err = s3Client.PutObject(ctx, putInput)
 	testutil.Check(t, err)
-	stdout, _ := testutil.WithStdout(func() {
+	stdout, _ = testutil.WithStdout(func() {
 		misc.TestPromptChannel <- "y"
 		err = qfs.Run([]string{"qfs", "init-repo", "-clean-repo", "-top", j("site1")})
 		if err != nil {
@@ -2514,3 +2804,2800 @@ prompt: Continue?
 		"updated repository copy of site database to reflect changes",
 	})
 }
+
+func TestMerge(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/text"), start, 0o644, base)
+	writeFile(t, j("site1/dir/other"), start, 0o644, base)
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2")}))
+	})
+
+	// Change the files differently on each site.
+	time.Sleep(10 * time.Millisecond)
+	writeFile(t, j("site1/dir/text"), start+1000, 0o644, "ONE\ntwo\nthree\nfour\nfive\n")
+	writeFile(t, j("site1/dir/other"), start+1000, 0o644, "one\ntwo\n3\nfour\nfive\n")
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+	})
+	writeFile(t, j("site2/dir/text"), start+2000, 0o644, "one\ntwo\nthree\nfour\nFIVE\n")
+	writeFile(t, j("site2/dir/other"), start+2000, 0o644, "one\ntwo\nTHREE\nfour\nfive\n")
+
+	// Without -merge, both files are conflicts.
+	testutil.ExpStdout(
+		t,
+		func() {
+			err := qfs.Run([]string{"qfs", "pull", "-n", "-top", j("site2")})
+			if err == nil || err.Error() != "conflicts detected" {
+				t.Errorf("%v", err)
+			}
+		},
+		`conflict: dir/other
+conflict: dir/text
+`,
+		"",
+	)
+
+	// With -merge, the non-overlapping change is merged, and the other file
+	// remains a conflict.
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "n" // Conflicts detected. Exit?
+			misc.TestPromptChannel <- "y" // Continue?
+			err := qfs.Run([]string{"qfs", "pull", "-merge", "-top", j("site2")})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		},
+		`merged: dir/text
+conflict: dir/other
+prompt: Conflicts detected. Exit?
+change dir/other
+prompt: Continue?
+`,
+		"",
+	)
+	data, err := os.ReadFile(j("site2/dir/text"))
+	testutil.Check(t, err)
+	if string(data) != "ONE\ntwo\nthree\nfour\nFIVE\n" {
+		t.Errorf("wrong merge result: %q", data)
+	}
+	data, err = os.ReadFile(j("site2/dir/other"))
+	testutil.Check(t, err)
+	if string(data) != "one\ntwo\n3\nfour\nfive\n" {
+		t.Errorf("conflicting file was not overridden: %q", data)
+	}
+
+	// The merged file is pushed without conflicts.
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y" // Continue?
+			err := qfs.Run([]string{"qfs", "push", "-top", j("site2")})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		},
+		`change dir/text
+prompt: Continue?
+`,
+		"",
+	)
+}
+
+func TestReplicate(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	writeFile(t, j("site1/dir/b@c"), start, 0o644, "b@c")
+	writeFile(t, j("site1/dir/d e"), start, 0o644, "d e")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+	})
+	// Create some history.
+	writeFile(t, j("site1/dir/a"), start+1000, 0o644, "a2")
+	testutil.Check(t, os.Remove(j("site1/dir/d e")))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+	})
+
+	for _, c := range []struct {
+		prefix string
+		args   []string
+	}{
+		{"replica", nil},
+		{"replica-versions", []string{"-versions"}},
+	} {
+		dest := "s3://" + TestBucket + "/" + c.prefix
+		_, _ = testutil.WithStdout(func() {
+			testutil.Check(t, qfs.Run(append(
+				[]string{"qfs", "replicate", "-top", j("site1"), "-dest", dest},
+				c.args...,
+			)))
+		})
+		err := qfs.Run([]string{"qfs", "replicate", "-top", j("site1"), "-dest", dest})
+		if err == nil || err.Error() != dest+" already contains a repository" {
+			t.Errorf("wrong error: %v", err)
+		}
+		site2 := j(c.prefix)
+		writeFile(t, filepath.Join(site2, ".qfs/repo"), start, 0o644, dest+"\n")
+		writeFile(t, filepath.Join(site2, ".qfs/site"), start, 0o644, "site2\n")
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", site2}))
+		})
+		for path, exp := range map[string]string{"dir/a": "a2", "dir/b@c": "b@c"} {
+			data, err := os.ReadFile(filepath.Join(site2, path))
+			testutil.Check(t, err)
+			if string(data) != exp {
+				t.Errorf("%s: %s: %q", c.prefix, path, data)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(site2, "dir/d e")); err == nil {
+			t.Errorf("%s: removed file was replicated", c.prefix)
+		}
+	}
+
+	err := qfs.Run([]string{"qfs", "replicate", "-top", j("site1"), "-dest", "s3://" + TestBucket + "/home"})
+	if err == nil || err.Error() != "replication destination is the same as the repository" {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = qfs.Run([]string{"qfs", "replicate", "-top", j("site1"), "-dest", "s3://" + TestBucket})
+	if err == nil || err.Error() != "replication destination must be s3://bucket/prefix" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestSubtrees(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a/x"), start, 0o644, "x")
+	writeFile(t, j("site1/dir/b/y"), start, 0o644, "y")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2")}))
+	})
+
+	writeFile(t, j("site1/dir/a/x"), start+1000, 0o644, "x2")
+	writeFile(t, j("site1/dir/b/y"), start+1000, 0o644, "y2")
+	// Only the given subtree is pushed.
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1"), "dir/a/"}))
+		},
+		`change dir/a/x
+prompt: Continue?
+`,
+		"",
+	)
+	// The rest of the site database was preserved, so a full push only sees the
+	// other change.
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-n", "-top", j("site1")}))
+		},
+		"change dir/b/y\n",
+		"",
+	)
+	// Pulling a different subtree sees no changes.
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2"), "dir/b"}))
+		},
+		"",
+		"",
+	)
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2"), "dir/b", "dir/a"}))
+		},
+		`change dir/a/x
+prompt: Continue?
+`,
+		"",
+	)
+	data, err := os.ReadFile(j("site2/dir/a/x"))
+	testutil.Check(t, err)
+	if string(data) != "x2" {
+		t.Errorf("wrong contents: %q", data)
+	}
+
+	// Pulling a subtree doesn't bring the rest of the repository database into
+	// the local copy, so a later push from site2 doesn't undo site1's change
+	// outside the subtree.
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+	})
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2"), "dir/a"}))
+		},
+		"",
+		"",
+	)
+	writeFile(t, j("site2/dir/a/x"), start+2000, 0o644, "x3")
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site2")}))
+		},
+		`change dir/a/x
+prompt: Continue?
+`,
+		"",
+	)
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site1")}))
+		},
+		`change dir/a/x
+prompt: Continue?
+`,
+		"",
+	)
+	data, err = os.ReadFile(j("site1/dir/b/y"))
+	testutil.Check(t, err)
+	if string(data) != "y2" {
+		t.Errorf("wrong contents: %q", data)
+	}
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2")}))
+		},
+		`change dir/b/y
+prompt: Continue?
+`,
+		"",
+	)
+
+	err = qfs.Run([]string{"qfs", "pull", "-top", j("site2"), "../dir"})
+	if err == nil || err.Error() != "../dir: paths must be relative to the top of the site" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestSites(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/old"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site2")}))
+	})
+
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "sites", "-top", j("site2")}))
+	})
+	lines := strings.Split(strings.TrimSpace(string(stdout)), "\n")
+	if len(lines) != 3 ||
+		lines[0] != "old never pushed (no database)" ||
+		!strings.HasPrefix(lines[1], "site1 2") ||
+		lines[2] != "site2 never pushed (current)" {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+
+	err := qfs.Run([]string{"qfs", "remove-site", "-top", j("site2"), "site2"})
+	if err == nil || err.Error() != "site2 is the current site and can't be removed" {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "remove-site", "-top", j("site2"), "potato"})
+	})
+	if err == nil || err.Error() != "the repository has no database or filter for site potato" {
+		t.Errorf("wrong error: %v", err)
+	}
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "remove-site", "-top", j("site2"), "old"}))
+		},
+		`rm .qfs/filters/old
+prompt: Remove site old from the repository?
+`,
+		"",
+	)
+	if _, err := os.Stat(j("site2/.qfs/filters/old")); err == nil {
+		t.Errorf("local copy of filter was not removed")
+	}
+	// Site 1 removes its copy when it pulls.
+	testutil.ExpStdout(
+		t,
+		func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "pull", "-top", j("site1")}))
+		},
+		`rm .qfs/filters/old
+prompt: Continue?
+`,
+		"",
+	)
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "sites", "-top", j("site1")}))
+	})
+	if strings.Contains(string(stdout), "old") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	push := func() {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		})
+	}
+	push()
+	writeFile(t, j("site1/dir/x"), start+1000, 0o644, "x2")
+	push()
+
+	err := qfs.Run([]string{"qfs", "apply-retention", "-top", j("site1")})
+	if err == nil || !strings.Contains(err.Error(), "no retention policy") {
+		t.Errorf("wrong error: %v", err)
+	}
+	writeFile(t, j("policy"), start, 0o644, "daily forever\nsecondly 1d\n")
+	err = qfs.Run([]string{"qfs", "set-retention", "-top", j("site1"), j("policy")})
+	if err == nil || err.Error() != j("policy")+":2: granularity must be all, hourly, daily, weekly, monthly, or yearly" {
+		t.Errorf("wrong error: %v", err)
+	}
+	writeFile(t, j("policy"), start, 0o644, "daily forever\n")
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "set-retention", "-top", j("site1"), j("policy")}))
+		},
+		"daily forever\n",
+		"",
+	)
+
+	// Both versions of dir/x were stored today, so only the current one is kept.
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "apply-retention", "-n", "-top", j("site1")}))
+	})
+	if !strings.Contains(string(stdout), " of dir/x\n") || strings.Contains(string(stdout), "prompt:") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "apply-retention", "-top", j("site1")}))
+	})
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "list-versions", "-top", j("site1"), "dir/x"}))
+	})
+	if strings.Count(string(stdout), "\n") != 2 {
+		t.Errorf("wrong versions after applying retention:\n%s", stdout)
+	}
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "apply-retention", "-n", "-top", j("site1")}))
+	})
+	if strings.Contains(string(stdout), "remove ") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	status := func() string {
+		stdout, _ := testutil.WithStdout(func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "protect", "-top", j("site1")}))
+		})
+		return string(stdout)
+	}
+	if status() != "the repository is not protected\n" {
+		t.Errorf("wrong status")
+	}
+	testutil.Check(t, qfs.Run([]string{"qfs", "protect", "-top", j("site1"), "on"}))
+	if status() != "the repository is protected\n" {
+		t.Errorf("wrong status")
+	}
+
+	r, err := repo.New(repo.WithLocalTop(j("site1")), repo.WithS3Client(s3Client))
+	testutil.Check(t, err)
+	token := r.ConfirmToken("clean the repository")
+	if token == r.ConfirmToken("repair the repository") || len(token) != 8 {
+		t.Errorf("bad tokens")
+	}
+
+	// Commands that remove data fail without the token for the operation, but dry
+	// runs work.
+	for _, args := range [][]string{
+		{"init-repo", "-clean-repo"},
+		{"init-repo", "-clean-repo", "-confirm-token", r.ConfirmToken("repair the repository")},
+		{"fsck-repo", "-repair"},
+		{"remove-site", "site2"},
+		{"protect", "off"},
+	} {
+		err = qfs.Run(append([]string{"qfs", args[0], "-top", j("site1")}, args[1:]...))
+		if !errors.Is(err, repo.ErrProtected) || !strings.Contains(err.Error(), "run again with -confirm-token ") {
+			t.Errorf("%v: wrong error: %v", args, err)
+		}
+	}
+	_, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "fsck-repo", "-top", j("site1")}))
+	})
+	_, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1"), "-clean-repo", "-confirm-token", token}))
+	})
+	testutil.Check(t, qfs.Run([]string{
+		"qfs", "protect", "-top", j("site1"), "off", "-confirm-token", r.ConfirmToken("remove protection"),
+	}))
+	if status() != "the repository is not protected\n" {
+		t.Errorf("wrong status")
+	}
+	_, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1"), "-clean-repo"}))
+	})
+}
+
+func TestUpgrade(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, os.Symlink("x@y", j("site1/dir/link")))
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	keyVersions := func() map[int]int {
+		t.Helper()
+		output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(TestBucket),
+			Prefix: aws.String("home/"),
+		})
+		testutil.Check(t, err)
+		src, err := s3source.New(TestBucket, "home", s3source.WithS3Client(s3Client))
+		testutil.Check(t, err)
+		result := map[int]int{}
+		for _, o := range output.Contents {
+			if v := src.KeyVersionOf(*o.Key); v != 0 {
+				result[v]++
+			}
+		}
+		return result
+	}
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site2")))
+	if v := keyVersions(); v[s3source.KeyVersion1] == 0 || v[s3source.KeyVersion2] != 0 {
+		t.Errorf("wrong key versions: %v", v)
+	}
+
+	// A dry run changes nothing.
+	testutil.Check(t, run(false, "qfs", "upgrade-repo", "-n", "-top", j("site1")))
+	if v := keyVersions(); v[s3source.KeyVersion2] != 0 {
+		t.Errorf("wrong key versions: %v", v)
+	}
+
+	testutil.Check(t, run(false, "qfs", "upgrade-repo", "-top", j("site1")))
+	if v := keyVersions(); v[s3source.KeyVersion1] != 0 || v[s3source.KeyVersion2] == 0 {
+		t.Errorf("wrong key versions: %v", v)
+	}
+	h, err := database.FileHeader(j("site1/.qfs/db/repo"))
+	testutil.Check(t, err)
+	if h.KeyVersion != s3source.KeyVersion2 {
+		t.Errorf("wrong header: %#v", h)
+	}
+	// Upgrading again does nothing.
+	testutil.Check(t, run(false, "qfs", "upgrade-repo", "-top", j("site1")))
+
+	// Both sites keep working, and new objects get version 2 keys.
+	writeFile(t, j("site1/dir/y"), start, 0o644, "y")
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site2")))
+	checkSync(t, j("site1"), j("site2"), "dir")
+	writeFile(t, j("site2/dir/x"), start+1000, 0o644, "new x")
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site2")))
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site1")))
+	checkSync(t, j("site1"), j("site2"), "dir")
+	if v := keyVersions(); v[s3source.KeyVersion1] != 0 {
+		t.Errorf("wrong key versions: %v", v)
+	}
+	_, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "fsck-repo", "-top", j("site1")}))
+	})
+
+	// Rebuilding the database keeps the version.
+	testutil.Check(t, run(true, "qfs", "init-repo", "-top", j("site1")))
+	h, err = database.FileHeader(j("site1/.qfs/db/repo"))
+	testutil.Check(t, err)
+	if h.KeyVersion != s3source.KeyVersion2 {
+		t.Errorf("wrong header after rebuild: %#v", h)
+	}
+}
+
+func TestObjectLock(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	deleteTestBucket()
+	_, err := s3Client.CreateBucket(ctx, &s3.CreateBucketInput{
+		Bucket:                     aws.String(TestBucket),
+		ObjectLockEnabledForBucket: aws.Bool(true),
+	})
+	testutil.Check(t, err)
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644,
+		"s3://"+TestBucket+"/home\nobject-lock-mode = governance\nobject-lock-retain = 1d\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	push := func() {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		})
+	}
+	push()
+	writeFile(t, j("site1/dir/x"), start+1000, 0o644, "x2")
+	push()
+
+	// Every stored version is retained.
+	versions, err := s3Client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(TestBucket),
+		Prefix: aws.String("home/dir/x@"),
+	})
+	testutil.Check(t, err)
+	if len(versions.Versions) != 2 {
+		t.Fatalf("wrong number of versions: %d", len(versions.Versions))
+	}
+	for _, v := range versions.Versions {
+		head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(TestBucket),
+			Key:       v.Key,
+			VersionId: v.VersionId,
+		})
+		testutil.Check(t, err)
+		if head.ObjectLockMode != types.ObjectLockModeGovernance || head.ObjectLockRetainUntilDate == nil {
+			t.Errorf("%s wasn't retained", *v.Key)
+		}
+	}
+
+	// Retention keeps the old version unless governance is bypassed.
+	writeFile(t, j("policy"), start, 0o644, "daily forever\n")
+	_, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "set-retention", "-top", j("site1"), j("policy")}))
+	})
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "apply-retention", "-top", j("site1")}))
+	})
+	if !strings.Contains(string(stdout), " of dir/x: GOVERNANCE retention until ") ||
+		strings.Contains(string(stdout), "remove version") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "apply-retention", "-bypass-governance", "-top", j("site1")}))
+	})
+	stdout, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "list-versions", "-top", j("site1"), "dir/x"}))
+	})
+	if strings.Count(string(stdout), "\n") != 2 {
+		t.Errorf("wrong versions after applying retention:\n%s", stdout)
+	}
+}
+
+func TestDu(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\nz\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site1/dir/sub/y"), start, 0o644, "yy")
+	writeFile(t, j("site1/z"), start, 0o644, "zzz")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	push := func() {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		})
+	}
+	push()
+	writeFile(t, j("site1/dir/x"), start+1000, 0o644, "xx")
+	push()
+
+	// Directories are objects too, so sub counts itself and y.
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "du", "-top", j("site1"), "dir"}))
+		},
+		`    size  objects  name
+       2        2  sub
+       2        1  x
+       4        3  total
+`,
+		"",
+	)
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "du", "-top", j("site1")}))
+	})
+	if !strings.Contains(string(stdout), "\n       4        4  dir\n") ||
+		!strings.Contains(string(stdout), "\n       3        1  z\n") ||
+		!strings.Contains(string(stdout), "  .qfs\n") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{"qfs", "du", "-top", j("site1"), "-versions", "dir"}))
+		},
+		`    size  objects old-size      old  deleted  name
+       2        2        0        0        0  sub
+       2        1        1        1        1  x
+       4        3        1        1        1  total
+`,
+		"",
+	)
+	err := qfs.Run([]string{"qfs", "du", "-top", j("site1"), "potato"})
+	if err == nil || err.Error() != `nothing found in the repository below "potato"` {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestStaleRepoFilter(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\nnew\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	testutil.Check(t, run("qfs", "push", "-top", j("site1")))
+	testutil.Check(t, run("qfs", "pull", "-top", j("site2")))
+
+	// Include another directory in the repository. Until site2 pulls, it would
+	// compare itself with the repository using the old filter.
+	writeFile(t, j("site1/.qfs/filters/repo"), start+1000, 0o644, ":include:\ndir\nnew\n")
+	testutil.Check(t, run("qfs", "push", "-top", j("site1")))
+	writeFile(t, j("site2/dir/y"), start, 0o644, "y")
+	err := run("qfs", "push", "-top", j("site2"))
+	if err == nil || !strings.HasSuffix(err.Error(), "since this site last pulled; run qfs pull first") {
+		t.Errorf("wrong error: %v", err)
+	}
+	// With -n, it's only a warning.
+	testutil.Check(t, run("qfs", "push", "-n", "-top", j("site2")))
+	testutil.Check(t, run("qfs", "pull", "-top", j("site2")))
+	testutil.Check(t, run("qfs", "push", "-top", j("site2")))
+}
+
+func TestPlan(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+
+	// Writing a plan changes nothing.
+	testutil.Check(t, run(false, "qfs", "pull", "-plan", j("pull.json"), "-top", j("site2")))
+	if _, err := os.Stat(j("site2/dir/x")); err == nil {
+		t.Errorf("pull -plan pulled")
+	}
+	plan, err := repo.ReadPlan(j("pull.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if plan.Operation != "pull" || plan.Site != "site2" || plan.Bytes != 1 || len(plan.Conflicts) != 0 {
+		t.Errorf("wrong plan: %#v", plan)
+	}
+	var added []string
+	for _, f := range plan.Changes.Add {
+		added = append(added, f.Path)
+	}
+	if !slices.Contains(added, "dir/x") {
+		t.Errorf("wrong additions: %v", added)
+	}
+
+	// A plan that no longer matches is rejected.
+	writeFile(t, j("site1/dir/y"), start, 0o644, "y")
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+	err = run(false, "qfs", "apply-plan", j("pull.json"), "-top", j("site2"))
+	if err == nil || !strings.Contains(err.Error(), "has changed since the plan was created") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, err := os.Stat(j("site2/dir/x")); err == nil {
+		t.Errorf("stale plan was applied")
+	}
+	err = run(false, "qfs", "apply-plan", j("pull.json"), "-top", j("site1"))
+	if err == nil || !strings.Contains(err.Error(), "the plan is for site site2") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// A current plan is applied without prompting.
+	testutil.Check(t, run(false, "qfs", "pull", "-plan", j("pull.json"), "-top", j("site2")))
+	testutil.Check(t, run(false, "qfs", "apply-plan", j("pull.json"), "-top", j("site2")))
+	for _, p := range []string{"site2/dir/x", "site2/dir/y"} {
+		if _, err := os.Stat(j(p)); err != nil {
+			t.Errorf("%s wasn't pulled: %v", p, err)
+		}
+	}
+
+	// Push a plan.
+	writeFile(t, j("site2/dir/z"), start, 0o644, "zz")
+	testutil.Check(t, run(false, "qfs", "push", "-plan", j("push.json"), "-top", j("site2")))
+	plan, err = repo.ReadPlan(j("push.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if plan.Operation != "push" || plan.Bytes != 2 {
+		t.Errorf("wrong plan: %#v", plan)
+	}
+	testutil.Check(t, run(false, "qfs", "apply-plan", j("push.json"), "-top", j("site2")))
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site1")))
+	if _, err := os.Stat(j("site1/dir/z")); err != nil {
+		t.Errorf("plan wasn't pushed: %v", err)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":storage-class:POTATO\narchives\n")
+	writeFile(t, j("site1/archives/x"), start, 0o644, "x")
+	writeFile(t, j("site1/y"), start, 0o644, "y")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	push := func() (err error) {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run([]string{"qfs", "push", "-top", j("site1")})
+		})
+		return err
+	}
+	err := push()
+	if err == nil || !strings.Contains(err.Error(), "unknown storage class POTATO") {
+		t.Errorf("wrong error: %v", err)
+	}
+	<-misc.TestPromptChannel
+
+	// MinIO supports only STANDARD and REDUCED_REDUNDANCY.
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":storage-class:REDUCED_REDUNDANCY\narchives\n")
+	testutil.Check(t, push())
+	classes := map[string]types.ObjectStorageClass{}
+	prefix := "home/"
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(TestBucket),
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, obj := range page.Contents {
+			if strings.HasPrefix(*obj.Key, "home/archives/x@") || strings.HasPrefix(*obj.Key, "home/y@") {
+				classes[strings.Split(*obj.Key, "@")[0]] = obj.StorageClass
+			}
+		}
+	}
+	if classes["home/archives/x"] != types.ObjectStorageClassReducedRedundancy ||
+		classes["home/y"] != types.ObjectStorageClassStandard {
+		t.Errorf("wrong storage classes: %v", classes)
+	}
+}
+
+func TestDirTimes(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/sub/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	dirTimes := map[string]time.Time{
+		"dir/sub": time.UnixMilli(start - 60000),
+		"dir":     time.UnixMilli(start - 120000),
+	}
+	setTimes := func() {
+		t.Helper()
+		for _, dir := range []string{"dir/sub", "dir"} {
+			if err := os.Chtimes(j("site1/"+dir), time.Time{}, dirTimes[dir]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	checkTimes := func(top string) {
+		t.Helper()
+		for dir, exp := range dirTimes {
+			st, err := os.Stat(j(top + "/" + dir))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !st.ModTime().Equal(exp) {
+				t.Errorf("%s/%s: wrong time %v", top, dir, st.ModTime())
+			}
+		}
+	}
+	setTimes()
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	testutil.Check(t, run("qfs", "push", "-dir-times", "-top", j("site1")))
+	testutil.Check(t, run("qfs", "pull", "-dir-times", "-top", j("site2")))
+	checkTimes("site2")
+
+	// A change to only a directory's time is pushed and pulled.
+	dirTimes["dir"] = time.UnixMilli(start - 180000)
+	setTimes()
+	testutil.Check(t, run("qfs", "push", "-dir-times", "-top", j("site1")))
+	testutil.Check(t, run("qfs", "pull", "-dir-times", "-top", j("site2")))
+	checkTimes("site2")
+
+	_, _ = testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "get", "-dir-times", "-top", j("site1"), "dir", j("get")}))
+	})
+	checkTimes("get")
+}
+
+func TestAudit(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\naudit = repository\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\naudit = local\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (stdout string, err error) {
+		out, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(out), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	// A push with no changes isn't recorded.
+	_, err = run(false, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	_, err = run(true, "qfs", "pull", "-top", j("site2"))
+	testutil.Check(t, err)
+	writeFile(t, j("site2/dir/y"), start, 0o644, "y")
+	_, err = run(true, "qfs", "push", "-top", j("site2"))
+	testutil.Check(t, err)
+
+	// The repository and the local log are separate, and the audit objects
+	// aren't mistaken for files.
+	r, err := repo.New(repo.WithLocalTop(j("site1")), repo.WithS3Client(s3Client))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	records, err := r.AuditLog(&repo.AuditConfig{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 2 || records[0].Operation != "init-repo" || records[1].Operation != "push" {
+		t.Fatalf("wrong records: %v", records)
+	}
+	push := records[1]
+	if push.Site != "site1" || push.Counts["added"] == 0 || push.RepoDbKey == "" || push.User == "" {
+		t.Errorf("wrong push record: %#v", push)
+	}
+	stdout, err := run(false, "qfs", "log", "-local", "-top", j("site2"))
+	testutil.Check(t, err)
+	if !strings.Contains(stdout, " push site2 ") || !strings.Contains(stdout, "added=1") {
+		t.Errorf("wrong local log:\n%s", stdout)
+	}
+	stdout, err = run(false, "qfs", "log", "-top", j("site2"))
+	testutil.Check(t, err)
+	if strings.Count(stdout, "\n") != 2 || strings.Contains(stdout, "site2") {
+		t.Errorf("wrong repository log:\n%s", stdout)
+	}
+	// Cleaning the repository doesn't remove the audit records.
+	_, err = run(false, "qfs", "init-repo", "-clean-repo", "-top", j("site1"))
+	testutil.Check(t, err)
+	records, err = r.AuditLog(&repo.AuditConfig{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 3 || records[2].Operation != "clean-repo" || records[2].Counts["removed"] != 0 {
+		t.Errorf("wrong records: %v", records)
+	}
+}
+
+func TestClampFutureMtimes(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	future := time.Now().Add(24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	checkTime := func(path string, inFuture bool) {
+		t.Helper()
+		st, err := os.Stat(j(path))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if st.ModTime().After(time.Now()) != inFuture {
+			t.Errorf("%s: wrong time %v", path, st.ModTime())
+		}
+	}
+	writeFile(t, j("site1/dir/future"), future, 0o644, "future")
+
+	// Without the option, or with -n, the file is only reported.
+	testutil.Check(t, run(false, "qfs", "push", "-n", "-clamp-future-mtimes", "-top", j("site1")))
+	checkTime("site1/dir/future", true)
+
+	testutil.Check(t, run(true, "qfs", "push", "-clamp-future-mtimes", "-top", j("site1")))
+	checkTime("site1/dir/future", false)
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site2")))
+	checkTime("site2/dir/future", false)
+	// Nothing is left to push.
+	testutil.Check(t, run(false, "qfs", "push", "-top", j("site1")))
+}
+
+func TestFsckRepo(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (stdout string, err error) {
+		out, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(out), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	stdout, err := run(false, "qfs", "fsck-repo", "-top", j("site1"))
+	testutil.Check(t, err)
+	if stdout != "" {
+		t.Errorf("unexpected output:\n%s", stdout)
+	}
+
+	// Store objects as if things had gone wrong.
+	for _, k := range []string{
+		fmt.Sprintf("home/dir/x@f,%d,0644", start-1000),
+		"home/junk",
+		"home/other/y@f,1715443000777,0644",
+		fmt.Sprintf("home/dir/z@f,%d,0644", start),
+	} {
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(TestBucket),
+			Key:    aws.String(k),
+			Body:   strings.NewReader(""),
+		})
+		testutil.Check(t, err)
+	}
+	stdout, err = run(false, "qfs", "fsck-repo", "-top", j("site1"))
+	if err == nil || err.Error() != "4 problem(s) found" {
+		t.Errorf("wrong error: %v", err)
+	}
+	for _, exp := range []string{
+		fmt.Sprintf("duplicate key: home/dir/x@f,%d,0644\n", start-1000),
+		"invalid key: home/junk\n",
+		"excluded key: home/other/y@f,1715443000777,0644\n",
+		"not in database: dir/z\n",
+	} {
+		if !strings.Contains(stdout, exp) {
+			t.Errorf("output doesn't contain %q:\n%s", exp, stdout)
+		}
+	}
+
+	_, err = run(true, "qfs", "fsck-repo", "-repair", "-top", j("site1"))
+	testutil.Check(t, err)
+	stdout, err = run(false, "qfs", "fsck-repo", "-top", j("site1"))
+	testutil.Check(t, err)
+	if stdout != "" {
+		t.Errorf("unexpected output after repair:\n%s", stdout)
+	}
+	// The rebuilt database includes the untracked file.
+	_, err = run(true, "qfs", "pull", "-top", j("site1"))
+	testutil.Check(t, err)
+	if _, err = os.Stat(j("site1/dir/z")); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestClone(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	location := "s3://" + TestBucket + "/home"
+	run := func(prompt bool, args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	err := run(false, "qfs", "clone", "-site", "site2", location, j("site2"))
+	if err == nil || err.Error() != location+" has not been initialized; run qfs init-repo" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, err = os.Stat(j("site2")); err == nil {
+		t.Errorf("directory was created for uninitialized repository")
+	}
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, location+"\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+
+	err = run(false, "qfs", "clone", "-site", "site1", location, j("site3"))
+	if err == nil || !strings.HasPrefix(err.Error(), "the repository already has a database for site site1;") {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = run(false, "qfs", "clone", "-site", "site2", location, j("site1"))
+	if err == nil || err.Error() != j("site1")+" is not empty" {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = run(false, "qfs", "clone", "-site", "site2", "s3://"+TestBucket, j("site2"))
+	if err == nil || err.Error() != "s3://"+TestBucket+" must have the form s3://bucket/prefix" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// A site with a filter in the repository gets its files right away.
+	testutil.Check(t, run(true, "qfs", "clone", "-site", "site2", location, j("site2")))
+	for path, exp := range map[string]string{
+		"site2/.qfs/repo":          location + "\n",
+		"site2/.qfs/site":          "site2\n",
+		"site2/.qfs/filters/site2": ":include:\ndir\n",
+		"site2/dir/x":              "x",
+	} {
+		data, err := os.ReadFile(j(path))
+		if err != nil {
+			t.Error(err.Error())
+		} else if string(data) != exp {
+			t.Errorf("%s: wrong contents: %q", path, data)
+		}
+	}
+
+	// A site without one only gets the filters.
+	testutil.Check(t, run(true, "qfs", "clone", "-site", "site3", location, j("site3")))
+	if _, err = os.Stat(j("site3/.qfs/filters/repo")); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err = os.Stat(j("site3/dir/x")); err == nil {
+		t.Errorf("files were pulled without a site filter")
+	}
+}
+
+func TestMetadataOnlyPush(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	later := start + 3600000
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site1/dir/y"), start, 0o644, "y")
+	writeFile(t, j("site1/dir/z"), start, 0o644, "z")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	keys := func() map[string]bool {
+		t.Helper()
+		output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(TestBucket),
+			Prefix: aws.String("home/dir/"),
+		})
+		testutil.Check(t, err)
+		result := map[string]bool{}
+		for _, o := range output.Contents {
+			result[*o.Key] = true
+		}
+		return result
+	}
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site2")))
+
+	// Change permissions and times without changing contents, and change
+	// contents.
+	testutil.Check(t, os.Chmod(j("site1/dir/x"), 0o600))
+	testutil.Check(t, os.Chtimes(j("site1/dir/y"), time.Time{}, time.UnixMilli(later)))
+	writeFile(t, j("site1/dir/z"), later, 0o644, "Z")
+	writeFile(t, j("site1/dir/w"), later, 0o644, "w")
+	testutil.Check(t, run(true, "qfs", "push", "-metadata-only", "-top", j("site1")))
+	k := keys()
+	for key, exp := range map[string]bool{
+		fmt.Sprintf("home/dir/x@f,%d,0600", start): true,
+		fmt.Sprintf("home/dir/x@f,%d,0644", start): false,
+		fmt.Sprintf("home/dir/y@f,%d,0644", later): true,
+		fmt.Sprintf("home/dir/y@f,%d,0644", start): false,
+		fmt.Sprintf("home/dir/z@f,%d,0644", start): true,
+		fmt.Sprintf("home/dir/w@f,%d,0644", later): false,
+		fmt.Sprintf("home/dir/z@f,%d,0644", later): false,
+	} {
+		if k[key] != exp {
+			t.Errorf("%s: expected %v", key, exp)
+		}
+	}
+
+	// The metadata changes can be pulled, and the copies have the original
+	// contents.
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site2")))
+	for path, exp := range map[string]string{"x": "x", "y": "y", "z": "z"} {
+		data, err := os.ReadFile(j("site2/dir/" + path))
+		testutil.Check(t, err)
+		if string(data) != exp {
+			t.Errorf("%s: wrong contents %q", path, data)
+		}
+	}
+	st, err := os.Stat(j("site2/dir/x"))
+	testutil.Check(t, err)
+	if st.Mode().Perm() != 0o600 {
+		t.Errorf("wrong mode: %v", st.Mode())
+	}
+	st, err = os.Stat(j("site2/dir/y"))
+	testutil.Check(t, err)
+	if st.ModTime().UnixMilli() != later {
+		t.Errorf("wrong time: %v", st.ModTime())
+	}
+
+	// Pulling at the pushing site doesn't restore the old contents, and a full
+	// push pushes the rest.
+	testutil.Check(t, run(false, "qfs", "pull", "-top", j("site1")))
+	data, err := os.ReadFile(j("site1/dir/z"))
+	testutil.Check(t, err)
+	if string(data) != "Z" {
+		t.Errorf("pull restored old contents: %q", data)
+	}
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+	k = keys()
+	for _, key := range []string{
+		fmt.Sprintf("home/dir/w@f,%d,0644", later),
+		fmt.Sprintf("home/dir/z@f,%d,0644", later),
+	} {
+		if !k[key] {
+			t.Errorf("%s was not pushed", key)
+		}
+	}
+}
+
+func TestRenames(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a/x"), start, 0o644, "xx")
+	writeFile(t, j("site1/dir/a/y"), start, 0o644, "yyy")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (stdout []byte, err error) {
+		stdout, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return stdout, err
+	}
+	keys := func() map[string]bool {
+		t.Helper()
+		output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(TestBucket),
+			Prefix: aws.String("home/dir/"),
+		})
+		testutil.Check(t, err)
+		result := map[string]bool{}
+		for _, o := range output.Contents {
+			result[*o.Key] = true
+		}
+		return result
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	_, err = run(true, "qfs", "pull", "-top", j("site2"))
+	testutil.Check(t, err)
+
+	// Rename a directory, and push the renames.
+	testutil.Check(t, os.Rename(j("site1/dir/a"), j("site1/dir/b")))
+	stdout, err := run(true, "qfs", "push", "-renames", "-top", j("site1"))
+	testutil.Check(t, err)
+	for _, line := range []string{"rename dir/a/x -> dir/b/x\n", "rename dir/a/y -> dir/b/y\n"} {
+		if !strings.Contains(string(stdout), line) {
+			t.Errorf("missing %q in %s", line, stdout)
+		}
+	}
+	k := keys()
+	for key, exp := range map[string]bool{
+		fmt.Sprintf("home/dir/b/x@f,%d,0644", start): true,
+		fmt.Sprintf("home/dir/b/y@f,%d,0644", start): true,
+		fmt.Sprintf("home/dir/a/x@f,%d,0644", start): false,
+		fmt.Sprintf("home/dir/a/y@f,%d,0644", start): false,
+	} {
+		if k[key] != exp {
+			t.Errorf("%s: expected %v", key, exp)
+		}
+	}
+
+	// Pulling with -renames moves the files.
+	before, err := os.Stat(j("site2/dir/a/x"))
+	testutil.Check(t, err)
+	_, err = run(true, "qfs", "pull", "-renames", "-top", j("site2"))
+	testutil.Check(t, err)
+	after, err := os.Stat(j("site2/dir/b/x"))
+	testutil.Check(t, err)
+	if !os.SameFile(before, after) {
+		t.Error("dir/b/x was downloaded instead of moved")
+	}
+	data, err := os.ReadFile(j("site2/dir/b/y"))
+	testutil.Check(t, err)
+	if string(data) != "yyy" {
+		t.Errorf("wrong contents: %q", data)
+	}
+	if _, err = os.Stat(j("site2/dir/a")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("dir/a still exists: %v", err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	// Each hook saves its input and environment where the test can find them.
+	hook := func(site, name string, status int) {
+		t.Helper()
+		writeFile(t, j(site+"/.qfs/hooks/"+name), start, 0o755, fmt.Sprintf(
+			"#!/bin/sh\ncat > %s\necho \"$QFS_HOOK $QFS_SITE\" > %s\nexit %d\n",
+			j(name+".json"),
+			j(name+".env"),
+			status,
+		))
+	}
+	readHook := func(name string) (*repo.HookInput, string) {
+		t.Helper()
+		data, err := os.ReadFile(j(name + ".json"))
+		testutil.Check(t, err)
+		input := &repo.HookInput{}
+		testutil.Check(t, json.Unmarshal(data, input))
+		env, err := os.ReadFile(j(name + ".env"))
+		testutil.Check(t, err)
+		testutil.Check(t, os.Remove(j(name+".json")))
+		return input, strings.TrimSpace(string(env))
+	}
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (err error) {
+		_, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	hook("site1", "pre-push", 0)
+	hook("site1", "post-push", 0)
+	testutil.Check(t, run(true, "qfs", "push", "-top", j("site1")))
+	for _, name := range []string{"pre-push", "post-push"} {
+		input, env := readHook(name)
+		if input.Hook != name || input.Operation != "push" || input.Site != "site1" {
+			t.Errorf("%s: wrong input: %#v", name, input)
+		}
+		if !slices.ContainsFunc(input.Changes.Add, func(f *repo.PlanFile) bool { return f.Path == "dir/x" }) {
+			t.Errorf("%s: dir/x is not in the changes", name)
+		}
+		if env != name+" site1" || input.Top != j("site1") {
+			t.Errorf("%s: wrong environment: %s", name, env)
+		}
+	}
+
+	// Hooks don't run when there is nothing to do.
+	testutil.Check(t, run(false, "qfs", "push", "-top", j("site1")))
+	if _, err := os.Stat(j("pre-push.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("pre-push ran without changes: %v", err)
+	}
+
+	// A failing pre- hook prevents the operation.
+	writeFile(t, j("site1/dir/y"), start, 0o644, "y")
+	hook("site1", "pre-push", 1)
+	err := run(true, "qfs", "push", "-top", j("site1"))
+	if err == nil || !strings.Contains(err.Error(), "pre-push hook failed") {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, err = os.Stat(j("post-push.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("post-push ran after pre-push failed: %v", err)
+	}
+	_, err = s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(TestBucket),
+		Key:    aws.String(fmt.Sprintf("home/dir/y@f,%d,0644", start)),
+	})
+	if err == nil {
+		t.Error("dir/y was pushed")
+	}
+
+	// A failing post- hook doesn't fail the operation.
+	hook("site2", "pre-pull", 0)
+	hook("site2", "post-pull", 1)
+	testutil.Check(t, run(true, "qfs", "pull", "-top", j("site2")))
+	for _, name := range []string{"pre-pull", "post-pull"} {
+		input, _ := readHook(name)
+		if input.Operation != "pull" || input.Site != "site2" {
+			t.Errorf("%s: wrong input: %#v", name, input)
+		}
+	}
+	if _, err = os.Stat(j("site2/dir/x")); err != nil {
+		t.Errorf("dir/x was not pulled: %v", err)
+	}
+}
+
+func TestMaxTransfer(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "xxxx")
+	writeFile(t, j("site1/dir/y"), start, 0o644, "yyyyyy")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+
+	r, err := repo.New(repo.WithLocalTop(j("site1")), repo.WithS3Client(s3Client))
+	testutil.Check(t, err)
+	var result *repo.Result
+	_, _ = testutil.WithStdout(func() {
+		result, err = r.Push(&repo.PushConfig{NoOp: true})
+	})
+	testutil.Check(t, err)
+	// The filter is added as well.
+	e := result.Transfer
+	if e.AddedFiles != 3 || e.AddedBytes != 24 || e.ChangedFiles != 0 {
+		t.Errorf("wrong estimate: %#v", e)
+	}
+
+	// Exceeding the maximum fails before prompting.
+	_, _ = testutil.WithStdout(func() {
+		err = qfs.Run([]string{"qfs", "push", "-max-transfer", "20", "-top", j("site1")})
+	})
+	if err == nil || !strings.Contains(err.Error(), "24 to upload is more than the maximum transfer of 20") {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		err = qfs.Run([]string{"qfs", "push", "-max-transfer", "1K", "-top", j("site1")})
+	})
+	testutil.Check(t, err)
+}
+
+func TestKeepGoing(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "xxxx")
+	writeFile(t, j("site1/dir/y"), start, 0o644, "yyyyyy")
+	writeFile(t, j("site1/dir/z"), start, 0o644, "zz")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+
+	// A file that can't be read doesn't keep the others from being pushed.
+	testutil.Check(t, os.Chmod(j("site1/dir/y"), 0))
+	defer func() { _ = os.Chmod(j("site1/dir/y"), 0o644) }()
+	var err error
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		err = qfs.Run([]string{"qfs", "push", "-keep-going", "-top", j("site1")})
+	})
+	if !errors.Is(err, misc.ErrFailures) || !strings.Contains(err.Error(), "1 file(s) failed") {
+		t.Errorf("wrong error: %v", err)
+	}
+	r, err := repo.New(repo.WithLocalTop(j("site1")), repo.WithS3Client(s3Client))
+	testutil.Check(t, err)
+	var result *repo.Result
+	_, _ = testutil.WithStdout(func() {
+		result, err = r.Push(&repo.PushConfig{NoOp: true})
+	})
+	testutil.Check(t, err)
+	if len(result.Changes.Add) != 1 || result.Changes.Add[0].Path != "dir/y" {
+		t.Errorf("wrong changes after failure: %v", result.Changes.Add)
+	}
+
+	// Once the problem is fixed, the rest is pushed.
+	testutil.Check(t, os.Chmod(j("site1/dir/y"), 0o644))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		err = qfs.Run([]string{"qfs", "push", "-keep-going", "-top", j("site1")})
+	})
+	testutil.Check(t, err)
+}
+
+func TestDiffVersions(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+	push := func() {
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			testutil.Check(t, qfs.Run([]string{"qfs", "push", "-top", j("site1")}))
+		})
+	}
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\nother\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x1")
+	writeFile(t, j("site1/dir/y"), start, 0o644, "y")
+	writeFile(t, j("site1/other/w"), start, 0o644, "w")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	push()
+
+	// S3 modification times have one-second granularity.
+	time.Sleep(1100 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(1100 * time.Millisecond)
+	writeFile(t, j("site1/dir/x"), start+1000, 0o644, "x2")
+	testutil.Check(t, os.Remove(j("site1/dir/y")))
+	writeFile(t, j("site1/dir/z"), start, 0o644, "z")
+	testutil.Check(t, os.Remove(j("site1/other/w")))
+	push()
+
+	r, err := repo.New(repo.WithLocalTop(j("site1")), repo.WithS3Client(s3Client))
+	testutil.Check(t, err)
+	result, err := r.DiffVersions("", &repo.DiffVersionsConfig{From: between})
+	testutil.Check(t, err)
+	buf := &bytes.Buffer{}
+	testutil.Check(t, result.WriteDiff(buf, false))
+	exp := "rm dir/y\nrm other/w\nadd dir/z\nchange dir/x\n"
+	if buf.String() != exp {
+		t.Errorf("wrong diff:\n%s", buf.String())
+	}
+
+	// Nothing changed between the pushes, and a path limits the comparison.
+	result, err = r.DiffVersions("", &repo.DiffVersionsConfig{
+		From: between.Add(-500 * time.Millisecond),
+		To:   between,
+	})
+	testutil.Check(t, err)
+	if result.NumChanges() != 0 {
+		t.Errorf("unexpected changes: %#v", result)
+	}
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, qfs.Run([]string{
+				"qfs",
+				"diff-versions",
+				"-top",
+				j("site1"),
+				"-from",
+				strconv.FormatInt(between.UnixMilli(), 10),
+				"dir",
+			}))
+		},
+		"rm dir/y\nadd dir/z\nchange dir/x\n",
+		"",
+	)
+	_, err = r.DiffVersions("", &repo.DiffVersionsConfig{From: between, To: between})
+	if err == nil || !strings.Contains(err.Error(), "is not before") {
+		t.Errorf("wrong error: %v", err)
+	}
+	// Compare the contents of versions of a file.
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "list-versions", "-top", j("site1"), "-diff", "2", "dir/x"}))
+	})
+	lines := strings.Split(string(stdout), "\n")
+	if len(lines) != 8 || !strings.HasPrefix(lines[0], "--- dir/x\t") || !strings.HasPrefix(lines[1], "+++ dir/x\t") ||
+		strings.Join(lines[2:], "\n") != "@@ -1 +1 @@\n-x1\n\\ No newline at end of file\n+x2\n\\ No newline at end of file\n" {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, r.DiffContents("dir/x", &repo.ContentDiffConfig{Old: "1"}))
+		},
+		"",
+		"",
+	)
+	testutil.ExpStdout(
+		t,
+		func() {
+			testutil.Check(t, r.DiffContents("dir/x", &repo.ContentDiffConfig{Old: "2", New: "1", Tool: "cat"}))
+		},
+		"x1x2",
+		"",
+	)
+	for spec, expErr := range map[string]string{
+		"3":     "dir/x: version number must be from 1 to 2",
+		"nope":  "dir/x: version nope not found",
+		"0,bad": "dir/x: version number must be from 1 to 2",
+	} {
+		err = qfs.Run([]string{"qfs", "list-versions", "-top", j("site1"), "-diff", spec, "dir/x"})
+		if err == nil || err.Error() != expErr {
+			t.Errorf("%s: wrong error: %v", spec, err)
+		}
+	}
+	err = r.DiffContents("dir/nothing", &repo.ContentDiffConfig{Old: "1"})
+	if err == nil || err.Error() != "dir/nothing: no versions found in repository" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestBirthTimes(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/x"), start, 0o644, "x")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	_, _ = testutil.WithStdout(func() {
+		misc.TestPromptChannel <- "y"
+		testutil.Check(t, qfs.Run([]string{"qfs", "push", "-birth-times", "-top", j("site1")}))
+	})
+	siteDb, err := database.LoadFile(j("site1/.qfs/db/site1"))
+	testutil.Check(t, err)
+	btime := siteDb["dir/x"].BirthTime
+	if btime.IsZero() {
+		t.Skip("creation times aren't available on this file system")
+	}
+	stdout, _ := testutil.WithStdout(func() {
+		testutil.Check(t, qfs.Run([]string{"qfs", "list-versions", "-long", "-top", j("site1"), "dir/x"}))
+	})
+	if !strings.Contains(string(stdout), " btime="+misc.FormatTime(btime)+"\n") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+		sync.TestCaseInsensitive = false
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/Notes.txt"), start, 0o644, "upper")
+	writeFile(t, j("site1/dir/notes.txt"), start, 0o644, "lower")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (stdout []byte, err error) {
+		stdout, _ = testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return stdout, err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+
+	sync.TestCaseInsensitive = true
+	stdout, err := run(false, "qfs", "pull", "-top", j("site2"))
+	if err == nil || err.Error() != "case collisions detected" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if !strings.Contains(string(stdout), "case collision: dir/notes.txt and dir/Notes.txt\n") {
+		t.Errorf("wrong output:\n%s", stdout)
+	}
+	if _, err = os.Stat(j("site2/dir")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("pull changed the site: %v", err)
+	}
+
+	_, err = run(true, "qfs", "pull", "-rename-case-collisions", "-top", j("site2"))
+	testutil.Check(t, err)
+	for path, exp := range map[string]string{
+		"dir/Notes.txt":        "upper",
+		"dir/notes.case-1.txt": "lower",
+	} {
+		data, err := os.ReadFile(j("site2/" + path))
+		testutil.Check(t, err)
+		if string(data) != exp {
+			t.Errorf("%s: wrong contents: %q", path, data)
+		}
+	}
+}
+
+func TestSiteGroups(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/common"), start, 0o644, ":include:\ndir/shared\n:include-group:laptops\ndir/music\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":read:common\n")
+	writeFile(t, j("site1/.qfs/filters/site3"), start, 0o644, ":read:common\n")
+	writeFile(t, j("site1/.qfs/filters/groups/laptops"), start, 0o644, "site2\n")
+	writeFile(t, j("site1/dir/shared/a"), start, 0o644, "a")
+	writeFile(t, j("site1/dir/music/b"), start, 0o644, "b")
+	for _, site := range []string{"site2", "site3"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) {
+		t.Helper()
+		var err error
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		testutil.Check(t, err)
+	}
+	run("qfs", "push", "-top", j("site1"))
+	run("qfs", "pull", "-top", j("site2"))
+	run("qfs", "pull", "-top", j("site3"))
+	for path, exp := range map[string]bool{
+		"site2/dir/shared/a": true,
+		"site2/dir/music/b":  true,
+		"site3/dir/shared/a": true,
+		"site3/dir/music/b":  false,
+	} {
+		_, err := os.Stat(j(path))
+		if exists := err == nil; exists != exp {
+			t.Errorf("%s: exists = %v", path, exists)
+		}
+	}
+}
+
+func TestReadOnlySite(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, site := range []string{"site1", "site2"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	writeFile(t, j("site2/.qfs/readonly"), start, 0o644, "")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) error {
+		t.Helper()
+		var err error
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		return err
+	}
+	testutil.Check(t, run("qfs", "push", "-top", j("site1")))
+	testutil.Check(t, run("qfs", "pull", "-top", j("site2")))
+	if _, err := os.Stat(j("site2/dir/a")); err != nil {
+		t.Errorf("dir/a was not pulled: %v", err)
+	}
+
+	// The site database stays local.
+	if _, err := os.Stat(j("site2/.qfs/db/site2.tmp")); err != nil {
+		t.Errorf("local site database is missing: %v", err)
+	}
+	_, err := s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(TestBucket),
+		Key:    aws.String("home/.qfs/db/site2"),
+	})
+	if err == nil {
+		t.Error("read-only site uploaded its database")
+	}
+
+	// The next pull starts from the local copy, so only the new file is pulled.
+	writeFile(t, j("site1/dir/b"), start+1000, 0o644, "b")
+	testutil.Check(t, run("qfs", "push", "-top", j("site1")))
+	writeFile(t, j("site2/dir/a"), start+2000, 0o644, "local change")
+	testutil.Check(t, run("qfs", "pull", "-top", j("site2")))
+	if data, err := os.ReadFile(j("site2/dir/a")); err != nil || string(data) != "local change" {
+		t.Errorf("dir/a was pulled again: %q %v", data, err)
+	}
+	if _, err := os.Stat(j("site2/dir/b")); err != nil {
+		t.Errorf("dir/b was not pulled: %v", err)
+	}
+
+	err = run("qfs", "push", "-top", j("site2"))
+	if !errors.Is(err, repo.ErrReadOnly) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestStagedPull(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, site := range []string{"site1", "site2"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	writeFile(t, j("site1/dir/sub/b"), start, 0o644, "b")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) {
+		t.Helper()
+		var err error
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		testutil.Check(t, err)
+	}
+	run("qfs", "push", "-top", j("site1"))
+	run("qfs", "pull", "-stage", "-top", j("site2"))
+	for path, exp := range map[string]string{"dir/a": "a", "dir/sub/b": "b"} {
+		if data, err := os.ReadFile(j("site2/" + path)); err != nil || string(data) != exp {
+			t.Errorf("%s: %q %v", path, data, err)
+		}
+	}
+	if _, err := os.Stat(j("site2/.qfs/stage")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stage directory still exists: %v", err)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, site := range []string{"site1", "site2"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(stdout), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+
+	// Without a local copy of the repository database, nothing works offline.
+	_, err = run(false, "qfs", "status", "-offline", "-top", j("site2"))
+	if err == nil || !strings.Contains(err.Error(), "qfs refresh") {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = run(true, "qfs", "pull", "-top", j("site2"))
+	testutil.Check(t, err)
+
+	// After site1 pushes, site2 doesn't see the change offline until it
+	// refreshes.
+	writeFile(t, j("site1/dir/b"), start, 0o644, "b")
+	_, err = run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	out, err := run(false, "qfs", "status", "-offline", "-top", j("site2"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "offline: repository as of last refresh\n") ||
+		!strings.Contains(out, "unpulled changes: 0\n") {
+		t.Errorf("wrong status: %s", out)
+	}
+	_, err = run(false, "qfs", "refresh", "-top", j("site2"))
+	testutil.Check(t, err)
+	if _, err := os.Stat(j("site2/.qfs/db/repo.version")); err != nil {
+		t.Errorf("version not recorded: %v", err)
+	}
+	out, err = run(false, "qfs", "status", "-offline", "-top", j("site2"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "unpulled changes: 1\n") {
+		t.Errorf("wrong status: %s", out)
+	}
+	out, err = run(false, "qfs", "diff", "-offline", "-top", j("site2"), "repo:repo", j("site2"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "dir/b") {
+		t.Errorf("wrong diff: %s", out)
+	}
+	_, err = run(false, "qfs", "diff", "-offline", "-top", j("site2"), "repo:site1", j("site2"))
+	if !errors.Is(err, repo.ErrOffline) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// The refreshed copy is used by pull, which then makes it the site's copy.
+	_, err = run(true, "qfs", "pull", "-top", j("site2"))
+	testutil.Check(t, err)
+	if data, err := os.ReadFile(j("site2/dir/b")); err != nil || string(data) != "b" {
+		t.Errorf("dir/b: %q %v", data, err)
+	}
+	if _, err := os.Stat(j("site2/.qfs/db/repo.tmp")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("cached copy still exists: %v", err)
+	}
+	out, err = run(false, "qfs", "status", "-offline", "-top", j("site2"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "unpulled changes: 0\n") {
+		t.Errorf("wrong status: %s", out)
+	}
+}
+
+func TestPathMap(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, site := range []string{"site1", "site2"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	writeFile(t, j("site1/dir/docs/d"), start, 0o644, "d")
+	writeFile(t, j("site2/.qfs/pathmap"), start, 0o644, "# local layout\nsrc=dir/docs/ dest=Documents/\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(stdout), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+
+	// site2 keeps dir/docs in Documents.
+	_, err = run(true, "qfs", "pull", "-top", j("site2"))
+	testutil.Check(t, err)
+	if data, err := os.ReadFile(j("site2/Documents/d")); err != nil || string(data) != "d" {
+		t.Errorf("Documents/d: %q %v", data, err)
+	}
+	if data, err := os.ReadFile(j("site2/dir/a")); err != nil || string(data) != "a" {
+		t.Errorf("dir/a: %q %v", data, err)
+	}
+	if _, err := os.Stat(j("site2/dir/docs")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("dir/docs exists: %v", err)
+	}
+	out, err := run(false, "qfs", "status", "-top", j("site2"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "unpushed changes: 0\n") {
+		t.Errorf("wrong status: %s", out)
+	}
+
+	// Changes in Documents are pushed as changes to dir/docs.
+	writeFile(t, j("site2/Documents/d"), start+1000, 0o644, "d2")
+	_, err = run(true, "qfs", "push", "-top", j("site2"))
+	testutil.Check(t, err)
+	_, err = run(true, "qfs", "pull", "-top", j("site1"))
+	testutil.Check(t, err)
+	if data, err := os.ReadFile(j("site1/dir/docs/d")); err != nil || string(data) != "d2" {
+		t.Errorf("dir/docs/d: %q %v", data, err)
+	}
+
+	writeFile(t, j("site2/.qfs/pathmap"), start, 0o644, "src=dir dest=.qfs/dir\n")
+	_, err = run(false, "qfs", "status", "-top", j("site2"))
+	if err == nil || !strings.Contains(err.Error(), "path rules can't apply to .qfs") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(stdout), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	out, err := run(false, "qfs", "quota", "-top", j("site1"))
+	testutil.Check(t, err)
+	if out != "the repository has no quota\n" {
+		t.Errorf("wrong output: %s", out)
+	}
+
+	// A push that would go over the quota is refused before anything changes.
+	_, err = run(false, "qfs", "quota", "-top", j("site1"), "-size", "1K")
+	testutil.Check(t, err)
+	writeFile(t, j("site1/dir/big"), start, 0o644, strings.Repeat("x", 2000))
+	_, err = run(false, "qfs", "push", "-top", j("site1"))
+	if err == nil || !strings.Contains(err.Error(), "push would exceed the repository's quota: 2.0K is more than 1.0K") {
+		t.Errorf("wrong error: %v", err)
+	}
+	out, err = run(false, "qfs", "status", "-top", j("site1"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "unpushed changes: 1\n") {
+		t.Errorf("wrong status: %s", out)
+	}
+
+	// With -warn, it is allowed.
+	_, err = run(false, "qfs", "quota", "-top", j("site1"), "-size", "1K", "-warn")
+	testutil.Check(t, err)
+	_, err = run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	out, err = run(false, "qfs", "quota", "-top", j("site1"))
+	testutil.Check(t, err)
+	if !strings.HasPrefix(out, "quota: 2.0K of 1.0K (") ||
+		!strings.HasSuffix(out, "\npushes that exceed the quota are allowed with a warning\n") {
+		t.Errorf("wrong output: %s", out)
+	}
+	out, err = run(false, "qfs", "du", "-top", j("site1"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "\nquota: 2.0K of 1.0K (") {
+		t.Errorf("wrong du output: %s", out)
+	}
+
+	// Removing files is allowed even though the repository is still over.
+	_, err = run(false, "qfs", "quota", "-top", j("site1"), "-size", "1K", "-objects", "3")
+	testutil.Check(t, err)
+	testutil.Check(t, os.Remove(j("site1/dir/big")))
+	_, err = run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+
+	_, err = run(false, "qfs", "quota", "-top", j("site1"), "-remove")
+	testutil.Check(t, err)
+	out, err = run(false, "qfs", "quota", "-top", j("site1"))
+	testutil.Check(t, err)
+	if out != "the repository has no quota\n" {
+		t.Errorf("wrong output: %s", out)
+	}
+}
+
+func TestCopySite(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, site := range []string{"site1", "site2"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir/two\n")
+	writeFile(t, j("site1/dir/one/a"), start, 0o644, "a")
+	writeFile(t, j("site1/dir/two/b"), start, 0o644, "b")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(stdout), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	_, err = run(true, "qfs", "pull", "-top", j("site2"))
+	testutil.Check(t, err)
+
+	for _, tc := range []struct {
+		args   []string
+		errMsg string
+	}{
+		{[]string{"site2", "site2"}, "can't copy site site2 to itself"},
+		{[]string{"potato", "site3"}, "the repository has no database or filter for site potato"},
+		{[]string{"site2", "site1"}, "the repository already has a database or filter for site site1"},
+		{[]string{"site2", "a/b"}, "\"a/b\" is not a valid site name"},
+	} {
+		_, err = run(false, append([]string{"qfs", "copy-site", "-top", j("site1")}, tc.args...)...)
+		if err == nil || err.Error() != tc.errMsg {
+			t.Errorf("%v: wrong error: %v", tc.args, err)
+		}
+	}
+
+	// site2's computer is replaced. Its files move to the new computer, which is
+	// site3 and starts where site2 left off.
+	_, err = run(false, "qfs", "copy-site", "-top", j("site1"), "site2", "site3")
+	testutil.Check(t, err)
+	if data, err := os.ReadFile(j("site1/.qfs/filters/site3")); err != nil || string(data) != ":include:\ndir/two\n" {
+		t.Errorf("local copy of filter: %q %v", data, err)
+	}
+	testutil.Check(t, os.Rename(j("site2"), j("site3")))
+	writeFile(t, j("site3/.qfs/site"), start, 0o644, "site3\n")
+	_, err = run(true, "qfs", "pull", "-top", j("site3"))
+	testutil.Check(t, err)
+	if _, err := os.Stat(j("site3/dir/one")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("site3 pulled files outside its filter: %v", err)
+	}
+	out, err := run(false, "qfs", "status", "-top", j("site3"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "unpushed changes: 0\n") {
+		t.Errorf("wrong status: %s", out)
+	}
+
+	// With -filter-only, the new site has no database, so it pulls everything.
+	_, err = run(false, "qfs", "copy-site", "-top", j("site1"), "-filter-only", "site1", "site4")
+	testutil.Check(t, err)
+	out, err = run(false, "qfs", "sites", "-top", j("site1"))
+	testutil.Check(t, err)
+	if !strings.Contains(out, "\nsite4 never pushed (no database)\n") {
+		t.Errorf("wrong output: %s", out)
+	}
+}
+
+func TestGetDeletedAndVersionId(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site1"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a v1")
+	writeFile(t, j("site1/dir/b"), start, 0o644, "b")
+	writeFile(t, j("site1/dir/sub/c"), start, 0o644, "c")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(prompt bool, args ...string) (string, error) {
+		var err error
+		stdout, _ := testutil.WithStdout(func() {
+			if prompt {
+				misc.TestPromptChannel <- "y"
+			}
+			err = qfs.Run(args)
+		})
+		return string(stdout), err
+	}
+	_, err := run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	writeFile(t, j("site1/dir/a"), start+1000, 0o644, "a v2")
+	_, err = run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+	testutil.Check(t, os.Remove(j("site1/dir/b")))
+	testutil.Check(t, os.RemoveAll(j("site1/dir/sub")))
+	_, err = run(true, "qfs", "push", "-top", j("site1"))
+	testutil.Check(t, err)
+
+	// Only deleted files are retrieved, as they were before they were deleted.
+	out, err := run(false, "qfs", "get", "-top", j("site1"), "-deleted-only", "dir", j("restore"))
+	testutil.Check(t, err)
+	if out != "dir/b\ndir/sub\ndir/sub/c\n" {
+		t.Errorf("wrong output: %s", out)
+	}
+	for p, exp := range map[string]string{"b": "b", "sub/c": "c"} {
+		data, err := os.ReadFile(j("restore/dir/" + p))
+		testutil.Check(t, err)
+		if string(data) != exp {
+			t.Errorf("%s: wrong contents: %s", p, data)
+		}
+	}
+	if _, err := os.Stat(j("restore/dir/a")); !os.IsNotExist(err) {
+		t.Errorf("dir/a was retrieved: %v", err)
+	}
+
+	// Retrieve the older version of a file by its version ID.
+	out, err = run(false, "qfs", "list-versions", "-top", j("site1"), "-long", "dir/a")
+	testutil.Check(t, err)
+	var versionIds []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "    ") {
+			versionIds = append(versionIds, strings.Fields(line)[1])
+		}
+	}
+	if len(versionIds) != 2 {
+		t.Fatalf("wrong versions: %s", out)
+	}
+	out, err = run(false, "qfs", "get", "-top", j("site1"), "-version-id", versionIds[1], "dir/a", j("old"))
+	testutil.Check(t, err)
+	if out != "dir/a\n" {
+		t.Errorf("wrong output: %s", out)
+	}
+	data, err := os.ReadFile(j("old/dir/a"))
+	testutil.Check(t, err)
+	if string(data) != "a v1" {
+		t.Errorf("wrong contents: %s", data)
+	}
+	out, err = run(false, "qfs", "get", "-top", j("site1"), "-version-id", versionIds[0], "-stdout", "dir/a")
+	testutil.Check(t, err)
+	if out != "a v2" {
+		t.Errorf("wrong output: %s", out)
+	}
+	_, err = run(false, "qfs", "get", "-top", j("site1"), "-version-id", "bogus", "dir/a", j("bogus"))
+	if err == nil || err.Error() != "dir/a: version bogus not found" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDeleteExcluded(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	for _, site := range []string{"site1", "site2"} {
+		writeFile(t, j(site+"/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+		writeFile(t, j(site+"/.qfs/site"), start, 0o644, site+"\n")
+	}
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\n")
+	writeFile(t, j("site1/dir/keep/a"), start, 0o644, "a")
+	writeFile(t, j("site1/dir/drop/b"), start, 0o644, "b")
+	writeFile(t, j("site1/dir/drop/c"), start, 0o644, "c")
+	writeFile(t, j("site1/dir/gone/d"), start, 0o644, "d")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) {
+		t.Helper()
+		var err error
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		testutil.Check(t, err)
+	}
+	run("qfs", "push", "-top", j("site1"))
+	run("qfs", "pull", "-top", j("site2"))
+
+	// Narrow site2's filter. Its copies of dir/drop and dir/gone stay until it
+	// pulls with -delete-excluded.
+	writeFile(t, j("site1/.qfs/filters/site2"), start+1000, 0o644, ":include:\ndir/keep\n")
+	run("qfs", "push", "-top", j("site1"))
+	writeFile(t, j("site2/dir/drop/c"), start+2000, 0o644, "changed")
+	writeFile(t, j("site2/dir/drop/local"), start, 0o644, "local")
+	r, err := repo.New(repo.WithLocalTop(j("site2")), repo.WithS3Client(s3Client))
+	testutil.Check(t, err)
+	var result *repo.Result
+	_, _ = testutil.WithStdout(func() {
+		result, err = r.Pull(&repo.PullConfig{NoOp: true, DeleteExcluded: true})
+	})
+	testutil.Check(t, err)
+	if !slices.Equal(result.Excluded, []string{"dir/drop/b", "dir/gone/d"}) {
+		t.Errorf("wrong excluded files: %v", result.Excluded)
+	}
+	// One prompt for the pull and one for removing excluded files
+	misc.TestPromptChannel <- "y"
+	run("qfs", "pull", "-delete-excluded", "-trash", "-top", j("site2"))
+	for path, exp := range map[string]bool{
+		"dir/keep/a":     true,
+		"dir/drop/b":     false,
+		"dir/drop/c":     true,
+		"dir/drop/local": true,
+		"dir/gone":       false,
+	} {
+		_, err := os.Stat(j("site2/" + path))
+		if exists := err == nil; exists != exp {
+			t.Errorf("%s: exists = %v", path, exists)
+		}
+	}
+}
+
+func TestShardedRepoDb(t *testing.T) {
+	defer func() {
+		misc.TestPromptChannel = nil
+		misc.TestMessageChannel = nil
+	}()
+	setUpTestBucket()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	cleanupMessages, _ := testutil.CaptureMessages()
+	defer cleanupMessages()
+	misc.TestPromptChannel = make(chan string, 5)
+	qfs.S3Client = s3Client
+	defer func() { qfs.S3Client = nil }()
+
+	start := time.Now().Add(-24 * time.Hour).UnixMilli()
+	later := start + 3600000
+	writeFile(t, j("site1/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\nshard-db = true\n")
+	writeFile(t, j("site1/.qfs/site"), start, 0o644, "site1\n")
+	writeFile(t, j("site1/.qfs/filters/repo"), start, 0o644, ":include:\ndir\nother\n")
+	writeFile(t, j("site1/.qfs/filters/site2"), start, 0o644, ":include:\ndir\nother\n")
+	writeFile(t, j("site1/dir/a"), start, 0o644, "a")
+	writeFile(t, j("site1/other/b"), start, 0o644, "b")
+	writeFile(t, j("site2/.qfs/repo"), start, 0o644, "s3://"+TestBucket+"/home\n")
+	writeFile(t, j("site2/.qfs/site"), start, 0o644, "site2\n")
+	testutil.Check(t, qfs.Run([]string{"qfs", "init-repo", "-top", j("site1")}))
+	run := func(args ...string) {
+		t.Helper()
+		var err error
+		_, _ = testutil.WithStdout(func() {
+			misc.TestPromptChannel <- "y"
+			err = qfs.Run(args)
+		})
+		testutil.Check(t, err)
+	}
+	// shards maps each shard to its key.
+	shards := func() map[string]string {
+		t.Helper()
+		output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(TestBucket),
+			Prefix: aws.String("home/" + repofiles.RepoShards + "/"),
+		})
+		testutil.Check(t, err)
+		result := map[string]string{}
+		for _, o := range output.Contents {
+			name, _, _ := strings.Cut(strings.TrimPrefix(*o.Key, "home/"+repofiles.RepoShards+"/"), "@")
+			result[name] = *o.Key
+		}
+		return result
+	}
+	checkFiles := func(exp map[string]string) {
+		t.Helper()
+		for path, contents := range exp {
+			if data, err := os.ReadFile(j(path)); err != nil || string(data) != contents {
+				t.Errorf("%s: %q %v", path, data, err)
+			}
+		}
+	}
+
+	run("qfs", "push", "-top", j("site1"))
+	before := shards()
+	if !slices.Equal(misc.SortedKeys(before), []string{"d-.qfs", "d-dir", "d-other", "top"}) {
+		t.Errorf("wrong shards: %v", before)
+	}
+	// A site that doesn't write shards can still read them.
+	run("qfs", "pull", "-top", j("site2"))
+	checkFiles(map[string]string{"site2/dir/a": "a", "site2/other/b": "b"})
+	if _, err := os.Stat(j("site2/" + repofiles.RepoShardIndex)); err != nil {
+		t.Error(err.Error())
+	}
+
+	// Only the shard with the change is replaced, and the one it replaces is
+	// removed.
+	writeFile(t, j("site1/dir/a"), later, 0o644, "A")
+	run("qfs", "push", "-top", j("site1"))
+	after := shards()
+	if len(after) != 4 || after["d-other"] != before["d-other"] || after["d-dir"] == before["d-dir"] {
+		t.Errorf("wrong shards after push: %v", after)
+	}
+	run("qfs", "pull", "-top", j("site2"))
+	checkFiles(map[string]string{"site2/dir/a": "A", "site2/other/b": "b"})
+
+	// A push from a site that doesn't write shards replaces them with the whole
+	// database.
+	writeFile(t, j("site2/other/b"), later, 0o644, "B")
+	run("qfs", "push", "-top", j("site2"))
+	if s := shards(); len(s) != 0 {
+		t.Errorf("shards remain: %v", s)
+	}
+	run("qfs", "pull", "-top", j("site1"))
+	checkFiles(map[string]string{"site1/dir/a": "A", "site1/other/b": "B"})
+	if _, err := os.Stat(j("site1/" + repofiles.RepoShards)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("local shards remain: %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sso"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/jberkenbilt/qfs/keyring"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// repoConfig is the contents of .qfs/repo. The first line is the location of
+// the repository as s3://bucket/prefix. Subsequent lines may contain settings,
+// as `key = value`, used to create the S3 client and to store files.
+type repoConfig struct {
+	bucket    string
+	prefix    string
+	endpoint  string
+	region    string
+	pathStyle bool
+	accel     bool
+	dualStack bool
+	profile   string
+	role      roleConfig
+	sso       ssoConfig
+	retry     s3source.RetryPolicy
+	layout    s3source.Layout
+	chunkSize int64
+	audit     string
+	shardDb   bool
+	lock      s3source.ObjectLock
+	keyring   bool
+}
+
+// roleConfig describes a role to assume with the credentials that would
+// otherwise be used.
+type roleConfig struct {
+	arn         string
+	externalId  string
+	sessionName string
+	stsEndpoint string
+}
+
+// ssoConfig describes credentials obtained through IAM Identity Center, formerly
+// AWS SSO, using a token cached by `aws sso login`.
+type ssoConfig struct {
+	startUrl  string
+	session   string
+	region    string
+	accountId string
+	roleName  string
+}
+
+// parseRepoConfig parses the contents of .qfs/repo. Retry settings modify
+// retryPolicy.
+func parseRepoConfig(data string, retryPolicy s3source.RetryPolicy) (*repoConfig, error) {
+	first, rest, _ := strings.Cut(data, "\n")
+	m := s3Re.FindStringSubmatch(strings.TrimSpace(first))
+	if m == nil {
+		return nil, fmt.Errorf("%s must contain s3://bucket/prefix", repofiles.RepoConfig)
+	}
+	c := &repoConfig{
+		bucket: m[1],
+		prefix: m[2],
+		retry:  retryPolicy,
+	}
+	for i, line := range strings.Split(rest, "\n") {
+		lineNo := i + 2
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key = value", repofiles.RepoConfig, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "endpoint":
+			c.endpoint = value
+		case "region":
+			c.region = value
+		case "path-style":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: path-style must be true or false", repofiles.RepoConfig, lineNo)
+			}
+			c.pathStyle = v
+		case "accelerate", "dual-stack":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s must be true or false", repofiles.RepoConfig, lineNo, key)
+			}
+			if key == "accelerate" {
+				c.accel = v
+			} else {
+				c.dualStack = v
+			}
+		case "profile":
+			c.profile = value
+		case "role-arn":
+			c.role.arn = value
+		case "external-id":
+			c.role.externalId = value
+		case "role-session-name":
+			c.role.sessionName = value
+		case "sts-endpoint":
+			c.role.stsEndpoint = value
+		case "sso-start-url":
+			c.sso.startUrl = value
+		case "sso-session":
+			c.sso.session = value
+		case "sso-region":
+			c.sso.region = value
+		case "sso-account-id":
+			c.sso.accountId = value
+		case "sso-role-name":
+			c.sso.roleName = value
+		case "layout":
+			layout, err := s3source.ParseLayout(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", repofiles.RepoConfig, lineNo, err)
+			}
+			c.layout = layout
+		case "chunk-size":
+			size, err := misc.ParseSize(value)
+			if err != nil || size == 0 {
+				return nil, fmt.Errorf("%s:%d: chunk-size must be a positive size such as 64M", repofiles.RepoConfig, lineNo)
+			}
+			c.chunkSize = size
+		case "retry-attempts":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s:%d: retry-attempts must be a positive integer", repofiles.RepoConfig, lineNo)
+			}
+			c.retry.MaxAttempts = n
+		case "retry-delay", "retry-max-delay":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("%s:%d: %s must be a duration such as 500ms or 10s", repofiles.RepoConfig, lineNo, key)
+			}
+			if key == "retry-delay" {
+				c.retry.InitialDelay = d
+			} else {
+				c.retry.MaxDelay = d
+			}
+		case "shard-db":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: shard-db must be true or false", repofiles.RepoConfig, lineNo)
+			}
+			c.shardDb = v
+		case "object-lock-mode":
+			mode := types.ObjectLockMode(strings.ToUpper(value))
+			if mode != types.ObjectLockModeGovernance && mode != types.ObjectLockModeCompliance {
+				return nil, fmt.Errorf("%s:%d: object-lock-mode must be governance or compliance", repofiles.RepoConfig, lineNo)
+			}
+			c.lock.Mode = mode
+		case "object-lock-retain":
+			age, err := misc.ParseAge(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: object-lock-retain must be a number followed by h, d, or w", repofiles.RepoConfig, lineNo)
+			}
+			c.lock.Retain = age
+		case "legal-hold":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: legal-hold must be true or false", repofiles.RepoConfig, lineNo)
+			}
+			c.lock.LegalHold = v
+		case "keyring":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: keyring must be true or false", repofiles.RepoConfig, lineNo)
+			}
+			c.keyring = v
+		case "audit":
+			if value != auditRepository && value != auditLocal {
+				return nil, fmt.Errorf("%s:%d: audit must be repository or local", repofiles.RepoConfig, lineNo)
+			}
+			c.audit = value
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown setting \"%s\"", repofiles.RepoConfig, lineNo, key)
+		}
+	}
+	if c.chunkSize > 0 && c.layout != s3source.LayoutContent {
+		return nil, fmt.Errorf("%s: chunk-size requires layout = content", repofiles.RepoConfig)
+	}
+	if (c.lock.Mode == "") != (c.lock.Retain == 0) {
+		return nil, fmt.Errorf("%s: object-lock-mode and object-lock-retain must be given together", repofiles.RepoConfig)
+	}
+	if c.accel && (c.endpoint != "" || c.pathStyle) {
+		return nil, fmt.Errorf("%s: accelerate can't be used with endpoint or path-style", repofiles.RepoConfig)
+	}
+	if c.dualStack && c.endpoint != "" {
+		return nil, fmt.Errorf("%s: dual-stack can't be used with endpoint", repofiles.RepoConfig)
+	}
+	if c.role.arn == "" && c.role != (roleConfig{}) {
+		return nil, fmt.Errorf("%s: external-id, role-session-name, and sts-endpoint require role-arn", repofiles.RepoConfig)
+	}
+	if c.sso != (ssoConfig{}) {
+		if c.sso.region == "" {
+			c.sso.region = c.region
+		}
+		if c.sso.startUrl == "" || c.sso.accountId == "" || c.sso.roleName == "" || c.sso.region == "" {
+			return nil, fmt.Errorf(
+				"%s: sso-start-url, sso-account-id, sso-role-name, and sso-region or region are required for SSO",
+				repofiles.RepoConfig,
+			)
+		}
+		if c.profile != "" {
+			return nil, fmt.Errorf("%s: profile can't be used with sso-start-url", repofiles.RepoConfig)
+		}
+	}
+	if c.keyring {
+		if c.endpoint == "" {
+			return nil, fmt.Errorf("%s: keyring requires endpoint", repofiles.RepoConfig)
+		}
+		if c.profile != "" || c.sso.startUrl != "" {
+			return nil, fmt.Errorf("%s: keyring can't be used with profile or sso-start-url", repofiles.RepoConfig)
+		}
+	}
+	return c, nil
+}
+
+// keyringAccount returns the account under which credentials are stored in the
+// keyring or the empty string if they aren't. Credentials are stored by
+// endpoint, so all repositories on a server share them.
+func (c *repoConfig) keyringAccount() string {
+	if !c.keyring {
+		return ""
+	}
+	return c.endpoint
+}
+
+// objectLock returns the Object Lock settings for stored objects or nil if
+// there are none.
+func (c *repoConfig) objectLock() *s3source.ObjectLock {
+	if c.lock == (s3source.ObjectLock{}) {
+		return nil
+	}
+	lock := c.lock
+	return &lock
+}
+
+// s3Client creates an S3 client using the default AWS configuration as modified
+// by the repository configuration. Credentials come from SSO or the keyring if
+// configured and from the default chain, which honors the profile, otherwise.
+// If a role is configured, those credentials are used to assume it. If transfer
+// acceleration is configured, the bucket is checked to make sure it is enabled.
+func (c *repoConfig) s3Client(ctx context.Context, kr keyring.Keyring) (*s3.Client, error) {
+	var loadOptions []func(*config.LoadOptions) error
+	if c.region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(c.region))
+	}
+	if c.profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(c.profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if c.sso.startUrl != "" {
+		var ssoOptions []func(*ssocreds.Options)
+		if c.sso.session != "" {
+			// aws sso login --sso-session caches the token by session name.
+			tokenPath, err := ssocreds.StandardCachedTokenFilepath(c.sso.session)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, err
+			}
+			ssoOptions = append(ssoOptions, func(o *ssocreds.Options) {
+				o.CachedTokenFilepath = tokenPath
+			})
+		}
+		ssoClient := sso.NewFromConfig(cfg, func(o *sso.Options) {
+			o.Region = c.sso.region
+		})
+		cfg.Credentials = aws.NewCredentialsCache(ssocreds.New(
+			ssoClient,
+			c.sso.accountId,
+			c.sso.roleName,
+			c.sso.startUrl,
+			ssoOptions...,
+		))
+	}
+	if account := c.keyringAccount(); account != "" {
+		cfg.Credentials = aws.NewCredentialsCache(&keyringProvider{
+			keyring: kr,
+			account: account,
+		})
+	}
+	if c.role.arn != "" {
+		stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if c.role.stsEndpoint != "" {
+				o.BaseEndpoint = aws.String(c.role.stsEndpoint)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(
+			stsClient,
+			c.role.arn,
+			func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = c.role.sessionName
+				if o.RoleSessionName == "" {
+					o.RoleSessionName = "qfs"
+				}
+				if c.role.externalId != "" {
+					o.ExternalID = aws.String(c.role.externalId)
+				}
+			},
+		))
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if c.endpoint != "" {
+			o.BaseEndpoint = aws.String(c.endpoint)
+		}
+		o.UsePathStyle = c.pathStyle
+		o.UseAccelerate = c.accel
+		if c.dualStack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+	})
+	if c.accel {
+		if err := c.checkAccelerate(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// checkAccelerate returns an error if transfer acceleration is not enabled for
+// the bucket. Without this, every request would fail with a less helpful error.
+func (c *repoConfig) checkAccelerate(ctx context.Context, client *s3.Client) error {
+	output, err := client.GetBucketAccelerateConfiguration(
+		ctx,
+		&s3.GetBucketAccelerateConfigurationInput{
+			Bucket: &c.bucket,
+		},
+		func(o *s3.Options) {
+			// The accelerate endpoint fails if acceleration is not enabled.
+			o.UseAccelerate = false
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to check transfer acceleration for bucket %s: %w", c.bucket, err)
+	}
+	if output.Status != types.BucketAccelerateStatusEnabled {
+		// TEST: NOT COVERED
+		return fmt.Errorf(
+			"%s: accelerate is set, but transfer acceleration is not enabled for bucket %s",
+			repofiles.RepoConfig,
+			c.bucket,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A retention policy determines which old versions of files are kept in the
+// repository. It is stored in the repository so that every site applies the
+// same policy. Each line of the policy is a rule of the form `granularity age`.
+// Among the versions of a file that are no older than age, a rule keeps the
+// newest version in each period of the given granularity. A version is kept if
+// any rule keeps it. The current version of every file is always kept.
+
+// RetentionRule is one line of a retention policy.
+type RetentionRule struct {
+	// Granularity is one of all, hourly, daily, weekly, monthly, or yearly. With
+	// all, every version is kept.
+	Granularity string
+	// MaxAge is the age beyond which the rule doesn't apply. If zero, the rule
+	// applies to versions of any age.
+	MaxAge time.Duration
+}
+
+type RetentionPolicy struct {
+	Rules []*RetentionRule
+}
+
+// RetentionConfig is passed to ApplyRetention.
+type RetentionConfig struct {
+	// NoOp shows which versions would be removed without removing them.
+	NoOp bool
+	// BypassGovernance removes versions whose Object Lock retention in governance
+	// mode hasn't expired. This requires the s3:BypassGovernanceRetention
+	// permission.
+	BypassGovernance bool
+}
+
+var retentionPeriods = map[string]string{
+	"all":     "",
+	"hourly":  "2006-01-02T15",
+	"daily":   "2006-01-02",
+	"weekly":  "",
+	"monthly": "2006-01",
+	"yearly":  "2006",
+}
+
+var ageUnits = map[byte]time.Duration{
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// ParseRetentionPolicy parses a retention policy. filename is used in error
+// messages.
+func ParseRetentionPolicy(filename string, data string) (*RetentionPolicy, error) {
+	p := &RetentionPolicy{}
+	for i, line := range strings.Split(data, "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected granularity and age", filename, lineNo)
+		}
+		if _, ok := retentionPeriods[fields[0]]; !ok {
+			return nil, fmt.Errorf(
+				"%s:%d: granularity must be all, hourly, daily, weekly, monthly, or yearly",
+				filename,
+				lineNo,
+			)
+		}
+		rule := &RetentionRule{Granularity: fields[0]}
+		if fields[1] != "forever" {
+			age, err := misc.ParseAge(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: age must be forever or a number followed by h, d, or w", filename, lineNo)
+			}
+			rule.MaxAge = age
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("%s: retention policy has no rules", filename)
+	}
+	return p, nil
+}
+
+func (p *RetentionPolicy) String() string {
+	var b strings.Builder
+	for _, rule := range p.Rules {
+		age := "forever"
+		if rule.MaxAge > 0 {
+			age = fmt.Sprintf("%dh", int64(rule.MaxAge/time.Hour))
+			for _, unit := range []byte{'w', 'd'} {
+				if rule.MaxAge%ageUnits[unit] == 0 {
+					age = fmt.Sprintf("%d%c", int64(rule.MaxAge/ageUnits[unit]), unit)
+					break
+				}
+			}
+		}
+		_, _ = fmt.Fprintf(&b, "%s %s\n", rule.Granularity, age)
+	}
+	return b.String()
+}
+
+func period(granularity string, t time.Time) string {
+	t = t.Local()
+	if granularity == "weekly" {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return t.Format(retentionPeriods[granularity])
+}
+
+// expired returns the versions of a single file that the policy doesn't keep.
+// versions must be sorted newest first.
+func (p *RetentionPolicy) expired(versions []*versionData, now time.Time) []*versionData {
+	if len(versions) == 0 {
+		return nil
+	}
+	keep := make([]bool, len(versions))
+	keep[0] = true
+	for _, rule := range p.Rules {
+		seen := map[string]bool{}
+		for i, v := range versions {
+			if rule.MaxAge > 0 && now.Sub(v.lastModified) > rule.MaxAge {
+				break
+			}
+			if rule.Granularity == "all" {
+				keep[i] = true
+				continue
+			}
+			key := period(rule.Granularity, v.lastModified)
+			if !seen[key] {
+				seen[key] = true
+				keep[i] = true
+			}
+		}
+	}
+	// If all that's left of a file is delete markers, there's nothing to restore,
+	// so remove them too.
+	onlyDeletes := true
+	for i, v := range versions {
+		if keep[i] && !v.isDelete {
+			onlyDeletes = false
+			break
+		}
+	}
+	var result []*versionData
+	for i, v := range versions {
+		if !keep[i] || onlyDeletes {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (r *Repo) retentionKey() string {
+	return path.Join(r.prefix, repofiles.Retention)
+}
+
+// SetRetention validates the retention policy in the given local file and
+// stores it in the repository.
+func (r *Repo) SetRetention(filename string) error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	policy, err := ParseRetentionPolicy(filename, string(data))
+	if err != nil {
+		return err
+	}
+	_, err = r.s3Client.PutObject(r.ctx, &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.retentionKey()),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("store retention policy: %w", err)
+	}
+	r.ui.Message("stored retention policy:")
+	_, _ = fmt.Fprint(r.ui.Output(), policy)
+	return nil
+}
+
+// RetentionPolicy returns the repository's retention policy or nil if it
+// doesn't have one.
+func (r *Repo) RetentionPolicy() (*RetentionPolicy, error) {
+	output, err := r.s3Client.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    aws.String(r.retentionKey()),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return nil, nil
+		}
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer func() { _ = output.Body.Close() }()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("read retention policy: %w", err)
+	}
+	return ParseRetentionPolicy(repofiles.Retention, string(data))
+}
+
+// ApplyRetention permanently removes the versions of files in the repository
+// that the repository's retention policy doesn't keep. The repository is
+// locked while versions are removed.
+func (r *Repo) ApplyRetention(config *RetentionConfig) error {
+	if !config.NoOp {
+		if err := r.checkReadOnly(); err != nil {
+			return err
+		}
+		if err := r.checkProtected("apply the retention policy"); err != nil {
+			return err
+		}
+	}
+	policy, err := r.RetentionPolicy()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return errors.New("the repository has no retention policy; use qfs set-retention to store one")
+	}
+	r.ui.Message("applying retention policy:")
+	_, _ = fmt.Fprint(r.ui.Output(), policy)
+	files, err := r.getVersions("", &ListVersionsConfig{})
+	if err != nil {
+		return err
+	}
+	lockEnabled, err := r.src.ObjectLockEnabled()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	now := time.Now()
+	var toRemove []*versionData
+	protected := 0
+	governance := 0
+	for _, p := range misc.SortedKeys(files) {
+		for _, v := range policy.expired(files[p], now) {
+			if lockEnabled && !v.isDelete {
+				// Removing a version that Object Lock protects would fail.
+				retention, err := r.src.VersionRetention(v.key, aws.String(v.version))
+				if err != nil {
+					// TEST: NOT COVERED
+					return err
+				}
+				if retention.Protected(now, config.BypassGovernance) {
+					_, _ = fmt.Fprintf(
+						r.ui.Output(),
+						"keep version %s of %s: %s\n",
+						misc.FormatTime(v.lastModified),
+						p,
+						retention,
+					)
+					protected++
+					if !retention.Protected(now, true) {
+						governance++
+					}
+					continue
+				}
+			}
+			what := "version"
+			if v.isDelete {
+				what = "deletion"
+			}
+			_, _ = fmt.Fprintf(r.ui.Output(), "remove %s %s of %s\n", what, misc.FormatTime(v.lastModified), p)
+			toRemove = append(toRemove, v)
+		}
+	}
+	if protected > 0 {
+		r.ui.Message("%d version(s) protected by Object Lock can't be removed", protected)
+		if governance > 0 {
+			r.ui.Message("use -bypass-governance to remove %d version(s) in governance mode", governance)
+		}
+	}
+	if len(toRemove) == 0 {
+		r.ui.Message("no versions to remove")
+		return nil
+	}
+	if config.NoOp || !r.ui.Prompt(fmt.Sprintf("Permanently remove %d version(s)?", len(toRemove))) {
+		return nil
+	}
+
+	site, err := r.currentSite()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	err = r.createBusy(site)
+	if err != nil {
+		return err
+	}
+	defer r.stopHeartbeat()
+	err = r.removeVersions(toRemove, config.BypassGovernance)
+	if err == nil {
+		err = r.audit("apply-retention", site, map[string]int{"removed": len(toRemove)}, "")
+	}
+	if err2 := r.removeBusy(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	r.ui.Message("removed %d version(s)", len(toRemove))
+	return nil
+}
+
+func (r *Repo) removeVersions(versions []*versionData, bypassGovernance bool) error {
+	for len(versions) > 0 {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+		batch := versions[:min(len(versions), s3source.DeleteBatchSize)]
+		versions = versions[len(batch):]
+		var objects []types.ObjectIdentifier
+		for _, v := range batch {
+			objects = append(objects, types.ObjectIdentifier{
+				Key:       aws.String(v.key),
+				VersionId: aws.String(v.version),
+			})
+		}
+		input := &s3.DeleteObjectsInput{
+			Bucket: &r.bucket,
+			Delete: &types.Delete{Objects: objects},
+		}
+		if bypassGovernance {
+			input.BypassGovernanceRetention = aws.Bool(true)
+		}
+		if r.mfa != "" {
+			input.MFA = &r.mfa
+		}
+		output, err := r.s3Client.DeleteObjects(r.ctx, input)
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("remove versions: %w", err)
+		}
+		if len(output.Errors) > 0 {
+			// TEST: NOT COVERED
+			e := output.Errors[0]
+			return fmt.Errorf("remove %s version %s: %s", aws.ToString(e.Key), aws.ToString(e.VersionId), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
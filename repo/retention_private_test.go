@@ -0,0 +1,79 @@
+package repo
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	p, err := ParseRetentionPolicy("policy", "# comment\nall 36h\n\ndaily 2w\nmonthly forever\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if p.String() != "all 36h\ndaily 2w\nmonthly forever\n" {
+		t.Errorf("wrong policy:\n%s", p)
+	}
+	for data, exp := range map[string]string{
+		"":              "policy: retention policy has no rules",
+		"daily":         "policy:1: expected granularity and age",
+		"\nsecondly 1d": "policy:2: granularity must be",
+		"daily 1y":      "policy:1: age must be forever",
+		"daily 0d":      "policy:1: age must be forever",
+		"daily d":       "policy:1: age must be forever",
+	} {
+		_, err := ParseRetentionPolicy("policy", data)
+		if err == nil || !strings.HasPrefix(err.Error(), exp) {
+			t.Errorf("%q: wrong error: %v", data, err)
+		}
+	}
+}
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	version := func(ago time.Duration, isDelete bool) *versionData {
+		return &versionData{lastModified: now.Add(-ago), isDelete: isDelete}
+	}
+	hour := time.Hour
+	day := 24 * hour
+	versions := []*versionData{
+		version(1*hour, false),  // current
+		version(2*hour, false),  // all 3h
+		version(4*hour, false),  // superseded on the same day
+		version(13*hour, false), // last of June 14
+		version(14*hour, true),  // superseded on the same day
+		version(3*day, false),   // last of June 12
+		version(20*day, false),  // too old for daily; last of May
+		version(21*day, false),  // superseded in May
+		version(400*day, false), // last of May 2023
+		version(401*day, false), // superseded in May 2023
+	}
+	p, err := ParseRetentionPolicy("policy", "all 3h\ndaily 10d\nmonthly forever\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expired := p.expired(versions, now)
+	exp := []*versionData{versions[2], versions[4], versions[7], versions[9]}
+	if len(expired) != len(exp) {
+		t.Fatalf("wrong number of expired versions: %d", len(expired))
+	}
+	for i := range exp {
+		if expired[i] != exp[i] {
+			t.Errorf("wrong version at %d: %v", i, expired[i].lastModified)
+		}
+	}
+
+	// If only deletions remain, everything goes.
+	p, err = ParseRetentionPolicy("policy", "all 1h\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	versions = []*versionData{version(3*hour, true), version(4*hour, false)}
+	if expired = p.expired(versions, now); len(expired) != 2 {
+		t.Errorf("wrong expired versions: %#v", expired)
+	}
+	versions = []*versionData{version(3*hour, false), version(4*hour, false)}
+	if expired = p.expired(versions, now); len(expired) != 1 || expired[0] != versions[1] {
+		t.Errorf("wrong expired versions: %#v", expired)
+	}
+}
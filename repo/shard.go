@@ -0,0 +1,454 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"io"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A repository database with tens of millions of entries takes a long time to
+// download and upload, even when only a few files have changed. With
+// `shard-db = true` in .qfs/repo, the database is split into shards by
+// top-level directory, each stored as its own object under .qfs/db/repo.d, and
+// the object that would otherwise hold the database holds a small index of the
+// shards instead. A push uploads only the shards that contain changes, a pull
+// downloads only the shards that have changed since the site last pulled, and
+// the index is the only object that has to be replaced atomically, so the
+// existing checks for concurrent updates apply to it unchanged. In memory and
+// in the site's local copy, the database is still whole.
+
+// shardIndexHeader is the first line of a shard index. It keeps versions of qfs
+// that don't know about shards from reading the index as a database.
+const shardIndexHeader = "QFS REPO INDEX 1"
+
+// topShard holds the entries for "." and for files, links, and special files
+// at the top of the repository. Shards for directories are named with a prefix
+// so they can't collide with it.
+const topShard = "top"
+
+// shardInfo describes one shard in the index.
+type shardInfo struct {
+	modTime time.Time
+	size    int64
+	entries int
+	// hash is the SHA-256 digest of the shard's contents, which is used to tell
+	// whether a shard has to be uploaded again.
+	hash string
+}
+
+// shardIndex maps shard names to their descriptions.
+type shardIndex map[string]*shardInfo
+
+// shardFor returns the name of the shard that holds the entry for p.
+func shardFor(p string, info *fileinfo.FileInfo) string {
+	top, _, nested := strings.Cut(p, "/")
+	if p == "." || (!nested && info.FileType != fileinfo.TypeDirectory) {
+		return topShard
+	}
+	return "d-" + top
+}
+
+// shardFileInfo returns the information from which the key of a shard's object
+// is computed.
+func shardFileInfo(name string, s *shardInfo) *fileinfo.FileInfo {
+	return &fileinfo.FileInfo{
+		Path:        repofiles.RepoShard(name),
+		FileType:    fileinfo.TypeFile,
+		ModTime:     s.modTime,
+		Size:        s.size,
+		Permissions: 0o644,
+	}
+}
+
+// splitShards divides a repository database into shards. Entries that wouldn't
+// survive loading the database, such as those for the databases themselves,
+// are omitted.
+func splitShards(db database.Database) map[string]database.Database {
+	cache := filter.NewCache(true)
+	shards := map[string]database.Database{}
+	for p, info := range db {
+		if included, _ := cache.IsIncluded(p); !included {
+			continue
+		}
+		name := shardFor(p, info)
+		if shards[name] == nil {
+			shards[name] = database.Database{}
+		}
+		shards[name][p] = info
+	}
+	return shards
+}
+
+// shardHash returns the digest of a shard's contents as they are stored. Since
+// the header is included, shards are stored again when the key version
+// changes.
+func shardHash(db database.Database, options ...database.WriterOptions) (string, error) {
+	h := sha256.New()
+	if err := database.WriteDbTo(h, db, database.DbRepo, options...); err != nil {
+		// TEST: NOT COVERED. Writing to a hash never fails.
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (idx shardIndex) bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(shardIndexHeader + "\n")
+	for _, name := range misc.SortedKeys(idx) {
+		s := idx[name]
+		_, _ = fmt.Fprintf(
+			&b,
+			"%s %d %d %d %s\n",
+			url.PathEscape(name),
+			s.modTime.UnixMilli(),
+			s.size,
+			s.entries,
+			s.hash,
+		)
+	}
+	return b.Bytes()
+}
+
+// isShardIndex returns whether the file at path is a shard index rather than a
+// repository database.
+func isShardIndex(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	header, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	return strings.TrimSuffix(header, "\n") == shardIndexHeader, nil
+}
+
+// parseShardIndex parses a shard index. name is used for error messages.
+func parseShardIndex(name string, r io.Reader) (shardIndex, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != shardIndexHeader {
+		return nil, fmt.Errorf("%s is not a repository database index", name)
+	}
+	idx := shardIndex{}
+	lineNo := 1
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		var shard string
+		var mtime, size int64
+		var entries int
+		var errs [4]error
+		if len(fields) == 5 {
+			shard, errs[0] = url.PathUnescape(fields[0])
+			mtime, errs[1] = strconv.ParseInt(fields[1], 10, 64)
+			size, errs[2] = strconv.ParseInt(fields[2], 10, 64)
+			entries, errs[3] = strconv.Atoi(fields[3])
+		}
+		if len(fields) != 5 || errors.Join(errs[:]...) != nil || shard == "" || strings.Contains(shard, "/") {
+			return nil, fmt.Errorf("%s:%d: invalid shard", name, lineNo)
+		}
+		idx[shard] = &shardInfo{
+			modTime: time.UnixMilli(mtime),
+			size:    size,
+			entries: entries,
+			hash:    fields[4],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return idx, nil
+}
+
+// loadShards loads a sharded repository database whose index, described by
+// srcInfo, has been copied to the local index. The local copy of the database
+// is used if it was made from this index. Otherwise, shards that have changed
+// since they were last copied are downloaded, the database is assembled from
+// the local copies of the shards, and it is written to TempRepoDb. The return
+// values are the same as for loadRepoDbFrom.
+func (r *Repo) loadShards(src *s3source.S3Source, srcInfo *fileinfo.FileInfo) (database.Database, bool, error) {
+	indexPath := r.localPath(repofiles.RepoShardIndex).Path()
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	idx, err := parseShardIndex(indexPath, bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	r.shardIndex = idx
+
+	if r.localShardedDbCurrent(srcInfo) {
+		r.ui.Message("local copy of repository database is current")
+		db, err := r.loadRepoDbCopy(repofiles.RepoDb())
+		// Any copy downloaded earlier is out of date.
+		_ = os.Remove(r.localPath(repofiles.TempRepoDb()).Path())
+		return db, false, err
+	}
+
+	db := database.Database{}
+	for _, name := range misc.SortedKeys(idx) {
+		shardPath := repofiles.RepoShard(name)
+		info := shardFileInfo(name, idx[name])
+		requiresCopy, err := fileinfo.RequiresCopy(info, r.localPath(shardPath))
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, false, err
+		}
+		if requiresCopy {
+			r.ui.Message("downloading repository database shard %s", name)
+			_, err = fileinfo.RetrieveFromInfo(info, r.localPath(shardPath), func(f *os.File) error {
+				return src.Download(shardPath, info, f)
+			})
+			if err != nil {
+				return nil, false, fmt.Errorf("download shard %s: %w", name, err)
+			}
+		}
+		shard, err := r.loadRepoDbCopy(shardPath)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, false, err
+		}
+		maps.Copy(db, shard)
+	}
+	r.removeLocalShards(idx)
+
+	pending := r.localPath(repofiles.TempRepoDb()).Path()
+	err = database.WriteDb(pending, db, database.DbRepo, r.repoDbOptions())
+	if err == nil {
+		err = os.Chtimes(pending, srcInfo.ModTime, srcInfo.ModTime)
+	}
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, false, err
+	}
+	return db, true, nil
+}
+
+// localShardedDbCurrent returns whether the local copy of the repository
+// database was made from the index described by srcInfo. The local copy is
+// given the index's modification time when it is written.
+func (r *Repo) localShardedDbCurrent(srcInfo *fileinfo.FileInfo) bool {
+	info, err := r.localPath(repofiles.RepoDb()).FileInfo()
+	return err == nil && info.ModTime.Equal(srcInfo.ModTime)
+}
+
+// localRepoDbCurrent returns whether the local copy of the repository database
+// matches the repository's, whose object is described by srcInfo, whether or
+// not it is sharded.
+func (r *Repo) localRepoDbCurrent(srcInfo *fileinfo.FileInfo) (bool, error) {
+	indexCopy, err := fileinfo.RequiresCopy(srcInfo, r.localPath(repofiles.RepoShardIndex))
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	if !indexCopy {
+		return r.localShardedDbCurrent(srcInfo), nil
+	}
+	requiresCopy, err := fileinfo.RequiresCopy(srcInfo, r.localPath(repofiles.RepoDb()))
+	return !requiresCopy, err
+}
+
+// removeLocalShards removes local copies of shards that aren't in idx. If idx
+// is nil, the local copy of the index is removed as well.
+func (r *Repo) removeLocalShards(idx shardIndex) {
+	dir := r.localPath(repofiles.RepoShards).Path()
+	if idx == nil {
+		_ = os.RemoveAll(dir)
+		return
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		name := e.Name()
+		if idx[name] == nil && repofiles.RepoShard(name) != repofiles.RepoShardIndex {
+			_ = os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// storeShards uploads the shards of the repository database that have changed
+// since it was loaded and then uploads the index as the repository database
+// with the modification time in info. Shards are stored under new keys, so the
+// previous shards remain readable until the index has been replaced. It returns
+// the new index and the keys of the shards that it no longer refers to, which
+// can be removed once it is known that nobody else has replaced the index.
+func (r *Repo) storeShards(info *fileinfo.FileInfo) (shardIndex, []string, error) {
+	shards := splitShards(r.repoDb)
+	idx := shardIndex{}
+	var changed []string
+	for _, name := range misc.SortedKeys(shards) {
+		hash, err := shardHash(shards[name], r.repoDbOptions())
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, nil, err
+		}
+		if old := r.shardIndex[name]; old != nil && old.hash == hash {
+			idx[name] = old
+			continue
+		}
+		idx[name] = &shardInfo{
+			modTime: info.ModTime,
+			entries: len(shards[name]),
+			hash:    hash,
+		}
+		changed = append(changed, name)
+	}
+	for _, name := range changed {
+		r.ui.Message("uploading repository database shard %s", name)
+		shardInfo := shardFileInfo(name, idx[name])
+		err := r.storeDbStream(repofiles.RepoShard(name), shardInfo, shards[name], false)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, nil, err
+		}
+		idx[name].size = shardInfo.Size
+	}
+	r.ui.Message("uploading repository database index")
+	err := r.src.StoreStream(repofiles.RepoDb(), info, bytes.NewReader(idx.bytes()))
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, nil, err
+	}
+	return idx, r.supersededShards(idx), nil
+}
+
+// supersededShards returns the keys of shards in the loaded index that aren't
+// in idx. If idx is nil, all of them are returned.
+func (r *Repo) supersededShards(idx shardIndex) []string {
+	var keys []string
+	for _, name := range misc.SortedKeys(r.shardIndex) {
+		old := r.shardIndex[name]
+		if idx[name] != old {
+			keys = append(keys, r.src.KeyFromPath(repofiles.RepoShard(name), shardFileInfo(name, old)))
+		}
+	}
+	return keys
+}
+
+// storeDbStream uploads db at repoPath without writing it to a local file
+// first. If replace is true, the existing object is removed first as with
+// StoreStream. Otherwise, it is left in place as with AddStream.
+func (r *Repo) storeDbStream(repoPath string, info *fileinfo.FileInfo, db database.Database, replace bool) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(database.WriteDbTo(pw, db, database.DbRepo, r.repoDbOptions()))
+	}()
+	var err error
+	if replace {
+		err = r.src.StoreStream(repoPath, info, pr)
+	} else {
+		err = r.src.AddStream(repoPath, info, pr)
+	}
+	// If the upload failed, this makes the writer stop.
+	_ = pr.Close()
+	return err
+}
+
+// updateLocalShards writes the local copies of the index and of the shards that
+// were uploaded with it. Like the local copy of the database, these are only a
+// cache, so if they can't be written, they are removed.
+func (r *Repo) updateLocalShards(idx shardIndex, indexTime time.Time) {
+	if idx == nil {
+		r.removeLocalShards(nil)
+		return
+	}
+	write := func(relPath string, modTime time.Time, fn func(string) error) error {
+		localPath := r.localPath(relPath).Path()
+		err := os.MkdirAll(filepath.Dir(localPath), 0o777)
+		if err == nil {
+			err = fn(localPath)
+		}
+		if err == nil {
+			err = os.Chtimes(localPath, modTime, modTime)
+		}
+		return err
+	}
+	var err error
+	shards := splitShards(r.repoDb)
+	for _, name := range misc.SortedKeys(idx) {
+		s := idx[name]
+		if !s.modTime.Equal(indexTime) {
+			// This shard wasn't uploaded, so the local copy is already current.
+			continue
+		}
+		err = write(repofiles.RepoShard(name), s.modTime, func(localPath string) error {
+			return database.WriteDb(localPath, shards[name], database.DbRepo, r.repoDbOptions())
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			break
+		}
+	}
+	if err == nil {
+		err = write(repofiles.RepoShardIndex, indexTime, func(localPath string) error {
+			return os.WriteFile(localPath, idx.bytes(), 0o666)
+		})
+	}
+	if err != nil {
+		// TEST: NOT COVERED
+		r.ui.Message("unable to update local copy of repository database shards: %v", err)
+		r.removeLocalShards(nil)
+		return
+	}
+	r.removeLocalShards(idx)
+}
+
+// readRepoDb reads the repository database from src, which need not be this
+// repository, whether or not it is sharded.
+func readRepoDb(src *s3source.S3Source) (database.Database, error) {
+	dbPath := fileinfo.NewPath(src, repofiles.RepoDb())
+	f, err := dbPath.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(len(shardIndexHeader))
+	if string(header) != shardIndexHeader {
+		return database.Load(dbPath, database.WithRepoRules(true))
+	}
+	idx, err := parseShardIndex(dbPath.Path(), br)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	db := database.Database{}
+	for _, name := range misc.SortedKeys(idx) {
+		shard, err := database.Load(
+			fileinfo.NewPath(src, repofiles.RepoShard(name)),
+			database.WithRepoRules(true),
+		)
+		if errors.Is(err, fs.ErrNotExist) {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("shard %s of %s is missing: %w", name, dbPath.Path(), err)
+		} else if err != nil {
+			// TEST: NOT COVERED
+			return nil, err
+		}
+		maps.Copy(db, shard)
+	}
+	return db, nil
+}
@@ -0,0 +1,104 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"os"
+	"strings"
+)
+
+// ErrSiteDbChanged indicates that the repository's copy of the site's database
+// was written by another operation while this one was running.
+var ErrSiteDbChanged = errors.New("site database changed in repository; pull and retry")
+
+var errSiteLocked = errors.New("site lock is held by another process")
+
+// lockSite takes the site's local lock, which keeps two qfs processes at the
+// same site, such as overlapping cron jobs, from pushing or pulling at the same
+// time. The lock file holds the process ID of its owner. The returned function
+// releases the lock.
+func (r *Repo) lockSite() (func(), error) {
+	p := r.localPath(repofiles.SiteLock).Path()
+	f, err := openSiteLock(p)
+	if errors.Is(err, errSiteLocked) {
+		owner := "another process"
+		if data, err := os.ReadFile(p); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			owner = "process " + strings.TrimSpace(string(data))
+		}
+		return nil, fmt.Errorf("%s: site is in use by %s; try again when it finishes", p, owner)
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("lock site: %w", err)
+	}
+	// The process ID is only informational, so don't fail if it can't be written.
+	if err = f.Truncate(0); err == nil {
+		_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return func() {
+		_ = f.Close()
+	}, nil
+}
+
+// recordSiteDbVersion remembers which version of the repository's copy of the
+// site's database is current so that storing a new one can detect another
+// operation that stored one in the meantime.
+func (r *Repo) recordSiteDbVersion(site string) error {
+	v, err := r.currentVersion(repofiles.SiteDb(site))
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	r.siteDbVersion = v
+	return nil
+}
+
+// storeSiteDbChecked stores the local database at localRelPath as the
+// repository's copy of the site's database. Like the repository database, the
+// modification time is part of the key, so checking the key and ETag before
+// and after the upload detects an upload by anyone else. This can happen if
+// the same site is used from more than one host.
+func (r *Repo) storeSiteDbChecked(site, localRelPath string) error {
+	repoPath := repofiles.SiteDb(site)
+	current, err := r.currentVersion(repoPath)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if !current.equal(r.siteDbVersion) {
+		// TEST: NOT COVERED. This requires another host to store the database while
+		// this operation is running.
+		return fmt.Errorf(
+			"repository's copy of site database was %s when loaded and is now %s: %w",
+			r.siteDbVersion,
+			current,
+			ErrSiteDbChanged,
+		)
+	}
+	localPath := r.localPath(localRelPath)
+	info, err := localPath.FileInfo()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	err = r.src.Store(localPath, repoPath)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	current, err = r.currentVersion(repoPath)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if current == nil || current.key != r.src.KeyFromPath(repoPath, info) {
+		// TEST: NOT COVERED. This requires a concurrent upload from another host.
+		return fmt.Errorf(
+			"another operation uploaded site database %s at the same time: %w",
+			current,
+			ErrSiteDbChanged,
+		)
+	}
+	r.siteDbVersion = current
+	return nil
+}
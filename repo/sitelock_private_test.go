@@ -0,0 +1,42 @@
+package repo
+
+import (
+	"errors"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLockSite(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmp, repofiles.Top), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	r := &Repo{localTop: tmp}
+	unlock, err := r.lockSite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmp, repofiles.SiteLock))
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("wrong lock file contents: %q, %v", data, err)
+	}
+	// A second lock, even from the same process, fails while the first is held.
+	_, err = openSiteLock(filepath.Join(tmp, repofiles.SiteLock))
+	if !errors.Is(err, errSiteLocked) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = r.lockSite()
+	if err == nil || !strings.Contains(err.Error(), "site is in use by process "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("wrong error: %v", err)
+	}
+	unlock()
+	unlock, err = r.lockSite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
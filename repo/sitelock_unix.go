@@ -0,0 +1,29 @@
+//go:build !windows
+
+package repo
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openSiteLock opens the lock file at p and locks it for exclusive use. It
+// returns errSiteLocked if another process holds the lock. The lock is
+// released when the file is closed or the process exits.
+func openSiteLock(p string) (*os.File, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errSiteLocked
+		}
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package repo
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, which the syscall package
+// doesn't define.
+const errorSharingViolation = syscall.Errno(32)
+
+// openSiteLock opens the lock file at p and locks it for exclusive use. It
+// returns errSiteLocked if another process holds the lock. Windows has no
+// flock, so the file is opened without allowing anyone else to write it, which
+// has the same effect. The lock is released when the file is closed or the
+// process exits.
+func openSiteLock(p string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(
+		name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ,
+		nil,
+		syscall.OPEN_ALWAYS,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0,
+	)
+	if errors.Is(err, errorSharingViolation) {
+		return nil, errSiteLocked
+	} else if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(h), p), nil
+}
@@ -0,0 +1,360 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// SiteInfo describes a site known to the repository.
+type SiteInfo struct {
+	Name string
+	// HasDb and HasFilter indicate whether the repository has the site's database
+	// and filter.
+	HasDb     bool
+	HasFilter bool
+	// LastPush is the time of the site's last push that changed the repository.
+	// It is zero if the repository has no record of one.
+	LastPush time.Time
+	// Current is true for the local site.
+	Current bool
+}
+
+// Sites returns the sites that have a database or filter in the repository
+// sorted by name.
+func (r *Repo) Sites() ([]*SiteInfo, error) {
+	err := r.loadRepoDb()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	current, _ := r.currentSite()
+	sites := map[string]*SiteInfo{}
+	get := func(name string) *SiteInfo {
+		if sites[name] == nil {
+			sites[name] = &SiteInfo{Name: name, Current: name == current}
+		}
+		return sites[name]
+	}
+
+	names, err := r.SiteNames()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	for _, name := range names {
+		get(name).HasDb = true
+	}
+	for p := range r.repoDb {
+		if name, ok := siteName(p, repofiles.SiteFilter("")); ok {
+			get(name).HasFilter = true
+		}
+	}
+
+	// Each push that changes the repository stores a new version of the
+	// repository database tagged with the site that pushed it. getVersions replaces
+	// the source, so keep the one that is backed by the repository database.
+	src := r.src
+	files, err := r.getVersions(repofiles.RepoDb(), &ListVersionsConfig{})
+	r.src = src
+	if err != nil {
+		return nil, err
+	}
+	versions := files[repofiles.RepoDb()]
+	if err = r.getVersionSites(map[string][]*versionData{repofiles.RepoDb(): versions}); err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	for _, v := range versions {
+		if s, ok := sites[v.site]; ok && s.LastPush.IsZero() {
+			s.LastPush = v.lastModified
+		}
+	}
+
+	var result []*SiteInfo
+	for _, name := range misc.SortedKeys(sites) {
+		result = append(result, sites[name])
+	}
+	return result, nil
+}
+
+// SiteNames returns the names of the sites that have a database in the
+// repository sorted by name. Unlike Sites, it only lists the site databases, so
+// it is fast enough to use for command-line completion.
+func (r *Repo) SiteNames() ([]string, error) {
+	src, err := s3source.New(
+		r.bucket,
+		r.prefix,
+		s3source.WithS3Client(r.s3Client),
+		s3source.WithContext(r.ctx),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	// Site databases aren't in the repository database, so list them.
+	names := map[string]bool{}
+	prefix := path.Join(r.prefix, path.Dir(repofiles.RepoDb())) + "/"
+	paginator := s3.NewListObjectsV2Paginator(r.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &r.bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(r.ctx)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("list s3://%s/%s: %w", r.bucket, prefix, err)
+		}
+		for _, object := range page.Contents {
+			info := src.KeyToFileInfo(*object.Key, *object.Size)
+			if info == nil {
+				continue
+			}
+			if name, ok := siteName(info.Path, repofiles.SiteDb("")); ok {
+				names[name] = true
+			}
+		}
+	}
+	return misc.SortedKeys(names), nil
+}
+
+// siteName returns the site name from the path of a site's database or filter
+// given the directory prefix. The repository's own database and filter are not
+// sites.
+func siteName(p string, dirPrefix string) (string, bool) {
+	name, found := strings.CutPrefix(p, dirPrefix)
+	if !found || name == "" || name == repofiles.RepoSite || strings.Contains(name, "/") {
+		return "", false
+	}
+	if name == path.Base(repofiles.RepoShards) {
+		// The shards of the repository database are stored here.
+		return "", false
+	}
+	return name, true
+}
+
+// RemoveSite removes a site's database and filter from the repository after
+// confirmation. Other sites remove their copies of the filter when they pull.
+// The local site can't be removed.
+func (r *Repo) RemoveSite(name string) error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	if _, ok := siteName(repofiles.SiteDb(name), repofiles.SiteDb("")); !ok {
+		return fmt.Errorf("\"%s\" is not a valid site name", name)
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		return err
+	}
+	if name == site {
+		return fmt.Errorf("%s is the current site and can't be removed", name)
+	}
+	if err := r.checkProtected("remove site " + name); err != nil {
+		return err
+	}
+	sites, err := r.Sites()
+	if err != nil {
+		return err
+	}
+	var info *SiteInfo
+	for _, s := range sites {
+		if s.Name == name {
+			info = s
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("the repository has no database or filter for site %s", name)
+	}
+	err = r.checkBusy()
+	if err != nil {
+		return err
+	}
+	var toRemove []string
+	if info.HasDb {
+		toRemove = append(toRemove, repofiles.SiteDb(name))
+	}
+	if info.HasFilter {
+		toRemove = append(toRemove, repofiles.SiteFilter(name))
+	}
+	for _, p := range toRemove {
+		_, _ = fmt.Fprintf(r.ui.Output(), "rm %s\n", p)
+	}
+	if !r.ui.Prompt(fmt.Sprintf("Remove site %s from the repository?", name)) {
+		return fmt.Errorf("exiting")
+	}
+
+	err = r.createBusy(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	defer r.stopHeartbeat()
+	r.tagUploads(site)
+	err = r.checkRepoDbUnchanged()
+	if err != nil {
+		// TEST: NOT COVERED
+		_ = r.removeBusy()
+		return err
+	}
+	r.detachContext()
+	for _, p := range toRemove {
+		r.ui.Message("removing %s", p)
+		// Removing the filter also removes it from the repository database.
+		if err = r.src.Remove(p); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	if info.HasFilter {
+		err = r.updateRepoDb()
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		// Otherwise, the next push would store the filter again.
+		err = r.localPath(repofiles.SiteFilter(name)).Remove()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	err = r.audit("remove-site", site, map[string]int{"removed": len(toRemove)}, "removed site "+name)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	err = r.removeBusy()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return nil
+}
+
+// CopySiteConfig is passed to CopySite.
+type CopySiteConfig struct {
+	// FilterOnly copies only the filter, so the new site pulls everything as a
+	// new site would.
+	FilterOnly bool
+}
+
+// CopySite gives the site newName a copy of oldName's filter and database in
+// the repository. The objects are copied within S3. This lets a site on a
+// replacement computer to which the old site's files have been moved start
+// where the old site left off. The new site must not already be known to the
+// repository.
+func (r *Repo) CopySite(oldName, newName string, config *CopySiteConfig) error {
+	if err := r.checkReadOnly(); err != nil {
+		return err
+	}
+	for _, name := range []string{oldName, newName} {
+		if _, ok := siteName(repofiles.SiteDb(name), repofiles.SiteDb("")); !ok {
+			return fmt.Errorf("\"%s\" is not a valid site name", name)
+		}
+	}
+	if oldName == newName {
+		return fmt.Errorf("can't copy site %s to itself", oldName)
+	}
+	site, err := r.currentSite()
+	if err != nil {
+		return err
+	}
+	sites, err := r.Sites()
+	if err != nil {
+		return err
+	}
+	var info *SiteInfo
+	for _, s := range sites {
+		switch s.Name {
+		case oldName:
+			info = s
+		case newName:
+			return fmt.Errorf("the repository already has a database or filter for site %s", newName)
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("the repository has no database or filter for site %s", oldName)
+	}
+	if config.FilterOnly && !info.HasFilter {
+		return fmt.Errorf("the repository has no filter for site %s", oldName)
+	}
+	err = r.checkBusy()
+	if err != nil {
+		return err
+	}
+	type toCopy struct {
+		from, to string
+	}
+	var copies []toCopy
+	if info.HasDb && !config.FilterOnly {
+		copies = append(copies, toCopy{repofiles.SiteDb(oldName), repofiles.SiteDb(newName)})
+	}
+	if info.HasFilter {
+		copies = append(copies, toCopy{repofiles.SiteFilter(oldName), repofiles.SiteFilter(newName)})
+	}
+
+	err = r.createBusy(site)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	defer r.stopHeartbeat()
+	r.tagUploads(site)
+	err = r.checkRepoDbUnchanged()
+	if err != nil {
+		// TEST: NOT COVERED
+		_ = r.removeBusy()
+		return err
+	}
+	r.detachContext()
+	for _, c := range copies {
+		r.ui.Message("copying %s to %s", c.from, c.to)
+		// Copying the filter also adds it to the repository database.
+		if err = r.src.Copy(c.from, c.to); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	if info.HasFilter {
+		err = r.updateRepoDb()
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		// The local copy of the repository database now has the filter, so keep a
+		// local copy of it as well. Otherwise, the next push would remove it.
+		_, err = fileinfo.Retrieve(
+			fileinfo.NewPath(r.src, repofiles.SiteFilter(newName)),
+			r.localPath(repofiles.SiteFilter(newName)),
+		)
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	err = r.audit(
+		"copy-site",
+		site,
+		map[string]int{"copied": len(copies)},
+		fmt.Sprintf("copied site %s to %s", oldName, newName),
+	)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	err = r.removeBusy()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return nil
+}
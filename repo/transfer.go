@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+)
+
+// TransferEstimate gives the number and total size of the regular files that
+// applying a diff copies between the site and the repository. Renamed files
+// are moved or copied within S3 rather than transferred, so they aren't
+// counted. The estimate doesn't include the databases qfs uploads and
+// downloads.
+type TransferEstimate struct {
+	AddedFiles   int
+	AddedBytes   int64
+	ChangedFiles int
+	ChangedBytes int64
+}
+
+// estimateTransfer estimates the transfer for diffResult. If rekey is true,
+// changed files are copied within S3, as with PushConfig.MetadataOnly, and
+// aren't counted.
+func estimateTransfer(diffResult *diff.Result, rekey bool) *TransferEstimate {
+	e := &TransferEstimate{}
+	for _, f := range diffResult.Add {
+		if f.FileType == fileinfo.TypeFile {
+			e.AddedFiles++
+			e.AddedBytes += f.Size
+		}
+	}
+	if !rekey {
+		for _, f := range diffResult.Change {
+			if f.FileType == fileinfo.TypeFile {
+				e.ChangedFiles++
+				e.ChangedBytes += f.Size
+			}
+		}
+	}
+	return e
+}
+
+func (e *TransferEstimate) Bytes() int64 {
+	return e.AddedBytes + e.ChangedBytes
+}
+
+func (e *TransferEstimate) String() string {
+	files := func(n int) string {
+		if n == 1 {
+			return "1 file"
+		}
+		return fmt.Sprintf("%d files", n)
+	}
+	return fmt.Sprintf(
+		"%s (added: %s in %s; changed: %s in %s)",
+		misc.FormatSize(e.Bytes()),
+		misc.FormatSize(e.AddedBytes),
+		files(e.AddedFiles),
+		misc.FormatSize(e.ChangedBytes),
+		files(e.ChangedFiles),
+	)
+}
+
+// checkTransfer reports the estimated transfer for diffResult and returns an
+// error if it is larger than maxTransfer, which is ignored if it is zero.
+// direction is "upload" or "download".
+func (r *Repo) checkTransfer(
+	estimate *TransferEstimate,
+	direction string,
+	maxTransfer int64,
+) error {
+	r.ui.Message("to %s: %s", direction, estimate)
+	if maxTransfer > 0 && estimate.Bytes() > maxTransfer {
+		return fmt.Errorf(
+			"%s to %s is more than the maximum transfer of %s",
+			misc.FormatSize(estimate.Bytes()),
+			direction,
+			misc.FormatSize(maxTransfer),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"testing"
+)
+
+func TestEstimateTransfer(t *testing.T) {
+	file := func(path string, size int64) *fileinfo.FileInfo {
+		return &fileinfo.FileInfo{Path: path, FileType: fileinfo.TypeFile, Size: size}
+	}
+	diffResult := &diff.Result{
+		Add: []*fileinfo.FileInfo{
+			file("a", 1000),
+			file("b", 2048),
+			{Path: "d", FileType: fileinfo.TypeDirectory, Size: 4096},
+			{Path: "l", FileType: fileinfo.TypeLink, Size: 10},
+		},
+		Change: []*fileinfo.FileInfo{file("c", 3<<20)},
+		Rename: []*diff.Rename{{Old: file("e", 5000), New: file("f", 5000)}},
+	}
+	e := estimateTransfer(diffResult, false)
+	if e.Bytes() != 3048+3<<20 {
+		t.Errorf("wrong total: %d", e.Bytes())
+	}
+	if s := e.String(); s != "3.0M (added: 3.0K in 2 files; changed: 3.0M in 1 file)" {
+		t.Errorf("wrong string: %s", s)
+	}
+	e = estimateTransfer(diffResult, true)
+	if e.ChangedFiles != 0 || e.Bytes() != 3048 {
+		t.Errorf("wrong estimate with rekey: %#v", e)
+	}
+}
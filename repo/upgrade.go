@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"github.com/jberkenbilt/qfs/s3source"
+	"strings"
+)
+
+type UpgradeConfig struct {
+	// NoOp reports what would be rewritten without changing anything.
+	NoOp bool
+}
+
+// upgradeObject is an object whose key is rewritten by Upgrade.
+type upgradeObject struct {
+	obj    *replicaObject
+	newKey string
+}
+
+// Upgrade rewrites the key of every object in the repository as a version 2
+// key using server-side copies and records the new version in the header of
+// the repository database, which versions of qfs that only know about version
+// 1 keys can't read. The old keys are removed once the new database has been
+// stored. If Upgrade is interrupted, the repository is still usable with the
+// old keys, and it can be run again.
+func (r *Repo) Upgrade(config *UpgradeConfig) error {
+	if !config.NoOp {
+		if err := r.checkReadOnly(); err != nil {
+			return err
+		}
+	}
+	err := r.loadRepoDb()
+	if err != nil {
+		return err
+	}
+	if !r.initialized {
+		return errors.New("repository is not initialized")
+	}
+	if r.keyVersion >= s3source.KeyVersion2 {
+		r.ui.Message("the repository already uses version %d keys", r.keyVersion)
+		return nil
+	}
+	objects, err := r.replicaObjects(false)
+	if err != nil {
+		return err
+	}
+	// The repository database and its shards are stored again with new keys
+	// rather than copied.
+	var toCopy []*upgradeObject
+	var oldKeys []string
+	var size int64
+	for _, obj := range objects {
+		if r.src.KeyVersionOf(obj.key) != s3source.KeyVersion1 {
+			continue
+		}
+		oldKeys = append(oldKeys, obj.key)
+		info := r.src.KeyToFileInfo(obj.key, obj.size)
+		if info.Path == repofiles.RepoDb() || strings.HasPrefix(info.Path, repofiles.RepoShards+"/") {
+			continue
+		}
+		toCopy = append(toCopy, &upgradeObject{
+			obj:    obj,
+			newKey: r.src.KeyForVersion(info.Path, info, s3source.KeyVersion2),
+		})
+		size += obj.size
+	}
+	if config.NoOp {
+		for _, x := range toCopy {
+			_, _ = fmt.Fprintf(r.ui.Output(), "%s -> %s\n", x.obj.key, x.newKey)
+		}
+		r.ui.Message(
+			"upgrading requires %d copies of %s within S3 and %d deletions",
+			len(toCopy),
+			misc.FormatSize(size),
+			len(oldKeys),
+		)
+		return nil
+	}
+
+	site, _ := r.currentSite()
+	err = r.createBusy(site)
+	if err != nil {
+		return err
+	}
+	defer r.stopHeartbeat()
+	c := make(chan *upgradeObject, numWorkers)
+	go func() {
+		for _, x := range toCopy {
+			c <- x
+		}
+		close(c)
+	}()
+	var allErrors []error
+	misc.DoConcurrently(
+		func(c chan *upgradeObject, errorChan chan error) {
+			for x := range c {
+				if r.ctx.Err() != nil {
+					continue
+				}
+				if err := r.replicate(x.obj, r.bucket, x.newKey); err != nil {
+					errorChan <- err
+					continue
+				}
+				r.ui.Message("rewrote %s", misc.RemovePrefix(x.newKey, r.prefix))
+			}
+		},
+		func(e error) {
+			allErrors = append(allErrors, e)
+		},
+		c,
+		numWorkers,
+	)
+	if err := r.ctx.Err(); err != nil {
+		allErrors = append(allErrors, fmt.Errorf("upgrade interrupted: %w", err))
+	}
+	if len(allErrors) > 0 {
+		// Nothing refers to the new keys yet, so the repository is unchanged.
+		_ = r.removeBusy()
+		return errors.Join(allErrors...)
+	}
+
+	r.keyVersion = s3source.KeyVersion2
+	err = r.newRepoSource()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	err = r.updateRepoDb()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	err = r.src.RemoveKeys(oldKeys)
+	if err != nil {
+		// TEST: NOT COVERED. The old keys are ignored, and clean-repo removes them.
+		r.ui.Message("unable to remove old keys: %v", err)
+	}
+	r.ui.Message("the repository now uses version %d keys", r.keyVersion)
+	err = r.audit("upgrade-repo", site, map[string]int{"rewritten": len(toCopy)}, "")
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return r.removeBusy()
+}
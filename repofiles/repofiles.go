@@ -1,14 +1,42 @@
 package repofiles
 
+import "strings"
+
 const (
 	RepoSite   = "repo"
 	Top        = ".qfs"
 	Filters    = ".qfs/filters"
+	Groups     = ".qfs/filters/groups"
 	RepoConfig = ".qfs/repo"
 	Site       = ".qfs/site"
 	Busy       = ".qfs/busy"
 	Push       = ".qfs/push"
 	Pull       = ".qfs/pull"
+	Trash      = ".qfs/trash"
+	Symlinks   = ".qfs/symlinks"
+	Config     = ".qfs/config"
+	Content    = ".qfs/content"
+	Retention  = ".qfs/retention"
+	Quota      = ".qfs/quota"
+	Audit      = ".qfs/audit"
+	AuditLog   = ".qfs/audit.log"
+	Hooks      = ".qfs/hooks"
+	ReadOnly   = ".qfs/readonly"
+	Canary     = ".qfs/canary"
+	Protected  = ".qfs/protected"
+	Stage      = ".qfs/stage"
+	SiteLock   = ".qfs/lock"
+	PathMap    = ".qfs/pathmap"
+	// RepoShards holds the shards of a sharded repository database and, at a
+	// site, the local copy of its index.
+	RepoShards     = ".qfs/db/repo.d"
+	RepoShardIndex = ".qfs/db/repo.d/index"
+	// RepoDbVersion records the version of the newest local copy of the
+	// repository database.
+	RepoDbVersion = ".qfs/db/repo.version"
+	// RepoDbHead is the object that sites write before replacing the repository
+	// database so that two sites can't replace it at the same time.
+	RepoDbHead = ".qfs/db/repo.head"
 )
 
 func SiteDb(site string) string {
@@ -19,6 +47,10 @@ func RepoDb() string {
 	return SiteDb(RepoSite)
 }
 
+func RepoShard(shard string) string {
+	return RepoShards + "/" + shard
+}
+
 func TempSiteDb(site string) string {
 	return ".qfs/db/" + site + ".tmp"
 }
@@ -30,3 +62,22 @@ func TempRepoDb() string {
 func SiteFilter(site string) string {
 	return ".qfs/filters/" + site
 }
+
+// LocalFilterSuffix marks files and directories in .qfs/filters that are kept
+// only at the site where they are created.
+const LocalFilterSuffix = ".local"
+
+// IsLocalFilter returns true if relPath is in .qfs/filters but is kept only at
+// the site because it or a directory containing it ends with LocalFilterSuffix.
+func IsLocalFilter(relPath string) bool {
+	rest, ok := strings.CutPrefix(relPath, Filters+"/")
+	if !ok {
+		return false
+	}
+	for _, element := range strings.Split(rest, "/") {
+		if strings.HasSuffix(element, LocalFilterSuffix) {
+			return true
+		}
+	}
+	return false
+}
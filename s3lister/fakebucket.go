@@ -10,7 +10,8 @@ import (
 )
 
 type fakeListClient struct {
-	objects []types.Object
+	objects  []types.Object
+	versions []*fakeVersion
 }
 
 // ListObjectsV2 does not fully emulate the real one. It just returns enough
@@ -75,3 +76,103 @@ func (b *fakeListClient) ListObjectsV2(
 func (b *fakeListClient) addObjects(objects ...types.Object) {
 	b.objects = append(b.objects, objects...)
 }
+
+// fakeVersion is a version or delete marker in a fakeListClient.
+type fakeVersion struct {
+	version      *types.ObjectVersion
+	deleteMarker *types.DeleteMarkerEntry
+}
+
+func (v *fakeVersion) key() string {
+	if v.version != nil {
+		return *v.version.Key
+	}
+	return *v.deleteMarker.Key
+}
+
+func (v *fakeVersion) versionId() string {
+	if v.version != nil {
+		return *v.version.VersionId
+	}
+	return *v.deleteMarker.VersionId
+}
+
+// ListObjectVersions, like ListObjectsV2, only emulates enough for testing.
+// Versions of a key are returned in the order in which they were added.
+func (b *fakeListClient) ListObjectVersions(
+	_ context.Context,
+	input *s3.ListObjectVersionsInput,
+	_ ...func(*s3.Options),
+) (*s3.ListObjectVersionsOutput, error) {
+	maxKeys := int32(1000)
+	if input.MaxKeys != nil && *input.MaxKeys > 0 && *input.MaxKeys < 1000 {
+		maxKeys = *input.MaxKeys
+	}
+	start := 0
+	if input.KeyMarker != nil {
+		marker := *input.KeyMarker
+		if input.VersionIdMarker == nil {
+			start = sort.Search(len(b.versions), func(i int) bool {
+				return b.versions[i].key() > marker
+			})
+		} else {
+			start = sort.Search(len(b.versions), func(i int) bool {
+				return b.versions[i].key() >= marker
+			})
+			for start < len(b.versions) && b.versions[start].key() == marker {
+				start++
+				if b.versions[start-1].versionId() == *input.VersionIdMarker {
+					break
+				}
+			}
+		}
+	}
+	result := &s3.ListObjectVersionsOutput{
+		Name:        input.Bucket,
+		Prefix:      input.Prefix,
+		KeyMarker:   input.KeyMarker,
+		MaxKeys:     aws.Int32(maxKeys),
+		IsTruncated: aws.Bool(false),
+	}
+	var count int32
+	var last *fakeVersion
+	for _, v := range b.versions[start:] {
+		if input.Prefix != nil && !strings.HasPrefix(v.key(), *input.Prefix) {
+			continue
+		}
+		if count == maxKeys {
+			result.IsTruncated = aws.Bool(true)
+			result.NextKeyMarker = aws.String(last.key())
+			result.NextVersionIdMarker = aws.String(last.versionId())
+			break
+		}
+		if v.version != nil {
+			result.Versions = append(result.Versions, *v.version)
+		} else {
+			result.DeleteMarkers = append(result.DeleteMarkers, *v.deleteMarker)
+		}
+		count++
+		last = v
+	}
+	return result, nil
+}
+
+func (b *fakeListClient) addVersions(versions ...types.ObjectVersion) {
+	for i := range versions {
+		b.versions = append(b.versions, &fakeVersion{version: &versions[i]})
+	}
+	b.sortVersions()
+}
+
+func (b *fakeListClient) addDeleteMarkers(deleteMarkers ...types.DeleteMarkerEntry) {
+	for i := range deleteMarkers {
+		b.versions = append(b.versions, &fakeVersion{deleteMarker: &deleteMarkers[i]})
+	}
+	b.sortVersions()
+}
+
+func (b *fakeListClient) sortVersions() {
+	sort.SliceStable(b.versions, func(i, j int) bool {
+		return b.versions[i].key() < b.versions[j].key()
+	})
+}
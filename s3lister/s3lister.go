@@ -69,32 +69,64 @@ func WithS3Client(s3Client s3.ListObjectsV2APIClient) func(*Lister) {
 }
 
 func KeyUpperBound(ctx context.Context, bucketName string, s3Client s3.ListObjectsV2APIClient) (string, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket:     &bucketName,
-		MaxKeys:    aws.Int32(1),
-		StartAfter: aws.String(""),
-	}
+	return keyUpperBound(bucketName, func(after string) (bool, error) {
+		output, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:     &bucketName,
+			MaxKeys:    aws.Int32(1),
+			StartAfter: aws.String(after),
+		})
+		if err != nil {
+			return false, err
+		}
+		return len(output.Contents) > 0, nil
+	})
+}
+
+// VersionKeyUpperBound is like KeyUpperBound but also considers keys that have
+// only noncurrent versions or delete markers.
+func VersionKeyUpperBound(
+	ctx context.Context,
+	bucketName string,
+	s3Client s3.ListObjectVersionsAPIClient,
+) (string, error) {
+	return keyUpperBound(bucketName, func(after string) (bool, error) {
+		output, err := s3Client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+			Bucket:    &bucketName,
+			MaxKeys:   aws.Int32(1),
+			KeyMarker: aws.String(after),
+		})
+		if err != nil {
+			return false, err
+		}
+		return len(output.Versions) > 0 || len(output.DeleteMarkers) > 0, nil
+	})
+}
+
+// keyUpperBound finds a key that is after every key in the bucket using
+// anyAfter, which reports whether there are any keys after the given one.
+func keyUpperBound(bucketName string, anyAfter func(string) (bool, error)) (string, error) {
+	after := ""
 	for {
-		switch *input.StartAfter {
+		switch after {
 		case "":
-			input.StartAfter = aws.String("~")
+			after = "~"
 		case "~":
-			input.StartAfter = aws.String("\u0100")
+			after = "\u0100"
 		case "\U00100000":
-			input.StartAfter = aws.String("\U0010FFFF")
+			after = "\U0010FFFF"
 		case "\U0010FFFF":
 			return "", fmt.Errorf("can't handle keys lexically after U+0010FFFF")
 		default:
-			t := []rune(*input.StartAfter)[0]
+			t := []rune(after)[0]
 			t *= 2
-			input.StartAfter = aws.String(string([]rune{t}))
+			after = string([]rune{t})
 		}
-		output, err := s3Client.ListObjectsV2(ctx, input)
+		found, err := anyAfter(after)
 		if err != nil {
 			return "", fmt.Errorf("list S3 bucket %s: %w", bucketName, err)
 		}
-		if len(output.Contents) == 0 {
-			return *input.StartAfter, nil
+		if !found {
+			return after, nil
 		}
 	}
 }
@@ -123,7 +155,45 @@ func (l *Lister) List(
 	if err != nil {
 		return err
 	}
+	return l.run(w)
+}
+
+// ListVersions lists all the versions and delete markers in a bucket. For each
+// response to ListObjectVersions, outFn is called with the versions and
+// delete markers in the response. It must handle being called concurrently.
+// Versions of a key may be split across calls. The lister's S3 client must
+// support ListObjectVersions.
+func (l *Lister) ListVersions(
+	ctx context.Context,
+	input *s3.ListObjectVersionsInput,
+	outFn func([]types.ObjectVersion, []types.DeleteMarkerEntry),
+	options ...func(*s3.Options),
+) error {
+	s3Client, ok := l.s3Client.(s3.ListObjectVersionsAPIClient)
+	if !ok {
+		return errors.New("the S3 client doesn't support ListObjectVersions")
+	}
+	upperBound, err := VersionKeyUpperBound(ctx, *input.Bucket, s3Client)
+	if err != nil {
+		return err
+	}
+	w, err := newWorker(workerConfig{
+		Logger:            l.logger,
+		InitialUpperBound: upperBound,
+		Ctx:               ctx,
+		VersionsClient:    s3Client,
+		VersionsInput:     input,
+		VersionsOutputFn:  outFn,
+		S3Options:         options,
+	})
+	if err != nil {
+		return err
+	}
+	return l.run(w)
+}
 
+// run runs up to l.threads nodes of w at a time until the listing is done.
+func (l *Lister) run(w *worker) error {
 	c := make(chan error, 2*l.threads)
 	w.run(c)
 	active := 1
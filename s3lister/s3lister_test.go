@@ -7,7 +7,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"maps"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -96,3 +98,63 @@ func TestLister(t *testing.T) {
 		}
 	}
 }
+
+func TestListVersions(t *testing.T) {
+	// Give each key a few versions, some of them delete markers, and make sure we
+	// get every version exactly once even when a page ends partway through a key's
+	// versions.
+	b := &fakeListClient{}
+	exp := map[string]int{}
+	var versions []types.ObjectVersion
+	var deleteMarkers []types.DeleteMarkerEntry
+	for i := 0; i < 30000; i++ {
+		k := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%d", i))))
+		for j := 0; j <= i%3; j++ {
+			v := fmt.Sprintf("%s/%d", k, j)
+			exp[v] = 1
+			if j == 1 {
+				deleteMarkers = append(deleteMarkers, types.DeleteMarkerEntry{Key: aws.String(k), VersionId: aws.String(v)})
+			} else {
+				versions = append(versions, types.ObjectVersion{Key: aws.String(k), VersionId: aws.String(v)})
+			}
+		}
+	}
+	// A key with only a delete marker after all the others must still be found.
+	deleteMarkers = append(deleteMarkers, types.DeleteMarkerEntry{Key: aws.String("~deleted"), VersionId: aws.String("x")})
+	exp["x"] = 1
+	b.addVersions(versions...)
+	b.addDeleteMarkers(deleteMarkers...)
+
+	var mutex sync.Mutex
+	actual := map[string]int{}
+	fn := func(versions []types.ObjectVersion, deleteMarkers []types.DeleteMarkerEntry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, v := range versions {
+			actual[*v.VersionId]++
+		}
+		for _, d := range deleteMarkers {
+			actual[*d.VersionId]++
+		}
+	}
+	lister, err := New(WithThreads(20), WithS3Client(b), WithDebug(false))
+	if err != nil {
+		t.Fatalf("create lister: %v", err)
+	}
+	err = lister.ListVersions(
+		context.Background(),
+		&s3.ListObjectVersionsInput{Bucket: aws.String("any"), MaxKeys: aws.Int32(100)},
+		fn,
+	)
+	if err != nil {
+		t.Errorf("lister failed: %v", err)
+	}
+	if !maps.Equal(actual, exp) {
+		t.Errorf("wrong versions: got %d, expected %d", len(actual), len(exp))
+		for v, n := range actual {
+			if n != 1 {
+				t.Errorf("%s: %d", v, n)
+			}
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package s3lister
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
@@ -20,6 +22,9 @@ type worker struct {
 	upperBound string
 }
 
+// workerConfig configures a worker to list either objects, with S3Client,
+// Input, and OutputFn, or versions, with VersionsClient, VersionsInput, and
+// VersionsOutputFn.
 type workerConfig struct {
 	Logger            *slog.Logger
 	InitialUpperBound string
@@ -28,14 +33,109 @@ type workerConfig struct {
 	Input             s3.ListObjectsV2Input
 	S3Options         []func(*s3.Options)
 	OutputFn          func([]types.Object)
+	VersionsClient    s3.ListObjectVersionsAPIClient
+	VersionsInput     *s3.ListObjectVersionsInput
+	VersionsOutputFn  func([]types.ObjectVersion, []types.DeleteMarkerEntry)
 }
 
 type node struct {
 	w        *worker
 	startKey string // original starting key
 	lastKey  string // the last key read
-	next     *node
-	prev     *node
+	// When listing versions, a page may end partway through a key's versions.
+	// lastVersionId is then the last version read, and lastKey is its key.
+	lastVersionId string
+	next          *node
+	prev          *node
+}
+
+// A page is one response from S3 in a form that doesn't depend on which list
+// operation produced it. keys contains the key of each item in order. If
+// truncated, nextKey and nextVersionId are where the next page starts.
+// output passes the items whose keys are keys[:n] to the output function.
+type page struct {
+	keys          []string
+	truncated     bool
+	nextKey       string
+	nextVersionId string
+	output        func(n int)
+}
+
+// page reads the page that follows the given key and, for versions, version.
+func (w *worker) page(afterKey, afterVersionId string) (*page, error) {
+	if w.config.VersionsInput == nil {
+		input := w.config.Input
+		input.StartAfter = aws.String(afterKey)
+		output, err := w.config.S3Client.ListObjectsV2(w.ctx, &input, w.config.S3Options...)
+		if err != nil {
+			return nil, err
+		}
+		p := &page{
+			truncated: aws.ToBool(output.IsTruncated),
+			output: func(n int) {
+				w.config.OutputFn(output.Contents[:n])
+			},
+		}
+		for _, obj := range output.Contents {
+			p.keys = append(p.keys, *obj.Key)
+		}
+		if len(p.keys) > 0 {
+			p.nextKey = p.keys[len(p.keys)-1]
+		}
+		return p, nil
+	}
+
+	input := *w.config.VersionsInput
+	input.KeyMarker = nil
+	input.VersionIdMarker = nil
+	if afterKey != "" {
+		input.KeyMarker = aws.String(afterKey)
+	}
+	if afterVersionId != "" {
+		input.VersionIdMarker = aws.String(afterVersionId)
+	}
+	output, err := w.config.VersionsClient.ListObjectVersions(w.ctx, &input, w.config.S3Options...)
+	if err != nil {
+		return nil, err
+	}
+	// Versions and delete markers are returned separately, each in key order.
+	// Merge them so that the page can be cut off at a key.
+	type item struct {
+		key      string
+		isDelete bool
+		index    int
+	}
+	var items []item
+	for i, v := range output.Versions {
+		items = append(items, item{key: *v.Key, index: i})
+	}
+	for i, d := range output.DeleteMarkers {
+		items = append(items, item{key: *d.Key, isDelete: true, index: i})
+	}
+	slices.SortStableFunc(items, func(a, b item) int {
+		return cmp.Compare(a.key, b.key)
+	})
+	p := &page{
+		truncated:     aws.ToBool(output.IsTruncated),
+		nextKey:       aws.ToString(output.NextKeyMarker),
+		nextVersionId: aws.ToString(output.NextVersionIdMarker),
+		output: func(n int) {
+			var versions []types.ObjectVersion
+			var deleteMarkers []types.DeleteMarkerEntry
+			for _, x := range items[:n] {
+				if x.isDelete {
+					deleteMarkers = append(deleteMarkers, output.DeleteMarkers[x.index])
+				} else {
+					versions = append(versions, output.Versions[x.index])
+				}
+			}
+			w.config.VersionsOutputFn(versions, deleteMarkers)
+		},
+	}
+	for _, x := range items {
+		p.keys = append(p.keys, x.key)
+	}
+	return p, nil
 }
 
 func newWorker(config workerConfig) (*worker, error) {
@@ -119,19 +219,18 @@ func (n *node) mergeWithNext() {
 
 func (n *node) run(started chan<- struct{}) error {
 	defer close(started)
-	input := n.w.config.Input
 	first := true
 	for {
 		// Read the next page of keys. We will get between 0 and MaxKeys. Truncated
 		// indicates whether we actually reached the end of the bucket. It's possible to
 		// get fewer than MaxKeys even if there are more keys.
 		n.w.mutex.Lock()
-		input.StartAfter = aws.String(n.lastKey)
+		afterKey, afterVersionId := n.lastKey, n.lastVersionId
 		n.w.mutex.Unlock()
-		var output *s3.ListObjectsV2Output
+		var p *page
 		err := retryOnError(n.logger(), "list objects", 3, time.Second, func() error {
 			var err error
-			output, err = n.w.config.S3Client.ListObjectsV2(n.w.ctx, &input, n.w.config.S3Options...)
+			p, err = n.w.page(afterKey, afterVersionId)
 			return err
 		})
 		if err != nil {
@@ -140,35 +239,42 @@ func (n *node) run(started chan<- struct{}) error {
 
 		// Grab objects that are within our range, and detect completion. The mutex must
 		// be locked to prevent other nodes from changing start/end values.
-		var objects []types.Object
+		count := 0
 		reachedEndOfRange := false
 		func() {
 			n.w.mutex.Lock()
 			defer n.w.mutex.Unlock()
 			endKey := n.endKey()
-			for _, obj := range output.Contents {
+			for _, key := range p.keys {
 				if n.startKey == "" {
 					// This is the actual first key. Having it prevents us from bisecting into the
 					// range of non-printable characters.
-					n.startKey = *obj.Key
+					n.startKey = key
 				}
 				if first {
 					first = false
 					started <- struct{}{}
 				}
-				if *obj.Key > endKey {
+				if key > endKey {
 					reachedEndOfRange = true
 					break
 				} else {
-					objects = append(objects, obj)
+					count++
 				}
 			}
-			if len(objects) > 0 {
-				n.lastKey = *objects[len(objects)-1].Key
+			if count > 0 {
+				n.lastKey = p.keys[count-1]
+				n.lastVersionId = ""
 			}
-			if !*output.IsTruncated {
+			if !p.truncated {
 				reachedEndOfRange = true
 			}
+			if !reachedEndOfRange && p.nextVersionId != "" {
+				// There may be more versions of the last key, so resume exactly where this page
+				// stopped.
+				n.lastKey = p.nextKey
+				n.lastVersionId = p.nextVersionId
+			}
 			if reachedEndOfRange {
 				// If we have reached the end of our range and we are the last node, then our
 				// start key is a tighter upper bound for unread keys. Only do this if we are the
@@ -184,6 +290,7 @@ func (n *node) run(started chan<- struct{}) error {
 						n.debug("adjusting start", "new", escapeUnicode(midpoint), "node", n)
 						n.startKey = midpoint
 						n.lastKey = n.startKey
+						n.lastVersionId = ""
 						reachedEndOfRange = false
 					}
 				}
@@ -194,8 +301,8 @@ func (n *node) run(started chan<- struct{}) error {
 				}
 			}
 		}()
-		if len(objects) > 0 {
-			n.w.config.OutputFn(objects)
+		if count > 0 {
+			p.output(count)
 		}
 		if reachedEndOfRange {
 			break
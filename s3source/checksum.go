@@ -0,0 +1,129 @@
+package s3source
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Downloaded contents are checked before they are used. Contents stored by
+// hash are checked against the hash, which requires no extra request. Other
+// objects are checked against the full-object checksum S3 stores with them.
+// Objects uploaded by clients that didn't send checksums have none, and objects
+// uploaded in parts may have only a checksum of the parts' checksums. Those
+// can't be checked.
+
+// objectChecksum returns the algorithm and base64-encoded value of the
+// full-object checksum in output. It returns empty strings if there is none.
+// Checksums of parts' checksums end with -n, where n is the number of parts.
+func objectChecksum(output *s3.HeadObjectOutput) (types.ChecksumAlgorithm, string) {
+	for _, c := range []struct {
+		algorithm types.ChecksumAlgorithm
+		value     *string
+	}{
+		{types.ChecksumAlgorithmSha256, output.ChecksumSHA256},
+		{types.ChecksumAlgorithmSha1, output.ChecksumSHA1},
+		{types.ChecksumAlgorithmCrc32c, output.ChecksumCRC32C},
+		{types.ChecksumAlgorithmCrc32, output.ChecksumCRC32},
+	} {
+		if c.value != nil && *c.value != "" && !strings.Contains(*c.value, "-") {
+			return c.algorithm, *c.value
+		}
+	}
+	return "", ""
+}
+
+func newChecksumHash(algorithm types.ChecksumAlgorithm) hash.Hash {
+	switch algorithm {
+	case types.ChecksumAlgorithmSha256:
+		return sha256.New()
+	case types.ChecksumAlgorithmSha1:
+		return sha1.New()
+	case types.ChecksumAlgorithmCrc32c:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case types.ChecksumAlgorithmCrc32:
+		return crc32.NewIEEE()
+	}
+	return nil
+}
+
+// computeChecksum returns the base64-encoded checksum of r's contents in the
+// form S3 uses for algorithm.
+func computeChecksum(algorithm types.ChecksumAlgorithm, r io.Reader) (string, error) {
+	h := newChecksumHash(algorithm)
+	if h == nil {
+		return "", fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *S3Source) checksumError(key string, algorithm types.ChecksumAlgorithm, exp, actual string) error {
+	return fmt.Errorf(
+		"download s3://%s/%s: %w: expected %s %s, got %s",
+		s.bucket,
+		key,
+		fileinfo.ErrChecksumMismatch,
+		algorithm,
+		exp,
+		actual,
+	)
+}
+
+// checkHash checks size bytes of r at offset, which were downloaded from the
+// given content key, against their SHA-256 hash.
+func (s *S3Source) checkHash(r io.ReaderAt, offset, size int64, key, hash string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, offset, size)); err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("read contents of s3://%s/%s: %w", s.bucket, key, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		return s.checksumError(key, types.ChecksumAlgorithmSha256, hash, actual)
+	}
+	return nil
+}
+
+// checkObjectChecksum checks the contents of f, which were downloaded with
+// input, against the object's checksum in S3 if it has one.
+func (s *S3Source) checkObjectChecksum(input *s3.GetObjectInput, f *os.File) error {
+	output, err := s.s3Client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket:       input.Bucket,
+		Key:          input.Key,
+		VersionId:    input.VersionId,
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return s.objectError("get information about", *input.Key, err)
+	}
+	algorithm, exp := objectChecksum(output)
+	if exp == "" {
+		return nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	actual, err := computeChecksum(algorithm, io.NewSectionReader(f, 0, st.Size()))
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("read contents of s3://%s/%s: %w", s.bucket, *input.Key, err)
+	}
+	if actual != exp {
+		return s.checksumError(*input.Key, algorithm, exp, actual)
+	}
+	return nil
+}
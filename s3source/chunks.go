@@ -0,0 +1,226 @@
+package s3source
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A file stored in chunks has a manifest that lists the hash and size of each
+// chunk in order. The manifest and the chunks are all stored as content, so a
+// chunk that is unchanged from an earlier version of the file, or that appears
+// in another file, is stored only once.
+
+const manifestHeader = "QFS CHUNKS 1\n"
+
+type chunk struct {
+	hash string
+	size int64
+}
+
+func encodeManifest(chunks []chunk) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(manifestHeader)
+	for _, c := range chunks {
+		_, _ = fmt.Fprintf(b, "%s %d\n", c.hash, c.size)
+	}
+	return b.Bytes()
+}
+
+func parseManifest(data []byte) ([]chunk, error) {
+	rest, found := strings.CutPrefix(string(data), manifestHeader)
+	if !found {
+		return nil, errors.New("not a chunk manifest")
+	}
+	var chunks []chunk
+	for _, line := range strings.Split(strings.TrimSuffix(rest, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		hash, sizeStr, _ := strings.Cut(line, " ")
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if !hashRe.MatchString(hash) || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid chunk manifest line \"%s\"", line)
+		}
+		chunks = append(chunks, chunk{hash: hash, size: size})
+	}
+	return chunks, nil
+}
+
+// storeChunks uploads the chunks of a file that are not already in the
+// repository, in the given storage class, followed by its manifest and returns
+// the manifest's hash. The manifest is stored last so that its presence implies
+// that of its chunks.
+func (s *S3Source) storeChunks(localPath *fileinfo.Path, class types.StorageClass) (string, error) {
+	f, err := localPath.Open()
+	if err != nil {
+		// TEST: NOT COVERED
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		// TEST: NOT COVERED
+		return "", fmt.Errorf("%s doesn't support random access", localPath.Path())
+	}
+	// In a sparse file, such as a disk image, a chunk that lies entirely within
+	// a hole is all zeros, so there's no need to read it.
+	osFile, _ := f.(*os.File)
+	var zeroHash string
+	var chunks []chunk
+	var offset int64
+	for {
+		var c chunk
+		if osFile != nil && fileinfo.NextData(osFile, offset) >= offset+s.chunkSize {
+			if zeroHash == "" {
+				h := sha256.New()
+				_, _ = io.CopyN(h, zeroReader{}, s.chunkSize)
+				zeroHash = hex.EncodeToString(h.Sum(nil))
+			}
+			c = chunk{hash: zeroHash, size: s.chunkSize}
+		} else {
+			h := sha256.New()
+			n, err := io.Copy(h, io.NewSectionReader(ra, offset, s.chunkSize))
+			if err != nil {
+				// TEST: NOT COVERED
+				return "", fmt.Errorf("read %s: %w", localPath.Path(), err)
+			}
+			if n == 0 {
+				break
+			}
+			c = chunk{hash: hex.EncodeToString(h.Sum(nil)), size: n}
+		}
+		chunks = append(chunks, c)
+		offset += c.size
+		if c.size < s.chunkSize {
+			break
+		}
+	}
+	manifest := encodeManifest(chunks)
+	sum := sha256.Sum256(manifest)
+	manifestHash := hex.EncodeToString(sum[:])
+	// A chunk that appears more than once, such as a chunk of zeros, is only
+	// uploaded once.
+	stored := map[string]bool{}
+	offset = 0
+	for _, c := range chunks {
+		if !stored[c.hash] {
+			err = s.putContent(c.hash, io.NewSectionReader(ra, offset, c.size), class)
+			if err != nil {
+				return "", err
+			}
+			stored[c.hash] = true
+		}
+		offset += c.size
+	}
+	// The manifest is needed to find the chunks, so it is always readable.
+	err = s.putContent(manifestHash, bytes.NewReader(manifest), "")
+	if err != nil {
+		return "", err
+	}
+	return manifestHash, nil
+}
+
+func (s *S3Source) readManifest(hash string) ([]chunk, error) {
+	key := s.ContentKey(hash)
+	output, err := s.s3Client.GetObject(s.ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get object s3://%s/%s: %w", s.bucket, key, err)
+	}
+	defer func() { _ = output.Body.Close() }()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("read s3://%s/%s: %w", s.bucket, key, err)
+	}
+	chunks, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return chunks, nil
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// offsetWriter writes to w starting at offset.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) WriteAt(p []byte, off int64) (int, error) {
+	return o.w.WriteAt(p, o.offset+off)
+}
+
+// downloadChunks reassembles a chunked file whose manifest has the given hash.
+// Each chunk is checked against its hash after it is downloaded.
+func (s *S3Source) downloadChunks(hash string, f *os.File) error {
+	chunks, err := s.readManifest(hash)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for _, c := range chunks {
+		key := s.ContentKey(c.hash)
+		_, err = s.downloader.Download(s.ctx, &offsetWriter{w: f, offset: offset}, &s3.GetObjectInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return s.objectError("download", key, err)
+		}
+		if err = s.checkHash(f, offset, c.size, key, c.hash); err != nil {
+			return err
+		}
+		offset += c.size
+	}
+	return nil
+}
+
+// openChunks returns a reader that reads the chunks of a chunked file in order.
+func (s *S3Source) openChunks(hash string) (io.ReadCloser, error) {
+	chunks, err := s.readManifest(hash)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		for _, c := range chunks {
+			key := s.ContentKey(c.hash)
+			output, err := s.s3Client.GetObject(s.ctx, &s3.GetObjectInput{
+				Bucket: &s.bucket,
+				Key:    &key,
+			})
+			if err != nil {
+				w.CloseWithError(s.objectError("get object", key, err))
+				return
+			}
+			_, err = io.Copy(w, output.Body)
+			_ = output.Body.Close()
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		_ = w.Close()
+	}()
+	return r, nil
+}
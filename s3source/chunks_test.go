@@ -0,0 +1,209 @@
+package s3source
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of S3 to store and retrieve objects.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	puts    []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	w.Header().Set("Content-Type", "application/xml")
+	switch {
+	case r.URL.Query().Has("list-type"):
+		_, _ = fmt.Fprint(w, "<ListBucketResult></ListBucketResult>")
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		f.puts = append(f.puts, key)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	}
+}
+
+func TestManifest(t *testing.T) {
+	chunks := []chunk{
+		{hash: strings.Repeat("a", 64), size: 4},
+		{hash: strings.Repeat("b", 64), size: 2},
+	}
+	data := encodeManifest(chunks)
+	back, err := parseManifest(data)
+	if err != nil || !reflect.DeepEqual(chunks, back) {
+		t.Errorf("round trip failed: %#v, %v", back, err)
+	}
+	for _, bad := range []string{
+		"potato",
+		manifestHeader + "x 4\n",
+		manifestHeader + strings.Repeat("a", 64) + " -1\n",
+	} {
+		if _, err := parseManifest([]byte(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	s, err := New(
+		"bucket",
+		"prefix",
+		WithS3Client(client),
+		WithDatabase(database.Database{}),
+		WithLayout(LayoutContent),
+		WithChunkSize(4),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmp := t.TempDir()
+	local := fileinfo.NewPath(localsource.New(tmp), "big")
+	contentPuts := func() int {
+		n := 0
+		for _, k := range fake.puts {
+			if strings.HasPrefix(k, "prefix/.qfs/content/") {
+				n++
+			}
+		}
+		fake.puts = nil
+		return n
+	}
+	store := func(data string) *fileinfo.FileInfo {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(tmp, "big"), []byte(data), 0o644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := s.Store(local, "big"); err != nil {
+			t.Fatal(err.Error())
+		}
+		info := s.db["big"]
+		if info == nil || !info.Chunked || info.Size != int64(len(data)) {
+			t.Fatalf("wrong info: %#v", info)
+		}
+		f, err := os.CreateTemp(tmp, "download")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer func() { _ = f.Close() }()
+		if err := s.Download("big", info, f); err != nil {
+			t.Fatal(err.Error())
+		}
+		downloaded, _ := os.ReadFile(f.Name())
+		if string(downloaded) != data {
+			t.Errorf("wrong download: %s", downloaded)
+		}
+		r, err := s.Open("big")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		opened, _ := io.ReadAll(r)
+		_ = r.Close()
+		if string(opened) != data {
+			t.Errorf("wrong contents: %s", opened)
+		}
+		r, err = s.OpenVersion(s.KeyFromPath("big", info), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		opened, _ = io.ReadAll(r)
+		_ = r.Close()
+		if string(opened) != data {
+			t.Errorf("wrong contents from OpenVersion: %s", opened)
+		}
+		return info
+	}
+
+	// Five chunks plus the manifest, with the repeated chunk stored once
+	first := store("0123012389abcdefgh")
+	if n := contentPuts(); n != 5 {
+		t.Errorf("wrong number of content uploads: %d", n)
+	}
+	// Only the changed chunk and the new manifest are uploaded.
+	second := store("0123012389xbcdefgh")
+	if n := contentPuts(); n != 2 {
+		t.Errorf("wrong number of content uploads: %d", n)
+	}
+
+	// Only the first version's manifest and its changed chunk are unreferenced.
+	for key := range fake.objects {
+		if hash := key[strings.LastIndex(key, "/")+1:]; hashRe.MatchString(hash) {
+			s.content[hash] = key
+		}
+	}
+	keys, err := s.UnreferencedContent(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 2 || !strings.Contains(strings.Join(keys, " "), first.Hash) {
+		t.Errorf("wrong unreferenced content: %#v", keys)
+	}
+	if strings.Contains(strings.Join(keys, " "), second.Hash) {
+		t.Errorf("current manifest is unreferenced")
+	}
+	// While a noncurrent version refers to the first manifest, it and its chunks
+	// are kept.
+	keys, err = s.UnreferencedContent(map[string]bool{first.Hash: true})
+	if err != nil || len(keys) != 0 {
+		t.Errorf("wrong unreferenced content: %#v, %v", keys, err)
+	}
+
+	// Contents that don't match the hash they were stored under, as when a file
+	// changes between being hashed and being uploaded, are never stored.
+	sum := sha256.Sum256([]byte("before"))
+	hash := hex.EncodeToString(sum[:])
+	err = s.putContent(hash, strings.NewReader("after!"), "")
+	if !errors.Is(err, ErrContentsChanged) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, ok := fake.objects[s.ContentKey(hash)]; ok {
+		t.Errorf("changed contents were stored")
+	}
+	if err := s.putContent(hash, strings.NewReader("before"), ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(fake.objects[s.ContentKey(hash)]) != "before" {
+		t.Errorf("contents weren't stored")
+	}
+}
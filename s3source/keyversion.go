@@ -0,0 +1,238 @@
+package s3source
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/misc"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The key of each object encodes the file's metadata after the path. Version 1
+// keys have the form path@type,mtime,rest, where the meaning of rest depends on
+// the type, so there is no room to add anything else. Version 2 keys have the
+// form path@2;type;mtime;field;field..., where each field is name=value or just
+// name. Fields that aren't recognized are ignored, so new ones can be added
+// without a new version. A link's target, which may contain anything, is
+// always the last field. Both versions can always be read. Which version is
+// written is recorded in the header of the repository database.
+
+const (
+	KeyVersion1 = 1
+	KeyVersion2 = 2
+)
+
+var path2Re = regexp.MustCompile(`^((?:[^@]|@@)+)@2;([fdl]);(\d+)(?:\.(\d{6}))?((?:;(?:[^@]|@@)*)?)$`)
+
+// targetField is the name of the field that holds a link's target.
+const targetField = "target"
+
+// WithKeyVersion sets the version of the keys that are created for new
+// objects. If it is not given, the source uses the version of the keys it has
+// already seen, so it is only needed when the source doesn't look at existing
+// keys before storing objects, as when it is given a database.
+func WithKeyVersion(version int) func(*S3Source) {
+	return func(s *S3Source) {
+		s.keyVersion = version
+	}
+}
+
+// KeyVersionOf returns the version of a key or 0 if it isn't a key qfs would
+// create for a file.
+func (s *S3Source) KeyVersionOf(key string) int {
+	if s.KeyToFileInfo(key, 0) == nil {
+		return 0
+	}
+	if path2Re.MatchString(misc.RemovePrefix(key, s.prefix)) {
+		return KeyVersion2
+	}
+	return KeyVersion1
+}
+
+// KeyForVersion is like KeyFromPath but always creates a key of the given
+// version.
+func (s *S3Source) KeyForVersion(path string, fi *fileinfo.FileInfo, version int) string {
+	key := s.keyPrefix() + strings.Replace(path, "@", "@@", -1) + "@"
+	if fi == nil {
+		return key
+	}
+	if version >= KeyVersion2 {
+		return key + keySuffix2(fi)
+	}
+	return key + keySuffix1(fi)
+}
+
+// keyPrefix returns what precedes the escaped path in each key.
+func (s *S3Source) keyPrefix() string {
+	if s.prefix == "" {
+		return ""
+	}
+	return s.prefix + "/"
+}
+
+// newKeyVersion returns the version of the key to use for fi at path. If the
+// key of an existing object for fi was found by listing, that key's version is
+// used so that the object can be found.
+func (s *S3Source) newKeyVersion(path string, fi *fileinfo.FileInfo) int {
+	if s.keyVersion != 0 {
+		return s.keyVersion
+	}
+	s.keyMutex.Lock()
+	listed := s.listedKeys[path]
+	s.keyMutex.Unlock()
+	if listed != "" {
+		for _, v := range []int{KeyVersion1, KeyVersion2} {
+			if listed == s.KeyForVersion(path, fi, v) {
+				return v
+			}
+		}
+	}
+	return s.KeyVersion()
+}
+
+// KeyVersion returns the version of the keys the source creates for new
+// objects.
+func (s *S3Source) KeyVersion() int {
+	if s.keyVersion != 0 {
+		return s.keyVersion
+	}
+	return max(int(s.seenKeyVersion.Load()), KeyVersion1)
+}
+
+// noteListedKey records that key was found in S3 for path.
+func (s *S3Source) noteListedKey(path, key string) {
+	s.keyMutex.Lock()
+	defer s.keyMutex.Unlock()
+	if s.listedKeys == nil {
+		s.listedKeys = map[string]string{}
+	}
+	s.listedKeys[path] = key
+}
+
+// noteKeyVersion records that a key of the given version was seen.
+func (s *S3Source) noteKeyVersion(version int) {
+	for {
+		seen := s.seenKeyVersion.Load()
+		if int(seen) >= version || s.seenKeyVersion.CompareAndSwap(seen, int32(version)) {
+			return
+		}
+	}
+}
+
+func keyMtime(t time.Time) string {
+	mtime := strconv.FormatInt(t.UnixMilli(), 10)
+	if fileinfo.SubMillisecond(t) {
+		mtime += fmt.Sprintf(".%06d", t.Nanosecond()%int(time.Millisecond))
+	}
+	return mtime
+}
+
+func keySuffix1(fi *fileinfo.FileInfo) string {
+	var rest string
+	if fi.FileType == fileinfo.TypeLink {
+		rest = strings.Replace(fi.Special, "@", "@@", -1)
+	} else if fi.FileType == fileinfo.TypeFile && fi.Hash != "" {
+		rest = fmt.Sprintf("%04o,%d,%s", fi.Permissions, fi.Size, fi.Hash)
+		if fi.Chunked {
+			rest += ",chunked"
+		}
+	} else {
+		rest = fmt.Sprintf("%04o", fi.Permissions)
+	}
+	return fmt.Sprintf("%c,%s,%s", fi.FileType, keyMtime(fi.ModTime), rest)
+}
+
+func keySuffix2(fi *fileinfo.FileInfo) string {
+	key := fmt.Sprintf("2;%c;%s", fi.FileType, keyMtime(fi.ModTime))
+	if fi.FileType == fileinfo.TypeLink {
+		return key + ";" + targetField + "=" + strings.Replace(fi.Special, "@", "@@", -1)
+	}
+	key += fmt.Sprintf(";mode=%04o", fi.Permissions)
+	if fi.FileType == fileinfo.TypeFile && fi.Hash != "" {
+		key += fmt.Sprintf(";size=%d;hash=%s", fi.Size, fi.Hash)
+		if fi.Chunked {
+			key += ";chunked"
+		}
+	}
+	return key
+}
+
+// keyFields splits the fields of a version 2 key, each of which is preceded
+// by a semicolon.
+func keyFields(s string) map[string]string {
+	fields := map[string]string{}
+	s = strings.TrimPrefix(s, ";")
+	for s != "" {
+		var field string
+		if strings.HasPrefix(s, targetField+"=") {
+			field, s = s, ""
+		} else {
+			field, s, _ = strings.Cut(s, ";")
+		}
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	return fields
+}
+
+// keyToFileInfo2 is KeyToFileInfo for the submatches of path2Re.
+func keyToFileInfo2(m []string, size int64) *fileinfo.FileInfo {
+	modTime, ok := keyModTime(m[3], m[4])
+	if !ok {
+		return nil
+	}
+	fType := fileinfo.FileType(m[2][0])
+	fields := keyFields(m[5])
+	fi := &fileinfo.FileInfo{
+		Path:     strings.Replace(m[1], "@@", "@", -1),
+		FileType: fType,
+		ModTime:  modTime,
+		Size:     size,
+	}
+	if fType == fileinfo.TypeLink {
+		target, ok := fields[targetField]
+		if !ok {
+			return nil
+		}
+		fi.Special = strings.Replace(target, "@@", "@", -1)
+		fi.Permissions = 0o777
+		return fi
+	}
+	mode := fields["mode"]
+	if !permRe.MatchString(mode) {
+		return nil
+	}
+	permissions, _ := strconv.ParseInt(mode, 8, 16)
+	fi.Permissions = uint16(permissions)
+	if hash, ok := fields["hash"]; ok && fType == fileinfo.TypeFile {
+		// The object is empty, and the contents are stored by hash.
+		if !hashRe.MatchString(hash) {
+			return nil
+		}
+		var err error
+		fi.Size, err = strconv.ParseInt(fields["size"], 10, 64)
+		if err != nil {
+			return nil
+		}
+		fi.Hash = hash
+		_, fi.Chunked = fields["chunked"]
+	}
+	return fi
+}
+
+// keyModTime parses the modification time in a key, given as milliseconds and
+// optional nanoseconds within the millisecond.
+func keyModTime(ms, ns string) (time.Time, bool) {
+	modTimeMs, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	modTime := time.UnixMilli(modTimeMs)
+	if ns != "" {
+		n, _ := strconv.Atoi(ns)
+		modTime = modTime.Add(time.Duration(n))
+	}
+	return modTime, true
+}
@@ -0,0 +1,122 @@
+package s3source
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"path"
+	"strings"
+)
+
+// Without a database, FileInfo has to ask S3 about each path. Rather than
+// listing the keys for one path at a time, FileInfo lists the directory that
+// contains the path and caches what it finds, so looking up several paths in
+// the same directory, such as the filters in .qfs/filters, takes one listing.
+// Store and Remove discard the cached listing of the directory they change,
+// and RemoveKeys discards all cached listings.
+
+// listingPrefix returns the key prefix of the entries of the directory dir.
+func (s *S3Source) listingPrefix(dir string) string {
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	if dir != "." {
+		prefix += strings.Replace(dir, "@", "@@", -1) + "/"
+	}
+	return prefix
+}
+
+// cachedFileInfo returns the entry for repoPath from the cached listing of its
+// directory. The second return value is false if the directory hasn't been
+// listed.
+func (s *S3Source) cachedFileInfo(repoPath string) (*fileinfo.FileInfo, bool) {
+	var fi *fileinfo.FileInfo
+	var ok bool
+	s.withDbLock(func() {
+		var entries map[string]*fileinfo.FileInfo
+		entries, ok = s.listings[path.Dir(repoPath)]
+		fi = entries[repoPath]
+	})
+	return fi, ok
+}
+
+// listDir lists the entries of the directory containing repoPath in S3, caches
+// them, and returns the one for repoPath, or nil if there isn't one.
+func (s *S3Source) listDir(repoPath string) (*fileinfo.FileInfo, error) {
+	dir := path.Dir(repoPath)
+	entries := map[string]*fileinfo.FileInfo{}
+	keys := map[string]string{}
+	addKey := func(key string, size int64) {
+		fi := s.KeyToFileInfo(key, size)
+		if fi == nil || path.Dir(fi.Path) != dir {
+			// This is not an entry of this directory -- most likely the key is for
+			// content or has extra @ signs in the name.
+			return
+		}
+		if old := entries[fi.Path]; old != nil && fi.ModTime.Before(old.ModTime) {
+			// Keep only the latest match
+			return
+		}
+		entries[fi.Path] = fi
+		keys[fi.Path] = key
+	}
+	prefix := s.listingPrefix(dir)
+	delimiter := "/"
+	paginator := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    &s.bucket,
+		Prefix:    &prefix,
+		Delimiter: &delimiter,
+	})
+	var linkPrefixes []string
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(s.ctx)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil, fmt.Errorf("get listing for %s: %w", s.FullPath(dir), err)
+		}
+		for _, object := range output.Contents {
+			addKey(*object.Key, *object.Size)
+		}
+		for _, p := range output.CommonPrefixes {
+			// The key of a symbolic link includes its target, which may contain /. Such
+			// keys are grouped with subdirectories, but unlike subdirectories, they
+			// contain an unescaped @.
+			name := strings.TrimPrefix(*p.Prefix, prefix)
+			if strings.Contains(strings.Replace(name, "@@", "", -1), "@") {
+				linkPrefixes = append(linkPrefixes, *p.Prefix)
+			}
+		}
+	}
+	for _, linkPrefix := range linkPrefixes {
+		paginator := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+			Bucket: &s.bucket,
+			Prefix: &linkPrefix,
+		})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(s.ctx)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, fmt.Errorf("get listing for %s: %w", s.FullPath(dir), err)
+			}
+			for _, object := range output.Contents {
+				addKey(*object.Key, *object.Size)
+			}
+		}
+	}
+	s.withDbLock(func() {
+		s.listings[dir] = entries
+	})
+	for p, key := range keys {
+		s.noteListedKey(p, key)
+	}
+	return entries[repoPath], nil
+}
+
+// invalidateListing discards the cached listing of the directory containing
+// repoPath.
+func (s *S3Source) invalidateListing(repoPath string) {
+	s.withDbLock(func() {
+		delete(s.listings, path.Dir(repoPath))
+	})
+}
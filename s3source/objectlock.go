@@ -0,0 +1,183 @@
+package s3source
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"time"
+)
+
+// ObjectLock describes the S3 Object Lock settings given to every object
+// stored in a bucket that has Object Lock enabled. Object Lock prevents object
+// versions from being permanently removed or overwritten. Removing an object
+// without a version ID only adds a delete marker, which Object Lock allows, so
+// only operations that remove specific versions are affected.
+type ObjectLock struct {
+	// Mode is governance or compliance. In governance mode, users with the
+	// s3:BypassGovernanceRetention permission can remove versions before their
+	// retention expires. In compliance mode, nobody can. If Mode is empty, no
+	// retention is set, and the bucket's default retention, if any, applies.
+	Mode types.ObjectLockMode
+	// Retain is how long each stored object is retained.
+	Retain time.Duration
+	// LegalHold places a legal hold on each stored object, which prevents its
+	// removal until the hold is removed regardless of its retention.
+	LegalHold bool
+}
+
+// Retention describes the Object Lock protection of an object version.
+type Retention struct {
+	Mode      types.ObjectLockMode
+	Until     time.Time
+	LegalHold bool
+}
+
+func (r *Retention) String() string {
+	var s string
+	if r.Mode != "" {
+		s = fmt.Sprintf("%s retention until %s", r.Mode, r.Until.Local().Format(time.DateTime))
+	}
+	if r.LegalHold {
+		if s != "" {
+			s += ", "
+		}
+		s += "legal hold"
+	}
+	return s
+}
+
+// Protected returns true if the version can't be permanently removed at the
+// given time. Versions in governance mode can be removed if bypass is true.
+func (r *Retention) Protected(now time.Time, bypass bool) bool {
+	if r == nil {
+		return false
+	}
+	if r.LegalHold {
+		return true
+	}
+	if r.Mode == "" || !now.Before(r.Until) {
+		return false
+	}
+	return r.Mode == types.ObjectLockModeCompliance || !bypass
+}
+
+// WithObjectLock causes retention and legal hold settings to be given to every
+// object that is stored.
+func WithObjectLock(lock *ObjectLock) func(*S3Source) {
+	return func(s *S3Source) {
+		s.objectLock = lock
+	}
+}
+
+// retainUntil returns the time until which an object stored now is retained.
+func (s *S3Source) retainUntil() *time.Time {
+	return aws.Time(time.Now().Add(s.objectLock.Retain).UTC())
+}
+
+// lockPut adds the Object Lock settings to an upload. S3 requires a checksum on
+// uploads with Object Lock settings.
+func (s *S3Source) lockPut(input *s3.PutObjectInput) {
+	if s.objectLock == nil {
+		return
+	}
+	input.ChecksumAlgorithm = types.ChecksumAlgorithmCrc32
+	if s.objectLock.Mode != "" {
+		input.ObjectLockMode = s.objectLock.Mode
+		input.ObjectLockRetainUntilDate = s.retainUntil()
+	}
+	if s.objectLock.LegalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+}
+
+// lockCopy adds the Object Lock settings to a copy.
+func (s *S3Source) lockCopy(input *s3.CopyObjectInput) {
+	if s.objectLock == nil {
+		return
+	}
+	if s.objectLock.Mode != "" {
+		input.ObjectLockMode = s.objectLock.Mode
+		input.ObjectLockRetainUntilDate = s.retainUntil()
+	}
+	if s.objectLock.LegalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+}
+
+// extendRetention makes sure that existing content, which head describes, is
+// retained at least as long as the file that is about to refer to it. The
+// retention of an object may be extended but never shortened.
+func (s *S3Source) extendRetention(key string, head *s3.HeadObjectOutput) error {
+	if s.objectLock == nil || s.objectLock.Mode == "" {
+		return nil
+	}
+	until := s.retainUntil()
+	if head.ObjectLockRetainUntilDate != nil && !head.ObjectLockRetainUntilDate.Before(*until) {
+		return nil
+	}
+	mode := types.ObjectLockRetentionMode(s.objectLock.Mode)
+	if head.ObjectLockMode == types.ObjectLockModeCompliance {
+		// Compliance mode can't be relaxed to governance mode.
+		mode = types.ObjectLockRetentionModeCompliance
+	}
+	_, err := s.s3Client.PutObjectRetention(s.ctx, &s3.PutObjectRetentionInput{
+		Bucket:    &s.bucket,
+		Key:       &key,
+		VersionId: head.VersionId,
+		Retention: &types.ObjectLockRetention{
+			Mode:            mode,
+			RetainUntilDate: until,
+		},
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("extend retention of s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+// ObjectLockEnabled returns true if the bucket has Object Lock enabled.
+func (s *S3Source) ObjectLockEnabled() (bool, error) {
+	output, err := s.s3Client.GetObjectLockConfiguration(s.ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: &s.bucket,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError" {
+			return false, nil
+		}
+		// TEST: NOT COVERED
+		return false, fmt.Errorf("get object lock configuration of bucket %s: %w", s.bucket, err)
+	}
+	return output.ObjectLockConfiguration != nil &&
+		output.ObjectLockConfiguration.ObjectLockEnabled == types.ObjectLockEnabledEnabled, nil
+}
+
+// VersionRetention returns the Object Lock protection of the given version of
+// key, or of the current version if versionId is nil. It returns nil if the
+// version isn't protected.
+func (s *S3Source) VersionRetention(key string, versionId *string) (*Retention, error) {
+	output, err := s.s3Client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket:    &s.bucket,
+		Key:       &key,
+		VersionId: versionId,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("get information about s3://%s/%s: %w", s.bucket, key, err)
+	}
+	r := &Retention{
+		Mode:      output.ObjectLockMode,
+		LegalHold: output.ObjectLockLegalHoldStatus == types.ObjectLockLegalHoldStatusOn,
+	}
+	if output.ObjectLockRetainUntilDate != nil {
+		r.Until = *output.ObjectLockRetainUntilDate
+	}
+	if r.Mode == "" && !r.LegalHold {
+		return nil, nil
+	}
+	return r, nil
+}
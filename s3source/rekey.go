@@ -0,0 +1,239 @@
+package s3source
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/repofiles"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+// maxRekeySize is the largest object Rekey copies. Larger objects can't be
+// copied with CopyObject, so they are uploaded instead.
+var maxRekeySize int64 = 5 * 1024 * 1024 * 1024
+
+// CopySource returns the value of CopySource for copying the given object
+// version. If versionId is nil, the current version is copied.
+func CopySource(bucket, key string, versionId *string) *string {
+	source := url.PathEscape(bucket) + "/" + (&url.URL{Path: key}).EscapedPath()
+	if versionId != nil {
+		source += "?versionId=" + url.QueryEscape(*versionId)
+	}
+	return &source
+}
+
+// SameContents returns true if the local file at localPath has the same
+// contents as the repository's copy of repoPath. Contents stored by hash are
+// compared by hash. Other objects are compared using their ETags, which are
+// the MD5 digests of objects uploaded in one piece without server-side
+// encryption by KMS. If the contents can't be compared this way, SameContents
+// returns false.
+func (s *S3Source) SameContents(localPath *fileinfo.Path, repoPath string) (bool, error) {
+	repoInfo, err := s.FileInfo(repoPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	localInfo, err := localPath.FileInfo()
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	if repoInfo.FileType != fileinfo.TypeFile ||
+		localInfo.FileType != fileinfo.TypeFile ||
+		repoInfo.Size != localInfo.Size ||
+		repoInfo.Chunked {
+		return false, nil
+	}
+	if repoInfo.Hash != "" {
+		hash, err := fileHash(localPath)
+		if err != nil {
+			// TEST: NOT COVERED
+			return false, err
+		}
+		return hash == repoInfo.Hash, nil
+	}
+	key := s.KeyFromPath(repoPath, repoInfo)
+	output, err := s.s3Client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return false, s.objectError("get information about", key, err)
+	}
+	if output.ETag == nil {
+		// TEST: NOT COVERED
+		return false, nil
+	}
+	etag := strings.Trim(*output.ETag, `"`)
+	if strings.Contains(etag, "-") {
+		// Uploaded in parts
+		return false, nil
+	}
+	f, err := localPath.Open()
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		// TEST: NOT COVERED
+		return false, fmt.Errorf("read %s: %w", localPath.Path(), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == etag, nil
+}
+
+// Rekey stores the local file at localPath, whose contents must be the same as
+// those of the repository's copy of repoPath, by copying the repository's
+// object to the key for the local file's metadata within S3 and removing the
+// old key. The new object gets the same tags, storage class, and metadata as
+// Store would give it. Objects that can't be
+// copied, such as directories, links, objects that are too large, and objects
+// in archival storage classes, are stored with Store.
+func (s *S3Source) Rekey(localPath *fileinfo.Path, repoPath string) error {
+	return s.copyObject(localPath, repoPath, repoPath)
+}
+
+// Rename stores the local file at localPath at newPath and removes oldPath.
+// Renames are detected by size and modification time, so the object is only
+// copied within S3, as with Rekey, if SameContents shows that the local file
+// has the same contents as the repository's copy of oldPath. Otherwise, it is
+// stored with Store.
+func (s *S3Source) Rename(localPath *fileinfo.Path, oldPath, newPath string) error {
+	if err := s.copyObject(localPath, oldPath, newPath); err != nil {
+		return err
+	}
+	return s.Remove(oldPath)
+}
+
+// copyObject copies the repository's object for oldPath to the key for the
+// local file's metadata at newPath. If the paths are the same, the old key is
+// removed.
+func (s *S3Source) copyObject(localPath *fileinfo.Path, oldPath, newPath string) error {
+	defer s.invalidateListing(newPath)
+	defer s.invalidateListing(oldPath)
+	repoInfo, err := s.FileInfo(oldPath)
+	if err != nil {
+		return s.Store(localPath, newPath)
+	}
+	info, err := localPath.FileInfo()
+	if err != nil {
+		return err
+	}
+	if info.FileType != fileinfo.TypeFile ||
+		repoInfo.FileType != fileinfo.TypeFile ||
+		repoInfo.Hash != "" ||
+		repoInfo.Size > maxRekeySize ||
+		strings.HasPrefix(oldPath, repofiles.Top+"/") ||
+		strings.HasPrefix(newPath, repofiles.Top+"/") {
+		// Store doesn't upload contents stored by hash again, and the rest can't be
+		// copied.
+		return s.Store(localPath, newPath)
+	}
+	if oldPath != newPath {
+		same, err := s.SameContents(localPath, oldPath)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return s.Store(localPath, newPath)
+		}
+	}
+	oldKey := s.KeyFromPath(oldPath, repoInfo)
+	key := s.KeyFromPath(newPath, info)
+	input := &s3.CopyObjectInput{
+		Bucket:            &s.bucket,
+		Key:               &key,
+		CopySource:        CopySource(s.bucket, oldKey, nil),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		TaggingDirective:  types.TaggingDirectiveReplace,
+	}
+	if s.tagging != "" {
+		input.Tagging = &s.tagging
+	}
+	input.Metadata = s.metadata(info)
+	if s.storageClass != nil {
+		input.StorageClass = s.storageClass(newPath)
+	}
+	s.lockCopy(input)
+	_, err = s.s3Client.CopyObject(s.ctx, input)
+	var notActive *types.ObjectNotInActiveTierError
+	var state *types.InvalidObjectState
+	if errors.As(err, &notActive) || errors.As(err, &state) {
+		// TEST: NOT COVERED. The archived object can't be copied.
+		return s.Store(localPath, newPath)
+	} else if err != nil {
+		return fmt.Errorf("copy s3://%s/%s to %s: %w", s.bucket, oldKey, key, err)
+	}
+	if oldPath == newPath && key != oldKey {
+		_, err = s.s3Client.DeleteObject(s.ctx, &s3.DeleteObjectInput{
+			Bucket: &s.bucket,
+			Key:    &oldKey,
+		})
+		if err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("delete s3://%s/%s: %w", s.bucket, oldKey, err)
+		}
+	}
+	if s.db != nil {
+		s.withDbLock(func() {
+			newFi := *info
+			newFi.Path = newPath
+			s.db[newPath] = &newFi
+		})
+	}
+	return nil
+}
+
+// Copy copies the repository's object for oldPath to newPath within S3, so its
+// contents don't pass through the local machine. The copy has the same
+// modification time, permissions, and metadata. Only regular files stored by
+// path that are small enough for CopyObject can be copied.
+func (s *S3Source) Copy(oldPath, newPath string) error {
+	defer s.invalidateListing(newPath)
+	info, err := s.FileInfo(oldPath)
+	if err != nil {
+		return err
+	}
+	if info.FileType != fileinfo.TypeFile || info.Hash != "" || info.Size > maxRekeySize {
+		return fmt.Errorf("%s: only regular files stored by path can be copied", oldPath)
+	}
+	if err = s.Remove(newPath); err != nil {
+		return err
+	}
+	oldKey := s.KeyFromPath(oldPath, info)
+	key := s.KeyFromPath(newPath, info)
+	input := &s3.CopyObjectInput{
+		Bucket:            &s.bucket,
+		Key:               &key,
+		CopySource:        CopySource(s.bucket, oldKey, nil),
+		MetadataDirective: types.MetadataDirectiveCopy,
+		TaggingDirective:  types.TaggingDirectiveReplace,
+	}
+	if s.tagging != "" {
+		input.Tagging = &s.tagging
+	}
+	s.lockCopy(input)
+	_, err = s.s3Client.CopyObject(s.ctx, input)
+	if err != nil {
+		return fmt.Errorf("copy s3://%s/%s to %s: %w", s.bucket, oldKey, key, err)
+	}
+	if s.db != nil {
+		s.withDbLock(func() {
+			newFi := *info
+			newFi.Path = newPath
+			s.db[newPath] = &newFi
+		})
+	}
+	return nil
+}
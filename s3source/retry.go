@@ -0,0 +1,64 @@
+package s3source
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy determines how S3 operations that fail with transient errors,
+// such as throttling, server errors, and dropped connections, are retried. The
+// wait before each retry is chosen at random up to a limit that starts at
+// InitialDelay and doubles with each retry up to MaxDelay. Waiting stops if the
+// operation's context is canceled.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     20 * time.Second,
+}
+
+// WithRetryPolicy causes all operations of the S3Source's client to be retried
+// according to policy.
+func WithRetryPolicy(policy RetryPolicy) func(*S3Source) {
+	return func(s *S3Source) {
+		s.retryPolicy = &policy
+	}
+}
+
+// Client returns a copy of client whose operations are retried according to
+// the policy.
+func (p RetryPolicy) Client(client *s3.Client) *s3.Client {
+	return s3.New(client.Options(), func(o *s3.Options) {
+		o.Retryer = retry.NewStandard(func(so *retry.StandardOptions) {
+			so.MaxAttempts = p.MaxAttempts
+			so.Backoff = p
+			// Don't limit the total number of retries across concurrent operations,
+			// which could stop retries during a large push or pull.
+			so.RateLimiter = ratelimit.None
+		})
+	})
+}
+
+// BackoffDelay implements retry.BackoffDelayer. attempt is 1 for the first
+// retry.
+func (p RetryPolicy) BackoffDelay(attempt int, _ error) (time.Duration, error) {
+	limit := p.MaxDelay
+	if attempt < 32 {
+		if d := p.InitialDelay << (attempt - 1); d > 0 && d < limit {
+			limit = d
+		}
+	}
+	if limit <= 0 {
+		return 0, nil
+	}
+	return rand.N(limit + 1), nil
+}
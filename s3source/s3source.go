@@ -3,8 +3,11 @@ package s3source
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -14,14 +17,19 @@ import (
 	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/repofiles"
 	"github.com/jberkenbilt/qfs/s3lister"
+	"hash"
 	"io"
 	"io/fs"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/user"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,22 +38,85 @@ import (
 // the test suite to exercise the batching logic.
 var DeleteBatchSize = 1000
 
-var pathRe = regexp.MustCompile(`^((?:[^@]|@@)+)@([fdl]),(\d+),((?:[^@]|@@)+)$`)
+// OwnerMetadataKey is the S3 user metadata key in which file ownership is saved.
+const OwnerMetadataKey = "qfs-owner"
+
+// BirthTimeMetadataKey is the S3 user metadata key in which a file's creation
+// time, in milliseconds since the epoch, is saved if it was captured.
+const BirthTimeMetadataKey = "qfs-btime"
+
+// The modification time in a key is in milliseconds. If it has a fractional
+// millisecond, it is followed by a period and six digits of nanoseconds.
+var pathRe = regexp.MustCompile(`^((?:[^@]|@@)+)@([fdl]),(\d+)(?:\.(\d{6}))?,((?:[^@]|@@)+)$`)
 var permRe = regexp.MustCompile(`^[0-7]{4}$`)
-var ctx = context.Background()
+var contentRe = regexp.MustCompile(`^([0-7]{4}),(\d+),([0-9a-f]{64})(,chunked)?$`)
+var hashRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Layout determines how Store stores the contents of files.
+type Layout int
+
+const (
+	// LayoutPath stores each file's contents in the object whose key encodes the
+	// file's path and metadata.
+	LayoutPath Layout = iota
+	// LayoutContent stores each file's contents once under a key derived from
+	// its SHA-256 hash. The key that encodes the path and metadata also includes
+	// the size and hash and refers to an empty object. Files with identical
+	// contents share storage.
+	LayoutContent
+)
+
+// ParseLayout parses "path" or "content".
+func ParseLayout(s string) (Layout, error) {
+	switch s {
+	case "path":
+		return LayoutPath, nil
+	case "content":
+		return LayoutContent, nil
+	}
+	return LayoutPath, fmt.Errorf("layout must be path or content")
+}
 
 type Options func(*S3Source)
 
 type S3Source struct {
+	ctx        context.Context
 	s3Client   *s3.Client
 	uploader   *manager.Uploader
 	downloader *manager.Downloader
 	bucket     string
 	prefix     string
+	tagging    string
+	owners     bool
+	layout     Layout
+	chunkSize  int64
+	// If retryPolicy is not nil, it is applied to s3Client.
+	retryPolicy *RetryPolicy
+	// storageClass, if not nil, returns the storage class for the contents of
+	// the file with the given path.
+	storageClass func(path string) types.StorageClass
+	// objectLock, if not nil, gives the Object Lock settings for stored objects.
+	objectLock *ObjectLock
+	// mfa, if not empty, is given with requests that remove objects.
+	mfa string
+	// keyVersion, if not 0, is the version of new keys. seenKeyVersion is the
+	// highest version of the keys that have been parsed.
+	keyVersion     int
+	seenKeyVersion atomic.Int32
+	// listedKeys maps paths to the keys found for them in S3. It requires
+	// keyMutex protection.
+	keyMutex   sync.Mutex
+	listedKeys map[string]string
 	// Everything below requires mutex protection.
 	dbMutex   sync.Mutex
 	db        database.Database
 	extraKeys map[string]time.Time
+	// extraSizes holds the sizes of extra keys that qfs didn't store.
+	extraSizes map[string]int64
+	// content maps the hash of each content object found by Database to its key.
+	content map[string]string
+	// listings caches the entries of directories listed by FileInfo.
+	listings map[string]map[string]*fileinfo.FileInfo
 }
 
 func New(bucket, prefix string, options ...Options) (*S3Source, error) {
@@ -56,9 +127,13 @@ func New(bucket, prefix string, options ...Options) (*S3Source, error) {
 		return nil, fmt.Errorf("prefix may not end with '/'")
 	}
 	s := &S3Source{
-		bucket:    bucket,
-		prefix:    prefix,
-		extraKeys: map[string]time.Time{},
+		ctx:        context.Background(),
+		bucket:     bucket,
+		prefix:     prefix,
+		extraKeys:  map[string]time.Time{},
+		extraSizes: map[string]int64{},
+		content:    map[string]string{},
+		listings:   map[string]map[string]*fileinfo.FileInfo{},
 	}
 	for _, fn := range options {
 		fn(s)
@@ -66,6 +141,9 @@ func New(bucket, prefix string, options ...Options) (*S3Source, error) {
 	if s.s3Client == nil {
 		return nil, fmt.Errorf("an s3 client must be given when creating an S3Source")
 	}
+	if s.retryPolicy != nil {
+		s.s3Client = s.retryPolicy.Client(s.s3Client)
+	}
 	s.uploader = manager.NewUploader(s.s3Client)
 	s.downloader = manager.NewDownloader(s.s3Client)
 	return s, nil
@@ -89,29 +167,260 @@ func WithDatabase(db database.Database) func(*S3Source) {
 	}
 }
 
-func (s *S3Source) FullPath(path string) string {
-	return fmt.Sprintf("s3://%s/%s@...", s.bucket, filepath.Join(s.prefix, path))
+// WithContext sets the context used for S3 requests. Canceling it aborts
+// requests that are in progress, including uploads and downloads.
+func WithContext(ctx context.Context) func(*S3Source) {
+	return func(s *S3Source) {
+		s.ctx = ctx
+	}
+}
+
+// WithMFA supplies the serial number and current code of an MFA device, as
+// "serial code", with the requests that remove objects. See repo.WithMFA.
+func WithMFA(mfa string) func(*S3Source) {
+	return func(s *S3Source) {
+		s.mfa = mfa
+	}
+}
+
+// WithLayout sets how Store stores files. Files stored with either layout can
+// always be read.
+func WithLayout(layout Layout) func(*S3Source) {
+	return func(s *S3Source) {
+		s.layout = layout
+	}
+}
+
+// WithChunkSize causes Store to store files larger than size in chunks of that
+// size when using the content layout. Only chunks that are not already in the
+// repository are uploaded, so storing a large file that has changed slightly
+// uploads only the chunks that changed. If size is 0, files are not chunked.
+func WithChunkSize(size int64) func(*S3Source) {
+	return func(s *S3Source) {
+		s.chunkSize = size
+	}
+}
+
+// SetContext replaces the context used for subsequent S3 requests. This allows
+// cleanup to be done after the original context has been canceled.
+func (s *S3Source) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+// SetTags sets S3 object tags to apply to every object subsequently stored by
+// Store. Passing nil or an empty map stops tagging.
+func (s *S3Source) SetTags(tags map[string]string) {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	s.tagging = values.Encode()
+}
+
+// SetCaptureOwners causes the ownership of every object subsequently stored by
+// Store to be saved in the object's metadata so it can be restored later.
+func (s *S3Source) SetCaptureOwners(capture bool) {
+	s.owners = capture
+}
+
+// SetStorageClass causes the contents of every regular file subsequently
+// stored by Store to be stored in the storage class returned by fn for the
+// file's path. If fn returns "", the bucket's default is used. The
+// repository's own files are always stored with the default storage class.
+func (s *S3Source) SetStorageClass(fn func(path string) types.StorageClass) {
+	s.storageClass = fn
+}
+
+// ErrArchived is wrapped by errors from reading objects that are in archival
+// storage classes and have not been restored.
+var ErrArchived = errors.New("it must be restored before it can be read")
+
+// objectError describes err, which occurred while performing op on the object
+// with the given key. If the object is archived, the error wraps ErrArchived.
+func (s *S3Source) objectError(op, key string, err error) error {
+	var state *types.InvalidObjectState
+	if errors.As(err, &state) {
+		return fmt.Errorf(
+			"%s s3://%s/%s: object is in storage class %s: %w",
+			op,
+			s.bucket,
+			key,
+			state.StorageClass,
+			ErrArchived,
+		)
+	}
+	return fmt.Errorf("%s s3://%s/%s: %w", op, s.bucket, key, err)
+}
+
+// ownerMetadata returns the metadata value that records the ownership in info.
+// User and group names are included when they can be determined.
+func ownerMetadata(info *fileinfo.FileInfo) string {
+	values := url.Values{}
+	values.Set("uid", strconv.Itoa(info.Uid))
+	values.Set("gid", strconv.Itoa(info.Gid))
+	if u, err := user.LookupId(strconv.Itoa(info.Uid)); err == nil {
+		values.Set("user", u.Username)
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(info.Gid)); err == nil {
+		values.Set("group", g.Name)
+	}
+	return values.Encode()
+}
+
+// metadata returns the user metadata to store with the object for info, which
+// includes ownership if owners are captured and the creation time if it is
+// known. It returns nil if there is none.
+func (s *S3Source) metadata(info *fileinfo.FileInfo) map[string]string {
+	var m map[string]string
+	if s.owners {
+		m = map[string]string{
+			OwnerMetadataKey: ownerMetadata(info),
+		}
+	}
+	if !info.BirthTime.IsZero() {
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[BirthTimeMetadataKey] = strconv.FormatInt(info.BirthTime.UnixMilli(), 10)
+	}
+	return m
+}
+
+// Owner returns the ownership saved when the file at path was stored, or nil if
+// ownership was not captured.
+func (s *S3Source) Owner(path string, info *fileinfo.FileInfo) (*fileinfo.Owner, error) {
+	if info == nil {
+		var err error
+		info, err = s.FileInfo(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.VersionOwner(s.KeyFromPath(path, info), nil)
+}
+
+// VersionOwner returns the ownership saved with a specific version of an object,
+// or nil if ownership was not captured. If versionId is nil, the current version
+// is used.
+func (s *S3Source) VersionOwner(key string, versionId *string) (*fileinfo.Owner, error) {
+	output, err := s.s3Client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket:    &s.bucket,
+		Key:       &key,
+		VersionId: versionId,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("get metadata for s3://%s/%s: %w", s.bucket, key, err)
+	}
+	data, ok := output.Metadata[OwnerMetadataKey]
+	if !ok {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(data)
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: invalid owner metadata: %w", s.bucket, key, err)
+	}
+	uid, err1 := strconv.Atoi(values.Get("uid"))
+	gid, err2 := strconv.Atoi(values.Get("gid"))
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("s3://%s/%s: invalid owner metadata %q", s.bucket, key, data)
+	}
+	return &fileinfo.Owner{
+		Uid:   uid,
+		Gid:   gid,
+		User:  values.Get("user"),
+		Group: values.Get("group"),
+	}, nil
+}
+
+// VersionBirthTime returns the creation time saved with a specific version of
+// an object, or the zero time if none was saved. If versionId is nil, the
+// current version is used.
+func (s *S3Source) VersionBirthTime(key string, versionId *string) (time.Time, error) {
+	output, err := s.s3Client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket:    &s.bucket,
+		Key:       &key,
+		VersionId: versionId,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return time.Time{}, fmt.Errorf("get metadata for s3://%s/%s: %w", s.bucket, key, err)
+	}
+	data, ok := output.Metadata[BirthTimeMetadataKey]
+	if !ok {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("s3://%s/%s: invalid birth time metadata %q", s.bucket, key, data)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// Tags returns the tags of a specific version of an object. If versionId is nil,
+// the current version is used.
+func (s *S3Source) Tags(key string, versionId *string) (map[string]string, error) {
+	output, err := s.s3Client.GetObjectTagging(s.ctx, &s3.GetObjectTaggingInput{
+		Bucket:    &s.bucket,
+		Key:       &key,
+		VersionId: versionId,
+	})
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("get tags for s3://%s/%s: %w", s.bucket, key, err)
+	}
+	tags := map[string]string{}
+	for _, tag := range output.TagSet {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	return tags, nil
+}
+
+func (s *S3Source) FullPath(relPath string) string {
+	return fmt.Sprintf("s3://%s/%s@...", s.bucket, path.Join(s.prefix, relPath))
 }
 
 func (s *S3Source) KeyToFileInfo(key string, size int64) *fileinfo.FileInfo {
 	key = misc.RemovePrefix(key, s.prefix)
+	if m := path2Re.FindStringSubmatch(key); m != nil {
+		fi := keyToFileInfo2(m, size)
+		if fi != nil {
+			fi.Uid = database.CurUid
+			fi.Gid = database.CurGid
+			s.noteKeyVersion(KeyVersion2)
+		}
+		return fi
+	}
 	m := pathRe.FindStringSubmatch(key)
 	if m == nil {
 		return nil
 	}
 	base := strings.Replace(m[1], "@@", "@", -1)
-	modTimeMs, err := strconv.ParseInt(m[3], 10, 64)
-	if err != nil {
+	modTime, ok := keyModTime(m[3], m[4])
+	if !ok {
 		// modTime is invalid
 		return nil
 	}
-	modTime := time.UnixMilli(modTimeMs)
 	// Setting fType this way is known to be safe because of the regular expression.
 	fType := fileinfo.FileType(m[2][0])
-	rest := m[4]
-	var special string
+	rest := m[5]
+	var special, hash string
+	var chunked bool
 	var permissions int64
-	if fType == fileinfo.TypeDirectory || fType == fileinfo.TypeFile {
+	if c := contentRe.FindStringSubmatch(rest); c != nil && fType == fileinfo.TypeFile {
+		// The object is empty, and the contents are stored by hash.
+		permissions, _ = strconv.ParseInt(c[1], 8, 16)
+		var err error
+		size, err = strconv.ParseInt(c[2], 10, 64)
+		if err != nil {
+			// TEST: NOT COVERED
+			return nil
+		}
+		hash = c[3]
+		chunked = c[4] != ""
+	} else if fType == fileinfo.TypeDirectory || fType == fileinfo.TypeFile {
 		if !permRe.MatchString(rest) {
 			// Invalid permissions
 			return nil
@@ -121,6 +430,7 @@ func (s *S3Source) KeyToFileInfo(key string, size int64) *fileinfo.FileInfo {
 		special = strings.Replace(rest, "@@", "@", -1)
 		permissions = 0o777
 	}
+	s.noteKeyVersion(KeyVersion1)
 	return &fileinfo.FileInfo{
 		Path:        base,
 		FileType:    fType,
@@ -130,13 +440,15 @@ func (s *S3Source) KeyToFileInfo(key string, size int64) *fileinfo.FileInfo {
 		Uid:         database.CurUid,
 		Gid:         database.CurGid,
 		Special:     special,
+		Hash:        hash,
+		Chunked:     chunked,
 	}
 }
 
 func (s *S3Source) FileInfo(path string) (*fileinfo.FileInfo, error) {
 	// If we have a reference database, try to use it instead of calling out to S3.
-	// Under any other conditions, we will call out to S3 and then update the
-	// database.
+	// Otherwise, use or create a cached listing of the path's directory, and then
+	// update the database.
 	var dbEntry *fileinfo.FileInfo
 	s.withDbLock(func() {
 		e, haveEntry := s.db[path]
@@ -147,31 +459,12 @@ func (s *S3Source) FileInfo(path string) (*fileinfo.FileInfo, error) {
 	if dbEntry != nil {
 		return dbEntry, nil
 	}
-	prefix := s.KeyFromPath(path, nil)
-	listInput := &s3.ListObjectsV2Input{
-		Bucket: &s.bucket,
-		Prefix: &prefix,
-	}
-	paginator := s3.NewListObjectsV2Paginator(s.s3Client, listInput)
-	var fi *fileinfo.FileInfo
-	for paginator.HasMorePages() {
-		listOutput, err := paginator.NextPage(ctx)
+	fi, listed := s.cachedFileInfo(path)
+	if !listed {
+		var err error
+		fi, err = s.listDir(path)
 		if err != nil {
-			// TEST: NOT COVERED
-			return nil, fmt.Errorf("get listing for %s: %w", s.FullPath(path), err)
-		}
-		for _, output := range listOutput.Contents {
-			newFi := s.KeyToFileInfo(*output.Key, *output.Size)
-			if newFi.Path != path {
-				// This is for the wrong path -- that most likely means there were extra @ signs
-				// in the name.
-				continue
-			}
-			if fi != nil && newFi.ModTime.Before(fi.ModTime) {
-				// Keep only the latest match
-				continue
-			}
-			fi = newFi
+			return nil, err
 		}
 	}
 	if fi == nil {
@@ -185,20 +478,27 @@ func (s *S3Source) FileInfo(path string) (*fileinfo.FileInfo, error) {
 	return fi, nil
 }
 
+// KeyFromPath returns the key of the object for path with the metadata in fi.
+// If fi is nil, it returns the prefix of the keys for path. See WithKeyVersion
+// for which version of key is created.
 func (s *S3Source) KeyFromPath(path string, fi *fileinfo.FileInfo) string {
-	key := s.prefix
-	if key != "" {
-		key += "/"
-	}
-	key += strings.Replace(path, "@", "@@", -1) + "@"
-	if fi != nil {
-		var rest string
-		if fi.FileType == fileinfo.TypeLink {
-			rest = strings.Replace(fi.Special, "@", "@@", -1)
-		} else {
-			rest = fmt.Sprintf("%04o", fi.Permissions)
-		}
-		key += fmt.Sprintf("%c,%d,%s", fi.FileType, fi.ModTime.UnixMilli(), rest)
+	if fi == nil {
+		return s.KeyForVersion(path, nil, KeyVersion1)
+	}
+	return s.KeyForVersion(path, fi, s.newKeyVersion(path, fi))
+}
+
+// ContentKey returns the key of the object that holds the contents of files
+// with the given hash in the content layout.
+func (s *S3Source) ContentKey(hash string) string {
+	return path.Join(s.prefix, repofiles.Content, hash[:2], hash)
+}
+
+// dataKey returns the key of the object that holds the contents of the file
+// with the given key.
+func (s *S3Source) dataKey(key string, info *fileinfo.FileInfo) string {
+	if info != nil && info.Hash != "" {
+		return s.ContentKey(info.Hash)
 	}
 	return key
 }
@@ -208,14 +508,17 @@ func (s *S3Source) Open(path string) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	key := s.KeyFromPath(path, info)
+	if info.Chunked {
+		return s.openChunks(info.Hash)
+	}
+	key := s.dataKey(s.KeyFromPath(path, info), info)
 	input := &s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
-	output, err := s.s3Client.GetObject(ctx, input)
+	output, err := s.s3Client.GetObject(s.ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("get object s3://%s/%s: %w", s.bucket, key, err)
+		return nil, s.objectError("get object", key, err)
 	}
 	return output.Body, nil
 }
@@ -231,7 +534,11 @@ func (s *S3Source) Remove(path string) error {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
-	_, err = s.s3Client.DeleteObject(ctx, input)
+	if s.mfa != "" {
+		input.MFA = &s.mfa
+	}
+	_, err = s.s3Client.DeleteObject(s.ctx, input)
+	s.invalidateListing(path)
 	if err != nil {
 		// TEST: NOT COVERED. DeleteObject is idempotent.
 		return fmt.Errorf("delete object s3://%s/%s: %w", s.bucket, key, err)
@@ -245,6 +552,10 @@ func (s *S3Source) Remove(path string) error {
 }
 
 func (s *S3Source) RemoveKeys(toDelete []string) error {
+	// The keys may be in any directory.
+	defer s.withDbLock(func() {
+		clear(s.listings)
+	})
 	for len(toDelete) > 0 {
 		last := min(len(toDelete), DeleteBatchSize)
 		batch := toDelete[:last]
@@ -266,7 +577,10 @@ func (s *S3Source) RemoveKeys(toDelete []string) error {
 			Bucket: &s.bucket,
 			Delete: &deleteBatch,
 		}
-		_, err := s.s3Client.DeleteObjects(ctx, deleteInput)
+		if s.mfa != "" {
+			deleteInput.MFA = &s.mfa
+		}
+		_, err := s.s3Client.DeleteObjects(s.ctx, deleteInput)
 		if err != nil {
 			// TEST: NOT COVERED
 			return fmt.Errorf("delete keys: %w", err)
@@ -275,22 +589,28 @@ func (s *S3Source) RemoveKeys(toDelete []string) error {
 	return nil
 }
 
+// RemoveBatch removes the objects for the given files. The database, if any, is
+// updated after each batch so that it remains accurate if a later batch fails
+// or is interrupted.
 func (s *S3Source) RemoveBatch(toDelete []*fileinfo.FileInfo) error {
-	var keys []string
-	for _, fi := range toDelete {
-		misc.Message("removing %s", fi.Path)
-		keys = append(keys, s.KeyFromPath(fi.Path, fi))
-	}
-	err := s.RemoveKeys(keys)
-	if err != nil {
-		return err
-	}
-	if s.db != nil {
-		s.withDbLock(func() {
-			for _, fi := range toDelete {
-				delete(s.db, fi.Path)
-			}
-		})
+	for len(toDelete) > 0 {
+		batch := toDelete[:min(len(toDelete), DeleteBatchSize)]
+		toDelete = toDelete[len(batch):]
+		var keys []string
+		for _, fi := range batch {
+			keys = append(keys, s.KeyFromPath(fi.Path, fi))
+		}
+		err := s.RemoveKeys(keys)
+		if err != nil {
+			return err
+		}
+		if s.db != nil {
+			s.withDbLock(func() {
+				for _, fi := range batch {
+					delete(s.db, fi.Path)
+				}
+			})
+		}
 	}
 	return nil
 }
@@ -299,6 +619,7 @@ func (s *S3Source) RemoveBatch(toDelete []*fileinfo.FileInfo) error {
 // metadata. `path` is relative to top of the file collection in both the local
 // and repository contexts.
 func (s *S3Source) Store(localPath *fileinfo.Path, repoPath string) error {
+	defer s.invalidateListing(repoPath)
 	info, err := localPath.FileInfo()
 	if err != nil {
 		return err
@@ -307,10 +628,29 @@ func (s *S3Source) Store(localPath *fileinfo.Path, repoPath string) error {
 	if err != nil {
 		return err
 	}
+	var class types.StorageClass
+	if info.FileType == fileinfo.TypeFile && s.storageClass != nil &&
+		!strings.HasPrefix(repoPath, repofiles.Top+"/") {
+		class = s.storageClass(repoPath)
+	}
+	if info.FileType == fileinfo.TypeFile && s.layout == LayoutContent &&
+		!strings.HasPrefix(repoPath, repofiles.Top+"/") {
+		// The repository's own files are always stored by path so that they can be
+		// found and versioned independently.
+		if s.chunkSize > 0 && info.Size > s.chunkSize {
+			info.Hash, err = s.storeChunks(localPath, class)
+			info.Chunked = true
+		} else {
+			info.Hash, err = s.storeContent(localPath, class)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	key := s.KeyFromPath(repoPath, info)
 	var body io.Reader
-	switch info.FileType {
-	case fileinfo.TypeFile:
+	switch {
+	case info.FileType == fileinfo.TypeFile && info.Hash == "":
 		fileBody, err := localPath.Open()
 		if err != nil {
 			// TEST: NOT COVERED
@@ -318,8 +658,9 @@ func (s *S3Source) Store(localPath *fileinfo.Path, repoPath string) error {
 		}
 		defer func() { _ = fileBody.Close() }()
 		body = fileBody
-	case fileinfo.TypeDirectory:
-	case fileinfo.TypeLink:
+	case info.FileType == fileinfo.TypeFile:
+	case info.FileType == fileinfo.TypeDirectory:
+	case info.FileType == fileinfo.TypeLink:
 	default:
 		return fmt.Errorf("can only store files, directories, and links")
 	}
@@ -331,7 +672,17 @@ func (s *S3Source) Store(localPath *fileinfo.Path, repoPath string) error {
 		Key:    &key,
 		Body:   body,
 	}
-	_, err = s.uploader.Upload(ctx, input)
+	if s.tagging != "" {
+		input.Tagging = &s.tagging
+	}
+	input.Metadata = s.metadata(info)
+	s.lockPut(input)
+	if info.FileType == fileinfo.TypeFile && info.Hash == "" {
+		// With the content layout, the object that refers to the contents stays in
+		// the default storage class so the repository can always be listed.
+		input.StorageClass = class
+	}
+	_, err = s.uploader.Upload(s.ctx, input)
 	if err != nil {
 		// TEST: NOT COVERED
 		return fmt.Errorf("upload s3://%s/%s: %w", s.bucket, key, err)
@@ -346,6 +697,163 @@ func (s *S3Source) Store(localPath *fileinfo.Path, repoPath string) error {
 	return nil
 }
 
+// StoreStream stores the contents read from body at repoPath as a regular file
+// with the modification time and permissions in info, which become part of the
+// key. This is like Store but doesn't require a local file, so the whole
+// contents never have to be on disk or in memory. The contents are always
+// stored by path, regardless of the layout. The size of info is set to the
+// number of bytes read.
+func (s *S3Source) StoreStream(repoPath string, info *fileinfo.FileInfo, body io.Reader) error {
+	if info.FileType != fileinfo.TypeFile {
+		return fmt.Errorf("can only stream regular files")
+	}
+	err := s.Remove(repoPath)
+	if err != nil {
+		return err
+	}
+	return s.AddStream(repoPath, info, body)
+}
+
+// AddStream is like StoreStream but leaves any existing object for repoPath in
+// place, so anyone who already has its key can still read it. The caller is
+// responsible for removing the old object with RemoveKeys.
+func (s *S3Source) AddStream(repoPath string, info *fileinfo.FileInfo, body io.Reader) error {
+	defer s.invalidateListing(repoPath)
+	if info.FileType != fileinfo.TypeFile {
+		return fmt.Errorf("can only stream regular files")
+	}
+	key := s.KeyFromPath(repoPath, info)
+	counter := &countingReader{r: body}
+	input := &s3.PutObjectInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		Body:     counter,
+		Metadata: s.metadata(info),
+	}
+	if s.tagging != "" {
+		input.Tagging = &s.tagging
+	}
+	s.lockPut(input)
+	_, err := s.uploader.Upload(s.ctx, input)
+	if err != nil {
+		return fmt.Errorf("upload s3://%s/%s: %w", s.bucket, key, err)
+	}
+	info.Size = counter.n
+	if s.db != nil {
+		s.withDbLock(func() {
+			newFi := *info
+			newFi.Path = repoPath
+			s.db[repoPath] = &newFi
+		})
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// storeContent uploads the contents of a file to its content key unless the
+// same contents are already there and returns its hash.
+func (s *S3Source) storeContent(localPath *fileinfo.Path, class types.StorageClass) (string, error) {
+	hash, err := fileHash(localPath)
+	if err != nil {
+		return "", err
+	}
+	body, err := localPath.Open()
+	if err != nil {
+		// TEST: NOT COVERED
+		return "", err
+	}
+	defer func() { _ = body.Close() }()
+	return hash, s.putContent(hash, body, class)
+}
+
+// putContent uploads body to the content key for hash in the given storage
+// class unless it is already there, in which case its storage class is not
+// changed, but its retention is extended if needed. Since the hash is computed
+// before the upload, body is hashed again as it is uploaded, and the upload
+// fails if the hashes differ. This way, a file that changes while it is being
+// pushed can't store the wrong contents under a hash that other files share.
+func (s *S3Source) putContent(hash string, body io.Reader, class types.StorageClass) error {
+	key := s.ContentKey(hash)
+	head, err := s.s3Client.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err == nil {
+		return s.extendRetention(key, head)
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		// TEST: NOT COVERED
+		return fmt.Errorf("get information about s3://%s/%s: %w", s.bucket, key, err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:       &s.bucket,
+		Key:          &key,
+		Body:         &verifyingReader{r: body, h: sha256.New(), exp: hash},
+		StorageClass: class,
+	}
+	if s.tagging != "" {
+		input.Tagging = &s.tagging
+	}
+	s.lockPut(input)
+	_, err = s.uploader.Upload(s.ctx, input)
+	if err != nil {
+		// TEST: NOT COVERED
+		return fmt.Errorf("upload s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+// ErrContentsChanged is returned when contents stored by hash change between
+// being hashed and being uploaded.
+var ErrContentsChanged = errors.New("contents changed while being uploaded")
+
+// verifyingReader hashes what is read through it and, instead of returning
+// io.EOF, returns an error if the hash isn't exp. The uploader stops before
+// completing the upload when reading fails, so the object is never created.
+type verifyingReader struct {
+	r   io.Reader
+	h   hash.Hash
+	exp string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if errors.Is(err, io.EOF) && hex.EncodeToString(v.h.Sum(nil)) != v.exp {
+		return n, ErrContentsChanged
+	}
+	return n, err
+}
+
+func fileHash(p *fileinfo.Path) (string, error) {
+	f, err := p.Open()
+	if err != nil {
+		// TEST: NOT COVERED
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		// TEST: NOT COVERED
+		return "", fmt.Errorf("read %s: %w", p.Path(), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DownloadVersion downloads a specific version of an object. If the object
+// refers to contents stored by hash, the contents are downloaded instead.
 func (s *S3Source) DownloadVersion(
 	key string,
 	versionId *string,
@@ -356,18 +864,64 @@ func (s *S3Source) DownloadVersion(
 		Key:       &key,
 		VersionId: versionId,
 	}
-	_, err := s.downloader.Download(ctx, f, input)
-	return err
+	info := s.KeyToFileInfo(key, 0)
+	if info != nil && info.Hash != "" {
+		// Contents are never changed once stored, so there's only one version.
+		if info.Chunked {
+			return s.downloadChunks(info.Hash, f)
+		}
+		input.Key = aws.String(s.ContentKey(info.Hash))
+		input.VersionId = nil
+	}
+	n, err := s.downloader.Download(s.ctx, f, input)
+	if err != nil {
+		return s.objectError("download", *input.Key, err)
+	}
+	if info != nil && info.Hash != "" {
+		return s.checkHash(f, 0, n, *input.Key, info.Hash)
+	}
+	return s.checkObjectChecksum(input, f)
+}
+
+// OpenVersion returns a reader for the contents of the given version of the
+// object with the given key. If versionId is nil, the current version is read.
+func (s *S3Source) OpenVersion(key string, versionId *string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:    &s.bucket,
+		Key:       &key,
+		VersionId: versionId,
+	}
+	if info := s.KeyToFileInfo(key, 0); info != nil && info.Hash != "" {
+		if info.Chunked {
+			return s.openChunks(info.Hash)
+		}
+		input.Key = aws.String(s.ContentKey(info.Hash))
+		input.VersionId = nil
+	}
+	output, err := s.s3Client.GetObject(s.ctx, input)
+	if err != nil {
+		return nil, s.objectError("get object", *input.Key, err)
+	}
+	return output.Body, nil
 }
 
 func (s *S3Source) Download(repoPath string, srcInfo *fileinfo.FileInfo, f *os.File) error {
-	key := s.KeyFromPath(repoPath, srcInfo)
+	if srcInfo.Chunked {
+		return s.downloadChunks(srcInfo.Hash, f)
+	}
+	key := s.dataKey(s.KeyFromPath(repoPath, srcInfo), srcInfo)
 	input := &s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
-	_, err := s.downloader.Download(ctx, f, input)
-	return err
+	n, err := s.downloader.Download(s.ctx, f, input)
+	if err != nil {
+		return s.objectError("download", key, err)
+	}
+	if srcInfo.Hash != "" {
+		return s.checkHash(f, 0, n, key, srcInfo.Hash)
+	}
+	return s.checkObjectChecksum(input, f)
 }
 
 func (s *S3Source) Database(
@@ -380,6 +934,8 @@ func (s *S3Source) Database(
 	}
 	s.db = database.Database{}
 	s.extraKeys = map[string]time.Time{}
+	s.extraSizes = map[string]int64{}
+	s.content = map[string]string{}
 	lister, err := s3lister.New(s3lister.WithS3Client(s.s3Client))
 	if err != nil {
 		return nil, err
@@ -392,12 +948,13 @@ func (s *S3Source) Database(
 		Bucket: &s.bucket,
 		Prefix: &prefix,
 	}
+	cache := filter.NewCache(repoRules, filters...)
 	err = lister.List(
-		context.Background(),
+		s.ctx,
 		input,
 		func(objects []types.Object) {
 			for _, object := range objects {
-				s.dbHandleObject(object, repoRules, filters)
+				s.dbHandleObject(object, cache)
 			}
 		},
 	)
@@ -407,18 +964,27 @@ func (s *S3Source) Database(
 	return s.db, nil
 }
 
-func (s *S3Source) dbHandleObject(
-	object types.Object,
-	repoRules bool,
-	filters []*filter.Filter,
-) {
-	if *object.Key == filepath.Join(s.prefix, repofiles.Busy) {
+func (s *S3Source) dbHandleObject(object types.Object, cache *filter.Cache) {
+	if *object.Key == path.Join(s.prefix, repofiles.Busy) ||
+		*object.Key == path.Join(s.prefix, repofiles.Retention) ||
+		*object.Key == path.Join(s.prefix, repofiles.Canary) ||
+		*object.Key == path.Join(s.prefix, repofiles.RepoDbHead) ||
+		*object.Key == path.Join(s.prefix, repofiles.Protected) ||
+		strings.HasPrefix(*object.Key, path.Join(s.prefix, repofiles.Audit)+"/") {
+		return
+	}
+	if hash := path.Base(*object.Key); hashRe.MatchString(hash) &&
+		*object.Key == s.ContentKey(hash) {
+		s.withDbLock(func() {
+			s.content[hash] = *object.Key
+		})
 		return
 	}
 	fi := s.KeyToFileInfo(*object.Key, *object.Size)
 	if fi == nil {
 		s.withDbLock(func() {
 			s.extraKeys[*object.Key] = *object.LastModified
+			s.extraSizes[*object.Key] = *object.Size
 		})
 		return
 	}
@@ -431,16 +997,18 @@ func (s *S3Source) dbHandleObject(
 				// without deleting an old one.
 				s.extraKeys[s.KeyFromPath(fi.Path, existing)] = existing.ModTime
 				s.db[fi.Path] = fi
+				s.noteListedKey(fi.Path, *object.Key)
 			} else {
 				// This is an older version than the one we already saw.
-				s.extraKeys[s.KeyFromPath(fi.Path, fi)] = fi.ModTime
+				s.extraKeys[*object.Key] = fi.ModTime
 			}
 		} else {
-			included, _ := filter.IsIncluded(fi.Path, repoRules, filters...)
+			included, _ := cache.IsIncluded(fi.Path)
 			if included {
 				s.db[fi.Path] = fi
+				s.noteListedKey(fi.Path, *object.Key)
 			} else if !strings.HasPrefix(fi.Path, repofiles.Top+"/") {
-				s.extraKeys[s.KeyFromPath(fi.Path, fi)] = fi.ModTime
+				s.extraKeys[*object.Key] = fi.ModTime
 			}
 		}
 	})
@@ -449,3 +1017,103 @@ func (s *S3Source) dbHandleObject(
 func (s *S3Source) ExtraKeys() map[string]time.Time {
 	return s.extraKeys
 }
+
+// ExtraKeySize returns the size of an extra key that qfs didn't store, such as
+// one stored by aws s3 sync. The second return value is false for other keys.
+func (s *S3Source) ExtraKeySize(key string) (int64, bool) {
+	size, ok := s.extraSizes[key]
+	return size, ok
+}
+
+// UnreferencedContent returns the keys of content objects found by Database
+// that are not referred to by any file in the database or by versioned, which
+// is the result of VersionHashes. Noncurrent versions of files still refer to
+// their contents since get and list-versions can retrieve them. The number of
+// files referring to each hash is counted, so contents shared by several files
+// are kept until the last of them is removed. The chunks of a chunked file are
+// referred to by its manifest.
+func (s *S3Source) UnreferencedContent(versioned map[string]bool) ([]string, error) {
+	refs := map[string]int{}
+	manifests := map[string]bool{}
+	s.withDbLock(func() {
+		for _, fi := range s.db {
+			if fi.Hash != "" {
+				refs[fi.Hash]++
+				if fi.Chunked {
+					manifests[fi.Hash] = true
+				}
+			}
+		}
+	})
+	for hash, chunked := range versioned {
+		refs[hash]++
+		if chunked {
+			manifests[hash] = true
+		}
+	}
+	for _, hash := range misc.SortedKeys(manifests) {
+		if _, ok := s.content[hash]; !ok {
+			// TEST: NOT COVERED. The manifest is missing, so there's nothing to count.
+			continue
+		}
+		chunks, err := s.readManifest(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			refs[c.hash]++
+		}
+	}
+	var keys []string
+	s.withDbLock(func() {
+		for hash, key := range s.content {
+			if refs[hash] == 0 {
+				keys = append(keys, key)
+			}
+		}
+	})
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// VersionHashes returns the hashes referred to by every version of every key
+// in the repository, mapped to whether each is a chunked file's manifest.
+// Delete markers don't refer to anything. Content objects are only removed
+// while the repository is locked, so call this with the lock held to ensure
+// that no push starts referring to a content object after this has been
+// called.
+func (s *S3Source) VersionHashes() (map[string]bool, error) {
+	lister, err := s3lister.New(s3lister.WithS3Client(s.s3Client))
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	hashes := map[string]bool{}
+	var mutex sync.Mutex
+	err = lister.ListVersions(
+		s.ctx,
+		&s3.ListObjectVersionsInput{
+			Bucket: &s.bucket,
+			Prefix: &prefix,
+		},
+		func(versions []types.ObjectVersion, _ []types.DeleteMarkerEntry) {
+			for _, v := range versions {
+				info := s.KeyToFileInfo(*v.Key, 0)
+				if info == nil || info.Hash == "" {
+					continue
+				}
+				mutex.Lock()
+				hashes[info.Hash] = hashes[info.Hash] || info.Chunked
+				mutex.Unlock()
+			}
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list versions in s3://%s/%s: %w", s.bucket, prefix, err)
+	}
+	return hashes, nil
+}
@@ -1,6 +1,24 @@
 package s3source
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 // This package is primarily tested through repo_test.
 
@@ -10,6 +28,7 @@ func TestPathRe(t *testing.T) {
 		base    string
 		fType   string
 		modTime string
+		ns      string
 		rest    string
 	}
 	cases := []testCase{
@@ -41,6 +60,21 @@ func TestPathRe(t *testing.T) {
 			modTime: "123",
 			rest:    "@@one@@two@@f,123,456",
 		},
+		{
+			path:    "a@f,123.000456,0644",
+			base:    "a",
+			fType:   "f",
+			modTime: "123",
+			ns:      "000456",
+			rest:    "0644",
+		},
+		{
+			path:    "a@f,123.456,0644",
+			base:    "",
+			fType:   "",
+			modTime: "",
+			rest:    "",
+		},
 		{
 			path:    "a@.@d,123,0777",
 			base:    "",
@@ -74,10 +108,407 @@ func TestPathRe(t *testing.T) {
 				if m[3] != c.modTime {
 					t.Errorf("wrong time: %s", m[3])
 				}
-				if m[4] != c.rest {
-					t.Errorf("wrong remainder: %s", m[4])
+				if m[4] != c.ns {
+					t.Errorf("wrong nanoseconds: %s", m[4])
+				}
+				if m[5] != c.rest {
+					t.Errorf("wrong remainder: %s", m[5])
 				}
 			}
 		})
 	}
 }
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts:  10,
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     time.Second,
+	}
+	for attempt, limit := range map[int]time.Duration{
+		1:   100 * time.Millisecond,
+		2:   200 * time.Millisecond,
+		4:   800 * time.Millisecond,
+		5:   time.Second,
+		100: time.Second,
+	} {
+		for range 20 {
+			d, err := p.BackoffDelay(attempt, nil)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if d < 0 || d > limit {
+				t.Errorf("attempt %d: delay %v exceeds %v", attempt, d, limit)
+			}
+		}
+	}
+	if d, _ := (RetryPolicy{MaxAttempts: 3}).BackoffDelay(1, nil); d != 0 {
+		t.Errorf("zero policy gave delay %v", d)
+	}
+}
+
+func TestContentKeys(t *testing.T) {
+	s := &S3Source{
+		prefix:     "prefix",
+		db:         database.Database{},
+		extraKeys:  map[string]time.Time{},
+		extraSizes: map[string]int64{},
+		content:    map[string]string{},
+	}
+	hash1 := strings.Repeat("ab", 32)
+	hash2 := strings.Repeat("cd", 32)
+	info := &fileinfo.FileInfo{
+		Path:        "a@b",
+		FileType:    fileinfo.TypeFile,
+		ModTime:     time.UnixMilli(1234),
+		Size:        56,
+		Permissions: 0o644,
+		Hash:        hash1,
+	}
+	key := s.KeyFromPath(info.Path, info)
+	if key != "prefix/a@@b@f,1234,0644,56,"+hash1 {
+		t.Errorf("wrong key: %s", key)
+	}
+	// The object is empty, so the size comes from the key.
+	back := s.KeyToFileInfo(key, 0)
+	if back == nil || back.Size != 56 || back.Hash != hash1 || back.Permissions != 0o644 {
+		t.Errorf("wrong info: %#v", back)
+	}
+	if s.ContentKey(hash1) != "prefix/.qfs/content/ab/"+hash1 {
+		t.Errorf("wrong content key: %s", s.ContentKey(hash1))
+	}
+	if s.dataKey(key, back) != s.ContentKey(hash1) {
+		t.Errorf("wrong data key")
+	}
+	if s.KeyToFileInfo("prefix/a@f,1234,0644,56,xyz", 0) != nil {
+		t.Errorf("invalid hash accepted")
+	}
+
+	// Nanoseconds are in the key only if the time isn't a whole millisecond.
+	info.ModTime = time.Unix(1, 234000567)
+	key = s.KeyFromPath(info.Path, info)
+	if key != "prefix/a@@b@f,1234.000567,0644,56,"+hash1 {
+		t.Errorf("wrong key: %s", key)
+	}
+	if back = s.KeyToFileInfo(key, 0); back == nil || !back.ModTime.Equal(info.ModTime) {
+		t.Errorf("wrong info: %#v", back)
+	}
+	info.ModTime = time.UnixMilli(1234)
+	key = s.KeyFromPath(info.Path, info)
+
+	// Contents are referenced by one or more files and are unreferenced when no
+	// file in the database refers to them.
+	unreferenced := func() []string {
+		t.Helper()
+		keys, err := s.UnreferencedContent(nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return keys
+	}
+	object := func(key string) types.Object {
+		return types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(0),
+			LastModified: aws.Time(time.UnixMilli(5678)),
+		}
+	}
+	for _, k := range []string{
+		key,
+		"prefix/c@f,1234,0644,56," + hash1,
+		s.ContentKey(hash1),
+		s.ContentKey(hash2),
+		"prefix/.qfs/content/xx/" + hash2,
+	} {
+		s.dbHandleObject(object(k), filter.NewCache(false))
+	}
+	if len(s.db) != 2 {
+		t.Errorf("wrong database: %#v", s.db)
+	}
+	if !reflect.DeepEqual(unreferenced(), []string{s.ContentKey(hash2)}) {
+		t.Errorf("wrong unreferenced content: %#v", unreferenced())
+	}
+	if _, ok := s.ExtraKeys()["prefix/.qfs/content/xx/"+hash2]; !ok {
+		t.Errorf("misplaced content key is not extra")
+	}
+	delete(s.db, "a@b")
+	if len(unreferenced()) != 1 {
+		t.Errorf("content shared with c was unreferenced")
+	}
+	delete(s.db, "c")
+	if len(unreferenced()) != 2 {
+		t.Errorf("wrong unreferenced content: %#v", unreferenced())
+	}
+	// Contents that a noncurrent version refers to are still referenced.
+	keys, err := s.UnreferencedContent(map[string]bool{hash1: false})
+	if err != nil || !reflect.DeepEqual(keys, []string{s.ContentKey(hash2)}) {
+		t.Errorf("wrong unreferenced content: %#v, %v", keys, err)
+	}
+}
+
+func TestObjectError(t *testing.T) {
+	s := &S3Source{bucket: "bucket"}
+	err := s.objectError("download", "prefix/x", fmt.Errorf("wrapped: %w", &types.InvalidObjectState{
+		StorageClass: types.StorageClassGlacier,
+	}))
+	if !errors.Is(err, ErrArchived) ||
+		err.Error() != "download s3://bucket/prefix/x: object is in storage class GLACIER: "+ErrArchived.Error() {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = s.objectError("download", "prefix/x", errors.New("potato"))
+	if errors.Is(err, ErrArchived) || err.Error() != "download s3://bucket/prefix/x: potato" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	for algorithm, exp := range map[types.ChecksumAlgorithm]string{
+		types.ChecksumAlgorithmSha256: "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+		types.ChecksumAlgorithmSha1:   "qvTGHdzF6KLavt4PO0gs2a6pQ00=",
+		types.ChecksumAlgorithmCrc32c: "mnG7TA==",
+		types.ChecksumAlgorithmCrc32:  "NhCmhg==",
+	} {
+		actual, err := computeChecksum(algorithm, strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err.Error())
+		} else if actual != exp {
+			t.Errorf("%s: got %s", algorithm, actual)
+		}
+	}
+
+	// Checksums of parts' checksums are skipped.
+	algorithm, value := objectChecksum(&s3.HeadObjectOutput{
+		ChecksumSHA256: aws.String("LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=-2"),
+		ChecksumCRC32:  aws.String("NhCmhg=="),
+	})
+	if algorithm != types.ChecksumAlgorithmCrc32 || value != "NhCmhg==" {
+		t.Errorf("wrong checksum: %s %s", algorithm, value)
+	}
+	if algorithm, value = objectChecksum(&s3.HeadObjectOutput{}); algorithm != "" || value != "" {
+		t.Errorf("wrong checksum: %s %s", algorithm, value)
+	}
+
+	s := &S3Source{bucket: "bucket"}
+	hash := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	r := strings.NewReader("potato hello")
+	if err := s.checkHash(r, 7, 5, "prefix/x", hash); err != nil {
+		t.Error(err.Error())
+	}
+	err := s.checkHash(r, 0, 5, "prefix/x", hash)
+	if !errors.Is(err, fileinfo.ErrChecksumMismatch) ||
+		!strings.HasPrefix(err.Error(), "download s3://bucket/prefix/x: contents don't match checksum: expected SHA256 "+hash+", got ") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestKeyVersions(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	infos := []*fileinfo.FileInfo{
+		{Path: "a@b", FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(1234), Permissions: 0o644},
+		{Path: "d", FileType: fileinfo.TypeDirectory, ModTime: time.Unix(1, 234000567), Permissions: 0o755},
+		{Path: "c", FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(1234), Size: 56, Permissions: 0o600, Hash: hash, Chunked: true},
+		{Path: "l", FileType: fileinfo.TypeLink, ModTime: time.UnixMilli(1234), Special: "../x@y;target=z"},
+	}
+	exp := []string{
+		"prefix/a@@b@2;f;1234;mode=0644",
+		"prefix/d@2;d;1234.000567;mode=0755",
+		"prefix/c@2;f;1234;mode=0600;size=56;hash=" + hash + ";chunked",
+		"prefix/l@2;l;1234;target=../x@@y;target=z",
+	}
+	s := &S3Source{prefix: "prefix", keyVersion: KeyVersion2}
+	for i, info := range infos {
+		key := s.KeyFromPath(info.Path, info)
+		if key != exp[i] {
+			t.Errorf("wrong key: %s", key)
+		}
+		back := s.KeyToFileInfo(key, 0)
+		if back == nil ||
+			back.Path != info.Path ||
+			back.FileType != info.FileType ||
+			!back.ModTime.Equal(info.ModTime) ||
+			back.Size != info.Size ||
+			back.Hash != info.Hash ||
+			back.Chunked != info.Chunked ||
+			back.Special != info.Special ||
+			(info.FileType != fileinfo.TypeLink && back.Permissions != info.Permissions) {
+			t.Errorf("%s: wrong info: %#v", key, back)
+		}
+		if v := s.KeyVersionOf(key); v != KeyVersion2 {
+			t.Errorf("%s: wrong version %d", key, v)
+		}
+		v1 := s.KeyForVersion(info.Path, info, KeyVersion1)
+		if v := s.KeyVersionOf(v1); v != KeyVersion1 {
+			t.Errorf("%s: wrong version %d", v1, v)
+		}
+	}
+	// Fields that aren't known are ignored.
+	if back := s.KeyToFileInfo("prefix/x@2;f;1234;xattr=1;mode=0644;future", 5); back == nil ||
+		back.Permissions != 0o644 || back.Size != 5 {
+		t.Errorf("wrong info: %#v", back)
+	}
+	for _, key := range []string{
+		"prefix/x@2;f;1234",
+		"prefix/x@2;f;1234;mode=644",
+		"prefix/x@2;l;1234;mode=0777",
+		"prefix/x@2;f;1234;mode=0644;size=1;hash=xyz",
+		"prefix/x@3;f;1234;mode=0644",
+		"prefix/.qfs/content/ab/" + hash,
+	} {
+		if s.KeyToFileInfo(key, 0) != nil || s.KeyVersionOf(key) != 0 {
+			t.Errorf("%s: invalid key accepted", key)
+		}
+	}
+
+	// Without WithKeyVersion, the key of a listed object is used, and new keys
+	// have the highest version seen.
+	s = &S3Source{prefix: "prefix"}
+	if key := s.KeyFromPath(infos[0].Path, infos[0]); key != "prefix/a@@b@f,1234,0644" {
+		t.Errorf("wrong key: %s", key)
+	}
+	s.noteListedKey("d", s.KeyForVersion("d", infos[1], KeyVersion1))
+	if s.KeyToFileInfo(exp[2], 0) == nil {
+		t.Errorf("parse failed")
+	}
+	if key := s.KeyFromPath(infos[0].Path, infos[0]); key != exp[0] {
+		t.Errorf("wrong key: %s", key)
+	}
+	if key := s.KeyFromPath(infos[1].Path, infos[1]); key != "prefix/d@d,1234.000567,0755" {
+		t.Errorf("wrong key: %s", key)
+	}
+}
+
+func TestListingCache(t *testing.T) {
+	keys := []string{
+		"home/.@d,1000,0755",
+		"home/a@f,1000,0644",
+		"home/b@f,2000,0644",
+		"home/b@f,1000,0644",
+		"home/link@l,1000,../x/y",
+		"home/sub/c@f,1000,0644",
+		"home/sub@d,1000,0755",
+	}
+	var listings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		delimiter := r.URL.Query().Get("delimiter")
+		listings = append(listings, prefix+" "+delimiter)
+		_, _ = fmt.Fprint(w, "<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>")
+		seen := map[string]bool{}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(key, prefix)
+			if i := strings.Index(rest, "/"); delimiter != "" && i >= 0 {
+				p := prefix + rest[:i+1]
+				if !seen[p] {
+					seen[p] = true
+					_, _ = fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", p)
+				}
+				continue
+			}
+			_, _ = fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>0</Size></Contents>", key)
+		}
+		_, _ = fmt.Fprint(w, "</ListBucketResult>")
+	}))
+	defer server.Close()
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+	s, err := New("bucket", "home", WithS3Client(client))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	check := func(path string, exp *fileinfo.FileInfo) {
+		t.Helper()
+		fi, err := s.FileInfo(path)
+		if exp == nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: wrong error: %v", path, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if fi.FileType != exp.FileType || !fi.ModTime.Equal(exp.ModTime) || fi.Special != exp.Special {
+			t.Errorf("%s: wrong info: %#v", path, fi)
+		}
+	}
+	check("a", &fileinfo.FileInfo{FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(1000)})
+	check("b", &fileinfo.FileInfo{FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(2000)})
+	check("link", &fileinfo.FileInfo{FileType: fileinfo.TypeLink, ModTime: time.UnixMilli(1000), Special: "../x/y"})
+	check("sub", &fileinfo.FileInfo{FileType: fileinfo.TypeDirectory, ModTime: time.UnixMilli(1000)})
+	check(".", &fileinfo.FileInfo{FileType: fileinfo.TypeDirectory, ModTime: time.UnixMilli(1000)})
+	check("missing", nil)
+	check("sub/c", &fileinfo.FileInfo{FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(1000)})
+	check("sub/d", nil)
+	exp := []string{"home/ /", "home/link@l,1000,../ ", "home/sub/ /"}
+	if !reflect.DeepEqual(listings, exp) {
+		t.Errorf("wrong listings: %q", listings)
+	}
+
+	// Changing a directory discards its listing.
+	listings = nil
+	s.invalidateListing("a")
+	check("b", &fileinfo.FileInfo{FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(2000)})
+	check("sub/c", &fileinfo.FileInfo{FileType: fileinfo.TypeFile, ModTime: time.UnixMilli(1000)})
+	if len(listings) != 2 || listings[0] != "home/ /" {
+		t.Errorf("wrong listings: %q", listings)
+	}
+}
+
+func TestStoreStream(t *testing.T) {
+	var puts []string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = fmt.Fprint(w, "<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated></ListBucketResult>")
+		case http.MethodPut:
+			puts = append(puts, r.URL.Path)
+			body, _ = io.ReadAll(r.Body)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+	db := database.Database{}
+	s, err := New("bucket", "home", WithS3Client(client), WithDatabase(db))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info := &fileinfo.FileInfo{
+		FileType:    fileinfo.TypeFile,
+		ModTime:     time.UnixMilli(1000),
+		Permissions: 0o644,
+	}
+	err = s.StoreStream(".qfs/db/repo", info, io.MultiReader(strings.NewReader("potato"), strings.NewReader("salad")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(puts, []string{"/bucket/home/.qfs/db/repo@f,1000,0644"}) {
+		t.Errorf("wrong puts: %q", puts)
+	}
+	if !strings.Contains(string(body), "potatosalad") {
+		t.Errorf("wrong body: %q", body)
+	}
+	if info.Size != 11 {
+		t.Errorf("wrong size: %d", info.Size)
+	}
+	if fi := db[".qfs/db/repo"]; fi == nil || fi.Size != 11 || !fi.ModTime.Equal(info.ModTime) {
+		t.Errorf("database not updated: %#v", fi)
+	}
+	err = s.StoreStream("x", &fileinfo.FileInfo{FileType: fileinfo.TypeLink}, strings.NewReader(""))
+	if err == nil || err.Error() != "can only stream regular files" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	Register("file", ProviderFunc(fileProvider))
+	Register("http", ProviderFunc(httpProvider))
+	Register("https", ProviderFunc(httpProvider))
+	Register("mtree", ProviderFunc(mtreeProvider))
+}
+
+// fileProvider handles file:// URIs, which refer to local directories or
+// databases.
+func fileProvider(input string, config *Config) (database.Database, error) {
+	path, ok := strings.CutPrefix(input, "file://")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("%s: file input must be file://path", input)
+	}
+	s, err := New(
+		path,
+		WithFilters(config.Filters),
+		WithFilesOnly(config.FilesOnly),
+		WithNoSpecial(config.NoSpecial),
+		WithContext(config.Context),
+	)
+	if err != nil {
+		// TEST: NOT COVERED. New never returns an error.
+		return nil, err
+	}
+	return s.Run()
+}
+
+// mtreeProvider handles mtree:path, which refers to a local mtree
+// specification.
+func mtreeProvider(input string, config *Config) (database.Database, error) {
+	path := input[len("mtree:"):]
+	if path == "" {
+		return nil, fmt.Errorf("%s: mtree input must be mtree:path", input)
+	}
+	return database.LoadMtree(
+		fileinfo.NewPath(localsource.New(""), path),
+		database.WithFilters(config.Filters),
+		database.WithFilesOnly(config.FilesOnly),
+		database.WithNoSpecial(config.NoSpecial),
+	)
+}
+
+// httpProvider loads a database from an HTTP or HTTPS URL.
+func httpProvider(input string, config *Config) (database.Database, error) {
+	return database.Load(
+		fileinfo.NewPath(httpSource{ctx: config.Context}, input),
+		database.WithFilters(config.Filters),
+		database.WithFilesOnly(config.FilesOnly),
+		database.WithNoSpecial(config.NoSpecial),
+	)
+}
+
+// httpSource is a minimal fileinfo.Source that can only open URLs. It is used to
+// load databases directly from web servers.
+type httpSource struct {
+	ctx context.Context
+}
+
+var errHttpSource = errors.New("operation not supported for http sources")
+
+func (httpSource) FullPath(path string) string {
+	return path
+}
+
+func (httpSource) FileInfo(string) (*fileinfo.FileInfo, error) {
+	return nil, errHttpSource
+}
+
+// Open retrieves a URL. Responses are cached in the user's cache directory, and
+// a cached response is revalidated with a conditional GET, so a database that
+// hasn't changed on the server is not downloaded again. If there is no cache
+// directory, the URL is retrieved without caching.
+func (s httpSource) Open(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	cache := httpCacheFor(path)
+	var cached *httpCacheInfo
+	if cache != nil {
+		cached = cache.load()
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		_ = resp.Body.Close()
+		if f, err := os.Open(cache.body); err == nil {
+			return f, nil
+		}
+		// TEST: NOT COVERED. The cached body disappeared after its metadata was read,
+		// so retrieve it again without revalidating.
+		cache.remove()
+		return s.Open(path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("get %s: %s", path, resp.Status)
+	}
+	if cache == nil || (resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
+		// There's no way to revalidate the response, so don't cache it.
+		return resp.Body, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return cache.store(resp)
+}
+
+func (httpSource) Remove(string) error {
+	return errHttpSource
+}
+
+func (httpSource) Download(string, *fileinfo.FileInfo, *os.File) error {
+	return errHttpSource
+}
+
+// httpCache is the location of a URL's cached response. The body is stored in
+// one file and the validators needed for a conditional GET in another.
+type httpCache struct {
+	body string
+	info string
+}
+
+type httpCacheInfo struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func httpCacheFor(url string) *httpCache {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil
+	}
+	sum := sha256.Sum256([]byte(url))
+	base := filepath.Join(dir, "qfs", "http", hex.EncodeToString(sum[:]))
+	return &httpCache{
+		body: base,
+		info: base + ".json",
+	}
+}
+
+// load returns the validators of the cached response or nil if there is
+// nothing usable in the cache.
+func (c *httpCache) load() *httpCacheInfo {
+	data, err := os.ReadFile(c.info)
+	if err != nil {
+		return nil
+	}
+	info := &httpCacheInfo{}
+	if err = json.Unmarshal(data, info); err != nil || (info.ETag == "" && info.LastModified == "") {
+		return nil
+	}
+	if _, err = os.Stat(c.body); err != nil {
+		return nil
+	}
+	return info
+}
+
+func (c *httpCache) remove() {
+	_ = os.Remove(c.info)
+	_ = os.Remove(c.body)
+}
+
+// store writes the body of resp and its validators to the cache and returns the
+// body. The cache only saves downloads, so if it can't be written, the problem
+// is reported, and the body is returned anyway. The body is read into memory
+// so it is available whether or not it was cached, but loading the database
+// takes more memory than that.
+func (c *httpCache) store(resp *http.Response) (io.ReadCloser, error) {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", resp.Request.URL, err)
+	}
+	if err = c.write(resp, data); err != nil {
+		c.remove()
+		misc.Message("unable to cache %s: %v", resp.Request.URL, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *httpCache) write(resp *http.Response, body []byte) error {
+	c.remove()
+	f, err := misc.CreateAtomic(c.body)
+	if err != nil {
+		return err
+	}
+	defer f.Discard()
+	if _, err = f.Write(body); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	if err = f.Commit(); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	data, _ := json.Marshal(&httpCacheInfo{
+		URL:          resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	return os.WriteFile(c.info, data, 0o666)
+}
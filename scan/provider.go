@@ -0,0 +1,96 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/misc"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A Provider creates databases for scan inputs that start with a registered URI
+// scheme. Providers are registered with Register, after which any command that
+// accepts a scan input accepts inputs with the provider's scheme. Inputs that
+// don't start with a registered scheme are local directories or databases.
+type Provider interface {
+	Database(input string, config *Config) (database.Database, error)
+}
+
+// A Lister is optionally implemented by a Provider whose inputs are not
+// databases. When scanning such an input, its listing is written directly to
+// the output instead. Such inputs can't be used where a database is required.
+type Lister interface {
+	List(input string, config *Config, w io.Writer) error
+}
+
+// ProviderFunc adapts an ordinary function to a Provider.
+type ProviderFunc func(input string, config *Config) (database.Database, error)
+
+func (fn ProviderFunc) Database(input string, config *Config) (database.Database, error) {
+	return fn(input, config)
+}
+
+// Config is passed to a Provider with the scan's options. Providers should apply
+// the filters and FilesOnly and NoSpecial if they can.
+type Config struct {
+	// Context is canceled if the scan should stop.
+	Context   context.Context
+	Filters   []*filter.Filter
+	FilesOnly bool
+	NoSpecial bool
+	// Top is the local directory to use for inputs that depend on one, such as
+	// the repository. If empty, the current directory is used.
+	Top string
+	// Offline asks the provider to use local copies instead of accessing remote
+	// storage. A provider that can't do that should fail.
+	Offline bool
+	// Long requests additional detail from a Lister.
+	Long bool
+}
+
+// A scheme has at least two characters so Windows drive letters are not
+// mistaken for schemes.
+var schemeRe = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]+):`)
+
+var providersMutex sync.Mutex
+var providers = map[string]Provider{}
+
+// Register makes p the provider for inputs that start with scheme followed by a
+// colon. The scheme is case-insensitive. Registering a scheme again replaces
+// the previous provider, and registering nil removes it.
+func Register(scheme string, p Provider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	scheme = strings.ToLower(scheme)
+	if !schemeRe.MatchString(scheme + ":") {
+		panic(fmt.Sprintf("scan.Register: invalid scheme %q", scheme))
+	}
+	if p == nil {
+		delete(providers, scheme)
+	} else {
+		providers[scheme] = p
+	}
+}
+
+// Schemes returns the registered schemes in sorted order.
+func Schemes() []string {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	return misc.SortedKeys(providers)
+}
+
+// ProviderFor returns the provider for input's scheme, if any.
+func ProviderFor(input string) (Provider, bool) {
+	m := schemeRe.FindStringSubmatch(input)
+	if m == nil {
+		return nil, false
+	}
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	p, ok := providers[strings.ToLower(m[1])]
+	return p, ok
+}
@@ -1,8 +1,12 @@
 package scan
 
 import (
+	"context"
+	"fmt"
 	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/localsource"
 	"github.com/jberkenbilt/qfs/traverse"
 	"os"
 )
@@ -10,16 +14,26 @@ import (
 type Options func(*Scan)
 
 type Scan struct {
-	input     string
-	filters   []*filter.Filter
-	sameDev   bool
-	cleanup   bool
-	filesOnly bool
-	noSpecial bool
+	ctx        context.Context
+	input      string
+	filters    []*filter.Filter
+	sameDev    bool
+	cleanup    bool
+	filesOnly  bool
+	noSpecial  bool
+	follow     bool
+	birthTimes bool
+	nanosecs   bool
+	pathMap    *localsource.PathMap
+	checksum   string
+	top        string
+	offline    bool
+	stats      *traverse.Stats
 }
 
 func New(input string, options ...Options) (*Scan, error) {
 	q := &Scan{
+		ctx:   context.Background(),
 		input: input,
 	}
 	for _, fn := range options {
@@ -52,29 +66,122 @@ func WithNoSpecial(noSpecial bool) func(*Scan) {
 	}
 }
 
+// WithFollowDirLinks causes symbolic links to directories to be followed when
+// scanning a local directory. See traverse.WithFollowDirLinks.
+func WithFollowDirLinks(follow bool) func(*Scan) {
+	return func(s *Scan) {
+		s.follow = follow
+	}
+}
+
 func WithFilesOnly(filesOnly bool) func(*Scan) {
 	return func(s *Scan) {
 		s.filesOnly = filesOnly
 	}
 }
 
-// Run scans the input source per the scanner's configuration. The caller must
-// call Close on the resulting provider.
+// WithBirthTimes causes files' creation times to be captured when scanning a
+// local directory. See traverse.WithBirthTimes.
+func WithBirthTimes(birthTimes bool) func(*Scan) {
+	return func(s *Scan) {
+		s.birthTimes = birthTimes
+	}
+}
+
+// WithNanoseconds causes modification times to be captured with nanosecond
+// precision when scanning a local directory. See traverse.WithNanoseconds.
+func WithNanoseconds(nanoseconds bool) func(*Scan) {
+	return func(s *Scan) {
+		s.nanosecs = nanoseconds
+	}
+}
+
+// WithPathMap causes a local directory to be scanned as if the files were at
+// the paths from which pathMap rewrites them. See traverse.WithPathMap.
+func WithPathMap(pathMap *localsource.PathMap) func(*Scan) {
+	return func(s *Scan) {
+		s.pathMap = pathMap
+	}
+}
+
+// WithStats causes measurements to be stored in stats when scanning a local
+// directory. See traverse.WithStats.
+func WithStats(stats *traverse.Stats) func(*Scan) {
+	return func(s *Scan) {
+		s.stats = stats
+	}
+}
+
+// WithChecksum causes the checksum of each regular file, computed with the
+// given algorithm, to be saved when scanning a local directory. See
+// traverse.WithChecksum.
+func WithChecksum(algorithm string) func(*Scan) {
+	return func(s *Scan) {
+		s.checksum = algorithm
+	}
+}
+
+// WithTop sets the local top-level directory passed to providers that need one,
+// such as the repository provider.
+func WithTop(top string) func(*Scan) {
+	return func(s *Scan) {
+		s.top = top
+	}
+}
+
+// WithOffline asks providers not to access remote storage. See Config.Offline.
+func WithOffline(offline bool) func(*Scan) {
+	return func(s *Scan) {
+		s.offline = offline
+	}
+}
+
+// WithContext sets a context that stops the scan when canceled. It is also
+// passed to providers.
+func WithContext(ctx context.Context) func(*Scan) {
+	return func(s *Scan) {
+		s.ctx = ctx
+	}
+}
+
+func (s *Scan) config() *Config {
+	return &Config{
+		Context:   s.ctx,
+		Filters:   s.filters,
+		FilesOnly: s.filesOnly,
+		NoSpecial: s.noSpecial,
+		Top:       s.top,
+		Offline:   s.offline,
+	}
+}
+
+// provider returns the provider for the input, or nil if the input is a local
+// directory or database.
+func (s *Scan) provider() (Provider, error) {
+	p, ok := ProviderFor(s.input)
+	if !ok {
+		return nil, nil
+	}
+	if _, isLister := p.(Lister); isLister {
+		return nil, fmt.Errorf("%s: input can only be listed, not used as a database", s.input)
+	}
+	return p, nil
+}
+
+// Run scans the input source per the scanner's configuration. Inputs with a
+// registered scheme are passed to the scheme's provider.
 func (s *Scan) Run() (database.Database, error) {
+	if p, err := s.provider(); err != nil {
+		return nil, err
+	} else if p != nil {
+		return p.Database(s.input, s.config())
+	}
 	st, err := os.Stat(s.input)
 	if err != nil {
 		return nil, err
 	}
 	if st.IsDir() {
-		var tr *traverse.Traverser
-		tr, err = traverse.New(
-			s.input,
-			traverse.WithFilters(s.filters),
-			traverse.WithSameDev(s.sameDev),
-			traverse.WithCleanup(s.cleanup),
-			traverse.WithFilesOnly(s.filesOnly),
-			traverse.WithNoSpecial(s.noSpecial),
-		)
+		tr, err := s.traverser()
 		if err != nil {
 			// TEST: NOT COVERED. By this point, any error returned by Traverse has already
 			// been caught.
@@ -86,11 +193,67 @@ func (s *Scan) Run() (database.Database, error) {
 		}
 		return result.Database(), nil
 	} else {
-		return database.LoadFile(
-			s.input,
-			database.WithFilters(s.filters),
-			database.WithFilesOnly(s.filesOnly),
-			database.WithNoSpecial(s.noSpecial),
-		)
+		return s.load()
 	}
 }
+
+// Stream is like Run but calls fn for each item in lexical order by path. When
+// scanning a directory, items are passed to fn as soon as they are found, so
+// the whole result is never held in memory. This makes it suitable for writing a
+// database of a very large directory tree with database.Writer. Databases
+// and provider inputs are loaded fully before fn is called.
+func (s *Scan) Stream(fn func(*fileinfo.FileInfo) error) error {
+	if p, err := s.provider(); err != nil {
+		return err
+	} else if p != nil {
+		files, err := p.Database(s.input, s.config())
+		if err != nil {
+			return err
+		}
+		return files.ForEach(fn)
+	}
+	st, err := os.Stat(s.input)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		tr, err := s.traverser()
+		if err != nil {
+			// TEST: NOT COVERED. See Run.
+			return err
+		}
+		return tr.Stream(fn, nil, nil)
+	}
+	files, err := s.load()
+	if err != nil {
+		return err
+	}
+	return files.ForEach(fn)
+}
+
+func (s *Scan) traverser() (*traverse.Traverser, error) {
+	return traverse.New(
+		s.input,
+		traverse.WithFilters(s.filters),
+		traverse.WithSameDev(s.sameDev),
+		traverse.WithCleanup(s.cleanup),
+		traverse.WithFilesOnly(s.filesOnly),
+		traverse.WithNoSpecial(s.noSpecial),
+		traverse.WithFollowDirLinks(s.follow),
+		traverse.WithBirthTimes(s.birthTimes),
+		traverse.WithNanoseconds(s.nanosecs),
+		traverse.WithPathMap(s.pathMap),
+		traverse.WithStats(s.stats),
+		traverse.WithChecksum(s.checksum),
+		traverse.WithContext(s.ctx),
+	)
+}
+
+func (s *Scan) load() (database.Database, error) {
+	return database.LoadFile(
+		s.input,
+		database.WithFilters(s.filters),
+		database.WithFilesOnly(s.filesOnly),
+		database.WithNoSpecial(s.noSpecial),
+	)
+}
@@ -0,0 +1,217 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// On a case-insensitive file system, such as the default file systems on macOS
+// and Windows, two paths that differ only in case refer to the same file, so
+// copying both would silently leave only one of them. Such pairs are reported
+// as case collisions. Optionally, the file being added is written under a
+// different name instead.
+
+// TestCaseInsensitive is set by the test suite to make every destination be
+// treated as case-insensitive.
+var TestCaseInsensitive bool
+
+// CaseCollision is a path that would be added but that differs only in case
+// from Other, another path that would exist after the changes are applied.
+type CaseCollision struct {
+	Path  string
+	Other string
+}
+
+func (c *CaseCollision) String() string {
+	return fmt.Sprintf("case collision: %s and %s", c.Path, c.Other)
+}
+
+// CaseInsensitive returns true if dir is on a file system that ignores case in
+// file names. It looks up an existing entry of dir with the case of its name
+// swapped. If dir has no suitable entry, it creates a temporary file, after
+// which it restores dir's modification time.
+func CaseInsensitive(dir string) (bool, error) {
+	if TestCaseInsensitive {
+		return true, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	for _, e := range entries {
+		swapped := swapCase(e.Name())
+		if swapped != e.Name() && !names[swapped] {
+			return sameFile(filepath.Join(dir, e.Name()), filepath.Join(dir, swapped))
+		}
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	f, err := os.CreateTemp(dir, ".qfs-case-*")
+	if err != nil {
+		return false, err
+	}
+	name := f.Name()
+	_ = f.Close()
+	defer func() {
+		_ = os.Remove(name)
+		_ = os.Chtimes(dir, time.Time{}, st.ModTime())
+	}()
+	return sameFile(name, filepath.Join(dir, swapCase(filepath.Base(name))))
+}
+
+// swapCase returns s with upper-case letters changed to lower case and vice
+// versa.
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+// sameFile returns true if other is another name for the existing file path.
+func sameFile(path, other string) (bool, error) {
+	st1, err := os.Lstat(path)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	st2, err := os.Lstat(other)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	return os.SameFile(st1, st2), nil
+}
+
+// caseState returns the paths that would exist in destDb after diffResult is
+// applied, indexed by their lower-case forms, and the paths that would be
+// added, in order.
+func caseState(destDb database.Database, diffResult *diff.Result) (map[string][]string, []string) {
+	exists := map[string]bool{}
+	for p := range destDb {
+		exists[p] = true
+	}
+	for _, rm := range diffResult.Rm {
+		delete(exists, rm.Path)
+	}
+	var added []string
+	for _, a := range diffResult.Add {
+		added = append(added, a.Path)
+	}
+	for _, rn := range diffResult.Rename {
+		delete(exists, rn.Old.Path)
+		added = append(added, rn.New.Path)
+	}
+	for _, p := range added {
+		exists[p] = true
+	}
+	slices.Sort(added)
+	folded := map[string][]string{}
+	for p := range exists {
+		k := strings.ToLower(p)
+		folded[k] = append(folded[k], p)
+	}
+	for _, paths := range folded {
+		slices.Sort(paths)
+	}
+	return folded, added
+}
+
+// FindCaseCollisions returns the paths that applying diffResult to a
+// destination described by destDb would add and that differ only in case from
+// another path. When two added paths collide, the later one in sort order is
+// reported. Paths within a colliding directory are not reported separately.
+func FindCaseCollisions(destDb database.Database, diffResult *diff.Result) []*CaseCollision {
+	folded, added := caseState(destDb, diffResult)
+	var result []*CaseCollision
+	var collidingDirs []string
+	for _, p := range added {
+		if slices.ContainsFunc(collidingDirs, func(dir string) bool {
+			return strings.HasPrefix(p, dir+"/")
+		}) {
+			continue
+		}
+		paths := folded[strings.ToLower(p)]
+		if len(paths) < 2 || paths[0] == p && slices.Contains(added, paths[1]) {
+			// If another added path collides with this one, it is reported instead.
+			continue
+		}
+		other := paths[0]
+		if other == p {
+			other = paths[1]
+		}
+		result = append(result, &CaseCollision{Path: p, Other: other})
+		collidingDirs = append(collidingDirs, p)
+	}
+	return result
+}
+
+// CaseRenames returns, for each collision, the path at which the added file is
+// to be written instead. The new path adds .case-n before the file's
+// extension, using the smallest n that doesn't collide with anything. It also
+// removes those paths from the files diffResult would remove so that they
+// aren't removed on every run.
+func CaseRenames(destDb database.Database, diffResult *diff.Result, collisions []*CaseCollision) map[string]string {
+	folded, _ := caseState(destDb, diffResult)
+	renames := map[string]string{}
+	for _, c := range collisions {
+		dir, base := path.Split(c.Path)
+		ext := path.Ext(base)
+		if ext == base {
+			ext = ""
+		}
+		for n := 1; ; n++ {
+			newPath := fmt.Sprintf("%s%s.case-%d%s", dir, strings.TrimSuffix(base, ext), n, ext)
+			k := strings.ToLower(newPath)
+			if len(folded[k]) == 0 {
+				folded[k] = []string{newPath}
+				renames[c.Path] = newPath
+				break
+			}
+		}
+	}
+	diffResult.Rm = slices.DeleteFunc(diffResult.Rm, func(f *fileinfo.FileInfo) bool {
+		for _, newPath := range renames {
+			if f.Path == newPath || strings.HasPrefix(f.Path, newPath+"/") {
+				return true
+			}
+		}
+		return false
+	})
+	return renames
+}
+
+// caseRenamed returns the path at which p is written given renames from
+// CaseRenames. Paths within a renamed directory are written within its new path.
+func caseRenamed(renames map[string]string, p string) string {
+	for oldPath, newPath := range renames {
+		if p == oldPath {
+			return newPath
+		}
+		if strings.HasPrefix(p, oldPath+"/") {
+			return newPath + strings.TrimPrefix(p, oldPath)
+		}
+	}
+	return p
+}
@@ -0,0 +1,72 @@
+package sync
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"slices"
+)
+
+// Schedule determines the order in which ApplyChanges retrieves files.
+type Schedule int
+
+const (
+	// ScheduleDiff retrieves added files and then changed files, each in path
+	// order, as they appear in the diff.
+	ScheduleDiff Schedule = iota
+	// ScheduleLargest retrieves the largest files first so that the longest
+	// downloads overlap with everything else.
+	ScheduleLargest
+	// ScheduleInterleave alternates between the largest and smallest remaining
+	// files so that small files don't wait for all the large ones to start.
+	ScheduleInterleave
+)
+
+func ParseSchedule(s string) (Schedule, error) {
+	switch s {
+	case "diff":
+		return ScheduleDiff, nil
+	case "largest":
+		return ScheduleLargest, nil
+	case "interleave":
+		return ScheduleInterleave, nil
+	}
+	return ScheduleDiff, fmt.Errorf("schedule must be diff, largest, or interleave")
+}
+
+// order returns the entries of lists in the order in which they should be
+// retrieved. Entries that aren't regular files are cheap to create, so they
+// always come first in their original order.
+func (s Schedule) order(lists ...[]*fileinfo.FileInfo) []*fileinfo.FileInfo {
+	var result []*fileinfo.FileInfo
+	var files []*fileinfo.FileInfo
+	for _, list := range lists {
+		for _, info := range list {
+			if s != ScheduleDiff && info.FileType == fileinfo.TypeFile {
+				files = append(files, info)
+			} else {
+				result = append(result, info)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return result
+	}
+	// The sort is stable so that files of the same size stay in path order.
+	slices.SortStableFunc(files, func(a, b *fileinfo.FileInfo) int {
+		return cmp.Compare(b.Size, a.Size)
+	})
+	if s == ScheduleLargest {
+		return append(result, files...)
+	}
+	first, last := 0, len(files)-1
+	for first <= last {
+		result = append(result, files[first])
+		if first != last {
+			result = append(result, files[last])
+		}
+		first++
+		last--
+	}
+	return result
+}
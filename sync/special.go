@@ -0,0 +1,55 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// isSpecial returns true for pipes, sockets, and devices.
+func isSpecial(t fileinfo.FileType) bool {
+	switch t {
+	case fileinfo.TypePipe, fileinfo.TypeSocket, fileinfo.TypeCharDev, fileinfo.TypeBlockDev:
+		return true
+	}
+	return false
+}
+
+// isDevice returns true for character and block devices, which only root can
+// create.
+func isDevice(t fileinfo.FileType) bool {
+	return t == fileinfo.TypeCharDev || t == fileinfo.TypeBlockDev
+}
+
+// createSpecial creates the pipe, socket, or device described by info at
+// destPath. These have no contents, so they are created from info rather than
+// copied from the source. It returns false if destPath is already a special
+// file of the same kind with the same permissions.
+func createSpecial(info *fileinfo.FileInfo, destPath *fileinfo.Path) (bool, error) {
+	localPath := destPath.Path()
+	if cur, err := destPath.FileInfo(); err == nil &&
+		cur.FileType == info.FileType &&
+		cur.Special == info.Special &&
+		cur.Permissions == info.Permissions {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o777); err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	if err := os.RemoveAll(localPath); err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	if err := mknod(localPath, info); err != nil {
+		return false, fmt.Errorf("create %s: %w", localPath, err)
+	}
+	// The umask may have removed some permissions.
+	if err := os.Chmod(localPath, fs.FileMode(info.Permissions)); err != nil {
+		// TEST: NOT COVERED
+		return false, fmt.Errorf("set mode for %s: %w", localPath, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package sync
+
+import (
+	"fmt"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"syscall"
+)
+
+// mknod creates the special file described by info at path. Device numbers are
+// encoded the way localsource decodes them.
+func mknod(path string, info *fileinfo.FileInfo) error {
+	perm := uint32(info.Permissions)
+	switch info.FileType {
+	case fileinfo.TypePipe:
+		return syscall.Mkfifo(path, perm)
+	case fileinfo.TypeSocket:
+		return syscall.Mknod(path, syscall.S_IFSOCK|perm, 0)
+	}
+	var major, minor uint64
+	if _, err := fmt.Sscanf(info.Special, "%d,%d", &major, &minor); err != nil {
+		return fmt.Errorf("invalid device numbers %q", info.Special)
+	}
+	dev := minor&0xff | (major&0xfff)<<8 | (minor&0xfff00)<<12
+	mode := uint32(syscall.S_IFBLK)
+	if info.FileType == fileinfo.TypeCharDev {
+		mode = syscall.S_IFCHR
+	}
+	// TEST: NOT COVERED. Tests don't run as root.
+	return syscall.Mknod(path, mode|perm, int(dev))
+}
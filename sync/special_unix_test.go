@@ -0,0 +1,80 @@
+//go:build !windows
+
+package sync_test
+
+import (
+	"github.com/jberkenbilt/qfs/sync"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestSyncSpecial(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	for _, dir := range []string{"src/sub", "dest"} {
+		if err := os.MkdirAll(j(dir), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"src/sub/pipe", "dest/old-pipe"} {
+		if err := syscall.Mkfifo(j(path), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("unix", j("src/socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	sync1 := func(options ...sync.Options) []string {
+		t.Helper()
+		ui := &recordingUI{}
+		s, err := sync.New(j("src"), j("dest"), append(options, sync.WithUI(ui))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(ui.messages)
+		return ui.messages
+	}
+
+	// With -no-special, the pipe at the destination is left alone, and nothing
+	// is created.
+	if msgs := sync1(sync.WithNoSpecial(true)); len(msgs) != 0 {
+		t.Errorf("wrong messages: %v", msgs)
+	}
+	if _, err := os.Lstat(j("dest/socket")); err == nil {
+		t.Error("socket was created")
+	}
+
+	exp := []string{"copied socket", "copied sub/pipe", "removing old-pipe"}
+	if msgs := sync1(); !slices.Equal(msgs, exp) {
+		t.Errorf("wrong messages: %v", msgs)
+	}
+	for path, mode := range map[string]os.FileMode{
+		"sub/pipe": os.ModeNamedPipe,
+		"socket":   os.ModeSocket,
+	} {
+		st, err := os.Lstat(j("dest/" + path))
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if st.Mode().Type() != mode {
+			t.Errorf("%s: wrong type: %v", path, st.Mode())
+		}
+	}
+	if st, err := os.Lstat(j("dest/sub/pipe")); err == nil && st.Mode().Perm() != 0o640 {
+		t.Errorf("wrong permissions: %v", st.Mode())
+	}
+	if _, err := os.Lstat(j("dest/old-pipe")); err == nil {
+		t.Error("old-pipe was not removed")
+	}
+	if msgs := sync1(); len(msgs) != 0 {
+		t.Errorf("second sync made changes: %v", msgs)
+	}
+}
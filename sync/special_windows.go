@@ -0,0 +1,12 @@
+//go:build windows
+
+package sync
+
+import (
+	"errors"
+	"github.com/jberkenbilt/qfs/fileinfo"
+)
+
+func mknod(string, *fileinfo.FileInfo) error {
+	return errors.New("special files are not supported on Windows")
+}
@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
+	"os"
+	"path/filepath"
+	gosync "sync"
+)
+
+// When ApplyConfig.StageDir is given, regular files that have to be copied are
+// first retrieved into the staging directory without touching the destination.
+// Only once everything has been retrieved are renames, removals, and other
+// changes applied, and staged files are moved into place by renaming them,
+// which doesn't involve the source. If staging is interrupted, the destination
+// is unchanged, and files that were already staged aren't retrieved again next
+// time.
+
+// stageFiles retrieves the regular files that applying diffResult would copy
+// into stageDir and returns the set of staged paths. Files that dest already
+// has are not staged.
+func stageFiles(
+	ctx context.Context,
+	src fileinfo.Source,
+	dest fileinfo.Source,
+	diffResult *diff.Result,
+	config *ApplyConfig,
+	ui misc.UI,
+	numWorkers int,
+) (map[string]bool, error) {
+	var toStage []*fileinfo.FileInfo
+	for _, list := range [][]*fileinfo.FileInfo{diffResult.Add, diffResult.Change} {
+		for _, info := range list {
+			if info.FileType == fileinfo.TypeFile {
+				toStage = append(toStage, info)
+			}
+		}
+	}
+	for _, rn := range diffResult.Rename {
+		if rn.New.FileType != fileinfo.TypeFile {
+			continue
+		}
+		canMove := false
+		if caseRenamed(config.CaseRenames, rn.New.Path) == rn.New.Path {
+			var err error
+			canMove, err = canMoveRenamed(src, dest, rn)
+			if err != nil {
+				// TEST: NOT COVERED
+				return nil, err
+			}
+		}
+		if !canMove {
+			toStage = append(toStage, rn.New)
+		}
+	}
+	stage := localsource.New(config.StageDir)
+	staged := map[string]bool{}
+	progress := misc.NewProgress(ui, "staged", len(toStage))
+	var mutex gosync.Mutex
+	var allErrors []error
+	c := make(chan *fileinfo.FileInfo, numWorkers)
+	go func() {
+		for _, info := range config.Schedule.order(toStage) {
+			c <- info
+		}
+		close(c)
+	}()
+	misc.DoConcurrently(
+		func(c chan *fileinfo.FileInfo, errorChan chan error) {
+			for info := range c {
+				if ctx.Err() != nil {
+					continue
+				}
+				destRel := caseRenamed(config.CaseRenames, info.Path)
+				required, err := fileinfo.RequiresCopy(info, fileinfo.NewPath(dest, destRel))
+				if err != nil {
+					// TEST: NOT COVERED
+					errorChan <- err
+					continue
+				}
+				if !required {
+					continue
+				}
+				downloaded, err := fileinfo.Retrieve(fileinfo.NewPath(src, info.Path), fileinfo.NewPath(stage, destRel))
+				if err != nil {
+					if ctx.Err() == nil {
+						// TEST: NOT COVERED
+						errorChan <- fmt.Errorf("stage %s: %w", info.Path, err)
+					}
+					continue
+				}
+				mutex.Lock()
+				staged[info.Path] = true
+				mutex.Unlock()
+				if downloaded {
+					progress.File(info.Size, "staged %s", info.Path)
+				}
+			}
+		},
+		func(e error) {
+			// TEST: NOT COVERED
+			allErrors = append(allErrors, e)
+		},
+		c,
+		numWorkers,
+	)
+	progress.Done()
+	if len(allErrors) > 0 {
+		// TEST: NOT COVERED
+		return nil, errors.Join(allErrors...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// promoteStaged moves the staged copy of destRel into place in dest.
+func promoteStaged(stageDir string, destRel string, destPath *fileinfo.Path) error {
+	stagePath := fileinfo.NewPath(localsource.New(stageDir), destRel).Path()
+	err := os.MkdirAll(filepath.Dir(destPath.Path()), 0o777)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	return os.Rename(stagePath, destPath.Path())
+}
@@ -1,6 +1,10 @@
 package sync
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/jberkenbilt/qfs/database"
@@ -10,23 +14,45 @@ import (
 	"github.com/jberkenbilt/qfs/localsource"
 	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/scan"
+	"io"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	gosync "sync"
+	"time"
 )
 
 type Options func(*Sync)
 
 type Sync struct {
-	srcDir  string
-	destDir string
-	filters []*filter.Filter
-	noOp    bool
+	ctx        context.Context
+	srcDir     string
+	destDir    string
+	filters    []*filter.Filter
+	noOp       bool
+	backupDir  string
+	owners     *fileinfo.OwnerMap
+	symlinks   fileinfo.SymlinkMode
+	dirTimes   bool
+	renames    bool
+	renameCase bool
+	noSpecial  bool
+	pruneEmpty bool
+	noPerms    bool
+	window     time.Duration
+	pathMap    *localsource.PathMap
+	ui         misc.UI
 }
 
 func New(srcDir, destDir string, options ...Options) (*Sync, error) {
 	s := &Sync{
+		ctx:     context.Background(),
 		srcDir:  srcDir,
 		destDir: destDir,
+		ui:      misc.ConsoleUI{},
 	}
 	for _, fn := range options {
 		fn(s)
@@ -52,38 +78,409 @@ func WithNoOp(noOp bool) Options {
 	}
 }
 
+// WithBackupDir causes files that would be removed or overwritten to be moved
+// into a timestamped subdirectory of backupDir instead.
+func WithBackupDir(backupDir string) Options {
+	return func(s *Sync) {
+		s.backupDir = backupDir
+	}
+}
+
+// WithOwners causes copied files to be given the ownership of the source files,
+// mapped through owners. Ownerships are only changed when running as root.
+func WithOwners(owners *fileinfo.OwnerMap) Options {
+	return func(s *Sync) {
+		s.owners = owners
+	}
+}
+
+// WithSymlinks determines how symbolic links in the source are handled.
+func WithSymlinks(mode fileinfo.SymlinkMode) Options {
+	return func(s *Sync) {
+		s.symlinks = mode
+	}
+}
+
+// WithDirTimes causes directory modification times to be copied along with
+// the directories' contents.
+func WithDirTimes(dirTimes bool) Options {
+	return func(s *Sync) {
+		s.dirTimes = dirTimes
+	}
+}
+
+// WithRenames causes files that were moved or renamed in the source to be moved
+// in the destination instead of being copied again. See diff.WithRenames.
+func WithRenames(renames bool) Options {
+	return func(s *Sync) {
+		s.renames = renames
+	}
+}
+
+// WithNoPermissions causes permission changes to be ignored, so no directory or
+// file is chmodded just because its permissions differ. Files that are copied
+// still get the source's permissions. See diff.WithNoPermissions.
+func WithNoPermissions(noPerms bool) Options {
+	return func(s *Sync) {
+		s.noPerms = noPerms
+	}
+}
+
+// WithModifyWindow causes modification times that differ by no more than
+// window to be treated as the same. See diff.WithModifyWindow.
+func WithModifyWindow(window time.Duration) Options {
+	return func(s *Sync) {
+		s.window = window
+	}
+}
+
+// WithPathMap causes files to be written to the destination at the paths
+// given by pathMap. Paths in the source are rewritten; see
+// localsource.WithPathMap.
+func WithPathMap(pathMap *localsource.PathMap) Options {
+	return func(s *Sync) {
+		s.pathMap = pathMap
+	}
+}
+
+// WithRenameCaseCollisions causes files that would collide with other files on
+// a case-insensitive destination to be written under different names. Without
+// it, Sync fails if there are any such files. See CaseRenames.
+func WithRenameCaseCollisions(rename bool) Options {
+	return func(s *Sync) {
+		s.renameCase = rename
+	}
+}
+
+// WithNoSpecial causes pipes, sockets, and devices to be ignored in both the
+// source and the destination. Otherwise, they are created in the destination.
+// Devices are only created when running as root.
+func WithNoSpecial(noSpecial bool) Options {
+	return func(s *Sync) {
+		s.noSpecial = noSpecial
+	}
+}
+
+// WithPruneEmptyDirs causes directories that don't contain any files, links,
+// or special files, at any depth, to be left out of the destination, like
+// rsync --prune-empty-dirs. This includes directories whose contents are all
+// excluded by the filters. Such directories that are already in the
+// destination are removed.
+func WithPruneEmptyDirs(prune bool) Options {
+	return func(s *Sync) {
+		s.pruneEmpty = prune
+	}
+}
+
+// WithUI sets the UI used for messages and output. The default is
+// misc.ConsoleUI.
+func WithUI(ui misc.UI) Options {
+	return func(s *Sync) {
+		s.ui = ui
+	}
+}
+
+// WithContext sets the context for the sync. When it is canceled, the sync stops
+// after the files in progress have been copied.
+func WithContext(ctx context.Context) Options {
+	return func(s *Sync) {
+		s.ctx = ctx
+	}
+}
+
+// trashTimeFormat is the format of the names of the directories TrashDir
+// creates. Unlike misc.TimeFormat, it has no colons, which aren't allowed in
+// Windows file names.
+const trashTimeFormat = "2006-01-02_15-04-05.000"
+
+// TrashDir returns a new timestamped directory name within backupDir for use
+// with ApplyChanges.
+func TrashDir(backupDir string) string {
+	return filepath.Join(backupDir, time.Now().Local().Format(trashTimeFormat))
+}
+
+// isTrashDir returns whether name has the form of a directory name created by
+// TrashDir.
+func isTrashDir(name string) bool {
+	_, err := time.ParseInLocation(trashTimeFormat, name, time.Local)
+	return err == nil
+}
+
+// moveToTrash moves path, whose path relative to the top of the destination is
+// relPath, to the same relative location in trashDir. It returns false if path
+// doesn't exist.
+func moveToTrash(path, relPath, trashDir string) (bool, error) {
+	st, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	dest := filepath.Join(trashDir, relPath)
+	err = os.MkdirAll(filepath.Dir(dest), 0o777)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	// Moving a directory to a different parent requires the directory to be
+	// writable since its ".." entry changes.
+	mode := st.Mode()
+	if mode.IsDir() && mode.Perm()&0o200 == 0 {
+		err = os.Chmod(path, mode.Perm()|0o200)
+		if err != nil {
+			// TEST: NOT COVERED
+			return false, err
+		}
+		defer func() { _ = os.Chmod(dest, mode.Perm()) }()
+	}
+	err = os.Rename(path, dest)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, fmt.Errorf("move %s to trash: %w", path, err)
+	}
+	return true, nil
+}
+
+// removeTree removes path and, if it is a directory, everything in it.
+func removeTree(path string) error {
+	if st, err := os.Lstat(path); err == nil && st.IsDir() {
+		// Read-only directories beneath it would keep it from being removed.
+		if err = makeTreeWritable(path); err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// EmptyTrash removes the timestamped directories that TrashDir created in
+// backupDir and everything in them, first making any read-only directories
+// writable. Anything else in backupDir, and backupDir itself, is left alone, so
+// pointing backupDir at the wrong directory can't remove unrelated files. If ui
+// is nil, misc.ConsoleUI is used.
+func EmptyTrash(backupDir string, ui misc.UI) error {
+	if ui == nil {
+		ui = misc.ConsoleUI{}
+	}
+	entries, err := os.ReadDir(backupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		ui.Message("%s does not exist", backupDir)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	skipped := 0
+	for _, e := range entries {
+		if !e.IsDir() || !isTrashDir(e.Name()) {
+			skipped++
+			continue
+		}
+		path := filepath.Join(backupDir, e.Name())
+		if err = removeTree(path); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		ui.Message("removed %s", path)
+	}
+	if skipped > 0 {
+		ui.Message("%s: left %d entries that are not trash directories", backupDir, skipped)
+	}
+	return nil
+}
+
+// ApplyConfig holds optional behavior for ApplyChanges. A nil or zero
+// ApplyConfig removes files outright, leaves ownerships alone, and creates
+// symbolic links.
+type ApplyConfig struct {
+	// If TrashDir is not empty, files and directories that would be removed and
+	// files that would be overwritten are moved into TrashDir instead.
+	TrashDir string
+	// If Owners is not nil and we are running as root, files that are copied are
+	// given their original ownership, mapped through Owners, if the source can
+	// report it.
+	Owners *fileinfo.OwnerMap
+	// Symlinks determines how symbolic links are created.
+	Symlinks fileinfo.SymlinkMode
+	// UI receives progress messages. If nil, misc.ConsoleUI is used.
+	UI misc.UI
+	// If Context is canceled, no further changes are started, and ApplyChanges
+	// returns the context's error once the changes in progress are finished. If
+	// nil, context.Background() is used.
+	Context context.Context
+	// If DirTimes is not nil, the modification time of each directory that was
+	// added or changed or whose contents were changed is set from DirTimes once
+	// everything else is done. Otherwise, directory modification times are
+	// ignored.
+	DirTimes database.Database
+	// CaseRenames maps the paths of added files, as returned by CaseRenames, to
+	// the paths at which they are written instead. destDb records them at their
+	// original paths.
+	CaseRenames map[string]string
+	// If StageDir is not empty, regular files are retrieved into StageDir before
+	// dest is changed and are then moved into place. StageDir must be on the
+	// same file system as dest. It is removed once all changes are applied.
+	StageDir string
+	// If Failures is not nil, files that can't be removed, retrieved, or given
+	// their new permissions are recorded in Failures, and the remaining changes
+	// are still applied. Failed changes are not recorded in destDb.
+	Failures *misc.Failures
+	// Schedule determines the order in which files are retrieved or staged.
+	Schedule Schedule
+}
+
+// ApplyChanges applies diffResult to dest, copying files from src. If destDb is
+// not nil, it is updated to reflect the changes. Symbolic links that are
+// skipped or copied are recorded in destDb as links. If ApplyChanges fails or is
+// canceled, destDb reflects the changes that were made. Directories in which
+// entries are added, removed, or replaced are made writable while changes are
+// applied, and their permissions are restored afterward, even on failure.
 func ApplyChanges(
 	src fileinfo.Source,
 	dest fileinfo.Source,
 	diffResult *diff.Result,
 	destDb database.Database,
+	config *ApplyConfig,
 	numWorkers int,
-) error {
-	// Apply changes. Possible enhancement: make sure every directory we have to
-	// modify (by adding or removing files) is writable first, and if we change it,
-	// change it back. For now, if we try to modify a read-only directory, it will be
-	// an error. The user can change the permissions and run again. The pull
-	// operation will restore the permissions.
-
-	// Remove what needs to be removed, then add/modify, then apply permission
-	// changes. We ignore ownerships, directory modification times, and special
-	// files.
-	for _, rm := range diffResult.Rm {
-		path := fileinfo.NewPath(dest, rm.Path).Path()
-		misc.Message("removing %s", rm.Path)
-		if err := os.RemoveAll(path); err != nil {
+) (err error) {
+	if config == nil {
+		config = &ApplyConfig{}
+	}
+	ui := config.UI
+	if ui == nil {
+		ui = misc.ConsoleUI{}
+	}
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	trashDir := config.TrashDir
+	owners := config.Owners
+	failures := config.Failures
+	ownerSrc, _ := src.(fileinfo.OwnerSource)
+	if owners != nil && os.Geteuid() != 0 {
+		ui.Message("not changing ownerships: this requires running as root")
+		owners = nil
+	}
+
+	// Apply renames, then remove what needs to be removed, then add/modify, then
+	// apply permission changes, then, if requested, set directory modification
+	// times. We ignore ownerships. Renames come first since
+	// renamed files may be in directories that are being removed. A rename that
+	// can't be done by moving the file is done by removing the old file and
+	// copying the new one.
+	var staged map[string]bool
+	if config.StageDir != "" {
+		var err error
+		staged, err = stageFiles(ctx, src, dest, diffResult, config, ui, numWorkers)
+		if err != nil {
+			return err
+		}
+		ui.Message("all files are staged; applying changes")
+	}
+	writable := newWritableDirs(dest, diffResult, config.CaseRenames)
+	defer func() {
+		if rErr := writable.restore(); rErr != nil && err == nil {
+			err = rErr
+		}
+	}()
+	if err := writable.makeWritable(); err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	rmList := slices.Clone(diffResult.Rm)
+	addList := slices.Clone(diffResult.Add)
+	// Symbolic links whose targets changed are replaced like changed files.
+	changeList := append(slices.Clone(diffResult.Change), diffResult.Relinks()...)
+	for _, rn := range diffResult.Rename {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if caseRenamed(config.CaseRenames, rn.New.Path) != rn.New.Path {
+			rmList = append(rmList, rn.Old)
+			addList = append(addList, rn.New)
+			continue
+		}
+		moved, err := moveRenamed(src, dest, rn)
+		if err != nil {
 			// TEST: NOT COVERED
-			return fmt.Errorf("remove %s: %w", path, err)
+			return err
+		}
+		if !moved {
+			rmList = append(rmList, rn.Old)
+			addList = append(addList, rn.New)
+			continue
+		}
+		ui.Message("renamed %s to %s", rn.Old.Path, rn.New.Path)
+		if destDb != nil {
+			delete(destDb, rn.Old.Path)
+			destDb[rn.New.Path] = rn.New
+		}
+	}
+	removed := misc.NewProgress(ui, "removed", len(rmList))
+	for _, rm := range rmList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := fileinfo.NewPath(dest, rm.Path).Path()
+		if trashDir != "" {
+			moved, err := moveToTrash(path, rm.Path, trashDir)
+			if err != nil {
+				return err
+			}
+			if moved {
+				removed.File(0, "moved %s to trash", rm.Path)
+			}
+		} else {
+			removed.File(0, "removing %s", rm.Path)
+			err := removeTree(path)
+			if err != nil && failures != nil {
+				failures.Add(rm.Path, err)
+				continue
+			} else if err != nil {
+				// TEST: NOT COVERED
+				return err
+			}
 		}
 		if destDb != nil {
 			delete(destDb, rm.Path)
 		}
 	}
+	removed.Done()
+
+	// If requested, move files we are about to overwrite out of the way. Don't
+	// move directories since their contents are handled individually.
+	if trashDir != "" {
+		for _, list := range [][]*fileinfo.FileInfo{addList, changeList} {
+			for _, info := range list {
+				destRel := caseRenamed(config.CaseRenames, info.Path)
+				path := fileinfo.NewPath(dest, destRel).Path()
+				st, err := os.Lstat(path)
+				if err != nil || st.IsDir() {
+					continue
+				}
+				_, err = moveToTrash(path, destRel, trashDir)
+				if err != nil {
+					return err
+				}
+				ui.Message("moved %s to trash", destRel)
+				// The file is gone until it is replaced, which may not happen if we are
+				// interrupted.
+				if destDb != nil {
+					delete(destDb, info.Path)
+				}
+			}
+		}
+	}
 
 	// Make sure files we are changing will be writable. We will set the correct
 	// permissions when we replace them.
 	for _, ch := range diffResult.Change {
 		path := fileinfo.NewPath(dest, ch.Path).Path()
+		if _, err := os.Lstat(path); trashDir != "" && errors.Is(err, fs.ErrNotExist) {
+			// Moved to trash
+			continue
+		}
 		if ch.FileType == fileinfo.TypeFile {
 			err := os.Chmod(path, fs.FileMode(ch.Permissions|0o600))
 			if err != nil {
@@ -93,20 +490,23 @@ func ApplyChanges(
 		}
 	}
 
-	// Concurrently pull changed files from the repository. This sets permissions and modification time.
+	// Concurrently pull changed files from the repository. This sets permissions
+	// and modification time. Once the context is canceled, remaining files are
+	// skipped.
+	toCopy := 0
+	for _, list := range [][]*fileinfo.FileInfo{addList, changeList} {
+		for _, info := range list {
+			if info.FileType != fileinfo.TypeDirectory {
+				toCopy++
+			}
+		}
+	}
+	copied := misc.NewProgress(ui, "copied", toCopy)
 	c := make(chan *fileinfo.FileInfo, numWorkers)
 	var allErrors []error
+	var destDbMutex gosync.Mutex
 	go func() {
-		for _, info := range diffResult.Add {
-			if destDb != nil {
-				destDb[info.Path] = info
-			}
-			c <- info
-		}
-		for _, info := range diffResult.Change {
-			if destDb != nil {
-				destDb[info.Path] = info
-			}
+		for _, info := range config.Schedule.order(addList, changeList) {
 			c <- info
 		}
 		close(c)
@@ -114,14 +514,66 @@ func ApplyChanges(
 	misc.DoConcurrently(
 		func(c chan *fileinfo.FileInfo, errorChan chan error) {
 			for info := range c {
-				destPath := fileinfo.NewPath(dest, info.Path)
-				downloaded, err := fileinfo.Retrieve(fileinfo.NewPath(src, info.Path), destPath)
+				if ctx.Err() != nil {
+					continue
+				}
+				destRel := caseRenamed(config.CaseRenames, info.Path)
+				destPath := fileinfo.NewPath(dest, destRel)
+				var downloaded bool
+				var err error
+				if isDevice(info.FileType) && os.Geteuid() != 0 {
+					ui.Message("not creating device %s: this requires running as root", info.Path)
+					continue
+				}
+				if staged[info.Path] {
+					downloaded = true
+					err = promoteStaged(config.StageDir, destRel, destPath)
+				} else if isSpecial(info.FileType) {
+					downloaded, err = createSpecial(info, destPath)
+				} else if info.FileType == fileinfo.TypeLink && !config.Symlinks.CreatesLinks() {
+					downloaded, err = retrieveLink(src, info, destPath, config.Symlinks, ui)
+				} else if info.FileType == fileinfo.TypeDirectory && config.Symlinks == fileinfo.SymlinkFollow {
+					downloaded, err = retrieveFollowedDir(info, destPath)
+				} else if info.FileType == fileinfo.TypeDirectory && writable.modified(destRel) {
+					downloaded, err = writable.retrieveDir(info, destRel, destPath)
+				} else {
+					downloaded, err = fileinfo.Retrieve(fileinfo.NewPath(src, info.Path), destPath)
+				}
 				if err != nil {
-					// TEST: NOT COVERED
-					errorChan <- fmt.Errorf("retrieve %s: %w", info.Path, err)
+					if ctx.Err() == nil {
+						err = fmt.Errorf("retrieve %s: %w", info.Path, err)
+						if failures != nil {
+							failures.Add(info.Path, err)
+						} else {
+							// TEST: NOT COVERED
+							errorChan <- err
+						}
+					}
+					continue
+				}
+				if destDb != nil {
+					destDbMutex.Lock()
+					destDb[info.Path] = info
+					destDbMutex.Unlock()
 				}
 				if downloaded && info.FileType != fileinfo.TypeDirectory {
-					misc.Message("copied %s", info.Path)
+					if destRel != info.Path {
+						copied.File(info.Size, "copied %s as %s", info.Path, destRel)
+					} else {
+						copied.File(info.Size, "copied %s", info.Path)
+					}
+				}
+				if downloaded && owners != nil && ownerSrc != nil {
+					// TEST: NOT COVERED. Tests don't run as root.
+					owner, err := ownerSrc.Owner(info.Path, info)
+					if err == nil {
+						err = owners.Apply(destPath.Path(), owner)
+					}
+					if err != nil && failures != nil {
+						failures.Add(info.Path, err)
+					} else if err != nil {
+						errorChan <- err
+					}
 				}
 			}
 		},
@@ -132,68 +584,379 @@ func ApplyChanges(
 		c,
 		numWorkers,
 	)
+	copied.Done()
 	if len(allErrors) > 0 {
 		// TEST: NOT COVERED
 		return errors.Join(allErrors...)
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	for _, m := range diffResult.MetaChange {
-		if m.Permissions == nil {
-			// TEST: NOT COVERED -- we don't generate other kinds of changes in diff with sites
+		if m.Permissions != nil {
+			path := fileinfo.NewPath(dest, m.Info.Path).Path()
+			ui.Message("chmod %04o %s", *m.Permissions, m.Info.Path)
+			err := os.Chmod(path, os.FileMode(*m.Permissions))
+			if err != nil {
+				err = fmt.Errorf("chmod %04o %s: %w", *m.Permissions, path, err)
+				if failures == nil {
+					// TEST: NOT COVERED
+					return err
+				}
+				// TEST: NOT COVERED
+				failures.Add(m.Info.Path, err)
+				continue
+			}
+			// Don't let restoring the permissions of modified directories undo this.
+			writable.setMode(m.Info.Path, os.FileMode(*m.Permissions))
+		} else if m.DirTime == nil {
+			// Links were relinked with the changed files above, and we don't generate
+			// other kinds of changes in diff with sites.
 			continue
 		}
-		path := fileinfo.NewPath(dest, m.Info.Path).Path()
-		misc.Message("chmod %04o %s", *m.Permissions, m.Info.Path)
-		err := os.Chmod(path, os.FileMode(*m.Permissions))
-		if err != nil {
-			// TEST: NOT COVERED
-			return fmt.Errorf("chmod %04o %s: %w", *m.Permissions, path, err)
-		}
 		if destDb != nil {
 			destDb[m.Info.Path] = m.Info
 		}
 	}
+	if config.StageDir != "" {
+		if err := os.RemoveAll(config.StageDir); err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+	}
+	if err := writable.restore(); err != nil {
+		return err
+	}
+	if config.DirTimes != nil {
+		return SetDirTimes(dest, changedDirs(diffResult, config.DirTimes))
+	}
+	return nil
+}
+
+// changedDirs returns the directories in dirTimes whose modification times may
+// have been changed by applying diffResult: those that were added or had
+// their modification times changed and those containing anything that was
+// removed, added, renamed, or changed.
+func changedDirs(diffResult *diff.Result, dirTimes database.Database) []*fileinfo.FileInfo {
+	seen := map[string]bool{}
+	var result []*fileinfo.FileInfo
+	add := func(p string) {
+		info, ok := dirTimes[p]
+		if seen[p] || !ok || info.FileType != fileinfo.TypeDirectory {
+			return
+		}
+		seen[p] = true
+		result = append(result, info)
+	}
+	for _, list := range [][]*fileinfo.FileInfo{diffResult.Rm, diffResult.Add, diffResult.Change, diffResult.Relinks()} {
+		for _, info := range list {
+			add(info.Path)
+			add(path.Dir(info.Path))
+		}
+	}
+	for _, rn := range diffResult.Rename {
+		add(path.Dir(rn.Old.Path))
+		add(path.Dir(rn.New.Path))
+	}
+	for _, m := range diffResult.MetaChange {
+		if m.DirTime != nil {
+			add(m.Info.Path)
+		}
+	}
+	return result
+}
+
+// moveRenamed applies rn within dest by moving the file if the file at the old
+// path is still the one that was removed and nothing is at the new path. It
+// returns false if it didn't move the file.
+func moveRenamed(src, dest fileinfo.Source, rn *diff.Rename) (bool, error) {
+	if ok, err := canMoveRenamed(src, dest, rn); !ok || err != nil {
+		return false, err
+	}
+	oldPath := fileinfo.NewPath(dest, rn.Old.Path).Path()
+	newPath := fileinfo.NewPath(dest, rn.New.Path).Path()
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o777); err != nil {
+		// TEST: NOT COVERED
+		return false, nil
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		// TEST: NOT COVERED
+		return false, nil
+	}
+	if err := os.Chmod(newPath, fs.FileMode(rn.New.Permissions)); err != nil {
+		// TEST: NOT COVERED
+		return true, fmt.Errorf("set mode for %s: %w", newPath, err)
+	}
+	return true, nil
+}
+
+// canMoveRenamed returns true if moveRenamed would move the file for rn. Since
+// renames are detected by size and modification time, the file at the old
+// path must also have the same contents as the file in src.
+func canMoveRenamed(src, dest fileinfo.Source, rn *diff.Rename) (bool, error) {
+	oldPath := fileinfo.NewPath(dest, rn.Old.Path)
+	st, err := os.Lstat(oldPath.Path())
+	if err != nil ||
+		!st.Mode().IsRegular() ||
+		st.Size() != rn.Old.Size ||
+		st.ModTime().UnixMilli() != rn.Old.ModTime.UnixMilli() {
+		return false, nil
+	}
+	_, err = os.Lstat(fileinfo.NewPath(dest, rn.New.Path).Path())
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return sameContents(src, oldPath, rn.New.Path)
+}
+
+// sameContents returns true if the local file at localPath has the same
+// contents as srcPath in src. Sources that can compare contents without
+// transferring them do so. Otherwise, both files are hashed.
+func sameContents(src fileinfo.Source, localPath *fileinfo.Path, srcPath string) (bool, error) {
+	if s, ok := src.(fileinfo.SameContentsSource); ok {
+		return s.SameContents(localPath, srcPath)
+	}
+	h1, err := contentsHash(localPath)
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	h2, err := contentsHash(fileinfo.NewPath(src, srcPath))
+	if err != nil {
+		// TEST: NOT COVERED
+		return false, err
+	}
+	return bytes.Equal(h1, h2), nil
+}
+
+func contentsHash(p *fileinfo.Path) ([]byte, error) {
+	f, err := p.Open()
+	if err != nil {
+		// TEST: NOT COVERED
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		// TEST: NOT COVERED
+		return nil, fmt.Errorf("read %s: %w", p.Path(), err)
+	}
+	return h.Sum(nil), nil
+}
+
+// SetDirTimes sets the modification time of each directory in dirs, whose
+// paths are relative to dest, deepest first. Paths that are no longer
+// directories, including symbolic links to directories, are skipped.
+func SetDirTimes(dest fileinfo.Source, dirs []*fileinfo.FileInfo) error {
+	depth := func(p string) int {
+		if p == "." {
+			return -1
+		}
+		return strings.Count(p, "/")
+	}
+	sorted := slices.Clone(dirs)
+	slices.SortFunc(sorted, func(a, b *fileinfo.FileInfo) int {
+		if c := cmp.Compare(depth(b.Path), depth(a.Path)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Path, b.Path)
+	})
+	for _, info := range sorted {
+		p := fileinfo.NewPath(dest, info.Path).Path()
+		st, err := os.Lstat(p)
+		if err != nil || !st.IsDir() {
+			continue
+		}
+		if err = os.Chtimes(p, info.ModTime, info.ModTime); err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("set modification time of %s: %w", p, err)
+		}
+	}
 	return nil
 }
 
-func (s *Sync) Sync() error {
+// retrieveLink handles a symbolic link that is not to be created. With
+// SymlinkCopy, the link's target is copied if it is a regular file in src.
+// Otherwise, the link is skipped.
+func retrieveLink(
+	src fileinfo.Source,
+	info *fileinfo.FileInfo,
+	destPath *fileinfo.Path,
+	mode fileinfo.SymlinkMode,
+	ui misc.UI,
+) (bool, error) {
+	if mode == fileinfo.SymlinkSkip {
+		ui.Message("skipping symbolic link %s", info.Path)
+		return false, nil
+	}
+	var targetInfo *fileinfo.FileInfo
+	target, ok := fileinfo.LinkTarget(info)
+	if ok {
+		targetInfo, _ = src.FileInfo(target)
+	}
+	if targetInfo == nil || targetInfo.FileType != fileinfo.TypeFile {
+		ui.Message("skipping symbolic link %s: target is not a file within the source", info.Path)
+		return false, nil
+	}
+	if st, err := os.Lstat(destPath.Path()); err == nil && !st.Mode().IsRegular() {
+		if err := os.RemoveAll(destPath.Path()); err != nil {
+			// TEST: NOT COVERED
+			return false, err
+		}
+	}
+	return fileinfo.RetrieveFromInfo(targetInfo, destPath, func(f *os.File) error {
+		return src.Download(target, targetInfo, f)
+	})
+}
+
+// retrieveFollowedDir creates a directory with SymlinkFollow. The directory may
+// be a followed link in src, so it is created from info rather than from src. If
+// the destination is a link to a directory, it is left alone, and the
+// directory's contents are written through it.
+func retrieveFollowedDir(info *fileinfo.FileInfo, destPath *fileinfo.Path) (bool, error) {
+	if lst, err := os.Lstat(destPath.Path()); err == nil && lst.Mode().Type() == fs.ModeSymlink {
+		if st, err := os.Stat(destPath.Path()); err == nil && st.IsDir() {
+			return false, nil
+		}
+	}
+	return fileinfo.RetrieveFromInfo(info, destPath, nil)
+}
+
+// Sync makes the destination match the source and returns the changes that
+// were made. With WithNoOp, the changes are written to the UI's output instead of
+// being applied.
+func (s *Sync) Sync() (*diff.Result, error) {
 	scanSrc, err := scan.New(
 		s.srcDir,
 		scan.WithFilters(s.filters),
-		scan.WithNoSpecial(true),
+		scan.WithNoSpecial(s.noSpecial),
+		scan.WithFollowDirLinks(s.symlinks == fileinfo.SymlinkFollow),
+		scan.WithContext(s.ctx),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	scanDest, err := scan.New(s.destDir)
+	scanDest, err := scan.New(
+		s.destDir,
+		scan.WithNoSpecial(s.noSpecial),
+		scan.WithPathMap(s.pathMap),
+		scan.WithContext(s.ctx),
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dbSrc, err := scanSrc.Run()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dbDest, err := scanDest.Run()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if s.pruneEmpty {
+		pruneEmptyDirs(dbSrc)
 	}
-	d := diff.New(diff.WithNoOwnerships(true))
+	d := diff.New(
+		diff.WithNoOwnerships(true),
+		diff.WithPermissionMask(localsource.PermissionMask),
+		diff.WithNoPermissions(s.noPerms),
+		diff.WithNonFileTimes(s.dirTimes),
+		diff.WithRenames(s.renames),
+		diff.WithModifyWindow(s.window),
+	)
 	diffResult, err := d.Run(dbDest, dbSrc)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	caseRenames, err := s.caseRenames(dbDest, diffResult)
+	if err != nil {
+		return nil, err
 	}
 	if s.noOp {
-		_ = diffResult.WriteDiff(os.Stdout, false)
+		_ = diffResult.WriteDiff(s.ui.Output(), false)
 	} else {
+		var trashDir string
+		if s.backupDir != "" {
+			trashDir = TrashDir(s.backupDir)
+		}
+		var dirTimes database.Database
+		if s.dirTimes {
+			dirTimes = dbSrc
+		}
 		err = ApplyChanges(
 			localsource.New(s.srcDir),
-			localsource.New(s.destDir),
+			localsource.New(
+				s.destDir,
+				localsource.WithModifyWindow(s.window),
+				localsource.WithPathMap(s.pathMap),
+			),
 			diffResult,
 			nil,
+			&ApplyConfig{
+				TrashDir:    trashDir,
+				Owners:      s.owners,
+				Symlinks:    s.symlinks,
+				UI:          s.ui,
+				Context:     s.ctx,
+				DirTimes:    dirTimes,
+				CaseRenames: caseRenames,
+			},
 			10,
 		)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return diffResult, nil
+}
+
+// pruneEmptyDirs removes the directories from db that contain nothing other
+// than directories. The top directory is always kept.
+func pruneEmptyDirs(db database.Database) {
+	keep := map[string]bool{".": true}
+	for p, info := range db {
+		if info.FileType == fileinfo.TypeDirectory {
+			continue
+		}
+		for dir := path.Dir(p); !keep[dir]; dir = path.Dir(dir) {
+			keep[dir] = true
+		}
+	}
+	for p, info := range db {
+		if info.FileType == fileinfo.TypeDirectory && !keep[p] {
+			delete(db, p)
+		}
+	}
+}
+
+// caseRenames reports case collisions if the destination is case-insensitive.
+// With WithRenameCaseCollisions, it returns the paths at which colliding files
+// are written, and files already written there that haven't changed are left
+// alone. Otherwise, it returns an error if there are any collisions.
+func (s *Sync) caseRenames(dbDest database.Database, diffResult *diff.Result) (map[string]string, error) {
+	insensitive, err := CaseInsensitive(s.destDir)
+	if err != nil || !insensitive {
+		return nil, err
+	}
+	collisions := FindCaseCollisions(dbDest, diffResult)
+	if len(collisions) == 0 {
+		return nil, nil
+	}
+	for _, c := range collisions {
+		_, _ = fmt.Fprintln(s.ui.Output(), c)
+	}
+	if !s.renameCase {
+		return nil, errors.New("case collisions detected")
+	}
+	renames := CaseRenames(dbDest, diffResult, collisions)
+	diffResult.Add = slices.DeleteFunc(diffResult.Add, func(f *fileinfo.FileInfo) bool {
+		newPath := caseRenamed(renames, f.Path)
+		old, ok := dbDest[newPath]
+		return newPath != f.Path && ok &&
+			old.FileType == f.FileType &&
+			old.Size == f.Size &&
+			old.Permissions == f.Permissions &&
+			(f.FileType == fileinfo.TypeDirectory || fileinfo.SameTimeWithin(old.ModTime, f.ModTime, s.window))
+	})
+	return renames, nil
 }
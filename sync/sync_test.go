@@ -0,0 +1,1222 @@
+package sync_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
+	"github.com/jberkenbilt/qfs/sync"
+	"github.com/jberkenbilt/qfs/testutil"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path string, contents string, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Time{}, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSyncBackupDir(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/changed"), "new contents", old.Add(time.Minute))
+	writeFile(t, j("src/added"), "added", old)
+	writeFile(t, j("src/same"), "same", old)
+	writeFile(t, j("dest/changed"), "old contents", old)
+	writeFile(t, j("dest/removed"), "removed", old)
+	writeFile(t, j("dest/dir/removed"), "removed in dir", old)
+	writeFile(t, j("dest/same"), "same", old)
+	if err := os.Chmod(j("dest/dir"), 0o555); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the source directory's time the same so the only differences are the
+	// files.
+	if err := os.Chtimes(j("src"), time.Time{}, old); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := sync.New(j("src"), j("dest"), sync.WithBackupDir(j("backup")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for path, exp := range map[string]string{
+		"changed": "new contents",
+		"added":   "added",
+		"same":    "same",
+	} {
+		if v := readFile(t, j("dest/"+path)); v != exp {
+			t.Errorf("%s: %q", path, v)
+		}
+	}
+	for _, path := range []string{"removed", "dir"} {
+		if _, err := os.Lstat(j("dest/" + path)); err == nil {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+	entries, err := os.ReadDir(j("backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one trash directory, got %d", len(entries))
+	}
+	if strings.Contains(entries[0].Name(), ":") {
+		t.Errorf("trash directory name isn't valid on Windows: %s", entries[0].Name())
+	}
+	trash := filepath.Join(j("backup"), entries[0].Name())
+	for path, exp := range map[string]string{
+		"changed":     "old contents",
+		"removed":     "removed",
+		"dir/removed": "removed in dir",
+	} {
+		if v := readFile(t, filepath.Join(trash, path)); v != exp {
+			t.Errorf("trash %s: %q", path, v)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(trash, "same")); err == nil {
+		t.Errorf("unchanged file was moved to trash")
+	}
+
+	// Only the trash directories are removed.
+	writeFile(t, j("backup/keep"), "keep", old)
+	writeFile(t, j("backup/2024-01-02/keep"), "keep", old)
+	ui := &recordingUI{}
+	if err := sync.EmptyTrash(j("backup"), ui); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(trash); err == nil {
+		t.Errorf("trash directory still exists")
+	}
+	for _, path := range []string{"backup/keep", "backup/2024-01-02/keep"} {
+		if v := readFile(t, j(path)); v != "keep" {
+			t.Errorf("%s: %q", path, v)
+		}
+	}
+	expMessages := []string{
+		"removed " + trash,
+		j("backup") + ": left 2 entries that are not trash directories",
+	}
+	if !slices.Equal(ui.messages, expMessages) {
+		t.Errorf("wrong messages: %q", ui.messages)
+	}
+	// Emptying a missing trash is not an error.
+	if err := sync.EmptyTrash(j("missing"), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// recordingUI is a misc.UI that records messages and output. Changes are
+// applied by several goroutines, so messages may arrive concurrently.
+type recordingUI struct {
+	mutex    gosync.Mutex
+	messages []string
+	output   bytes.Buffer
+}
+
+func (u *recordingUI) Message(format string, args ...any) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.messages = append(u.messages, fmt.Sprintf(format, args...))
+}
+
+func (u *recordingUI) Prompt(string) bool {
+	return false
+}
+
+func (u *recordingUI) Output() io.Writer {
+	return &u.output
+}
+
+func TestSyncUI(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/added"), "added", old)
+	writeFile(t, j("dest/removed"), "removed", old)
+	if err := os.Chtimes(j("src"), time.Time{}, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(j("dest"), time.Time{}, old); err != nil {
+		t.Fatal(err)
+	}
+
+	ui := &recordingUI{}
+	s, err := sync.New(j("src"), j("dest"), sync.WithNoOp(true), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result *diff.Result
+	stdout, _ := testutil.WithStdout(func() {
+		result, err = s.Sync()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Add) != 1 || len(result.Rm) != 1 {
+		t.Errorf("wrong result: %d adds, %d removes", len(result.Add), len(result.Rm))
+	}
+	if len(stdout) != 0 {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	if v := ui.output.String(); v != "rm removed\nadd added\n" {
+		t.Errorf("wrong output: %q", v)
+	}
+	if len(ui.messages) != 0 {
+		t.Errorf("unexpected messages: %v", ui.messages)
+	}
+
+	s, err = sync.New(j("src"), j("dest"), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, _ = testutil.WithStdout(func() {
+		_, err = s.Sync()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) != 0 {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	if !slices.Equal(ui.messages, []string{"removing removed", "copied added"}) {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+	if v := readFile(t, j("dest/added")); v != "added" {
+		t.Errorf("added: %q", v)
+	}
+}
+
+func TestSyncSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/dir/target"), "target", old)
+	for link, target := range map[string]string{
+		"src/dir/link":     "target",
+		"src/up":           "dir/target",
+		"src/dir/dangling": "nowhere",
+		"src/outside":      "../elsewhere",
+		"src/to-dir":       "dir",
+	} {
+		if err := os.Symlink(target, j(link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, mode := range []fileinfo.SymlinkMode{fileinfo.SymlinkSkip, fileinfo.SymlinkCopy} {
+		dest := j(fmt.Sprintf("dest%d", mode))
+		if err := os.Mkdir(dest, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		s, err := sync.New(j("src"), dest, sync.WithSymlinks(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if v := readFile(t, filepath.Join(dest, "dir/target")); v != "target" {
+			t.Errorf("target: %q", v)
+		}
+		for _, path := range []string{"dir/link", "up", "dir/dangling", "outside", "to-dir"} {
+			st, err := os.Lstat(filepath.Join(dest, path))
+			copied := mode == fileinfo.SymlinkCopy && (path == "dir/link" || path == "up")
+			if !copied {
+				if err == nil {
+					t.Errorf("mode %d: %s was created", mode, path)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("mode %d: %s: %v", mode, path, err)
+			} else if !st.Mode().IsRegular() {
+				t.Errorf("mode %d: %s is not a regular file", mode, path)
+			} else if v := readFile(t, filepath.Join(dest, path)); v != "target" {
+				t.Errorf("mode %d: %s: %q", mode, path, v)
+			}
+		}
+	}
+}
+
+func TestSyncCanceled(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/added"), "added", old)
+	writeFile(t, j("dest/removed"), "removed", old)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s, err := sync.New(j("src"), j("dest"), sync.WithContext(ctx), sync.WithUI(&recordingUI{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Sync()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// Apply changes directly to make sure nothing is changed and that the
+	// database still matches the destination.
+	destInfo, err := fileinfo.NewPath(localsource.New(j("dest")), "removed").FileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcInfo, err := fileinfo.NewPath(localsource.New(j("src")), "added").FileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destDb := database.Database{"removed": destInfo}
+	err = sync.ApplyChanges(
+		localsource.New(j("src")),
+		localsource.New(j("dest")),
+		&diff.Result{
+			Rm:  []*fileinfo.FileInfo{destInfo},
+			Add: []*fileinfo.FileInfo{srcInfo},
+		},
+		destDb,
+		&sync.ApplyConfig{UI: &recordingUI{}, Context: ctx},
+		2,
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, ok := destDb["removed"]; !ok || len(destDb) != 1 {
+		t.Errorf("database changed: %v", destDb)
+	}
+	if v := readFile(t, j("dest/removed")); v != "removed" {
+		t.Errorf("removed: %q", v)
+	}
+	if _, err := os.Lstat(j("dest/added")); err == nil {
+		t.Errorf("added was copied")
+	}
+}
+
+// cancelingUI cancels a context when it receives its first message.
+type cancelingUI struct {
+	recordingUI
+	cancel context.CancelFunc
+}
+
+func (u *cancelingUI) Message(format string, args ...any) {
+	u.recordingUI.Message(format, args...)
+	u.cancel()
+}
+
+func TestApplyInterrupted(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/a"), "a", old)
+	writeFile(t, j("src/b"), "b", old)
+	if err := os.MkdirAll(j("dest"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	src := localsource.New(j("src"))
+	var add []*fileinfo.FileInfo
+	for _, path := range []string{"a", "b"} {
+		info, err := fileinfo.NewPath(src, path).FileInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add = append(add, info)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ui := &cancelingUI{cancel: cancel}
+	destDb := database.Database{}
+	// With one worker, the first copy finishes, and the second is skipped.
+	err := sync.ApplyChanges(
+		src,
+		localsource.New(j("dest")),
+		&diff.Result{Add: add},
+		destDb,
+		&sync.ApplyConfig{UI: ui, Context: ctx},
+		1,
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if !slices.Equal(ui.messages, []string{"copied a"}) {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+	if len(destDb) != 1 || destDb["a"] == nil {
+		t.Errorf("wrong database: %v", destDb)
+	}
+	if v := readFile(t, j("dest/a")); v != "a" {
+		t.Errorf("a: %q", v)
+	}
+	entries, err := os.ReadDir(j("dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("extra files in destination: %v", entries)
+	}
+}
+
+func TestApplyKeepGoing(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{"a", "b", "c"} {
+		writeFile(t, j("src/"+path), path, old)
+	}
+	if err := os.MkdirAll(j("dest"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	src := localsource.New(j("src"))
+	var add []*fileinfo.FileInfo
+	for _, path := range []string{"a", "b", "c"} {
+		info, err := fileinfo.NewPath(src, path).FileInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add = append(add, info)
+	}
+	// b can't be read, but the other files are still copied.
+	testutil.Check(t, os.Chmod(j("src/b"), 0))
+	defer func() { _ = os.Chmod(j("src/b"), 0o644) }()
+	ui := &recordingUI{}
+	destDb := database.Database{}
+	failures := &misc.Failures{}
+	err := sync.ApplyChanges(
+		src,
+		localsource.New(j("dest")),
+		&diff.Result{Add: add},
+		destDb,
+		&sync.ApplyConfig{UI: ui, Failures: failures},
+		1,
+	)
+	testutil.Check(t, err)
+	if !slices.Equal(ui.messages, []string{"copied a", "copied c"}) {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+	if len(destDb) != 2 || destDb["a"] == nil || destDb["c"] == nil {
+		t.Errorf("wrong database: %v", destDb)
+	}
+	if !errors.Is(failures.Err(), misc.ErrFailures) || failures.Len() != 1 {
+		t.Errorf("wrong failures: %v", failures.Err())
+	}
+	ui.messages = nil
+	failures.Summarize(ui)
+	if len(ui.messages) != 4 || ui.messages[1] != "permission denied (1):" ||
+		!strings.HasPrefix(ui.messages[2], "  b: retrieve b: ") {
+		t.Errorf("wrong summary: %v", ui.messages)
+	}
+}
+
+func TestApplySchedule(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	// Paths are in diff order; the contents give the sizes.
+	sizes := map[string]int{"a": 2, "b": 5, "c": 1, "d": 4, "e": 3}
+	var add []*fileinfo.FileInfo
+	src := localsource.New(j("src"))
+	for _, path := range []string{"a", "b", "c", "d", "e"} {
+		writeFile(t, j("src/"+path), strings.Repeat("x", sizes[path]), old)
+		info, err := fileinfo.NewPath(src, path).FileInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add = append(add, info)
+	}
+	_, err := sync.ParseSchedule("random")
+	if err == nil || err.Error() != "schedule must be diff, largest, or interleave" {
+		t.Errorf("wrong error: %v", err)
+	}
+	for _, tc := range []struct {
+		schedule string
+		order    string
+	}{
+		{"diff", "abcde"},
+		{"largest", "bdeac"},
+		{"interleave", "bcdae"},
+	} {
+		t.Run(tc.schedule, func(t *testing.T) {
+			schedule, err := sync.ParseSchedule(tc.schedule)
+			testutil.Check(t, err)
+			dest := j("dest-" + tc.schedule)
+			if err := os.MkdirAll(dest, 0o777); err != nil {
+				t.Fatal(err)
+			}
+			ui := &recordingUI{}
+			err = sync.ApplyChanges(
+				src,
+				localsource.New(dest),
+				&diff.Result{Add: add},
+				nil,
+				&sync.ApplyConfig{UI: ui, Schedule: schedule},
+				1,
+			)
+			testutil.Check(t, err)
+			var order string
+			for _, m := range ui.messages {
+				order += strings.TrimPrefix(m, "copied ")
+			}
+			if order != tc.order {
+				t.Errorf("wrong order: %v", ui.messages)
+			}
+		})
+	}
+}
+
+func TestSyncReadOnlyDirs(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/ro/changed"), "new contents", old.Add(time.Minute))
+	writeFile(t, j("src/ro/added"), "added", old)
+	writeFile(t, j("src/new-ro/sub/a"), "a", old)
+	writeFile(t, j("src/chmod/x"), "x", old)
+	writeFile(t, j("src/chmod/y"), "y", old)
+	writeFile(t, j("dest/ro/changed"), "old contents", old)
+	writeFile(t, j("dest/ro/removed"), "removed", old)
+	writeFile(t, j("dest/gone/sub/f"), "f", old)
+	writeFile(t, j("dest/chmod/x"), "x", old)
+	modes := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{"src/ro", 0o555},
+		{"src/new-ro/sub", 0o500},
+		{"src/new-ro", 0o555},
+		{"src/chmod", 0o555},
+		{"dest/ro", 0o555},
+		{"dest/gone/sub", 0o555},
+		{"dest/gone", 0o555},
+	}
+	for _, m := range modes {
+		testutil.Check(t, os.Chmod(j(m.path), m.mode))
+	}
+	defer func() {
+		for _, p := range []string{"src", "dest"} {
+			_ = filepath.WalkDir(j(p), func(path string, d os.DirEntry, err error) error {
+				if err == nil && d.IsDir() {
+					_ = os.Chmod(path, 0o755)
+				}
+				return nil
+			})
+		}
+	}()
+
+	s, err := sync.New(j("src"), j("dest"))
+	testutil.Check(t, err)
+	_, err = s.Sync()
+	testutil.Check(t, err)
+	for path, exp := range map[string]string{
+		"ro/changed":   "new contents",
+		"ro/added":     "added",
+		"new-ro/sub/a": "a",
+		"chmod/y":      "y",
+	} {
+		if v := readFile(t, j("dest/"+path)); v != exp {
+			t.Errorf("%s: %q", path, v)
+		}
+	}
+	for _, path := range []string{"ro/removed", "gone"} {
+		if _, err := os.Lstat(j("dest/" + path)); err == nil {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+	for path, exp := range map[string]os.FileMode{
+		"ro":         0o555,
+		"new-ro":     0o555,
+		"new-ro/sub": 0o500,
+		"chmod":      0o555,
+	} {
+		st, err := os.Stat(j("dest/" + path))
+		testutil.Check(t, err)
+		if st.Mode().Perm() != exp {
+			t.Errorf("%s: mode %04o", path, st.Mode().Perm())
+		}
+	}
+
+	// Permissions are restored when applying changes fails.
+	testutil.Check(t, os.Chmod(j("src/ro"), 0o755))
+	writeFile(t, j("src/ro/vanishes"), "vanishes", old)
+	src := localsource.New(j("src"))
+	info, err := fileinfo.NewPath(src, "ro/vanishes").FileInfo()
+	testutil.Check(t, err)
+	testutil.Check(t, os.Remove(j("src/ro/vanishes")))
+	err = sync.ApplyChanges(
+		src,
+		localsource.New(j("dest")),
+		&diff.Result{Add: []*fileinfo.FileInfo{info}},
+		nil,
+		&sync.ApplyConfig{UI: &recordingUI{}},
+		1,
+	)
+	if err == nil {
+		t.Error("expected an error")
+	}
+	st, err := os.Stat(j("dest/ro"))
+	testutil.Check(t, err)
+	if st.Mode().Perm() != 0o555 {
+		t.Errorf("ro: mode %04o after failure", st.Mode().Perm())
+	}
+}
+
+func TestSyncNoPermissions(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/dir/a"), "a", old)
+	writeFile(t, j("src/b"), "b", old)
+	writeFile(t, j("dest/dir/a"), "a", old)
+	writeFile(t, j("dest/b"), "b", old)
+	testutil.Check(t, os.Chmod(j("src/dir/a"), 0o600))
+	testutil.Check(t, os.Chmod(j("src/dir"), 0o700))
+	for _, d := range []string{"src", "dest"} {
+		testutil.Check(t, os.Chtimes(j(d+"/dir"), time.Time{}, old))
+		testutil.Check(t, os.Chtimes(j(d), time.Time{}, old))
+	}
+	ui := &recordingUI{}
+	s, err := sync.New(j("src"), j("dest"), sync.WithNoPermissions(true), sync.WithUI(ui))
+	testutil.Check(t, err)
+	result, err := s.Sync()
+	testutil.Check(t, err)
+	if result.NumChanges() != 0 || len(ui.messages) != 0 {
+		t.Errorf("unexpected changes: %v", ui.messages)
+	}
+	st, err := os.Stat(j("dest/dir/a"))
+	testutil.Check(t, err)
+	if st.Mode().Perm() != 0o644 {
+		t.Errorf("permissions were changed: %04o", st.Mode().Perm())
+	}
+	// Without it, the permissions are copied.
+	s, err = sync.New(j("src"), j("dest"), sync.WithUI(ui))
+	testutil.Check(t, err)
+	_, err = s.Sync()
+	testutil.Check(t, err)
+	if !slices.Equal(ui.messages, []string{"chmod 0700 dir", "chmod 0600 dir/a"}) {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+}
+
+func TestSyncPruneEmptyDirs(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	writeFile(t, j("src/keep/a"), "a", old)
+	writeFile(t, j("src/build/x.o"), "x", old)
+	writeFile(t, j("src/build/sub/y.o"), "y", old)
+	writeFile(t, j("src/open/b"), "b", old)
+	testutil.Check(t, os.MkdirAll(j("src/empty/deeper"), 0o777))
+	testutil.Check(t, os.Chmod(j("src/open"), 0o777))
+	testutil.Check(t, os.MkdirAll(j("dest/empty"), 0o777))
+	f := filter.New()
+	testutil.Check(t, f.AddPattern(filter.Exclude, `\.o$`))
+
+	sync1 := func(noOp bool, prune bool) string {
+		t.Helper()
+		ui := &recordingUI{}
+		s, err := sync.New(
+			j("src"),
+			j("dest"),
+			sync.WithFilters([]*filter.Filter{f}),
+			sync.WithPruneEmptyDirs(prune),
+			sync.WithNoOp(noOp),
+			sync.WithUI(ui),
+		)
+		testutil.Check(t, err)
+		_, err = s.Sync()
+		testutil.Check(t, err)
+		return ui.output.String()
+	}
+	// Without pruning, directories are created even if nothing is copied into
+	// them.
+	sync1(false, false)
+	for _, p := range []string{"build/sub", "empty/deeper"} {
+		if st, err := os.Stat(j("dest/" + p)); err != nil || !st.IsDir() {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+	// Created directories get exactly the source's permissions regardless of the
+	// umask.
+	if st, err := os.Stat(j("dest/open")); err != nil || st.Mode().Perm() != 0o777 {
+		t.Errorf("wrong mode for open: %v %v", st, err)
+	}
+
+	if v := sync1(true, true); v != "rm build\nrm build/sub\nrm empty\nrm empty/deeper\n" {
+		t.Errorf("wrong output: %q", v)
+	}
+	sync1(false, true)
+	for _, p := range []string{"build", "empty"} {
+		if _, err := os.Lstat(j("dest/" + p)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists: %v", p, err)
+		}
+	}
+	if v := readFile(t, j("dest/keep/a")); v != "a" {
+		t.Errorf("wrong contents: %q", v)
+	}
+	if v := sync1(true, true); v != "" {
+		t.Errorf("wrong output: %q", v)
+	}
+}
+
+func TestApplyStaged(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/a"), "a", old)
+	writeFile(t, j("src/b"), "b", old)
+	writeFile(t, j("dest/removed"), "removed", old)
+	src := localsource.New(j("src"))
+	dest := localsource.New(j("dest"))
+	var add []*fileinfo.FileInfo
+	for _, path := range []string{"a", "b"} {
+		info, err := fileinfo.NewPath(src, path).FileInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		add = append(add, info)
+	}
+	removed, err := fileinfo.NewPath(dest, "removed").FileInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffResult := &diff.Result{Add: add, Rm: []*fileinfo.FileInfo{removed}}
+	destDb := database.Database{"removed": removed}
+
+	// An interruption while staging leaves the destination alone.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cui := &cancelingUI{cancel: cancel}
+	err = sync.ApplyChanges(
+		src,
+		dest,
+		diffResult,
+		destDb,
+		&sync.ApplyConfig{UI: cui, Context: ctx, StageDir: j("stage")},
+		1,
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if !slices.Equal(cui.messages, []string{"staged a"}) {
+		t.Errorf("wrong messages: %v", cui.messages)
+	}
+	if len(destDb) != 1 || destDb["removed"] == nil {
+		t.Errorf("wrong database: %v", destDb)
+	}
+	if v := readFile(t, j("dest/removed")); v != "removed" {
+		t.Errorf("removed: %q", v)
+	}
+	if _, err := os.Lstat(j("dest/a")); err == nil {
+		t.Errorf("a was copied")
+	}
+
+	// Running again stages only what's left and then applies everything.
+	ui := &recordingUI{}
+	err = sync.ApplyChanges(
+		src,
+		dest,
+		diffResult,
+		destDb,
+		&sync.ApplyConfig{UI: ui, StageDir: j("stage")},
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"staged b",
+		"all files are staged; applying changes",
+		"removing removed",
+		"copied a",
+		"copied b",
+	}
+	if !slices.Equal(ui.messages, exp) {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+	for _, path := range []string{"a", "b"} {
+		if v := readFile(t, j("dest/"+path)); v != path {
+			t.Errorf("%s: %q", path, v)
+		}
+		if destDb[path] == nil {
+			t.Errorf("%s is missing from the database", path)
+		}
+	}
+	if _, err := os.Lstat(j("dest/removed")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removed still exists: %v", err)
+	}
+	if _, err := os.Lstat(j("stage")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stage directory still exists: %v", err)
+	}
+}
+
+func TestSyncFollowDirLinks(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour)
+	writeFile(t, j("src/dir/target"), "target", old)
+	writeFile(t, j("outside/file"), "outside", old)
+	for link, target := range map[string]string{
+		"src/dir/link": "target",
+		"src/ext":      "../outside",
+	} {
+		if err := os.Symlink(target, j(link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(j("dest"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	s, err := sync.New(j("src"), j("dest"), sync.WithSymlinks(fileinfo.SymlinkFollow), sync.WithUI(&recordingUI{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// The link to the directory is materialized, and other links are created.
+	if st, err := os.Lstat(j("dest/ext")); err != nil || !st.IsDir() {
+		t.Errorf("ext is not a directory: %v", err)
+	}
+	if v := readFile(t, j("dest/ext/file")); v != "outside" {
+		t.Errorf("ext/file: %q", v)
+	}
+	if target, err := os.Readlink(j("dest/dir/link")); err != nil || target != "target" {
+		t.Errorf("dir/link: %q, %v", target, err)
+	}
+}
+
+func TestSyncDirTimes(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	writeFile(t, j("src/a/b/file"), "file", old)
+	writeFile(t, j("src/a/other"), "other", old)
+	dirTimes := map[string]time.Time{
+		"a/b": old.Add(-2 * time.Minute),
+		"a":   old.Add(-3 * time.Minute),
+	}
+	setTimes := func() {
+		t.Helper()
+		for _, dir := range []string{"a/b", "a"} {
+			if err := os.Chtimes(j("src/"+dir), time.Time{}, dirTimes[dir]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkTimes := func(dest string) {
+		t.Helper()
+		for dir, exp := range dirTimes {
+			st, err := os.Stat(j(dest + "/" + dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.ModTime().Equal(exp) {
+				t.Errorf("%s/%s: wrong time %v", dest, dir, st.ModTime())
+			}
+		}
+	}
+	setTimes()
+	for _, dest := range []string{"dest", "plain"} {
+		if err := os.Mkdir(j(dest), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without -dir-times, directories get new times.
+	s, err := sync.New(j("src"), j("plain"), sync.WithUI(&recordingUI{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(j("plain/a")); err != nil || st.ModTime().Equal(dirTimes["a"]) {
+		t.Errorf("directory time was copied: %v", err)
+	}
+
+	sync1 := func() *diff.Result {
+		t.Helper()
+		s, err := sync.New(j("src"), j("dest"), sync.WithDirTimes(true), sync.WithUI(&recordingUI{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	sync1()
+	checkTimes("dest")
+
+	// Adding a file changes the destination directory's time, which is then
+	// restored.
+	writeFile(t, j("src/a/b/new"), "new", old)
+	dirTimes["a/b"] = old.Add(-time.Minute)
+	setTimes()
+	sync1()
+	checkTimes("dest")
+
+	// A change to only a directory's time is copied.
+	dirTimes["a"] = old.Add(-4 * time.Minute)
+	setTimes()
+	result := sync1()
+	if len(result.MetaChange) != 1 || result.MetaChange[0].DirTime == nil {
+		t.Errorf("wrong changes: %#v", result.MetaChange)
+	}
+	checkTimes("dest")
+}
+
+func TestSyncRenames(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	writeFile(t, j("src/same"), "same", old)
+	writeFile(t, j("src/new/a"), "a", old)
+	writeFile(t, j("src/new/b"), "bb", old)
+	writeFile(t, j("src/name2"), "renamed", old)
+	writeFile(t, j("src/empty2"), "", old)
+	writeFile(t, j("dest/same"), "same", old)
+	writeFile(t, j("dest/old/a"), "a", old)
+	writeFile(t, j("dest/old/b"), "bb", old)
+	writeFile(t, j("dest/name1"), "renamed", old)
+	writeFile(t, j("dest/empty"), "", old)
+	for _, dir := range []string{"src", "dest"} {
+		if err := os.Chtimes(j(dir), time.Time{}, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ui := &recordingUI{}
+	s, err := sync.New(j("src"), j("dest"), sync.WithRenames(true), sync.WithNoOp(true), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Empty files are never paired.
+	exp := "rm empty\nrm old\n" +
+		"rename name1 -> name2\nrename old/a -> new/a\nrename old/b -> new/b\n" +
+		"add empty2\nmkdir new\n"
+	if v := ui.output.String(); v != exp {
+		t.Errorf("wrong output: %q", v)
+	}
+
+	before, err := os.Stat(j("dest/old/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui = &recordingUI{}
+	s, err = sync.New(j("src"), j("dest"), sync.WithRenames(true), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"renamed name1 to name2", "renamed old/a to new/a", "renamed old/b to new/b"} {
+		if !slices.Contains(ui.messages, m) {
+			t.Errorf("missing %q: %v", m, ui.messages)
+		}
+	}
+	if slices.Contains(ui.messages, "copied new/a") {
+		t.Errorf("renamed file was copied: %v", ui.messages)
+	}
+	after, err := os.Stat(j("dest/new/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("new/a is not the file that was at old/a")
+	}
+	for path, exp := range map[string]string{"new/a": "a", "new/b": "bb", "name2": "renamed", "empty2": ""} {
+		if v := readFile(t, j("dest/"+path)); v != exp {
+			t.Errorf("%s: %q", path, v)
+		}
+	}
+	for _, path := range []string{"old", "name1", "empty"} {
+		if _, err := os.Lstat(j("dest/" + path)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists: %v", path, err)
+		}
+	}
+
+	// If the file at the old path isn't the one that was renamed, the new file is
+	// copied, and the old one is removed.
+	writeFile(t, j("src/moved"), "moved", old)
+	writeFile(t, j("dest/edited"), "edited", old.Add(time.Minute))
+	src := localsource.New(j("src"))
+	movedInfo, err := src.FileInfo("moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	editedInfo := *movedInfo
+	editedInfo.Path = "edited"
+	destDb := database.Database{"edited": &editedInfo}
+	ui = &recordingUI{}
+	err = sync.ApplyChanges(
+		src,
+		localsource.New(j("dest")),
+		&diff.Result{Rename: []*diff.Rename{{Old: &editedInfo, New: movedInfo}}},
+		destDb,
+		&sync.ApplyConfig{UI: ui},
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ui.messages, []string{"removing edited", "copied moved"}) {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+	if v := readFile(t, j("dest/moved")); v != "moved" {
+		t.Errorf("moved: %q", v)
+	}
+	if _, ok := destDb["edited"]; ok || destDb["moved"] != movedInfo {
+		t.Errorf("wrong database: %v", destDb)
+	}
+
+	// A file with the same size and modification time but different contents is
+	// paired as a rename but is copied rather than moved.
+	writeFile(t, j("src/lookalike2"), "abcd", old)
+	writeFile(t, j("dest/lookalike1"), "wxyz", old)
+	ui = &recordingUI{}
+	s, err = sync.New(j("src"), j("dest"), sync.WithRenames(true), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(ui.messages, "copied lookalike2") || slices.Contains(ui.messages, "renamed lookalike1 to lookalike2") {
+		t.Errorf("wrong messages: %v", ui.messages)
+	}
+	if v := readFile(t, j("dest/lookalike2")); v != "abcd" {
+		t.Errorf("lookalike2: %q", v)
+	}
+	if _, err := os.Lstat(j("dest/lookalike1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lookalike1 still exists: %v", err)
+	}
+}
+
+func TestSyncPathMap(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	writeFile(t, j("src/docs/a"), "a", old)
+	writeFile(t, j("src/docs/sub/b"), "b", old)
+	writeFile(t, j("src/work/notes/n"), "n", old)
+	writeFile(t, j("src/other/c"), "c", old)
+	// The destination's own docs isn't part of what is synced.
+	writeFile(t, j("dest/docs/stray"), "stray", old)
+
+	_, err := localsource.ParsePathRule("docs Documents")
+	if err == nil || err.Error() != "path rules must have the form \"src=path dest=path\"" {
+		t.Errorf("wrong error: %v", err)
+	}
+	var rules []localsource.PathRule
+	for _, r := range []string{"src=docs/ dest=Documents/", "src=work/notes dest=Notes"} {
+		rule, err := localsource.ParsePathRule(r)
+		testutil.Check(t, err)
+		rules = append(rules, rule)
+	}
+	for _, tc := range []struct {
+		rule   localsource.PathRule
+		errMsg string
+	}{
+		{localsource.PathRule{Src: "docs/x", Dest: "X"}, "path rules for docs and docs/x overlap"},
+		{localsource.PathRule{Src: "x", Dest: "Notes/x"}, "path rules to Notes and Notes/x overlap"},
+		{localsource.PathRule{Src: "x", Dest: "../x"}, "../x: path rules must use clean relative paths"},
+		{localsource.PathRule{Src: ".qfs/x", Dest: "x"}, ".qfs/x: path rules can't apply to .qfs"},
+	} {
+		_, err := localsource.NewPathMap(append(slices.Clone(rules), tc.rule))
+		if err == nil || err.Error() != tc.errMsg {
+			t.Errorf("%v: wrong error: %v", tc.rule, err)
+		}
+	}
+	pathMap, err := localsource.NewPathMap(rules)
+	testutil.Check(t, err)
+	if v := pathMap.ToLocal("work/notes/n"); v != "Notes/n" {
+		t.Errorf("wrong local path: %s", v)
+	}
+	if v := pathMap.FromLocal("Documents/sub"); v != "docs/sub" {
+		t.Errorf("wrong path: %s", v)
+	}
+
+	sync1 := func(noOp bool) string {
+		t.Helper()
+		ui := &recordingUI{}
+		s, err := sync.New(j("src"), j("dest"), sync.WithPathMap(pathMap), sync.WithNoOp(noOp), sync.WithUI(ui))
+		testutil.Check(t, err)
+		_, err = s.Sync()
+		testutil.Check(t, err)
+		return ui.output.String()
+	}
+	sync1(false)
+	for path, exp := range map[string]string{
+		"Documents/a":     "a",
+		"Documents/sub/b": "b",
+		"Notes/n":         "n",
+		"other/c":         "c",
+		"docs/stray":      "stray",
+	} {
+		if v := readFile(t, j("dest/"+path)); v != exp {
+			t.Errorf("%s: %q", path, v)
+		}
+	}
+	for _, path := range []string{"docs/a", "work/notes"} {
+		if _, err := os.Lstat(j("dest/" + path)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists: %v", path, err)
+		}
+	}
+	// The destination is scanned with the same rules, so it is up to date.
+	if v := sync1(true); v != "" {
+		t.Errorf("wrong output: %q", v)
+	}
+	writeFile(t, j("src/docs/a"), "changed", old.Add(time.Minute))
+	if err := os.Remove(j("src/work/notes/n")); err != nil {
+		t.Fatal(err)
+	}
+	if v := sync1(true); v != "rm work/notes/n\nchange docs/a\n" {
+		t.Errorf("wrong output: %q", v)
+	}
+	sync1(false)
+	if v := readFile(t, j("dest/Documents/a")); v != "changed" {
+		t.Errorf("wrong contents: %q", v)
+	}
+	if _, err := os.Lstat(j("dest/Notes/n")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Notes/n still exists: %v", err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	tmp := t.TempDir()
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(tmp, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// With no entries, a temporary file is created, and the directory's time is
+	// restored.
+	empty, err := sync.CaseInsensitive(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(tmp); err != nil || !st.ModTime().Equal(old) {
+		t.Errorf("directory time changed: %v", err)
+	}
+	writeFile(t, filepath.Join(tmp, "Abc"), "abc", old)
+	withFile, err := sync.CaseInsensitive(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty != withFile {
+		t.Errorf("results differ: %v, %v", empty, withFile)
+	}
+}
+
+func TestSyncCaseCollisions(t *testing.T) {
+	sync.TestCaseInsensitive = true
+	defer func() { sync.TestCaseInsensitive = false }()
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	old := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	writeFile(t, j("src/README"), "upper", old)
+	writeFile(t, j("src/Readme"), "mixed", old)
+	writeFile(t, j("src/Docs/a"), "a", old)
+	writeFile(t, j("src/docs/b"), "b", old)
+	writeFile(t, j("src/notes.txt"), "notes", old)
+	// A file whose name only changes case is removed before it is added.
+	writeFile(t, j("dest/NOTES.TXT"), "notes", old)
+
+	ui := &recordingUI{}
+	s, err := sync.New(j("src"), j("dest"), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Sync()
+	if err == nil || err.Error() != "case collisions detected" {
+		t.Errorf("wrong error: %v", err)
+	}
+	exp := "case collision: Readme and README\ncase collision: docs and Docs\n"
+	if v := ui.output.String(); v != exp {
+		t.Errorf("wrong output: %q", v)
+	}
+	if _, err = os.Lstat(j("dest/README")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("changes were applied: %v", err)
+	}
+
+	ui = &recordingUI{}
+	s, err = sync.New(j("src"), j("dest"), sync.WithRenameCaseCollisions(true), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"copied Readme as Readme.case-1", "copied docs/b as docs.case-1/b", "copied notes.txt"} {
+		if !slices.Contains(ui.messages, m) {
+			t.Errorf("missing %q: %v", m, ui.messages)
+		}
+	}
+	for path, exp := range map[string]string{
+		"README":        "upper",
+		"Readme.case-1": "mixed",
+		"Docs/a":        "a",
+		"docs.case-1/b": "b",
+		"notes.txt":     "notes",
+	} {
+		if v := readFile(t, j("dest/"+path)); v != exp {
+			t.Errorf("%s: %q", path, v)
+		}
+	}
+	for _, path := range []string{"Readme", "docs", "NOTES.TXT"} {
+		if _, err := os.Lstat(j("dest/" + path)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists: %v", path, err)
+		}
+	}
+
+	// Files that were already written under other names are left alone.
+	ui = &recordingUI{}
+	s, err = sync.New(j("src"), j("dest"), sync.WithRenameCaseCollisions(true), sync.WithUI(ui))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range ui.messages {
+		if strings.HasPrefix(m, "copied ") || strings.HasPrefix(m, "removing ") {
+			t.Errorf("unexpected change: %s", m)
+		}
+	}
+}
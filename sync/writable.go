@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jberkenbilt/qfs/diff"
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+)
+
+// writableMode is or'ed into the permissions of a directory while entries are
+// added to it or removed from it.
+const writableMode = 0o700
+
+// keepMode holds the bits of a directory's mode that are restored.
+const keepMode = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// writableDirs makes directories whose entries ApplyChanges modifies writable
+// while it works and then gives them back their permissions. Otherwise,
+// changes in read-only directories would fail.
+type writableDirs struct {
+	dest fileinfo.Source
+	// dirs holds the directories, relative to dest, in which entries are added,
+	// removed, or replaced.
+	dirs map[string]bool
+	// modes maps directories that were made writable to the modes they get back.
+	modes map[string]fs.FileMode
+	mutex gosync.Mutex
+}
+
+// newWritableDirs finds the directories in which diffResult adds, removes, or
+// replaces entries.
+func newWritableDirs(dest fileinfo.Source, diffResult *diff.Result, caseRenames map[string]string) *writableDirs {
+	w := &writableDirs{
+		dest:  dest,
+		dirs:  map[string]bool{},
+		modes: map[string]fs.FileMode{},
+	}
+	for _, rn := range diffResult.Rename {
+		w.dirs[path.Dir(rn.Old.Path)] = true
+		w.dirs[path.Dir(rn.New.Path)] = true
+	}
+	for _, info := range diffResult.Rm {
+		w.dirs[path.Dir(info.Path)] = true
+	}
+	for _, list := range [][]*fileinfo.FileInfo{diffResult.Add, diffResult.Change, diffResult.Relinks()} {
+		for _, info := range list {
+			if info.Path != "." {
+				w.dirs[path.Dir(caseRenamed(caseRenames, info.Path))] = true
+			}
+		}
+	}
+	return w
+}
+
+// makeWritable makes each existing directory that will be modified writable.
+func (w *writableDirs) makeWritable() error {
+	for dir := range w.dirs {
+		p := fileinfo.NewPath(w.dest, dir).Path()
+		st, err := os.Lstat(p)
+		if err != nil || !st.IsDir() {
+			// It will be created, or it isn't a directory yet.
+			continue
+		}
+		if st.Mode().Perm()&writableMode == writableMode {
+			continue
+		}
+		if err = os.Chmod(p, st.Mode()&keepMode|writableMode); err != nil {
+			// TEST: NOT COVERED
+			return fmt.Errorf("%s: make writable: %w", p, err)
+		}
+		w.modes[dir] = st.Mode() & keepMode
+	}
+	return nil
+}
+
+// modified returns true if entries are added, removed, or replaced in dir.
+func (w *writableDirs) modified(dir string) bool {
+	return w.dirs[dir]
+}
+
+// retrieveDir creates or updates the directory info at destPath, which must be
+// modified. It is left writable, and restore gives it its permissions.
+func (w *writableDirs) retrieveDir(info *fileinfo.FileInfo, destRel string, destPath *fileinfo.Path) (bool, error) {
+	writable := *info
+	writable.Permissions |= writableMode
+	downloaded, err := fileinfo.RetrieveFromInfo(&writable, destPath, nil)
+	if err != nil {
+		return false, err
+	}
+	w.setMode(destRel, fs.FileMode(info.Permissions))
+	return downloaded, nil
+}
+
+// setMode sets the mode restore gives dir if entries are modified within it.
+func (w *writableDirs) setMode(dir string, mode fs.FileMode) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.dirs[dir] {
+		w.modes[dir] = mode
+	}
+}
+
+// restore gives directories that were made writable their permissions back,
+// starting with the deepest so that none is made inaccessible before the ones
+// beneath it are restored. It tries all of them even if some fail.
+func (w *writableDirs) restore() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var dirs []string
+	for dir := range w.modes {
+		dirs = append(dirs, dir)
+	}
+	depth := func(dir string) int {
+		if dir == "." {
+			return 0
+		}
+		return strings.Count(dir, "/") + 1
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return depth(dirs[i]) > depth(dirs[j])
+	})
+	var allErrors []error
+	for _, dir := range dirs {
+		p := fileinfo.NewPath(w.dest, dir).Path()
+		err := os.Chmod(p, w.modes[dir])
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// TEST: NOT COVERED
+			allErrors = append(allErrors, fmt.Errorf("%s: restore permissions: %w", p, err))
+		}
+	}
+	w.modes = map[string]fs.FileMode{}
+	return errors.Join(allErrors...)
+}
+
+// makeTreeWritable makes dir and every directory beneath it writable so that
+// they can be removed.
+func makeTreeWritable(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// TEST: NOT COVERED
+			return err
+		}
+		if d.IsDir() {
+			return os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package traverse_test
+
+import (
+	"syscall"
+	"testing"
+)
+
+func mkfifo(t *testing.T, path string) {
+	t.Helper()
+	if err := syscall.Mkfifo(path, 0666); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package traverse_test
+
+import (
+	"testing"
+)
+
+func mkfifo(t *testing.T, _ string) {
+	t.Skip("named pipes are not supported on Windows")
+}
@@ -0,0 +1,107 @@
+package traverse
+
+import (
+	"github.com/jberkenbilt/qfs/fileinfo"
+	"github.com/jberkenbilt/qfs/filter"
+	"sync"
+	"time"
+)
+
+// Stats collects measurements of a traversal for tuning filters and
+// concurrency. Pass one to WithStats, and read it after Traverse or Stream
+// returns.
+type Stats struct {
+	// Elapsed is the total time taken by the traversal.
+	Elapsed time.Duration
+	// Visited gives the number of entries of each type that were examined,
+	// whether or not they were included.
+	Visited map[fileinfo.FileType]int64
+	// Rejected gives the number of entries excluded by each filter group. Pruned
+	// directories are counted, but their contents are never visited.
+	Rejected map[filter.Group]int64
+	// JunkRemoved is the number of junk files removed because of WithCleanup.
+	JunkRemoved int64
+	// MaxPending is the largest number of entries that were waiting to be
+	// examined at one time.
+	MaxPending int64
+	// Workers has the measurements of each worker.
+	Workers []WorkerStats
+	mutex   sync.Mutex
+}
+
+// WorkerStats describes the work done by one of the goroutines that examine
+// entries.
+type WorkerStats struct {
+	// Entries is the number of entries the worker examined.
+	Entries int64
+	// Busy is the time the worker spent examining them. The rest of the time, it
+	// was waiting for work.
+	Busy time.Duration
+}
+
+// Entries returns the total number of entries examined.
+func (s *Stats) Entries() int64 {
+	var n int64
+	for _, c := range s.Visited {
+		n += c
+	}
+	return n
+}
+
+// PerSecond returns the number of entries examined per second.
+func (s *Stats) PerSecond() float64 {
+	if s.Elapsed <= 0 {
+		// TEST: NOT COVERED
+		return 0
+	}
+	return float64(s.Entries()) / s.Elapsed.Seconds()
+}
+
+// start resets the statistics for a traversal with the given number of
+// workers. The methods that record statistics do nothing if s is nil.
+func (s *Stats) start(workers int) {
+	if s == nil {
+		return
+	}
+	s.Elapsed = 0
+	s.Visited = map[fileinfo.FileType]int64{}
+	s.Rejected = map[filter.Group]int64{}
+	s.JunkRemoved = 0
+	s.MaxPending = 0
+	s.Workers = make([]WorkerStats, workers)
+}
+
+func (s *Stats) finish(start time.Time) {
+	if s == nil {
+		return
+	}
+	s.Elapsed = time.Since(start)
+}
+
+// node records the examination of an entry by the given worker.
+func (s *Stats) node(worker int, info *fileinfo.FileInfo, rejected filter.Group, junk bool, busy time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Workers[worker].Entries++
+	s.Workers[worker].Busy += busy
+	if info != nil {
+		s.Visited[info.FileType]++
+	}
+	if junk {
+		s.JunkRemoved++
+	} else if rejected != filter.NoGroup {
+		s.Rejected[rejected]++
+	}
+}
+
+func (s *Stats) pending(n int64) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.MaxPending = max(s.MaxPending, n)
+}
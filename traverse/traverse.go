@@ -3,20 +3,25 @@
 package traverse
 
 import (
-	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/jberkenbilt/qfs/database"
+	"github.com/jberkenbilt/qfs/digest"
 	"github.com/jberkenbilt/qfs/fileinfo"
 	"github.com/jberkenbilt/qfs/filter"
 	"github.com/jberkenbilt/qfs/localsource"
+	"github.com/jberkenbilt/qfs/misc"
 	"github.com/jberkenbilt/qfs/queue"
+	"iter"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var numWorkers = 5 * runtime.NumCPU()
@@ -32,9 +37,16 @@ type treeNode struct {
 	info     *fileinfo.FileInfo
 	children []*treeNode
 	included bool
+	// rejected is the filter group that excluded the node, if any.
+	rejected filter.Group
+	// parent and stat are only used when following symbolic links to detect
+	// links to a directory's own ancestors.
+	parent *treeNode
+	stat   os.FileInfo
 }
 
 type Traverser struct {
+	ctx        context.Context
 	fs         *localsource.LocalSource
 	root       *fileinfo.Path
 	errChan    chan error
@@ -46,31 +58,66 @@ type Traverser struct {
 	rootDev    uint64
 	filters    []*filter.Filter
 	repoRules  bool
+	cache      *filter.Cache
 	sameDev    bool
 	cleanup    bool
 	filesOnly  bool
 	noSpecial  bool
+	followDirs bool
+	birthTimes bool
+	nanosecs   bool
+	pathMap    *localsource.PathMap
+	checksum   string
+	subtrees   []string
+	stats      *Stats
 }
 
-func (tr *Traverser) getNode(node *treeNode) error {
-	path := tr.root.Join(node.path)
-	included, group := filter.IsIncluded(node.path, tr.repoRules, tr.filters...)
-	node.included = included
+// visit describes what happened to a node for Stats.
+type visit struct {
+	rejected filter.Group
+	junk     bool
+}
+
+// examine calls getNode on behalf of the given worker and records statistics.
+func (tr *Traverser) examine(worker int, node *treeNode) error {
+	start := time.Now()
+	v := visit{rejected: filter.NoGroup}
+	err := tr.getNode(node, &v)
+	tr.stats.node(worker, node.info, v.rejected, v.junk, time.Since(start))
+	return err
+}
+
+func (tr *Traverser) getNode(node *treeNode, v *visit) error {
+	nodePath := tr.root.Join(node.path)
 	var err error
-	node.info, err = path.FileInfo()
+	node.info, err = nodePath.FileInfo()
 	if err != nil {
 		// TEST: NOT COVERED. This would mean we couldn't get FileInfo for a file we
 		// encountered during directory traversal.
 		return err
 	}
+	if node.info.FileType == fileinfo.TypeLink && tr.followDirs {
+		if err = tr.followLink(node); err != nil {
+			// TEST: NOT COVERED. The link's target disappeared after it was checked.
+			return err
+		}
+	}
+	included, group := tr.cache.IsIncludedFile(node.info)
+	node.included = included
+	node.rejected = filter.NoGroup
+	if !included {
+		node.rejected = group
+		v.rejected = group
+	}
 	ft := node.info.FileType
 	isSpecial := !(ft == fileinfo.TypeFile || ft == fileinfo.TypeDirectory || ft == fileinfo.TypeLink)
 	if ft == fileinfo.TypeFile {
 		if group == filter.Junk && tr.cleanup {
 			node.included = false
 			if err = tr.root.Join(node.path).Remove(); err != nil {
-				return fmt.Errorf("remove junk %s: %w", path.Path(), err)
+				return fmt.Errorf("remove junk %s: %w", nodePath.Path(), err)
 			} else {
+				v.junk = true
 				tr.notifyChan <- fmt.Sprintf("removing %s", node.path)
 			}
 		}
@@ -88,18 +135,44 @@ func (tr *Traverser) getNode(node *treeNode) error {
 			node.included = false
 			skip = true
 		}
+		if !skip && tr.followDirs && node.stat == nil {
+			node.stat, err = os.Stat(nodePath.Path())
+			if err != nil {
+				// TEST: NOT COVERED
+				return err
+			}
+		}
 		if !skip {
 			entries, err := tr.fs.DirEntries(node.path)
 			if err != nil {
-				return fmt.Errorf("read dir %s: %w", path.Path(), err)
+				return fmt.Errorf("read dir %s: %w", nodePath.Path(), err)
 			}
 			sort.Slice(entries, func(i, j int) bool {
 				return entries[i].Name < entries[j].Name
 			})
 			for _, e := range entries {
-				node.children = append(node.children, &treeNode{
-					path: filepath.Join(node.path, e.Name),
-				})
+				if e.Name == filter.IgnoreFile {
+					// The rules must be known before any entries are checked. If the file can't be
+					// read, report it, and traverse the directory as if it weren't there rather than
+					// leaving out the whole directory.
+					err = tr.cache.ReadIgnoreFile(nodePath.Join(e.Name), node.path)
+					if err != nil {
+						tr.errChan <- err
+					}
+				}
+			}
+			for _, e := range entries {
+				childPath := path.Join(node.path, e.Name)
+				if !misc.InSubtrees(childPath, tr.subtrees) {
+					continue
+				}
+				child := &treeNode{
+					path: childPath,
+				}
+				if tr.followDirs {
+					child.parent = node
+				}
+				node.children = append(node.children, child)
 			}
 		}
 	}
@@ -110,16 +183,54 @@ func (tr *Traverser) getNode(node *treeNode) error {
 		// Special are excluded above, and links are included with filesOnly.
 		node.included = false
 	}
+	if ft == fileinfo.TypeFile && node.included && tr.checksum != "" {
+		node.info.Checksum, err = digest.File(tr.checksum, nodePath.Path())
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (tr *Traverser) worker() {
+// followLink replaces the information about a symbolic link with information
+// about its target if the target is a directory, so the directory is traversed
+// as if it were at the link's path. Links to anything else are left alone. A
+// link to one of its own ancestors is reported and not followed since it would
+// be traversed forever. Directories are identified by device and inode.
+func (tr *Traverser) followLink(node *treeNode) error {
+	st, err := os.Stat(tr.root.Join(node.path).Path())
+	if err != nil || !st.IsDir() {
+		// The link is dangling or doesn't point to a directory.
+		return nil
+	}
+	for a := node.parent; a != nil; a = a.parent {
+		if a.stat != nil && os.SameFile(st, a.stat) {
+			tr.notifyChan <- fmt.Sprintf("not following symbolic link %s: it points to %s", node.path, a.path)
+			return nil
+		}
+	}
+	info, err := tr.fs.TargetInfo(node.path)
+	if err != nil {
+		// TEST: NOT COVERED
+		return err
+	}
+	node.info = info
+	node.stat = st
+	return nil
+}
+
+func (tr *Traverser) worker(id int) {
 	for node := range tr.workChan {
-		if err := tr.getNode(node); err != nil {
-			tr.errChan <- err
+		// Once the context is canceled, drain the remaining work without visiting it.
+		if tr.ctx.Err() == nil {
+			if err := tr.examine(id, node); err != nil {
+				tr.errChan <- err
+			}
 		}
 		tr.q.Push(node.children...)
-		if tr.pending.Add(int64(len(node.children))-1) == 0 {
+		pending := tr.pending.Add(int64(len(node.children)) - 1)
+		tr.stats.pending(pending)
+		if pending == 0 {
 			select {
 			case tr.zero <- struct{}{}:
 			default:
@@ -156,7 +267,7 @@ func (tr *Traverser) traverse(node *treeNode) {
 
 func New(root string, options ...Options) (*Traverser, error) {
 	tr := &Traverser{
-		fs:         localsource.New(root),
+		ctx:        context.Background(),
 		errChan:    make(chan error, numWorkers),
 		notifyChan: make(chan string, numWorkers),
 		workChan:   make(chan *treeNode, numWorkers),
@@ -166,6 +277,13 @@ func New(root string, options ...Options) (*Traverser, error) {
 	for _, fn := range options {
 		fn(tr)
 	}
+	tr.cache = filter.NewCache(tr.repoRules, tr.filters...)
+	tr.fs = localsource.New(
+		root,
+		localsource.WithBirthTimes(tr.birthTimes),
+		localsource.WithNanoseconds(tr.nanosecs),
+		localsource.WithPathMap(tr.pathMap),
+	)
 	tr.root = fileinfo.NewPath(tr.fs, ".")
 	fi, err := tr.root.FileInfo()
 	if err != nil {
@@ -205,23 +323,82 @@ func WithNoSpecial(noSpecial bool) func(*Traverser) {
 	}
 }
 
+// WithFollowDirLinks causes symbolic links to directories to be followed. The
+// directory's contents appear at the link's path, and the link itself appears as
+// a directory. Links that would cause a loop are not followed.
+func WithFollowDirLinks(followDirs bool) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.followDirs = followDirs
+	}
+}
+
+// WithBirthTimes causes files' creation times to be captured. See
+// localsource.WithBirthTimes.
+func WithBirthTimes(birthTimes bool) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.birthTimes = birthTimes
+	}
+}
+
+// WithNanoseconds causes modification times to be captured with nanosecond
+// precision. See localsource.WithNanoseconds.
+func WithNanoseconds(nanoseconds bool) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.nanosecs = nanoseconds
+	}
+}
+
+// WithPathMap causes the tree to be traversed as if the files were at the
+// paths from which pathMap rewrites them. See localsource.WithPathMap.
+func WithPathMap(pathMap *localsource.PathMap) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.pathMap = pathMap
+	}
+}
+
+// WithChecksum causes the contents of each included regular file to be read
+// and its checksum, computed with the given algorithm, to be saved in its
+// FileInfo. See the digest package for the available algorithms.
+func WithChecksum(algorithm string) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.checksum = algorithm
+	}
+}
+
+// WithSubtrees restricts traversal to the given paths, which are relative to the
+// root. The directories above them are included, but nothing else is visited.
+func WithSubtrees(paths []string) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.subtrees = paths
+	}
+}
+
+// WithStats causes measurements of the traversal to be stored in stats, which
+// is reset when the traversal starts.
+func WithStats(stats *Stats) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.stats = stats
+	}
+}
+
+// WithContext sets a context that stops the traversal when canceled, in which
+// case Traverse or Stream returns the context's error.
+func WithContext(ctx context.Context) func(*Traverser) {
+	return func(tr *Traverser) {
+		tr.ctx = ctx
+	}
+}
+
 func WithRepoRules(repoRules bool) func(traverser *Traverser) {
 	return func(tr *Traverser) {
 		tr.repoRules = repoRules
 	}
 }
 
-// Traverse traverses a file system starting from to given path and returns a
-// FileInfo, which represents a tree of the file system. Call the Flatten method
-// on the resulting FileInfo to walk through all the items included by the
-// filters. Note that a specific FileInfo has an Included field indicating
-// whether the item is included. Pruned directories' children are not included,
-// but regular excluded directories are present in case they have included
-// children.
-func (tr *Traverser) Traverse(
-	notifyFn func(string),
-	errFn func(error),
-) (*Result, error) {
+// handleMessages starts goroutines that pass errors and notifications to the
+// given functions, supplying defaults for nil functions. The returned function
+// must be called after all traversal is finished.
+func (tr *Traverser) handleMessages(notifyFn func(string), errFn func(error)) func() {
 	progName := filepath.Base(os.Args[0])
 	if notifyFn == nil {
 		notifyFn = func(msg string) {
@@ -233,15 +410,6 @@ func (tr *Traverser) Traverse(
 			_, _ = fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
 		}
 	}
-	numWorkers := 5 * runtime.NumCPU()
-	var workerWait sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		workerWait.Add(1)
-		go func() {
-			defer workerWait.Done()
-			tr.worker()
-		}()
-	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -257,42 +425,235 @@ func (tr *Traverser) Traverse(
 			notifyFn(msg)
 		}
 	}()
+	return func() {
+		close(tr.errChan)
+		close(tr.notifyChan)
+		wg.Wait()
+	}
+}
 
+// Traverse traverses a file system starting from to given path and returns a
+// FileInfo, which represents a tree of the file system. Call the Flatten method
+// on the resulting FileInfo to walk through all the items included by the
+// filters. Note that a specific FileInfo has an Included field indicating
+// whether the item is included. Pruned directories' children are not included,
+// but regular excluded directories are present in case they have included
+// children.
+func (tr *Traverser) Traverse(
+	notifyFn func(string),
+	errFn func(error),
+) (*Result, error) {
+	numWorkers := 5 * runtime.NumCPU()
+	tr.stats.start(numWorkers)
+	defer tr.stats.finish(time.Now())
+	var workerWait sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workerWait.Add(1)
+		go func() {
+			defer workerWait.Done()
+			tr.worker(i)
+		}()
+	}
+	wait := tr.handleMessages(notifyFn, errFn)
 	tree := &treeNode{
 		path: ".",
 	}
 	tr.traverse(tree)
 	close(tr.workChan)
 	workerWait.Wait()
-	close(tr.errChan)
-	close(tr.notifyChan)
-	wg.Wait()
+	wait()
+	if err := tr.ctx.Err(); err != nil {
+		return nil, err
+	}
 	return &Result{
 		tree: tree,
 	}, nil
 }
 
-// Database traverses the traversal result and calls the function for each item
-// in lexical order. If the function returns an error, traversal is stopped, and
-// the error is returned.
+// Database returns a database containing every included item of the result.
+// If a directory is excluded but some of its descendants are included, the
+// directory itself won't appear.
 func (r *Result) Database() database.Database {
 	db := database.Database{}
-	q := list.New()
-	q.PushFront(r.tree)
-	for q.Len() > 0 {
-		front := q.Front()
-		q.Remove(front)
-		cur := front.Value.(*treeNode)
-		// If a directory is excluded but some of its descendants are included, the
-		// directory itself won't appear. This could be changed if desired, but it would
-		// involve an extra tree traversal.
-		if cur.included {
-			db[cur.info.Path] = cur.info
+	_ = r.Walk(func(info *fileinfo.FileInfo) error {
+		db[info.Path] = info
+		return nil
+	})
+	return db
+}
+
+// Walk calls fn for each included item of the result in lexical order by path,
+// which is the order in which Stream reports them. This makes it possible to
+// process a result without building a database from it. If fn returns an
+// error, the walk stops, and the error is returned.
+func (r *Result) Walk(fn func(*fileinfo.FileInfo) error) error {
+	return walkDir(r.tree, true, fn)
+}
+
+// walkDir is Walk for node's children and their descendants. If self is true,
+// node itself is included.
+func walkDir(node *treeNode, self bool, fn func(*fileinfo.FileInfo) error) error {
+	for _, i := range orderedItems(node, self) {
+		if i.subtree {
+			if err := walkDir(i.node, false, fn); err != nil {
+				return err
+			}
+		} else if i.node.included && i.node.info != nil {
+			if err := fn(i.node.info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WalkExcluded calls fn for each item of the result that a filter excluded,
+// along with the group of the rule that excluded it, in lexical order by path.
+// This includes junk files, whether or not they were removed, and pruned
+// directories, whose contents are never visited. If fn returns an error, the
+// walk stops, and the error is returned.
+func (r *Result) WalkExcluded(fn func(*fileinfo.FileInfo, filter.Group) error) error {
+	return walkExcluded(r.tree, true, fn)
+}
+
+// walkExcluded is WalkExcluded for node's children and their descendants. If
+// self is true, node itself is included.
+func walkExcluded(node *treeNode, self bool, fn func(*fileinfo.FileInfo, filter.Group) error) error {
+	for _, i := range orderedItems(node, self) {
+		if i.subtree {
+			if err := walkExcluded(i.node, false, fn); err != nil {
+				return err
+			}
+		} else if !i.node.included && i.node.info != nil && i.node.rejected != filter.NoGroup {
+			if err := fn(i.node.info, i.node.rejected); err != nil {
+				return err
+			}
 		}
-		n := len(cur.children)
-		for i := range cur.children {
-			q.PushFront(cur.children[n-i-1])
+	}
+	return nil
+}
+
+// Stream traverses the file system like Traverse but calls fn for each included
+// item in lexical order by path as soon as it is known instead of building a
+// tree of the whole file system. Only the entries of the directories between
+// the root and the current directory are held in memory, so memory use is
+// proportional to the depth of the tree rather than the number of files.
+// Directories are still read concurrently, one directory's entries at a time.
+// If fn returns an error, traversal stops, and the error is returned.
+func (tr *Traverser) Stream(
+	fn func(*fileinfo.FileInfo) error,
+	notifyFn func(string),
+	errFn func(error),
+) error {
+	wait := tr.handleMessages(notifyFn, errFn)
+	defer wait()
+	tr.stats.start(numWorkers)
+	defer tr.stats.finish(time.Now())
+	root := &treeNode{
+		path: ".",
+	}
+	tr.getNodes([]*treeNode{root})
+	return tr.streamDir(root, true, fn)
+}
+
+// All returns an iterator over the items Stream would report, for use with
+// range. Breaking out of the loop stops the traversal. If the traversal fails,
+// the last iteration yields the error with a nil FileInfo.
+func (tr *Traverser) All(notifyFn func(string), errFn func(error)) iter.Seq2[*fileinfo.FileInfo, error] {
+	return func(yield func(*fileinfo.FileInfo, error) bool) {
+		errStop := errors.New("stop")
+		err := tr.Stream(
+			func(info *fileinfo.FileInfo) error {
+				if !yield(info, nil) {
+					return errStop
+				}
+				return nil
+			},
+			notifyFn,
+			errFn,
+		)
+		if err != nil && !errors.Is(err, errStop) {
+			yield(nil, err)
 		}
 	}
-	return db
+}
+
+// getNodes calls getNode on each node concurrently. At most numWorkers nodes
+// are examined at once, and each goroutine takes the number of a free worker
+// for Stats.
+func (tr *Traverser) getNodes(nodes []*treeNode) {
+	tr.stats.pending(int64(len(nodes)))
+	var wg sync.WaitGroup
+	workers := make(chan int, numWorkers)
+	for i := range numWorkers {
+		workers <- i
+	}
+	for _, node := range nodes {
+		wg.Add(1)
+		id := <-workers
+		go func() {
+			defer wg.Done()
+			defer func() { workers <- id }()
+			if tr.ctx.Err() != nil {
+				return
+			}
+			if err := tr.examine(id, node); err != nil {
+				tr.errChan <- err
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// dirItem is an item returned by orderedItems. If subtree is true, it stands
+// for the descendants of node rather than node itself.
+type dirItem struct {
+	key     string
+	node    *treeNode
+	subtree bool
+}
+
+// orderedItems returns node's children, and node itself if self is true, in
+// lexical order by path. The children are sorted by path, but a directory's
+// descendants, which all share the prefix "dir/", have to be interleaved with
+// its siblings at the position of that prefix rather than immediately
+// following the directory. For example, "a.txt" sorts between "a" and "a/b".
+func orderedItems(node *treeNode, self bool) []dirItem {
+	var items []dirItem
+	if self {
+		items = append(items, dirItem{key: node.path, node: node})
+	}
+	for _, c := range node.children {
+		items = append(items, dirItem{key: c.path, node: c})
+		if len(c.children) > 0 {
+			items = append(items, dirItem{key: c.path + "/", node: c, subtree: true})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	return items
+}
+
+// streamDir calls fn for node's children and their descendants in lexical
+// order as given by orderedItems. If self is true, node itself is included.
+func (tr *Traverser) streamDir(node *treeNode, self bool, fn func(*fileinfo.FileInfo) error) error {
+	tr.getNodes(node.children)
+	if err := tr.ctx.Err(); err != nil {
+		return err
+	}
+	for _, i := range orderedItems(node, self) {
+		if i.subtree {
+			if err := tr.streamDir(i.node, false, fn); err != nil {
+				return err
+			}
+		} else if i.node.included && i.node.info != nil {
+			if err := fn(i.node.info); err != nil {
+				return err
+			}
+		}
+	}
+	// Let the garbage collector reclaim this part of the tree.
+	node.children = nil
+	return nil
 }
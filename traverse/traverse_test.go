@@ -1,6 +1,7 @@
 package traverse_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/jberkenbilt/qfs/fileinfo"
@@ -13,7 +14,6 @@ import (
 	"slices"
 	"sort"
 	"strings"
-	"syscall"
 	"testing"
 	"time"
 )
@@ -49,10 +49,7 @@ func TestTraverse(t *testing.T) {
 	if err != nil {
 		t.Fatalf("write file: %v", err)
 	}
-	err = syscall.Mkfifo(j("one/flute"), 0666)
-	if err != nil {
-		t.Fatalf("mkfifo: %v", err)
-	}
+	mkfifo(t, j("one/flute"))
 	socketPath := j("one/lost-sock")
 	_ = os.Remove(socketPath)
 	sock, err := net.Listen("unix", socketPath)
@@ -243,6 +240,35 @@ func TestNoRoot(t *testing.T) {
 	}
 }
 
+func TestCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr, err := traverse.New(".", traverse.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Traverse(nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error: %v", err)
+	}
+	tr, err = traverse.New(".", traverse.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = tr.Stream(
+		func(*fileinfo.FileInfo) error {
+			n++
+			return nil
+		},
+		nil,
+		nil,
+	)
+	if !errors.Is(err, context.Canceled) || n != 0 {
+		t.Errorf("wrong result: %v, %d", err, n)
+	}
+}
+
 func TestFilterInteraction(t *testing.T) {
 	f := filter.New()
 	_ = f.SetJunk("~$")
@@ -321,3 +347,365 @@ func TestFilterInteraction(t *testing.T) {
 		t.Errorf("wrong errors: %#v", allErrors)
 	}
 }
+
+func TestStream(t *testing.T) {
+	f := filter.New()
+	f.AddPath(filter.Prune, "prune")
+	f.AddPath(filter.Exclude, "a")
+	f.AddBase(filter.Include, "b")
+	tmp := t.TempDir()
+	j := func(p string) string {
+		return filepath.Join(tmp, p)
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, p := range []string{
+		"-x",
+		"a.txt",
+		"a/b",
+		"a/c.d/e",
+		"a/c/e",
+		"a/c-d",
+		"b",
+		"prune/x",
+		"z/b",
+		"z/a/b/c",
+	} {
+		check(os.MkdirAll(j(filepath.Dir(p)), 0777))
+		check(os.WriteFile(j(p), []byte(p), 0666))
+	}
+	for _, filters := range [][]*filter.Filter{nil, {f}} {
+		tr, err := traverse.New(tmp, traverse.WithFilters(filters))
+		check(err)
+		result, err := tr.Traverse(nil, nil)
+		check(err)
+		var exp []string
+		check(result.Database().ForEach(func(info *fileinfo.FileInfo) error {
+			exp = append(exp, info.Path)
+			return nil
+		}))
+		var walked []string
+		check(result.Walk(func(info *fileinfo.FileInfo) error {
+			walked = append(walked, info.Path)
+			return nil
+		}))
+		if !slices.Equal(walked, exp) {
+			t.Errorf("wrong walked paths: %#v, expected %#v", walked, exp)
+		}
+		tr, err = traverse.New(tmp, traverse.WithFilters(filters))
+		check(err)
+		var paths []string
+		check(tr.Stream(
+			func(info *fileinfo.FileInfo) error {
+				paths = append(paths, info.Path)
+				return nil
+			},
+			nil,
+			nil,
+		))
+		if !slices.Equal(paths, exp) {
+			t.Errorf("wrong paths: %#v, expected %#v", paths, exp)
+		}
+	}
+
+	// An error from the callback stops traversal.
+	tr, err := traverse.New(tmp)
+	check(err)
+	var paths []string
+	err = tr.Stream(
+		func(info *fileinfo.FileInfo) error {
+			if info.Path == "a/b" {
+				return errors.New("stop")
+			}
+			paths = append(paths, info.Path)
+			return nil
+		},
+		nil,
+		nil,
+	)
+	if err == nil || err.Error() != "stop" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if !slices.Equal(paths, []string{"-x", ".", "a", "a.txt"}) {
+		t.Errorf("wrong paths: %#v", paths)
+	}
+
+	// The same items can be ranged over, and breaking out of the loop stops
+	// traversal.
+	tr, err = traverse.New(tmp)
+	check(err)
+	paths = nil
+	for info, err := range tr.All(nil, nil) {
+		check(err)
+		if info.Path == "a/b" {
+			break
+		}
+		paths = append(paths, info.Path)
+	}
+	if !slices.Equal(paths, []string{"-x", ".", "a", "a.txt"}) {
+		t.Errorf("wrong paths from iterator: %#v", paths)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr, err = traverse.New(tmp, traverse.WithContext(ctx))
+	check(err)
+	var errs []error
+	for info, err := range tr.All(nil, nil) {
+		if info != nil {
+			t.Errorf("unexpected item: %s", info.Path)
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("wrong errors: %v", errs)
+	}
+}
+
+func TestSubtrees(t *testing.T) {
+	tmp := t.TempDir()
+	for _, p := range []string{"a/b/c", "a/bc", "a/d", "e/f", "g"} {
+		if err := os.MkdirAll(filepath.Join(tmp, filepath.Dir(p)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, p), []byte(p), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr, err := traverse.New(tmp, traverse.WithSubtrees([]string{"a/b", "e"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := tr.Traverse(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := misc.SortedKeys(result.Database())
+	exp := []string{".", "a", "a/b", "a/b/c", "e", "e/f"}
+	if !slices.Equal(keys, exp) {
+		t.Errorf("wrong entries: %#v", keys)
+	}
+}
+
+func TestFollowDirLinks(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(path string) string { return filepath.Join(tmp, path) }
+	for _, p := range []string{"top/a/file", "outside/x"} {
+		if err := os.MkdirAll(filepath.Dir(j(p)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(j(p), []byte(p), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"top/ext":       "../outside",
+		"top/a/loop":    "..",
+		"top/self":      ".",
+		"top/file-link": "a/file",
+		"top/dangling":  "nowhere",
+	} {
+		if err := os.Symlink(target, j(link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := map[string]fileinfo.FileType{
+		".":         fileinfo.TypeDirectory,
+		"a":         fileinfo.TypeDirectory,
+		"a/file":    fileinfo.TypeFile,
+		"a/loop":    fileinfo.TypeLink,
+		"dangling":  fileinfo.TypeLink,
+		"ext":       fileinfo.TypeDirectory,
+		"ext/x":     fileinfo.TypeFile,
+		"file-link": fileinfo.TypeLink,
+		"self":      fileinfo.TypeLink,
+	}
+	expMessages := []string{
+		"not following symbolic link a/loop: it points to .",
+		"not following symbolic link self: it points to .",
+	}
+	check := func(what string, files map[string]*fileinfo.FileInfo, messages []string) {
+		t.Helper()
+		if len(files) != len(exp) {
+			t.Errorf("%s: wrong entries: %v", what, misc.SortedKeys(files))
+		}
+		for p, ft := range exp {
+			if files[p] == nil || files[p].FileType != ft {
+				t.Errorf("%s: wrong information for %s: %#v", what, p, files[p])
+			}
+		}
+		sort.Strings(messages)
+		if !slices.Equal(messages, expMessages) {
+			t.Errorf("%s: wrong messages: %#v", what, messages)
+		}
+	}
+
+	tr, err := traverse.New(j("top"), traverse.WithFollowDirLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	result, err := tr.Traverse(func(msg string) { messages = append(messages, msg) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("traverse", result.Database(), messages)
+
+	tr, err = traverse.New(j("top"), traverse.WithFollowDirLinks(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = nil
+	files := map[string]*fileinfo.FileInfo{}
+	err = tr.Stream(
+		func(f *fileinfo.FileInfo) error {
+			files[f.Path] = f
+			return nil
+		},
+		func(msg string) { messages = append(messages, msg) },
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("stream", files, messages)
+}
+
+func TestStats(t *testing.T) {
+	f := filter.New()
+	_ = f.SetJunk("~$")
+	f.AddPath(filter.Prune, "prune")
+	f.AddPath(filter.Exclude, "one")
+	tmp := t.TempDir()
+	j := func(p string) string {
+		return filepath.Join(tmp, p)
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	check(os.MkdirAll(j("prune/a"), 0777))
+	check(os.MkdirAll(j("one"), 0777))
+	check(os.MkdirAll(j("two"), 0777))
+	check(os.WriteFile(j("one/x"), []byte("x"), 0666))
+	check(os.WriteFile(j("two/y"), []byte("y"), 0666))
+	check(os.WriteFile(j("two/z~"), []byte("z"), 0666))
+	check(os.Symlink("y", j("two/w")))
+	for _, stream := range []bool{false, true} {
+		check(os.WriteFile(j("two/z~"), []byte("z"), 0666))
+		var stats traverse.Stats
+		tr, err := traverse.New(
+			tmp,
+			traverse.WithFilters([]*filter.Filter{f}),
+			traverse.WithCleanup(true),
+			traverse.WithStats(&stats),
+		)
+		check(err)
+		if stream {
+			check(tr.Stream(func(*fileinfo.FileInfo) error { return nil }, nil, nil))
+		} else {
+			_, err = tr.Traverse(nil, nil)
+			check(err)
+		}
+		// ., prune, one, one/x, two, two/w, two/y, two/z~
+		if stats.Entries() != 8 {
+			t.Errorf("stream=%v: wrong entries: %d", stream, stats.Entries())
+		}
+		if stats.Visited[fileinfo.TypeDirectory] != 4 ||
+			stats.Visited[fileinfo.TypeFile] != 3 ||
+			stats.Visited[fileinfo.TypeLink] != 1 {
+			t.Errorf("stream=%v: wrong visited: %#v", stream, stats.Visited)
+		}
+		// one/x is not included because one is excluded, but it is still visited.
+		if stats.Rejected[filter.Prune] != 1 || stats.Rejected[filter.Exclude] != 2 {
+			t.Errorf("stream=%v: wrong rejected: %#v", stream, stats.Rejected)
+		}
+		if stats.JunkRemoved != 1 {
+			t.Errorf("stream=%v: wrong junk removed: %d", stream, stats.JunkRemoved)
+		}
+		var entries int64
+		for _, w := range stats.Workers {
+			entries += w.Entries
+		}
+		if entries != 8 {
+			t.Errorf("stream=%v: wrong worker entries: %d", stream, entries)
+		}
+		if stats.Elapsed <= 0 || stats.MaxPending < 1 || stats.PerSecond() <= 0 {
+			t.Errorf("stream=%v: wrong stats: %#v", stream, &stats)
+		}
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	tmp := t.TempDir()
+	j := func(p string) string {
+		return filepath.Join(tmp, p)
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, p := range []string{
+		"a/node_modules/x",
+		"a/src/x.o",
+		"a/src/x.c",
+		"a/target/y",
+		"b/node_modules/x",
+		"b/x.o",
+	} {
+		check(os.MkdirAll(j(filepath.Dir(p)), 0777))
+		check(os.WriteFile(j(p), []byte(p), 0666))
+	}
+	check(os.WriteFile(j("a/.qfsignore"), []byte("node_modules\ntarget\n*.o\n"), 0666))
+	check(os.MkdirAll(j("c/.qfsignore"), 0777))
+	exp := []string{
+		".",
+		"a",
+		"a/.qfsignore",
+		"a/src",
+		"a/src/x.c",
+		"b",
+		"b/node_modules",
+		"b/node_modules/x",
+		"b/x.o",
+		"c",
+		"c/.qfsignore",
+	}
+	for _, stream := range []bool{false, true} {
+		tr, err := traverse.New(tmp)
+		check(err)
+		var paths []string
+		var allErrors []string
+		errFn := func(e error) {
+			allErrors = append(allErrors, e.Error())
+		}
+		if stream {
+			check(tr.Stream(
+				func(info *fileinfo.FileInfo) error {
+					paths = append(paths, info.Path)
+					return nil
+				},
+				nil,
+				errFn,
+			))
+		} else {
+			result, err := tr.Traverse(nil, errFn)
+			check(err)
+			paths = misc.SortedKeys(result.Database())
+		}
+		if !slices.Equal(paths, exp) {
+			t.Errorf("stream=%v: wrong paths: %#v", stream, paths)
+		}
+		// An ignore file that can't be read is reported.
+		if len(allErrors) != 1 || !strings.Contains(allErrors[0], j("c/.qfsignore")) {
+			t.Errorf("stream=%v: wrong errors: %#v", stream, allErrors)
+		}
+	}
+}